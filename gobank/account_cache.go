@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// With ACCOUNT_CACHE_TTL set the storage backend is wrapped in
+// CachedStorage, which answers GetAccountbyID and GetAccountByNumber from a
+// read-through cache. ACCOUNT_CACHE=memory keeps an LRU of
+// ACCOUNT_CACHE_SIZE accounts per instance, redis shares one through
+// REDIS_URL so every instance sees the others' invalidations. Every write
+// to an account row drops the account, writes inside a transaction drop it
+// again once it commits. A lookup that started before an invalidation isn't
+// cached, so a read racing a write can't put the old row back.
+//
+// Reads carrying a consistency token skip the cache. The corebanking
+// backend keeps its own cache and isn't wrapped.
+
+type AccountCache interface {
+	Get(ctx context.Context, id int) (*Account, bool)
+	GetByNumber(ctx context.Context, number int64) (*Account, bool)
+	// Put caches acc unless it was invalidated after readAt
+	Put(ctx context.Context, acc *Account, readAt time.Time)
+	Invalidate(ctx context.Context, ids ...int)
+	Flush(ctx context.Context)
+}
+
+func NewAccountCache(cfg *Config) (AccountCache, error) {
+	switch cfg.AccountCache {
+	case "memory":
+		return newMemoryAccountCache(cfg.AccountCacheTTL, cfg.AccountCacheSize), nil
+	case "redis":
+		if cfg.RedisURL == "" {
+			return nil, fmt.Errorf("ACCOUNT_CACHE=redis needs REDIS_URL")
+		}
+		opts, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REDIS_URL: %v", err)
+		}
+		return &redisAccountCache{client: redis.NewClient(opts), ttl: cfg.AccountCacheTTL}, nil
+	}
+	return nil, fmt.Errorf("unknown ACCOUNT_CACHE %q, use memory or redis", cfg.AccountCache)
+}
+
+// Lookups never take this long, older invalidations can't race one
+const accountInvalidationHorizon = time.Minute
+
+type memoryAccountCache struct {
+	mu          sync.Mutex
+	ttl         time.Duration
+	size        int
+	order       *list.List // of *cachedAccount, most recently used first
+	byID        map[int]*list.Element
+	byNumber    map[int64]int
+	invalidated map[int]time.Time
+	flushedAt   time.Time
+}
+
+func newMemoryAccountCache(ttl time.Duration, size int) *memoryAccountCache {
+	return &memoryAccountCache{
+		ttl:         ttl,
+		size:        max(size, 1),
+		order:       list.New(),
+		byID:        map[int]*list.Element{},
+		byNumber:    map[int64]int{},
+		invalidated: map[int]time.Time{},
+	}
+}
+
+func (c *memoryAccountCache) Get(ctx context.Context, id int) (*Account, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.get(id)
+}
+
+func (c *memoryAccountCache) get(id int) (*Account, bool) {
+	elem, ok := c.byID[id]
+	if !ok {
+		return nil, false
+	}
+	cached := elem.Value.(*cachedAccount)
+	if time.Now().After(cached.expiresAt) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	acc := cached.account
+	return &acc, true
+}
+
+func (c *memoryAccountCache) GetByNumber(ctx context.Context, number int64) (*Account, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id, ok := c.byNumber[number]
+	if !ok {
+		return nil, false
+	}
+	return c.get(id)
+}
+
+func (c *memoryAccountCache) Put(ctx context.Context, acc *Account, readAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if readAt.Before(c.flushedAt) || readAt.Before(c.invalidated[acc.ID]) {
+		return
+	}
+	if elem, ok := c.byID[acc.ID]; ok {
+		c.remove(elem)
+	}
+	c.byID[acc.ID] = c.order.PushFront(&cachedAccount{account: *acc, expiresAt: time.Now().Add(c.ttl)})
+	c.byNumber[acc.Number] = acc.ID
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *memoryAccountCache) remove(elem *list.Element) {
+	cached := c.order.Remove(elem).(*cachedAccount)
+	delete(c.byID, cached.account.ID)
+	delete(c.byNumber, cached.account.Number)
+}
+
+func (c *memoryAccountCache) Invalidate(ctx context.Context, ids ...int) {
+	if len(ids) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for id, at := range c.invalidated {
+		if now.Sub(at) > accountInvalidationHorizon {
+			delete(c.invalidated, id)
+		}
+	}
+	for _, id := range ids {
+		c.invalidated[id] = now
+		if elem, ok := c.byID[id]; ok {
+			c.remove(elem)
+		}
+	}
+}
+
+func (c *memoryAccountCache) Flush(ctx context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	c.byID, c.byNumber, c.invalidated = map[int]*list.Element{}, map[int64]int{}, map[int]time.Time{}
+	c.flushedAt = time.Now()
+}
+
+// redisAccountCache stores gob encoded accounts, gob keeps the fields JSON hides.
+// Failures are logged and count as misses.
+type redisAccountCache struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+type redisCachedAccount struct {
+	Account Account
+	ReadAt  time.Time
+}
+
+const (
+	redisAccountKey        = "gobank:account:"
+	redisAccountNumberKey  = "gobank:account-number:"
+	redisAccountStaleKey   = "gobank:account-invalidated:"
+	redisAccountFlushedKey = "gobank:account-flushed"
+)
+
+func (c *redisAccountCache) Get(ctx context.Context, id int) (*Account, bool) {
+	values, err := c.client.MGet(ctx, redisAccountKey+strconv.Itoa(id), redisAccountFlushedKey).Result()
+	if err != nil {
+		log.Printf("Account cache read failed: %v", err)
+		return nil, false
+	}
+	raw, ok := values[0].(string)
+	if !ok {
+		return nil, false
+	}
+
+	var cached redisCachedAccount
+	if err := gob.NewDecoder(bytes.NewBufferString(raw)).Decode(&cached); err != nil {
+		log.Printf("Account cache entry %d is unreadable: %v", id, err)
+		return nil, false
+	}
+	if flushed, ok := values[1].(string); ok {
+		if nanos, _ := strconv.ParseInt(flushed, 10, 64); cached.ReadAt.UnixNano() < nanos {
+			return nil, false
+		}
+	}
+	return &cached.Account, true
+}
+
+func (c *redisAccountCache) GetByNumber(ctx context.Context, number int64) (*Account, bool) {
+	id, err := c.client.Get(ctx, redisAccountNumberKey+strconv.FormatInt(number, 10)).Int()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Printf("Account cache read failed: %v", err)
+		}
+		return nil, false
+	}
+	return c.Get(ctx, id)
+}
+
+func (c *redisAccountCache) Put(ctx context.Context, acc *Account, readAt time.Time) {
+	markers, err := c.client.MGet(ctx, redisAccountStaleKey+strconv.Itoa(acc.ID), redisAccountFlushedKey).Result()
+	if err != nil {
+		log.Printf("Account cache write failed: %v", err)
+		return
+	}
+	for _, marker := range markers {
+		if at, ok := marker.(string); ok {
+			if nanos, _ := strconv.ParseInt(at, 10, 64); readAt.UnixNano() < nanos {
+				return
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(redisCachedAccount{Account: *acc, ReadAt: readAt}); err != nil {
+		log.Printf("Account cache write failed: %v", err)
+		return
+	}
+	pipe := c.client.Pipeline()
+	pipe.Set(ctx, redisAccountKey+strconv.Itoa(acc.ID), buf.Bytes(), c.ttl)
+	pipe.Set(ctx, redisAccountNumberKey+strconv.FormatInt(acc.Number, 10), acc.ID, c.ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Account cache write failed: %v", err)
+	}
+}
+
+func (c *redisAccountCache) Invalidate(ctx context.Context, ids ...int) {
+	if len(ids) == 0 {
+		return
+	}
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	pipe := c.client.Pipeline()
+	for _, id := range ids {
+		pipe.Set(ctx, redisAccountStaleKey+strconv.Itoa(id), now, accountInvalidationHorizon)
+		pipe.Del(ctx, redisAccountKey+strconv.Itoa(id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Account cache invalidation failed: %v", err)
+	}
+}
+
+// Flush outdates every entry at once, they expire on their own
+func (c *redisAccountCache) Flush(ctx context.Context) {
+	if err := c.client.Set(ctx, redisAccountFlushedKey, time.Now().UnixNano(), c.ttl).Err(); err != nil {
+		log.Printf("Account cache flush failed: %v", err)
+	}
+}
+
+// CachedStorage is a Storage with account lookups served from an AccountCache
+type CachedStorage struct {
+	Storage
+
+	cache AccountCache
+
+	// Set on copies serving reads that must observe the client's own writes
+	freshReads bool
+}
+
+func NewCachedStorage(store Storage, cache AccountCache) *CachedStorage {
+	return &CachedStorage{Storage: store, cache: cache}
+}
+
+// Unwrap gives storageAs the wrapped backend
+func (s *CachedStorage) Unwrap() Storage {
+	return s.Storage
+}
+
+// storageAs finds the optional interface T on store or a backend it wraps
+func storageAs[T any](store Storage) (T, bool) {
+	for {
+		if t, ok := store.(T); ok {
+			return t, true
+		}
+		wrapper, ok := store.(interface{ Unwrap() Storage })
+		if !ok {
+			var zero T
+			return zero, false
+		}
+		store = wrapper.Unwrap()
+	}
+}
+
+func (s *CachedStorage) WithRequestID(id string) Storage {
+	scoped := *s
+	if scopable, ok := s.Storage.(requestScopedStorage); ok {
+		scoped.Storage = scopable.WithRequestID(id)
+	}
+	return &scoped
+}
+
+func (s *CachedStorage) WithFreshReads() Storage {
+	scoped := *s
+	scoped.freshReads = true
+	if fresh, ok := s.Storage.(freshReadStorage); ok {
+		scoped.Storage = fresh.WithFreshReads()
+	}
+	return &scoped
+}
+
+func (s *CachedStorage) GetAccountbyID(ctx context.Context, id int) (*Account, error) {
+	if !s.freshReads {
+		if acc, ok := s.cache.Get(ctx, id); ok {
+			return acc, nil
+		}
+	}
+	readAt := time.Now()
+	acc, err := s.Storage.GetAccountbyID(ctx, id)
+	if err == nil {
+		s.cache.Put(ctx, acc, readAt)
+	}
+	return acc, err
+}
+
+func (s *CachedStorage) GetAccountByNumber(ctx context.Context, number int64) (*Account, error) {
+	if !s.freshReads {
+		if acc, ok := s.cache.GetByNumber(ctx, number); ok {
+			return acc, nil
+		}
+	}
+	readAt := time.Now()
+	acc, err := s.Storage.GetAccountByNumber(ctx, number)
+	if err == nil {
+		s.cache.Put(ctx, acc, readAt)
+	}
+	return acc, err
+}
+
+// cachedTx remembers the accounts written in a transaction to drop them again on commit
+type cachedTx struct {
+	Transaction
+
+	cache AccountCache
+	ctx   context.Context
+	mu    sync.Mutex
+	ids   []int
+}
+
+func (tx *cachedTx) Commit() error {
+	err := tx.Transaction.Commit()
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.cache.Invalidate(tx.ctx, tx.ids...)
+	return err
+}
+
+func (s *CachedStorage) BeginTransaction(ctx context.Context) (Transaction, error) {
+	tx, err := s.Storage.BeginTransaction(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedTx{Transaction: tx, cache: s.cache, ctx: context.WithoutCancel(ctx)}, nil
+}
+
+// inTx notes the accounts a transaction writes, they're dropped again once
+// it commits. It returns the transaction the wrapped backend began.
+func inTx(tx Transaction, ids ...int) Transaction {
+	wrapped, ok := tx.(*cachedTx)
+	if !ok {
+		return tx
+	}
+	wrapped.mu.Lock()
+	defer wrapped.mu.Unlock()
+	wrapped.ids = append(wrapped.ids, ids...)
+	return wrapped.Transaction
+}
+
+func (s *CachedStorage) PostLedgerEntry(ctx context.Context, entry *LedgerEntry, tx Transaction) error {
+	ids := []int{}
+	for _, p := range entry.Postings {
+		if p.AccountID != 0 {
+			ids = append(ids, p.AccountID)
+		}
+	}
+	defer s.cache.Invalidate(ctx, ids...)
+	return s.Storage.PostLedgerEntry(ctx, entry, inTx(tx, ids...))
+}
+
+func (s *CachedStorage) MergeAccounts(ctx context.Context, merge *AccountMerge, tx Transaction) error {
+	ids := []int{merge.MergedAccountID, merge.SurvivorAccountID}
+	defer s.cache.Invalidate(ctx, ids...)
+	return s.Storage.MergeAccounts(ctx, merge, inTx(tx, ids...))
+}
+
+// The other methods taking a transaction don't write accounts, they only
+// need the wrapped backend's own transaction
+
+func (s *CachedStorage) RecordTransfer(ctx context.Context, fromAccountID, toAccountID int, conv Conversion, tx Transaction) error {
+	return s.Storage.RecordTransfer(ctx, fromAccountID, toAccountID, conv, inTx(tx))
+}
+
+func (s *CachedStorage) RecordAudit(ctx context.Context, entry *AuditEntry, tx Transaction) error {
+	return s.Storage.RecordAudit(ctx, entry, inTx(tx))
+}
+
+func (s *CachedStorage) RecordOverdraftFee(ctx context.Context, fee *OverdraftFee, tx Transaction) (bool, error) {
+	return s.Storage.RecordOverdraftFee(ctx, fee, inTx(tx))
+}
+
+func (s *CachedStorage) RecordFeeCharge(ctx context.Context, charge *FeeCharge, tx Transaction) (bool, error) {
+	return s.Storage.RecordFeeCharge(ctx, charge, inTx(tx))
+}
+
+func (s *CachedStorage) RecordCashback(ctx context.Context, c *Cashback, tx Transaction) error {
+	return s.Storage.RecordCashback(ctx, c, inTx(tx))
+}
+
+func (s *CachedStorage) UpdateAccount(ctx context.Context, acc *Account) error {
+	defer s.cache.Invalidate(ctx, acc.ID)
+	return s.Storage.UpdateAccount(ctx, acc)
+}
+
+func (s *CachedStorage) EraseAccount(ctx context.Context, accountID int, at time.Time) error {
+	defer s.cache.Invalidate(ctx, accountID)
+	return s.Storage.EraseAccount(ctx, accountID, at)
+}
+
+func (s *CachedStorage) SetAccountStatus(ctx context.Context, id int, from, to string) error {
+	defer s.cache.Invalidate(ctx, id)
+	return s.Storage.SetAccountStatus(ctx, id, from, to)
+}
+
+func (s *CachedStorage) CloseAccount(ctx context.Context, id int, closedAt time.Time) error {
+	defer s.cache.Invalidate(ctx, id)
+	return s.Storage.CloseAccount(ctx, id, closedAt)
+}
+
+func (s *CachedStorage) RehashPassword(ctx context.Context, id int, oldHash, newHash string) error {
+	defer s.cache.Invalidate(ctx, id)
+	return s.Storage.RehashPassword(ctx, id, oldHash, newHash)
+}
+
+// A reset doesn't name its account, the whole cache goes
+func (s *CachedStorage) ResetPassword(ctx context.Context, resetID int, encryptedPassword string, usedAt time.Time) error {
+	defer s.cache.Flush(ctx)
+	return s.Storage.ResetPassword(ctx, resetID, encryptedPassword, usedAt)
+}
+
+func (s *CachedStorage) VerifyEmail(ctx context.Context, tokenHash string, now time.Time) (int, error) {
+	id, err := s.Storage.VerifyEmail(ctx, tokenHash, now)
+	if err == nil {
+		s.cache.Invalidate(ctx, id)
+	}
+	return id, err
+}
+
+func (s *CachedStorage) TouchAccountActivity(ctx context.Context, id int, at time.Time) error {
+	defer s.cache.Invalidate(ctx, id)
+	return s.Storage.TouchAccountActivity(ctx, id, at)
+}
+
+func (s *CachedStorage) MarkDormancyNotified(ctx context.Context, id int, at time.Time) (bool, error) {
+	defer s.cache.Invalidate(ctx, id)
+	return s.Storage.MarkDormancyNotified(ctx, id, at)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachedStorageReadThrough(t *testing.T) {
+	ctx := context.Background()
+	backend := newMemoryStorage()
+	require.Nil(t, backend.CreateAccount(ctx, &Account{FirstName: "Ada", Number: 9801, Balance: 10000, Currency: "USD", EmailVerified: true}))
+	require.Nil(t, backend.CreateAccount(ctx, &Account{Number: 9802, Currency: "USD"}))
+	store := NewCachedStorage(backend, newMemoryAccountCache(time.Minute, 10))
+
+	acc, err := store.GetAccountbyID(ctx, 1)
+	require.Nil(t, err)
+	assert.Equal(t, "Ada", acc.FirstName)
+
+	// Served from the cache, by id and by number
+	backend.accounts[1].FirstName = "Grace"
+	acc, err = store.GetAccountbyID(ctx, 1)
+	require.Nil(t, err)
+	assert.Equal(t, "Ada", acc.FirstName)
+	acc, err = store.GetAccountByNumber(ctx, 9801)
+	require.Nil(t, err)
+	assert.Equal(t, "Ada", acc.FirstName)
+
+	// Reads that must see the latest row skip it
+	acc, err = store.WithFreshReads().GetAccountbyID(ctx, 1)
+	require.Nil(t, err)
+	assert.Equal(t, "Grace", acc.FirstName)
+
+	// Writes drop the account
+	acc.FirstName = "Hopper"
+	require.Nil(t, store.UpdateAccount(ctx, acc))
+	acc, err = store.GetAccountByNumber(ctx, 9801)
+	require.Nil(t, err)
+	assert.Equal(t, "Hopper", acc.FirstName)
+
+	// A transfer through the cached store shows the new balances once committed
+	_, err = store.GetAccountbyID(ctx, 2)
+	require.Nil(t, err)
+	transfers := NewTransferService(store, TransferLimits{}, staticRateProvider{}, nil, nil)
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	_, _, err = transfers.Transfer(ctx, TransferRequest{FromAccountNumber: 9801, ToAccountNumber: 9802, Amount: 25}, engine, "test")
+	require.Nil(t, err)
+
+	from, err := store.GetAccountbyID(ctx, 1)
+	require.Nil(t, err)
+	to, err := store.GetAccountByNumber(ctx, 9802)
+	require.Nil(t, err)
+	assert.Equal(t, int64(7500), from.Balance)
+	assert.Equal(t, int64(2500), to.Balance)
+}
+
+func TestMemoryAccountCache(t *testing.T) {
+	ctx := context.Background()
+	cache := newMemoryAccountCache(time.Minute, 2)
+	readAt := time.Now()
+	cache.Put(ctx, &Account{ID: 1, Number: 101}, readAt)
+	cache.Put(ctx, &Account{ID: 2, Number: 102}, readAt)
+	_, ok := cache.Get(ctx, 1)
+	require.True(t, ok)
+
+	// The least recently used account is evicted
+	cache.Put(ctx, &Account{ID: 3, Number: 103}, readAt)
+	_, ok = cache.Get(ctx, 2)
+	assert.False(t, ok)
+	_, ok = cache.GetByNumber(ctx, 102)
+	assert.False(t, ok)
+	_, ok = cache.GetByNumber(ctx, 101)
+	assert.True(t, ok)
+
+	// A lookup that started before an invalidation isn't cached
+	cache.Invalidate(ctx, 4)
+	cache.Put(ctx, &Account{ID: 4, Number: 104}, readAt)
+	_, ok = cache.Get(ctx, 4)
+	assert.False(t, ok)
+	cache.Put(ctx, &Account{ID: 4, Number: 104}, time.Now())
+	_, ok = cache.Get(ctx, 4)
+	assert.True(t, ok)
+
+	cache.Flush(ctx)
+	_, ok = cache.Get(ctx, 4)
+	assert.False(t, ok)
+
+	expiring := newMemoryAccountCache(time.Millisecond, 10)
+	expiring.Put(ctx, &Account{ID: 1, Number: 101}, time.Now())
+	time.Sleep(5 * time.Millisecond)
+	_, ok = expiring.Get(ctx, 1)
+	assert.False(t, ok)
+}
+
+func TestStorageAs(t *testing.T) {
+	store := NewCachedStorage(newMemoryStorage(), newMemoryAccountCache(time.Minute, 10))
+	backend, ok := storageAs[*memoryStorage](store)
+	assert.True(t, ok)
+	assert.Same(t, store.Storage, backend)
+
+	_, ok = storageAs[dbPool](store)
+	assert.False(t, ok)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Owners can give their accounts a nickname and attach metadata, string
+// values under keys of their own, with PATCH /account/{id}. Both come back
+// in account responses. Metadata is merged: keys left out of a request are
+// kept and a null value removes one. Admins find accounts by nickname
+// through the search's q, and by metadata with ?metadata=key:value.
+
+const (
+	maxNicknameLength      = 50
+	maxMetadataKeys        = 20
+	maxMetadataKeyLength   = 40
+	maxMetadataValueLength = 500
+)
+
+var validMetadataKey = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// AccountMetadata is stored as a jsonb object
+type AccountMetadata map[string]string
+
+func (m AccountMetadata) Value() (driver.Value, error) {
+	if m == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(m)
+}
+
+func (m *AccountMetadata) Scan(src any) error {
+	var b []byte
+	switch v := src.(type) {
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	case nil:
+		*m = nil
+		return nil
+	default:
+		return fmt.Errorf("can't scan %T into account metadata", src)
+	}
+
+	var decoded AccountMetadata
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return err
+	}
+	if len(decoded) == 0 {
+		decoded = nil
+	}
+	*m = decoded
+	return nil
+}
+
+// contains reports whether every key of want has the same value in m, like jsonb's @>
+func (m AccountMetadata) contains(want AccountMetadata) bool {
+	for k, v := range want {
+		if got, ok := m[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// UpdateAccountRequest leaves the nickname unchanged when it isn't sent, an
+// empty one removes it. Metadata keys set to null are removed.
+type UpdateAccountRequest struct {
+	Nickname *string            `json:"nickname"`
+	Metadata map[string]*string `json:"metadata"`
+}
+
+func checkMetadataKey(key string) string {
+	if key == "" || utf8.RuneCountInString(key) > maxMetadataKeyLength {
+		return fmt.Sprintf("keys must be 1 to %d characters", maxMetadataKeyLength)
+	}
+	if !validMetadataKey.MatchString(key) {
+		return "keys may only contain letters, digits, underscores, hyphens and periods"
+	}
+	return ""
+}
+
+// apply returns acc with the request's changes, reporting every invalid field
+func (req UpdateAccountRequest) apply(acc *Account) (*Account, error) {
+	after := *acc
+	fields := []FieldError{}
+
+	if req.Nickname != nil {
+		after.Nickname = strings.TrimSpace(*req.Nickname)
+		if utf8.RuneCountInString(after.Nickname) > maxNicknameLength {
+			fields = append(fields, FieldError{Field: jsonPointer("nickname"), Code: "max", Message: fmt.Sprintf("must be at most %d characters", maxNicknameLength)})
+		}
+	}
+
+	if len(req.Metadata) > 0 {
+		after.Metadata = maps.Clone(acc.Metadata)
+		if after.Metadata == nil {
+			after.Metadata = AccountMetadata{}
+		}
+		for key, value := range req.Metadata {
+			if msg := checkMetadataKey(key); msg != "" {
+				fields = append(fields, FieldError{Field: jsonPointer("metadata", key), Code: "key", Message: msg})
+				continue
+			}
+			if value == nil {
+				delete(after.Metadata, key)
+				continue
+			}
+			if utf8.RuneCountInString(*value) > maxMetadataValueLength {
+				fields = append(fields, FieldError{Field: jsonPointer("metadata", key), Code: "max", Message: fmt.Sprintf("must be at most %d characters", maxMetadataValueLength)})
+				continue
+			}
+			after.Metadata[key] = *value
+		}
+		if len(after.Metadata) > maxMetadataKeys {
+			fields = append(fields, FieldError{Field: jsonPointer("metadata"), Code: "max", Message: fmt.Sprintf("must have at most %d keys", maxMetadataKeys)})
+		}
+		if len(after.Metadata) == 0 {
+			after.Metadata = nil
+		}
+	}
+
+	if len(fields) > 0 {
+		return nil, &ValidationError{Fields: fields}
+	}
+	return &after, nil
+}
+
+// metadataChanges are the audit log's changes for metadata, one per key
+func metadataChanges(before, after AccountMetadata) []FieldChange {
+	changes := []FieldChange{}
+	for key, old := range before {
+		if v, ok := after[key]; !ok {
+			changes = append(changes, FieldChange{Field: "metadata." + key, Old: old, New: nil})
+		} else if v != old {
+			changes = append(changes, FieldChange{Field: "metadata." + key, Old: old, New: v})
+		}
+	}
+	for key, v := range after {
+		if _, ok := before[key]; !ok {
+			changes = append(changes, FieldChange{Field: "metadata." + key, Old: nil, New: v})
+		}
+	}
+	return changes
+}
+
+func (s *accountService) UpdateAccount(ctx context.Context, id int, req UpdateAccountRequest, actor string) (*Account, error) {
+	before, err := s.store.GetAccountbyID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	after, err := req.apply(before)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := append(diffAccounts(before, after), metadataChanges(before.Metadata, after.Metadata)...)
+	if len(changes) == 0 {
+		return s.GetAccount(ctx, id)
+	}
+	if err := s.store.UpdateAccount(ctx, after); err != nil {
+		return nil, err
+	}
+	recordAudit(ctx, s.store, actor, id, AuditAccountUpdated, changes)
+	return s.GetAccount(ctx, id)
+}
+
+// PATCH /account/{id} sets the nickname and metadata
+func (s *APIServer) handleUpdateAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	s = s.forRequest(r)
+
+	var req UpdateAccountRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+	account, err := s.accounts().UpdateAccount(r.Context(), id, req, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+	return writeLocalized(w, r, http.StatusOK, account, account.Currency, accountAmounts(account))
+}
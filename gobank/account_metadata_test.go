@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateAccountNicknameAndMetadata(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	require.Nil(t, store.CreateAccount(ctx, &Account{FirstName: "Ada", Number: 9801, Currency: "USD", Status: AccountActive}))
+	s := NewAPIServer(&Config{}, store)
+
+	patch := func(body string) (*httptest.ResponseRecorder, *Account) {
+		r := mux.SetURLVars(httptest.NewRequest("PATCH", "/account/1", strings.NewReader(body)), map[string]string{"id": "1"})
+		w := httptest.NewRecorder()
+		makeHTTPHandle(s.handleUpdateAccount)(w, r)
+		acc := &Account{}
+		json.Unmarshal(w.Body.Bytes(), acc)
+		return w, acc
+	}
+
+	w, acc := patch(`{"nickname": "  Rainy day  ", "metadata": {"purpose": "savings", "colour": "green"}}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "Rainy day", acc.Nickname)
+	assert.Equal(t, AccountMetadata{"purpose": "savings", "colour": "green"}, acc.Metadata)
+	require.Len(t, store.audit, 1)
+	assert.Equal(t, AuditAccountUpdated, store.audit[0].Action)
+	assert.Len(t, store.audit[0].Changes, 3)
+
+	// Keys left out are kept, null removes one
+	w, acc = patch(`{"metadata": {"colour": null, "owner": "ada"}}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "Rainy day", acc.Nickname)
+	assert.Equal(t, AccountMetadata{"purpose": "savings", "owner": "ada"}, acc.Metadata)
+	require.Len(t, store.audit, 2)
+	assert.ElementsMatch(t, []FieldChange{
+		{Field: "metadata.colour", Old: "green", New: nil},
+		{Field: "metadata.owner", Old: nil, New: "ada"},
+	}, store.audit[1].Changes)
+
+	// Nothing changed, nothing audited
+	w, _ = patch(`{"nickname": "Rainy day"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, store.audit, 2)
+
+	w, acc = patch(`{"nickname": "", "metadata": {"purpose": null, "owner": null}}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, acc.Nickname)
+	assert.Nil(t, acc.Metadata)
+
+	w, _ = patch(`{"nickname": "` + strings.Repeat("n", maxNicknameLength+1) + `", "metadata": {"bad key": "x", "ok": "` + strings.Repeat("v", maxMetadataValueLength+1) + `"}}`)
+	require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	var apiErr ApiError
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &apiErr))
+	fields := map[string]string{}
+	for _, f := range apiErr.Fields {
+		fields[f.Field] = f.Code
+	}
+	assert.Equal(t, map[string]string{"/nickname": "max", "/metadata/bad key": "key", "/metadata/ok": "max"}, fields)
+}
+
+func TestAccountMetadataScan(t *testing.T) {
+	var m AccountMetadata
+	require.Nil(t, m.Scan([]byte(`{"a": "1"}`)))
+	assert.Equal(t, AccountMetadata{"a": "1"}, m)
+	require.Nil(t, m.Scan("{}"))
+	assert.Nil(t, m)
+	assert.NotNil(t, m.Scan(42))
+
+	v, err := AccountMetadata(nil).Value()
+	require.Nil(t, err)
+	assert.Equal(t, []byte("{}"), v)
+}
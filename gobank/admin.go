@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+// gobank admin runs operator tasks against the configured storage without
+// going through the HTTP API. The commands use the same services as the
+// handlers, so validation, audit entries and events are the same as for a
+// request, with "cli" as the actor.
+
+const cliActor = "cli"
+
+func adminCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: gobank admin <create-account|credit|list|keygen|sign> [flags]")
+		return 2
+	}
+
+	// Approver keys are handled offline, without storage
+	var store Storage
+	if args[0] != "keygen" && args[0] != "sign" {
+		var err error
+		if store, err = openStorage(LoadConfig()); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open storage: %v\n", err)
+			return 1
+		}
+	}
+
+	return runAdmin(context.Background(), store, args, os.Stdout)
+}
+
+func runAdmin(ctx context.Context, store Storage, args []string, out io.Writer) int {
+	var run func(context.Context, Storage, []string, io.Writer) error
+	switch args[0] {
+	case "create-account":
+		run = adminCreateAccount
+	case "credit":
+		run = adminCredit
+	case "list":
+		run = adminList
+	case "keygen":
+		run = adminKeygen
+	case "sign":
+		run = adminSign
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown admin command %q\n", args[0])
+		return 2
+	}
+
+	if err := run(ctx, store, args[1:], out); err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func adminCreateAccount(ctx context.Context, store Storage, args []string, out io.Writer) error {
+	cmd := flag.NewFlagSet("create-account", flag.ExitOnError)
+	req := &CreateAccountRequest{}
+	cmd.StringVar(&req.FirstName, "first", "", "first name, required")
+	cmd.StringVar(&req.LastName, "last", "", "last name, required")
+	cmd.StringVar(&req.Password, "password", "", "password, required")
+	cmd.StringVar(&req.Currency, "currency", "", "ISO 4217 currency, defaults to "+DefaultCurrency)
+	cmd.StringVar(&req.Email, "email", "", "email address")
+	cmd.Parse(args)
+
+	if err := validateRequest(req); err != nil {
+		return err
+	}
+
+	acc, err := NewAccountService(store).CreateAccount(ctx, req, cliActor)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Created account ID %d, number %d\n", acc.ID, acc.Number)
+	return nil
+}
+
+// credit adds money from outside the bank, booked against the funding ledger
+func adminCredit(ctx context.Context, store Storage, args []string, out io.Writer) error {
+	cmd := flag.NewFlagSet("credit", flag.ExitOnError)
+	number := cmd.Int64("account", 0, "account number to credit, required")
+	amount := cmd.Float64("amount", 0, "amount in the account's currency, required")
+	cmd.Parse(args)
+
+	if *number <= 0 || *amount <= 0 {
+		return fmt.Errorf("-account and a positive -amount are required")
+	}
+
+	acc, err := store.GetAccountByNumber(ctx, *number)
+	if err != nil {
+		return err
+	}
+	if acc.Status == AccountClosed {
+		return ErrAccountClosed
+	}
+
+	tx, err := store.BeginTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	delta := toCents(*amount)
+	if err := store.PostLedgerEntry(ctx, fundingEntry(ctx, acc, delta), tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	auditBalanceChange(ctx, store, cliActor, acc, delta)
+
+	fmt.Fprintf(out, "Credited %.2f %s to account %d, balance %.2f\n", float64(delta)/100, acc.Currency, acc.Number, float64(acc.Balance+delta)/100)
+	return nil
+}
+
+func adminList(ctx context.Context, store Storage, args []string, out io.Writer) error {
+	cmd := flag.NewFlagSet("list", flag.ExitOnError)
+	closed := cmd.Bool("closed", false, "include closed accounts")
+	cmd.Parse(args)
+
+	accounts, err := NewAccountService(store).ListAccounts(ctx, *closed)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNUMBER\tNAME\tSTATUS\tBALANCE")
+	for _, acc := range accounts {
+		fmt.Fprintf(w, "%d\t%d\t%s %s\t%s\t%.2f %s\n", acc.ID, acc.Number, acc.FirstName, acc.LastName, acc.Status, float64(acc.Balance)/100, acc.Currency)
+	}
+	return w.Flush()
+}
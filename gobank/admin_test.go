@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminCommands(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	var out bytes.Buffer
+
+	code := runAdmin(ctx, store, []string{"create-account", "-first", "Ada", "-last", "Lovelace", "-password", "hunter2hunter2", "-currency", "EUR"}, &out)
+	require.Equal(t, 0, code, out.String())
+	assert.Contains(t, out.String(), "Created account ID 1")
+
+	accounts, err := store.GetAccounts(ctx)
+	require.Nil(t, err)
+	require.Len(t, accounts, 1)
+	acc := accounts[0]
+	assert.Equal(t, "EUR", acc.Currency)
+
+	// Requests are validated like the API does
+	assert.Equal(t, 1, runAdmin(ctx, store, []string{"create-account", "-first", "Ada", "-last", "Lovelace", "-password", "short"}, &out))
+
+	number := []string{"-account", strconv.FormatInt(acc.Number, 10)}
+	assert.Equal(t, 0, runAdmin(ctx, store, append([]string{"credit", "-amount", "12.50"}, number...), &out))
+	assert.Equal(t, 1, runAdmin(ctx, store, append([]string{"credit", "-amount", "-1"}, number...), &out))
+
+	credited, err := store.GetAccountbyID(ctx, acc.ID)
+	require.Nil(t, err)
+	assert.Equal(t, int64(1250), credited.Balance)
+	assert.Empty(t, store.reconcile())
+
+	out.Reset()
+	require.Equal(t, 0, runAdmin(ctx, store, []string{"list"}, &out))
+	assert.Contains(t, out.String(), "Ada Lovelace")
+	assert.Contains(t, out.String(), "12.50 EUR")
+
+	assert.Equal(t, 2, runAdmin(ctx, store, []string{"delete-everything"}, &out))
+}
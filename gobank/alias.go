@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Account holders register a phone number or email address as an alias
+// others can pay instead of the account number. A new alias gets a six
+// digit code, mailed to the address for emails and sent through the
+// Notifier for phone numbers, and only becomes payable once the holder
+// confirms it within ALIAS_VERIFICATION_TTL. Five wrong codes use it up,
+// registering the alias again sends a new one. A verified alias belongs to
+// one account, others can register it but not verify it while it's taken.
+// GET /resolve?alias= shows a payer who they'd pay, transfers take toAlias
+// in place of toAccount.
+
+const (
+	AliasPhone = "phone"
+	AliasEmail = "email"
+
+	AuditAliasVerified = "alias.verified"
+	AuditAliasDeleted  = "alias.deleted"
+
+	maxAliasCodeAttempts = 5
+)
+
+// Phone numbers are stored in E.164
+var validPhoneAlias = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+type AccountAlias struct {
+	ID         int        `json:"id"`
+	AccountID  int        `json:"account_id"`
+	Type       string     `json:"type"`
+	Value      string     `json:"value"`
+	Verified   bool       `json:"verified"` // payable
+	CreatedAt  time.Time  `json:"created_at"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+
+	CodeHash      string    `json:"-"`
+	CodeExpiresAt time.Time `json:"-"`
+}
+
+type RegisterAliasRequest struct {
+	Alias string `json:"alias" validate:"required,max=254"` // phone number with its country code, or email
+}
+
+type VerifyAliasRequest struct {
+	Code string `json:"code" validate:"required,numeric,min=6,max=6"`
+}
+
+// AliasResolution is who an alias pays, the name is shortened for the payer to recognise
+type AliasResolution struct {
+	Alias         string `json:"alias"`
+	Type          string `json:"type"`
+	AccountNumber int64  `json:"account_number"`
+	Name          string `json:"name"`
+}
+
+// normalizeAlias tells phone numbers from emails and returns the form
+// they're stored in, phone numbers without spaces, dots, hyphens or brackets
+func normalizeAlias(alias string) (kind, value string, err error) {
+	alias = strings.TrimSpace(alias)
+	if strings.Contains(alias, "@") {
+		email, err := normalizeEmail(alias)
+		return AliasEmail, email, err
+	}
+	phone := strings.NewReplacer(" ", "", ".", "", "-", "", "(", "", ")", "").Replace(alias)
+	if !validPhoneAlias.MatchString(phone) {
+		return "", "", fmt.Errorf("invalid phone number, it needs its + country code")
+	}
+	return AliasPhone, phone, nil
+}
+
+func newAliasCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// shortName is the first name and last initial, enough to confirm a payee
+func shortName(acc *Account) string {
+	if acc.LastName == "" {
+		return acc.FirstName
+	}
+	initial, _ := utf8.DecodeRuneInString(acc.LastName)
+	return acc.FirstName + " " + string(initial) + "."
+}
+
+type AliasService interface {
+	List(ctx context.Context, accountID int) ([]*AccountAlias, error)
+	Register(ctx context.Context, accountID int, req RegisterAliasRequest) (*AccountAlias, error)
+	Verify(ctx context.Context, accountID, id int, code, actor string) (*AccountAlias, error)
+	Delete(ctx context.Context, accountID, id int, actor string) error
+	Resolve(ctx context.Context, alias string) (*Account, *AccountAlias, error)
+}
+
+type aliasService struct {
+	store    Storage
+	notifier Notifier
+	mailer   Mailer
+	ttl      time.Duration
+}
+
+func NewAliasService(store Storage, notifier Notifier, mailer Mailer, ttl time.Duration) AliasService {
+	return &aliasService{store: store, notifier: notifier, mailer: mailer, ttl: ttl}
+}
+
+func (s *APIServer) aliases() AliasService {
+	return NewAliasService(s.store, s.notifier, s.mailer, s.config.AliasVerificationTTL)
+}
+
+func (s *aliasService) List(ctx context.Context, accountID int) ([]*AccountAlias, error) {
+	if _, err := s.store.GetAccountbyID(ctx, accountID); err != nil {
+		return nil, err
+	}
+	return s.store.GetAliases(ctx, accountID)
+}
+
+// Register adds the alias unverified and sends its code, a pending alias
+// gets a new code
+func (s *aliasService) Register(ctx context.Context, accountID int, req RegisterAliasRequest) (*AccountAlias, error) {
+	kind, value, err := normalizeAlias(req.Alias)
+	if err != nil {
+		return nil, invalidField("alias", "format", "must be an email address or a phone number starting with + and its country code")
+	}
+
+	acc, err := s.store.GetAccountbyID(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if acc.Status == AccountClosed {
+		return nil, ErrAccountClosed
+	}
+	if taken, err := s.store.GetVerifiedAlias(ctx, value); err == nil {
+		if taken.AccountID == accountID {
+			return nil, ErrAliasVerified
+		}
+		return nil, ErrAliasTaken
+	}
+
+	code, err := newAliasCode()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	alias := &AccountAlias{
+		AccountID:     accountID,
+		Type:          kind,
+		Value:         value,
+		CreatedAt:     now,
+		CodeHash:      hashResetToken(code),
+		CodeExpiresAt: now.Add(s.ttl),
+	}
+	if err := s.store.SaveAlias(ctx, alias); err != nil {
+		return nil, err
+	}
+
+	if err := s.sendCode(ctx, alias, code); err != nil {
+		log.Printf("Failed to send the code for alias %d of account %d: %v", alias.ID, accountID, err)
+	}
+	return alias, nil
+}
+
+func (s *aliasService) sendCode(ctx context.Context, alias *AccountAlias, code string) error {
+	message := fmt.Sprintf("Your code to receive GoBank payments at %s is %s, it expires in %s", alias.Value, code, s.ttl)
+	if alias.Type == AliasEmail {
+		return s.mailer.Send(ctx, &MailMessage{To: alias.Value, Subject: "Confirm your GoBank alias", Body: message})
+	}
+	return s.notifier.Notify(alias.AccountID, "Confirm your GoBank alias", message)
+}
+
+func (s *aliasService) Verify(ctx context.Context, accountID, id int, code, actor string) (*AccountAlias, error) {
+	alias, err := s.store.VerifyAlias(ctx, accountID, id, hashResetToken(code), time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	recordAudit(ctx, s.store, actor, accountID, AuditAliasVerified, []FieldChange{
+		{Field: "alias", Old: nil, New: alias.Value},
+	})
+	return alias, nil
+}
+
+func (s *aliasService) Delete(ctx context.Context, accountID, id int, actor string) error {
+	alias, err := s.store.DeleteAlias(ctx, accountID, id)
+	if err != nil {
+		return err
+	}
+	if alias.Verified {
+		recordAudit(ctx, s.store, actor, accountID, AuditAliasDeleted, []FieldChange{
+			{Field: "alias", Old: alias.Value, New: nil},
+		})
+	}
+	return nil
+}
+
+func (s *aliasService) Resolve(ctx context.Context, alias string) (*Account, *AccountAlias, error) {
+	return resolveAlias(ctx, s.store, alias)
+}
+
+// resolveAlias finds the open account a verified alias pays
+func resolveAlias(ctx context.Context, store Storage, alias string) (*Account, *AccountAlias, error) {
+	_, value, err := normalizeAlias(alias)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrAliasNotFound, err)
+	}
+	found, err := store.GetVerifiedAlias(ctx, value)
+	if err != nil {
+		return nil, nil, err
+	}
+	acc, err := store.GetAccountbyID(ctx, found.AccountID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if acc.Status == AccountClosed {
+		return nil, nil, fmt.Errorf("%w: %s", ErrAliasNotFound, value)
+	}
+	return acc, found, nil
+}
+
+// resolvePayee fills in the account number for transfers to an alias
+func (s *transferService) resolvePayee(ctx context.Context, req TransferRequest) (TransferRequest, error) {
+	if req.ToAlias == "" {
+		if req.ToAccountNumber == 0 {
+			return req, invalidField("toAccount", "required", "is required without toAlias")
+		}
+		return req, nil
+	}
+
+	acc, _, err := resolveAlias(ctx, s.store, req.ToAlias)
+	if err != nil {
+		return req, err
+	}
+	if req.ToAccountNumber != 0 && req.ToAccountNumber != acc.Number {
+		return req, invalidField("toAlias", "mismatch", "pays another account than toAccount")
+	}
+	req.ToAccountNumber = acc.Number
+	return req, nil
+}
+
+func aliasID(r *http.Request) (int, error) {
+	return pathID(r, "aliasID")
+}
+
+// GET /account/{id}/aliases
+func (s *APIServer) handleGetAliases(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	aliases, err := s.forRequest(r).aliases().List(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, aliases)
+}
+
+// POST /account/{id}/aliases
+func (s *APIServer) handleRegisterAlias(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	var req RegisterAliasRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+	alias, err := s.forRequest(r).aliases().Register(r.Context(), id, req)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusCreated, alias)
+}
+
+// POST /account/{id}/aliases/{aliasID}/verify
+func (s *APIServer) handleVerifyAlias(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	aID, err := aliasID(r)
+	if err != nil {
+		return err
+	}
+	s = s.forRequest(r)
+
+	var req VerifyAliasRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+	alias, err := s.aliases().Verify(r.Context(), id, aID, req.Code, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, alias)
+}
+
+// DELETE /account/{id}/aliases/{aliasID}
+func (s *APIServer) handleDeleteAlias(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	aID, err := aliasID(r)
+	if err != nil {
+		return err
+	}
+	s = s.forRequest(r)
+
+	if err := s.aliases().Delete(r.Context(), id, aID, auditActor(r, s.config)); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, map[string]int{"deleted": aID})
+}
+
+// GET /resolve?alias=, for logged in customers only so aliases can't be
+// checked anonymously
+func (s *APIServer) handleResolveAlias(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	if _, _, err := s.tokenAccount(r); err != nil {
+		return err
+	}
+	alias := r.URL.Query().Get("alias")
+	if alias == "" {
+		return invalidParam("query", "alias", "required", "is required")
+	}
+
+	acc, found, err := s.aliases().Resolve(r.Context(), alias)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, &AliasResolution{Alias: found.Value, Type: found.Type, AccountNumber: acc.Number, Name: shortName(acc)})
+}
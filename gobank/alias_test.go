@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var aliasCode = regexp.MustCompile(`is (\d{6}),`)
+
+func TestNormalizeAlias(t *testing.T) {
+	for alias, want := range map[string]string{
+		"+44 20 7946-0958":  "+442079460958",
+		" Ada@Example.com ": "ada@example.com",
+		"+1 (415) 555.0100": "+14155550100",
+	} {
+		_, value, err := normalizeAlias(alias)
+		require.Nil(t, err, alias)
+		assert.Equal(t, want, value)
+	}
+
+	for _, alias := range []string{"07946 0958", "+0123456789", "+12", "ada@", "Ada <ada@example.com>"} {
+		_, _, err := normalizeAlias(alias)
+		assert.Error(t, err, alias)
+	}
+}
+
+func TestAliasLifecycle(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	ada := &Account{FirstName: "Ada", LastName: "Lovelace", Number: 9881, Balance: 10000, Currency: "USD", Status: AccountActive}
+	alan := &Account{FirstName: "Alan", Number: 9882, Currency: "USD", Status: AccountActive}
+	require.Nil(t, store.CreateAccount(ctx, ada))
+	require.Nil(t, store.CreateAccount(ctx, alan))
+
+	notifier := &capturingNotifier{}
+	mailer := &recordingMailer{}
+	aliases := NewAliasService(store, notifier, mailer, 15*time.Minute)
+
+	// Email codes go to the address itself
+	email, err := aliases.Register(ctx, ada.ID, RegisterAliasRequest{Alias: "Ada@Example.com"})
+	require.Nil(t, err)
+	assert.Equal(t, AliasEmail, email.Type)
+	assert.False(t, email.Verified)
+	require.Len(t, mailer.sent, 1)
+	assert.Equal(t, "ada@example.com", mailer.sent[0].To)
+	code := aliasCode.FindStringSubmatch(mailer.sent[0].Body)[1]
+
+	_, _, err = aliases.Resolve(ctx, "ada@example.com")
+	assert.ErrorIs(t, err, ErrAliasNotFound, "not payable until verified")
+
+	_, err = aliases.Verify(ctx, ada.ID, email.ID, wrongCode(code), "test")
+	assert.ErrorIs(t, err, ErrInvalidAliasCode)
+	verified, err := aliases.Verify(ctx, ada.ID, email.ID, code, "test")
+	require.Nil(t, err)
+	assert.True(t, verified.Verified)
+
+	acc, found, err := aliases.Resolve(ctx, " ADA@example.com")
+	require.Nil(t, err)
+	assert.Equal(t, ada.Number, acc.Number)
+	assert.Equal(t, "ada@example.com", found.Value)
+
+	_, err = aliases.Register(ctx, ada.ID, RegisterAliasRequest{Alias: "ada@example.com"})
+	assert.ErrorIs(t, err, ErrAliasVerified)
+	_, err = aliases.Register(ctx, alan.ID, RegisterAliasRequest{Alias: "ada@example.com"})
+	assert.ErrorIs(t, err, ErrAliasTaken)
+
+	// Phone codes go through the notifier, wrong codes use up the attempts
+	phone, err := aliases.Register(ctx, alan.ID, RegisterAliasRequest{Alias: "+1 415 555 0100"})
+	require.Nil(t, err)
+	require.Len(t, notifier.messages, 1)
+	code = aliasCode.FindStringSubmatch(notifier.messages[0])[1]
+	for i := 0; i < maxAliasCodeAttempts; i++ {
+		_, err = aliases.Verify(ctx, alan.ID, phone.ID, wrongCode(code), "test")
+		assert.ErrorIs(t, err, ErrInvalidAliasCode)
+	}
+	_, err = aliases.Verify(ctx, alan.ID, phone.ID, code, "test")
+	assert.ErrorIs(t, err, ErrInvalidAliasCode)
+
+	// Registering again sends a fresh code
+	again, err := aliases.Register(ctx, alan.ID, RegisterAliasRequest{Alias: "+14155550100"})
+	require.Nil(t, err)
+	assert.Equal(t, phone.ID, again.ID)
+	code = aliasCode.FindStringSubmatch(notifier.messages[1])[1]
+	_, err = aliases.Verify(ctx, alan.ID, phone.ID, code, "test")
+	require.Nil(t, err)
+
+	_, err = aliases.Verify(ctx, ada.ID, phone.ID, code, "test")
+	assert.ErrorIs(t, err, ErrAliasNotFound, "another account's alias")
+
+	list, err := aliases.List(ctx, alan.ID)
+	require.Nil(t, err)
+	require.Len(t, list, 1)
+
+	require.Nil(t, aliases.Delete(ctx, alan.ID, phone.ID, "test"))
+	_, _, err = aliases.Resolve(ctx, "+14155550100")
+	assert.ErrorIs(t, err, ErrAliasNotFound)
+
+	actions := []string{}
+	for _, entry := range store.audit {
+		actions = append(actions, entry.Action)
+	}
+	assert.Equal(t, []string{AuditAliasVerified, AuditAliasVerified, AuditAliasDeleted}, actions)
+}
+
+func TestTransferToAlias(t *testing.T) {
+	t.Setenv("JWT_SECRET", "alias-secret")
+	ctx := context.Background()
+	store := newMemoryStorage()
+	from := &Account{FirstName: "Grace", Number: 9891, Balance: 10000, Currency: "USD", Status: AccountActive}
+	to := &Account{FirstName: "Ada", LastName: "Lovelace", Number: 9892, Currency: "USD", Status: AccountActive}
+	require.Nil(t, store.CreateAccount(ctx, from))
+	require.Nil(t, store.CreateAccount(ctx, to))
+
+	s := NewAPIServer(&Config{AliasVerificationTTL: time.Minute}, store)
+	mailer := &recordingMailer{}
+	s.mailer = mailer
+	alias, err := s.aliases().Register(ctx, to.ID, RegisterAliasRequest{Alias: "ada@example.com"})
+	require.Nil(t, err)
+	code := aliasCode.FindStringSubmatch(mailer.sent[0].Body)[1]
+
+	w := httptest.NewRecorder()
+	r := mux.SetURLVars(httptest.NewRequest("POST", "/account/2/aliases/1/verify", strings.NewReader(`{"code": "`+code+`"}`)),
+		map[string]string{"id": "2", "aliasID": "1"})
+	makeHTTPHandle(s.handleVerifyAlias)(w, r)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	token, err := createJWT(from)
+	require.Nil(t, err)
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/resolve?alias=ada@example.com", nil)
+	r.Header.Set("x-jwt-token", token)
+	makeHTTPHandle(s.handleResolveAlias)(w, r)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	resolved := &AliasResolution{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), resolved))
+	assert.Equal(t, AliasResolution{Alias: alias.Value, Type: AliasEmail, AccountNumber: 9892, Name: "Ada L."}, *resolved)
+
+	w = httptest.NewRecorder()
+	makeHTTPHandle(s.handleResolveAlias)(w, httptest.NewRequest("GET", "/resolve?alias=ada@example.com", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	receipt, _, err := s.transfers().Transfer(ctx, TransferRequest{FromAccountNumber: 9891, ToAlias: "ada@example.com", Amount: 25}, engine, "test")
+	require.Nil(t, err)
+	assert.Equal(t, int64(9892), receipt.ToAccount)
+
+	var verr *ValidationError
+	_, _, err = s.transfers().Transfer(ctx, TransferRequest{FromAccountNumber: 9891, ToAccountNumber: 9891, ToAlias: "ada@example.com", Amount: 1}, engine, "test")
+	require.True(t, errors.As(err, &verr))
+	assert.Equal(t, "/toAlias", verr.Fields[0].Field)
+	_, _, err = s.transfers().Transfer(ctx, TransferRequest{FromAccountNumber: 9891, Amount: 1}, engine, "test")
+	require.True(t, errors.As(err, &verr))
+	assert.Equal(t, "/toAccount", verr.Fields[0].Field)
+	_, _, err = s.transfers().Transfer(ctx, TransferRequest{FromAccountNumber: 9891, ToAlias: "+14155550100", Amount: 1}, engine, "test")
+	assert.ErrorIs(t, err, ErrAliasNotFound)
+}
+
+func wrongCode(code string) string {
+	if code == "000000" {
+		return "000001"
+	}
+	return "000000"
+}
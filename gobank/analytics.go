@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Spending analytics summarize an account's ledger postings over a calendar
+// month or ISO week (UTC): what came in and went out, per category, the
+// largest transactions, and the change against the period before. The
+// totals are aggregate queries over the postings, results are kept for
+// ANALYTICS_CACHE_TTL per account and period. Amounts are in cents in
+// the account's currency, entries without a category are counted under "".
+
+const (
+	AnalyticsMonth = "month"
+	AnalyticsWeek  = "week"
+
+	analyticsLargest = 5
+)
+
+type CategoryFlow struct {
+	Category string `json:"category"`
+	Count    int    `json:"count"`
+	Inflow   int64  `json:"inflow"`
+	Outflow  int64  `json:"outflow"`
+}
+
+type FlowTotals struct {
+	Count   int   `json:"count"`
+	Inflow  int64 `json:"inflow"`
+	Outflow int64 `json:"outflow"`
+	Net     int64 `json:"net"`
+}
+
+// FlowChange is the difference to the previous period, the percentages are
+// left out when the previous period had nothing to compare with
+type FlowChange struct {
+	Inflow         int64    `json:"inflow"`
+	Outflow        int64    `json:"outflow"`
+	Net            int64    `json:"net"`
+	InflowPercent  *float64 `json:"inflow_percent,omitempty"`
+	OutflowPercent *float64 `json:"outflow_percent,omitempty"`
+}
+
+type AccountAnalytics struct {
+	AccountID   int                   `json:"account_id"`
+	Currency    string                `json:"currency"`
+	Period      string                `json:"period"`
+	From        time.Time             `json:"from"`
+	To          time.Time             `json:"to"`
+	Totals      FlowTotals            `json:"totals"`
+	Previous    FlowTotals            `json:"previous"`
+	Change      FlowChange            `json:"change"`
+	Categories  []*CategoryFlow       `json:"categories"`
+	Largest     []*AccountTransaction `json:"largest"`
+	GeneratedAt time.Time             `json:"generated_at"`
+}
+
+// analyticsPeriod is the month or week containing day, as [from, to)
+func analyticsPeriod(period string, day time.Time) (from, to time.Time) {
+	day = startOfDay(day.UTC())
+	if period == AnalyticsWeek {
+		// Weeks start on Monday
+		from = day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+		return from, from.AddDate(0, 0, 7)
+	}
+	from = time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return from, from.AddDate(0, 1, 0)
+}
+
+func flowTotals(flows []*CategoryFlow) FlowTotals {
+	var t FlowTotals
+	for _, f := range flows {
+		t.Count += f.Count
+		t.Inflow += f.Inflow
+		t.Outflow += f.Outflow
+	}
+	t.Net = t.Inflow - t.Outflow
+	return t
+}
+
+func percentChange(from, to int64) *float64 {
+	if from == 0 {
+		return nil
+	}
+	p := float64(to-from) / float64(from) * 100
+	return &p
+}
+
+func flowChange(previous, current FlowTotals) FlowChange {
+	return FlowChange{
+		Inflow:         current.Inflow - previous.Inflow,
+		Outflow:        current.Outflow - previous.Outflow,
+		Net:            current.Net - previous.Net,
+		InflowPercent:  percentChange(previous.Inflow, current.Inflow),
+		OutflowPercent: percentChange(previous.Outflow, current.Outflow),
+	}
+}
+
+// GET /account/{id}/analytics?period=month&date=2024-03-15, the current
+// month by default
+func (s *APIServer) handleGetAnalytics(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = AnalyticsMonth
+	}
+	if period != AnalyticsMonth && period != AnalyticsWeek {
+		return invalidParam("query", "period", "oneof", "must be month or week")
+	}
+	day := time.Now().UTC()
+	if v := r.URL.Query().Get("date"); v != "" {
+		day, err = time.Parse("2006-01-02", v)
+		if err != nil {
+			return invalidParam("query", "date", "type", "must be a date like 2006-01-02")
+		}
+	}
+
+	store := s.forRequest(r).store
+	acc, err := store.GetAccountbyID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	from, to := analyticsPeriod(period, day)
+	key := fmt.Sprintf("%d/%s/%s", id, period, from.Format("2006-01-02"))
+	analytics, err := cachedStat(s.analytics, key, func() (*AccountAnalytics, error) {
+		flows, err := store.GetCategoryFlows(r.Context(), id, from, to)
+		if err != nil {
+			return nil, err
+		}
+		previousFrom, _ := analyticsPeriod(period, from.AddDate(0, 0, -1))
+		previousFlows, err := store.GetCategoryFlows(r.Context(), id, previousFrom, from)
+		if err != nil {
+			return nil, err
+		}
+		largest, err := store.GetLargestTransactions(r.Context(), id, from, to, analyticsLargest)
+		if err != nil {
+			return nil, err
+		}
+
+		a := &AccountAnalytics{
+			AccountID:   id,
+			Currency:    acc.Currency,
+			Period:      period,
+			From:        from,
+			To:          to,
+			Totals:      flowTotals(flows),
+			Previous:    flowTotals(previousFlows),
+			Categories:  flows,
+			Largest:     largest,
+			GeneratedAt: time.Now().UTC(),
+		}
+		a.Change = flowChange(a.Previous, a.Totals)
+		return a, nil
+	})
+	if err != nil {
+		return err
+	}
+	return writeLocalized(w, r, http.StatusOK, analytics, analytics.Currency, analyticsAmounts(analytics))
+}
+
+// analyticsAmounts are the amounts of an analytics response, the largest
+// transactions are in units already
+func analyticsAmounts(a *AccountAnalytics) map[string]int64 {
+	amounts := map[string]int64{}
+	for name, t := range map[string]FlowTotals{"totals": a.Totals, "previous": a.Previous} {
+		amounts[name+".inflow"] = t.Inflow
+		amounts[name+".outflow"] = t.Outflow
+		amounts[name+".net"] = t.Net
+	}
+	amounts["change.inflow"] = a.Change.Inflow
+	amounts["change.outflow"] = a.Change.Outflow
+	amounts["change.net"] = a.Change.Net
+	for i, f := range a.Categories {
+		amounts[fmt.Sprintf("categories.%d.inflow", i)] = f.Inflow
+		amounts[fmt.Sprintf("categories.%d.outflow", i)] = f.Outflow
+	}
+	return amounts
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalyticsPeriod(t *testing.T) {
+	day := time.Date(2024, 3, 14, 15, 4, 5, 0, time.UTC) // a Thursday
+
+	from, to := analyticsPeriod(AnalyticsMonth, day)
+	assert.Equal(t, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), from)
+	assert.Equal(t, time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC), to)
+
+	from, to = analyticsPeriod(AnalyticsWeek, day)
+	assert.Equal(t, time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC), from)
+	assert.Equal(t, time.Date(2024, 3, 18, 0, 0, 0, 0, time.UTC), to)
+
+	from, _ = analyticsPeriod(AnalyticsWeek, time.Date(2024, 3, 17, 0, 0, 0, 0, time.UTC))
+	assert.Equal(t, time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC), from, "Sunday ends the week")
+}
+
+func TestHandleGetAnalytics(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	acc := &Account{Number: 9801, Balance: 100000, Currency: "USD", Status: AccountActive, EmailVerified: true}
+	require.Nil(t, store.CreateAccount(ctx, acc))
+
+	post := func(at time.Time, category string, amount int64) {
+		require.Nil(t, postWithRetry(ctx, store, acc.ID, func(a *Account) *LedgerEntry {
+			entry := newLedgerEntry(ctx, "transfer").account(a, amount).ledger(LedgerFunding, "USD", -amount)
+			entry.Category, entry.CreatedAt = category, at
+			return entry
+		}))
+	}
+	feb := time.Date(2024, 2, 10, 12, 0, 0, 0, time.UTC)
+	mar := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	post(feb, "groceries", -4000)
+	post(feb, "salary", 200000)
+	post(mar, "groceries", -3000)
+	post(mar, "groceries", -2000)
+	post(mar, "rent", -90000)
+	post(mar, "", 250000)
+	post(time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC), "rent", -90000)
+
+	s := NewAPIServer(&Config{AnalyticsCacheTTL: time.Minute}, store)
+	get := func(query string, v any) int {
+		r := mux.SetURLVars(httptest.NewRequest("GET", "/account/1/analytics"+query, nil), map[string]string{"id": "1"})
+		w := httptest.NewRecorder()
+		makeHTTPHandle(s.handleGetAnalytics)(w, r)
+		if v != nil && w.Code == http.StatusOK {
+			require.Nil(t, json.Unmarshal(w.Body.Bytes(), v))
+		}
+		return w.Code
+	}
+
+	var a AccountAnalytics
+	require.Equal(t, http.StatusOK, get("?period=month&date=2024-03-20", &a))
+	assert.Equal(t, "USD", a.Currency)
+	assert.Equal(t, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), a.From)
+	assert.Equal(t, FlowTotals{Count: 4, Inflow: 250000, Outflow: 95000, Net: 155000}, a.Totals)
+	assert.Equal(t, FlowTotals{Count: 2, Inflow: 200000, Outflow: 4000, Net: 196000}, a.Previous)
+	assert.Equal(t, []*CategoryFlow{
+		{Category: "rent", Count: 1, Outflow: 90000},
+		{Category: "groceries", Count: 2, Outflow: 5000},
+		{Category: "", Count: 1, Inflow: 250000},
+	}, a.Categories)
+
+	assert.Equal(t, int64(50000), a.Change.Inflow)
+	assert.Equal(t, int64(-41000), a.Change.Net)
+	require.NotNil(t, a.Change.InflowPercent)
+	assert.InDelta(t, 25.0, *a.Change.InflowPercent, 0.001)
+	assert.InDelta(t, 2275.0, *a.Change.OutflowPercent, 0.001)
+
+	require.Len(t, a.Largest, 4)
+	assert.Equal(t, 2500.0, a.Largest[0].Amount)
+	assert.Equal(t, DirectionCredit, a.Largest[0].Direction)
+	assert.Equal(t, 900.0, a.Largest[1].Amount)
+
+	// Cached until the TTL runs out
+	post(mar, "groceries", -1000)
+	var cached AccountAnalytics
+	require.Equal(t, http.StatusOK, get("?date=2024-03-01", &cached))
+	assert.Equal(t, a.Totals, cached.Totals)
+
+	var week AccountAnalytics
+	require.Equal(t, http.StatusOK, get("?period=week&date=2024-02-10", &week))
+	assert.Equal(t, FlowTotals{Count: 2, Inflow: 200000, Outflow: 4000, Net: 196000}, week.Totals)
+	assert.Nil(t, week.Change.InflowPercent)
+
+	var localized struct {
+		Formatted map[string]string `json:"formatted"`
+	}
+	require.Equal(t, http.StatusOK, get("?date=2024-03-01&locale=en-US", &localized))
+	assert.Equal(t, "$2,500.00", localized.Formatted["totals.inflow"])
+	assert.Equal(t, "-$410.00", localized.Formatted["change.net"])
+	assert.Equal(t, "$900.00", localized.Formatted["categories.0.outflow"])
+
+	assert.Equal(t, http.StatusUnprocessableEntity, get("?period=year", nil))
+	assert.Equal(t, http.StatusUnprocessableEntity, get("?date=March", nil))
+}
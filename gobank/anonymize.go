@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// `gobank anonymize` scrubs a copy of the production database before it
+// seeds staging. Names, emails and account numbers are replaced with fakes
+// derived from an HMAC of the original value, so the same salt gives the same
+// fakes on every refresh. Account ids and balances are left alone, which
+// keeps foreign keys and balance sums intact; account numbers stored
+// elsewhere (schedules, sweeps, audit actors) are remapped to match.
+// Everything runs in one transaction.
+
+var fakeFirstNames = []string{"Alex", "Blake", "Casey", "Drew", "Emery", "Finley", "Gray", "Harper", "Indy", "Jordan", "Kai", "Logan", "Morgan", "Noel", "Oakley", "Parker", "Quinn", "Reese", "Sage", "Taylor"}
+
+var fakeLastNames = []string{"Ash", "Brook", "Cole", "Dale", "Ellis", "Ford", "Glen", "Hale", "Irving", "Jules", "Kent", "Lane", "Marsh", "North", "Oakes", "Pike", "Reed", "Stone", "Vale", "West"}
+
+// Audited fields holding personal data, their old and new values are faked too
+var anonymizedAuditFields = map[string]bool{"first_name": true, "last_name": true, "account_number": true, "email": true}
+
+type anonymizer struct {
+	salt    []byte
+	numbers map[int64]int64
+	used    map[int64]bool
+}
+
+func newAnonymizer(salt string) *anonymizer {
+	return &anonymizer{salt: []byte(salt), numbers: map[int64]int64{}, used: map[int64]bool{}}
+}
+
+func (a *anonymizer) hash(kind, value string) uint64 {
+	mac := hmac.New(sha256.New, a.salt)
+	mac.Write([]byte(kind + ":" + value))
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+func (a *anonymizer) firstName(v string) string {
+	return fakeFirstNames[a.hash("first_name", v)%uint64(len(fakeFirstNames))]
+}
+
+func (a *anonymizer) lastName(v string) string {
+	return fakeLastNames[a.hash("last_name", v)%uint64(len(fakeLastNames))]
+}
+
+func (a *anonymizer) email(v string) string {
+	if v == "" {
+		return ""
+	}
+	return fmt.Sprintf("user%d@example.invalid", a.hash("email", v)%1000000000)
+}
+
+// number maps an account number to a fake one, unique across the run.
+// Collisions move to the next free number, callers visit accounts in id
+// order so the result is stable.
+func (a *anonymizer) number(n int64) int64 {
+	if mapped, ok := a.numbers[n]; ok {
+		return mapped
+	}
+
+	fake := 100000 + int64(a.hash("account_number", strconv.FormatInt(n, 10))%900000)
+	for a.used[fake] {
+		fake = 100000 + (fake-100000+1)%900000
+	}
+	a.numbers[n] = fake
+	a.used[fake] = true
+	return fake
+}
+
+// actor rewrites "account:<number>" actors, others are operators or jobs
+func (a *anonymizer) actor(actor string) string {
+	number, err := strconv.ParseInt(strings.TrimPrefix(actor, "account:"), 10, 64)
+	if !strings.HasPrefix(actor, "account:") || err != nil {
+		return actor
+	}
+	return "account:" + strconv.FormatInt(a.number(number), 10)
+}
+
+func (a *anonymizer) auditValue(field string, v any) any {
+	switch value := v.(type) {
+	case string:
+		switch field {
+		case "first_name":
+			return a.firstName(value)
+		case "last_name":
+			return a.lastName(value)
+		case "email":
+			return a.email(value)
+		}
+	case float64:
+		if field == "account_number" && value != 0 {
+			return float64(a.number(int64(value)))
+		}
+	}
+	return v
+}
+
+func (a *anonymizer) auditChanges(changes []FieldChange) []FieldChange {
+	for i, c := range changes {
+		if anonymizedAuditFields[c.Field] {
+			changes[i].Old = a.auditValue(c.Field, c.Old)
+			changes[i].New = a.auditValue(c.Field, c.New)
+		}
+	}
+	return changes
+}
+
+func anonymizeCommand(args []string) int {
+	cmd := flag.NewFlagSet("anonymize", flag.ExitOnError)
+	dsn := cmd.String("dsn", "", "connection string of the copied database, required")
+	salt := cmd.String("salt", "", "secret the fakes are derived from, required")
+	password := cmd.String("password", "staging-password", "password every account gets after anonymizing")
+	confirm := cmd.Bool("yes", false, "confirm the database at -dsn is a copy and may be rewritten")
+	cmd.Parse(args)
+
+	if *dsn == "" || *salt == "" {
+		fmt.Fprintln(os.Stderr, "-dsn and -salt are required")
+		return 2
+	}
+	if !*confirm {
+		fmt.Fprintln(os.Stderr, "Refusing to rewrite the database without -yes")
+		return 2
+	}
+
+	db, err := sql.Open("postgres", *dsn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open database: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	encpw, err := passwords.Hash(*password)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to hash password: %v\n", err)
+		return 1
+	}
+
+	accounts, err := anonymizeDatabase(context.Background(), db, newAnonymizer(*salt), encpw)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Anonymizing failed, nothing was changed: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Anonymized %d accounts\n", accounts)
+	return 0
+}
+
+func anonymizeDatabase(ctx context.Context, db *sql.DB, a *anonymizer, encryptedPassword string) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	balanceSums := func() (string, error) {
+		var sums string
+		err := tx.QueryRowContext(ctx, "SELECT coalesce(string_agg(currency || '=' || total, ',' ORDER BY currency), '') FROM (SELECT currency, sum(balance) AS total FROM account GROUP BY currency) sums").Scan(&sums)
+		return sums, err
+	}
+	before, err := balanceSums()
+	if err != nil {
+		return 0, err
+	}
+
+	type accountRow struct {
+		id               int
+		first, last, eml string
+		number           int64
+	}
+	rows, err := tx.QueryContext(ctx, "SELECT id, coalesce(first_name, ''), coalesce(last_name, ''), coalesce(email, ''), account_number FROM account ORDER BY id")
+	if err != nil {
+		return 0, err
+	}
+	accounts := []accountRow{}
+	for rows.Next() {
+		var r accountRow
+		if err := rows.Scan(&r.id, &r.first, &r.last, &r.eml, &r.number); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		accounts = append(accounts, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, r := range accounts {
+		if _, err := tx.ExecContext(ctx,
+			"UPDATE account SET first_name = $1, last_name = $2, email = nullif($3, ''), account_number = $4, encrypted_password = $5 WHERE id = $6",
+			a.firstName(r.first), a.lastName(r.last), a.email(r.eml), a.number(r.number), encryptedPassword, r.id); err != nil {
+			return 0, fmt.Errorf("account %d: %v", r.id, err)
+		}
+	}
+
+	// Numbers referenced by value rather than by id
+	for _, table := range []string{"scheduled_transfer", "sweep_rule"} {
+		if err := remapNumbers(ctx, tx, a, table); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := anonymizeAuditLog(ctx, tx, a); err != nil {
+		return 0, err
+	}
+
+	// Outstanding tokens were sent to real people, webhooks point at their systems
+	for _, table := range []string{"password_reset", "email_verification", "event_subscription"} {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table); err != nil {
+			return 0, fmt.Errorf("%s: %v", table, err)
+		}
+	}
+
+	after, err := balanceSums()
+	if err != nil {
+		return 0, err
+	}
+	if before != after {
+		return 0, fmt.Errorf("balance sums changed from %q to %q", before, after)
+	}
+
+	return len(accounts), tx.Commit()
+}
+
+func remapNumbers(ctx context.Context, tx *sql.Tx, a *anonymizer, table string) error {
+	rows, err := tx.QueryContext(ctx, "SELECT id, to_account_number FROM "+table)
+	if err != nil {
+		return fmt.Errorf("%s: %v", table, err)
+	}
+	numbers := map[int]int64{}
+	for rows.Next() {
+		var id int
+		var number int64
+		if err := rows.Scan(&id, &number); err != nil {
+			rows.Close()
+			return err
+		}
+		numbers[id] = number
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, number := range numbers {
+		if _, err := tx.ExecContext(ctx, "UPDATE "+table+" SET to_account_number = $1 WHERE id = $2", a.number(number), id); err != nil {
+			return fmt.Errorf("%s %d: %v", table, id, err)
+		}
+	}
+	return nil
+}
+
+func anonymizeAuditLog(ctx context.Context, tx *sql.Tx, a *anonymizer) error {
+	type auditRow struct {
+		id      int
+		actor   string
+		changes []byte
+	}
+	rows, err := tx.QueryContext(ctx, "SELECT id, actor, changes FROM audit_log ORDER BY id")
+	if err != nil {
+		return err
+	}
+	entries := []auditRow{}
+	for rows.Next() {
+		var r auditRow
+		if err := rows.Scan(&r.id, &r.actor, &r.changes); err != nil {
+			rows.Close()
+			return err
+		}
+		entries = append(entries, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range entries {
+		changes := []FieldChange{}
+		if err := json.Unmarshal(r.changes, &changes); err != nil {
+			return fmt.Errorf("audit entry %d: %v", r.id, err)
+		}
+		scrubbed, err := json.Marshal(a.auditChanges(changes))
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE audit_log SET actor = $1, changes = $2 WHERE id = $3", a.actor(r.actor), scrubbed, r.id); err != nil {
+			return fmt.Errorf("audit entry %d: %v", r.id, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnonymizer(t *testing.T) {
+	a := newAnonymizer("salt")
+	b := newAnonymizer("salt")
+
+	// Same salt, same fakes
+	assert.Equal(t, a.firstName("Grace"), b.firstName("Grace"))
+	assert.Equal(t, a.email("grace@example.com"), b.email("grace@example.com"))
+	assert.Equal(t, a.number(123456), b.number(123456))
+	assert.Empty(t, a.email(""))
+
+	// Mapped numbers stay unique and stable
+	seen := map[int64]bool{}
+	for n := int64(100000); n < 102000; n++ {
+		fake := a.number(n)
+		assert.False(t, seen[fake], "number %d reused", fake)
+		seen[fake] = true
+	}
+	assert.Equal(t, a.number(100500), a.number(100500))
+
+	assert.Equal(t, "account:"+strconv.FormatInt(a.number(123456), 10), a.actor("account:123456"))
+	assert.Equal(t, "admin", a.actor("admin"))
+
+	changes := a.auditChanges([]FieldChange{
+		{Field: "first_name", Old: "Grace", New: "Ada"},
+		{Field: "account_number", Old: nil, New: float64(123456)},
+		{Field: "balance", Old: float64(10), New: float64(20)},
+	})
+	assert.Equal(t, a.firstName("Grace"), changes[0].Old)
+	assert.Equal(t, a.firstName("Ada"), changes[0].New)
+	assert.Nil(t, changes[1].Old)
+	assert.Equal(t, float64(a.number(123456)), changes[1].New)
+	assert.Equal(t, float64(20), changes[2].New)
+}
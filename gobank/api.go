@@ -1,459 +1,831 @@
-package main
-
-import (
-	"encoding/json"
-	"fmt"
-	"log"
-	"net/http"
-	"os"
-	"strconv"
-	"time"
-
-	jwt "github.com/golang-jwt/jwt/v5"
-	"github.com/gorilla/mux"
-)
-
-func WriteJSON(w http.ResponseWriter, status int, v any) error {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	return json.NewEncoder(w).Encode(v)
-}
-
-type apiFunc func(http.ResponseWriter, *http.Request) error
-
-type ApiError struct {
-	Error string `json:"error"`
-}
-
-func makeHTTPHandle(f apiFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if err := f(w, r); err != nil {
-			//handle error
-			WriteJSON(w, http.StatusBadRequest, ApiError{Error: err.Error()})
-		}
-	}
-}
-
-type APIServer struct {
-	listenAddr string
-	store      Storage
-}
-
-func NewAPIServer(listenAddr string, store Storage) *APIServer {
-	return &APIServer{
-		listenAddr: listenAddr,
-		store:      store,
-	}
-}
-
-func (s *APIServer) Run() {
-	router := mux.NewRouter()
-
-	router.HandleFunc("/login", makeHTTPHandle(s.handleLogin))
-	router.HandleFunc("/account", makeHTTPHandle(s.handleAccount))
-	router.HandleFunc("/account/{id}", http.HandlerFunc(withJWTAuth(makeHTTPHandle(s.handleGetAccountByID), s.store).ServeHTTP))
-	router.HandleFunc("/transfer", makeHTTPHandle(s.handleTransfer))
-
-	log.Println("JSON API server running on port:", s.listenAddr)
-
-	if err := http.ListenAndServe(s.listenAddr, router); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
-	}
-}
-
-// 885978
-func (s *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) error {
-	if r.Method != "POST" {
-		return fmt.Errorf("Method not allowed %s", r.Method)
-	}
-
-	var req LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		return err
-	}
-
-	acc, err := s.store.GetAccountByNumber(int64(req.Number))
-	if err != nil {
-		return err
-	}
-
-	if !acc.ValidatePassword(req.Password) {
-		return fmt.Errorf("User not authenticated.")
-	}
-
-	token, err := createJWT(acc)
-	if err != nil {
-		return err
-	}
-
-	resp := LoginResponse{
-		Number: acc.Number,
-		Token:  token,
-	}
-
-	return WriteJSON(w, http.StatusOK, resp)
-}
-
-func (s *APIServer) handleAccount(w http.ResponseWriter, r *http.Request) error {
-	if r.Method == "GET" {
-		return s.handleGetAccount(w, r)
-	}
-
-	if r.Method == "POST" {
-		return s.handleCreateAccount(w, r)
-	}
-
-	return fmt.Errorf("method not allowed %s", r.Method)
-}
-
-func santizeAccount(account *Account) PublicAccount {
-	return PublicAccount{
-		ID:            account.ID,
-		FirstName:     account.FirstName,
-		LastName:      account.LastName,
-		AccountNumber: account.Number,
-		CreatedAt:     account.CreatedAt,
-	}
-}
-
-// GET /acccount
-func (s *APIServer) handleGetAccount(w http.ResponseWriter, r *http.Request) error {
-	accounts, err := s.store.GetAccounts()
-	if err != nil {
-		return err
-	}
-
-	publicAccounts := make([]PublicAccount, len(accounts))
-	for i, account := range accounts {
-		publicAccounts[i] = santizeAccount(account)
-	}
-
-	return WriteJSON(w, http.StatusOK, publicAccounts)
-}
-
-func (s *APIServer) handleGetAccountByID(w http.ResponseWriter, r *http.Request) error {
-	if r.Method == "GET" {
-
-		id, err := getID(r)
-		if err != nil {
-			return err
-		}
-
-		account, err := s.store.GetAccountbyID(id)
-		if err != nil {
-			return err
-		}
-
-		//db.get(id)
-
-		return WriteJSON(w, http.StatusOK, account)
-	}
-
-	if r.Method == "DELETE" {
-		return s.handleDeleteAccount(w, r)
-	}
-	return fmt.Errorf("Method not allowed %s", r.Method)
-}
-
-func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request) error {
-	req := new(CreateAccountRequest)
-	if err := json.NewDecoder((r.Body)).Decode(req); err != nil {
-		return err
-	}
-
-	account, err := NewAccount(req.FirstName, req.LastName, req.Password)
-
-	if err != nil {
-		return err
-	}
-
-	// Extensive logging
-	fmt.Printf("Account Creation Details:\n")
-	fmt.Printf("First Name: %s\n", account.FirstName)
-	fmt.Printf("Last Name: %s\n", account.LastName)
-	fmt.Printf("Account Number: %d\n", account.Number)
-	fmt.Printf("Created At: %v\n", account.CreatedAt)
-
-	if err := s.store.CreateAccount(account); err != nil {
-		return err
-	}
-
-	return WriteJSON(w, http.StatusOK, account)
-}
-
-func (s *APIServer) handleDeleteAccount(w http.ResponseWriter, r *http.Request) error {
-	id, err := getID(r)
-	if err != nil {
-		return err
-	}
-	if err := s.store.DeleteAccount(id); err != nil {
-		return err
-	}
-	return WriteJSON(w, http.StatusOK, map[string]int{"deleted": id})
-}
-
-func (s *APIServer) handleTransfer(w http.ResponseWriter, r *http.Request) error {
-	//Validate request method
-	if r.Method != "POST" {
-		return fmt.Errorf("Method not allowed %s", r.Method)
-	}
-
-	//Parse transfer request
-	var req TransferRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		return fmt.Errorf("Invalid request payload")
-	}
-	defer r.Body.Close()
-
-	//Validate transfer request
-	if err := s.validateTransfer(req); err != nil {
-		return err
-	}
-
-	//Transaction execution
-	transferResult, err := s.performTransfer(req)
-	if err != nil {
-		return err
-	}
-
-	//Transaction result
-	return WriteJSON(w, http.StatusOK, transferResult)
-}
-
-func (s *APIServer) validateTransfer(req TransferRequest) error {
-	// Validate if amount is positive
-	if req.Amount <= 0 {
-		return fmt.Errorf("transfer amount must be positive")
-	}
-
-	// Fetch source account
-	fromAccount, err := s.store.GetAccountByNumber(req.FromAccountNumber)
-	if err != nil {
-		return fmt.Errorf("invalid source account")
-	}
-
-	// Fetch destination account
-	toAccount, err := s.store.GetAccountByNumber(req.ToAccountNumber)
-	if err != nil {
-		return fmt.Errorf("invalid destination account")
-	}
-
-	// Prevent transfers to the same account
-	if fromAccount.Number == toAccount.Number {
-		return fmt.Errorf("cannot transfer to the same account")
-	}
-
-	// Check for sufficient balance
-	if fromAccount.Balance < int64(req.Amount) {
-		return fmt.Errorf("insufficient balance")
-	}
-
-	return nil
-}
-
-// Performing the actual transfer
-func (s *APIServer) performTransfer(req TransferRequest) (map[string]interface{}, error) {
-	log.Printf("Transfer Request - From: %d, To: %d, Amount: %f",
-		req.FromAccountNumber, req.ToAccountNumber, req.Amount)
-	// Fetch source and destination accounts by number
-	fromAccount, err := s.store.GetAccountByNumber(int64(req.FromAccountNumber))
-	if err != nil {
-		return nil, fmt.Errorf("source account not found")
-	}
-
-	toAccount, err := s.store.GetAccountByNumber(int64(req.ToAccountNumber))
-	if err != nil {
-		return nil, fmt.Errorf("destination account not found")
-	}
-
-	// Begin database transaction
-	tx, err := s.store.BeginTransaction()
-	if err != nil {
-		return nil, fmt.Errorf("could not begin transaction: %v", err)
-	}
-	defer tx.Rollback()
-
-	// Deduct from source account using its ID
-	if err := s.store.UpdateAccountBalance(
-		fromAccount.ID,
-		-req.Amount,
-		tx,
-	); err != nil {
-		return nil, fmt.Errorf("failed to deduct from source account: %v", err)
-	}
-
-	// Add to destination account using its ID
-	if err := s.store.UpdateAccountBalance(
-		toAccount.ID,
-		req.Amount,
-		tx,
-	); err != nil {
-		return nil, fmt.Errorf("failed to credit destination account: %v", err)
-	}
-
-	// Commit transaction
-	if err := tx.Commit(); err != nil {
-		return nil, fmt.Errorf("failed to commit transfer: %v", err)
-	}
-
-	// Prepare transfer receipt
-	return map[string]interface{}{
-		"status":         "success",
-		"from_account":   req.FromAccountNumber,
-		"to_account":     req.ToAccountNumber,
-		"amount":         req.Amount,
-		"transferred_at": time.Now(),
-	}, nil
-}
-
-func getID(r *http.Request) (int, error) {
-	idStr := mux.Vars(r)["id"]
-
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		return id, fmt.Errorf("Invalid account ID %s", idStr)
-	}
-
-	return id, nil
-}
-
-func permissionDenied(w http.ResponseWriter, r *http.Request) {
-	WriteJSON(w, http.StatusForbidden, ApiError{Error: "Permission denied"})
-}
-
-func withJWTAuth(handler http.HandlerFunc, s Storage) http.HandlerFunc {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Println("Calling withJWTAuth middleware")
-
-		// Get the token from header
-		tokenString := r.Header.Get("x-jwt-token")
-		if tokenString == "" {
-			permissionDenied(w, r)
-			return
-		}
-
-		// Validate the token
-		token, err := validateJWT(tokenString)
-		if err != nil {
-			fmt.Printf("JWT Validation Error: %v\n", err)
-			permissionDenied(w, r)
-			return
-		}
-
-		// Ensure token is valid
-		if !token.Valid {
-			fmt.Println("Token is not valid")
-			permissionDenied(w, r)
-			return
-		}
-
-		// Extract claims
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			fmt.Println("Failed to parse claims")
-			permissionDenied(w, r)
-			return
-		}
-
-		// Get the account number from token claims
-		tokenAccountNumber, ok := claims["accountNumber"].(float64)
-		if !ok {
-			fmt.Println("Failed to extract account number from claims")
-			permissionDenied(w, r)
-			return
-		}
-
-		// Get the requested account ID
-		requestedID, err := getID(r)
-		if err != nil {
-			permissionDenied(w, r)
-			return
-		}
-
-		// Find the account by ID
-		account, err := s.GetAccountbyID(requestedID)
-		if err != nil {
-			permissionDenied(w, r)
-			return
-		}
-
-		// Verify the account number matches the token's account number
-		if int64(tokenAccountNumber) != account.Number {
-			fmt.Printf("Token Account Number: %v, Requested Account Number: %v\n",
-				tokenAccountNumber, account.Number)
-			permissionDenied(w, r)
-			return
-		}
-
-		// If all checks pass, proceed with the handler
-		handler(w, r)
-	})
-}
-
-func validateJWT(tokenString string) (*jwt.Token, error) {
-	secret := os.Getenv("JWT_SECRET")
-	fmt.Printf("Validating with secret: %s\n", secret)
-
-	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Check signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-
-		return []byte(secret), nil
-	})
-}
-
-func createJWT(account *Account) (string, error) {
-	claims := jwt.MapClaims{
-		"accountNumber": float64(account.Number),
-		"expiresAt":     15000,
-	}
-
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		return "", fmt.Errorf("JWT_SECRET is not set")
-	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	tokenString, err := token.SignedString([]byte(secret))
-	if err != nil {
-		return "", err
-	}
-
-	fmt.Printf("Created JWT Token:\n")
-	fmt.Printf("Account Number: %d\n", account.Number)
-	fmt.Printf("Token: %s\n", tokenString)
-
-	return tokenString, nil
-}
-
-func seedAccountWithBalance(store Storage, accountNumber int64, initialBalance float64) error {
-	// First, find the account by number
-	account, err := store.GetAccountByNumber(accountNumber)
-	if err != nil {
-		return fmt.Errorf("account not found: %v", err)
-	}
-
-	// Begin a transaction
-	tx, err := store.BeginTransaction()
-	if err != nil {
-		return fmt.Errorf("could not begin transaction: %v", err)
-	}
-	defer tx.Rollback()
-
-	// Update the account balance
-	err = store.UpdateAccountBalance(account.ID, initialBalance, tx)
-	if err != nil {
-		return fmt.Errorf("failed to update account balance: %v", err)
-	}
-
-	// Commit the transaction
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit balance update: %v", err)
-	}
-
-	fmt.Printf("Successfully added %.2f to account %d\n", initialBalance, accountNumber)
-	return nil
-}
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+func WriteJSON(w http.ResponseWriter, status int, v any) error {
+	contentType := "application/json"
+	if _, ok := w.(*decimalAmountsWriter); ok {
+		contentType += "; amounts=string"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(responseValue(w, v))
+}
+
+type apiFunc func(http.ResponseWriter, *http.Request) error
+
+type ApiError struct {
+	Error  string       `json:"error"`
+	Code   string       `json:"code,omitempty"`
+	Fields []FieldError `json:"fields,omitempty"`
+
+	// Set on internal errors, for finding the request in the logs
+	RequestID string `json:"request_id,omitempty"`
+
+	// Set on failed logins while the lockout is enabled
+	RemainingAttempts *int       `json:"remaining_attempts,omitempty"`
+	LockedUntil       *time.Time `json:"locked_until,omitempty"`
+}
+
+// httpError lets handlers choose the status code and error code returned to the client
+type httpError struct {
+	Status int
+	Code   string
+	Msg    string
+}
+
+func (e *httpError) Error() string {
+	return e.Msg
+}
+
+func newHTTPError(status int, code string, format string, args ...any) *httpError {
+	return &httpError{
+		Status: status,
+		Code:   code,
+		Msg:    fmt.Sprintf(format, args...),
+	}
+}
+
+func makeHTTPHandle(f apiFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w = withNegotiatedAmounts(w, r)
+		if err := f(w, r); err != nil {
+			//handle error
+			status, apiErr := apiErrorFor(err)
+			WriteJSON(w, status, apiErr)
+		}
+	}
+}
+
+type APIServer struct {
+	listenAddr     string
+	store          Storage
+	config         *Config
+	transferLimits TransferLimits
+	canary         *canaryRouter
+	notifier       Notifier
+	mailer         Mailer
+	rates          RateProvider
+	cashback       *CashbackProgram
+	dbHealth       *dbHealthChecker
+	enrichment     *EnrichmentPipeline
+	revocations    RevocationList
+	oidc           *oidcLogin
+	stats          *statsCache
+	rateLimiter    *rateLimiter // nil unless RATE_LIMIT_ENABLED
+	analytics      *statsCache
+	backups        BackupTarget
+}
+
+func NewAPIServer(config *Config, store Storage) *APIServer {
+	return &APIServer{
+		listenAddr:     config.ListenAddr,
+		store:          store,
+		config:         config,
+		transferLimits: NewTransferLimits(config),
+		canary:         newCanaryRouter(config),
+		notifier:       logNotifier{},
+		mailer:         logMailer{},
+		rates:          staticRateProvider{},
+		dbHealth:       newDBHealthChecker(store, config),
+		revocations:    NewMemoryRevocationList(),
+		stats:          newStatsCache(config.StatsCacheTTL),
+		analytics:      newStatsCache(config.AnalyticsCacheTTL),
+	}
+}
+
+func (s *APIServer) Run() {
+	shutdownTracing, err := setupTracing(context.Background(), s.config)
+	if err != nil {
+		log.Fatalf("Tracing failed to start: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	rates, err := NewRateProvider(s.config)
+	if err != nil {
+		log.Fatalf("FX rate provider failed to start: %v", err)
+	}
+	s.rates = rates
+
+	if s.notifier, err = NewNotifier(s.config); err != nil {
+		log.Fatalf("Notifier failed to start: %v", err)
+	}
+
+	if s.mailer, err = NewMailer(s.config); err != nil {
+		log.Fatalf("Mailer failed to start: %v", err)
+	}
+
+	if s.revocations, err = NewRevocationList(s.config); err != nil {
+		log.Fatalf("Token revocation list failed to start: %v", err)
+	}
+
+	if s.oidc, err = NewOIDCLogin(context.Background(), s.config); err != nil {
+		log.Fatalf("OIDC provider discovery failed: %v", err)
+	}
+
+	if s.backups, err = NewBackupTarget(s.config); err != nil {
+		log.Fatalf("Backup target failed to start: %v", err)
+	}
+
+	if s.cashback, err = NewCashbackProgram(s.config); err != nil {
+		log.Fatalf("Cashback rules failed to load: %v", err)
+	}
+
+	if s.enrichment, err = NewEnrichmentPipeline(s.config, s.store); err != nil {
+		log.Fatalf("Enrichment pipeline failed to start: %v", err)
+	}
+	if s.enrichment != nil {
+		s.enrichment.Start(context.Background(), s.config.EnrichmentWorkers)
+	}
+
+	engine, err := NewTransferEngine(s.config.TransferEngine, s.store, s.config)
+	if err != nil {
+		log.Fatalf("Transfer engine failed to start: %v", err)
+	}
+
+	router := s.routes(engine)
+
+	if s.dbHealth != nil {
+		s.dbHealth.start(context.Background())
+	}
+
+	if s.config.GRPCListenAddr != "" {
+		go s.serveGRPC(engine)
+	}
+
+	if s.config.TransferMode == TransferModeAsync {
+		s.transferQueue(engine).Start()
+	}
+
+	if s.config.SchedulerEnabled {
+		scheduler := NewScheduler()
+		scheduler.Register(s.scheduledTransferJob(engine))
+		scheduler.Register(s.standingOrderJob(engine))
+		scheduler.Register(s.mandateCollectionJob(engine))
+		scheduler.Register(s.chequeClearingJob())
+		scheduler.Register(s.externalSettlementJob())
+		scheduler.Register(s.overdraftFeeJob())
+		scheduler.Register(s.sweepJob(engine))
+		scheduler.Register(s.financeSnapshotJob())
+		scheduler.Register(s.dormancyJob())
+		scheduler.Register(s.webhookJob())
+		scheduler.Register(s.holdExpiryJob())
+		scheduler.Register(s.feeJob())
+		scheduler.Register(s.statementJob())
+		scheduler.Register(s.erasureJob())
+		if s.config.EODEnabled {
+			scheduler.Register(s.eodJob(engine))
+		}
+		if s.config.ExportSFTPAddr != "" {
+			job, err := s.exportJob()
+			if err != nil {
+				log.Fatalf("Export job failed to start: %v", err)
+			}
+			scheduler.Register(job)
+		}
+		scheduler.Start()
+	}
+
+	var handler http.Handler = s.withConsistency(router)
+	if s.config.RequestJournalEnabled {
+		journal, err := openRequestJournal(s.config)
+		if err != nil {
+			log.Fatalf("Request journal failed to open: %v", err)
+		}
+		handler = withRequestJournal(handler, journal)
+		log.Println("Recording requests to", s.config.RequestJournalPath)
+	}
+
+	handler = withBodyLimit(handler, s.config.MaxBodyBytes)
+
+	if s.config.ForceHTTPS {
+		handler = withHTTPSRedirect(handler)
+	}
+	proxies, err := parseTrustedProxies(s.config.TrustedProxies)
+	if err != nil {
+		log.Fatalf("Trusted proxies failed to parse: %v", err)
+	}
+	handler = withForwardedHeaders(handler, proxies)
+
+	if err := s.serve(withRequestID(handler)); err != nil {
+		log.Fatalf("Server failed to start: %v", err)
+	}
+}
+
+// Routes added here should also be described in openapi.go, API routes go
+// into a version's routeSet and are served under its prefix, see versioning.go
+func (s *APIServer) routes(engine TransferEngine) *mux.Router {
+	router := mux.NewRouter()
+	router.Use(withTracing, withRecovery)
+	router.MethodNotAllowedHandler = methodNotAllowedHandler(router)
+
+	loginHandler := makeHTTPHandle(s.handleLogin)
+	createAccountHandler := makeHTTPHandle(s.handleCreateAccount)
+	forgotHandler := makeHTTPHandle(s.handleForgotPassword)
+
+	if s.config.SignupQuotaEnabled {
+		counter, err := NewQuotaCounter(s.config)
+		if err != nil {
+			log.Fatalf("Signup quota store failed to start: %v", err)
+		}
+
+		createAccountHandler = withSignupQuota(createAccountHandler, &signupQuota{
+			counter:   counter,
+			captcha:   NewCaptchaVerifier(s.config),
+			softLimit: s.config.SignupSoftLimitPerDay,
+			hardLimit: s.config.SignupHardLimitPerDay,
+			config:    s.config,
+		})
+	}
+
+	if s.config.RateLimitEnabled {
+		limiter, err := NewRateLimitStore(s.config)
+		if err != nil {
+			log.Fatalf("Rate limiter failed to start: %v", err)
+		}
+
+		s.rateLimiter = &rateLimiter{store: limiter}
+		loginLimit := perMinute(s.config.LoginRatePerMinute)
+		loginHandler = s.rateLimiter.wrap(loginHandler,
+			rateLimitRule{name: "login-ip", limit: loginLimit, key: rateLimitByIP},
+			rateLimitRule{name: "login-account", limit: loginLimit, key: rateLimitByLoginNumber},
+		)
+		createAccountHandler = s.rateLimiter.wrap(createAccountHandler,
+			rateLimitRule{name: "create-account-ip", limit: perMinute(s.config.AccountRatePerMinute), key: rateLimitByIP},
+		)
+		forgotHandler = s.rateLimiter.wrap(forgotHandler,
+			rateLimitRule{name: "forgot-password-ip", limit: loginLimit, key: rateLimitByIP},
+			rateLimitRule{name: "forgot-password-account", limit: loginLimit, key: rateLimitByLoginNumber},
+		)
+	}
+
+	v1 := newRouteSet(currentAPIVersion)
+	v1.HandleFunc("/login", loginHandler).Methods("POST")
+	v1.HandleFunc("/logout", makeHTTPHandle(s.handleLogout)).Methods("POST")
+	v1.HandleFunc("/me/data-export", makeHTTPHandle(s.handleDataExport)).Methods("GET")
+	v1.HandleFunc("/me", makeHTTPHandle(s.handleRequestErasure)).Methods("DELETE")
+	v1.HandleFunc("/login/oidc", makeHTTPHandle(s.handleOIDCLogin)).Methods("GET")
+	v1.HandleFunc("/login/oidc/callback", makeHTTPHandle(s.handleOIDCCallback)).Methods("GET")
+	v1.HandleFunc("/account", makeHTTPHandle(s.handleGetAccount)).Methods("GET")
+	v1.HandleFunc("/account", createAccountHandler).Methods("POST")
+	v1.HandleFunc("/password/forgot", forgotHandler).Methods("POST")
+	v1.HandleFunc("/password/reset", makeHTTPHandle(s.handleResetPassword)).Methods("POST")
+	v1.HandleFunc("/verify", makeHTTPHandle(s.handleVerifyEmail)).Methods("GET")
+	v1.HandleFunc("/limits", makeHTTPHandle(s.handleGetLimits)).Methods("GET")
+	v1.HandleFunc("/resolve", makeHTTPHandle(s.handleResolveAlias)).Methods("GET")
+	v1.HandleFunc("/account/search", withAdminAuth(makeHTTPHandle(s.handleSearchAccounts), s.config, s.store)).Methods("GET")
+	v1.HandleFunc("/account/{id}", withJWTAuth(makeHTTPHandle(s.handleGetAccountByID), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}", withJWTAuth(makeHTTPHandle(s.handleUpdateAccount), s.store, s.revocations)).Methods("PATCH")
+	v1.HandleFunc("/account/{id}", withJWTAuth(makeHTTPHandle(s.handleCloseAccount), s.store, s.revocations)).Methods("DELETE")
+
+	if s.config.CanaryTransferEngine != "" {
+		canaryEngine, err := NewTransferEngine(s.config.CanaryTransferEngine, s.store, s.config)
+		if err != nil {
+			log.Fatalf("Canary transfer engine failed to start: %v", err)
+		}
+		s.canary.Register("transfer", makeHTTPHandle(s.handleTransfer(canaryEngine)))
+	}
+
+	v1.HandleFunc("/account/{id}/balance", withJWTAuth(makeHTTPHandle(s.handleGetBalanceAt), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/holds", withJWTAuth(makeHTTPHandle(s.handleGetAuthorizations), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/holds", withJWTAuth(makeHTTPHandle(s.handleAuthorize), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/holds/{holdID}/capture", withJWTAuth(makeHTTPHandle(s.handleCaptureAuthorization), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/holds/{holdID}/release", withJWTAuth(makeHTTPHandle(s.handleReleaseAuthorization), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/scheduled-transfers", withJWTAuth(makeHTTPHandle(s.handleGetScheduledTransfers), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/scheduled-transfers", withJWTAuth(makeHTTPHandle(s.handleCreateScheduledTransfer), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/scheduled-transfers/{scheduledID}", withJWTAuth(makeHTTPHandle(s.handleCancelScheduledTransfer), s.store, s.revocations)).Methods("DELETE")
+	v1.HandleFunc("/account/{id}/aliases", withJWTAuth(makeHTTPHandle(s.handleGetAliases), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/aliases", withJWTAuth(makeHTTPHandle(s.handleRegisterAlias), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/aliases/{aliasID}/verify", withJWTAuth(makeHTTPHandle(s.handleVerifyAlias), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/aliases/{aliasID}", withJWTAuth(makeHTTPHandle(s.handleDeleteAlias), s.store, s.revocations)).Methods("DELETE")
+	v1.HandleFunc("/account/{id}/splits", withJWTAuth(makeHTTPHandle(s.handleGetSplits), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/splits", withJWTAuth(makeHTTPHandle(s.handleCreateSplit), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/splits/{splitID}", withJWTAuth(makeHTTPHandle(s.handleGetSplit), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/splits/{splitID}", withJWTAuth(makeHTTPHandle(s.handleCancelSplit), s.store, s.revocations)).Methods("DELETE")
+	v1.HandleFunc("/account/{id}/split-shares", withJWTAuth(makeHTTPHandle(s.handleGetSplitShares), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/split-shares/{shareID}/pay", withJWTAuth(makeHTTPHandle(s.handlePaySplitShare(engine)), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/split-shares/{shareID}/decline", withJWTAuth(makeHTTPHandle(s.handleDeclineSplitShare), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/disputes", withJWTAuth(makeHTTPHandle(s.handleGetAccountDisputes), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/beneficiaries", withJWTAuth(makeHTTPHandle(s.handleGetBeneficiaries), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/beneficiaries", withJWTAuth(makeHTTPHandle(s.handleCreateBeneficiary), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/beneficiaries/{beneficiaryID}", withJWTAuth(makeHTTPHandle(s.handleDeleteBeneficiary), s.store, s.revocations)).Methods("DELETE")
+	v1.HandleFunc("/account/{id}/standing-orders", withJWTAuth(makeHTTPHandle(s.handleGetStandingOrders), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/standing-orders", withJWTAuth(makeHTTPHandle(s.handleCreateStandingOrder), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/standing-orders/{orderID}", withJWTAuth(makeHTTPHandle(s.handleCancelStandingOrder), s.store, s.revocations)).Methods("DELETE")
+	v1.HandleFunc("/account/{id}/standing-orders/{orderID}/pause", withJWTAuth(makeHTTPHandle(s.handlePauseStandingOrder), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/standing-orders/{orderID}/resume", withJWTAuth(makeHTTPHandle(s.handleResumeStandingOrder), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/freeze", withAdminAuth(makeHTTPHandle(s.handleAccountStatus(AccountService.FreezeAccount)), s.config, s.store)).Methods("POST")
+	v1.HandleFunc("/account/{id}/unfreeze", withAdminAuth(makeHTTPHandle(s.handleAccountStatus(AccountService.UnfreezeAccount)), s.config, s.store)).Methods("POST")
+	v1.HandleFunc("/account/{id}/reactivate", withJWTAuth(makeHTTPHandle(s.handleReactivateAccount), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/cards", withJWTAuth(makeHTTPHandle(s.handleGetCards), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/cards", withJWTAuth(makeHTTPHandle(s.handleIssueCard), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/cards/{cardID}/freeze", withJWTAuth(makeHTTPHandle(s.handleCardStatus(CardActive, CardFrozen)), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/cards/{cardID}/unfreeze", withJWTAuth(makeHTTPHandle(s.handleCardStatus(CardFrozen, CardActive)), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/cards/{cardID}/limits", withJWTAuth(makeHTTPHandle(s.handleCardLimits), s.store, s.revocations)).Methods("PUT")
+	v1.HandleFunc("/cards/{cardID}/authorize", withAdminAuth(makeHTTPHandle(s.handleCardAuthorize), s.config, s.store)).Methods("POST")
+	v1.HandleFunc("/account/{id}/cheques", withJWTAuth(makeHTTPHandle(s.handleGetCheques), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/cheques", withJWTAuth(makeHTTPHandle(s.handleDepositCheque), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/external-transfers", withJWTAuth(makeHTTPHandle(s.handleGetExternalTransfers), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/mandates", withJWTAuth(makeHTTPHandle(s.handleGetMandates), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/mandates", withJWTAuth(makeHTTPHandle(s.handleCreateMandate), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/mandates/{mandateID}", withJWTAuth(makeHTTPHandle(s.handleCancelMandate), s.store, s.revocations)).Methods("DELETE")
+	v1.HandleFunc("/account/{id}/mandates/{mandateID}/approve", withJWTAuth(makeHTTPHandle(s.handleApproveMandate), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/mandates/{mandateID}/collections", withJWTAuth(makeHTTPHandle(s.handleGetMandateCollections), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/mandates/{mandateID}/collections", withJWTAuth(makeHTTPHandle(s.handleCreateMandateCollection), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/sweeps", withJWTAuth(makeHTTPHandle(s.handleGetSweepRules), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/sweeps", withJWTAuth(makeHTTPHandle(s.handleCreateSweepRule), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/sweeps/{sweepID}", withJWTAuth(makeHTTPHandle(s.handleCancelSweepRule), s.store, s.revocations)).Methods("DELETE")
+	v1.HandleFunc("/account/{id}/sweeps/{sweepID}/executions", withJWTAuth(makeHTTPHandle(s.handleSweepExecutions), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/subscriptions", withJWTAuth(makeHTTPHandle(s.handleGetEventSubscriptions), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/subscriptions", withJWTAuth(makeHTTPHandle(s.handleCreateEventSubscription), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/subscriptions/{subscriptionID}", withJWTAuth(makeHTTPHandle(s.handleCancelEventSubscription), s.store, s.revocations)).Methods("DELETE")
+	v1.HandleFunc("/account/{id}/transactions", withJWTAuth(makeHTTPHandle(s.handleGetTransactions), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/analytics", withJWTAuth(makeHTTPHandle(s.handleGetAnalytics), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/ws", s.handleWebSocket).Methods("GET")
+	v1.HandleFunc("/account/{id}/events", withJWTAuth(makeHTTPHandle(s.handleStreamEvents), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/events/poll", withJWTAuth(makeHTTPHandle(s.handlePollEvents), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/cashback", withJWTAuth(makeHTTPHandle(s.handleCashback), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/pin", withJWTAuth(makeHTTPHandle(s.handleSetPIN), s.store, s.revocations)).Methods("PUT")
+	v1.HandleFunc("/account/{id}/notifications", withJWTAuth(makeHTTPHandle(s.handleGetNotifications), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/notifications/read", withJWTAuth(makeHTTPHandle(s.handleMarkNotificationsRead), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/preferences", withJWTAuth(makeHTTPHandle(s.handleGetPreferences), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/preferences", withJWTAuth(makeHTTPHandle(s.handleUpdatePreferences), s.store, s.revocations)).Methods("PATCH")
+	v1.HandleFunc("/account/{id}/kyc", withJWTAuth(makeHTTPHandle(s.handleGetKYC), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/kyc", withJWTAuth(makeHTTPHandle(s.handleSubmitKYC), s.store, s.revocations)).Methods("POST")
+	v1.HandleFunc("/account/{id}/overdraft", withJWTAuth(makeHTTPHandle(s.handleGetOverdraft), s.store, s.revocations)).Methods("GET")
+	v1.HandleFunc("/account/{id}/overdraft", withJWTAuth(makeHTTPHandle(s.handleSetOverdraft), s.store, s.revocations)).Methods("PUT")
+	v1.HandleFunc("/admin/accounts/{id}/unlock", withAdminAuth(makeHTTPHandle(s.handleUnlockAccount), s.config, s.store)).Methods("POST")
+	v1.HandleFunc("/admin/accounts/{id}/merge", withAdminAuth(makeHTTPHandle(s.handleMergeAccounts), s.config, s.store)).Methods("POST")
+	v1.HandleFunc("/admin/finance/trial-balance", withAdminAuth(makeHTTPHandle(s.handleTrialBalance), s.config, s.store)).Methods("GET")
+	v1.HandleFunc("/admin/fees", withAdminAuth(makeHTTPHandle(s.handleGetFeeSchedules), s.config, s.store)).Methods("GET")
+	v1.HandleFunc("/admin/fees/{currency}", withAdminAuth(makeHTTPHandle(s.handleGetFeeSchedule), s.config, s.store)).Methods("GET")
+	v1.HandleFunc("/admin/fees/{currency}", withAdminAuth(makeHTTPHandle(s.handleSetFeeSchedule), s.config, s.store)).Methods("PUT")
+	v1.HandleFunc("/admin/stats", withAdminAuth(makeHTTPHandle(s.handleGetStats), s.config, s.store)).Methods("GET")
+	v1.HandleFunc("/admin/stats/transfers", withAdminAuth(makeHTTPHandle(s.handleGetTransferVolume), s.config, s.store)).Methods("GET")
+	v1.HandleFunc("/admin/stats/top-accounts", withAdminAuth(makeHTTPHandle(s.handleGetTopAccounts), s.config, s.store)).Methods("GET")
+	v1.HandleFunc("/admin/backups", withAdminAuth(makeHTTPHandle(s.handleGetBackups), s.config, s.store)).Methods("GET")
+	v1.HandleFunc("/admin/backups", withAdminAuth(makeHTTPHandle(s.handleCreateBackup), s.config, s.store)).Methods("POST")
+	v1.HandleFunc("/admin/finance/daily", withAdminAuth(makeHTTPHandle(s.handleFinanceDaily), s.config, s.store)).Methods("GET")
+	v1.HandleFunc("/admin/exports", withAdminAuth(makeHTTPHandle(s.handleGetExports), s.config, s.store)).Methods("GET")
+	v1.HandleFunc("/admin/accounts/{id}/holds", withAdminAuth(makeHTTPHandle(s.handleGetLegalHolds), s.config, s.store)).Methods("GET")
+	v1.HandleFunc("/admin/accounts/{id}/holds", withAdminAuth(makeHTTPHandle(s.handlePlaceLegalHold), s.config, s.store)).Methods("POST")
+	v1.HandleFunc("/admin/accounts/{id}/holds/{holdID}/release", withAdminAuth(makeHTTPHandle(s.handleReleaseLegalHold), s.config, s.store)).Methods("POST")
+	v1.HandleFunc("/admin/kyc", withAdminAuth(makeHTTPHandle(s.handleGetKYCSubmissions), s.config, s.store)).Methods("GET")
+	v1.HandleFunc("/admin/kyc/{submissionID}/review", withAdminAuth(makeHTTPHandle(s.handleReviewKYC), s.config, s.store)).Methods("POST")
+	v1.HandleFunc("/admin/disputes", withAdminAuth(makeHTTPHandle(s.handleGetDisputes), s.config, s.store)).Methods("GET")
+	v1.HandleFunc("/admin/disputes/{disputeID}/resolve", withAdminAuth(makeHTTPHandle(s.handleResolveDispute), s.config, s.store)).Methods("POST")
+	v1.HandleFunc("/admin/accounts/{id}/adjustments", withAdminAuth(makeHTTPHandle(s.handleAdjustment), s.config, s.store)).Methods("POST")
+	v1.HandleFunc("/admin/exports/{fileName}", withAdminAuth(makeHTTPHandle(s.handleDeleteExport), s.config, s.store)).Methods("DELETE")
+	v1.HandleFunc("/admin/eod", withAdminAuth(makeHTTPHandle(s.handleGetEODRuns), s.config, s.store)).Methods("GET")
+	v1.HandleFunc("/admin/eod/{day}", withAdminAuth(makeHTTPHandle(s.handleGetEODRun), s.config, s.store)).Methods("GET")
+	v1.HandleFunc("/admin/eod/{day}/run", withAdminAuth(makeHTTPHandle(s.handleRunEOD(engine)), s.config, s.store)).Methods("POST")
+	v1.HandleFunc("/admin/eod/{day}/steps/{step}/skip", withAdminAuth(makeHTTPHandle(s.handleSkipEODStep), s.config, s.store)).Methods("POST")
+	v1.HandleFunc("/admin/operations", withAdminAuth(makeHTTPHandle(s.handleGetOperations), s.config, s.store)).Methods("GET")
+	v1.HandleFunc("/admin/operations/{operationID}", withAdminAuth(makeHTTPHandle(s.handleGetOperation), s.config, s.store)).Methods("GET")
+	v1.HandleFunc("/admin/operations/{operationID}/approve", withAdminAuth(makeHTTPHandle(s.handleApproveOperation), s.config, s.store)).Methods("POST")
+	v1.HandleFunc("/admin/accounts/{id}/stream", withAdminAuth(makeHTTPHandle(s.handleGetAccountStream), s.config, s.store)).Methods("GET")
+	v1.HandleFunc("/admin/accounts/{id}/history", withAdminAuth(makeHTTPHandle(s.handleGetAccountHistory), s.config, s.store)).Methods("GET")
+	v1.HandleFunc("/calculators/interest", makeHTTPHandle(s.handleInterestCalculator)).Methods("GET")
+	v1.HandleFunc("/calculators/fees", makeHTTPHandle(s.handleFeeCalculator)).Methods("GET")
+	v1.HandleFunc("/transfer", s.canary.Wrap("transfer", makeHTTPHandle(s.handleTransfer(engine)))).Methods("POST")
+	v1.HandleFunc("/payments/iso20022", makeHTTPHandle(s.handlePaymentInitiation(engine))).Methods("POST")
+	v1.HandleFunc("/transfer/external", makeHTTPHandle(s.handleExternalTransfer)).Methods("POST")
+	v1.HandleFunc("/transfer/{reference}", makeHTTPHandle(s.handleGetTransfer)).Methods("GET")
+	v1.HandleFunc("/transfer/status/{id}", makeHTTPHandle(s.handleGetTransferJob)).Methods("GET")
+	v1.HandleFunc("/transfer/{reference}/approve", withAdminAuth(makeHTTPHandle(s.handleApproveTransfer(engine)), s.config, s.store)).Methods("POST")
+	v1.HandleFunc("/transfer/{reference}/reject", withAdminAuth(makeHTTPHandle(s.handleRejectTransfer), s.config, s.store)).Methods("POST")
+	v1.HandleFunc("/transfer/{reference}/dispute", makeHTTPHandle(s.handleOpenDispute)).Methods("POST")
+	v1.HandleFunc("/transfer/{reference}/dispute", makeHTTPHandle(s.handleGetTransferDispute)).Methods("GET")
+	v1.HandleFunc("/admin/api-keys", withAdminAuth(makeHTTPHandle(s.handleGetAPIKeys), s.config, s.store)).Methods("GET")
+	v1.HandleFunc("/admin/api-keys", withAdminAuth(makeHTTPHandle(s.handleCreateAPIKey), s.config, s.store)).Methods("POST")
+	v1.HandleFunc("/admin/api-keys/{keyID}", withAdminAuth(makeHTTPHandle(s.handleRevokeAPIKey), s.config, s.store)).Methods("DELETE")
+	v1.HandleFunc("/admin/cheques/{chequeID}/bounce", withAdminAuth(makeHTTPHandle(s.handleBounceCheque), s.config, s.store)).Methods("POST")
+	v1.HandleFunc("/admin/transfers/pending", withAdminAuth(makeHTTPHandle(s.handleGetPendingTransfers), s.config, s.store)).Methods("GET")
+	v1.HandleFunc("/admin/fraud/decisions", withAdminAuth(makeHTTPHandle(s.handleGetFraudDecisions), s.config, s.store)).Methods("GET")
+	v1.HandleFunc("/admin/fraud/reviews", withAdminAuth(makeHTTPHandle(s.handleGetFraudReviews), s.config, s.store)).Methods("GET")
+	v1.HandleFunc("/transfer/{reference}/enrichments", makeHTTPHandle(s.handleGetTransferEnrichments)).Methods("GET")
+
+	mountVersions(router, s.config, v1, v1)
+
+	router.HandleFunc("/openapi.json", s.handleOpenAPI).Methods("GET")
+	router.HandleFunc("/.well-known/jwks.json", s.handleJWKS).Methods("GET")
+	router.HandleFunc("/readyz", s.handleReadyz).Methods("GET")
+	router.HandleFunc("/docs", handleDocs).Methods("GET")
+
+	s.registerDebugRoutes(router)
+	s.registerDevRoutes(router)
+
+	return router
+}
+
+// 885978
+func (s *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) error {
+	var req LoginRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+
+	resp, err := s.forRequest(r).accounts().Login(r.Context(), req)
+	if err != nil {
+		return err
+	}
+	s.notifyLogin(r, resp.Number)
+
+	return WriteJSON(w, http.StatusOK, resp)
+}
+
+func santizeAccount(account *Account) PublicAccount {
+	return PublicAccount{
+		ID:            account.ID,
+		FirstName:     account.FirstName,
+		LastName:      account.LastName,
+		AccountNumber: account.Number,
+		Currency:      account.Currency,
+		Status:        account.Status,
+		CreatedAt:     account.CreatedAt,
+	}
+}
+
+// GET /acccount, closed accounts are only listed with ?include_closed=true
+func (s *APIServer) handleGetAccount(w http.ResponseWriter, r *http.Request) error {
+	includeClosed, _ := strconv.ParseBool(r.URL.Query().Get("include_closed"))
+
+	accounts, err := s.forRequest(r).accounts().ListAccounts(r.Context(), includeClosed)
+	if err != nil {
+		return err
+	}
+
+	publicAccounts := make([]PublicAccount, len(accounts))
+	for i, account := range accounts {
+		publicAccounts[i] = santizeAccount(account)
+	}
+
+	return WriteJSON(w, http.StatusOK, publicAccounts)
+}
+
+// GET /account/{id}
+func (s *APIServer) handleGetAccountByID(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	account, err := s.forRequest(r).accounts().GetAccount(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	//db.get(id)
+
+	return writeLocalized(w, r, http.StatusOK, account, account.Currency, accountAmounts(account))
+}
+
+func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request) error {
+	req := new(CreateAccountRequest)
+	if err := decodeRequest(r, req); err != nil {
+		return err
+	}
+
+	s = s.forRequest(r)
+	account, err := s.accounts().CreateAccount(r.Context(), req, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+	s.sendEmailVerification(r.Context(), account)
+
+	return WriteJSON(w, http.StatusOK, account)
+}
+
+// DELETE /account/{id} closes the account, it isn't removed
+func (s *APIServer) handleCloseAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	account, err := s.forRequest(r).accounts().CloseAccount(r.Context(), id, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, account)
+}
+
+// POST /account/{id}/freeze and /account/{id}/unfreeze
+func (s *APIServer) handleAccountStatus(change func(AccountService, context.Context, int, string) (*Account, error)) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		id, err := getID(r)
+		if err != nil {
+			return err
+		}
+
+		account, err := change(s.forRequest(r).accounts(), r.Context(), id, auditActor(r, s.config))
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, account)
+	}
+}
+
+func (s *APIServer) handleTransfer(engine TransferEngine) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		return s.transfer(w, r, engine)
+	}
+}
+
+func (s *APIServer) transfer(w http.ResponseWriter, r *http.Request, engine TransferEngine) error {
+	//Parse transfer request
+	var req TransferRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+
+	// Queued for the transfer workers, the client polls the tracking ID
+	if s.config.TransferMode == TransferModeAsync {
+		job, err := s.forRequest(r).enqueueTransfer(r.Context(), req, auditActor(r, s.config))
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Location", "/v1/transfer/status/"+job.ID)
+		return WriteJSON(w, http.StatusAccepted, job)
+	}
+
+	receipt, usage, err := s.forRequest(r).transfers().Transfer(r.Context(), req, engine, auditActor(r, s.config))
+	if usage != nil {
+		setTransferLimitHeaders(w, s.senderLimits(r.Context(), req.FromAccountNumber), *usage)
+	}
+	if err != nil {
+		return err
+	}
+
+	//Transaction receipt, large transfers are only accepted until approved
+	if receipt.Status == TransferPendingApproval {
+		return WriteJSON(w, http.StatusAccepted, receipt)
+	}
+	return WriteJSON(w, http.StatusOK, receipt)
+}
+
+func getID(r *http.Request) (int, error) {
+	return pathID(r, "id")
+}
+
+func permissionDenied(w http.ResponseWriter, r *http.Request) {
+	WriteJSON(w, http.StatusForbidden, ApiError{Error: "Permission denied"})
+}
+
+func withJWTAuth(handler http.HandlerFunc, s Storage, revocations RevocationList) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Println("Calling withJWTAuth middleware")
+
+		// Get the token from header
+		tokenString := r.Header.Get("x-jwt-token")
+
+		if tokenString == "" {
+			// An API key stands in for the token, its scope decides what it may do
+			if key := requestAPIKey(r, s); key != nil {
+				requestedID, err := getID(r)
+				if err != nil || !key.allowsAccount(requestedID, isWriteMethod(r.Method)) {
+					permissionDenied(w, r)
+					return
+				}
+				handler(w, withAPIKey(r, key))
+				return
+			}
+			permissionDenied(w, r)
+			return
+		}
+
+		// Validate the token
+		token, err := validateJWT(tokenString)
+		if err != nil {
+			fmt.Printf("JWT Validation Error: %v\n", err)
+			permissionDenied(w, r)
+			return
+		}
+
+		// Ensure token is valid
+		if !token.Valid {
+			fmt.Println("Token is not valid")
+			permissionDenied(w, r)
+			return
+		}
+
+		if tokenRevoked(revocations, token) {
+			fmt.Println("Token has been revoked")
+			permissionDenied(w, r)
+			return
+		}
+
+		// Get the account number from token claims
+		tokenAccountNumber, ok := jwtAccountNumber(token)
+		if !ok {
+			fmt.Println("Failed to extract account number from claims")
+			permissionDenied(w, r)
+			return
+		}
+
+		// Get the requested account ID
+		requestedID, err := getID(r)
+		if err != nil {
+			permissionDenied(w, r)
+			return
+		}
+
+		// Find the account by ID
+		account, err := s.GetAccountbyID(r.Context(), requestedID)
+		if err != nil {
+			permissionDenied(w, r)
+			return
+		}
+
+		// Verify the account number matches the token's account number
+		if tokenAccountNumber != account.Number {
+			fmt.Printf("Token Account Number: %v, Requested Account Number: %v\n",
+				tokenAccountNumber, account.Number)
+			permissionDenied(w, r)
+			return
+		}
+
+		// If all checks pass, proceed with the handler
+		handler(w, r)
+	})
+}
+
+func withAdminAuth(handler http.HandlerFunc, cfg *Config, s Storage) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isAdminToken(r.Header.Get("x-admin-token"), cfg) {
+			handler(w, r)
+			return
+		}
+
+		// Admin scoped API keys pass too
+		if key := requestAPIKey(r, s); key != nil && key.Scope == APIKeyScopeAdmin {
+			handler(w, withAPIKey(r, key))
+			return
+		}
+
+		permissionDenied(w, r)
+	})
+}
+
+func isAdminToken(token string, cfg *Config) bool {
+	// An unset admin token disables admin access entirely
+	if cfg.AdminToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) == 1
+}
+
+func jwtAccountNumber(token *jwt.Token) (int64, bool) {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return 0, false
+	}
+
+	number, ok := claims["accountNumber"].(float64)
+	if !ok {
+		return 0, false
+	}
+	return int64(number), true
+}
+
+// tokenAccount is the account the request's x-jwt-token was issued to. An
+// x-api-key stands in for the token like it does in withJWTAuth, the request
+// comes back carrying the key so it's audited as the key.
+func (s *APIServer) tokenAccount(r *http.Request) (*Account, *http.Request, error) {
+	if r.Header.Get("x-jwt-token") == "" {
+		if key := requestAPIKey(r, s.store); key != nil {
+			// Admin keys belong to no account
+			if key.AccountID == nil || !key.allowsAccount(*key.AccountID, isWriteMethod(r.Method)) {
+				return nil, r, newHTTPError(http.StatusForbidden, "PERMISSION_DENIED", "the API key may not do this")
+			}
+			acc, err := s.store.GetAccountbyID(r.Context(), *key.AccountID)
+			return acc, withAPIKey(r, key), err
+		}
+	}
+
+	token, err := validateJWT(r.Header.Get("x-jwt-token"))
+	if err != nil || !token.Valid || tokenRevoked(s.revocations, token) {
+		return nil, r, newHTTPError(http.StatusUnauthorized, "INVALID_TOKEN", "token is invalid or revoked")
+	}
+	number, ok := jwtAccountNumber(token)
+	if !ok {
+		return nil, r, newHTTPError(http.StatusUnauthorized, "INVALID_TOKEN", "token has no account number")
+	}
+	acc, err := s.store.GetAccountByNumber(r.Context(), number)
+	return acc, r, err
+}
+
+// Tokens are issued for this audience, tokens carrying another one are refused
+const jwtAudience = "gobank"
+
+// expiresAt was always meant as 15000 seconds, exp has the parser enforce it
+const jwtTTL = 15000 * time.Second
+
+func validateJWT(tokenString string) (*jwt.Token, error) {
+	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		secret := os.Getenv("JWT_SECRET")
+		fmt.Printf("Validating with secret: %s\n", secret)
+
+		// Check signing method
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		return []byte(secret), nil
+	}
+	if jwtKeys != nil {
+		keyFunc = jwtKeys.keyFunc
+	}
+
+	token, err := jwt.Parse(tokenString, keyFunc)
+	if err != nil {
+		return token, err
+	}
+
+	// Tokens issued before aud was added have none and stay valid until they expire
+	if aud, err := token.Claims.GetAudience(); err != nil || (len(aud) > 0 && !slices.Contains(aud, jwtAudience)) {
+		return token, fmt.Errorf("token audience %v is not %s", aud, jwtAudience)
+	}
+	return token, nil
+}
+
+func jwtClaims(account *Account, now time.Time) jwt.MapClaims {
+	return jwt.MapClaims{
+		"accountNumber": float64(account.Number),
+		"expiresAt":     15000,
+		"aud":           jwtAudience,
+		"iat":           now.Unix(),
+		"exp":           now.Add(jwtTTL).Unix(),
+		"jti":           newTokenID(),
+	}
+}
+
+func signJWT(claims jwt.MapClaims, secret string) (string, error) {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+}
+
+func createJWT(account *Account) (string, error) {
+	var tokenString string
+	var err error
+	if jwtKeys != nil {
+		tokenString, err = jwtKeys.sign(jwtClaims(account, time.Now()))
+	} else if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		tokenString, err = signJWT(jwtClaims(account, time.Now()), secret)
+	} else {
+		return "", fmt.Errorf("JWT_SECRET is not set")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Printf("Created JWT Token:\n")
+	fmt.Printf("Account Number: %d\n", account.Number)
+	fmt.Printf("Token: %s\n", tokenString)
+
+	return tokenString, nil
+}
+
+func seedAccountWithBalance(store Storage, accountNumber int64, initialBalance float64) error {
+	ctx := context.Background()
+
+	// First, find the account by number
+	account, err := store.GetAccountByNumber(ctx, accountNumber)
+	if err != nil {
+		return fmt.Errorf("account not found: %v", err)
+	}
+
+	// Begin a transaction
+	tx, err := store.BeginTransaction(ctx)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// Fund the account from outside the ledger
+	err = store.PostLedgerEntry(ctx, fundingEntry(ctx, account, toCents(initialBalance)), tx)
+	if err != nil {
+		return fmt.Errorf("failed to update account balance: %v", err)
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit balance update: %v", err)
+	}
+
+	fmt.Printf("Successfully added %.2f to account %d\n", initialBalance, accountNumber)
+	return nil
+}
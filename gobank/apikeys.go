@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Integrations and cron jobs authenticate with an API key in x-api-key
+// instead of logging in. Admins mint keys with one of three scopes: read
+// keys may only GET their account's routes, transfer keys may use all of
+// their account's routes, admin keys pass wherever x-admin-token does and
+// act on any account. A key is shown once when it's created, only its
+// SHA-256 is stored. Keys are revoked, never edited.
+
+const (
+	AuditAPIKeyCreated = "api_key.created"
+	AuditAPIKeyRevoked = "api_key.revoked"
+
+	apiKeyPrefix = "gbk_"
+)
+
+type APIKeyScope string
+
+const (
+	APIKeyScopeRead     APIKeyScope = "read"
+	APIKeyScopeTransfer APIKeyScope = "transfer"
+	APIKeyScopeAdmin    APIKeyScope = "admin"
+)
+
+type APIKey struct {
+	ID         int         `json:"id"`
+	Name       string      `json:"name"`
+	Scope      APIKeyScope `json:"scope"`
+	AccountID  *int        `json:"account_id,omitempty"` // nil for admin keys
+	Prefix     string      `json:"prefix"`               // identifies the key in listings
+	KeyHash    string      `json:"-"`
+	CreatedBy  string      `json:"created_by"`
+	CreatedAt  time.Time   `json:"created_at"`
+	LastUsedAt *time.Time  `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time  `json:"revoked_at,omitempty"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name      string `json:"name" validate:"required,max=100"`
+	Scope     string `json:"scope" validate:"required,oneof=read transfer admin"`
+	AccountID int    `json:"account_id" validate:"min=0"`
+}
+
+// CreateAPIKeyResponse carries the only copy of the key
+type CreateAPIKeyResponse struct {
+	APIKey *APIKey `json:"api_key"`
+	Key    string  `json:"key"`
+}
+
+type APIKeyService interface {
+	Create(ctx context.Context, req CreateAPIKeyRequest, actor string) (*CreateAPIKeyResponse, error)
+	List(ctx context.Context) ([]*APIKey, error)
+	Revoke(ctx context.Context, id int, actor string) (*APIKey, error)
+	Authenticate(ctx context.Context, key string) (*APIKey, error)
+}
+
+type apiKeyService struct {
+	store Storage
+}
+
+func NewAPIKeyService(store Storage) APIKeyService {
+	return &apiKeyService{store: store}
+}
+
+func (s *APIServer) apiKeys() APIKeyService {
+	return NewAPIKeyService(s.store)
+}
+
+func newAPIKey() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return apiKeyPrefix + hex.EncodeToString(b)
+}
+
+// auditAccount is the account an API key's audit entries go under, 0 for admin keys
+func (k *APIKey) auditAccount() int {
+	if k.AccountID == nil {
+		return 0
+	}
+	return *k.AccountID
+}
+
+func (s *apiKeyService) Create(ctx context.Context, req CreateAPIKeyRequest, actor string) (*CreateAPIKeyResponse, error) {
+	scope := APIKeyScope(req.Scope)
+	key := &APIKey{Name: req.Name, Scope: scope, CreatedBy: actor, CreatedAt: time.Now().UTC()}
+	switch {
+	case scope == APIKeyScopeAdmin && req.AccountID != 0:
+		return nil, invalidField("account_id", "excluded", "admin keys aren't bound to an account")
+	case scope != APIKeyScopeAdmin && req.AccountID == 0:
+		return nil, invalidField("account_id", "required", "read and transfer keys are bound to an account")
+	case scope != APIKeyScopeAdmin:
+		if _, err := s.store.GetAccountbyID(ctx, req.AccountID); err != nil {
+			return nil, err
+		}
+		key.AccountID = &req.AccountID
+	}
+
+	raw := newAPIKey()
+	key.KeyHash = hashResetToken(raw)
+	key.Prefix = raw[:len(apiKeyPrefix)+8]
+	if err := s.store.CreateAPIKey(ctx, key); err != nil {
+		return nil, err
+	}
+	recordAudit(ctx, s.store, actor, key.auditAccount(), AuditAPIKeyCreated, []FieldChange{
+		{Field: "api_key", Old: "", New: key.Prefix + " (" + string(key.Scope) + ")"},
+	})
+	return &CreateAPIKeyResponse{APIKey: key, Key: raw}, nil
+}
+
+func (s *apiKeyService) List(ctx context.Context) ([]*APIKey, error) {
+	return s.store.ListAPIKeys(ctx)
+}
+
+func (s *apiKeyService) Revoke(ctx context.Context, id int, actor string) (*APIKey, error) {
+	key, err := s.store.RevokeAPIKey(ctx, id, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	recordAudit(ctx, s.store, actor, key.auditAccount(), AuditAPIKeyRevoked, []FieldChange{
+		{Field: "api_key", Old: key.Prefix + " (" + string(key.Scope) + ")", New: "revoked"},
+	})
+	return key, nil
+}
+
+// Authenticate resolves a presented key, revoked and unknown keys are both ErrAPIKeyNotFound
+func (s *apiKeyService) Authenticate(ctx context.Context, raw string) (*APIKey, error) {
+	if !strings.HasPrefix(raw, apiKeyPrefix) {
+		return nil, ErrAPIKeyNotFound
+	}
+	key, err := s.store.GetAPIKeyByHash(ctx, hashResetToken(raw))
+	if err != nil {
+		return nil, err
+	}
+	if key.RevokedAt != nil {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	// Last use is informational, it shouldn't fail the request
+	if err := s.store.TouchAPIKey(ctx, key.ID, time.Now().UTC()); err != nil {
+		log.Printf("Failed to record use of API key %d: %v", key.ID, err)
+	}
+	return key, nil
+}
+
+// allowsAccount tells whether the key may read, or with write also change, the account
+func (k *APIKey) allowsAccount(accountID int, write bool) bool {
+	switch k.Scope {
+	case APIKeyScopeAdmin:
+		return true
+	case APIKeyScopeRead:
+		if write {
+			return false
+		}
+	}
+	return k.AccountID != nil && *k.AccountID == accountID
+}
+
+func isWriteMethod(method string) bool {
+	return method != "GET" && method != "HEAD"
+}
+
+type apiKeyContextKey struct{}
+
+// requestAPIKey authenticates the request's x-api-key, nil when there's no usable key
+func requestAPIKey(r *http.Request, store Storage) *APIKey {
+	raw := r.Header.Get("x-api-key")
+	if raw == "" {
+		return nil
+	}
+	key, err := NewAPIKeyService(store).Authenticate(r.Context(), raw)
+	if err != nil {
+		log.Printf("API key rejected: %v", err)
+		return nil
+	}
+	return key
+}
+
+func withAPIKey(r *http.Request, key *APIKey) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key))
+}
+
+func apiKeyFromContext(ctx context.Context) *APIKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*APIKey)
+	return key
+}
+
+// GET /admin/api-keys
+func (s *APIServer) handleGetAPIKeys(w http.ResponseWriter, r *http.Request) error {
+	keys, err := s.apiKeys().List(r.Context())
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, keys)
+}
+
+// POST /admin/api-keys
+func (s *APIServer) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) error {
+	var req CreateAPIKeyRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+	key, err := s.apiKeys().Create(r.Context(), req, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusCreated, key)
+}
+
+// DELETE /admin/api-keys/{keyID}
+func (s *APIServer) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "keyID")
+	if err != nil {
+		return err
+	}
+	key, err := s.apiKeys().Revoke(r.Context(), id, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, key)
+}
+
+func apiKeyActor(key *APIKey) string {
+	return "api_key:" + strconv.Itoa(key.ID)
+}
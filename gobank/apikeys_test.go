@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIKeyScopes(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	for _, number := range []int64{9951, 9952} {
+		acc, err := NewAccount("Kay", "Keys", "password")
+		require.Nil(t, err)
+		acc.Number = number
+		require.Nil(t, store.CreateAccount(ctx, acc))
+	}
+	s := NewAPIServer(&Config{AdminToken: "admin"}, store)
+
+	mint := func(req CreateAPIKeyRequest) (int, CreateAPIKeyResponse) {
+		body, _ := json.Marshal(req)
+		r := httptest.NewRequest("POST", "/v1/admin/api-keys", bytes.NewReader(body))
+		r.Header.Set("x-admin-token", "admin")
+		w := httptest.NewRecorder()
+		withAdminAuth(makeHTTPHandle(s.handleCreateAPIKey), s.config, store)(w, r)
+		var resp CreateAPIKeyResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+	account := func(method string, id int, key string) int {
+		r := mux.SetURLVars(httptest.NewRequest(method, "/v1/account/"+strconv.Itoa(id), nil), map[string]string{"id": strconv.Itoa(id)})
+		r.Header.Set("x-api-key", key)
+		w := httptest.NewRecorder()
+		withJWTAuth(makeHTTPHandle(s.handleGetAccountByID), store, s.revocations)(w, r)
+		return w.Code
+	}
+
+	code, read := mint(CreateAPIKeyRequest{Name: "statements cron", Scope: "read", AccountID: 1})
+	require.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, read.APIKey.Prefix, read.Key[:len(read.APIKey.Prefix)])
+	assert.NotContains(t, store.apiKeys[0].KeyHash, read.Key, "only the hash is stored")
+
+	assert.Equal(t, http.StatusOK, account("GET", 1, read.Key))
+	assert.Equal(t, http.StatusForbidden, account("GET", 2, read.Key), "keys are bound to their account")
+	assert.Equal(t, http.StatusForbidden, account("DELETE", 1, read.Key), "read keys can't change anything")
+	assert.Equal(t, http.StatusForbidden, account("GET", 1, "gbk_unknown"))
+	assert.NotNil(t, store.apiKeys[0].LastUsedAt)
+
+	code, _ = mint(CreateAPIKeyRequest{Name: "no account", Scope: "transfer"})
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	// Admin keys pass the admin routes and reach any account
+	code, admin := mint(CreateAPIKeyRequest{Name: "ops", Scope: "admin"})
+	require.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, http.StatusOK, account("GET", 2, admin.Key))
+	r := httptest.NewRequest("GET", "/v1/admin/api-keys", nil)
+	r.Header.Set("x-api-key", admin.Key)
+	w := httptest.NewRecorder()
+	withAdminAuth(makeHTTPHandle(s.handleGetAPIKeys), s.config, store)(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), admin.Key)
+
+	r = httptest.NewRequest("GET", "/v1/admin/api-keys", nil)
+	r.Header.Set("x-api-key", read.Key)
+	w = httptest.NewRecorder()
+	withAdminAuth(makeHTTPHandle(s.handleGetAPIKeys), s.config, store)(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Revoked keys stop working, revoking is done by the admin key here
+	r = mux.SetURLVars(httptest.NewRequest("DELETE", "/v1/admin/api-keys/1", nil), map[string]string{"keyID": "1"})
+	r.Header.Set("x-api-key", admin.Key)
+	w = httptest.NewRecorder()
+	withAdminAuth(makeHTTPHandle(s.handleRevokeAPIKey), s.config, store)(w, r)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, http.StatusForbidden, account("GET", 1, read.Key))
+
+	last := store.audit[len(store.audit)-1]
+	assert.Equal(t, AuditAPIKeyRevoked, last.Action)
+	assert.Equal(t, "api_key:2", last.Actor)
+}
+
+func TestAPIKeyTokenAccount(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	payer := &Account{FirstName: "Kay", Number: 9961, Balance: 10000, Currency: "USD", Status: AccountActive, EmailVerified: true}
+	require.Nil(t, store.CreateAccount(ctx, payer))
+	require.Nil(t, store.CreateAccount(ctx, &Account{FirstName: "Lee", Number: 9962, Currency: "USD", Status: AccountActive}))
+
+	s := NewAPIServer(&Config{DailyTransferAmount: 500}, store)
+	s.notifier = &capturingNotifier{}
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	receipt, _, err := s.transfers().Transfer(ctx, TransferRequest{FromAccountNumber: 9961, ToAccountNumber: 9962, Amount: 30}, engine, "test")
+	require.Nil(t, err)
+
+	mint := func(scope string, accountID int) string {
+		resp, err := s.apiKeys().Create(ctx, CreateAPIKeyRequest{Name: scope, Scope: scope, AccountID: accountID}, "admin")
+		require.Nil(t, err)
+		return resp.Key
+	}
+	read, transfer, admin := mint("read", payer.ID), mint("transfer", payer.ID), mint("admin", 0)
+	call := func(handler apiFunc, method, path, key, body string) *httptest.ResponseRecorder {
+		r := mux.SetURLVars(httptest.NewRequest(method, path, bytes.NewBufferString(body)), map[string]string{"reference": receipt.Reference})
+		r.Header.Set("x-api-key", key)
+		w := httptest.NewRecorder()
+		makeHTTPHandle(handler)(w, r)
+		return w
+	}
+
+	w := call(s.handleGetLimits, "GET", "/limits", read, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	limits := &CallerLimits{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), limits))
+	require.NotNil(t, limits.Transfers, "the key's account")
+	assert.Equal(t, 30.0, limits.Transfers.AmountUsed)
+
+	dispute := "/transfer/" + receipt.Reference + "/dispute"
+	w = call(s.handleOpenDispute, "POST", dispute, read, `{"reason": "not mine"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code, "read keys can't change anything")
+	w = call(s.handleOpenDispute, "POST", dispute, transfer, `{"reason": "not mine"}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	assert.Equal(t, "api_key:2", store.audit[len(store.audit)-1].Actor)
+	w = call(s.handleGetTransferDispute, "GET", dispute, read, "")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = call(s.handleGetTransferDispute, "GET", dispute, admin, "")
+	assert.Equal(t, http.StatusForbidden, w.Code, "admin keys have no account")
+	w = call(s.handleGetTransferDispute, "GET", dispute, "gbk_unknown", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
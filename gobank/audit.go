@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   any    `json:"old"`
+	New   any    `json:"new"`
+}
+
+type AuditEntry struct {
+	ID        int           `json:"id"`
+	AccountID int           `json:"account_id"`
+	Actor     string        `json:"actor"`
+	Action    string        `json:"action"`
+	Changes   []FieldChange `json:"changes"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+const (
+	AuditAccountCreated = "account.created"
+	AuditAccountUpdated = "account.updated"
+	AuditAccountDeleted = "account.deleted"
+	AuditAccountClosed  = "account.closed"
+	AuditBalanceChanged = "balance.changed"
+)
+
+// auditedFields lists the account fields tracked in the audit log.
+// Credentials are deliberately left out.
+var auditedFields = []struct {
+	name  string
+	value func(*Account) any
+}{
+	{"first_name", func(a *Account) any { return a.FirstName }},
+	{"last_name", func(a *Account) any { return a.LastName }},
+	{"account_number", func(a *Account) any { return a.Number }},
+	{"balance", func(a *Account) any { return a.Balance }},
+	{"status", func(a *Account) any { return a.Status }},
+	{"overdraft_limit", func(a *Account) any { return a.OverdraftLimit }},
+	{"merged_into", func(a *Account) any { return a.MergedInto }},
+	{"email", func(a *Account) any { return a.Email }},
+	{"email_verified", func(a *Account) any { return a.EmailVerified }},
+	{"nickname", func(a *Account) any { return a.Nickname }},
+}
+
+// diffAccounts returns the audited fields that differ, a nil before means the account is new
+func diffAccounts(before, after *Account) []FieldChange {
+	changes := []FieldChange{}
+	for _, f := range auditedFields {
+		var old, new any
+		if before != nil {
+			old = f.value(before)
+		}
+		if after != nil {
+			new = f.value(after)
+		}
+		if old != new {
+			changes = append(changes, FieldChange{Field: f.name, Old: old, New: new})
+		}
+	}
+	return changes
+}
+
+// Identifies who made a request for the audit log
+func auditActor(r *http.Request, cfg *Config) string {
+	if key := apiKeyFromContext(r.Context()); key != nil {
+		return apiKeyActor(key)
+	}
+
+	if token, err := validateJWT(r.Header.Get("x-jwt-token")); err == nil && token.Valid {
+		if number, ok := jwtAccountNumber(token); ok {
+			return "account:" + strconv.FormatInt(number, 10)
+		}
+	}
+
+	if r.Header.Get("x-admin-token") != "" && isAdminToken(r.Header.Get("x-admin-token"), cfg) {
+		return "admin"
+	}
+
+	return "anonymous@" + clientIP(r)
+}
+
+func recordAudit(ctx context.Context, store Storage, actor string, accountID int, action string, changes []FieldChange) {
+	entry := &AuditEntry{
+		AccountID: accountID,
+		Actor:     actor,
+		Action:    action,
+		Changes:   changes,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	// The operation already happened, a failed audit write shouldn't fail the request
+	if err := store.RecordAudit(ctx, entry, nil); err != nil {
+		log.Printf("Failed to write audit entry %s for account %d: %v", action, accountID, err)
+	}
+}
+
+func auditBalanceChange(ctx context.Context, store Storage, actor string, before *Account, delta int64) {
+	after := *before
+	after.Balance += delta
+	recordAudit(ctx, store, actor, before.ID, AuditBalanceChanged, diffAccounts(before, &after))
+	publishBalanceChange(ctx, store, before, delta)
+}
+
+// GET /admin/accounts/{id}/history
+func (s *APIServer) handleGetAccountHistory(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	entries, err := s.forRequest(r).store.GetAuditLog(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, entries)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffAccounts(t *testing.T) {
+	before, err := NewAccount("Ada", "Audit", "password")
+	require.Nil(t, err)
+	before.Number = 7801
+
+	same := *before
+	assert.Empty(t, diffAccounts(before, &same))
+
+	after := *before
+	after.LastName, after.Balance, after.Nickname = "Lovelace", 500, "savings"
+	assert.Equal(t, []FieldChange{
+		{Field: "last_name", Old: "Audit", New: "Lovelace"},
+		{Field: "balance", Old: int64(0), New: int64(500)},
+		{Field: "nickname", Old: "", New: "savings"},
+	}, diffAccounts(before, &after))
+
+	// A new account lists every audited field, the password is never one of them
+	rehashed, err := NewAccount("Ada", "Audit", "another password")
+	require.Nil(t, err)
+	after.EncryptedPassword = rehashed.EncryptedPassword
+	assert.Len(t, diffAccounts(before, &after), 3, "a password change isn't audited")
+	created := diffAccounts(nil, before)
+	assert.Len(t, created, len(auditedFields))
+	for _, change := range created {
+		assert.NotContains(t, change.Field, "password")
+		assert.NotEqual(t, before.EncryptedPassword, change.New)
+	}
+}
+
+func TestHandleGetAccountHistory(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	from := &Account{Number: 7811, Balance: 5000, Currency: "USD"}
+	to := &Account{Number: 7812, Currency: "USD"}
+	require.Nil(t, store.CreateAccount(ctx, from))
+	require.Nil(t, store.CreateAccount(ctx, to))
+	recordAudit(ctx, store, "admin", from.ID, AuditAccountCreated, diffAccounts(nil, from))
+	recordAudit(ctx, store, "admin", to.ID, AuditAccountCreated, diffAccounts(nil, to))
+
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	s := NewAPIServer(&Config{}, store)
+	_, _, err = s.transfers().Transfer(ctx, TransferRequest{FromAccountNumber: 7811, ToAccountNumber: 7812, Amount: 20}, engine, "account:7811")
+	require.Nil(t, err)
+	recordAudit(ctx, store, "admin", from.ID, AuditAccountClosed, nil)
+
+	history := func(id int) []*AuditEntry {
+		r := mux.SetURLVars(httptest.NewRequest("GET", "/v1/admin/accounts/"+strconv.Itoa(id)+"/history", nil), map[string]string{"id": strconv.Itoa(id)})
+		w := httptest.NewRecorder()
+		makeHTTPHandle(s.handleGetAccountHistory)(w, r)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var entries []*AuditEntry
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &entries))
+		return entries
+	}
+
+	entries := history(from.ID)
+	require.Len(t, entries, 3)
+	var actions []string
+	for _, e := range entries {
+		assert.Equal(t, from.ID, e.AccountID)
+		actions = append(actions, e.Action)
+	}
+	assert.Equal(t, []string{AuditAccountCreated, AuditBalanceChanged, AuditAccountClosed}, actions)
+	assert.Equal(t, "account:7811", entries[1].Actor)
+	assert.Equal(t, []FieldChange{{Field: "balance", Old: 5000.0, New: 3000.0}}, entries[1].Changes)
+
+	entries = history(to.ID)
+	require.Len(t, entries, 2)
+	assert.Equal(t, AuditBalanceChanged, entries[1].Action)
+	assert.Equal(t, []FieldChange{{Field: "balance", Old: 0.0, New: 2000.0}}, entries[1].Changes)
+
+	assert.Empty(t, history(999))
+}
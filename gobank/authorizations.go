@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// An authorization hold reserves funds for a payment that hasn't settled
+// yet, like a card authorization. It comes out of the available balance but
+// leaves the booked balance alone until it's captured, which books up to the
+// authorized amount against the clearing ledger. Released and expired holds
+// give the funds back without booking anything.
+
+const (
+	TransferKindHoldCapture = "hold_capture"
+	LedgerHoldClearing      = "clearing:authorizations"
+
+	// How long a hold lasts when it's placed without expires_at
+	authorizationTTL = 7 * 24 * time.Hour
+
+	AuditAuthorizationPlaced   = "authorization.placed"
+	AuditAuthorizationCaptured = "authorization.captured"
+	AuditAuthorizationReleased = "authorization.released"
+)
+
+type AuthorizeRequest struct {
+	Amount    float64    `json:"amount" validate:"positive"`
+	Reference string     `json:"reference" validate:"required,max=100"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	PIN       string     `json:"pin,omitempty" validate:"numeric,min=4,max=6"`
+}
+
+// CaptureRequest books Amount of the hold, the whole hold when it's zero
+type CaptureRequest struct {
+	Amount float64 `json:"amount" validate:"min=0"`
+}
+
+type Authorizations struct {
+	AccountID        int            `json:"account_id"`
+	Balance          int64          `json:"balance"`
+	AvailableBalance int64          `json:"available_balance"`
+	Holds            []*Reservation `json:"holds"`
+}
+
+// spendable is the available balance less legal holds and active reservations
+func spendable(ctx context.Context, store Storage, acc *Account) (int64, error) {
+	holds, err := store.GetLegalHolds(ctx, acc.ID, true)
+	if err != nil {
+		return 0, fmt.Errorf("could not load legal holds: %v", err)
+	}
+	reservations, err := store.GetReservations(ctx, acc.ID, true)
+	if err != nil {
+		return 0, fmt.Errorf("could not load reservations: %v", err)
+	}
+	return max(availableBalance(acc, holds)-reservedAmount(reservations, time.Now()), 0), nil
+}
+
+// withAvailableBalance fills in the account's available balance next to the booked one
+func withAvailableBalance(ctx context.Context, store Storage, acc *Account) (*Account, error) {
+	available, err := spendable(ctx, store, acc)
+	if err != nil {
+		return nil, err
+	}
+	acc.AvailableBalance = &available
+	return acc, nil
+}
+
+func (s *accountService) GetAuthorizations(ctx context.Context, id int) (*Authorizations, error) {
+	acc, err := s.store.GetAccountbyID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	reservations, err := s.store.GetReservations(ctx, id, false)
+	if err != nil {
+		return nil, err
+	}
+	available, err := spendable(ctx, s.store, acc)
+	if err != nil {
+		return nil, err
+	}
+
+	holds := []*Reservation{}
+	for _, r := range reservations {
+		if r.Kind == ReservationAuthorization {
+			holds = append(holds, r)
+		}
+	}
+	return &Authorizations{AccountID: id, Balance: acc.Balance, AvailableBalance: available, Holds: holds}, nil
+}
+
+func (s *accountService) Authorize(ctx context.Context, id int, req AuthorizeRequest, actor string) (*Reservation, error) {
+	now := time.Now().UTC()
+	expires := now.Add(authorizationTTL)
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(now) {
+			return nil, invalidField("expires_at", "future", "expires_at must be in the future")
+		}
+		expires = req.ExpiresAt.UTC()
+	}
+
+	acc, err := s.store.GetAccountbyID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAccountUsable(acc); err != nil {
+		return nil, err
+	}
+	amount := toCents(req.Amount)
+	if err := checkAvailable(ctx, s.store, acc, amount); err != nil {
+		return nil, err
+	}
+
+	hold := &Reservation{
+		AccountID: id,
+		Amount:    amount,
+		Currency:  acc.Currency,
+		Kind:      ReservationAuthorization,
+		Reference: strings.TrimSpace(req.Reference),
+		Status:    ReservationActive,
+		CreatedAt: now,
+		ExpiresAt: &expires,
+	}
+	if err := s.store.CreateReservation(ctx, hold); err != nil {
+		return nil, err
+	}
+	recordAudit(ctx, s.store, actor, id, AuditAuthorizationPlaced, []FieldChange{{Field: "authorization", Old: nil, New: hold.ID}})
+	return hold, nil
+}
+
+// authorization loads an active authorization hold on the account
+func (s *accountService) authorization(ctx context.Context, id, holdID int) (*Reservation, error) {
+	hold, err := s.store.GetReservation(ctx, holdID)
+	if err != nil {
+		return nil, err
+	}
+	if hold.AccountID != id || hold.Kind != ReservationAuthorization {
+		return nil, fmt.Errorf("%w: %d", ErrHoldNotFound, holdID)
+	}
+	if !hold.active(time.Now()) {
+		return nil, fmt.Errorf("%w: %d is %s", ErrHoldResolved, holdID, hold.Status)
+	}
+	return hold, nil
+}
+
+// CaptureAuthorization books the captured amount and releases the rest of the hold
+func (s *accountService) CaptureAuthorization(ctx context.Context, id, holdID int, req CaptureRequest, actor string) (*Reservation, error) {
+	hold, err := s.authorization(ctx, id, holdID)
+	if err != nil {
+		return nil, err
+	}
+	amount := hold.Amount
+	if req.Amount > 0 {
+		amount = toCents(req.Amount)
+	}
+	if amount > hold.Amount {
+		return nil, invalidField("amount", "max", fmt.Sprintf("amount must not exceed the authorized %.2f", float64(hold.Amount)/100))
+	}
+
+	// Claiming the hold first means it no longer counts against the balance
+	// it's being captured from, and a second capture can't book it twice
+	now := time.Now().UTC()
+	hold.Status, hold.Captured, hold.ResolvedAt = ReservationCaptured, amount, &now
+	claimed, err := s.store.ResolveReservation(ctx, hold, ReservationActive)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, fmt.Errorf("%w: %d", ErrHoldResolved, holdID)
+	}
+
+	acc, err := s.bookCapture(ctx, hold)
+	if err != nil {
+		hold.Status, hold.Captured, hold.ResolvedAt = ReservationActive, 0, nil
+		if _, rerr := s.store.ResolveReservation(ctx, hold, ReservationCaptured); rerr != nil {
+			log.Printf("Failed to restore authorization %d after a failed capture: %v", holdID, rerr)
+		}
+		return nil, err
+	}
+
+	auditBalanceChange(ctx, s.store, actor, acc, -amount)
+	recordAudit(ctx, s.store, actor, id, AuditAuthorizationCaptured, []FieldChange{{Field: "authorization", Old: hold.ID, New: amount}})
+	return hold, nil
+}
+
+func (s *accountService) bookCapture(ctx context.Context, hold *Reservation) (*Account, error) {
+	for attempt := 1; ; attempt++ {
+		acc, err := s.store.GetAccountbyID(ctx, hold.AccountID)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkAvailable(ctx, s.store, acc, hold.Captured); err != nil {
+			return nil, err
+		}
+
+		entry := newLedgerEntry(ctx, TransferKindHoldCapture).
+			account(acc, -hold.Captured).
+			ledger(LedgerHoldClearing, hold.Currency, hold.Captured)
+		entry.Memo = hold.Reference
+		err = s.store.PostLedgerEntry(ctx, entry, nil)
+		if err == nil {
+			return acc, nil
+		}
+		if !errors.Is(err, ErrConflict) || attempt == transferConflictRetries {
+			return nil, err
+		}
+	}
+}
+
+func (s *accountService) ReleaseAuthorization(ctx context.Context, id, holdID int, actor string) (*Reservation, error) {
+	hold, err := s.authorization(ctx, id, holdID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	hold.Status, hold.ResolvedAt = ReservationReleased, &now
+	released, err := s.store.ResolveReservation(ctx, hold, ReservationActive)
+	if err != nil {
+		return nil, err
+	}
+	if !released {
+		return nil, fmt.Errorf("%w: %d", ErrHoldResolved, holdID)
+	}
+	recordAudit(ctx, s.store, actor, id, AuditAuthorizationReleased, []FieldChange{{Field: "authorization", Old: hold.ID, New: nil}})
+	return hold, nil
+}
+
+// holdExpiryJob marks reservations past their expiry as expired. They
+// stopped counting against the balance when they expired, this keeps the
+// records in step.
+func (s *APIServer) holdExpiryJob() Job {
+	return Job{
+		Name:     "hold_expiry",
+		Interval: s.config.SchedulerInterval,
+		Run: func(ctx context.Context) error {
+			expired, err := s.store.ExpireReservations(ctx, time.Now().UTC())
+			if err != nil {
+				return err
+			}
+			if expired > 0 {
+				log.Printf("Expired %d holds", expired)
+			}
+			return nil
+		},
+	}
+}
+
+// GET /account/{id}/holds
+func (s *APIServer) handleGetAuthorizations(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	holds, err := s.forRequest(r).accounts().GetAuthorizations(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, holds)
+}
+
+// POST /account/{id}/holds
+func (s *APIServer) handleAuthorize(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	s = s.forRequest(r)
+
+	var req AuthorizeRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+	acc, err := s.store.GetAccountbyID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if err := checkTransactionPIN(r.Context(), s.store, s.transferLimits.PIN, acc, toCents(req.Amount), req.PIN); err != nil {
+		return err
+	}
+	hold, err := s.accounts().Authorize(r.Context(), id, req, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusCreated, hold)
+}
+
+// POST /account/{id}/holds/{holdID}/capture
+func (s *APIServer) handleCaptureAuthorization(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	hid, err := pathID(r, "holdID")
+	if err != nil {
+		return err
+	}
+	var req CaptureRequest
+	if r.ContentLength != 0 {
+		if err := decodeRequest(r, &req); err != nil {
+			return err
+		}
+	}
+
+	hold, err := s.forRequest(r).accounts().CaptureAuthorization(r.Context(), id, hid, req, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, hold)
+}
+
+// POST /account/{id}/holds/{holdID}/release
+func (s *APIServer) handleReleaseAuthorization(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	hid, err := pathID(r, "holdID")
+	if err != nil {
+		return err
+	}
+
+	hold, err := s.forRequest(r).accounts().ReleaseAuthorization(r.Context(), id, hid, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, hold)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthorizationHolds(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9601, Balance: 10000, Currency: "USD"}))
+	accounts := NewAccountService(store)
+
+	hold, err := accounts.Authorize(ctx, 1, AuthorizeRequest{Amount: 60, Reference: "card 4242 hotel"}, "account:9601")
+	require.Nil(t, err)
+	assert.Equal(t, ReservationActive, hold.Status)
+
+	acc, err := accounts.GetAccount(ctx, 1)
+	require.Nil(t, err)
+	assert.Equal(t, int64(10000), acc.Balance, "holds don't touch the booked balance")
+	assert.Equal(t, int64(4000), *acc.AvailableBalance)
+
+	_, err = accounts.Authorize(ctx, 1, AuthorizeRequest{Amount: 50, Reference: "second"}, "account:9601")
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+
+	// Capturing less than the hold books that much and frees the rest
+	captured, err := accounts.CaptureAuthorization(ctx, 1, hold.ID, CaptureRequest{Amount: 45}, "account:9601")
+	require.Nil(t, err)
+	assert.Equal(t, ReservationCaptured, captured.Status)
+	assert.Equal(t, int64(4500), captured.Captured)
+	acc, err = accounts.GetAccount(ctx, 1)
+	require.Nil(t, err)
+	assert.Equal(t, int64(5500), acc.Balance)
+	assert.Equal(t, int64(5500), *acc.AvailableBalance)
+
+	_, err = accounts.CaptureAuthorization(ctx, 1, hold.ID, CaptureRequest{}, "account:9601")
+	assert.ErrorIs(t, err, ErrHoldResolved)
+
+	// Released and expired holds give the funds back without booking
+	released, err := accounts.Authorize(ctx, 1, AuthorizeRequest{Amount: 20, Reference: "fuel"}, "account:9601")
+	require.Nil(t, err)
+	_, err = accounts.ReleaseAuthorization(ctx, 1, released.ID, "account:9601")
+	require.Nil(t, err)
+
+	soon := time.Now().Add(time.Hour)
+	expiring, err := accounts.Authorize(ctx, 1, AuthorizeRequest{Amount: 30, Reference: "rental", ExpiresAt: &soon}, "account:9601")
+	require.Nil(t, err)
+	n, err := store.ExpireReservations(ctx, soon.Add(time.Second))
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+
+	holds, err := accounts.GetAuthorizations(ctx, 1)
+	require.Nil(t, err)
+	assert.Equal(t, int64(5500), holds.Balance)
+	assert.Equal(t, int64(5500), holds.AvailableBalance)
+	require.Len(t, holds.Holds, 3)
+	assert.Equal(t, ReservationExpired, holds.Holds[2].Status)
+	_, err = accounts.ReleaseAuthorization(ctx, 1, expiring.ID, "account:9601")
+	assert.ErrorIs(t, err, ErrHoldResolved)
+}
+
+func TestAuthorizeRequestValidation(t *testing.T) {
+	store := newMemoryStorage()
+	require.Nil(t, store.CreateAccount(context.Background(), &Account{Number: 9611, Balance: 10000, Currency: "USD"}))
+	s := NewAPIServer(&Config{}, store)
+
+	post := func(handler apiFunc, path, body string) int {
+		r := mux.SetURLVars(httptest.NewRequest("POST", path, strings.NewReader(body)), map[string]string{"id": "1", "holdID": "1"})
+		w := httptest.NewRecorder()
+		makeHTTPHandle(handler)(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusUnprocessableEntity, post(s.handleAuthorize, "/account/1/holds", `{"amount": 0, "reference": "fuel"}`))
+	assert.Equal(t, http.StatusCreated, post(s.handleAuthorize, "/account/1/holds", `{"amount": 25, "reference": "fuel"}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, post(s.handleCaptureAuthorization, "/account/1/holds/1/capture", `{"amount": -1}`))
+	assert.Equal(t, http.StatusOK, post(s.handleCaptureAuthorization, "/account/1/holds/1/capture", `{"amount": 10}`))
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// POST /admin/backups snapshots every account and ledger entry, as of one
+// repeatable read transaction, into an export dump (see dump.go) and uploads
+// it to BACKUP_TARGET: dir keeps backups in BACKUP_DIR, s3 in a bucket. Each
+// backup is named after the time it was taken and has a manifest recording
+// its size and sha256.
+//
+// Restoring is deliberately not an endpoint. gobank restore downloads a
+// backup, checks it against its manifest and only then loads it into an
+// empty database, -dry-run stops before committing.
+
+const backupManifestSuffix = ".manifest.json"
+
+type BackupManifest struct {
+	Name      string    `json:"name"`
+	Format    string    `json:"format"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Accounts  int       `json:"accounts"`
+	Entries   int       `json:"entries"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BackupTarget stores backup objects by name
+type BackupTarget interface {
+	Put(ctx context.Context, name string, r io.ReadSeeker, size int64, checksum string) error
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// List returns the names of the stored objects
+	List(ctx context.Context) ([]string, error)
+}
+
+// NewBackupTarget returns nil when backups aren't configured
+func NewBackupTarget(cfg *Config) (BackupTarget, error) {
+	switch cfg.BackupTarget {
+	case "":
+		return nil, nil
+	case "dir":
+		if err := os.MkdirAll(cfg.BackupDir, 0o700); err != nil {
+			return nil, err
+		}
+		return &dirBackupTarget{dir: cfg.BackupDir}, nil
+	case "s3":
+		if cfg.BackupS3Bucket == "" || cfg.BackupS3AccessKey == "" || cfg.BackupS3SecretKey == "" {
+			return nil, fmt.Errorf("BACKUP_TARGET=s3 needs BACKUP_S3_BUCKET, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		endpoint := cfg.BackupS3Endpoint
+		if endpoint == "" {
+			endpoint = "https://s3." + cfg.BackupS3Region + ".amazonaws.com"
+		}
+		return &s3BackupTarget{
+			endpoint:  strings.TrimSuffix(endpoint, "/"),
+			region:    cfg.BackupS3Region,
+			bucket:    cfg.BackupS3Bucket,
+			prefix:    cfg.BackupS3Prefix,
+			accessKey: cfg.BackupS3AccessKey,
+			secretKey: cfg.BackupS3SecretKey,
+			client:    &http.Client{Timeout: 10 * time.Minute},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown BACKUP_TARGET %q, use dir or s3", cfg.BackupTarget)
+}
+
+type dirBackupTarget struct {
+	dir string
+}
+
+// Put writes a temporary file and renames it, a backup is never half there
+func (t *dirBackupTarget) Put(ctx context.Context, name string, r io.ReadSeeker, size int64, checksum string) error {
+	tmp, err := os.CreateTemp(t.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(t.dir, filepath.Base(name)))
+}
+
+func (t *dirBackupTarget) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(t.dir, filepath.Base(name)))
+}
+
+func (t *dirBackupTarget) List(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// s3BackupTarget speaks just enough of the S3 API for backups, PUT, GET and
+// ListObjectsV2 with path style URLs, signed with AWS Signature Version 4.
+// Works with S3 and compatible stores like MinIO through BACKUP_S3_ENDPOINT.
+type s3BackupTarget struct {
+	endpoint  string
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// sha256 of an empty payload
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (t *s3BackupTarget) do(ctx context.Context, method, key string, query url.Values, body io.ReadSeeker, size int64, payloadHash string) (*http.Response, error) {
+	u := t.endpoint + "/" + s3Escape(t.bucket+"/"+key, false)
+	if len(query) > 0 {
+		u += "?" + s3CanonicalQuery(query)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Body = io.NopCloser(body)
+		req.ContentLength = size
+	}
+	signS3(req, payloadHash, t.region, t.accessKey, t.secretKey, time.Now())
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("s3: %s %s: %s: %s", method, key, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+func (t *s3BackupTarget) Put(ctx context.Context, name string, r io.ReadSeeker, size int64, checksum string) error {
+	resp, err := t.do(ctx, "PUT", t.prefix+name, nil, r, size, checksum)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (t *s3BackupTarget) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := t.do(ctx, "GET", t.prefix+name, nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (t *s3BackupTarget) List(ctx context.Context) ([]string, error) {
+	names := []string{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {t.prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := t.do(ctx, "GET", "", query, nil, 0, emptyPayloadHash)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3: listing %s: %v", t.bucket, err)
+		}
+		for _, c := range result.Contents {
+			names = append(names, strings.TrimPrefix(c.Key, t.prefix))
+		}
+		if !result.IsTruncated {
+			return names, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// signS3 adds the Signature Version 4 headers, every header already on req is signed
+func signS3(req *http.Request, payloadHash, region, accessKey, secretKey string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{day, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but unreserved characters, and
+// slashes unless escapeSlash is set
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	pairs := []string{}
+	for name, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, s3Escape(name, true)+"="+s3Escape(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// dumpExporter is a storage backend that can write an export dump
+type dumpExporter interface {
+	ExportDump(ctx context.Context, w dumpWriter) (*DumpSummary, error)
+}
+
+// createBackup writes a dump to a temporary file, uploads it and then its manifest
+func createBackup(ctx context.Context, exporter dumpExporter, target BackupTarget, now time.Time) (*BackupManifest, error) {
+	manifest := &BackupManifest{
+		Name:      "backup-" + now.UTC().Format("20060102T150405Z") + "." + DumpJSONL,
+		Format:    DumpJSONL,
+		CreatedAt: now.UTC(),
+	}
+
+	tmp, err := os.CreateTemp("", "gobank-backup-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	sum := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(tmp, sum)}
+	w, err := newDumpWriter(manifest.Format, counter)
+	if err != nil {
+		return nil, err
+	}
+	summary, err := exporter.ExportDump(ctx, w)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot failed: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	manifest.Size, manifest.SHA256 = counter.n, hex.EncodeToString(sum.Sum(nil))
+	manifest.Accounts, manifest.Entries = summary.Accounts, summary.Entries
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := target.Put(ctx, manifest.Name, tmp, manifest.Size, manifest.SHA256); err != nil {
+		return nil, fmt.Errorf("upload failed: %v", err)
+	}
+
+	// The manifest goes last, a backup without one never completed
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	dataSum := sha256.Sum256(data)
+	if err := target.Put(ctx, manifest.Name+backupManifestSuffix, bytes.NewReader(data), int64(len(data)), hex.EncodeToString(dataSum[:])); err != nil {
+		return nil, fmt.Errorf("upload failed: %v", err)
+	}
+	return manifest, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func getBackupManifest(ctx context.Context, target BackupTarget, name string) (*BackupManifest, error) {
+	r, err := target.Get(ctx, name+backupManifestSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("no manifest for backup %s: %v", name, err)
+	}
+	defer r.Close()
+
+	var manifest BackupManifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("manifest of backup %s is unreadable: %v", name, err)
+	}
+	return &manifest, nil
+}
+
+// listBackups returns the manifests of completed backups, newest first
+func listBackups(ctx context.Context, target BackupTarget) ([]*BackupManifest, error) {
+	names, err := target.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	backups := []*BackupManifest{}
+	for _, name := range names {
+		if !strings.HasSuffix(name, backupManifestSuffix) {
+			continue
+		}
+		manifest, err := getBackupManifest(ctx, target, strings.TrimSuffix(name, backupManifestSuffix))
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, manifest)
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].CreatedAt.After(backups[j].CreatedAt) })
+	return backups, nil
+}
+
+// downloadBackup fetches a backup into a temporary file and checks it
+// against its manifest. The caller removes the file.
+func downloadBackup(ctx context.Context, target BackupTarget, name string) (*os.File, *BackupManifest, error) {
+	manifest, err := getBackupManifest(ctx, target, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := target.Get(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	tmp, err := os.CreateTemp("", "gobank-restore-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	fail := func(err error) (*os.File, *BackupManifest, error) {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, nil, err
+	}
+
+	sum := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, sum), r)
+	if err != nil {
+		return fail(err)
+	}
+	if size != manifest.Size || hex.EncodeToString(sum.Sum(nil)) != manifest.SHA256 {
+		return fail(fmt.Errorf("backup %s doesn't match its manifest, %d bytes with sha256 %x", name, size, sum.Sum(nil)))
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	return tmp, manifest, nil
+}
+
+var errBackupsDisabled = newHTTPError(http.StatusNotImplemented, "BACKUPS_DISABLED", "backups are not configured, set BACKUP_TARGET")
+
+// GET /admin/backups lists completed backups
+func (s *APIServer) handleGetBackups(w http.ResponseWriter, r *http.Request) error {
+	if s.backups == nil {
+		return errBackupsDisabled
+	}
+
+	backups, err := listBackups(r.Context(), s.backups)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, backups)
+}
+
+// POST /admin/backups takes one
+func (s *APIServer) handleCreateBackup(w http.ResponseWriter, r *http.Request) error {
+	if s.backups == nil {
+		return errBackupsDisabled
+	}
+
+	exporter, ok := storageAs[dumpExporter](s.store)
+	if !ok {
+		return newHTTPError(http.StatusNotImplemented, "BACKUPS_DISABLED", "the %s storage backend can't be backed up", s.config.StorageBackend)
+	}
+	manifest, err := createBackup(r.Context(), exporter, s.backups, time.Now())
+	if err != nil {
+		return err
+	}
+	log.Printf("Backup %s taken by %s: %d accounts, %d ledger entries, %d bytes", manifest.Name, auditActor(r, s.config), manifest.Accounts, manifest.Entries, manifest.Size)
+	return WriteJSON(w, http.StatusCreated, manifest)
+}
+
+func restoreCommand(args []string) int {
+	cmd := flag.NewFlagSet("restore", flag.ExitOnError)
+	dryRun := cmd.Bool("dry-run", false, "check the backup and load it without keeping anything")
+	list := cmd.Bool("list", false, "list the completed backups and exit")
+	cmd.Parse(args)
+
+	cfg := LoadConfig()
+	target, err := NewBackupTarget(cfg)
+	if err == nil && target == nil {
+		err = errors.New("backups are not configured, set BACKUP_TARGET")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	ctx := context.Background()
+
+	if *list {
+		backups, err := listBackups(ctx, target)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list backups: %v\n", err)
+			return 1
+		}
+		for _, b := range backups {
+			fmt.Printf("%s\t%d accounts\t%d entries\t%d bytes\n", b.Name, b.Accounts, b.Entries, b.Size)
+		}
+		return 0
+	}
+	if cmd.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: gobank restore [-dry-run] <backup name> | -list")
+		return 2
+	}
+
+	f, manifest, err := downloadBackup(ctx, target, cmd.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Restore failed, nothing was changed: %v\n", err)
+		return 1
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	pg, err := NewPostgresStorage(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open database: %v\n", err)
+		return 1
+	}
+	if err := pg.VerifySchema(); err != nil {
+		fmt.Fprintf(os.Stderr, "Incompatible database schema, run gobank migrate first: %v\n", err)
+		return 1
+	}
+	r, err := newDumpReader(manifest.Format, f)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	expect := &DumpSummary{Accounts: manifest.Accounts, Entries: manifest.Entries}
+	summary, err := pg.ImportDump(ctx, r, *dryRun, expect)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Restore failed, nothing was changed: %v\n", err)
+		return 1
+	}
+
+	if *dryRun {
+		fmt.Printf("Dry run: backup %s would restore %d accounts and %d ledger entries\n", manifest.Name, summary.Accounts, summary.Entries)
+		return 0
+	}
+	fmt.Printf("Restored %d accounts and %d ledger entries from backup %s\n", summary.Accounts, summary.Entries, manifest.Name)
+	return 0
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Beneficiaries are an account's saved payees, the accounts its standing
+// orders pay. One that's still paid by a standing order that isn't
+// cancelled or completed can't be deleted.
+
+type Beneficiary struct {
+	ID            int       `json:"id"`
+	AccountID     int       `json:"account_id"`
+	Name          string    `json:"name"`
+	AccountNumber int64     `json:"account_number"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type CreateBeneficiaryRequest struct {
+	Name          string `json:"name" validate:"required,max=70"`
+	AccountNumber int64  `json:"accountNumber" validate:"required,positive"`
+}
+
+func beneficiaryID(r *http.Request) (int, error) {
+	return pathID(r, "beneficiaryID")
+}
+
+// beneficiary loads one of the account's beneficiaries, others look like they don't exist
+func (s *APIServer) beneficiary(ctx context.Context, accountID, id int) (*Beneficiary, error) {
+	b, err := s.store.GetBeneficiary(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if b.AccountID != accountID {
+		return nil, fmt.Errorf("%w: %d", ErrBeneficiaryNotFound, id)
+	}
+	return b, nil
+}
+
+// GET /account/{id}/beneficiaries
+func (s *APIServer) handleGetBeneficiaries(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	beneficiaries, err := s.store.GetBeneficiaries(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, beneficiaries)
+}
+
+// POST /account/{id}/beneficiaries
+func (s *APIServer) handleCreateBeneficiary(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	accountID, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	var req CreateBeneficiaryRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+
+	acc, err := s.store.GetAccountbyID(r.Context(), accountID)
+	if err != nil {
+		return err
+	}
+	if _, err := s.store.GetAccountByNumber(r.Context(), req.AccountNumber); err != nil {
+		return invalidField("accountNumber", "exists", "is not an account")
+	}
+	if acc.Number == req.AccountNumber {
+		return invalidField("accountNumber", "different", "must not be the account itself")
+	}
+
+	b := &Beneficiary{
+		AccountID:     accountID,
+		Name:          strings.TrimSpace(req.Name),
+		AccountNumber: req.AccountNumber,
+		CreatedAt:     time.Now().UTC(),
+	}
+	if err := s.store.CreateBeneficiary(r.Context(), b); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusCreated, b)
+}
+
+// DELETE /account/{id}/beneficiaries/{beneficiaryID}
+func (s *APIServer) handleDeleteBeneficiary(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	bID, err := beneficiaryID(r)
+	if err != nil {
+		return err
+	}
+	if _, err := s.beneficiary(r.Context(), id, bID); err != nil {
+		return err
+	}
+
+	orders, err := s.store.GetStandingOrders(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	for _, o := range orders {
+		if o.BeneficiaryID == bID && o.live() {
+			return fmt.Errorf("%w: standing order %d pays beneficiary %d", ErrBeneficiaryInUse, o.ID, bID)
+		}
+	}
+
+	if err := s.store.DeleteBeneficiary(r.Context(), bID); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, map[string]int{"deleted": bID})
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Request bodies are capped at MAX_BODY_BYTES, bigger ones are refused with
+// 413 before a handler reads them into memory. Bodies announced with a
+// Content-Length over the limit are refused up front, the others are cut off
+// by http.MaxBytesReader and decodeRequest reports the 413.
+
+func bodyTooLarge(limit int64) error {
+	return newHTTPError(http.StatusRequestEntityTooLarge, "BODY_TOO_LARGE", "request body is larger than %d bytes", limit)
+}
+
+func withBodyLimit(next http.Handler, limit int64) http.Handler {
+	if limit <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			status, apiErr := apiErrorFor(bodyTooLarge(limit))
+			WriteJSON(w, status, apiErr)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBodyLimit(t *testing.T) {
+	handler := withBodyLimit(makeHTTPHandle(func(w http.ResponseWriter, r *http.Request) error {
+		var req LoginRequest
+		if err := decodeRequest(r, &req); err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, req)
+	}), 64)
+
+	post := func(body string, chunked bool) (int, ApiError) {
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(body))
+		if chunked {
+			r.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		var apiErr ApiError
+		json.NewDecoder(w.Body).Decode(&apiErr)
+		return w.Code, apiErr
+	}
+
+	status, _ := post(`{"number": 123, "password": "password"}`, false)
+	assert.Equal(t, http.StatusOK, status)
+
+	large := `{"number": 123, "password": "` + strings.Repeat("x", 100) + `"}`
+	status, apiErr := post(large, false)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Equal(t, "BODY_TOO_LARGE", apiErr.Code)
+
+	// Without a Content-Length the reader cuts the body off
+	status, apiErr = post(large, true)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Equal(t, "BODY_TOO_LARGE", apiErr.Code)
+}
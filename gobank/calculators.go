@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The calculators preview charges with the functions production uses, so a
+// quote always matches what would actually be booked. Interest compounds
+// daily at rate/365 in whole cents, like overdraft fees accrue on an
+// overdrawn balance. Amounts are in major units, rates are fractions
+// (0.05 is 5%).
+
+const (
+	daysPerYear        = 365
+	maxCalculationDays = 10 * daysPerYear
+)
+
+type InterestPreview struct {
+	Principal  float64 `json:"principal"`
+	AnnualRate float64 `json:"annual_rate"`
+	Days       int     `json:"days"`
+	Interest   float64 `json:"interest"`
+	Total      float64 `json:"total"`
+}
+
+type FeePreview struct {
+	Type     string  `json:"type"`
+	Amount   float64 `json:"amount"`
+	Currency string  `json:"currency"`
+	Days     int     `json:"days"`
+	Rate     float64 `json:"rate"`
+	Fee      float64 `json:"fee"`
+}
+
+// feeCalculators preview each fee type for an amount over days. Overdraft
+// fees are charged daily on the overdrawn amount, transfer fees once from
+// the tier the amount falls in.
+var feeCalculators = map[string]func(cfg *Config, schedule *FeeSchedule, amount int64, days int) (rate float64, fee int64){
+	"overdraft": func(cfg *Config, schedule *FeeSchedule, amount int64, days int) (float64, int64) {
+		return cfg.OverdraftDailyFeeRate, accrue(amount, cfg.OverdraftDailyFeeRate, days)
+	},
+	"transfer": func(cfg *Config, schedule *FeeSchedule, amount int64, days int) (float64, int64) {
+		var rate float64
+		if t := schedule.tier(amount); t != nil {
+			rate = t.Rate
+		}
+		return rate, schedule.transferFee(amount)
+	},
+}
+
+// GET /calculators/interest?principal=&rate=&days=
+func (s *APIServer) handleInterestCalculator(w http.ResponseWriter, r *http.Request) error {
+	principal, err := amountParam(r, "principal")
+	if err != nil {
+		return err
+	}
+	rate, err := strconv.ParseFloat(r.URL.Query().Get("rate"), 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return invalidParam("query", "rate", "range", "must be an annual rate between 0 and 1")
+	}
+	days, err := daysParam(r, 0)
+	if err != nil {
+		return err
+	}
+
+	interest := accrue(principal, rate/daysPerYear, days)
+	return WriteJSON(w, http.StatusOK, &InterestPreview{
+		Principal:  float64(principal) / 100,
+		AnnualRate: rate,
+		Days:       days,
+		Interest:   float64(interest) / 100,
+		Total:      float64(principal+interest) / 100,
+	})
+}
+
+// GET /calculators/fees?amount=&type=&days=&currency=
+func (s *APIServer) handleFeeCalculator(w http.ResponseWriter, r *http.Request) error {
+	kind := r.URL.Query().Get("type")
+	calculate, ok := feeCalculators[kind]
+	if !ok {
+		return invalidParam("query", "type", "oneof", "must be a fee type like overdraft or transfer")
+	}
+	currency := strings.ToUpper(r.URL.Query().Get("currency"))
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	if !validCurrency.MatchString(currency) {
+		return invalidParam("query", "currency", "iso4217", "must be a three letter currency code")
+	}
+	amount, err := amountParam(r, "amount")
+	if err != nil {
+		return err
+	}
+	days, err := daysParam(r, 1)
+	if err != nil {
+		return err
+	}
+
+	schedule, err := feeSchedule(r.Context(), s.forRequest(r).store, currency)
+	if err != nil {
+		return err
+	}
+
+	rate, fee := calculate(s.config, schedule, amount, days)
+	return WriteJSON(w, http.StatusOK, &FeePreview{
+		Type:     kind,
+		Amount:   float64(amount) / 100,
+		Currency: currency,
+		Days:     days,
+		Rate:     rate,
+		Fee:      float64(fee) / 100,
+	})
+}
+
+// amountParam reads a positive amount in major units as cents
+func amountParam(r *http.Request, name string) (int64, error) {
+	amount, err := strconv.ParseFloat(r.URL.Query().Get(name), 64)
+	if err != nil || amount <= 0 {
+		return 0, invalidParam("query", name, "positive", "must be an amount greater than zero")
+	}
+	return toCents(amount), nil
+}
+
+// daysParam reads ?days=, required unless a positive fallback is given
+func daysParam(r *http.Request, fallback int) (int, error) {
+	v := r.URL.Query().Get("days")
+	if v == "" && fallback > 0 {
+		return fallback, nil
+	}
+	days, err := strconv.Atoi(v)
+	if err != nil || days < 1 || days > maxCalculationDays {
+		return 0, invalidParam("query", "days", "range", fmt.Sprintf("must be between 1 and %d", maxCalculationDays))
+	}
+	return days, nil
+}
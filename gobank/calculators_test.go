@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterestCalculator(t *testing.T) {
+	s := NewAPIServer(&Config{}, newMemoryStorage())
+	get := func(query string) (int, *InterestPreview) {
+		w := httptest.NewRecorder()
+		makeHTTPHandle(s.handleInterestCalculator)(w, httptest.NewRequest("GET", "/v1/calculators/interest?"+query, nil))
+		preview := &InterestPreview{}
+		json.Unmarshal(w.Body.Bytes(), preview)
+		return w.Code, preview
+	}
+
+	// 10 cents a day, the second day's 10.001 rounds to whole cents
+	status, preview := get("principal=1000&rate=0.0365&days=2")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 0.20, preview.Interest)
+	assert.Equal(t, 1000.20, preview.Total)
+
+	// A year compounds daily, a little above the simple rate
+	_, preview = get("principal=1000&rate=0.05&days=365")
+	assert.Greater(t, preview.Interest, 50.0)
+	assert.Less(t, preview.Interest, 52.0)
+
+	for _, query := range []string{"principal=0&rate=0.05&days=1", "principal=10&rate=5&days=1", "principal=10&rate=0.05", "principal=10&rate=0.05&days=0"} {
+		status, _ := get(query)
+		assert.Equal(t, http.StatusUnprocessableEntity, status, query)
+	}
+}
+
+func TestFeeCalculatorMatchesAccrual(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{OverdraftMaxLimit: 100, OverdraftDailyFeeRate: 0.013}
+	store := newMemoryStorage()
+	acc := &Account{Number: 2101, Balance: -4321, OverdraftLimit: 5000, Currency: "USD"}
+	require.Nil(t, store.CreateAccount(ctx, acc))
+
+	s := NewAPIServer(cfg, store)
+	w := httptest.NewRecorder()
+	makeHTTPHandle(s.handleFeeCalculator)(w, httptest.NewRequest("GET", "/v1/calculators/fees?type=overdraft&amount=43.21&days=3", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	preview := &FeePreview{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), preview))
+
+	// Three days of the real accrual charge what the preview said
+	overdrafts := NewOverdraftService(store, cfg)
+	day := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		require.Nil(t, overdrafts.AccrueFees(ctx, day.AddDate(0, 0, i)))
+	}
+	status, err := overdrafts.GetStatus(ctx, acc.ID)
+	require.Nil(t, err)
+	assert.Equal(t, toCents(preview.Fee), status.FeesAccrued)
+	assert.Equal(t, 0.013, preview.Rate)
+
+	w = httptest.NewRecorder()
+	makeHTTPHandle(s.handleFeeCalculator)(w, httptest.NewRequest("GET", "/v1/calculators/fees?type=wire&amount=10", nil))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/http"
+)
+
+// Canary routing sends a slice of real traffic to an alternate implementation of
+// a route. Clients can opt in or out explicitly with the canary header
+// ("always"/"never"), the rest is bucketed by client IP so a given caller
+// consistently hits the same implementation.
+const (
+	canaryAlways = "always"
+	canaryNever  = "never"
+)
+
+type canaryRouter struct {
+	header   string
+	percent  int
+	handlers map[string]http.HandlerFunc
+}
+
+func newCanaryRouter(cfg *Config) *canaryRouter {
+	return &canaryRouter{
+		header:   cfg.CanaryHeader,
+		percent:  cfg.CanaryPercent,
+		handlers: map[string]http.HandlerFunc{},
+	}
+}
+
+// Register the alternate implementation for a named route
+func (c *canaryRouter) Register(route string, handler http.HandlerFunc) {
+	c.handlers[route] = handler
+}
+
+// Wrap returns the stable handler untouched if no canary is registered for the route
+func (c *canaryRouter) Wrap(route string, stable http.HandlerFunc) http.HandlerFunc {
+	canary, ok := c.handlers[route]
+	if !ok {
+		return stable
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c.useCanary(r) {
+			w.Header().Set("X-Canary-Route", "canary")
+			canary(w, r)
+			return
+		}
+		w.Header().Set("X-Canary-Route", "stable")
+		stable(w, r)
+	}
+}
+
+func (c *canaryRouter) useCanary(r *http.Request) bool {
+	switch r.Header.Get(c.header) {
+	case canaryAlways, "true", "1":
+		return true
+	case canaryNever, "false", "0":
+		return false
+	}
+
+	if c.percent <= 0 {
+		return false
+	}
+	return canaryBucket(clientIP(r)) < c.percent
+}
+
+func canaryBucket(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % 100)
+}
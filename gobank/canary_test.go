@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanaryRouter(t *testing.T) {
+	route := func(c *canaryRouter, r *http.Request) string {
+		handler := c.Wrap("transfer", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("stable")) })
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Body.String()
+	}
+	request := func(ip, header string) *http.Request {
+		r := httptest.NewRequest("POST", "/transfer", nil)
+		r.RemoteAddr = ip + ":4000"
+		if header != "" {
+			r.Header.Set("X-Canary", header)
+		}
+		return r
+	}
+
+	// Without a canary the stable handler is used as is
+	c := newCanaryRouter(&Config{CanaryHeader: "X-Canary", CanaryPercent: 100})
+	w := httptest.NewRecorder()
+	c.Wrap("transfer", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("stable")) })(w, request("10.0.0.1", canaryAlways))
+	assert.Equal(t, "stable", w.Body.String())
+	assert.Empty(t, w.Header().Get("X-Canary-Route"))
+
+	c.Register("transfer", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("canary")) })
+	for _, header := range []string{"always", "true", "1"} {
+		c.percent = 0
+		assert.Equal(t, "canary", route(c, request("10.0.0.1", header)), header)
+	}
+	for _, header := range []string{"never", "false", "0"} {
+		c.percent = 100
+		assert.Equal(t, "stable", route(c, request("10.0.0.1", header)), header)
+	}
+
+	// Everyone else goes by the rollout percentage
+	for i := 0; i < 50; i++ {
+		ip := fmt.Sprintf("10.0.1.%d", i)
+		c.percent = 0
+		assert.Equal(t, "stable", route(c, request(ip, "")), ip)
+		c.percent = 100
+		assert.Equal(t, "canary", route(c, request(ip, "")), ip)
+	}
+
+	w = httptest.NewRecorder()
+	c.Wrap("transfer", func(w http.ResponseWriter, r *http.Request) {})(w, request("10.0.0.1", ""))
+	assert.Equal(t, "canary", w.Header().Get("X-Canary-Route"))
+}
+
+func TestCanaryBucket(t *testing.T) {
+	c := newCanaryRouter(&Config{CanaryHeader: "X-Canary", CanaryPercent: 50})
+	var canary int
+	for i := 0; i < 200; i++ {
+		ip := fmt.Sprintf("192.168.%d.%d", i/100, i%100)
+		bucket := canaryBucket(ip)
+		assert.Equal(t, bucket, canaryBucket(ip), "the same client stays in its bucket")
+		assert.True(t, bucket >= 0 && bucket < 100)
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = ip + ":1234"
+		first := c.useCanary(r)
+		r.RemoteAddr = ip + ":5678"
+		assert.Equal(t, first, c.useCanary(r), "the port doesn't matter")
+		if first {
+			canary++
+		}
+	}
+	assert.InDelta(t, 100, canary, 40, "roughly half the clients")
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cards are issued against an account and spend through authorization
+// holds: POST /cards/{cardID}/authorize, called by the card processor with
+// admin credentials, places a hold on the card's account that is captured or
+// released through the account's hold endpoints like any other. A card can
+// have a per-transaction and a daily limit, zero meaning none. The daily
+// limit counts the card's holds placed since midnight UTC that weren't
+// released or left to expire.
+//
+// Only the masked PAN is kept. The simulation has no use for the full
+// number, and not storing it keeps card data out of the database.
+
+const (
+	CardActive    = "active"
+	CardFrozen    = "frozen"
+	CardCancelled = "cancelled"
+
+	// Issuer identification number of simulated cards
+	cardBIN = "400000"
+
+	cardValidity = 4 // years
+
+	AuditCardIssued        = "card.issued"
+	AuditCardStatusChanged = "card.status_changed"
+	AuditCardLimitsChanged = "card.limits_changed"
+)
+
+type Card struct {
+	ID               int       `json:"id"`
+	AccountID        int       `json:"account_id"`
+	MaskedPAN        string    `json:"masked_pan"`
+	Status           string    `json:"status"`
+	TransactionLimit float64   `json:"transaction_limit"`
+	DailyLimit       float64   `json:"daily_limit"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+type CardLimitsRequest struct {
+	TransactionLimit float64 `json:"transactionLimit" validate:"min=0"`
+	DailyLimit       float64 `json:"dailyLimit" validate:"min=0"`
+}
+
+type CardAuthorizeRequest struct {
+	Amount   float64 `json:"amount" validate:"positive"`
+	Merchant string  `json:"merchant" validate:"required,max=80"`
+}
+
+// newMaskedPAN draws a Luhn-valid card number under cardBIN and masks all
+// but its last four digits
+func newMaskedPAN() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000_000))
+	if err != nil {
+		return "", err
+	}
+	pan := fmt.Sprintf("%s%09d", cardBIN, n.Int64())
+	pan += strconv.Itoa(luhnCheckDigit(pan))
+	return pan[:6] + strings.Repeat("*", len(pan)-10) + pan[len(pan)-4:], nil
+}
+
+// luhnCheckDigit is the digit that makes number+digit pass the Luhn check
+func luhnCheckDigit(number string) int {
+	sum := 0
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		// Doubled digits are the ones that sit in even positions once the check digit is appended
+		if (len(number)-i)%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return (10 - sum%10) % 10
+}
+
+// cardHoldReference ties a hold to the card that placed it
+func cardHoldReference(card *Card, merchant string) string {
+	return fmt.Sprintf("card:%d %s", card.ID, merchant)
+}
+
+// cardSpentToday is what the card's holds since midnight UTC took, captured
+// holds count with what they actually booked
+func cardSpentToday(card *Card, reservations []*Reservation, now time.Time) int64 {
+	midnight := now.UTC().Truncate(24 * time.Hour)
+	prefix := cardHoldReference(card, "")
+	var spent int64
+	for _, r := range reservations {
+		if r.Kind != ReservationAuthorization || !strings.HasPrefix(r.Reference, prefix) || r.CreatedAt.Before(midnight) {
+			continue
+		}
+		switch {
+		case r.Status == ReservationCaptured:
+			spent += r.Captured
+		case r.active(now):
+			spent += r.Amount
+		}
+	}
+	return spent
+}
+
+func cardID(r *http.Request) (int, error) {
+	return pathID(r, "cardID")
+}
+
+// accountCard loads one of the account's cards, others look like they don't exist
+func (s *APIServer) accountCard(r *http.Request) (*Card, error) {
+	id, err := getID(r)
+	if err != nil {
+		return nil, err
+	}
+	cid, err := cardID(r)
+	if err != nil {
+		return nil, err
+	}
+	card, err := s.store.GetCard(r.Context(), cid)
+	if err != nil {
+		return nil, err
+	}
+	if card.AccountID != id {
+		return nil, fmt.Errorf("%w: %d", ErrCardNotFound, cid)
+	}
+	return card, nil
+}
+
+// GET /account/{id}/cards
+func (s *APIServer) handleGetCards(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	cards, err := s.store.GetCards(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, cards)
+}
+
+// POST /account/{id}/cards
+func (s *APIServer) handleIssueCard(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	var req CardLimitsRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+	card, err := s.issueCard(r.Context(), id, req, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusCreated, card)
+}
+
+func (s *APIServer) issueCard(ctx context.Context, accountID int, req CardLimitsRequest, actor string) (*Card, error) {
+	acc, err := s.store.GetAccountbyID(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAccountUsable(acc); err != nil {
+		return nil, err
+	}
+
+	pan, err := newMaskedPAN()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	// Valid until the end of the expiry month
+	expires := time.Date(now.Year()+cardValidity, now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+
+	card := &Card{
+		AccountID:        accountID,
+		MaskedPAN:        pan,
+		Status:           CardActive,
+		TransactionLimit: req.TransactionLimit,
+		DailyLimit:       req.DailyLimit,
+		ExpiresAt:        expires,
+		CreatedAt:        now,
+	}
+	if err := s.store.CreateCard(ctx, card); err != nil {
+		return nil, err
+	}
+	recordAudit(ctx, s.store, actor, accountID, AuditCardIssued, []FieldChange{{Field: "card", Old: nil, New: card.ID}})
+	return card, nil
+}
+
+// POST /account/{id}/cards/{cardID}/freeze and /unfreeze
+func (s *APIServer) handleCardStatus(from, to string) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		s := s.forRequest(r)
+
+		card, err := s.accountCard(r)
+		if err != nil {
+			return err
+		}
+		if card.Status != from {
+			return newHTTPError(http.StatusConflict, "CARD_STATUS", "card %d is %s, not %s", card.ID, card.Status, from)
+		}
+		if err := s.store.SetCardStatus(r.Context(), card.ID, from, to); err != nil {
+			return err
+		}
+
+		card.Status = to
+		recordAudit(r.Context(), s.store, auditActor(r, s.config), card.AccountID, AuditCardStatusChanged,
+			[]FieldChange{{Field: "card:" + strconv.Itoa(card.ID), Old: from, New: to}})
+		return WriteJSON(w, http.StatusOK, card)
+	}
+}
+
+// PUT /account/{id}/cards/{cardID}/limits
+func (s *APIServer) handleCardLimits(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	card, err := s.accountCard(r)
+	if err != nil {
+		return err
+	}
+	var req CardLimitsRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+
+	changes := []FieldChange{}
+	if card.TransactionLimit != req.TransactionLimit {
+		changes = append(changes, FieldChange{Field: "transaction_limit", Old: card.TransactionLimit, New: req.TransactionLimit})
+	}
+	if card.DailyLimit != req.DailyLimit {
+		changes = append(changes, FieldChange{Field: "daily_limit", Old: card.DailyLimit, New: req.DailyLimit})
+	}
+	card.TransactionLimit, card.DailyLimit = req.TransactionLimit, req.DailyLimit
+	if err := s.store.UpdateCardLimits(r.Context(), card); err != nil {
+		return err
+	}
+	recordAudit(r.Context(), s.store, auditActor(r, s.config), card.AccountID, AuditCardLimitsChanged, changes)
+	return WriteJSON(w, http.StatusOK, card)
+}
+
+// POST /cards/{cardID}/authorize
+func (s *APIServer) handleCardAuthorize(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	id, err := cardID(r)
+	if err != nil {
+		return err
+	}
+	var req CardAuthorizeRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+
+	hold, err := s.authorizeCard(r.Context(), id, req)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusCreated, hold)
+}
+
+func (s *APIServer) authorizeCard(ctx context.Context, id int, req CardAuthorizeRequest) (*Reservation, error) {
+	card, err := s.store.GetCard(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if card.Status != CardActive {
+		return nil, fmt.Errorf("%w: card %d is %s", ErrCardInactive, card.ID, card.Status)
+	}
+	if !now.Before(card.ExpiresAt) {
+		return nil, fmt.Errorf("%w: card %d expired", ErrCardInactive, card.ID)
+	}
+
+	amount := toCents(req.Amount)
+	if card.TransactionLimit > 0 && amount > toCents(card.TransactionLimit) {
+		return nil, fmt.Errorf("%w: %.2f per transaction", ErrCardLimitExceeded, card.TransactionLimit)
+	}
+	if card.DailyLimit > 0 {
+		reservations, err := s.store.GetReservations(ctx, card.AccountID, false)
+		if err != nil {
+			return nil, err
+		}
+		if cardSpentToday(card, reservations, now)+amount > toCents(card.DailyLimit) {
+			return nil, fmt.Errorf("%w: %.2f per day", ErrCardLimitExceeded, card.DailyLimit)
+		}
+	}
+
+	return s.accounts().Authorize(ctx, card.AccountID, AuthorizeRequest{
+		Amount:    req.Amount,
+		Reference: cardHoldReference(card, strings.TrimSpace(req.Merchant)),
+	}, "card:"+strconv.Itoa(card.ID))
+}
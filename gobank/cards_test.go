@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLuhnCheckDigit(t *testing.T) {
+	assert.Equal(t, 3, luhnCheckDigit("7992739871"))
+	assert.Equal(t, 2, luhnCheckDigit("400000000000000"))
+}
+
+func TestCards(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	acc := &Account{Number: 5301, Balance: 100000, Currency: "USD", Status: AccountActive}
+	other := &Account{Number: 5302, Balance: 100000, Currency: "USD", Status: AccountActive}
+	require.Nil(t, store.CreateAccount(ctx, acc))
+	require.Nil(t, store.CreateAccount(ctx, other))
+	s := NewAPIServer(&Config{}, store)
+
+	call := func(h apiFunc, method, body string, vars map[string]string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		makeHTTPHandle(h)(w, mux.SetURLVars(httptest.NewRequest(method, "/", strings.NewReader(body)), vars))
+		return w
+	}
+	cardVars := func(accountID, card int) map[string]string {
+		return map[string]string{"id": strconv.Itoa(accountID), "cardID": strconv.Itoa(card)}
+	}
+	authorize := func(card int, amount string) int {
+		return call(s.handleCardAuthorize, "POST", `{"amount": `+amount+`, "merchant": "Corner Shop"}`,
+			map[string]string{"cardID": strconv.Itoa(card)}).Code
+	}
+
+	w := call(s.handleIssueCard, "POST", `{"transactionLimit": 50, "dailyLimit": 80}`, map[string]string{"id": strconv.Itoa(acc.ID)})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var card Card
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &card))
+	assert.Regexp(t, regexp.MustCompile(`^400000\*{6}\d{4}$`), card.MaskedPAN)
+	assert.Equal(t, CardActive, card.Status)
+	assert.True(t, card.ExpiresAt.After(card.CreatedAt))
+
+	// Authorizations place holds tagged with the card
+	require.Equal(t, http.StatusCreated, authorize(card.ID, "40"))
+	holds, err := store.GetReservations(ctx, acc.ID, false)
+	require.Nil(t, err)
+	require.Len(t, holds, 1)
+	assert.Equal(t, int64(4000), holds[0].Amount)
+	assert.Equal(t, "card:"+strconv.Itoa(card.ID)+" Corner Shop", holds[0].Reference)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, authorize(card.ID, "60"), "over the transaction limit")
+	assert.Equal(t, http.StatusUnprocessableEntity, authorize(card.ID, "45"), "over the daily limit")
+	assert.Equal(t, http.StatusCreated, authorize(card.ID, "40"))
+
+	// Frozen cards are declined until they're unfrozen
+	assert.Equal(t, http.StatusOK, call(s.handleCardStatus(CardActive, CardFrozen), "POST", "", cardVars(acc.ID, card.ID)).Code)
+	assert.Equal(t, http.StatusConflict, call(s.handleCardStatus(CardActive, CardFrozen), "POST", "", cardVars(acc.ID, card.ID)).Code)
+	assert.Equal(t, http.StatusForbidden, authorize(card.ID, "1"))
+	assert.Equal(t, http.StatusOK, call(s.handleCardStatus(CardFrozen, CardActive), "POST", "", cardVars(acc.ID, card.ID)).Code)
+
+	w = call(s.handleCardLimits, "PUT", `{"transactionLimit": 0, "dailyLimit": 0}`, cardVars(acc.ID, card.ID))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, http.StatusCreated, authorize(card.ID, "60"))
+
+	// Another account's card doesn't exist as far as this one is concerned
+	assert.Equal(t, http.StatusNotFound, call(s.handleCardStatus(CardActive, CardFrozen), "POST", "", cardVars(other.ID, card.ID)).Code)
+	assert.Equal(t, http.StatusNotFound, call(s.handleCardLimits, "PUT", `{}`, cardVars(other.ID, card.ID)).Code)
+	assert.Equal(t, http.StatusNotFound, authorize(99, "1"))
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Cashback rules are read from CASHBACK_RULES as a JSON array and checked in
+// order, the first rule matching a settled transfer sets the percentage paid
+// back to the sender. Credits per account are capped per calendar month and
+// can be funded from a designated account. Amounts are in cents.
+
+type CashbackRule struct {
+	Name      string  `json:"name"`
+	Category  string  `json:"category,omitempty"`
+	Payee     int64   `json:"payee,omitempty"`
+	MinAmount float64 `json:"min_amount,omitempty"`
+	MaxAmount float64 `json:"max_amount,omitempty"` // zero means no upper bound
+	Percent   float64 `json:"percent"`
+}
+
+func (r *CashbackRule) matches(req TransferRequest) bool {
+	if r.Category != "" && r.Category != req.Category {
+		return false
+	}
+	if r.Payee != 0 && r.Payee != req.ToAccountNumber {
+		return false
+	}
+	if req.Amount < r.MinAmount {
+		return false
+	}
+	return r.MaxAmount == 0 || req.Amount <= r.MaxAmount
+}
+
+type Cashback struct {
+	ID             int       `json:"id"`
+	AccountID      int       `json:"account_id"`
+	Rule           string    `json:"rule"`
+	TransferAmount int64     `json:"transfer_amount"`
+	Amount         int64     `json:"amount"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type CashbackSummary struct {
+	AccountID     int         `json:"account_id"`
+	MonthTotal    int64       `json:"month_total"`
+	MonthlyCap    int64       `json:"monthly_cap"`
+	CapRemaining  int64       `json:"cap_remaining"`
+	LifetimeTotal int64       `json:"lifetime_total"`
+	Recent        []*Cashback `json:"recent"`
+}
+
+type CashbackProgram struct {
+	rules          []CashbackRule
+	monthlyCap     int64
+	fundingAccount int64
+}
+
+func NewCashbackProgram(cfg *Config) (*CashbackProgram, error) {
+	if cfg.CashbackRules == "" {
+		return nil, nil
+	}
+
+	rules := []CashbackRule{}
+	if err := json.Unmarshal([]byte(cfg.CashbackRules), &rules); err != nil {
+		return nil, fmt.Errorf("invalid CASHBACK_RULES: %v", err)
+	}
+	for _, r := range rules {
+		if r.Percent <= 0 || r.Percent > 100 {
+			return nil, fmt.Errorf("cashback rule %q: percent must be between 0 and 100", r.Name)
+		}
+	}
+
+	return &CashbackProgram{
+		rules:          rules,
+		monthlyCap:     toCents(cfg.CashbackMonthlyCap),
+		fundingAccount: cfg.CashbackFundingAccount,
+	}, nil
+}
+
+func startOfMonth(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+// earn returns the credit for a transfer given what was already paid this
+// month, and the rule that qualified it
+func (p *CashbackProgram) earn(req TransferRequest, paidThisMonth int64) (int64, *CashbackRule) {
+	for i := range p.rules {
+		rule := &p.rules[i]
+		if !rule.matches(req) {
+			continue
+		}
+
+		amount := int64(math.Floor(float64(toCents(req.Amount)) * rule.Percent / 100))
+		if p.monthlyCap > 0 {
+			amount = min(amount, max(p.monthlyCap-paidThisMonth, 0))
+		}
+		return amount, rule
+	}
+	return 0, nil
+}
+
+// pay credits cashback for a settled transfer. The transfer already
+// happened, so failures are logged rather than returned.
+func (p *CashbackProgram) pay(ctx context.Context, store Storage, from *Account, req TransferRequest) {
+	now := time.Now().UTC()
+	paid, err := store.GetCashbackTotal(ctx, from.ID, startOfMonth(now))
+	if err != nil {
+		log.Printf("Failed to load cashback total for account %d: %v", from.ID, err)
+		return
+	}
+
+	amount, rule := p.earn(req, paid)
+	if amount <= 0 {
+		return
+	}
+
+	if err := p.credit(ctx, store, from, rule, req, amount, now); err != nil {
+		log.Printf("Failed to pay cashback to account %d: %v", from.ID, err)
+	}
+}
+
+func (p *CashbackProgram) credit(ctx context.Context, store Storage, to *Account, rule *CashbackRule, req TransferRequest, amount int64, now time.Time) error {
+	var funding *Account
+	if p.fundingAccount != 0 {
+		var err error
+		if funding, err = store.GetAccountByNumber(ctx, p.fundingAccount); err != nil {
+			return fmt.Errorf("cashback funding account: %v", err)
+		}
+	}
+
+	tx, err := store.BeginTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Paid out of the funding account when there is one, otherwise it's an expense
+	entry := newLedgerEntry(ctx, "cashback").account(to, amount)
+	if funding != nil {
+		entry.account(funding, -amount)
+	} else {
+		entry.ledger(LedgerCashback, to.Currency, -amount)
+	}
+	if err := store.PostLedgerEntry(ctx, entry, tx); err != nil {
+		return err
+	}
+
+	err = store.RecordCashback(ctx, &Cashback{
+		AccountID:      to.ID,
+		Rule:           rule.Name,
+		TransferAmount: toCents(req.Amount),
+		Amount:         amount,
+		CreatedAt:      now,
+	}, tx)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if funding != nil {
+		auditBalanceChange(ctx, store, "cashback", funding, -amount)
+	}
+	// to predates the transfer, reload it for an accurate before balance
+	if acc, err := store.GetAccountbyID(ctx, to.ID); err == nil {
+		acc.Balance -= amount
+		auditBalanceChange(ctx, store, "cashback", acc, amount)
+	}
+	return nil
+}
+
+// GET /account/{id}/cashback
+func (s *APIServer) handleCashback(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	store := s.forRequest(r).store
+	ctx := r.Context()
+
+	month, err := store.GetCashbackTotal(ctx, id, startOfMonth(time.Now().UTC()))
+	if err != nil {
+		return err
+	}
+	lifetime, err := store.GetCashbackTotal(ctx, id, time.Time{})
+	if err != nil {
+		return err
+	}
+	recent, err := store.GetCashbackCredits(ctx, id, 20)
+	if err != nil {
+		return err
+	}
+
+	summary := &CashbackSummary{
+		AccountID:     id,
+		MonthTotal:    month,
+		LifetimeTotal: lifetime,
+		Recent:        recent,
+	}
+	if s.cashback != nil && s.cashback.monthlyCap > 0 {
+		summary.MonthlyCap = s.cashback.monthlyCap
+		summary.CapRemaining = max(s.cashback.monthlyCap-month, 0)
+	}
+
+	return WriteJSON(w, http.StatusOK, summary)
+}
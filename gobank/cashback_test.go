@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCashbackEarn(t *testing.T) {
+	program, err := NewCashbackProgram(&Config{
+		CashbackRules:      `[{"name":"groceries","category":"groceries","percent":5},{"name":"big","min_amount":100,"max_amount":500,"percent":1}]`,
+		CashbackMonthlyCap: 10,
+	})
+	require.Nil(t, err)
+
+	amount, rule := program.earn(TransferRequest{Amount: 20, Category: "groceries"}, 0)
+	assert.Equal(t, int64(100), amount)
+	assert.Equal(t, "groceries", rule.Name)
+
+	amount, _ = program.earn(TransferRequest{Amount: 99.99}, 0)
+	assert.Equal(t, int64(0), amount)
+	amount, _ = program.earn(TransferRequest{Amount: 250}, 0)
+	assert.Equal(t, int64(250), amount)
+
+	// Only what is left of the monthly cap is paid
+	amount, _ = program.earn(TransferRequest{Amount: 250}, 900)
+	assert.Equal(t, int64(100), amount)
+	amount, _ = program.earn(TransferRequest{Amount: 250}, 1000)
+	assert.Equal(t, int64(0), amount)
+
+	_, err = NewCashbackProgram(&Config{CashbackRules: `[{"name":"bad","percent":0}]`})
+	assert.Error(t, err)
+	program, err = NewCashbackProgram(&Config{})
+	assert.Nil(t, err)
+	assert.Nil(t, program)
+}
+
+func TestCashbackPayout(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	funding := &Account{Number: 4000, Balance: 100000, Currency: "USD"}
+	from := &Account{Number: 4001, Balance: 10000, Currency: "USD"}
+	to := &Account{Number: 4002, Currency: "USD"}
+	for _, acc := range []*Account{funding, from, to} {
+		require.Nil(t, store.CreateAccount(ctx, acc))
+	}
+
+	program, err := NewCashbackProgram(&Config{
+		CashbackRules:          `[{"name":"payee","payee":4002,"percent":2}]`,
+		CashbackFundingAccount: 4000,
+	})
+	require.Nil(t, err)
+
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	transfers := NewTransferService(store, TransferLimits{}, staticRateProvider{}, program, nil)
+
+	_, _, err = transfers.Transfer(ctx, TransferRequest{FromAccountNumber: 4001, ToAccountNumber: 4002, Amount: 50}, engine, "test")
+	require.Nil(t, err)
+
+	fromAfter, _ := store.GetAccountbyID(ctx, from.ID)
+	fundingAfter, _ := store.GetAccountbyID(ctx, funding.ID)
+	assert.Equal(t, int64(5100), fromAfter.Balance)
+	assert.Equal(t, int64(99900), fundingAfter.Balance)
+	require.Len(t, store.cashback, 1)
+	assert.Equal(t, int64(100), store.cashback[0].Amount)
+
+	// Sweeps don't earn cashback
+	_, _, err = transfers.Transfer(withTransferKind(ctx, TransferKindSweep), TransferRequest{FromAccountNumber: 4001, ToAccountNumber: 4002, Amount: 10}, engine, "test")
+	require.Nil(t, err)
+	assert.Len(t, store.cashback, 1)
+	assert.Empty(t, store.reconcile())
+}
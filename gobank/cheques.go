@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A deposited cheque is booked to the account straight away, so it shows in
+// the balance, and reserved until it clears, so it doesn't show in the
+// available balance. The cheque-clearing job releases the reservation once
+// CHEQUE_CLEARING_DELAY has passed. Until then an admin can bounce the
+// cheque, which books the deposit back out against the clearing ledger and
+// releases the reservation with it.
+
+const (
+	TransferKindChequeDeposit = "cheque_deposit"
+	TransferKindChequeBounce  = "cheque_bounce"
+	LedgerChequeClearing      = "clearing:cheques"
+
+	ReservationChequeClearing = "cheque_clearing"
+
+	ChequePending = "pending"
+	ChequeCleared = "cleared"
+	ChequeBounced = "bounced"
+
+	AuditChequeDeposited = "cheque.deposited"
+	AuditChequeBounced   = "cheque.bounced"
+)
+
+type Cheque struct {
+	ID            int        `json:"id"`
+	AccountID     int        `json:"account_id"`
+	Number        string     `json:"number"`
+	Drawer        string     `json:"drawer,omitempty"`
+	Amount        float64    `json:"amount"`
+	Currency      string     `json:"currency"`
+	Status        string     `json:"status"`
+	ReservationID int        `json:"reservation_id"`
+	DepositedAt   time.Time  `json:"deposited_at"`
+	ClearsAt      time.Time  `json:"clears_at"`
+	ResolvedAt    *time.Time `json:"resolved_at,omitempty"`
+	BounceReason  string     `json:"bounce_reason,omitempty"`
+}
+
+type DepositChequeRequest struct {
+	Number string  `json:"number" validate:"required,max=20"`
+	Drawer string  `json:"drawer,omitempty" validate:"max=100"`
+	Amount float64 `json:"amount" validate:"positive"`
+}
+
+type BounceChequeRequest struct {
+	Reason string `json:"reason" validate:"required,max=500"`
+}
+
+func chequeID(r *http.Request) (int, error) {
+	return pathID(r, "chequeID")
+}
+
+// postWithRetry posts the entry build makes for the account's current
+// version, reading it again when a concurrent write got in first
+func postWithRetry(ctx context.Context, store Storage, accountID int, build func(acc *Account) *LedgerEntry) error {
+	for attempt := 1; ; attempt++ {
+		acc, err := store.GetAccountbyID(ctx, accountID)
+		if err != nil {
+			return err
+		}
+		err = store.PostLedgerEntry(ctx, build(acc), nil)
+		if !errors.Is(err, ErrConflict) || attempt == transferConflictRetries {
+			return err
+		}
+	}
+}
+
+// GET /account/{id}/cheques
+func (s *APIServer) handleGetCheques(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	cheques, err := s.store.GetCheques(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, cheques)
+}
+
+// POST /account/{id}/cheques
+func (s *APIServer) handleDepositCheque(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	var req DepositChequeRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+	cheque, err := s.depositCheque(r.Context(), id, req, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusCreated, cheque)
+}
+
+// depositCheque reserves the amount before booking it, a failure in between
+// leaves less available rather than more
+func (s *APIServer) depositCheque(ctx context.Context, accountID int, req DepositChequeRequest, actor string) (*Cheque, error) {
+	acc, err := s.store.GetAccountbyID(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAccountUsable(acc); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	amount := toCents(req.Amount)
+	number := strings.TrimSpace(req.Number)
+	reservation := &Reservation{
+		AccountID: accountID,
+		Amount:    amount,
+		Currency:  acc.Currency,
+		Kind:      ReservationChequeClearing,
+		Reference: "cheque " + number,
+		Status:    ReservationActive,
+		CreatedAt: now,
+	}
+	if err := s.store.CreateReservation(ctx, reservation); err != nil {
+		return nil, err
+	}
+
+	err = postWithRetry(ctx, s.store, accountID, func(acc *Account) *LedgerEntry {
+		entry := newLedgerEntry(ctx, TransferKindChequeDeposit).
+			account(acc, amount).
+			ledger(LedgerChequeClearing, acc.Currency, -amount)
+		entry.Memo = reservation.Reference
+		return entry
+	})
+	if err != nil {
+		reservation.Status, reservation.ResolvedAt = ReservationReleased, &now
+		if _, releaseErr := s.store.ResolveReservation(ctx, reservation, ReservationActive); releaseErr != nil {
+			log.Printf("Failed to release reservation %d of an unbooked cheque: %v", reservation.ID, releaseErr)
+		}
+		return nil, err
+	}
+
+	cheque := &Cheque{
+		AccountID:     accountID,
+		Number:        number,
+		Drawer:        strings.TrimSpace(req.Drawer),
+		Amount:        req.Amount,
+		Currency:      acc.Currency,
+		Status:        ChequePending,
+		ReservationID: reservation.ID,
+		DepositedAt:   now,
+		ClearsAt:      now.Add(s.config.ChequeClearingDelay),
+	}
+	if err := s.store.CreateCheque(ctx, cheque); err != nil {
+		return nil, err
+	}
+	recordAudit(ctx, s.store, actor, accountID, AuditChequeDeposited, []FieldChange{{Field: "cheque", Old: nil, New: cheque.ID}})
+	return cheque, nil
+}
+
+// POST /admin/cheques/{chequeID}/bounce
+func (s *APIServer) handleBounceCheque(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	id, err := chequeID(r)
+	if err != nil {
+		return err
+	}
+	var req BounceChequeRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+
+	cheque, err := s.store.GetCheque(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	// Claiming the bounce keeps the clearing job off the cheque
+	now := time.Now().UTC()
+	cheque.Status, cheque.ResolvedAt, cheque.BounceReason = ChequeBounced, &now, req.Reason
+	claimed, err := s.store.ResolveCheque(r.Context(), cheque, ChequePending)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return fmt.Errorf("%w: cheque %d", ErrChequeResolved, id)
+	}
+
+	amount := toCents(cheque.Amount)
+	err = postWithRetry(r.Context(), s.store, cheque.AccountID, func(acc *Account) *LedgerEntry {
+		entry := newLedgerEntry(r.Context(), TransferKindChequeBounce).
+			account(acc, -amount).
+			ledger(LedgerChequeClearing, cheque.Currency, amount)
+		entry.Memo = "cheque " + cheque.Number + " bounced"
+		return entry
+	})
+	if err != nil {
+		cheque.Status, cheque.ResolvedAt, cheque.BounceReason = ChequePending, nil, ""
+		if _, revertErr := s.store.ResolveCheque(r.Context(), cheque, ChequeBounced); revertErr != nil {
+			log.Printf("Cheque %d is marked bounced but wasn't booked out: %v", id, revertErr)
+		}
+		return err
+	}
+
+	s.releaseChequeReservation(r.Context(), cheque, now)
+	recordAudit(r.Context(), s.store, auditActor(r, s.config), cheque.AccountID, AuditChequeBounced,
+		[]FieldChange{{Field: "cheque", Old: cheque.ID, New: nil}})
+	return WriteJSON(w, http.StatusOK, cheque)
+}
+
+func (s *APIServer) releaseChequeReservation(ctx context.Context, cheque *Cheque, now time.Time) {
+	reservation := &Reservation{ID: cheque.ReservationID, Status: ReservationReleased, ResolvedAt: &now}
+	if _, err := s.store.ResolveReservation(ctx, reservation, ReservationActive); err != nil {
+		log.Printf("Failed to release the reservation of cheque %d: %v", cheque.ID, err)
+	}
+}
+
+// chequeClearingJob makes the funds of cheques past their clearing delay available
+func (s *APIServer) chequeClearingJob() Job {
+	return Job{
+		Name:     "cheque-clearing",
+		Interval: s.config.SchedulerInterval,
+		Run: func(ctx context.Context) error {
+			now := time.Now().UTC()
+			due, err := s.store.GetDueCheques(ctx, now, 100)
+			if err != nil {
+				return err
+			}
+			setJobQueueDepth("cheque_clearing", len(due))
+
+			for _, cheque := range due {
+				cheque.Status, cheque.ResolvedAt = ChequeCleared, &now
+				cleared, err := s.store.ResolveCheque(ctx, cheque, ChequePending)
+				if err != nil {
+					return err
+				}
+				if cleared {
+					s.releaseChequeReservation(ctx, cheque, now)
+				}
+			}
+			return nil
+		},
+	}
+}
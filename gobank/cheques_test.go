@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheques(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	acc := &Account{Number: 5201, Balance: 1000, Currency: "USD", Status: AccountActive}
+	require.Nil(t, store.CreateAccount(ctx, acc))
+	s := NewAPIServer(&Config{ChequeClearingDelay: time.Hour}, store)
+
+	balances := func() (int64, int64) {
+		current, err := withAvailableBalance(ctx, store, mustAccount(t, store, acc.ID))
+		require.Nil(t, err)
+		return current.Balance, *current.AvailableBalance
+	}
+	deposit := func(number string) *Cheque {
+		w := httptest.NewRecorder()
+		r := mux.SetURLVars(httptest.NewRequest("POST", "/", strings.NewReader(`{"number": "`+number+`", "amount": 25}`)),
+			map[string]string{"id": strconv.Itoa(acc.ID)})
+		makeHTTPHandle(s.handleDepositCheque)(w, r)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		cheques, _ := store.GetCheques(ctx, acc.ID)
+		return cheques[0]
+	}
+	bounce := func(id int) int {
+		w := httptest.NewRecorder()
+		r := mux.SetURLVars(httptest.NewRequest("POST", "/", strings.NewReader(`{"reason": "refer to drawer"}`)),
+			map[string]string{"chequeID": strconv.Itoa(id)})
+		makeHTTPHandle(s.handleBounceCheque)(w, r)
+		return w.Code
+	}
+
+	// Booked straight away, available once it clears
+	cleared := deposit("000101")
+	balance, available := balances()
+	assert.Equal(t, int64(3500), balance)
+	assert.Equal(t, int64(1000), available)
+
+	require.Nil(t, s.chequeClearingJob().Run(ctx))
+	_, available = balances()
+	assert.Equal(t, int64(1000), available, "not due yet")
+
+	store.cheques[0].ClearsAt = time.Now().Add(-time.Minute)
+	require.Nil(t, s.chequeClearingJob().Run(ctx))
+	_, available = balances()
+	assert.Equal(t, int64(3500), available)
+	assert.Equal(t, http.StatusConflict, bounce(cleared.ID), "cleared cheques can't bounce")
+
+	// A bounce books the deposit back out before releasing its reservation
+	bounced := deposit("000102")
+	require.Equal(t, http.StatusOK, bounce(bounced.ID))
+	balance, available = balances()
+	assert.Equal(t, int64(3500), balance)
+	assert.Equal(t, int64(3500), available)
+	bounced, _ = store.GetCheque(ctx, bounced.ID)
+	assert.Equal(t, ChequeBounced, bounced.Status)
+	assert.Equal(t, "refer to drawer", bounced.BounceReason)
+	assert.Equal(t, TransferKindChequeBounce, store.entries[len(store.entries)-1].Kind)
+
+	store.cheques[1].ClearsAt = time.Now().Add(-time.Minute)
+	require.Nil(t, s.chequeClearingJob().Run(ctx))
+	bounced, _ = store.GetCheque(ctx, bounced.ID)
+	assert.Equal(t, ChequeBounced, bounced.Status)
+	assert.Equal(t, http.StatusNotFound, bounce(99))
+}
+
+func mustAccount(t *testing.T, store Storage, id int) *Account {
+	acc, err := store.GetAccountbyID(context.Background(), id)
+	require.Nil(t, err)
+	return acc
+}
@@ -0,0 +1,189 @@
+// Package client is a Go client for the gobank HTTP API. Errors the server
+// reports come back as *APIError, see errors.go for matching them.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Client struct {
+	BaseURL    string // e.g. http://localhost:8080/v1
+	HTTPClient *http.Client
+	Token      string // sent as x-jwt-token, set by Login
+
+	// Retryable errors are retried up to MaxRetries times, waiting Backoff
+	// doubled per attempt unless the server sent Retry-After
+	MaxRetries int
+	Backoff    time.Duration
+}
+
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		MaxRetries: 3,
+		Backoff:    200 * time.Millisecond,
+	}
+}
+
+type Account struct {
+	ID            int       `json:"id"`
+	FirstName     string    `json:"first_name"`
+	LastName      string    `json:"last_name"`
+	AccountNumber int64     `json:"account_number"`
+	Balance       int64     `json:"balance"` // in cents
+	Currency      string    `json:"currency"`
+	Status        string    `json:"status"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type TransferRequest struct {
+	FromAccountNumber int64   `json:"fromAccount"`
+	ToAccountNumber   int64   `json:"toAccount"`
+	ToAlias           string  `json:"toAlias,omitempty"` // a payee's verified phone or email in place of ToAccountNumber
+	Amount            float64 `json:"amount"`
+	Category          string  `json:"category,omitempty"`
+}
+
+type TransferReceipt struct {
+	Reference       string    `json:"reference"`
+	Status          string    `json:"status"`
+	Kind            string    `json:"kind"`
+	FromAccount     int64     `json:"from_account"`
+	ToAccount       int64     `json:"to_account"`
+	Amount          float64   `json:"amount"`
+	Currency        string    `json:"currency"`
+	ConvertedAmount float64   `json:"converted_amount,omitempty"`
+	ToCurrency      string    `json:"to_currency,omitempty"`
+	FxRate          float64   `json:"fx_rate,omitempty"`
+	TransferredAt   time.Time `json:"transferred_at"`
+}
+
+// Login stores the returned token on the client for later requests
+func (c *Client) Login(ctx context.Context, number int64, password string) error {
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := c.do(ctx, "POST", "/login", map[string]any{"number": number, "password": password}, &resp); err != nil {
+		return err
+	}
+	c.Token = resp.Token
+	return nil
+}
+
+// Logout revokes the client's token on the server and forgets it
+func (c *Client) Logout(ctx context.Context) error {
+	if err := c.do(ctx, "POST", "/logout", nil, nil); err != nil {
+		return err
+	}
+	c.Token = ""
+	return nil
+}
+
+func (c *Client) GetAccount(ctx context.Context, id int) (*Account, error) {
+	acc := new(Account)
+	if err := c.do(ctx, "GET", "/account/"+strconv.Itoa(id), nil, acc); err != nil {
+		return nil, err
+	}
+	return acc, nil
+}
+
+func (c *Client) Transfer(ctx context.Context, req TransferRequest) (*TransferReceipt, error) {
+	receipt := new(TransferReceipt)
+	if err := c.do(ctx, "POST", "/transfer", req, receipt); err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
+
+func (c *Client) GetTransfer(ctx context.Context, reference string) (*TransferReceipt, error) {
+	receipt := new(TransferReceipt)
+	if err := c.do(ctx, "GET", "/transfer/"+reference, nil, receipt); err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		wait, err := c.send(ctx, method, path, payload, out)
+
+		var apiErr *APIError
+		if err == nil || !errors.As(err, &apiErr) || !apiErr.Retryable() || attempt >= c.MaxRetries {
+			return err
+		}
+
+		if wait == 0 {
+			wait = backoff
+			backoff *= 2
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// send makes one attempt, returning the server's Retry-After if it sent one
+func (c *Client) send(ctx context.Context, method, path string, payload []byte, out any) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("x-jwt-token", c.Token)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	if resp.StatusCode >= 300 {
+		apiErr := &APIError{Status: resp.StatusCode}
+		if json.Unmarshal(data, apiErr) != nil || apiErr.Message == "" {
+			apiErr.Message = strings.TrimSpace(string(data))
+		}
+		var wait time.Duration
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			wait = time.Duration(seconds) * time.Second
+		}
+		return wait, apiErr
+	}
+
+	if out == nil {
+		return 0, nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return 0, fmt.Errorf("gobank: decoding %s %s response: %v", method, path, err)
+	}
+	return 0, nil
+}
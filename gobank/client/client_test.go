@@ -0,0 +1,99 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// server answers each request with the next of responses, repeating the last
+func server(t *testing.T, calls *int32, responses ...func(w http.ResponseWriter)) *Client {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(calls, 1)) - 1
+		if n >= len(responses) {
+			n = len(responses) - 1
+		}
+		w.Header().Set("Content-Type", "application/json")
+		responses[n](w)
+	}))
+	t.Cleanup(srv.Close)
+
+	c := New(srv.URL)
+	c.Backoff = time.Millisecond
+	return c
+}
+
+func reply(status int, body string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	ctx := context.Background()
+	var calls int32
+	c := server(t, &calls, reply(400, `{"error":"insufficient balance","code":"INSUFFICIENT_FUNDS"}`))
+
+	_, err := c.Transfer(ctx, TransferRequest{FromAccountNumber: 1, ToAccountNumber: 2, Amount: 10})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	assert.NotErrorIs(t, err, ErrLimitExceeded)
+
+	var apiErr *APIError
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, 400, apiErr.Status)
+	assert.Equal(t, "insufficient balance", apiErr.Message)
+	assert.Equal(t, int32(1), calls)
+
+	calls = 0
+	c = server(t, &calls, reply(422, `{"error":"invalid request","code":"VALIDATION_FAILED","fields":[{"field":"amount","rule":"positive","message":"must be positive"}]}`))
+	_, err = c.Transfer(ctx, TransferRequest{})
+	assert.ErrorIs(t, err, ErrValidation)
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, "amount", apiErr.Fields[0].Field)
+
+	// Bodies that aren't the envelope still become an APIError
+	c = server(t, &calls, reply(502, `bad gateway`))
+	_, err = c.GetAccount(ctx, 1)
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, "bad gateway", apiErr.Message)
+}
+
+func TestRetries(t *testing.T) {
+	ctx := context.Background()
+	receipt := reply(200, `{"reference":"ref","status":"success"}`)
+
+	var calls int32
+	c := server(t, &calls, reply(429, `{"error":"too many requests","code":"RATE_LIMITED"}`), reply(409, `{"error":"conflict","code":"CONFLICT"}`), receipt)
+	got, err := c.Transfer(ctx, TransferRequest{FromAccountNumber: 1, ToAccountNumber: 2, Amount: 10})
+	require.Nil(t, err)
+	assert.Equal(t, "ref", got.Reference)
+	assert.Equal(t, int32(3), calls)
+
+	// The daily limit is a 429 too, but retrying won't help
+	for status, body := range map[int]string{
+		429: `{"error":"daily transfer count limit of 2 reached","code":"LIMIT_EXCEEDED"}`,
+		503: `{"error":"transfer outcome unknown","code":"TRANSFER_UNCONFIRMED"}`,
+	} {
+		calls = 0
+		c = server(t, &calls, reply(status, body), receipt)
+		_, err = c.Transfer(ctx, TransferRequest{FromAccountNumber: 1, ToAccountNumber: 2, Amount: 10})
+		require.Error(t, err)
+		assert.Equal(t, int32(1), calls, body)
+	}
+
+	calls = 0
+	c = server(t, &calls, reply(409, `{"error":"conflict","code":"CONFLICT"}`))
+	c.MaxRetries = 2
+	_, err = c.Transfer(ctx, TransferRequest{FromAccountNumber: 1, ToAccountNumber: 2, Amount: 10})
+	assert.ErrorIs(t, err, ErrConflict)
+	assert.Equal(t, int32(3), calls)
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinels for the error codes callers usually branch on. An *APIError
+// matches the sentinel for its code, so
+//
+//	if errors.Is(err, client.ErrInsufficientFunds) { ... }
+//
+// works on anything the Client returns, and errors.As gets at the status,
+// the message and, for validation errors, the failing fields.
+var (
+	ErrInsufficientFunds   = errors.New("insufficient funds")
+	ErrLimitExceeded       = errors.New("daily transfer limit exceeded")
+	ErrRateLimited         = errors.New("rate limited")
+	ErrAccountNotFound     = errors.New("account not found")
+	ErrAccountClosed       = errors.New("account is closed")
+	ErrAccountFrozen       = errors.New("account is frozen")
+	ErrAccountDormant      = errors.New("account is dormant")
+	ErrTransferNotFound    = errors.New("transfer not found")
+	ErrTransferUnconfirmed = errors.New("transfer outcome unknown")
+	ErrConflict            = errors.New("concurrent modification")
+	ErrValidation          = errors.New("validation failed")
+	ErrUnavailable         = errors.New("service unavailable")
+)
+
+var codeErrors = map[string]error{
+	"INSUFFICIENT_FUNDS":   ErrInsufficientFunds,
+	"LIMIT_EXCEEDED":       ErrLimitExceeded,
+	"RATE_LIMITED":         ErrRateLimited,
+	"ACCOUNT_NOT_FOUND":    ErrAccountNotFound,
+	"ACCOUNT_CLOSED":       ErrAccountClosed,
+	"ACCOUNT_FROZEN":       ErrAccountFrozen,
+	"ACCOUNT_DORMANT":      ErrAccountDormant,
+	"TRANSFER_NOT_FOUND":   ErrTransferNotFound,
+	"TRANSFER_UNCONFIRMED": ErrTransferUnconfirmed,
+	"CONFLICT":             ErrConflict,
+	"VALIDATION_FAILED":    ErrValidation,
+	"UPSTREAM_UNAVAILABLE": ErrUnavailable,
+	"CONSISTENCY_TIMEOUT":  ErrUnavailable,
+}
+
+// Codes whose request had no effect and can be sent again as is. Neither
+// UPSTREAM_UNAVAILABLE nor TRANSFER_UNCONFIRMED is here: a transfer may have
+// gone through, look it up by reference before retrying. LIMIT_EXCEEDED
+// shares 429 with RATE_LIMITED but won't clear until the next day.
+var retryableCodes = map[string]bool{
+	"RATE_LIMITED":        true,
+	"CONFLICT":            true,
+	"CONSISTENCY_TIMEOUT": true,
+}
+
+// FieldError is one failed check. Field is a JSON pointer into the request
+// body, or a parameter name when In is "query" or "path".
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	In      string `json:"in,omitempty"`
+}
+
+// APIError is the server's error envelope along with the HTTP status
+type APIError struct {
+	Status  int          `json:"-"`
+	Message string       `json:"error"`
+	Code    string       `json:"code,omitempty"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("gobank: %d: %s", e.Status, e.Message)
+	}
+	return fmt.Sprintf("gobank: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func (e *APIError) Is(target error) bool {
+	return codeErrors[e.Code] == target
+}
+
+// Retryable reports whether sending the same request again is safe
+func (e *APIError) Retryable() bool {
+	return retryableCodes[e.Code]
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Config struct {
+	ListenAddr     string
+	GRPCListenAddr string // empty disables the gRPC API
+	AdminToken     string
+	JWTKeys        string // kid=path PEM keys for RS256 or EdDSA tokens, see jwks.go
+
+	// Login through an external OpenID Connect provider when the issuer is
+	// set, OIDCScopes are requested on top of openid
+	OIDCIssuerURL    string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	OIDCScopes       string
+
+	// "postgres", "corebanking" to proxy accounts and balances to an external
+	// system, or "eventsourced" to derive balances from account event streams
+	StorageBackend      string
+	CoreBankingURL      string
+	CoreBankingAPIKey   string
+	CoreBankingRetries  int
+	CoreBankingCacheTTL time.Duration
+	EventSnapshotEvery  int
+
+	// HTTP-date sent as Sunset on the deprecated unversioned paths, empty omits it
+	LegacyRoutesSunset string
+
+	// Apply pending pre-deploy migrations on startup
+	AutoMigrate bool
+
+	// Expose pprof and expvar under /debug (admin only)
+	DebugEndpoints bool
+
+	// Comma-separated CIDRs or IPs of the load balancers and proxies in
+	// front of the server. X-Forwarded-For and X-Forwarded-Proto are only
+	// believed when they were added by one of these.
+	TrustedProxies string
+
+	// Redirect plain HTTP requests to HTTPS, judged by X-Forwarded-Proto behind a trusted proxy
+	ForceHTTPS bool
+
+	// Serve HTTPS on ListenAddr with a cert/key pair, or with certificates
+	// from Let's Encrypt for the comma-separated AutocertDomains. A plain
+	// HTTP listener on HTTPRedirectAddr redirects to it and answers ACME
+	// challenges.
+	TLSCertFile      string
+	TLSKeyFile       string
+	AutocertDomains  string
+	AutocertCacheDir string
+	AutocertEmail    string
+	HTTPRedirectAddr string
+
+	// Comma-separated name:base64 ed25519 public keys of the admins who
+	// approve high-impact operations, and how many of them must sign one.
+	// Manual adjustments above the threshold need approval.
+	AdminApproverKeys           string
+	AdminApprovalsRequired      int
+	AdminOperationTTL           time.Duration
+	AdjustmentApprovalThreshold float64
+
+	// Request bodies over this many bytes are refused with 413, 0 disables the limit
+	MaxBodyBytes int64
+
+	// Record sanitized inbound requests for `gobank replay`, bodies over
+	// the size limit are journaled without their body
+	RequestJournalEnabled bool
+	RequestJournalPath    string
+	RequestJournalMaxBody int64
+
+	// Token bucket limits applied per client IP and, for logins, per account number
+	RateLimitEnabled     bool
+	LoginRatePerMinute   int
+	AccountRatePerMinute int
+
+	// Accounts created per client IP or device per day before a CAPTCHA is
+	// required (soft) and before signups are refused (hard), zero disables either
+	SignupQuotaEnabled    bool
+	SignupSoftLimitPerDay int
+	SignupHardLimitPerDay int
+
+	// siteverify endpoint and secret of the CAPTCHA provider
+	CaptchaVerifyURL string
+	CaptchaSecret    string
+
+	// How long password reset and email verification tokens and alias codes stay valid
+	PasswordResetTTL     time.Duration
+	EmailVerificationTTL time.Duration
+	AliasVerificationTTL time.Duration
+
+	// HMAC key for KYC document numbers, only their hash is stored
+	KYCHashKey string
+
+	// How long a customer's personal data is kept after they ask for
+	// erasure with DELETE /me, zero erases it straight away
+	ErasureRetention time.Duration
+
+	// How long after a transfer its payer can dispute it, zero for no limit
+	DisputeWindow time.Duration
+
+	// Delivery channel for account notifications: "log", or "email" / "sms"
+	// through the gateway at NotifierGatewayURL
+	Notifier              string
+	NotifierGatewayURL    string
+	NotifierGatewayAPIKey string
+
+	// Email to addresses, used for statements: "log", or "smtp" through
+	// SMTPAddr, authenticating when SMTPUsername is set
+	Mailer       string
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+	MailFrom     string
+
+	// Optional shared store for rate limits and quotas, in-memory when unset
+	RedisURL string
+
+	// Transfer engine used for /transfer, and an optional one served to canary traffic
+	TransferEngine       string
+	CanaryTransferEngine string
+
+	// sync performs /transfer within the request, async queues it for the
+	// transfer workers and answers 202 with a tracking ID
+	TransferMode             string
+	TransferQueueWorkers     int
+	TransferQueueInterval    time.Duration
+	TransferQueueMaxAttempts int
+	TransferQueueRetryDelay  time.Duration
+
+	// Isolation level of transfer transactions (serializable, repeatable
+	// read or read committed) and how often one that lost a race is retried,
+	// backing off from TransferRetryBackoff doubling up to TransferRetryMaxBackoff
+	TransferIsolation       string
+	TransferRetries         int
+	TransferRetryBackoff    time.Duration
+	TransferRetryMaxBackoff time.Duration
+
+	// Share of traffic routed to registered canary handlers, and the header
+	// clients use to force a side
+	CanaryPercent int
+	CanaryHeader  string
+
+	// Exchange rates for cross-currency transfers: "static" reads FX_RATES
+	// ("USD:EUR=0.92,..."), "http" queries FX_RATES_URL
+	FXProvider string
+	FXRates    string
+	FXRatesURL string
+	FXRatesTTL time.Duration
+
+	// Connection strings of the primary and of an optional read replica
+	// serving account lookups, see replica.go. A failing replica is skipped
+	// for DBReplicaRetry.
+	DatabaseURL        string
+	DatabaseReplicaURL string
+	DBReplicaRetry     time.Duration
+
+	// Upper bound for a single database query
+	DBQueryTimeout time.Duration
+
+	// Prepare the hot path's queries at startup, see prepared.go
+	DBPrepareStatements bool
+
+	// Connection pool, and how often its health is checked. The pool counts
+	// as saturated when the share of open connections in use reaches
+	// DBPoolSaturation.
+	DBMaxOpenConns    int
+	DBMaxIdleConns    int
+	DBConnMaxLifetime time.Duration
+	DBHealthInterval  time.Duration
+	DBPoolSaturation  float64
+
+	// How long a read presenting a consistency token waits for the database to catch up
+	ConsistencyWaitTimeout time.Duration
+
+	// Longest a long-poll for account events is held open, and how often an
+	// idle event stream sends a keep-alive comment
+	EventPollMaxWait     time.Duration
+	EventStreamKeepAlive time.Duration
+
+	// WebSocket keep-alive and backpressure, see websocket.go
+	WSPingInterval time.Duration
+	WSWriteTimeout time.Duration
+	WSSendBuffer   int
+
+	// How long admin dashboard statistics are reused, zero recomputes them every time
+	StatsCacheTTL time.Duration
+
+	// How long an account's spending analytics are reused, zero recomputes them every time
+	AnalyticsCacheTTL time.Duration
+
+	// Read-through account cache, memory or redis, see account_cache.go. A
+	// zero ACCOUNT_CACHE_TTL turns it off.
+	AccountCache     string
+	AccountCacheTTL  time.Duration
+	AccountCacheSize int
+
+	// Where POST /admin/backups uploads to, see backup.go. BackupTarget is
+	// "dir" or "s3", empty turns backups off.
+	BackupTarget      string
+	BackupDir         string
+	BackupS3Endpoint  string
+	BackupS3Region    string
+	BackupS3Bucket    string
+	BackupS3Prefix    string
+	BackupS3AccessKey string
+	BackupS3SecretKey string
+
+	// Comma-separated enrichers run on committed transfers: category, impact
+	Enrichers           string
+	EnrichmentWorkers   int
+	EnrichmentQueueSize int
+
+	// Background jobs
+	SchedulerEnabled             bool
+	SchedulerInterval            time.Duration
+	EODEnabled                   bool // run yesterday's end of day processing from the scheduler
+	ScheduledTransferMaxAttempts int
+	ScheduledTransferRetryDelay  time.Duration
+	StandingOrderMaxAttempts     int
+	StandingOrderRetryDelay      time.Duration
+	MandateCollectionMaxAttempts int
+	MandateCollectionRetryDelay  time.Duration
+	ChequeClearingDelay          time.Duration // before a deposited cheque's funds are available
+	ExternalACHSettlementDelay   time.Duration
+	ExternalWireSettlementDelay  time.Duration
+
+	// Per-account daily transfer caps, zero means unlimited
+	DailyTransferAmount float64
+	DailyTransferCount  int
+
+	// Lower caps for accounts until their KYC is verified, zero keeps the above
+	UnverifiedDailyTransferAmount float64
+	UnverifiedDailyTransferCount  int
+
+	// Transfers above this amount wait for an admin's approval, zero disables
+	TransferApprovalThreshold float64
+
+	// Fraud rules screening customer transfers, see fraud.go. Zero counts,
+	// factors and amounts turn a rule off, actions are review or block.
+	FraudVelocityCount        int
+	FraudVelocityWindow       time.Duration
+	FraudVelocityAction       string
+	FraudUnusualFactor        float64
+	FraudUnusualMinHistory    int
+	FraudUnusualAction        string
+	FraudNewBeneficiaryAmount float64
+	FraudNewBeneficiaryAction string
+
+	// Transfers and holds above this amount need the transaction PIN, zero
+	// disables. PINMaxAttempts failures in a row lock it for PINLockout.
+	TransactionPINThreshold float64
+	PINMaxAttempts          int
+	PINLockout              time.Duration
+
+	// Balance changes of at least NotifyLargeTransfer and balances dropping
+	// below NotifyLowBalance raise in-app notifications, zero disables
+	NotifyLargeTransfer float64
+	NotifyLowBalance    float64
+
+	// LoginMaxAttempts failed logins in a row lock an account's logins for
+	// LoginLockout, zero disables the lockout
+	LoginMaxAttempts int
+	LoginLockout     time.Duration
+
+	// Highest overdraft an account may opt into, and the share of the
+	// overdrawn amount charged as a fee each day
+	OverdraftMaxLimit     float64
+	OverdraftDailyFeeRate float64
+
+	// Accounts without activity for DormancyMonths become dormant, zero
+	// disables the policy. Owners are notified DormancyNoticeDays ahead.
+	DormancyMonths     int
+	DormancyNoticeDays int
+
+	// JSON array of cashback rules, empty disables cashback. Credits are
+	// capped per account per month and debited from the funding account
+	// number when one is set.
+	CashbackRules          string
+	CashbackMonthlyCap     float64
+	CashbackFundingAccount int64
+
+	// Daily transaction and balance files for back-office systems, pushed
+	// over SFTP when ExportSFTPAddr is set. ExportSFTPHostKey is the
+	// server's key as an authorized_keys line. ExportFormat is "csv" or
+	// "fixed", files are PGP encrypted to ExportPGPKeyFile when it's set.
+	ExportSFTPAddr    string
+	ExportSFTPUser    string
+	ExportSFTPKeyFile string
+	ExportSFTPHostKey string
+	ExportSFTPDir     string
+	ExportFormat      string
+	ExportPGPKeyFile  string
+
+	// Traces are exported over OTLP/HTTP to TracingEndpoint, tracing is off
+	// when it's empty. TracingSampleRatio is the share of new traces kept,
+	// requests that arrive with a sampled parent are always traced.
+	TracingEndpoint    string
+	TracingServiceName string
+	TracingSampleRatio float64
+
+	// PasswordHash is "bcrypt" or "argon2id" for new hashes, Argon2Memory
+	// is in KiB. Logins upgrade hashes made with weaker settings.
+	PasswordHash  string
+	BcryptCost    int
+	Argon2Memory  int
+	Argon2Time    int
+	Argon2Threads int
+}
+
+func LoadConfig() *Config {
+	return &Config{
+		ListenAddr:          getEnv("LISTEN_ADDR", ":8080"),
+		AdminToken:          os.Getenv("ADMIN_TOKEN"),
+		JWTKeys:             os.Getenv("JWT_KEYS"),
+		OIDCIssuerURL:       os.Getenv("OIDC_ISSUER_URL"),
+		OIDCClientID:        os.Getenv("OIDC_CLIENT_ID"),
+		OIDCClientSecret:    os.Getenv("OIDC_CLIENT_SECRET"),
+		OIDCRedirectURL:     os.Getenv("OIDC_REDIRECT_URL"),
+		OIDCScopes:          getEnv("OIDC_SCOPES", "email profile"),
+		StorageBackend:      getEnv("STORAGE_BACKEND", "postgres"),
+		CoreBankingURL:      os.Getenv("CORE_BANKING_URL"),
+		CoreBankingAPIKey:   os.Getenv("CORE_BANKING_API_KEY"),
+		CoreBankingRetries:  getEnvInt("CORE_BANKING_RETRIES", 3),
+		CoreBankingCacheTTL: getEnvDuration("CORE_BANKING_CACHE_TTL", 5*time.Second),
+		EventSnapshotEvery:  getEnvInt("EVENT_SNAPSHOT_EVERY", 100),
+
+		LegacyRoutesSunset: os.Getenv("LEGACY_ROUTES_SUNSET"),
+
+		AutoMigrate:    getEnvBool("AUTO_MIGRATE", true),
+		DebugEndpoints: getEnvBool("DEBUG_ENDPOINTS", false),
+
+		TrustedProxies: os.Getenv("TRUSTED_PROXIES"),
+		ForceHTTPS:     getEnvBool("FORCE_HTTPS", false),
+
+		TLSCertFile:      os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:       os.Getenv("TLS_KEY_FILE"),
+		AutocertDomains:  os.Getenv("AUTOCERT_DOMAINS"),
+		AutocertCacheDir: getEnv("AUTOCERT_CACHE_DIR", "autocert-cache"),
+		AutocertEmail:    os.Getenv("AUTOCERT_EMAIL"),
+		HTTPRedirectAddr: os.Getenv("HTTP_REDIRECT_ADDR"),
+
+		AdminApproverKeys:           os.Getenv("ADMIN_APPROVER_KEYS"),
+		AdminApprovalsRequired:      getEnvInt("ADMIN_APPROVALS_REQUIRED", 2),
+		AdminOperationTTL:           getEnvDuration("ADMIN_OPERATION_TTL", 24*time.Hour),
+		AdjustmentApprovalThreshold: getEnvFloat("ADJUSTMENT_APPROVAL_THRESHOLD", 1000),
+
+		MaxBodyBytes: int64(getEnvInt("MAX_BODY_BYTES", 1<<20)),
+
+		RequestJournalEnabled: getEnvBool("REQUEST_JOURNAL_ENABLED", false),
+		RequestJournalPath:    getEnv("REQUEST_JOURNAL_PATH", "requests.journal"),
+		RequestJournalMaxBody: int64(getEnvInt("REQUEST_JOURNAL_MAX_BODY", 64*1024)),
+
+		RateLimitEnabled:     getEnvBool("RATE_LIMIT_ENABLED", true),
+		LoginRatePerMinute:   getEnvInt("RATE_LIMIT_LOGIN_PER_MINUTE", 10),
+		AccountRatePerMinute: getEnvInt("RATE_LIMIT_ACCOUNT_PER_MINUTE", 5),
+		RedisURL:             os.Getenv("REDIS_URL"),
+
+		PasswordResetTTL:     getEnvDuration("PASSWORD_RESET_TTL", 30*time.Minute),
+		EmailVerificationTTL: getEnvDuration("EMAIL_VERIFICATION_TTL", 24*time.Hour),
+		AliasVerificationTTL: getEnvDuration("ALIAS_VERIFICATION_TTL", 15*time.Minute),
+
+		KYCHashKey:       os.Getenv("KYC_HASH_KEY"),
+		ErasureRetention: getEnvDuration("GDPR_ERASURE_RETENTION", 30*24*time.Hour),
+		DisputeWindow:    getEnvDuration("DISPUTE_WINDOW", 120*24*time.Hour),
+
+		Notifier:              getEnv("NOTIFIER", "log"),
+		NotifierGatewayURL:    os.Getenv("NOTIFIER_GATEWAY_URL"),
+		NotifierGatewayAPIKey: os.Getenv("NOTIFIER_GATEWAY_API_KEY"),
+
+		Mailer:       getEnv("MAILER", "log"),
+		SMTPAddr:     os.Getenv("SMTP_ADDR"),
+		SMTPUsername: os.Getenv("SMTP_USERNAME"),
+		SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+		MailFrom:     os.Getenv("MAIL_FROM"),
+
+		SignupQuotaEnabled:    getEnvBool("SIGNUP_QUOTA_ENABLED", true),
+		SignupSoftLimitPerDay: getEnvInt("SIGNUP_SOFT_LIMIT_PER_DAY", 3),
+		SignupHardLimitPerDay: getEnvInt("SIGNUP_HARD_LIMIT_PER_DAY", 10),
+		CaptchaVerifyURL:      os.Getenv("CAPTCHA_VERIFY_URL"),
+		CaptchaSecret:         os.Getenv("CAPTCHA_SECRET"),
+
+		TransferEngine:       getEnv("TRANSFER_ENGINE", "balance"),
+		CanaryTransferEngine: os.Getenv("CANARY_TRANSFER_ENGINE"),
+
+		TransferMode:             getEnv("TRANSFER_MODE", TransferModeSync),
+		TransferQueueWorkers:     getEnvInt("TRANSFER_QUEUE_WORKERS", 4),
+		TransferQueueInterval:    getEnvDuration("TRANSFER_QUEUE_INTERVAL", time.Second),
+		TransferQueueMaxAttempts: getEnvInt("TRANSFER_QUEUE_MAX_ATTEMPTS", 5),
+		TransferQueueRetryDelay:  getEnvDuration("TRANSFER_QUEUE_RETRY_DELAY", 10*time.Second),
+
+		TransferIsolation:       getEnv("TRANSFER_ISOLATION", "serializable"),
+		TransferRetries:         getEnvInt("TRANSFER_RETRIES", 5),
+		TransferRetryBackoff:    getEnvDuration("TRANSFER_RETRY_BACKOFF", 10*time.Millisecond),
+		TransferRetryMaxBackoff: getEnvDuration("TRANSFER_RETRY_MAX_BACKOFF", 500*time.Millisecond),
+
+		CanaryPercent: getEnvInt("CANARY_PERCENT", 0),
+		CanaryHeader:  getEnv("CANARY_HEADER", "X-Canary"),
+
+		FXProvider: getEnv("FX_PROVIDER", "static"),
+		FXRates:    os.Getenv("FX_RATES"),
+		FXRatesURL: os.Getenv("FX_RATES_URL"),
+		FXRatesTTL: getEnvDuration("FX_RATES_TTL", time.Minute),
+
+		DatabaseURL:        getEnv("DATABASE_URL", "user=postgres password=siddharth_22 dbname=postgres sslmode=disable"),
+		DatabaseReplicaURL: os.Getenv("DATABASE_REPLICA_URL"),
+		DBReplicaRetry:     getEnvDuration("DB_REPLICA_RETRY", 30*time.Second),
+
+		DBQueryTimeout:         getEnvDuration("DB_QUERY_TIMEOUT", 5*time.Second),
+		ConsistencyWaitTimeout: getEnvDuration("CONSISTENCY_WAIT_TIMEOUT", 2*time.Second),
+		DBPrepareStatements:    getEnvBool("DB_PREPARE_STATEMENTS", true),
+
+		DBMaxOpenConns:    getEnvInt("DB_MAX_OPEN_CONNS", 25),
+		DBMaxIdleConns:    getEnvInt("DB_MAX_IDLE_CONNS", 10),
+		DBConnMaxLifetime: getEnvDuration("DB_CONN_MAX_LIFETIME", 30*time.Minute),
+		DBHealthInterval:  getEnvDuration("DB_HEALTH_INTERVAL", 15*time.Second),
+		DBPoolSaturation:  getEnvFloat("DB_POOL_SATURATION", 0.8),
+
+		EventPollMaxWait:     getEnvDuration("EVENT_POLL_MAX_WAIT", 30*time.Second),
+		EventStreamKeepAlive: getEnvDuration("EVENT_STREAM_KEEPALIVE", 15*time.Second),
+
+		WSPingInterval: getEnvDuration("WS_PING_INTERVAL", 30*time.Second),
+		WSWriteTimeout: getEnvDuration("WS_WRITE_TIMEOUT", 10*time.Second),
+		WSSendBuffer:   getEnvInt("WS_SEND_BUFFER", 64),
+
+		StatsCacheTTL:     getEnvDuration("STATS_CACHE_TTL", time.Minute),
+		AnalyticsCacheTTL: getEnvDuration("ANALYTICS_CACHE_TTL", 5*time.Minute),
+
+		AccountCache:     getEnv("ACCOUNT_CACHE", "memory"),
+		AccountCacheTTL:  getEnvDuration("ACCOUNT_CACHE_TTL", 0),
+		AccountCacheSize: getEnvInt("ACCOUNT_CACHE_SIZE", 10000),
+
+		BackupTarget:      os.Getenv("BACKUP_TARGET"),
+		BackupDir:         getEnv("BACKUP_DIR", "backups"),
+		BackupS3Endpoint:  os.Getenv("BACKUP_S3_ENDPOINT"),
+		BackupS3Region:    getEnv("BACKUP_S3_REGION", "us-east-1"),
+		BackupS3Bucket:    os.Getenv("BACKUP_S3_BUCKET"),
+		BackupS3Prefix:    os.Getenv("BACKUP_S3_PREFIX"),
+		BackupS3AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		BackupS3SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+
+		Enrichers:           getEnv("ENRICHERS", "category,impact"),
+		EnrichmentWorkers:   getEnvInt("ENRICHMENT_WORKERS", 2),
+		EnrichmentQueueSize: getEnvInt("ENRICHMENT_QUEUE_SIZE", 1000),
+
+		SchedulerEnabled:             getEnvBool("SCHEDULER_ENABLED", true),
+		SchedulerInterval:            getEnvDuration("SCHEDULER_INTERVAL", time.Minute),
+		EODEnabled:                   getEnvBool("EOD_ENABLED", false),
+		ScheduledTransferMaxAttempts: getEnvInt("SCHEDULED_TRANSFER_MAX_ATTEMPTS", 3),
+		ScheduledTransferRetryDelay:  getEnvDuration("SCHEDULED_TRANSFER_RETRY_DELAY", time.Hour),
+		StandingOrderMaxAttempts:     getEnvInt("STANDING_ORDER_MAX_ATTEMPTS", 3),
+		StandingOrderRetryDelay:      getEnvDuration("STANDING_ORDER_RETRY_DELAY", 4*time.Hour),
+		MandateCollectionMaxAttempts: getEnvInt("MANDATE_COLLECTION_MAX_ATTEMPTS", 3),
+		MandateCollectionRetryDelay:  getEnvDuration("MANDATE_COLLECTION_RETRY_DELAY", 24*time.Hour),
+		ChequeClearingDelay:          getEnvDuration("CHEQUE_CLEARING_DELAY", 72*time.Hour),
+		ExternalACHSettlementDelay:   getEnvDuration("EXTERNAL_ACH_SETTLEMENT_DELAY", 24*time.Hour),
+		ExternalWireSettlementDelay:  getEnvDuration("EXTERNAL_WIRE_SETTLEMENT_DELAY", time.Hour),
+
+		DailyTransferAmount: getEnvFloat("DAILY_TRANSFER_AMOUNT_LIMIT", 10000),
+		DailyTransferCount:  getEnvInt("DAILY_TRANSFER_COUNT_LIMIT", 20),
+
+		UnverifiedDailyTransferAmount: getEnvFloat("UNVERIFIED_DAILY_TRANSFER_AMOUNT_LIMIT", 1000),
+		UnverifiedDailyTransferCount:  getEnvInt("UNVERIFIED_DAILY_TRANSFER_COUNT_LIMIT", 5),
+
+		TransferApprovalThreshold: getEnvFloat("TRANSFER_APPROVAL_THRESHOLD", 0),
+
+		FraudVelocityCount:        getEnvInt("FRAUD_VELOCITY_COUNT", 0),
+		FraudVelocityWindow:       getEnvDuration("FRAUD_VELOCITY_WINDOW", time.Hour),
+		FraudVelocityAction:       getEnv("FRAUD_VELOCITY_ACTION", FraudActionReview),
+		FraudUnusualFactor:        getEnvFloat("FRAUD_UNUSUAL_FACTOR", 0),
+		FraudUnusualMinHistory:    getEnvInt("FRAUD_UNUSUAL_MIN_HISTORY", 5),
+		FraudUnusualAction:        getEnv("FRAUD_UNUSUAL_ACTION", FraudActionReview),
+		FraudNewBeneficiaryAmount: getEnvFloat("FRAUD_NEW_BENEFICIARY_AMOUNT", 0),
+		FraudNewBeneficiaryAction: getEnv("FRAUD_NEW_BENEFICIARY_ACTION", FraudActionReview),
+
+		TransactionPINThreshold: getEnvFloat("TRANSACTION_PIN_THRESHOLD", 0),
+		PINMaxAttempts:          getEnvInt("PIN_MAX_ATTEMPTS", 3),
+		PINLockout:              getEnvDuration("PIN_LOCKOUT", 30*time.Minute),
+
+		NotifyLargeTransfer: getEnvFloat("NOTIFY_LARGE_TRANSFER", 1000),
+		NotifyLowBalance:    getEnvFloat("NOTIFY_LOW_BALANCE", 50),
+
+		LoginMaxAttempts: getEnvInt("LOGIN_MAX_ATTEMPTS", 5),
+		LoginLockout:     getEnvDuration("LOGIN_LOCKOUT", 15*time.Minute),
+
+		OverdraftMaxLimit:     getEnvFloat("OVERDRAFT_MAX_LIMIT", 1000),
+		OverdraftDailyFeeRate: getEnvFloat("OVERDRAFT_DAILY_FEE_RATE", 0.0005),
+
+		DormancyMonths:     getEnvInt("DORMANCY_MONTHS", 12),
+		DormancyNoticeDays: getEnvInt("DORMANCY_NOTICE_DAYS", 30),
+
+		CashbackRules:          os.Getenv("CASHBACK_RULES"),
+		CashbackMonthlyCap:     getEnvFloat("CASHBACK_MONTHLY_CAP", 50),
+		CashbackFundingAccount: int64(getEnvInt("CASHBACK_FUNDING_ACCOUNT", 0)),
+
+		ExportSFTPAddr:    os.Getenv("EXPORT_SFTP_ADDR"),
+		ExportSFTPUser:    os.Getenv("EXPORT_SFTP_USER"),
+		ExportSFTPKeyFile: os.Getenv("EXPORT_SFTP_KEY_FILE"),
+		ExportSFTPHostKey: os.Getenv("EXPORT_SFTP_HOST_KEY"),
+		ExportSFTPDir:     getEnv("EXPORT_SFTP_DIR", "."),
+		ExportFormat:      getEnv("EXPORT_FORMAT", "csv"),
+		ExportPGPKeyFile:  os.Getenv("EXPORT_PGP_KEY_FILE"),
+
+		TracingEndpoint:    os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		TracingServiceName: getEnv("OTEL_SERVICE_NAME", "gobank"),
+		TracingSampleRatio: getEnvFloat("TRACING_SAMPLE_RATIO", 1),
+
+		PasswordHash:  getEnv("PASSWORD_HASH", PasswordBcrypt),
+		BcryptCost:    getEnvInt("BCRYPT_COST", bcrypt.DefaultCost),
+		Argon2Memory:  getEnvInt("ARGON2_MEMORY", 64*1024),
+		Argon2Time:    getEnvInt("ARGON2_TIME", 3),
+		Argon2Threads: getEnvInt("ARGON2_THREADS", 2),
+	}
+}
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+func getEnvInt(key string, fallback int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Mutations return a consistency token in this header, clients echo it on
+// later reads to be sure they observe their own write.
+const consistencyTokenHeader = "X-Consistency-Token"
+
+// Storage backends that can issue and wait for consistency tokens
+type consistencyTracker interface {
+	ConsistencyToken(ctx context.Context) (string, error)
+	WaitForConsistencyToken(ctx context.Context, token string, timeout time.Duration) error
+}
+
+// Storage backends with caches that must be bypassed for token-bearing reads
+type freshReadStorage interface {
+	WithFreshReads() Storage
+}
+
+type consistentReadKey struct{}
+
+func isReadMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+func (s *APIServer) withConsistency(next http.Handler) http.Handler {
+	tracker, ok := storageAs[consistencyTracker](s.store)
+	if !ok {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isReadMethod(r.Method) {
+			// Writes read what they change from the primary, not a replica
+			r = r.WithContext(withPrimaryReads(r.Context()))
+			next.ServeHTTP(&consistencyWriter{ResponseWriter: w, ctx: r.Context(), tracker: tracker}, r)
+			return
+		}
+
+		if token := r.Header.Get(consistencyTokenHeader); token != "" {
+			if err := tracker.WaitForConsistencyToken(r.Context(), token, s.config.ConsistencyWaitTimeout); err != nil {
+				status, apiErr := apiErrorFor(err)
+				if status == http.StatusServiceUnavailable {
+					w.Header().Set("Retry-After", "1")
+				}
+				WriteJSON(w, status, apiErr)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), consistentReadKey{}, true))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withConsistentReads bypasses storage caches when the request presented a token
+func (s *APIServer) withConsistentReads(ctx context.Context) *APIServer {
+	fresh, ok := s.store.(freshReadStorage)
+	if required, _ := ctx.Value(consistentReadKey{}).(bool); !required || !ok {
+		return s
+	}
+
+	scoped := *s
+	scoped.store = fresh.WithFreshReads()
+	return &scoped
+}
+
+// consistencyWriter adds the token to successful mutation responses. Handlers
+// write their response after committing, so the token covers the write.
+type consistencyWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	tracker     consistencyTracker
+	wroteHeader bool
+}
+
+func (w *consistencyWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if status < 400 {
+			token, err := w.tracker.ConsistencyToken(w.ctx)
+			if err != nil {
+				log.Printf("Failed to read consistency token: %v", err)
+			} else {
+				w.Header().Set(consistencyTokenHeader, token)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *consistencyWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// lsnStorage hands out increasing tokens and treats everything up to applied as visible
+type lsnStorage struct {
+	*memoryStorage
+	written int
+	applied int
+}
+
+func (s *lsnStorage) ConsistencyToken(ctx context.Context) (string, error) {
+	s.written++
+	return string(rune('0' + s.written)), nil
+}
+
+func (s *lsnStorage) WaitForConsistencyToken(ctx context.Context, token string, timeout time.Duration) error {
+	if len(token) != 1 {
+		return ErrInvalidConsistencyToken
+	}
+	if int(token[0]-'0') > s.applied {
+		return ErrConsistencyTimeout
+	}
+	return nil
+}
+
+func TestWithConsistency(t *testing.T) {
+	store := &lsnStorage{memoryStorage: newMemoryStorage()}
+	s := NewAPIServer(&Config{}, store)
+	handler := s.withConsistency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, map[string]string{})
+	}))
+
+	write := httptest.NewRecorder()
+	handler.ServeHTTP(write, httptest.NewRequest("POST", "/account", nil))
+	token := write.Header().Get(consistencyTokenHeader)
+	assert.Equal(t, "1", token)
+
+	// Reads don't get a token
+	read := httptest.NewRecorder()
+	handler.ServeHTTP(read, httptest.NewRequest("GET", "/account", nil))
+	assert.Empty(t, read.Header().Get(consistencyTokenHeader))
+
+	// Until the write is applied a token-bearing read is refused
+	req := httptest.NewRequest("GET", "/account", nil)
+	req.Header.Set(consistencyTokenHeader, token)
+	read = httptest.NewRecorder()
+	handler.ServeHTTP(read, req)
+	assert.Equal(t, http.StatusServiceUnavailable, read.Code)
+
+	store.applied = 1
+	read = httptest.NewRecorder()
+	handler.ServeHTTP(read, req)
+	assert.Equal(t, http.StatusOK, read.Code)
+
+	req.Header.Set(consistencyTokenHeader, "garbage")
+	read = httptest.NewRecorder()
+	handler.ServeHTTP(read, req)
+	assert.Equal(t, http.StatusBadRequest, read.Code)
+}
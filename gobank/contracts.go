@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Contracts are golden files describing request/response pairs of the HTTP
+// API. Requests are written by hand, the expected responses are generated
+// from the handlers by `go test -run TestContracts -update-contracts`.
+//
+// Responses are matched by shape so any compatible server passes: the status
+// must be equal, objects must contain every expected key with a value of the
+// same JSON type (extra keys are fine), and array elements must match the first
+// expected element. Values listed in "exact" must also be equal.
+//
+// Steps can capture top-level response fields, "{{name}}" in later paths,
+// headers or bodies is replaced with the captured value.
+
+//go:embed contracts/*.json
+var embeddedContracts embed.FS
+
+type Contract struct {
+	Description string         `json:"description"`
+	Steps       []ContractStep `json:"steps"`
+}
+
+type ContractStep struct {
+	Description string            `json:"description"`
+	Method      string            `json:"method"`
+	Path        string            `json:"path"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Body        json.RawMessage   `json:"body,omitempty"`
+	Capture     map[string]string `json:"capture,omitempty"`
+	Response    ContractResponse  `json:"response"`
+}
+
+type ContractResponse struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	Exact  []string        `json:"exact,omitempty"`
+}
+
+func loadContracts(fsys fs.FS) (map[string]*Contract, error) {
+	files, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return nil, err
+	}
+
+	contracts := map[string]*Contract{}
+	for _, file := range files {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		c := &Contract{}
+		if err := json.Unmarshal(data, c); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		contracts[file] = c
+	}
+	return contracts, nil
+}
+
+// runContract plays the contract against baseURL, adding extra to every
+// request. With record set the expected responses are replaced by the actual
+// ones instead of checked.
+func runContract(client *http.Client, baseURL string, extra http.Header, c *Contract, record bool) error {
+	// Lets one contract run repeatedly against the same server
+	vars := map[string]string{"run": fmt.Sprint(time.Now().UnixNano())}
+
+	for i := range c.Steps {
+		step := &c.Steps[i]
+
+		req, err := http.NewRequest(step.Method, baseURL+expandVars(step.Path, vars, false), bytes.NewReader([]byte(expandVars(string(step.Body), vars, true))))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k := range extra {
+			req.Header.Set(k, extra.Get(k))
+		}
+		for k, v := range step.Headers {
+			req.Header.Set(k, expandVars(v, vars, false))
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("step %q: %v", step.Description, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("step %q: %v", step.Description, err)
+		}
+
+		var actual any
+		if len(bytes.TrimSpace(body)) > 0 {
+			if err := json.Unmarshal(body, &actual); err != nil {
+				return fmt.Errorf("step %q: response is not JSON: %v", step.Description, err)
+			}
+		}
+
+		if record {
+			step.Response.Status = resp.StatusCode
+			step.Response.Body = bytes.TrimSpace(body)
+		} else if err := matchResponse(step.Response, resp.StatusCode, actual); err != nil {
+			return fmt.Errorf("step %q: %v", step.Description, err)
+		}
+
+		fields, _ := actual.(map[string]any)
+		for name, field := range step.Capture {
+			value, ok := fields[field]
+			if !ok {
+				return fmt.Errorf("step %q: response has no %q to capture", step.Description, field)
+			}
+			raw, _ := json.Marshal(value)
+			vars[name] = string(raw)
+		}
+	}
+	return nil
+}
+
+// expandVars substitutes captured values. In JSON bodies a quoted placeholder
+// is replaced by the raw value so numbers stay numbers.
+func expandVars(s string, vars map[string]string, jsonBody bool) string {
+	for name, raw := range vars {
+		if jsonBody {
+			s = strings.ReplaceAll(s, `"{{`+name+`}}"`, raw)
+		}
+		s = strings.ReplaceAll(s, "{{"+name+"}}", strings.Trim(raw, `"`))
+	}
+	return s
+}
+
+func matchResponse(expected ContractResponse, status int, actual any) error {
+	if status != expected.Status {
+		return fmt.Errorf("expected status %d, got %d", expected.Status, status)
+	}
+	if len(expected.Body) == 0 {
+		return nil
+	}
+
+	var want any
+	if err := json.Unmarshal(expected.Body, &want); err != nil {
+		return fmt.Errorf("invalid expected body: %v", err)
+	}
+
+	exact := map[string]bool{}
+	for _, p := range expected.Exact {
+		exact[p] = true
+	}
+
+	if problems := matchShape("$", want, actual, exact); len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("response doesn't match contract:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func matchShape(at string, want, got any, exact map[string]bool) []string {
+	if jsonType(want) != jsonType(got) {
+		return []string{fmt.Sprintf("%s: expected %s, got %s", at, jsonType(want), jsonType(got))}
+	}
+
+	var problems []string
+	switch w := want.(type) {
+	case map[string]any:
+		g := got.(map[string]any)
+		for key, value := range w {
+			child := at + "." + key
+			if _, ok := g[key]; !ok {
+				problems = append(problems, child+": missing")
+				continue
+			}
+			problems = append(problems, matchShape(child, value, g[key], exact)...)
+		}
+	case []any:
+		g := got.([]any)
+		if len(w) > 0 {
+			for i, item := range g {
+				problems = append(problems, matchShape(fmt.Sprintf("%s[%d]", at, i), w[0], item, exact)...)
+			}
+		}
+	default:
+		if exact[at] && want != got {
+			problems = append(problems, fmt.Sprintf("%s: expected %v, got %v", at, want, got))
+		}
+	}
+	return problems
+}
+
+func jsonType(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// gobank verify-contracts -server http://localhost:8080 [-dir contracts] [-admin-token ...]
+func verifyContractsCommand(args []string) int {
+	cmd := flag.NewFlagSet("verify-contracts", flag.ExitOnError)
+	server := cmd.String("server", "http://localhost:8080", "base URL of the server to verify")
+	dir := cmd.String("dir", "", "directory of contract files, defaults to the ones built into this binary")
+	adminToken := cmd.String("admin-token", "", "sent as x-admin-token so repeated runs aren't stopped by signup quotas")
+	cmd.Parse(args)
+
+	extra := http.Header{}
+	if *adminToken != "" {
+		extra.Set("x-admin-token", *adminToken)
+	}
+
+	var fsys fs.FS
+	if *dir != "" {
+		fsys = os.DirFS(*dir)
+	} else {
+		fsys, _ = fs.Sub(embeddedContracts, "contracts")
+	}
+
+	contracts, err := loadContracts(fsys)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load contracts: %v\n", err)
+		return 1
+	}
+
+	names := make([]string, 0, len(contracts))
+	for name := range contracts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	failed := 0
+	for _, name := range names {
+		if err := runContract(client, strings.TrimRight(*server, "/"), extra, contracts[name], false); err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", path.Base(name), err)
+			continue
+		}
+		fmt.Printf("ok   %s\n", path.Base(name))
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d contracts failed\n", failed, len(contracts))
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateContracts = flag.Bool("update-contracts", false, "rewrite the expected responses in contracts/ from the handlers")
+
+func TestContracts(t *testing.T) {
+	t.Setenv("JWT_SECRET", "contract-test-secret")
+
+	cfg := &Config{TransferEngine: "balance"}
+	store := newMemoryStorage()
+	engine, err := NewTransferEngine(cfg.TransferEngine, store, cfg)
+	require.Nil(t, err)
+
+	server := httptest.NewServer(NewAPIServer(cfg, store).routes(engine))
+	defer server.Close()
+
+	contracts, err := loadContracts(os.DirFS("contracts"))
+	require.Nil(t, err)
+	require.NotEmpty(t, contracts)
+
+	for file, contract := range contracts {
+		t.Run(file, func(t *testing.T) {
+			assert.Nil(t, runContract(server.Client(), server.URL, nil, contract, *updateContracts))
+
+			if *updateContracts {
+				data, err := json.MarshalIndent(contract, "", "  ")
+				require.Nil(t, err)
+				require.Nil(t, os.WriteFile(filepath.Join("contracts", file), append(data, '\n'), 0o644))
+			}
+		})
+	}
+}
+
+func TestMatchShape(t *testing.T) {
+	var want, got any
+	json.Unmarshal([]byte(`{"id": 1, "tags": ["a"], "code": "X"}`), &want)
+	json.Unmarshal([]byte(`{"id": 2, "tags": ["b", 3], "code": "Y", "extra": true}`), &got)
+
+	problems := matchShape("$", want, got, map[string]bool{"$.code": true})
+	assert.ElementsMatch(t, []string{"$.tags[1]: expected string, got number", "$.code: expected X, got Y"}, problems)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	transferEngineFixtures["corebanking"] = func(t *testing.T) transferEngineFixture {
+		fake := newFakeCoreBanking()
+		server := httptest.NewServer(fake.router())
+		t.Cleanup(server.Close)
+
+		store := NewCoreBankingStorage(testCoreBankingConfig(server.URL), nil)
+		engine, err := NewTransferEngine("corebanking", store, &Config{})
+		require.Nil(t, err)
+		return &coreBankingEngineFixture{engine: engine, store: store}
+	}
+}
+
+func testCoreBankingConfig(url string) *Config {
+	return &Config{
+		CoreBankingURL:      url,
+		CoreBankingRetries:  2,
+		CoreBankingCacheTTL: time.Minute,
+	}
+}
+
+type coreBankingEngineFixture struct {
+	engine TransferEngine
+	store  *CoreBankingStorage
+}
+
+func (f *coreBankingEngineFixture) Engine() TransferEngine {
+	return f.engine
+}
+
+func (f *coreBankingEngineFixture) NewAccount(t *testing.T, balance int64) *Account {
+	acc := &Account{Number: int64(rand.Intn(1000000)), Balance: balance}
+	require.Nil(t, f.store.CreateAccount(context.Background(), acc))
+	return acc
+}
+
+func (f *coreBankingEngineFixture) Balance(t *testing.T, acc *Account) int64 {
+	stored, err := f.store.GetAccountbyID(context.Background(), acc.ID)
+	require.Nil(t, err)
+	return stored.Balance
+}
+
+func (f *coreBankingEngineFixture) Receipt(t *testing.T, reference string) *TransferReceipt {
+	receipt, err := f.store.GetTransferReceipt(context.Background(), reference)
+	require.Nil(t, err)
+	return receipt
+}
+
+// fakeCoreBanking implements just enough of the external API for tests
+type fakeCoreBanking struct {
+	mu        sync.Mutex
+	nextID    int
+	accounts  map[int]*coreBankingAccount
+	transfers map[string]coreBankingTransfer
+	failures  int // respond 503 to this many requests first
+}
+
+func newFakeCoreBanking() *fakeCoreBanking {
+	return &fakeCoreBanking{accounts: map[int]*coreBankingAccount{}, transfers: map[string]coreBankingTransfer{}}
+}
+
+func (f *fakeCoreBanking) router() http.Handler {
+	router := mux.NewRouter()
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			f.mu.Lock()
+			fail := f.failures > 0
+			if fail {
+				f.failures--
+			}
+			f.mu.Unlock()
+
+			if fail {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	router.HandleFunc("/accounts", func(w http.ResponseWriter, r *http.Request) {
+		acc := &coreBankingAccount{}
+		json.NewDecoder(r.Body).Decode(acc)
+
+		f.mu.Lock()
+		f.nextID++
+		acc.ID = f.nextID
+		f.accounts[acc.ID] = acc
+		f.mu.Unlock()
+
+		json.NewEncoder(w).Encode(acc)
+	}).Methods("POST")
+
+	router.HandleFunc("/accounts/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		acc, ok := f.accounts[id]
+		if !ok {
+			writeFakeCoreBankingError(w, http.StatusNotFound, "UNKNOWN_ACCOUNT")
+			return
+		}
+		json.NewEncoder(w).Encode(acc)
+	}).Methods("GET")
+
+	router.HandleFunc("/transfers", func(w http.ResponseWriter, r *http.Request) {
+		transfer := coreBankingTransfer{}
+		json.NewDecoder(r.Body).Decode(&transfer)
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		from, fromOK := f.accounts[transfer.FromAccountID]
+		to, toOK := f.accounts[transfer.ToAccountID]
+		if !fromOK || !toOK {
+			writeFakeCoreBankingError(w, http.StatusUnprocessableEntity, "UNKNOWN_ACCOUNT")
+			return
+		}
+		if from.BalanceMinor < transfer.AmountMinor {
+			writeFakeCoreBankingError(w, http.StatusUnprocessableEntity, "NSF")
+			return
+		}
+		from.BalanceMinor -= transfer.AmountMinor
+		to.BalanceMinor += transfer.AmountMinor
+		f.transfers[transfer.Reference] = transfer
+	}).Methods("POST")
+
+	router.HandleFunc("/transfers/{reference}", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		transfer, ok := f.transfers[mux.Vars(r)["reference"]]
+		if !ok {
+			writeFakeCoreBankingError(w, http.StatusNotFound, "TRANSFER_NOT_FOUND")
+			return
+		}
+		json.NewEncoder(w).Encode(transfer)
+	}).Methods("GET")
+
+	return router
+}
+
+func writeFakeCoreBankingError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(coreBankingError{ErrorCode: code, Message: "rejected"})
+}
+
+func TestCoreBankingErrorMapping(t *testing.T) {
+	fake := newFakeCoreBanking()
+	server := httptest.NewServer(fake.router())
+	defer server.Close()
+
+	store := NewCoreBankingStorage(testCoreBankingConfig(server.URL), nil)
+
+	_, err := store.GetAccountbyID(context.Background(), 42)
+	assert.ErrorIs(t, err, ErrAccountNotFound)
+
+	engine := &coreBankingTransferEngine{storage: store}
+	from := &Account{Number: 1}
+	to := &Account{Number: 2}
+	require.Nil(t, store.CreateAccount(context.Background(), from))
+	require.Nil(t, store.CreateAccount(context.Background(), to))
+	assert.ErrorIs(t, engine.Execute(context.Background(), from, to, sameCurrency(DefaultCurrency, 10)), ErrInsufficientFunds)
+}
+
+func TestCoreBankingRetries(t *testing.T) {
+	fake := newFakeCoreBanking()
+	server := httptest.NewServer(fake.router())
+	defer server.Close()
+
+	store := NewCoreBankingStorage(testCoreBankingConfig(server.URL), nil)
+	store.client.backoff = time.Millisecond
+
+	// Recovers within the retry budget
+	fake.failures = 2
+	assert.Nil(t, store.CreateAccount(context.Background(), &Account{Number: 1}))
+
+	// Gives up once it's exhausted
+	fake.failures = 3
+	_, err := store.GetAccountbyID(context.Background(), 99)
+	assert.ErrorIs(t, err, ErrUpstreamUnavailable)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"expvar"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The health checker pings the database and samples the pool on an interval.
+// A saturated pool or requests queueing for a connection are logged, the
+// latest sample is published as the db_health expvar and served on /readyz,
+// which answers 503 while the database can't be reached.
+
+const dbPingTimeout = 2 * time.Second
+
+type dbPool interface {
+	dbStatsProvider
+	Ping(ctx context.Context) error
+}
+
+type PoolStats struct {
+	MaxOpen    int     `json:"max_open"` // zero is unlimited
+	Open       int     `json:"open"`
+	InUse      int     `json:"in_use"`
+	Idle       int     `json:"idle"`
+	WaitCount  int64   `json:"wait_count"`
+	WaitMillis int64   `json:"wait_ms"`
+	Saturation float64 `json:"saturation"`
+	Saturated  bool    `json:"saturated"`
+}
+
+type DBHealth struct {
+	OK        bool      `json:"ok"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+	Pool      PoolStats `json:"pool"`
+}
+
+type ReadyStatus struct {
+	Status   string    `json:"status"`
+	Database *DBHealth `json:"database,omitempty"` // absent when storage isn't database backed
+}
+
+func newPoolStats(st sql.DBStats, threshold float64) PoolStats {
+	stats := PoolStats{
+		MaxOpen:    st.MaxOpenConnections,
+		Open:       st.OpenConnections,
+		InUse:      st.InUse,
+		Idle:       st.Idle,
+		WaitCount:  st.WaitCount,
+		WaitMillis: st.WaitDuration.Milliseconds(),
+	}
+	if st.MaxOpenConnections > 0 {
+		stats.Saturation = float64(st.InUse) / float64(st.MaxOpenConnections)
+		stats.Saturated = stats.Saturation >= threshold
+	}
+	return stats
+}
+
+type dbHealthChecker struct {
+	pool      dbPool
+	threshold float64
+	interval  time.Duration
+
+	mu        sync.Mutex
+	last      *DBHealth
+	lastWaits int64
+}
+
+var publishDBHealthOnce sync.Once
+
+// newDBHealthChecker returns nil when the store has no connection pool
+func newDBHealthChecker(store Storage, cfg *Config) *dbHealthChecker {
+	pool, ok := storageAs[dbPool](store)
+	if !ok {
+		return nil
+	}
+	return &dbHealthChecker{pool: pool, threshold: cfg.DBPoolSaturation, interval: cfg.DBHealthInterval}
+}
+
+func (c *dbHealthChecker) start(ctx context.Context) {
+	publishDBHealthOnce.Do(func() {
+		expvar.Publish("db_health", expvar.Func(func() any {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return c.last
+		}))
+	})
+
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+
+		for {
+			c.check(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (c *dbHealthChecker) check(ctx context.Context) *DBHealth {
+	pingCtx, cancel := context.WithTimeout(ctx, dbPingTimeout)
+	defer cancel()
+
+	health := &DBHealth{OK: true, CheckedAt: time.Now().UTC()}
+	if err := c.pool.Ping(pingCtx); err != nil {
+		health.OK = false
+		health.Error = err.Error()
+		log.Printf("Database health check failed: %v", err)
+	}
+	health.Pool = newPoolStats(c.pool.Stats(), c.threshold)
+
+	c.mu.Lock()
+	waited := health.Pool.WaitCount - c.lastWaits
+	c.lastWaits = health.Pool.WaitCount
+	c.last = health
+	c.mu.Unlock()
+
+	if health.Pool.Saturated {
+		log.Printf("Database pool saturated: %d of %d connections in use", health.Pool.InUse, health.Pool.MaxOpen)
+	}
+	if waited > 0 {
+		log.Printf("Database pool: %d requests waited for a connection since the last check", waited)
+	}
+	return health
+}
+
+// GET /readyz
+func (s *APIServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if s.dbHealth == nil {
+		WriteJSON(w, http.StatusOK, &ReadyStatus{Status: "ready"})
+		return
+	}
+
+	health := s.dbHealth.check(r.Context())
+	if !health.OK {
+		WriteJSON(w, http.StatusServiceUnavailable, &ReadyStatus{Status: "unavailable", Database: health})
+		return
+	}
+	WriteJSON(w, http.StatusOK, &ReadyStatus{Status: "ready", Database: health})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakePoolStorage struct {
+	*memoryStorage
+	stats   sql.DBStats
+	pingErr error
+}
+
+func (s *fakePoolStorage) Stats() sql.DBStats             { return s.stats }
+func (s *fakePoolStorage) Ping(ctx context.Context) error { return s.pingErr }
+
+func TestReadyz(t *testing.T) {
+	store := &fakePoolStorage{memoryStorage: newMemoryStorage(), stats: sql.DBStats{MaxOpenConnections: 10, OpenConnections: 9, InUse: 9, WaitCount: 3}}
+	s := NewAPIServer(&Config{DBPoolSaturation: 0.8}, store)
+
+	readyz := func() (int, *ReadyStatus) {
+		w := httptest.NewRecorder()
+		s.handleReadyz(w, httptest.NewRequest("GET", "/readyz", nil))
+		var status ReadyStatus
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &status))
+		return w.Code, &status
+	}
+
+	code, status := readyz()
+	assert.Equal(t, http.StatusOK, code)
+	require.NotNil(t, status.Database)
+	assert.True(t, status.Database.Pool.Saturated)
+	assert.InDelta(t, 0.9, status.Database.Pool.Saturation, 0.001)
+	assert.Equal(t, int64(3), status.Database.Pool.WaitCount)
+
+	store.pingErr = errors.New("connection refused")
+	code, status = readyz()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable", status.Status)
+	assert.Equal(t, "connection refused", status.Database.Error)
+
+	// Stores without a pool are always ready
+	s.dbHealth = nil
+	code, status = readyz()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Nil(t, status.Database)
+}
+
+func TestPoolStatsUnlimited(t *testing.T) {
+	stats := newPoolStats(sql.DBStats{InUse: 500}, 0.8)
+	assert.False(t, stats.Saturated)
+	assert.Zero(t, stats.Saturation)
+}
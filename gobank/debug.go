@@ -0,0 +1,57 @@
+package main
+
+import (
+	"database/sql"
+	"expvar"
+	"net/http/pprof"
+	"runtime"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Background workers report their queue depth here, keyed by queue name
+var jobQueueDepths = expvar.NewMap("job_queues")
+
+var publishDebugVarsOnce sync.Once
+
+func setJobQueueDepth(queue string, depth int) {
+	v := new(expvar.Int)
+	v.Set(int64(depth))
+	jobQueueDepths.Set(queue, v)
+}
+
+type dbStatsProvider interface {
+	Stats() sql.DBStats
+}
+
+func publishDebugVars(store Storage) {
+	publishDebugVarsOnce.Do(func() {
+		expvar.Publish("goroutines", expvar.Func(func() any {
+			return runtime.NumGoroutine()
+		}))
+
+		expvar.Publish("db", expvar.Func(func() any {
+			if p, ok := storageAs[dbStatsProvider](store); ok {
+				return p.Stats()
+			}
+			return nil
+		}))
+	})
+}
+
+func (s *APIServer) registerDebugRoutes(router *mux.Router) {
+	if !s.config.DebugEndpoints {
+		return
+	}
+
+	publishDebugVars(s.store)
+
+	debug := router.PathPrefix("/debug").Subrouter()
+	debug.HandleFunc("/vars", withAdminAuth(expvar.Handler().ServeHTTP, s.config, s.store))
+	debug.HandleFunc("/pprof/cmdline", withAdminAuth(pprof.Cmdline, s.config, s.store))
+	debug.HandleFunc("/pprof/profile", withAdminAuth(pprof.Profile, s.config, s.store))
+	debug.HandleFunc("/pprof/symbol", withAdminAuth(pprof.Symbol, s.config, s.store))
+	debug.HandleFunc("/pprof/trace", withAdminAuth(pprof.Trace, s.config, s.store))
+	debug.PathPrefix("/pprof/").HandlerFunc(withAdminAuth(pprof.Index, s.config, s.store))
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// Amounts are JSON numbers by default, which clients in languages without
+// a decimal type tend to round on the way in. A client can switch to
+// decimal strings with the amounts=string media type parameter:
+//
+//	Content-Type: application/json; amounts=string   request amounts are "10.50"
+//	Accept: application/json; amounts=string         response amounts are "10.50"
+//
+// Request amounts are then parsed as decimals, values that aren't plain
+// decimal strings or have fractions of a cent are rejected, and numbers are
+// no longer accepted for them. Responses send every non-integer number as a
+// decimal string with at least two places, amounts in cents stay integers.
+
+const amountsParam = "amounts"
+
+// Plain decimals only, no exponents or thousands separators
+var decimalAmountPattern = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+// negotiatesDecimalAmounts reports whether any media type in header asks for string amounts
+func negotiatesDecimalAmounts(header string) bool {
+	for _, mediaType := range strings.Split(header, ",") {
+		_, params, err := mime.ParseMediaType(mediaType)
+		if err == nil && params[amountsParam] == "string" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDecimalAmount reads a decimal string amount, at most to the cent
+func parseDecimalAmount(s string) (decimal.Decimal, *FieldError) {
+	if !decimalAmountPattern.MatchString(s) {
+		return decimal.Decimal{}, &FieldError{Code: "decimal", Message: "must be a decimal string like 10.50"}
+	}
+	d, err := decimal.NewFromString(s)
+	if err != nil {
+		return decimal.Decimal{}, &FieldError{Code: "decimal", Message: "must be a decimal string like 10.50"}
+	}
+	if !d.Shift(2).IsInteger() {
+		return decimal.Decimal{}, &FieldError{Code: "precision", Message: "must not have fractions of a cent"}
+	}
+	return d, nil
+}
+
+// decimalRequestBody rewrites the string amounts of body, a JSON value
+// decoding into t, as numbers so it decodes like a numeric request
+func decimalRequestBody(body []byte, t reflect.Type) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var value any
+	if err := dec.Decode(&value); err != nil || dec.Decode(&json.RawMessage{}) != io.EOF {
+		// Left for the regular decoding to report
+		return body, nil
+	}
+
+	fields := []FieldError{}
+	value = decimalToNumbers(value, t, nil, &fields)
+	if len(fields) > 0 {
+		return nil, &ValidationError{Fields: fields}
+	}
+	return json.Marshal(value)
+}
+
+func decimalToNumbers(value any, t reflect.Type, path []string, fields *[]FieldError) any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64:
+		switch v := value.(type) {
+		case string:
+			d, fieldErr := parseDecimalAmount(v)
+			if fieldErr != nil {
+				fieldErr.Field = jsonPointer(path...)
+				*fields = append(*fields, *fieldErr)
+				return value
+			}
+			return json.Number(d.String())
+		case json.Number:
+			*fields = append(*fields, FieldError{Field: jsonPointer(path...), Code: "type", Message: "must be a decimal string"})
+		}
+	case reflect.Slice, reflect.Array:
+		if items, ok := value.([]any); ok {
+			for i, item := range items {
+				items[i] = decimalToNumbers(item, t.Elem(), append(path, strconv.Itoa(i)), fields)
+			}
+		}
+	case reflect.Map:
+		if object, ok := value.(map[string]any); ok {
+			for k, item := range object {
+				object[k] = decimalToNumbers(item, t.Elem(), append(path, k), fields)
+			}
+		}
+	case reflect.Struct:
+		if object, ok := value.(map[string]any); ok {
+			for name, field := range jsonFields(t) {
+				if item, ok := object[name]; ok {
+					object[name] = decimalToNumbers(item, field.Type, append(path, name), fields)
+				}
+			}
+		}
+	}
+	return value
+}
+
+// jsonFields are the struct fields of t by their JSON names, including
+// those promoted from embedded structs
+func jsonFields(t reflect.Type) map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			embedded := f.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				for n, ef := range jsonFields(embedded) {
+					if _, ok := fields[n]; !ok {
+						fields[n] = ef
+					}
+				}
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+// decimalAmountsWriter marks responses that go out with string amounts, see WriteJSON
+type decimalAmountsWriter struct {
+	http.ResponseWriter
+}
+
+func (w *decimalAmountsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withNegotiatedAmounts switches the response to string amounts when the request's Accept asks for them
+func withNegotiatedAmounts(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	w.Header().Add("Vary", "Accept")
+	if negotiatesDecimalAmounts(r.Header.Get("Accept")) {
+		return &decimalAmountsWriter{w}
+	}
+	return w
+}
+
+// responseValue is v as it's encoded for w, with floats as decimal strings
+// when w negotiated them
+func responseValue(w http.ResponseWriter, v any) any {
+	if _, ok := w.(*decimalAmountsWriter); !ok {
+		return v
+	}
+	return decimalStrings(reflect.ValueOf(v))
+}
+
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// decimalStrings mirrors what encoding/json does with v, except that
+// floats come out as decimal strings
+func decimalStrings(v reflect.Value) any {
+	if !v.IsValid() {
+		return nil
+	}
+	if v.Type().Implements(jsonMarshalerType) {
+		if v.Kind() == reflect.Pointer && v.IsNil() {
+			return nil
+		}
+		return v.Interface()
+	}
+
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return decimalString(v.Float())
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return decimalStrings(v.Elem())
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Interface()
+		}
+		fallthrough
+	case reflect.Array:
+		items := make([]any, v.Len())
+		for i := range items {
+			items[i] = decimalStrings(v.Index(i))
+		}
+		return items
+	case reflect.Map:
+		if v.IsNil() || v.Type().Key().Kind() != reflect.String {
+			return v.Interface()
+		}
+		object := make(map[string]any, v.Len())
+		for it := v.MapRange(); it.Next(); {
+			object[it.Key().String()] = decimalStrings(it.Value())
+		}
+		return object
+	case reflect.Struct:
+		return structDecimalStrings(v)
+	}
+	return v.Interface()
+}
+
+func structDecimalStrings(v reflect.Value) orderedObject {
+	object := orderedObject{}
+	seen := map[string]bool{}
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		value := v.Field(i)
+		if f.Anonymous && name == "" {
+			if value.Kind() == reflect.Pointer {
+				if value.IsNil() {
+					continue
+				}
+				value = value.Elem()
+			}
+			if value.Kind() == reflect.Struct && !value.Type().Implements(jsonMarshalerType) {
+				for _, field := range structDecimalStrings(value) {
+					if !seen[field.name] {
+						seen[field.name] = true
+						object = append(object, field)
+					}
+				}
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if strings.Contains(opts, "omitempty") && isEmptyJSON(value) {
+			continue
+		}
+		if !seen[name] {
+			seen[name] = true
+			object = append(object, objectField{name, decimalStrings(value)})
+		}
+	}
+	return object
+}
+
+// isEmptyJSON is encoding/json's notion of empty for omitempty
+func isEmptyJSON(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	case reflect.Struct:
+		return false
+	}
+	return v.IsZero()
+}
+
+// decimalString renders amounts with at least two places, like 10.50
+func decimalString(f float64) any {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return f
+	}
+	d := decimal.NewFromFloat(f)
+	if d.Exponent() > -2 {
+		return d.StringFixed(2)
+	}
+	return d.String()
+}
+
+// orderedObject keeps a struct's field order when it's encoded
+type orderedObject []objectField
+
+type objectField struct {
+	name  string
+	value any
+}
+
+func (o orderedObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, field := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		name, err := json.Marshal(field.name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(field.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(name)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// readDecimalRequest replaces r's body with one whose string amounts are numbers
+func readDecimalRequest(r *http.Request, v any) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	body, err = decimalRequestBody(body, reflect.TypeOf(v))
+	if err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiatesDecimalAmounts(t *testing.T) {
+	assert.True(t, negotiatesDecimalAmounts("application/json; amounts=string"))
+	assert.True(t, negotiatesDecimalAmounts("text/html, application/json;amounts=string;q=0.9"))
+	assert.False(t, negotiatesDecimalAmounts("application/json"))
+	assert.False(t, negotiatesDecimalAmounts(""))
+}
+
+func TestParseDecimalAmount(t *testing.T) {
+	for _, valid := range []string{"10", "10.5", "10.50", "10.500", "0.01", "-3.20"} {
+		_, fieldErr := parseDecimalAmount(valid)
+		assert.Nil(t, fieldErr, valid)
+	}
+	for value, code := range map[string]string{
+		"10.505": "precision",
+		"0.001":  "precision",
+		"1e3":    "decimal",
+		"1,000":  "decimal",
+		"ten":    "decimal",
+		"":       "decimal",
+		" 10":    "decimal",
+	} {
+		_, fieldErr := parseDecimalAmount(value)
+		require.NotNil(t, fieldErr, value)
+		assert.Equal(t, code, fieldErr.Code, value)
+	}
+}
+
+// The transfer handler reads the decimal request and answers in kind
+func TestDecimalAmountTransfer(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9951, Balance: 10000, Currency: "USD", Status: AccountActive}))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9952, Currency: "USD", Status: AccountActive}))
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	s := NewAPIServer(&Config{}, store)
+
+	transfer := func(body, contentType, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/v1/transfer", strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		makeHTTPHandle(s.handleTransfer(engine))(w, r)
+		return w
+	}
+	const decimalJSON = "application/json; amounts=string"
+
+	w := transfer(`{"fromAccount": 9951, "toAccount": 9952, "amount": "10.50"}`, decimalJSON, decimalJSON)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, decimalJSON, w.Header().Get("Content-Type"))
+	var receipt map[string]any
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &receipt))
+	assert.Equal(t, "10.50", receipt["amount"])
+	assert.Equal(t, float64(9951), receipt["from_account"], "integers stay numbers")
+	assert.NotContains(t, receipt, "fee", "omitempty still applies")
+	acc, err := store.GetAccountByNumber(ctx, 9952)
+	require.Nil(t, err)
+	assert.Equal(t, int64(1050), acc.Balance)
+
+	// Numeric requests and responses are unchanged without the parameter
+	w = transfer(`{"fromAccount": 9951, "toAccount": 9952, "amount": 1.25}`, "application/json", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"amount":1.25`)
+
+	for body, field := range map[string]FieldError{
+		`{"fromAccount": 9951, "toAccount": 9952, "amount": "10.505"}`: {Field: "/amount", Code: "precision"},
+		`{"fromAccount": 9951, "toAccount": 9952, "amount": "1e3"}`:    {Field: "/amount", Code: "decimal"},
+		`{"fromAccount": 9951, "toAccount": 9952, "amount": 10.5}`:     {Field: "/amount", Code: "type"},
+	} {
+		w = transfer(body, decimalJSON, "")
+		require.Equal(t, http.StatusUnprocessableEntity, w.Code, body)
+		var apiErr ApiError
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &apiErr))
+		require.Len(t, apiErr.Fields, 1, body)
+		assert.Equal(t, field.Field, apiErr.Fields[0].Field, body)
+		assert.Equal(t, field.Code, apiErr.Fields[0].Code, body)
+	}
+}
+
+func TestDecimalStrings(t *testing.T) {
+	type Embedded struct {
+		Rate float64 `json:"rate"`
+	}
+	type response struct {
+		Embedded
+		Amount  float64            `json:"amount"`
+		Limit   *float64           `json:"limit,omitempty"`
+		Cents   int64              `json:"cents"`
+		Items   []float64          `json:"items"`
+		ByName  map[string]float64 `json:"by_name"`
+		At      time.Time          `json:"at"`
+		Skipped float64            `json:"-"`
+	}
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	out, err := json.Marshal(decimalStrings(reflect.ValueOf(response{
+		Embedded: Embedded{Rate: 0.9234},
+		Amount:   12,
+		Cents:    1200,
+		Items:    []float64{0.1, 2.5},
+		ByName:   map[string]float64{"a": 1},
+		At:       at,
+	})))
+	require.Nil(t, err)
+	assert.Equal(t, `{"rate":"0.9234","amount":"12.00","cents":1200,"items":["0.10","2.50"],"by_name":{"a":"1.00"},"at":"2024-01-02T03:04:05Z"}`, string(out))
+}
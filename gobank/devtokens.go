@@ -0,0 +1,116 @@
+//go:build devtokens
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// Builds made with -tags devtokens serve POST /dev/tokens, which mints
+// deliberately broken JWTs so client developers can exercise their error
+// handling against a real server. Never ship this build.
+
+const (
+	DevTokenValid         = "valid"
+	DevTokenExpired       = "expired"
+	DevTokenWrongAudience = "wrong_audience"
+	DevTokenTampered      = "tampered"
+	DevTokenWrongSecret   = "wrong_secret"
+	DevTokenUnsigned      = "unsigned"
+)
+
+type DevTokenRequest struct {
+	AccountNumber int64  `json:"accountNumber" validate:"required,positive"`
+	Kind          string `json:"kind" validate:"required"`
+}
+
+type DevTokenResponse struct {
+	Kind           string `json:"kind"`
+	Token          string `json:"token"`
+	ExpectedStatus int    `json:"expected_status"` // what JWT-protected routes answer with this token
+}
+
+func init() {
+	apiOperations = append(apiOperations, apiOperation{
+		Method: "POST", Path: "/dev/tokens", Summary: "Mint a valid or deliberately broken JWT (dev builds only)",
+		Request: DevTokenRequest{}, Response: DevTokenResponse{},
+	})
+}
+
+func (s *APIServer) registerDevRoutes(router *mux.Router) {
+	log.Println("Dev token endpoints are enabled, this build must not run in production")
+	router.HandleFunc("/dev/tokens", makeHTTPHandle(s.handleDevToken)).Methods("POST")
+}
+
+func mintDevToken(kind string, account *Account, secret string, now time.Time) (string, error) {
+	claims := jwtClaims(account, now)
+
+	switch kind {
+	case DevTokenValid:
+		return signJWT(claims, secret)
+	case DevTokenExpired:
+		return signJWT(jwtClaims(account, now.Add(-2*jwtTTL)), secret)
+	case DevTokenWrongAudience:
+		claims["aud"] = "not-" + jwtAudience
+		return signJWT(claims, secret)
+	case DevTokenWrongSecret:
+		return signJWT(claims, "not-"+secret)
+	case DevTokenUnsigned:
+		return jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	case DevTokenTampered:
+		token, err := signJWT(claims, secret)
+		if err != nil {
+			return "", err
+		}
+		// Point the payload at another account and keep the original signature
+		claims["accountNumber"] = float64(account.Number + 1)
+		payload, err := json.Marshal(claims)
+		if err != nil {
+			return "", err
+		}
+		parts := strings.Split(token, ".")
+		return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2], nil
+	}
+
+	return "", fmt.Errorf("kind must be one of %s, %s, %s, %s, %s or %s", DevTokenValid, DevTokenExpired,
+		DevTokenWrongAudience, DevTokenTampered, DevTokenWrongSecret, DevTokenUnsigned)
+}
+
+// POST /dev/tokens
+func (s *APIServer) handleDevToken(w http.ResponseWriter, r *http.Request) error {
+	var req DevTokenRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		return fmt.Errorf("JWT_SECRET is not set")
+	}
+
+	account, err := s.forRequest(r).store.GetAccountByNumber(r.Context(), req.AccountNumber)
+	if err != nil {
+		return err
+	}
+
+	token, err := mintDevToken(req.Kind, account, secret, time.Now())
+	if err != nil {
+		return err
+	}
+
+	resp := &DevTokenResponse{Kind: req.Kind, Token: token, ExpectedStatus: http.StatusForbidden}
+	if req.Kind == DevTokenValid {
+		resp.ExpectedStatus = http.StatusOK
+	}
+	return WriteJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,8 @@
+//go:build !devtokens
+
+package main
+
+import "github.com/gorilla/mux"
+
+// Dev token endpoints only exist in builds made with -tags devtokens, see devtokens.go
+func (s *APIServer) registerDevRoutes(router *mux.Router) {}
@@ -0,0 +1,33 @@
+//go:build devtokens
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDevTokens(t *testing.T) {
+	t.Setenv("JWT_SECRET", "dev-secret")
+	account := &Account{Number: 4242}
+
+	for _, kind := range []string{DevTokenValid, DevTokenExpired, DevTokenWrongAudience, DevTokenTampered, DevTokenWrongSecret, DevTokenUnsigned} {
+		token, err := mintDevToken(kind, account, "dev-secret", time.Now())
+		require.Nil(t, err, kind)
+
+		parsed, err := validateJWT(token)
+		if kind == DevTokenValid {
+			require.Nil(t, err)
+			number, _ := jwtAccountNumber(parsed)
+			assert.Equal(t, int64(4242), number)
+			continue
+		}
+		assert.Error(t, err, kind)
+	}
+
+	_, err := mintDevToken("bogus", account, "dev-secret", time.Now())
+	assert.Error(t, err)
+}
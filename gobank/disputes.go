@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The payer of a settled transfer disputes it with POST
+// /transfer/{reference}/dispute within DISPUTE_WINDOW of the transfer, once
+// per transfer. An admin resolves the dispute by rejecting it or reversing
+// the transfer, which books the amount back from the payee to the payer in
+// a compensating ledger entry under the transfer's reference, the original
+// entry is left as it is. Fees stay charged. Both parties are notified and
+// can see the dispute, on the transfer and in GET /account/{id}/disputes.
+
+const (
+	DisputeOpen     = "open"
+	DisputeReversed = "reversed"
+	DisputeRejected = "rejected"
+
+	TransferKindReversal = "transfer_reversal"
+
+	AuditDisputeOpened   = "dispute.opened"
+	AuditDisputeResolved = "dispute.resolved"
+)
+
+type Dispute struct {
+	ID          int        `json:"id"`
+	Reference   string     `json:"reference"` // the disputed transfer
+	FromAccount int64      `json:"from_account"`
+	ToAccount   int64      `json:"to_account"`
+	Amount      float64    `json:"amount"`
+	Currency    string     `json:"currency"`
+	Reason      string     `json:"reason"`
+	Status      string     `json:"status"`
+	Resolution  string     `json:"resolution,omitempty"`
+	ResolvedBy  string     `json:"resolved_by,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ResolvedAt  *time.Time `json:"resolved_at,omitempty"`
+}
+
+type OpenDisputeRequest struct {
+	Reason string `json:"reason" validate:"required,max=500"`
+}
+
+type ResolveDisputeRequest struct {
+	Outcome string `json:"outcome" validate:"required,oneof=reversed rejected"`
+	Note    string `json:"note" validate:"required,max=500"`
+}
+
+type DisputeService interface {
+	Open(ctx context.Context, acc *Account, reference string, req OpenDisputeRequest, actor string) (*Dispute, error)
+	Resolve(ctx context.Context, id int, req ResolveDisputeRequest, actor string) (*Dispute, error)
+}
+
+type disputeService struct {
+	store    Storage
+	notifier Notifier
+	window   time.Duration
+}
+
+func NewDisputeService(store Storage, notifier Notifier, window time.Duration) DisputeService {
+	return &disputeService{store: store, notifier: notifier, window: window}
+}
+
+func (s *APIServer) disputes() DisputeService {
+	return NewDisputeService(s.store, s.notifier, s.config.DisputeWindow)
+}
+
+func (s *disputeService) Open(ctx context.Context, acc *Account, reference string, req OpenDisputeRequest, actor string) (*Dispute, error) {
+	receipt, err := s.store.GetTransferReceipt(ctx, reference)
+	if err != nil {
+		return nil, err
+	}
+	// Only the payer disputes, to anyone else the transfer doesn't exist
+	if receipt.FromAccount != acc.Number {
+		return nil, fmt.Errorf("%w: %s", ErrTransferNotFound, reference)
+	}
+	now := time.Now().UTC()
+	if s.window > 0 && now.After(receipt.TransferredAt.Add(s.window)) {
+		return nil, ErrDisputeWindowClosed
+	}
+
+	dispute := &Dispute{
+		Reference:   reference,
+		FromAccount: receipt.FromAccount,
+		ToAccount:   receipt.ToAccount,
+		Amount:      receipt.Amount,
+		Currency:    receipt.Currency,
+		Reason:      strings.TrimSpace(req.Reason),
+		Status:      DisputeOpen,
+		CreatedAt:   now,
+	}
+	if err := s.store.CreateDispute(ctx, dispute); err != nil {
+		return nil, err
+	}
+	recordAudit(ctx, s.store, actor, acc.ID, AuditDisputeOpened, []FieldChange{{Field: "dispute", Old: nil, New: dispute.ID}})
+
+	s.notify(ctx, dispute, fmt.Sprintf("Transfer %s of %.2f %s from account %d to %d is disputed", reference, dispute.Amount, dispute.Currency,
+		dispute.FromAccount, dispute.ToAccount))
+	return dispute, nil
+}
+
+// Resolve claims the open dispute first so it's resolved once, a reversal
+// that can't be booked leaves it open
+func (s *disputeService) Resolve(ctx context.Context, id int, req ResolveDisputeRequest, actor string) (*Dispute, error) {
+	dispute, err := s.store.GetDispute(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	dispute.Status, dispute.Resolution, dispute.ResolvedBy, dispute.ResolvedAt = req.Outcome, strings.TrimSpace(req.Note), actor, &now
+	claimed, err := s.store.ResolveDispute(ctx, dispute, DisputeOpen)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, fmt.Errorf("%w: dispute %d", ErrDisputeResolved, id)
+	}
+
+	if dispute.Status == DisputeReversed {
+		if err := s.reverse(ctx, dispute, actor); err != nil {
+			dispute.Status, dispute.Resolution, dispute.ResolvedBy, dispute.ResolvedAt = DisputeOpen, "", "", nil
+			if _, revertErr := s.store.ResolveDispute(ctx, dispute, DisputeReversed); revertErr != nil {
+				log.Printf("Dispute %d is marked reversed but wasn't booked: %v", id, revertErr)
+			}
+			return nil, err
+		}
+	}
+
+	for _, number := range []int64{dispute.FromAccount, dispute.ToAccount} {
+		if acc, err := s.store.GetAccountByNumber(ctx, number); err == nil {
+			recordAudit(ctx, s.store, actor, acc.ID, AuditDisputeResolved, []FieldChange{{Field: "dispute", Old: DisputeOpen, New: dispute.Status}})
+		}
+	}
+	s.notify(ctx, dispute, fmt.Sprintf("The dispute of transfer %s was resolved: %s", dispute.Reference, dispute.Status))
+	return dispute, nil
+}
+
+// reverse books what the payee received back to the payer, through FX
+// clearing for cross-currency transfers
+func (s *disputeService) reverse(ctx context.Context, dispute *Dispute, actor string) error {
+	receipt, err := s.store.GetTransferReceipt(ctx, dispute.Reference)
+	if err != nil {
+		return err
+	}
+	debit, credit, toCurrency := toCents(receipt.Amount), toCents(receipt.Amount), receipt.Currency
+	if receipt.ToCurrency != "" {
+		credit, toCurrency = toCents(receipt.ConvertedAmount), receipt.ToCurrency
+	}
+
+	ctx = withTransferReference(ctx, dispute.Reference)
+	for attempt := 1; ; attempt++ {
+		from, err := s.store.GetAccountByNumber(ctx, receipt.FromAccount)
+		if err != nil {
+			return err
+		}
+		to, err := s.store.GetAccountByNumber(ctx, receipt.ToAccount)
+		if err != nil {
+			return err
+		}
+		if from.Status == AccountClosed || to.Status == AccountClosed {
+			return ErrAccountClosed
+		}
+
+		entry := newLedgerEntry(ctx, TransferKindReversal).
+			accountIn(to, toCurrency, -credit).
+			accountIn(from, receipt.Currency, debit)
+		if toCurrency != receipt.Currency {
+			entry.ledger(LedgerFXClearing, receipt.Currency, -debit).
+				ledger(LedgerFXClearing, toCurrency, credit)
+		}
+		entry.Memo = "reversal of disputed transfer " + dispute.Reference
+		err = s.store.PostLedgerEntry(ctx, entry, nil)
+		if errors.Is(err, ErrConflict) && attempt < transferConflictRetries {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		auditBalanceChange(ctx, s.store, actor, to, -credit)
+		auditBalanceChange(ctx, s.store, actor, from, debit)
+		return nil
+	}
+}
+
+// notify tells both parties, failures are only logged
+func (s *disputeService) notify(ctx context.Context, dispute *Dispute, message string) {
+	for _, number := range []int64{dispute.FromAccount, dispute.ToAccount} {
+		acc, err := s.store.GetAccountByNumber(ctx, number)
+		if err == nil {
+			err = s.notifier.Notify(acc.ID, "Transfer dispute", message)
+		}
+		if err != nil {
+			log.Printf("Failed to notify account %d of dispute %d: %v", number, dispute.ID, err)
+		}
+	}
+}
+
+func transferReferenceParam(r *http.Request) (string, error) {
+	reference := mux.Vars(r)["reference"]
+	if !validReference.MatchString(reference) {
+		return "", newHTTPError(http.StatusBadRequest, "INVALID_REFERENCE", "transfer reference must be a UUID")
+	}
+	return reference, nil
+}
+
+// POST /transfer/{reference}/dispute, by the payer
+func (s *APIServer) handleOpenDispute(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	acc, r, err := s.tokenAccount(r)
+	if err != nil {
+		return err
+	}
+	reference, err := transferReferenceParam(r)
+	if err != nil {
+		return err
+	}
+	var req OpenDisputeRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+
+	dispute, err := s.disputes().Open(r.Context(), acc, reference, req, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusCreated, dispute)
+}
+
+// GET /transfer/{reference}/dispute, by either party
+func (s *APIServer) handleGetTransferDispute(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	acc, r, err := s.tokenAccount(r)
+	if err != nil {
+		return err
+	}
+	reference, err := transferReferenceParam(r)
+	if err != nil {
+		return err
+	}
+
+	dispute, err := s.store.GetTransferDispute(r.Context(), reference)
+	if err != nil {
+		return err
+	}
+	if dispute.FromAccount != acc.Number && dispute.ToAccount != acc.Number {
+		return fmt.Errorf("%w: %s", ErrDisputeNotFound, reference)
+	}
+	return WriteJSON(w, http.StatusOK, dispute)
+}
+
+// GET /account/{id}/disputes, the ones the account raised or is party to, newest first
+func (s *APIServer) handleGetAccountDisputes(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	acc, err := s.store.GetAccountbyID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	disputes, err := s.store.GetAccountDisputes(r.Context(), acc.Number)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, disputes)
+}
+
+// GET /admin/disputes, ?status= defaults to open
+func (s *APIServer) handleGetDisputes(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "":
+		status = DisputeOpen
+	case DisputeOpen, DisputeReversed, DisputeRejected:
+	default:
+		return invalidParam("query", "status", "oneof", "must be open, reversed or rejected")
+	}
+
+	disputes, err := s.store.GetDisputes(r.Context(), status)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, disputes)
+}
+
+// POST /admin/disputes/{disputeID}/resolve
+func (s *APIServer) handleResolveDispute(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "disputeID")
+	if err != nil {
+		return err
+	}
+	s = s.forRequest(r)
+
+	var req ResolveDisputeRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+	dispute, err := s.disputes().Resolve(r.Context(), id, req, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, dispute)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisputeReversal(t *testing.T) {
+	t.Setenv("JWT_SECRET", "dispute-secret")
+	ctx := context.Background()
+	store := newMemoryStorage()
+	payer := &Account{FirstName: "Ada", Number: 9921, Balance: 10000, Currency: "USD", Status: AccountActive}
+	payee := &Account{FirstName: "Alan", Number: 9922, Currency: "USD", Status: AccountActive}
+	require.Nil(t, store.CreateAccount(ctx, payer))
+	require.Nil(t, store.CreateAccount(ctx, payee))
+
+	s := NewAPIServer(&Config{DisputeWindow: time.Hour}, store)
+	notifier := &capturingNotifier{}
+	s.notifier = notifier
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	receipt, _, err := s.transfers().Transfer(ctx, TransferRequest{FromAccountNumber: 9921, ToAccountNumber: 9922, Amount: 40}, engine, "test")
+	require.Nil(t, err)
+
+	call := func(handler apiFunc, acc *Account, method, body string) *httptest.ResponseRecorder {
+		r := mux.SetURLVars(httptest.NewRequest(method, "/transfer/"+receipt.Reference+"/dispute", strings.NewReader(body)),
+			map[string]string{"reference": receipt.Reference})
+		token, err := createJWT(acc)
+		require.Nil(t, err)
+		r.Header.Set("x-jwt-token", token)
+		w := httptest.NewRecorder()
+		makeHTTPHandle(handler)(w, r)
+		return w
+	}
+
+	w := call(s.handleOpenDispute, payee, "POST", `{"reason": "never ordered"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code, "only the payer disputes")
+
+	w = call(s.handleOpenDispute, payer, "POST", `{"reason": "goods never arrived"}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	assert.Len(t, notifier.messages, 2, "both parties hear of it")
+	w = call(s.handleOpenDispute, payer, "POST", `{"reason": "again"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = call(s.handleGetTransferDispute, payee, "GET", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	dispute := &Dispute{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), dispute))
+	assert.Equal(t, DisputeOpen, dispute.Status)
+	assert.Equal(t, 40.0, dispute.Amount)
+
+	owed, err := store.GetAccountDisputes(ctx, 9922)
+	require.Nil(t, err)
+	assert.Len(t, owed, 1)
+
+	w = httptest.NewRecorder()
+	r := mux.SetURLVars(httptest.NewRequest("POST", "/admin/disputes/1/resolve", strings.NewReader(`{"outcome": "refunded", "note": "x"}`)),
+		map[string]string{"disputeID": "1"})
+	makeHTTPHandle(s.handleResolveDispute)(w, r)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	resolved, err := s.disputes().Resolve(ctx, dispute.ID, ResolveDisputeRequest{Outcome: DisputeReversed, Note: "merchant agreed"}, "admin")
+	require.Nil(t, err)
+	assert.Equal(t, DisputeReversed, resolved.Status)
+	assert.Equal(t, "admin", resolved.ResolvedBy)
+
+	for number, balance := range map[int64]int64{9921: 10000, 9922: 0} {
+		acc, err := store.GetAccountByNumber(ctx, number)
+		require.Nil(t, err)
+		assert.Equal(t, balance, acc.Balance, number)
+	}
+
+	_, err = s.disputes().Resolve(ctx, dispute.ID, ResolveDisputeRequest{Outcome: DisputeReversed, Note: "again"}, "admin")
+	assert.ErrorIs(t, err, ErrDisputeResolved, "reversed once")
+}
+
+func TestDisputeRejectedAndWindow(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	payer := &Account{FirstName: "Grace", Number: 9931, Balance: 10000, Currency: "USD", Status: AccountActive}
+	payee := &Account{FirstName: "Emmy", Number: 9932, Currency: "USD", Status: AccountActive}
+	require.Nil(t, store.CreateAccount(ctx, payer))
+	require.Nil(t, store.CreateAccount(ctx, payee))
+
+	s := NewAPIServer(&Config{}, store)
+	s.notifier = &capturingNotifier{}
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	receipt, _, err := s.transfers().Transfer(ctx, TransferRequest{FromAccountNumber: 9931, ToAccountNumber: 9932, Amount: 25}, engine, "test")
+	require.Nil(t, err)
+
+	_, err = NewDisputeService(store, s.notifier, time.Nanosecond).Open(ctx, payer, receipt.Reference, OpenDisputeRequest{Reason: "late"}, "test")
+	assert.ErrorIs(t, err, ErrDisputeWindowClosed)
+
+	dispute, err := s.disputes().Open(ctx, payer, receipt.Reference, OpenDisputeRequest{Reason: "wrong amount"}, "test")
+	require.Nil(t, err)
+	rejected, err := s.disputes().Resolve(ctx, dispute.ID, ResolveDisputeRequest{Outcome: DisputeRejected, Note: "amount matches the invoice"}, "admin")
+	require.Nil(t, err)
+	assert.Equal(t, DisputeRejected, rejected.Status)
+
+	acc, err := store.GetAccountByNumber(ctx, 9932)
+	require.Nil(t, err)
+	assert.Equal(t, int64(2500), acc.Balance, "nothing is booked back")
+
+	open, err := store.GetDisputes(ctx, DisputeOpen)
+	require.Nil(t, err)
+	assert.Empty(t, open)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Accounts that see no activity, an outgoing transfer or a login, for
+// DormancyMonths are marked dormant. Owners get a notice DormancyNoticeDays
+// before and have to re-enter their password to send money again. Incoming
+// transfers are still accepted while dormant.
+
+const AuditAccountReactivated = "account.reactivated"
+
+type ReactivateAccountRequest struct {
+	Password string `json:"password" validate:"required,max=72"`
+}
+
+// touchActivity is best effort, a failed write only delays dormancy
+func touchActivity(ctx context.Context, store Storage, id int) {
+	if err := store.TouchAccountActivity(ctx, id, time.Now().UTC()); err != nil {
+		log.Printf("Failed to record activity for account %d: %v", id, err)
+	}
+}
+
+func (s *accountService) ReactivateAccount(ctx context.Context, id int, password, actor string) (*Account, error) {
+	acc, err := s.store.GetAccountbyID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !acc.ValidatePassword(password) {
+		return nil, newHTTPError(http.StatusForbidden, "REVERIFICATION_FAILED", "password is incorrect")
+	}
+
+	after, err := s.setStatus(ctx, id, AccountDormant, AccountActive, actor)
+	if err != nil {
+		return nil, err
+	}
+	touchActivity(ctx, s.store, id)
+	recordAudit(ctx, s.store, actor, id, AuditAccountReactivated, []FieldChange{})
+	return after, nil
+}
+
+// POST /account/{id}/reactivate
+func (s *APIServer) handleReactivateAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	var req ReactivateAccountRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+
+	account, err := s.forRequest(r).accounts().ReactivateAccount(r.Context(), id, req.Password, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, account)
+}
+
+type dormancyRunner struct {
+	store      Storage
+	notifier   Notifier
+	months     int
+	noticeDays int
+}
+
+func (s *APIServer) dormancyJob() Job {
+	runner := &dormancyRunner{
+		store:      s.store,
+		notifier:   s.notifier,
+		months:     s.config.DormancyMonths,
+		noticeDays: s.config.DormancyNoticeDays,
+	}
+
+	return Job{
+		Name:     "dormancy",
+		Interval: s.config.SchedulerInterval,
+		Run: func(ctx context.Context) error {
+			return runner.run(ctx, time.Now().UTC())
+		},
+	}
+}
+
+func (d *dormancyRunner) run(ctx context.Context, now time.Time) error {
+	if d.months <= 0 {
+		return nil
+	}
+	cutoff := now.AddDate(0, -d.months, 0)
+
+	// Notices first, an account crossing both lines in one run still hears about it
+	if d.noticeDays > 0 {
+		upcoming, err := d.store.GetInactiveAccounts(ctx, cutoff.AddDate(0, 0, d.noticeDays), true, 100)
+		if err != nil {
+			return err
+		}
+		for _, acc := range upcoming {
+			claimed, err := d.store.MarkDormancyNotified(ctx, acc.ID, now)
+			if err != nil {
+				return err
+			}
+			if !claimed {
+				continue
+			}
+			dormantOn := acc.LastActivityAt.AddDate(0, d.months, 0)
+			message := fmt.Sprintf("Your account has had no activity since %s and becomes dormant on %s unless you log in or send a transfer.",
+				acc.LastActivityAt.Format("2006-01-02"), dormantOn.Format("2006-01-02"))
+			if err := d.notifier.Notify(acc.ID, "Your account is about to become dormant", message); err != nil {
+				log.Printf("Failed to send dormancy notice to account %d: %v", acc.ID, err)
+			}
+		}
+	}
+
+	stale, err := d.store.GetInactiveAccounts(ctx, cutoff, false, 100)
+	if err != nil {
+		return err
+	}
+	setJobQueueDepth("dormancy", len(stale))
+
+	for _, acc := range stale {
+		// The account may have been used or frozen since it was listed
+		if err := d.store.SetAccountStatus(ctx, acc.ID, AccountActive, AccountDormant); err != nil {
+			log.Printf("Failed to mark account %d dormant: %v", acc.ID, err)
+			continue
+		}
+
+		after := *acc
+		after.Status = AccountDormant
+		recordAudit(ctx, d.store, "dormancy", acc.ID, AuditAccountUpdated, diffAccounts(acc, &after))
+
+		if err := d.notifier.Notify(acc.ID, "Your account is dormant", "Log in and reactivate your account to send money again."); err != nil {
+			log.Printf("Failed to send dormancy notification to account %d: %v", acc.ID, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDormancy(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	store := newMemoryStorage()
+
+	stale, err := NewAccount("Old", "Owner", "password")
+	require.Nil(t, err)
+	stale.Balance = 1000
+	stale.LastActivityAt = now.AddDate(-1, 0, -1)
+	soon := &Account{Number: 6002, Currency: "USD", Status: AccountActive, LastActivityAt: now.AddDate(0, -12, 10)}
+	recent := &Account{Number: 6003, Currency: "USD", Status: AccountActive, LastActivityAt: now.AddDate(0, -1, 0)}
+	for _, acc := range []*Account{stale, soon, recent} {
+		require.Nil(t, store.CreateAccount(ctx, acc))
+	}
+
+	notifier := &capturingNotifier{}
+	runner := &dormancyRunner{store: store, notifier: notifier, months: 12, noticeDays: 30}
+	require.Nil(t, runner.run(ctx, now))
+
+	got, _ := store.GetAccountbyID(ctx, stale.ID)
+	assert.Equal(t, AccountDormant, got.Status)
+	got, _ = store.GetAccountbyID(ctx, soon.ID)
+	assert.Equal(t, AccountActive, got.Status)
+	got, _ = store.GetAccountbyID(ctx, recent.ID)
+	assert.Equal(t, AccountActive, got.Status)
+	// Both others got a notice, the stale one also the dormancy message
+	assert.Len(t, notifier.messages, 3)
+
+	// Notices aren't repeated
+	require.Nil(t, runner.run(ctx, now))
+	assert.Len(t, notifier.messages, 3)
+
+	// Dormant accounts can receive but not send
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	transfers := NewTransferService(store, TransferLimits{}, staticRateProvider{}, nil, nil)
+	transfer := func(from, to int64) error {
+		_, _, err := transfers.Transfer(ctx, TransferRequest{FromAccountNumber: from, ToAccountNumber: to, Amount: 1}, engine, "test")
+		return err
+	}
+	assert.ErrorIs(t, transfer(stale.Number, recent.Number), ErrAccountDormant)
+	require.Nil(t, store.PostLedgerEntry(ctx, fundingEntry(ctx, recent, 500), nil))
+	assert.Nil(t, transfer(recent.Number, stale.Number))
+
+	accounts := NewAccountService(store)
+	_, err = accounts.ReactivateAccount(ctx, stale.ID, "wrong", "test")
+	var herr *httpError
+	assert.ErrorAs(t, err, &herr)
+
+	reactivated, err := accounts.ReactivateAccount(ctx, stale.ID, "password", "test")
+	require.Nil(t, err)
+	assert.Equal(t, AccountActive, reactivated.Status)
+	assert.Nil(t, transfer(stale.Number, recent.Number))
+}
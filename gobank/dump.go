@@ -0,0 +1,660 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// gobank export streams every account and ledger entry to a file, gobank
+// import loads such a file into an empty database, for backups and for
+// cloning an environment. Ids, account numbers and password hashes are kept.
+//
+// jsonl has one record per line, {"account": {...}} or {"entry": {...}}. csv
+// has a row per account and one per posting, the first column names the
+// record and consecutive postings with the same entry id make up an entry.
+// Accounts come first, then entries in id order.
+//
+// Every dump gets a <file>.sha256 in sha256sum format next to it. Import
+// refuses a file that doesn't match it. With -dry-run the file is loaded in
+// a transaction that's rolled back, so the database's constraints are
+// checked too.
+
+const (
+	DumpJSONL = "jsonl"
+	DumpCSV   = "csv"
+)
+
+type DumpSummary struct {
+	Accounts int
+	Entries  int
+}
+
+type dumpWriter interface {
+	WriteAccount(acc *Account) error
+	WriteEntry(entry *LedgerEntry) error
+	Flush() error
+}
+
+type dumpReader interface {
+	// Next returns the next account or entry, io.EOF after the last
+	Next() (*Account, *LedgerEntry, error)
+}
+
+func newDumpWriter(format string, w io.Writer) (dumpWriter, error) {
+	switch format {
+	case DumpJSONL:
+		buf := bufio.NewWriter(w)
+		return &jsonlDumpWriter{buf: buf, enc: json.NewEncoder(buf)}, nil
+	case DumpCSV:
+		return &csvDumpWriter{w: csv.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("unknown dump format %q, use jsonl or csv", format)
+}
+
+func newDumpReader(format string, r io.Reader) (dumpReader, error) {
+	switch format {
+	case DumpJSONL:
+		return &jsonlDumpReader{dec: json.NewDecoder(bufio.NewReader(r))}, nil
+	case DumpCSV:
+		cr := csv.NewReader(bufio.NewReader(r))
+		cr.FieldsPerRecord = -1
+		return &csvDumpReader{r: cr}, nil
+	}
+	return nil, fmt.Errorf("unknown dump format %q, use jsonl or csv", format)
+}
+
+// dumpAccount is an Account with the fields its JSON hides
+type dumpAccount struct {
+	*Account
+	EncryptedPassword string `json:"encrypted_password"`
+	Version           int64  `json:"version"`
+}
+
+type dumpRecord struct {
+	Account *dumpAccount `json:"account,omitempty"`
+	Entry   *LedgerEntry `json:"entry,omitempty"`
+}
+
+type jsonlDumpWriter struct {
+	buf *bufio.Writer
+	enc *json.Encoder
+}
+
+func (w *jsonlDumpWriter) WriteAccount(acc *Account) error {
+	return w.enc.Encode(dumpRecord{Account: &dumpAccount{Account: acc, EncryptedPassword: acc.EncryptedPassword, Version: acc.Version}})
+}
+
+func (w *jsonlDumpWriter) WriteEntry(entry *LedgerEntry) error {
+	return w.enc.Encode(dumpRecord{Entry: entry})
+}
+
+func (w *jsonlDumpWriter) Flush() error {
+	return w.buf.Flush()
+}
+
+type jsonlDumpReader struct {
+	dec     *json.Decoder
+	records int
+}
+
+func (r *jsonlDumpReader) Next() (*Account, *LedgerEntry, error) {
+	var rec dumpRecord
+	if err := r.dec.Decode(&rec); err != nil {
+		if err == io.EOF {
+			return nil, nil, io.EOF
+		}
+		return nil, nil, fmt.Errorf("record %d: %v", r.records+1, err)
+	}
+	r.records++
+
+	switch {
+	case rec.Account != nil && rec.Account.Account != nil:
+		acc := rec.Account.Account
+		acc.EncryptedPassword, acc.Version = rec.Account.EncryptedPassword, rec.Account.Version
+		return acc, nil, nil
+	case rec.Entry != nil:
+		return nil, rec.Entry, nil
+	}
+	return nil, nil, fmt.Errorf("record %d is neither an account nor an entry", r.records)
+}
+
+type csvDumpWriter struct {
+	w *csv.Writer
+}
+
+func (w *csvDumpWriter) WriteAccount(acc *Account) error {
+	closedAt := ""
+	if acc.ClosedAt != nil {
+		closedAt = acc.ClosedAt.Format(time.RFC3339Nano)
+	}
+	metadata, err := json.Marshal(acc.Metadata)
+	if err != nil {
+		return err
+	}
+	return w.w.Write([]string{
+		"account",
+		strconv.Itoa(acc.ID),
+		strconv.FormatInt(acc.Number, 10),
+		acc.FirstName,
+		acc.LastName,
+		acc.Email,
+		strconv.FormatBool(acc.EmailVerified),
+		acc.EncryptedPassword,
+		strconv.FormatInt(acc.Balance, 10),
+		acc.Currency,
+		acc.Status,
+		strconv.FormatInt(acc.OverdraftLimit, 10),
+		strconv.Itoa(acc.MergedInto),
+		closedAt,
+		acc.LastActivityAt.Format(time.RFC3339Nano),
+		acc.CreatedAt.Format(time.RFC3339Nano),
+		strconv.FormatInt(acc.Version, 10),
+		acc.Nickname,
+		string(metadata),
+	})
+}
+
+func (w *csvDumpWriter) WriteEntry(entry *LedgerEntry) error {
+	for _, p := range entry.Postings {
+		err := w.w.Write([]string{
+			"posting",
+			strconv.FormatInt(entry.ID, 10),
+			entry.Kind,
+			entry.Reference,
+			entry.Memo,
+			entry.Category,
+			entry.CreatedAt.Format(time.RFC3339Nano),
+			strconv.Itoa(p.AccountID),
+			p.LedgerAccount,
+			p.Currency,
+			strconv.FormatInt(p.Amount, 10),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *csvDumpWriter) Flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+type csvDumpReader struct {
+	r     *csv.Reader
+	entry *LedgerEntry // being collected from its postings
+	ahead []string     // the row after the entry, read to find its end
+}
+
+func (r *csvDumpReader) Next() (*Account, *LedgerEntry, error) {
+	for {
+		fields := r.ahead
+		r.ahead = nil
+		if fields == nil {
+			var err error
+			if fields, err = r.r.Read(); err == io.EOF {
+				entry := r.entry
+				r.entry = nil
+				if entry != nil {
+					return nil, entry, nil
+				}
+				return nil, nil, io.EOF
+			} else if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		line, _ := r.r.FieldPos(0)
+		row := &csvRow{fields: fields, i: 1}
+		switch fields[0] {
+		case "account":
+			if r.entry != nil {
+				entry := r.entry
+				r.entry, r.ahead = nil, fields
+				return nil, entry, nil
+			}
+			acc := row.account()
+			if row.err != nil {
+				return nil, nil, fmt.Errorf("line %d: %v", line, row.err)
+			}
+			return acc, nil, nil
+		case "posting":
+			entry, posting := row.posting()
+			if row.err != nil {
+				return nil, nil, fmt.Errorf("line %d: %v", line, row.err)
+			}
+			if r.entry != nil && r.entry.ID != entry.ID {
+				done := r.entry
+				r.entry, r.ahead = nil, fields
+				return nil, done, nil
+			}
+			if r.entry == nil {
+				r.entry = entry
+			}
+			r.entry.Postings = append(r.entry.Postings, posting)
+		default:
+			return nil, nil, fmt.Errorf("line %d: unknown record %q", line, fields[0])
+		}
+	}
+}
+
+// csvRow parses a row's fields in order, keeping the first error
+type csvRow struct {
+	fields []string
+	i      int
+	err    error
+}
+
+func (r *csvRow) str() string {
+	if r.i >= len(r.fields) {
+		if r.err == nil {
+			r.err = fmt.Errorf("%s record has %d fields, expected more", r.fields[0], len(r.fields))
+		}
+		return ""
+	}
+	r.i++
+	return r.fields[r.i-1]
+}
+
+func (r *csvRow) int() int64 {
+	field := r.str()
+	n, err := strconv.ParseInt(field, 10, 64)
+	if err != nil && r.err == nil {
+		r.err = fmt.Errorf("field %d: %q is not a number", r.i, field)
+	}
+	return n
+}
+
+func (r *csvRow) bool() bool {
+	field := r.str()
+	b, err := strconv.ParseBool(field)
+	if err != nil && r.err == nil {
+		r.err = fmt.Errorf("field %d: %q is not true or false", r.i, field)
+	}
+	return b
+}
+
+func (r *csvRow) time() time.Time {
+	field := r.str()
+	t, err := time.Parse(time.RFC3339Nano, field)
+	if err != nil && r.err == nil {
+		r.err = fmt.Errorf("field %d: %q is not a timestamp", r.i, field)
+	}
+	return t
+}
+
+func (r *csvRow) optionalTime() *time.Time {
+	if r.i < len(r.fields) && r.fields[r.i] == "" {
+		r.i++
+		return nil
+	}
+	t := r.time()
+	return &t
+}
+
+func (r *csvRow) account() *Account {
+	acc := &Account{
+		ID:                int(r.int()),
+		Number:            r.int(),
+		FirstName:         r.str(),
+		LastName:          r.str(),
+		Email:             r.str(),
+		EmailVerified:     r.bool(),
+		EncryptedPassword: r.str(),
+		Balance:           r.int(),
+		Currency:          r.str(),
+		Status:            r.str(),
+		OverdraftLimit:    r.int(),
+		MergedInto:        int(r.int()),
+	}
+	acc.ClosedAt = r.optionalTime()
+	acc.LastActivityAt = r.time()
+	acc.CreatedAt = r.time()
+	acc.Version = r.int()
+	// Dumps taken before nicknames and metadata end here
+	if r.i < len(r.fields) {
+		acc.Nickname = r.str()
+		field := r.str()
+		if err := acc.Metadata.Scan(field); err != nil && r.err == nil {
+			r.err = fmt.Errorf("field %d: %q is not a metadata object", r.i, field)
+		}
+	}
+	return acc
+}
+
+func (r *csvRow) posting() (*LedgerEntry, Posting) {
+	entry := &LedgerEntry{
+		ID:        r.int(),
+		Kind:      r.str(),
+		Reference: r.str(),
+		Memo:      r.str(),
+		Category:  r.str(),
+		CreatedAt: r.time(),
+	}
+	posting := Posting{
+		AccountID:     int(r.int()),
+		LedgerAccount: r.str(),
+		Currency:      r.str(),
+		Amount:        r.int(),
+	}
+	return entry, posting
+}
+
+// writeDumpFile writes a dump to path through write, then its checksum
+func writeDumpFile(path, format string, write func(dumpWriter) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sum := sha256.New()
+	w, err := newDumpWriter(format, io.MultiWriter(f, sum))
+	if err != nil {
+		return err
+	}
+	if err := write(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.WriteFile(path+".sha256", []byte(hex.EncodeToString(sum.Sum(nil))+"  "+filepath.Base(path)+"\n"), 0o644)
+}
+
+// readDumpFile checks the dump at path against its checksum and hands it to read
+func readDumpFile(path, format string, read func(dumpReader) error) error {
+	checksum, err := os.ReadFile(path + ".sha256")
+	if err != nil {
+		return fmt.Errorf("no checksum for %s: %v", path, err)
+	}
+	want, _, _ := strings.Cut(strings.TrimSpace(string(checksum)), " ")
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return err
+	}
+	if hex.EncodeToString(sum.Sum(nil)) != want {
+		return fmt.Errorf("%s doesn't match its checksum, the file is damaged or incomplete", path)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	r, err := newDumpReader(format, f)
+	if err != nil {
+		return err
+	}
+	return read(r)
+}
+
+// ExportDump writes every account and ledger entry as of one snapshot
+func (s *PostgresStorage) ExportDump(ctx context.Context, w dumpWriter) (*DumpSummary, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	summary := &DumpSummary{}
+	rows, err := tx.QueryContext(ctx, "SELECT "+accountColumns+" FROM account ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		acc, err := scanIntoAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		if err := w.WriteAccount(acc); err != nil {
+			return nil, err
+		}
+		summary.Accounts++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = tx.QueryContext(ctx, `select e.id, e.kind, coalesce(e.reference::text, ''), coalesce(e.memo, ''), coalesce(e.category, ''), e.created_at,
+		coalesce(p.account_id, 0), coalesce(p.ledger_account, ''), p.currency, p.amount
+	from ledger_entry e join postings p on p.entry_id = e.id
+	order by e.id, p.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entry *LedgerEntry
+	for rows.Next() {
+		var e LedgerEntry
+		var p Posting
+		if err := rows.Scan(&e.ID, &e.Kind, &e.Reference, &e.Memo, &e.Category, &e.CreatedAt, &p.AccountID, &p.LedgerAccount, &p.Currency, &p.Amount); err != nil {
+			return nil, err
+		}
+		if entry != nil && entry.ID != e.ID {
+			if err := w.WriteEntry(entry); err != nil {
+				return nil, err
+			}
+			summary.Entries++
+			entry = nil
+		}
+		if entry == nil {
+			entry = &e
+		}
+		entry.Postings = append(entry.Postings, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		if err := w.WriteEntry(entry); err != nil {
+			return nil, err
+		}
+		summary.Entries++
+	}
+	return summary, nil
+}
+
+// ImportDump loads a dump into a database without accounts. Nothing is kept
+// when dryRun is set, anything fails or, with expect set, the dump held a
+// different number of accounts or entries.
+func (s *PostgresStorage) ImportDump(ctx context.Context, r dumpReader, dryRun bool, expect *DumpSummary) (*DumpSummary, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var existing int
+	if err := tx.QueryRowContext(ctx, "SELECT (SELECT count(*) FROM account) + (SELECT count(*) FROM ledger_entry)").Scan(&existing); err != nil {
+		return nil, err
+	}
+	if existing > 0 {
+		return nil, fmt.Errorf("the database already has accounts or ledger entries, import needs an empty one")
+	}
+
+	summary := &DumpSummary{}
+	imported := map[int]bool{}
+	// Survivors may come after the accounts merged into them
+	merges := map[int]int{}
+	for {
+		acc, entry, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if acc != nil {
+			_, err := tx.ExecContext(ctx, `insert into account
+			(id, first_name, last_name, account_number, encrypted_password, balance, currency, status, overdraft_limit,
+				closed_at, email, email_verified, last_activity_at, created_at, version, nickname, metadata)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, nullif($11, ''), $12, $13, $14, $15, $16, $17)`,
+				acc.ID, acc.FirstName, acc.LastName, acc.Number, acc.EncryptedPassword, acc.Balance, acc.Currency, acc.Status, acc.OverdraftLimit,
+				acc.ClosedAt, acc.Email, acc.EmailVerified, acc.LastActivityAt, acc.CreatedAt, acc.Version, acc.Nickname, acc.Metadata)
+			if err != nil {
+				return nil, fmt.Errorf("account %d: %v", acc.ID, err)
+			}
+			if acc.MergedInto != 0 {
+				merges[acc.ID] = acc.MergedInto
+			}
+			imported[acc.ID] = true
+			summary.Accounts++
+			continue
+		}
+
+		if err := entry.validate(); err != nil {
+			return nil, fmt.Errorf("entry %d: %v", entry.ID, err)
+		}
+		accountIDs := make([]int64, len(entry.Postings))
+		ledgerAccounts := make([]string, len(entry.Postings))
+		currencies := make([]string, len(entry.Postings))
+		amounts := make([]int64, len(entry.Postings))
+		for i, p := range entry.Postings {
+			if p.AccountID != 0 && !imported[p.AccountID] {
+				return nil, fmt.Errorf("entry %d posts to account %d, which isn't in the dump", entry.ID, p.AccountID)
+			}
+			accountIDs[i], ledgerAccounts[i], currencies[i], amounts[i] = int64(p.AccountID), p.LedgerAccount, p.Currency, p.Amount
+		}
+		_, err = tx.ExecContext(ctx, `with entry as (
+			insert into ledger_entry (id, kind, reference, memo, category, created_at)
+			values ($1, $2, nullif($3, '')::uuid, nullif($4, ''), nullif($5, ''), $6) returning id
+		)
+		insert into postings (entry_id, account_id, ledger_account, currency, amount)
+		select entry.id, nullif(p.account_id, 0), nullif(p.ledger_account, ''), p.currency, p.amount
+		from entry, unnest($7::int[], $8::text[], $9::text[], $10::bigint[]) as p(account_id, ledger_account, currency, amount)`,
+			entry.ID, entry.Kind, entry.Reference, entry.Memo, entry.Category, entry.CreatedAt,
+			pq.Array(accountIDs), pq.Array(ledgerAccounts), pq.Array(currencies), pq.Array(amounts))
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %v", entry.ID, err)
+		}
+		summary.Entries++
+	}
+
+	for id, into := range merges {
+		if _, err := tx.ExecContext(ctx, "UPDATE account SET merged_into = $1 WHERE id = $2", into, id); err != nil {
+			return nil, fmt.Errorf("account %d: %v", id, err)
+		}
+	}
+	// New rows continue after the imported ids
+	for _, table := range []string{"account", "ledger_entry"} {
+		if _, err := tx.ExecContext(ctx, "SELECT setval(pg_get_serial_sequence('"+table+"', 'id'), coalesce((SELECT max(id) FROM "+table+"), 0) + 1, false)"); err != nil {
+			return nil, err
+		}
+	}
+
+	if expect != nil && *expect != *summary {
+		return nil, fmt.Errorf("read %d accounts and %d entries, expected %d and %d", summary.Accounts, summary.Entries, expect.Accounts, expect.Entries)
+	}
+	if dryRun {
+		return summary, nil
+	}
+	return summary, tx.Commit()
+}
+
+func exportCommand(args []string) int {
+	cmd := flag.NewFlagSet("export", flag.ExitOnError)
+	format := cmd.String("format", DumpJSONL, "jsonl or csv")
+	out := cmd.String("o", "", "file to write, required")
+	cmd.Parse(args)
+
+	if *out == "" {
+		fmt.Fprintln(os.Stderr, "-o is required")
+		return 2
+	}
+
+	pg, err := NewPostgresStorage(LoadConfig())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open database: %v\n", err)
+		return 1
+	}
+
+	var summary *DumpSummary
+	err = writeDumpFile(*out, *format, func(w dumpWriter) error {
+		summary, err = pg.ExportDump(context.Background(), w)
+		return err
+	})
+	if err != nil {
+		os.Remove(*out)
+		fmt.Fprintf(os.Stderr, "Export failed: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Exported %d accounts and %d ledger entries to %s\n", summary.Accounts, summary.Entries, *out)
+	return 0
+}
+
+func importCommand(args []string) int {
+	cmd := flag.NewFlagSet("import", flag.ExitOnError)
+	format := cmd.String("format", "", "jsonl or csv, by default from the file's extension")
+	dryRun := cmd.Bool("dry-run", false, "check the file and load it without keeping anything")
+	cmd.Parse(args)
+
+	if cmd.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: gobank import [-format jsonl|csv] [-dry-run] <file>")
+		return 2
+	}
+	path := cmd.Arg(0)
+	if *format == "" {
+		*format = DumpJSONL
+		if strings.EqualFold(filepath.Ext(path), ".csv") {
+			*format = DumpCSV
+		}
+	}
+
+	pg, err := NewPostgresStorage(LoadConfig())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open database: %v\n", err)
+		return 1
+	}
+	if err := pg.VerifySchema(); err != nil {
+		fmt.Fprintf(os.Stderr, "Incompatible database schema, run gobank migrate first: %v\n", err)
+		return 1
+	}
+
+	var summary *DumpSummary
+	err = readDumpFile(path, *format, func(r dumpReader) error {
+		summary, err = pg.ImportDump(context.Background(), r, *dryRun, nil)
+		return err
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Import failed, nothing was changed: %v\n", err)
+		return 1
+	}
+
+	if *dryRun {
+		fmt.Printf("Dry run: %s would import %d accounts and %d ledger entries\n", path, summary.Accounts, summary.Entries)
+		return 0
+	}
+	fmt.Printf("Imported %d accounts and %d ledger entries from %s\n", summary.Accounts, summary.Entries, path)
+	return 0
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpRoundTrip(t *testing.T) {
+	created := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	closed := created.Add(48 * time.Hour)
+	accounts := []*Account{
+		{ID: 1, FirstName: "Ada", LastName: "Lovelace", Number: 4201, EncryptedPassword: "$2a$hash", Balance: 7500, Currency: "USD",
+			Status: AccountActive, OverdraftLimit: 1000, Email: "ada@example.com", EmailVerified: true, LastActivityAt: created, CreatedAt: created, Version: 3},
+		{ID: 2, FirstName: "Charles", LastName: "Babbage, Jr.", Number: 4202, Currency: "USD", Status: AccountClosed, MergedInto: 1,
+			ClosedAt: &closed, LastActivityAt: created, CreatedAt: created},
+	}
+	entries := []*LedgerEntry{
+		{ID: 10, Kind: "deposit", Memo: "opening \"cash\"", CreatedAt: created, Postings: []Posting{
+			{AccountID: 1, Currency: "USD", Amount: 10000},
+			{LedgerAccount: "assets:cash", Currency: "USD", Amount: -10000},
+		}},
+		{ID: 11, Kind: "transfer", Reference: "0b6f5a36-3f0e-4c52-9a57-1f2b3c4d5e6f", Category: "rent", CreatedAt: created, Postings: []Posting{
+			{AccountID: 1, Currency: "USD", Amount: -2500},
+			{AccountID: 2, Currency: "USD", Amount: 2500},
+		}},
+	}
+
+	for _, format := range []string{DumpJSONL, DumpCSV} {
+		t.Run(format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "dump."+format)
+			require.Nil(t, writeDumpFile(path, format, func(w dumpWriter) error {
+				for _, acc := range accounts {
+					if err := w.WriteAccount(acc); err != nil {
+						return err
+					}
+				}
+				for _, entry := range entries {
+					if err := w.WriteEntry(entry); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+
+			var gotAccounts []*Account
+			var gotEntries []*LedgerEntry
+			require.Nil(t, readDumpFile(path, format, func(r dumpReader) error {
+				for {
+					acc, entry, err := r.Next()
+					if errors.Is(err, io.EOF) {
+						return nil
+					}
+					if err != nil {
+						return err
+					}
+					if acc != nil {
+						gotAccounts = append(gotAccounts, acc)
+					} else {
+						gotEntries = append(gotEntries, entry)
+					}
+				}
+			}))
+			assert.Equal(t, accounts, gotAccounts)
+			assert.Equal(t, entries, gotEntries)
+
+			// A changed byte fails the checksum before anything is read
+			data, err := os.ReadFile(path)
+			require.Nil(t, err)
+			data[len(data)/2] ^= 1
+			require.Nil(t, os.WriteFile(path, data, 0o644))
+			read := false
+			err = readDumpFile(path, format, func(dumpReader) error {
+				read = true
+				return nil
+			})
+			assert.ErrorContains(t, err, "doesn't match its checksum")
+			assert.False(t, read)
+		})
+	}
+}
+
+func TestDumpCSVErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.csv")
+	require.Nil(t, os.WriteFile(path, []byte("account,1,4201,Ada\n"), 0o644))
+	err := readDumpFile(path, DumpCSV, func(r dumpReader) error { return nil })
+	assert.ErrorContains(t, err, "no checksum")
+
+	require.Nil(t, writeDumpFile(path, DumpCSV, func(w dumpWriter) error { return nil }))
+	require.Nil(t, os.WriteFile(path, []byte("posting,x\n"), 0o644))
+	r, err := newDumpReader(DumpCSV, mustOpen(t, path))
+	require.Nil(t, err)
+	_, _, err = r.Next()
+	assert.ErrorContains(t, err, `line 1: field 2: "x" is not a number`)
+}
+
+func mustOpen(t *testing.T, path string) *os.File {
+	f, err := os.Open(path)
+	require.Nil(t, err)
+	t.Cleanup(func() { f.Close() })
+	return f
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	email, err := normalizeEmail("  Grace@Example.COM ")
+	require.Nil(t, err)
+	assert.Equal(t, "grace@example.com", email)
+
+	for _, bad := range []string{"grace", "grace@", "Grace <grace@example.com>", "a@b@c"} {
+		_, err := normalizeEmail(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	accounts := NewAccountService(store)
+
+	acc, err := accounts.CreateAccount(ctx, &CreateAccountRequest{FirstName: "Grace", LastName: "Hopper", Password: "password", Email: "grace@example.com"}, "test")
+	require.Nil(t, err)
+	_, err = accounts.CreateAccount(ctx, &CreateAccountRequest{FirstName: "Grace", LastName: "Hopper", Password: "password", Email: "GRACE@example.com"}, "test")
+	assert.ErrorIs(t, err, ErrEmailTaken)
+
+	to := &Account{Number: 5002, Currency: "USD", Status: AccountActive}
+	require.Nil(t, store.CreateAccount(ctx, to))
+	require.Nil(t, store.PostLedgerEntry(ctx, fundingEntry(ctx, acc, 1000), nil))
+
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	transfer := func() error {
+		_, _, err := NewTransferService(store, TransferLimits{}, staticRateProvider{}, nil, nil).Transfer(ctx,
+			TransferRequest{FromAccountNumber: acc.Number, ToAccountNumber: to.Number, Amount: 1}, engine, "test")
+		return err
+	}
+	assert.ErrorIs(t, transfer(), ErrEmailNotVerified)
+
+	notifier := &capturingNotifier{}
+	verifications := NewEmailVerificationService(store, notifier, time.Hour)
+	require.Nil(t, verifications.Send(ctx, acc))
+	require.Len(t, notifier.messages, 1)
+	token := regexp.MustCompile(`token=([0-9a-f]{64})`).FindStringSubmatch(notifier.messages[0])[1]
+
+	_, err = verifications.Verify(ctx, "nope")
+	assert.ErrorIs(t, err, ErrInvalidVerificationToken)
+	verified, err := verifications.Verify(ctx, token)
+	require.Nil(t, err)
+	assert.True(t, verified.EmailVerified)
+	_, err = verifications.Verify(ctx, token)
+	assert.ErrorIs(t, err, ErrInvalidVerificationToken)
+
+	assert.Nil(t, transfer())
+}
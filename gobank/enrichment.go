@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Enrichers annotate transfers after they've committed, e.g. with a spending
+// category or an estimated carbon footprint. They run on the pipeline's
+// workers so a slow or failing enricher never holds up the transfer, and
+// each writes one row per transfer to transaction_enrichments. Enrichment is
+// best effort: when the queue is full the transfer goes unannotated.
+
+type Enricher interface {
+	Name() string
+	Enrich(ctx context.Context, input *EnrichmentInput) (any, error)
+}
+
+// EnrichmentInput is a committed transfer as enrichers see it
+type EnrichmentInput struct {
+	Receipt  *TransferReceipt
+	Category string // as given by the customer, may be empty
+}
+
+type TransferEnrichment struct {
+	Reference string          `json:"reference"`
+	Enricher  string          `json:"enricher"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+const enricherTimeout = 10 * time.Second
+
+type EnrichmentPipeline struct {
+	store     Storage
+	enrichers []Enricher
+	queue     chan *EnrichmentInput
+}
+
+// NewEnrichmentPipeline registers the enrichers named in ENRICHERS, nil when
+// there are none
+func NewEnrichmentPipeline(cfg *Config, store Storage) (*EnrichmentPipeline, error) {
+	p := &EnrichmentPipeline{store: store, queue: make(chan *EnrichmentInput, cfg.EnrichmentQueueSize)}
+
+	for _, name := range strings.Split(cfg.Enrichers, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "category":
+			p.Register(categoryEnricher{})
+		case "impact":
+			p.Register(impactEnricher{})
+		default:
+			return nil, fmt.Errorf("unknown enricher %q", name)
+		}
+	}
+
+	if len(p.enrichers) == 0 {
+		return nil, nil
+	}
+	return p, nil
+}
+
+func (p *EnrichmentPipeline) Register(e Enricher) {
+	p.enrichers = append(p.enrichers, e)
+}
+
+func (p *EnrichmentPipeline) Start(ctx context.Context, workers int) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case input := <-p.queue:
+					p.enrich(ctx, input)
+				}
+			}
+		}()
+	}
+}
+
+// Submit queues a committed transfer without waiting for the workers
+func (p *EnrichmentPipeline) Submit(input *EnrichmentInput) {
+	select {
+	case p.queue <- input:
+	default:
+		log.Printf("Enrichment queue full, skipping transfer %s", input.Receipt.Reference)
+	}
+}
+
+func (p *EnrichmentPipeline) enrich(ctx context.Context, input *EnrichmentInput) {
+	for _, e := range p.enrichers {
+		if err := p.runEnricher(ctx, e, input); err != nil {
+			log.Printf("Enricher %s failed for transfer %s: %v", e.Name(), input.Receipt.Reference, err)
+		}
+	}
+}
+
+func (p *EnrichmentPipeline) runEnricher(ctx context.Context, e Enricher, input *EnrichmentInput) error {
+	ctx, cancel := context.WithTimeout(ctx, enricherTimeout)
+	defer cancel()
+
+	result, err := e.Enrich(ctx, input)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	return p.store.RecordTransferEnrichment(ctx, &TransferEnrichment{
+		Reference: input.Receipt.Reference,
+		Enricher:  e.Name(),
+		Data:      data,
+		CreatedAt: time.Now().UTC(),
+	})
+}
+
+// Spending categories in match order, anything unrecognised is "other"
+var categoryKeywords = []struct {
+	category string
+	keywords []string
+}{
+	{"groceries", []string{"grocer", "supermarket", "food"}},
+	{"dining", []string{"restaurant", "cafe", "coffee", "dining", "takeaway"}},
+	{"travel", []string{"flight", "airline", "hotel", "travel", "taxi", "train"}},
+	{"fuel", []string{"fuel", "petrol", "gas station"}},
+	{"utilities", []string{"electric", "water", "utility", "utilities", "internet", "phone"}},
+	{"rent", []string{"rent", "mortgage"}},
+}
+
+type categoryEnricher struct{}
+
+func (categoryEnricher) Name() string { return "category" }
+
+func (categoryEnricher) Enrich(ctx context.Context, input *EnrichmentInput) (any, error) {
+	return map[string]string{"category": categorize(input.Category)}, nil
+}
+
+func categorize(label string) string {
+	label = strings.ToLower(label)
+	for _, c := range categoryKeywords {
+		if label == c.category {
+			return c.category
+		}
+		for _, keyword := range c.keywords {
+			if strings.Contains(label, keyword) {
+				return c.category
+			}
+		}
+	}
+	return "other"
+}
+
+// Rough kg CO2e per unit of spend by category, from spend-based emission factors
+var impactFactors = map[string]float64{
+	"groceries": 0.3,
+	"dining":    0.2,
+	"travel":    0.9,
+	"fuel":      2.1,
+	"utilities": 0.5,
+	"rent":      0.05,
+	"other":     0.1,
+}
+
+type impactEnricher struct{}
+
+func (impactEnricher) Name() string { return "impact" }
+
+func (impactEnricher) Enrich(ctx context.Context, input *EnrichmentInput) (any, error) {
+	category := categorize(input.Category)
+	factor := impactFactors[category]
+	return map[string]any{
+		"category": category,
+		"factor":   factor,
+		"co2e_kg":  math.Round(input.Receipt.Amount*factor*100) / 100,
+	}, nil
+}
+
+// GET /transfer/{reference}/enrichments
+func (s *APIServer) handleGetTransferEnrichments(w http.ResponseWriter, r *http.Request) error {
+	reference := mux.Vars(r)["reference"]
+	if !validReference.MatchString(reference) {
+		return newHTTPError(http.StatusBadRequest, "INVALID_REFERENCE", "transfer reference must be a UUID")
+	}
+
+	// Unknown transfers are a 404, not an empty list
+	store := s.forRequest(r).store
+	if _, err := store.GetTransferReceipt(r.Context(), reference); err != nil {
+		return err
+	}
+
+	enrichments, err := store.GetTransferEnrichments(r.Context(), reference)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, enrichments)
+}
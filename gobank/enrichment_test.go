@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type failingEnricher struct{}
+
+func (failingEnricher) Name() string { return "merchant" }
+
+func (failingEnricher) Enrich(ctx context.Context, input *EnrichmentInput) (any, error) {
+	return nil, errors.New("merchant lookup unavailable")
+}
+
+func TestCategorize(t *testing.T) {
+	assert.Equal(t, "travel", categorize("Travel"))
+	assert.Equal(t, "dining", categorize("Morning coffee"))
+	assert.Equal(t, "fuel", categorize("petrol"))
+	assert.Equal(t, "other", categorize(""))
+	assert.Equal(t, "other", categorize("birthday present"))
+}
+
+func TestEnrichmentPipeline(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 6101, Balance: 10000, Currency: "USD"}))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 6102, Currency: "USD"}))
+
+	_, err := NewEnrichmentPipeline(&Config{Enrichers: "category,horoscope"}, store)
+	assert.Error(t, err)
+
+	pipeline, err := NewEnrichmentPipeline(&Config{Enrichers: "category, impact", EnrichmentQueueSize: 10}, store)
+	require.Nil(t, err)
+	pipeline.Register(failingEnricher{})
+
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	receipt, _, err := NewTransferService(store, TransferLimits{}, staticRateProvider{}, nil, pipeline).
+		Transfer(ctx, TransferRequest{FromAccountNumber: 6101, ToAccountNumber: 6102, Amount: 40, Category: "flights"}, engine, "test")
+	require.Nil(t, err)
+
+	// Nothing ran yet, the transfer only queued its enrichment
+	enrichments, _ := store.GetTransferEnrichments(ctx, receipt.Reference)
+	assert.Empty(t, enrichments)
+	require.Len(t, pipeline.queue, 1)
+	pipeline.enrich(ctx, <-pipeline.queue)
+
+	s := NewAPIServer(&Config{}, store)
+	r := httptest.NewRequest("GET", "/v1/transfer/"+receipt.Reference+"/enrichments", nil)
+	r = mux.SetURLVars(r, map[string]string{"reference": receipt.Reference})
+	w := httptest.NewRecorder()
+	makeHTTPHandle(s.handleGetTransferEnrichments)(w, r)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// The failing enricher leaves no row and doesn't stop the others
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &enrichments))
+	require.Len(t, enrichments, 2)
+	assert.Equal(t, "category", enrichments[0].Enricher)
+	assert.JSONEq(t, `{"category":"travel"}`, string(enrichments[0].Data))
+	assert.Equal(t, "impact", enrichments[1].Enricher)
+	assert.JSONEq(t, `{"category":"travel","factor":0.9,"co2e_kg":36}`, string(enrichments[1].Data))
+}
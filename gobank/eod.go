@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// End of day runs the bank's daily processing for a business day (a UTC
+// date) as a pipeline of steps. A step runs once the steps it depends on
+// have completed or been skipped, and every step is checkpointed as it
+// finishes. A failed run is resumed from /admin/eod/{day}/run, completed
+// steps aren't repeated and the failed ones are retried. A step that can't
+// succeed can be skipped by an admin to let the rest of the run through.
+//
+// With EODEnabled the scheduler starts yesterday's run once, failed runs
+// wait for an admin to resume them. A run left running by an instance that
+// died is taken over once it's been idle for eodLease.
+
+const (
+	EODPending   = "pending"
+	EODRunning   = "running"
+	EODCompleted = "completed"
+	EODFailed    = "failed"
+	EODSkipped   = "skipped"
+
+	eodLease = time.Hour
+)
+
+type EODRun struct {
+	Day        time.Time  `json:"day"`
+	Status     string     `json:"status"`
+	CutOff     time.Time  `json:"cut_off"`
+	Steps      []*EODStep `json:"steps"`
+	StartedAt  time.Time  `json:"started_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+type EODStep struct {
+	Name       string     `json:"name"`
+	DependsOn  []string   `json:"depends_on"`
+	Status     string     `json:"status"`
+	Attempts   int        `json:"attempts"`
+	Detail     string     `json:"detail,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+func (st *EODStep) done() bool {
+	return st.Status == EODCompleted || st.Status == EODSkipped
+}
+
+type SkipEODStepRequest struct {
+	Reason string `json:"reason" validate:"required,max=500"`
+}
+
+// eodStepFunc runs a step for the run's day, returning a line for the run's record
+type eodStepFunc func(p *eodPipeline, ctx context.Context, run *EODRun) (string, error)
+
+// errEODStepSkipped marks a step with nothing to do in this deployment
+var errEODStepSkipped = errors.New("skipped")
+
+var eodSteps = []struct {
+	name      string
+	dependsOn []string
+	run       eodStepFunc
+}{
+	{"cut_off", nil, (*eodPipeline).cutOff},
+	{"settle_pending", []string{"cut_off"}, (*eodPipeline).settlePending},
+	{"accrue_interest", []string{"settle_pending"}, (*eodPipeline).accrueInterest},
+	{"snapshot_balances", []string{"accrue_interest"}, (*eodPipeline).snapshotBalances},
+	{"generate_reports", []string{"snapshot_balances"}, (*eodPipeline).generateReports},
+	{"reconcile", []string{"snapshot_balances"}, (*eodPipeline).reconcile},
+}
+
+// ledgerReconciler is implemented by storage that keeps the ledger itself
+type ledgerReconciler interface {
+	ReconcileLedger(ctx context.Context) (*LedgerReport, error)
+}
+
+type eodPipeline struct {
+	api    *APIServer
+	engine TransferEngine
+	now    func() time.Time
+}
+
+func (s *APIServer) eod(engine TransferEngine) *eodPipeline {
+	return &eodPipeline{api: s, engine: engine, now: func() time.Time { return time.Now().UTC() }}
+}
+
+// withSteps fills in the steps that haven't been checkpointed yet, in pipeline order
+func withSteps(run *EODRun) *EODRun {
+	saved := map[string]*EODStep{}
+	for _, st := range run.Steps {
+		saved[st.Name] = st
+	}
+	run.Steps = make([]*EODStep, 0, len(eodSteps))
+	for _, def := range eodSteps {
+		st, ok := saved[def.name]
+		if !ok {
+			st = &EODStep{Name: def.name, Status: EODPending}
+		}
+		st.DependsOn = append([]string{}, def.dependsOn...)
+		run.Steps = append(run.Steps, st)
+	}
+	return run
+}
+
+// start claims the day's run, refusing days that haven't ended
+func (p *eodPipeline) start(ctx context.Context, day time.Time) (*EODRun, error) {
+	day = startOfDay(day)
+	now := p.now()
+	cutOff := day.AddDate(0, 0, 1)
+	if now.Before(cutOff) {
+		return nil, fmt.Errorf("%w: %s closes at %s", ErrEODNotClosed, day.Format(time.DateOnly), cutOff.Format(time.RFC3339))
+	}
+
+	run, err := p.api.store.ClaimEODRun(ctx, day, cutOff, now, now.Add(-eodLease))
+	if err != nil {
+		return nil, err
+	}
+	return withSteps(run), nil
+}
+
+// execute runs every step whose dependencies are done, checkpointing each
+func (p *eodPipeline) execute(ctx context.Context, run *EODRun) error {
+	steps := map[string]*EODStep{}
+	for _, st := range run.Steps {
+		steps[st.Name] = st
+	}
+
+	for _, def := range eodSteps {
+		st := steps[def.name]
+		if st.done() {
+			continue
+		}
+		ready := true
+		for _, dep := range def.dependsOn {
+			ready = ready && steps[dep].done()
+		}
+		if !ready {
+			continue
+		}
+
+		started := p.now()
+		st.Status, st.Error, st.StartedAt, st.FinishedAt = EODRunning, "", &started, nil
+		st.Attempts++
+		if err := p.api.store.SaveEODStep(ctx, run.Day, st); err != nil {
+			return err
+		}
+
+		detail, err := def.run(p, ctx, run)
+		finished := p.now()
+		st.Detail, st.FinishedAt = detail, &finished
+		switch {
+		case errors.Is(err, errEODStepSkipped):
+			st.Status = EODSkipped
+		case err != nil:
+			st.Status, st.Error = EODFailed, err.Error()
+			log.Printf("End of day step %s for %s failed: %v", st.Name, run.Day.Format(time.DateOnly), err)
+		default:
+			st.Status = EODCompleted
+		}
+		if err := p.api.store.SaveEODStep(ctx, run.Day, st); err != nil {
+			return err
+		}
+	}
+
+	run.Status = EODCompleted
+	for _, st := range run.Steps {
+		if !st.done() {
+			run.Status = EODFailed
+		}
+	}
+	finished := p.now()
+	run.FinishedAt = &finished
+	return p.api.store.FinishEODRun(ctx, run.Day, run.Status, finished)
+}
+
+func (p *eodPipeline) run(ctx context.Context, day time.Time) (*EODRun, error) {
+	run, err := p.start(ctx, day)
+	if err != nil {
+		return nil, err
+	}
+	return run, p.execute(ctx, run)
+}
+
+// cutOff fixes the day's postings, everything later belongs to the next day
+func (p *eodPipeline) cutOff(ctx context.Context, run *EODRun) (string, error) {
+	return "postings until " + run.CutOff.Format(time.RFC3339), nil
+}
+
+// settlePending runs the scheduled transfers and sweeps that are due
+func (p *eodPipeline) settlePending(ctx context.Context, run *EODRun) (string, error) {
+	if err := p.api.scheduledTransferJob(p.engine).Run(ctx); err != nil {
+		return "", fmt.Errorf("scheduled transfers: %w", err)
+	}
+	if err := p.api.sweepJob(p.engine).Run(ctx); err != nil {
+		return "", fmt.Errorf("sweeps: %w", err)
+	}
+	return "", nil
+}
+
+// accrueInterest charges the day's overdraft interest, at most once per account
+func (p *eodPipeline) accrueInterest(ctx context.Context, run *EODRun) (string, error) {
+	return "", p.api.overdrafts().AccrueFees(ctx, run.Day)
+}
+
+// snapshotBalances records the day's closing liabilities from the ledger
+func (p *eodPipeline) snapshotBalances(ctx context.Context, run *EODRun) (string, error) {
+	closing, err := p.api.store.GetClosingBalances(ctx, run.CutOff)
+	if err != nil {
+		return "", err
+	}
+	accounts := make([]*Account, 0, len(closing))
+	for _, b := range closing {
+		accounts = append(accounts, &Account{Currency: b.Currency, Balance: b.Balance})
+	}
+
+	now := p.now()
+	totals := balanceTotals(accounts)
+	for _, t := range totals {
+		snap := &LiabilitySnapshot{Day: run.Day, Currency: t.Currency, Deposits: t.Deposits, Overdrafts: t.Overdrafts, TakenAt: now}
+		if err := p.api.store.RecordLiabilitySnapshot(ctx, snap); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%d accounts in %d currencies", len(closing), len(totals)), nil
+}
+
+// generateReports delivers the day's back-office files
+func (p *eodPipeline) generateReports(ctx context.Context, run *EODRun) (string, error) {
+	if p.api.config.ExportSFTPAddr == "" {
+		return "no export destination configured", errEODStepSkipped
+	}
+	exporter, err := p.api.sftpExporter()
+	if err != nil {
+		return "", err
+	}
+	return "", exporter.exportDay(ctx, run.Day, nil)
+}
+
+func (p *eodPipeline) reconcile(ctx context.Context, run *EODRun) (string, error) {
+	reconciler, ok := storageAs[ledgerReconciler](p.api.store)
+	if !ok {
+		return "the " + p.api.config.StorageBackend + " storage backend keeps no ledger here", errEODStepSkipped
+	}
+	report, err := reconciler.ReconcileLedger(ctx)
+	if err != nil {
+		return "", err
+	}
+	detail := fmt.Sprintf("%d entries and %d accounts checked", report.Entries, report.Accounts)
+	if len(report.Discrepancies) > 0 {
+		return detail, fmt.Errorf("%d discrepancies, run `gobank reconcile` for details", len(report.Discrepancies))
+	}
+	return detail, nil
+}
+
+// eodJob starts yesterday's run, or takes over one an instance left running
+func (s *APIServer) eodJob(engine TransferEngine) Job {
+	p := s.eod(engine)
+	return Job{
+		Name:     "end-of-day",
+		Interval: s.config.SchedulerInterval,
+		Run: func(ctx context.Context) error {
+			day := startOfDay(p.now()).AddDate(0, 0, -1)
+			run, err := s.store.GetEODRun(ctx, day)
+			if err == nil && run.Status != EODRunning {
+				return nil
+			}
+			if err != nil && !errors.Is(err, ErrEODRunNotFound) {
+				return err
+			}
+			if _, err := p.run(ctx, day); err != nil && !errors.Is(err, ErrEODRunning) {
+				return err
+			}
+			return nil
+		},
+	}
+}
+
+func eodDay(r *http.Request) (time.Time, error) {
+	day, err := time.Parse(time.DateOnly, mux.Vars(r)["day"])
+	if err != nil {
+		return time.Time{}, invalidParam("path", "day", "type", "must be a date like 2006-01-02")
+	}
+	return day, nil
+}
+
+// GET /admin/eod, the last 30 runs
+func (s *APIServer) handleGetEODRuns(w http.ResponseWriter, r *http.Request) error {
+	runs, err := s.forRequest(r).store.GetEODRuns(r.Context(), 30)
+	if err != nil {
+		return err
+	}
+	for _, run := range runs {
+		withSteps(run)
+	}
+	return WriteJSON(w, http.StatusOK, runs)
+}
+
+// GET /admin/eod/{day}
+func (s *APIServer) handleGetEODRun(w http.ResponseWriter, r *http.Request) error {
+	day, err := eodDay(r)
+	if err != nil {
+		return err
+	}
+	run, err := s.forRequest(r).store.GetEODRun(r.Context(), day)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, withSteps(run))
+}
+
+// POST /admin/eod/{day}/run starts or resumes the day's run in the background
+func (s *APIServer) handleRunEOD(engine TransferEngine) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		day, err := eodDay(r)
+		if err != nil {
+			return err
+		}
+		p := s.eod(engine)
+		run, err := p.start(r.Context(), day)
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			if err := p.execute(context.Background(), run); err != nil {
+				log.Printf("End of day run for %s failed: %v", run.Day.Format(time.DateOnly), err)
+			}
+		}()
+		return WriteJSON(w, http.StatusAccepted, run)
+	}
+}
+
+// POST /admin/eod/{day}/steps/{step}/skip lets a stopped run continue past a step
+func (s *APIServer) handleSkipEODStep(w http.ResponseWriter, r *http.Request) error {
+	day, err := eodDay(r)
+	if err != nil {
+		return err
+	}
+	var req SkipEODStepRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+
+	s = s.forRequest(r)
+	run, err := s.store.GetEODRun(r.Context(), day)
+	if err != nil {
+		return err
+	}
+	if run.Status == EODRunning {
+		return fmt.Errorf("%w: %s", ErrEODRunning, day.Format(time.DateOnly))
+	}
+
+	name := mux.Vars(r)["step"]
+	for _, st := range withSteps(run).Steps {
+		if st.Name != name {
+			continue
+		}
+		if st.done() {
+			return newHTTPError(http.StatusConflict, "EOD_STEP_DONE", "step %s is already %s", name, st.Status)
+		}
+		st.Status, st.Error = EODSkipped, ""
+		st.Detail = fmt.Sprintf("skipped by %s: %s", auditActor(r, s.config), strings.TrimSpace(req.Reason))
+		if err := s.store.SaveEODStep(r.Context(), run.Day, st); err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, run)
+	}
+	return invalidParam("path", "step", "unknown", "not an end of day step")
+}
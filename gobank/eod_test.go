@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// eodStore fails the steps a test chooses
+type eodStore struct {
+	*memoryStorage
+	closingErr    error
+	discrepancies int
+}
+
+func (s *eodStore) GetClosingBalances(ctx context.Context, at time.Time) ([]*ClosingBalance, error) {
+	if s.closingErr != nil {
+		return nil, s.closingErr
+	}
+	return s.memoryStorage.GetClosingBalances(ctx, at)
+}
+
+func (s *eodStore) ReconcileLedger(ctx context.Context) (*LedgerReport, error) {
+	report := &LedgerReport{Discrepancies: []*LedgerDiscrepancy{}}
+	for range s.discrepancies {
+		report.Discrepancies = append(report.Discrepancies, &LedgerDiscrepancy{Type: DiscrepancyBalanceMismatch})
+	}
+	return report, nil
+}
+
+func eodStatuses(run *EODRun) map[string]string {
+	statuses := map[string]string{}
+	for _, st := range run.Steps {
+		statuses[st.Name] = st.Status
+	}
+	return statuses
+}
+
+func TestEODPipeline(t *testing.T) {
+	ctx := context.Background()
+	store := &eodStore{memoryStorage: newMemoryStorage(), closingErr: fmt.Errorf("replica lagging")}
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9401, Balance: 10000, Currency: "USD"}))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9402, Balance: -2000, Currency: "USD"}))
+
+	s := NewAPIServer(&Config{AdminToken: "admin", StorageBackend: "test"}, store)
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	p := s.eod(engine)
+	day := time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return day.Add(25 * time.Hour) }
+
+	_, err = p.run(ctx, day.AddDate(0, 0, 1))
+	assert.ErrorIs(t, err, ErrEODNotClosed)
+
+	// A failed step leaves the steps depending on it pending
+	run, err := p.run(ctx, day)
+	require.Nil(t, err)
+	assert.Equal(t, EODFailed, run.Status)
+	assert.Equal(t, map[string]string{
+		"cut_off":           EODCompleted,
+		"settle_pending":    EODCompleted,
+		"accrue_interest":   EODCompleted,
+		"snapshot_balances": EODFailed,
+		"generate_reports":  EODPending,
+		"reconcile":         EODPending,
+	}, eodStatuses(run))
+
+	// Resuming retries from the failed step
+	store.closingErr = nil
+	store.discrepancies = 2
+	run, err = p.run(ctx, day)
+	require.Nil(t, err)
+	statuses := eodStatuses(run)
+	assert.Equal(t, EODCompleted, statuses["snapshot_balances"])
+	assert.Equal(t, EODSkipped, statuses["generate_reports"], "no export destination")
+	assert.Equal(t, EODFailed, statuses["reconcile"])
+	assert.Equal(t, 1, run.Steps[0].Attempts, "completed steps aren't repeated")
+	assert.Equal(t, 2, run.Steps[3].Attempts)
+	require.Len(t, store.snapshots, 1)
+	assert.Equal(t, int64(10000), store.snapshots[0].Deposits)
+	assert.Equal(t, int64(2000), store.snapshots[0].Overdrafts)
+
+	// An admin skips the step and resumes
+	router := s.routes(engine)
+	post := func(path string, body any) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req := httptest.NewRequest("POST", "/v1/admin/eod/2026-02-01"+path, bytes.NewReader(data))
+		req.Header.Set("x-admin-token", "admin")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	rr := post("/steps/reconcile/skip", SkipEODStepRequest{Reason: "known mismatch, ticket 4411"})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, http.StatusConflict, post("/steps/cut_off/skip", SkipEODStepRequest{Reason: "x"}).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, post("/steps/coffee/skip", SkipEODStepRequest{Reason: "x"}).Code)
+
+	run, err = p.run(ctx, day)
+	require.Nil(t, err)
+	assert.Equal(t, EODCompleted, run.Status)
+	assert.Contains(t, run.Steps[5].Detail, "ticket 4411")
+
+	_, err = p.run(ctx, day)
+	assert.ErrorIs(t, err, ErrEODCompleted)
+
+	req := httptest.NewRequest("GET", "/v1/admin/eod/2026-02-01", nil)
+	req.Header.Set("x-admin-token", "admin")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	got := &EODRun{}
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), got))
+	assert.Equal(t, EODCompleted, got.Status)
+	assert.Equal(t, []string{"snapshot_balances"}, got.Steps[4].DependsOn)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Domain errors returned by storage backends and transfer engines. Wrap them
+// with context using %w, handlers map them to status codes via errors.Is.
+var (
+	ErrAccountNotFound       = errors.New("account not found")
+	ErrTransferNotFound      = errors.New("transfer not found")
+	ErrTransferUnconfirmed   = errors.New("transfer outcome unknown")
+	ErrTransferResolved      = errors.New("transfer is no longer pending approval")
+	ErrTransferJobNotFound   = errors.New("queued transfer not found")
+	ErrTransferBlocked       = errors.New("transfer was blocked by fraud screening")
+	ErrConflict              = errors.New("account was modified concurrently, retry with fresh data")
+	ErrSerializationFailure  = errors.New("transfer conflicted with concurrent transfers, retry")
+	ErrMandateNotFound       = errors.New("mandate not found")
+	ErrMandateInactive       = errors.New("mandate is not active")
+	ErrMandateLimitExceeded  = errors.New("collection exceeds the mandate's limit")
+	ErrBeneficiaryNotFound   = errors.New("beneficiary not found")
+	ErrBeneficiaryInUse      = errors.New("beneficiary is paid by a standing order")
+	ErrStandingOrderNotFound = errors.New("standing order not found")
+	ErrStandingOrderInactive = errors.New("standing order can't be changed in its current status")
+	ErrInsufficientFunds     = errors.New("insufficient balance")
+	ErrUpstreamUnavailable   = errors.New("upstream system unavailable")
+	ErrNoFXRate              = errors.New("no exchange rate available")
+	ErrAccountClosed         = errors.New("account is closed")
+	ErrBalanceNotZero        = errors.New("account balance must be zero")
+	ErrAccountFrozen         = errors.New("account is frozen")
+	ErrAccountDormant        = errors.New("account is dormant, reactivate it to send money")
+	ErrInvalidResetToken     = errors.New("password reset token is invalid or expired")
+	ErrEmailTaken            = errors.New("email address is already in use")
+	ErrEmailNotVerified      = errors.New("email address is not verified")
+	ErrLegalHold             = errors.New("account is under legal hold")
+	ErrLegalHoldNotFound     = errors.New("active legal hold not found")
+	ErrAPIKeyNotFound        = errors.New("API key not found")
+	ErrHoldNotFound          = errors.New("hold not found")
+	ErrHoldResolved          = errors.New("hold is no longer active")
+	ErrChequeNotFound        = errors.New("cheque not found")
+	ErrChequeResolved        = errors.New("cheque has already cleared or bounced")
+	ErrCardNotFound          = errors.New("card not found")
+	ErrCardInactive          = errors.New("card can't be used")
+	ErrCardLimitExceeded     = errors.New("card spending limit exceeded")
+	ErrFeeScheduleNotFound   = errors.New("fee schedule not found")
+	ErrPINNotSet             = errors.New("a transaction PIN must be set up for this amount")
+	ErrPINRequired           = errors.New("a transaction PIN is required for this amount")
+	ErrInvalidPIN            = errors.New("transaction PIN is incorrect")
+	ErrPINLocked             = errors.New("transaction PIN is locked after too many failed attempts")
+	ErrIdentityNotLinked     = errors.New("external identity isn't linked to an account")
+	ErrExportNotFound        = errors.New("export delivery not found")
+	ErrOperationNotFound     = errors.New("pending operation not found")
+	ErrOperationNotPending   = errors.New("operation is no longer pending")
+	ErrAlreadyApproved       = errors.New("operation is already approved by this approver")
+	ErrEODRunNotFound        = errors.New("end of day run not found")
+	ErrEODRunning            = errors.New("end of day run is already in progress")
+	ErrEODCompleted          = errors.New("end of day run already completed")
+	ErrEODNotClosed          = errors.New("business day hasn't ended")
+	ErrKYCPending            = errors.New("KYC submission is already waiting for review")
+	ErrKYCVerified           = errors.New("KYC is already verified")
+	ErrKYCNotFound           = errors.New("pending KYC submission not found")
+	ErrKYCDocumentInUse      = errors.New("document already verifies another account")
+	ErrErasureNotFound       = errors.New("no erasure was requested for the account")
+	ErrAliasNotFound         = errors.New("alias not found")
+	ErrAliasTaken            = errors.New("alias is verified by another account")
+	ErrAliasVerified         = errors.New("alias is already verified")
+	ErrInvalidAliasCode      = errors.New("alias code is invalid or expired")
+	ErrSplitNotFound         = errors.New("split bill not found")
+	ErrSplitResolved         = errors.New("split bill is already completed or cancelled")
+	ErrSplitShareNotFound    = errors.New("split share not found")
+	ErrSplitShareResolved    = errors.New("split share has already been paid, declined or cancelled")
+	ErrDisputeNotFound       = errors.New("dispute not found")
+	ErrDisputeExists         = errors.New("transfer is already disputed")
+	ErrDisputeResolved       = errors.New("dispute is already resolved")
+	ErrDisputeWindowClosed   = errors.New("transfer is too old to dispute")
+
+	ErrInvalidVerificationToken = errors.New("verification token is invalid or expired")
+
+	ErrInvalidConsistencyToken = errors.New("invalid consistency token")
+	ErrConsistencyTimeout      = errors.New("timed out waiting for consistency token")
+)
+
+var domainErrors = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{ErrAccountNotFound, http.StatusNotFound, "ACCOUNT_NOT_FOUND"},
+	{ErrTransferNotFound, http.StatusNotFound, "TRANSFER_NOT_FOUND"},
+	{ErrTransferUnconfirmed, http.StatusServiceUnavailable, "TRANSFER_UNCONFIRMED"},
+	{ErrTransferResolved, http.StatusConflict, "TRANSFER_RESOLVED"},
+	{ErrTransferJobNotFound, http.StatusNotFound, "TRANSFER_JOB_NOT_FOUND"},
+	{ErrTransferBlocked, http.StatusForbidden, "TRANSFER_BLOCKED"},
+	{ErrConflict, http.StatusConflict, "CONFLICT"},
+	{ErrSerializationFailure, http.StatusConflict, "SERIALIZATION_FAILURE"},
+	{ErrMandateNotFound, http.StatusNotFound, "MANDATE_NOT_FOUND"},
+	{ErrMandateInactive, http.StatusConflict, "MANDATE_INACTIVE"},
+	{ErrMandateLimitExceeded, http.StatusUnprocessableEntity, "MANDATE_LIMIT_EXCEEDED"},
+	{ErrBeneficiaryNotFound, http.StatusNotFound, "BENEFICIARY_NOT_FOUND"},
+	{ErrBeneficiaryInUse, http.StatusConflict, "BENEFICIARY_IN_USE"},
+	{ErrStandingOrderNotFound, http.StatusNotFound, "STANDING_ORDER_NOT_FOUND"},
+	{ErrStandingOrderInactive, http.StatusConflict, "STANDING_ORDER_INACTIVE"},
+	{ErrInsufficientFunds, http.StatusBadRequest, "INSUFFICIENT_FUNDS"},
+	{ErrUpstreamUnavailable, http.StatusServiceUnavailable, "UPSTREAM_UNAVAILABLE"},
+	{ErrNoFXRate, http.StatusBadRequest, "FX_RATE_UNAVAILABLE"},
+	{ErrAccountClosed, http.StatusConflict, "ACCOUNT_CLOSED"},
+	{ErrBalanceNotZero, http.StatusConflict, "BALANCE_NOT_ZERO"},
+	{ErrAccountFrozen, http.StatusForbidden, "ACCOUNT_FROZEN"},
+	{ErrAccountDormant, http.StatusForbidden, "ACCOUNT_DORMANT"},
+	{ErrInvalidResetToken, http.StatusBadRequest, "INVALID_RESET_TOKEN"},
+	{ErrEmailTaken, http.StatusConflict, "EMAIL_TAKEN"},
+	{ErrEmailNotVerified, http.StatusForbidden, "EMAIL_NOT_VERIFIED"},
+	{ErrLegalHold, http.StatusConflict, "LEGAL_HOLD"},
+	{ErrLegalHoldNotFound, http.StatusNotFound, "LEGAL_HOLD_NOT_FOUND"},
+	{ErrAPIKeyNotFound, http.StatusNotFound, "API_KEY_NOT_FOUND"},
+	{ErrHoldNotFound, http.StatusNotFound, "HOLD_NOT_FOUND"},
+	{ErrHoldResolved, http.StatusConflict, "HOLD_RESOLVED"},
+	{ErrChequeNotFound, http.StatusNotFound, "CHEQUE_NOT_FOUND"},
+	{ErrChequeResolved, http.StatusConflict, "CHEQUE_RESOLVED"},
+	{ErrCardNotFound, http.StatusNotFound, "CARD_NOT_FOUND"},
+	{ErrCardInactive, http.StatusForbidden, "CARD_INACTIVE"},
+	{ErrCardLimitExceeded, http.StatusUnprocessableEntity, "CARD_LIMIT_EXCEEDED"},
+	{ErrFeeScheduleNotFound, http.StatusNotFound, "FEE_SCHEDULE_NOT_FOUND"},
+	{ErrPINNotSet, http.StatusForbidden, "PIN_NOT_SET"},
+	{ErrPINRequired, http.StatusForbidden, "PIN_REQUIRED"},
+	{ErrInvalidPIN, http.StatusForbidden, "INVALID_PIN"},
+	{ErrPINLocked, http.StatusLocked, "PIN_LOCKED"},
+	{ErrIdentityNotLinked, http.StatusForbidden, "IDENTITY_NOT_LINKED"},
+	{ErrLoginFailed, http.StatusUnauthorized, "LOGIN_FAILED"},
+	{ErrAccountLocked, http.StatusLocked, "ACCOUNT_LOCKED"},
+	{ErrExportNotFound, http.StatusNotFound, "EXPORT_NOT_FOUND"},
+	{ErrOperationNotFound, http.StatusNotFound, "OPERATION_NOT_FOUND"},
+	{ErrOperationNotPending, http.StatusConflict, "OPERATION_NOT_PENDING"},
+	{ErrAlreadyApproved, http.StatusConflict, "ALREADY_APPROVED"},
+	{ErrEODRunNotFound, http.StatusNotFound, "EOD_RUN_NOT_FOUND"},
+	{ErrEODRunning, http.StatusConflict, "EOD_RUNNING"},
+	{ErrEODCompleted, http.StatusConflict, "EOD_COMPLETED"},
+	{ErrEODNotClosed, http.StatusConflict, "EOD_DAY_NOT_CLOSED"},
+	{ErrKYCPending, http.StatusConflict, "KYC_PENDING"},
+	{ErrKYCVerified, http.StatusConflict, "KYC_VERIFIED"},
+	{ErrKYCNotFound, http.StatusNotFound, "KYC_NOT_FOUND"},
+	{ErrKYCDocumentInUse, http.StatusConflict, "KYC_DOCUMENT_IN_USE"},
+	{ErrErasureNotFound, http.StatusNotFound, "ERASURE_NOT_FOUND"},
+	{ErrAliasNotFound, http.StatusNotFound, "ALIAS_NOT_FOUND"},
+	{ErrAliasTaken, http.StatusConflict, "ALIAS_TAKEN"},
+	{ErrAliasVerified, http.StatusConflict, "ALIAS_VERIFIED"},
+	{ErrInvalidAliasCode, http.StatusBadRequest, "INVALID_ALIAS_CODE"},
+	{ErrSplitNotFound, http.StatusNotFound, "SPLIT_NOT_FOUND"},
+	{ErrSplitResolved, http.StatusConflict, "SPLIT_RESOLVED"},
+	{ErrSplitShareNotFound, http.StatusNotFound, "SPLIT_SHARE_NOT_FOUND"},
+	{ErrSplitShareResolved, http.StatusConflict, "SPLIT_SHARE_RESOLVED"},
+	{ErrDisputeNotFound, http.StatusNotFound, "DISPUTE_NOT_FOUND"},
+	{ErrDisputeExists, http.StatusConflict, "DISPUTE_EXISTS"},
+	{ErrDisputeResolved, http.StatusConflict, "DISPUTE_RESOLVED"},
+	{ErrDisputeWindowClosed, http.StatusUnprocessableEntity, "DISPUTE_WINDOW_CLOSED"},
+	{ErrInvalidVerificationToken, http.StatusBadRequest, "INVALID_VERIFICATION_TOKEN"},
+	{ErrInvalidConsistencyToken, http.StatusBadRequest, "INVALID_CONSISTENCY_TOKEN"},
+	{ErrConsistencyTimeout, http.StatusServiceUnavailable, "CONSISTENCY_TIMEOUT"},
+}
+
+func apiErrorFor(err error) (int, ApiError) {
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		return http.StatusUnprocessableEntity, ApiError{Error: verr.Error(), Code: "VALIDATION_FAILED", Fields: verr.Fields}
+	}
+
+	var lerr *LoginFailedError
+	if errors.As(err, &lerr) {
+		status, apiErr := apiErrorFor(lerr.Unwrap())
+		apiErr.Error, apiErr.RemainingAttempts, apiErr.LockedUntil = lerr.Error(), lerr.Remaining, lerr.LockedUntil
+		return status, apiErr
+	}
+
+	var herr *httpError
+	if errors.As(err, &herr) {
+		return herr.Status, ApiError{Error: herr.Msg, Code: herr.Code}
+	}
+
+	for _, d := range domainErrors {
+		if errors.Is(err, d.err) {
+			return d.status, ApiError{Error: err.Error(), Code: d.code}
+		}
+	}
+
+	return http.StatusBadRequest, ApiError{Error: err.Error()}
+}
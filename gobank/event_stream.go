@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Clients that can't keep a connection open read the outbox by long-polling:
+// the request returns as soon as there are events after the cursor, or empty
+// once the wait runs out. Events published by this instance wake waiters
+// straight away, waiters also re-read the outbox every eventRecheckInterval
+// to pick up events written by other instances.
+//
+// Browsers and other clients that can keep it open follow the same outbox
+// as Server-Sent Events on /account/{id}/events. Every event is sent with
+// its ID, so a reconnecting EventSource resumes after Last-Event-ID. Credits
+// caused by a transfer are sent as transfer_received, other balance changes
+// as balance_changed.
+
+const (
+	eventRecheckInterval = time.Second
+	eventPollLimit       = 100
+)
+
+type eventHub struct {
+	mu      sync.Mutex
+	waiters map[int]map[chan struct{}]struct{}
+}
+
+var accountEvents = &eventHub{waiters: map[int]map[chan struct{}]struct{}{}}
+
+// wait returns a channel closed on the next event for the account, and a
+// func releasing it
+func (h *eventHub) wait(accountID int) (<-chan struct{}, func()) {
+	ch := make(chan struct{})
+
+	h.mu.Lock()
+	if h.waiters[accountID] == nil {
+		h.waiters[accountID] = map[chan struct{}]struct{}{}
+	}
+	h.waiters[accountID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.waiters[accountID][ch]; ok {
+			delete(h.waiters[accountID], ch)
+			if len(h.waiters[accountID]) == 0 {
+				delete(h.waiters, accountID)
+			}
+		}
+	}
+}
+
+func (h *eventHub) notify(accountID int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.waiters[accountID] {
+		close(ch)
+	}
+	delete(h.waiters, accountID)
+}
+
+// nextEvents blocks until the account has events after the cursor, the wait
+// runs out or ctx is done
+func nextEvents(ctx context.Context, store Storage, accountID int, after int64, limit int, wait time.Duration) ([]*AccountEvent, error) {
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+
+	for {
+		// Register before reading so an event in between isn't missed
+		woken, release := accountEvents.wait(accountID)
+		events, err := store.GetAccountEvents(ctx, accountID, after, limit)
+		if err != nil || len(events) > 0 {
+			release()
+			return events, err
+		}
+
+		recheck := time.NewTimer(eventRecheckInterval)
+		select {
+		case <-woken:
+		case <-recheck.C:
+		case <-deadline.C:
+			recheck.Stop()
+			release()
+			return events, nil
+		case <-ctx.Done():
+			recheck.Stop()
+			release()
+			return nil, ctx.Err()
+		}
+		recheck.Stop()
+		release()
+	}
+}
+
+type EventPage struct {
+	Events []*AccountEvent `json:"events"`
+	Cursor int64           `json:"cursor"` // pass back as since to continue
+}
+
+// GET /account/{id}/events/poll?since=&wait=
+func (s *APIServer) handlePollEvents(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	var since int64
+	if v := r.URL.Query().Get("since"); v != "" {
+		if since, err = strconv.ParseInt(v, 10, 64); err != nil || since < 0 {
+			return invalidParam("query", "since", "type", "must be an event ID")
+		}
+	}
+
+	wait := s.config.EventPollMaxWait
+	if v := r.URL.Query().Get("wait"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 0 {
+			return invalidParam("query", "wait", "type", "must be a number of seconds")
+		}
+		if requested := time.Duration(seconds) * time.Second; requested < wait {
+			wait = requested
+		}
+	}
+
+	events, err := nextEvents(r.Context(), s.forRequest(r).store, id, since, eventPollLimit, wait)
+	if err != nil {
+		return err
+	}
+
+	page := &EventPage{Events: events, Cursor: since}
+	if len(events) > 0 {
+		page.Cursor = events[len(events)-1].ID
+	}
+	return WriteJSON(w, http.StatusOK, page)
+}
+
+const EventTransferReceived = "transfer_received"
+
+// sseEventName is what an event is sent as on the stream
+func sseEventName(event *AccountEvent) string {
+	if event.Type == EventBalanceChanged && event.Direction == DirectionCredit && event.Reference != "" {
+		return EventTransferReceived
+	}
+	return event.Type
+}
+
+// GET /account/{id}/events, a text/event-stream of the account's events
+// after Last-Event-ID or ?since=, starting with new ones when neither is sent
+func (s *APIServer) handleStreamEvents(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	store := s.forRequest(r).store
+
+	since := int64(-1)
+	for _, v := range []string{r.Header.Get("Last-Event-ID"), r.URL.Query().Get("since")} {
+		if v == "" {
+			continue
+		}
+		if since, err = strconv.ParseInt(v, 10, 64); err != nil || since < 0 {
+			return invalidParam("query", "since", "type", "must be an event ID")
+		}
+		break
+	}
+	if since < 0 {
+		if since, err = store.GetLatestAccountEventID(r.Context(), id); err != nil {
+			return err
+		}
+	}
+
+	// The stream outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return nil
+	}
+
+	for {
+		events, err := nextEvents(r.Context(), store, id, since, eventPollLimit, s.config.EventStreamKeepAlive)
+		if err != nil {
+			// The client went away, the response is already under way
+			return nil
+		}
+		if len(events) == 0 {
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		for _, event := range events {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return nil
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, sseEventName(event), data)
+			since = event.ID
+		}
+		if err := rc.Flush(); err != nil {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Balance movements are appended to the account_event outbox as they
+// happen. The event ID is a per-installation cursor, consumers remember the
+// last ID they saw and read on from there. Like the audit log, events are
+// written after the operation and a failed write is logged, not returned.
+
+const (
+	EventBalanceChanged = "balance_changed"
+
+	EventExternalTransferPending  = "external_transfer_" + ExternalPending
+	EventExternalTransferSettled  = "external_transfer_" + ExternalSettled
+	EventExternalTransferReturned = "external_transfer_" + ExternalReturned
+
+	DirectionCredit = "credit"
+	DirectionDebit  = "debit"
+)
+
+type AccountEvent struct {
+	ID        int64     `json:"id"`
+	AccountID int       `json:"account_id"`
+	Type      string    `json:"type"`
+	Direction string    `json:"direction"`
+	Amount    float64   `json:"amount"`
+	Balance   float64   `json:"balance"`
+	Currency  string    `json:"currency"`
+	Reference string    `json:"reference,omitempty"` // the transfer that caused it, if any
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func publishBalanceChange(ctx context.Context, store Storage, before *Account, delta int64) {
+	if delta == 0 {
+		return
+	}
+
+	event := &AccountEvent{
+		AccountID: before.ID,
+		Type:      EventBalanceChanged,
+		Direction: DirectionCredit,
+		Amount:    float64(delta) / 100,
+		Balance:   float64(before.Balance+delta) / 100,
+		Currency:  before.Currency,
+		Reference: transferReference(ctx),
+		CreatedAt: time.Now().UTC(),
+	}
+	if delta < 0 {
+		event.Direction = DirectionDebit
+		event.Amount = -event.Amount
+	}
+
+	if err := store.RecordAccountEvent(ctx, event); err != nil {
+		log.Printf("Failed to record %s event for account %d: %v", event.Type, event.AccountID, err)
+		return
+	}
+	accountEvents.notify(event.AccountID)
+	notifyBalanceChange(ctx, store, event)
+}
+
+// An EventFilter is a conjunction of comparisons, e.g.
+//
+//	amount > 100 and direction = credit
+//
+// amount compares with = != > >= < <= against a number in the account's
+// currency, direction and type only with = and !=. The empty filter matches
+// every event.
+type EventFilter struct {
+	clauses []filterClause
+}
+
+type filterClause struct {
+	field string
+	op    string
+	text  string
+	num   float64
+}
+
+var eventTypes = map[string]bool{
+	EventBalanceChanged:           true,
+	EventExternalTransferPending:  true,
+	EventExternalTransferSettled:  true,
+	EventExternalTransferReturned: true,
+}
+
+var (
+	filterAnd     = regexp.MustCompile(`(?i)\s+and\s+`)
+	filterCompare = regexp.MustCompile(`^\s*(\w+)\s*(>=|<=|!=|=|>|<)\s*(\S+)\s*$`)
+)
+
+func parseEventFilter(expr string) (*EventFilter, error) {
+	filter := &EventFilter{}
+	if strings.TrimSpace(expr) == "" {
+		return filter, nil
+	}
+
+	for _, part := range filterAnd.Split(strings.TrimSpace(expr), -1) {
+		m := filterCompare.FindStringSubmatch(part)
+		if m == nil {
+			return nil, fmt.Errorf("can't parse %q, expected <field> <operator> <value>", part)
+		}
+
+		c := filterClause{field: strings.ToLower(m[1]), op: m[2], text: strings.ToLower(m[3])}
+		switch c.field {
+		case "amount":
+			num, err := strconv.ParseFloat(c.text, 64)
+			if err != nil {
+				return nil, fmt.Errorf("amount must be compared with a number, got %q", m[3])
+			}
+			c.num = num
+		case "direction", "type":
+			if c.op != "=" && c.op != "!=" {
+				return nil, fmt.Errorf("%s only supports = and !=", c.field)
+			}
+			if c.field == "direction" && c.text != DirectionCredit && c.text != DirectionDebit {
+				return nil, fmt.Errorf("direction must be credit or debit, got %q", m[3])
+			}
+			if c.field == "type" && !eventTypes[c.text] {
+				return nil, fmt.Errorf("unknown event type %q", m[3])
+			}
+		default:
+			return nil, fmt.Errorf("unknown field %q, filters can use amount, direction and type", m[1])
+		}
+		filter.clauses = append(filter.clauses, c)
+	}
+
+	return filter, nil
+}
+
+func (f *EventFilter) Matches(e *AccountEvent) bool {
+	for _, c := range f.clauses {
+		var ok bool
+		switch c.field {
+		case "amount":
+			ok = compareNumbers(e.Amount, c.op, c.num)
+		case "direction":
+			ok = (e.Direction == c.text) == (c.op == "=")
+		case "type":
+			ok = (e.Type == c.text) == (c.op == "=")
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func compareNumbers(a float64, op string, b float64) bool {
+	switch op {
+	case "=":
+		return a == b
+	case "!=":
+		return a != b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventFilter(t *testing.T) {
+	credit := &AccountEvent{Type: EventBalanceChanged, Direction: DirectionCredit, Amount: 150}
+	debit := &AccountEvent{Type: EventBalanceChanged, Direction: DirectionDebit, Amount: 20}
+
+	for expr, want := range map[string][2]bool{
+		"":                                 {true, true},
+		"amount > 100":                     {true, false},
+		"amount<=20":                       {false, true},
+		"direction = credit":               {true, false},
+		"direction != credit":              {false, true},
+		"amount >= 20 AND direction=debit": {false, true},
+		"type = balance_changed":           {true, true},
+	} {
+		filter, err := parseEventFilter(expr)
+		require.Nil(t, err, expr)
+		assert.Equal(t, want[0], filter.Matches(credit), expr)
+		assert.Equal(t, want[1], filter.Matches(debit), expr)
+	}
+
+	for _, expr := range []string{"amount > lots", "direction > credit", "direction = sideways", "balance > 5", "amount", "amount > 1 or direction = credit"} {
+		_, err := parseEventFilter(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	from := &Account{Number: 9001, Balance: 100000, Currency: "USD"}
+	to := &Account{Number: 9002, Currency: "USD"}
+	require.Nil(t, store.CreateAccount(ctx, from))
+	require.Nil(t, store.CreateAccount(ctx, to))
+
+	var mu sync.Mutex
+	var received []AccountEvent
+	failing := false
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		sub := store.subs[0]
+		assert.Equal(t, signWebhook(sub.Secret, body), r.Header.Get("X-Gobank-Signature"))
+		var event AccountEvent
+		require.Nil(t, json.Unmarshal(body, &event))
+		received = append(received, event)
+	}))
+	defer receiver.Close()
+
+	s := NewAPIServer(&Config{}, store)
+	subscribe := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/v1/account/2/subscriptions", strings.NewReader(body))
+		r = mux.SetURLVars(r, map[string]string{"id": "2"})
+		w := httptest.NewRecorder()
+		makeHTTPHandle(s.handleCreateEventSubscription)(w, r)
+		return w
+	}
+
+	w := subscribe(`{"url": "` + receiver.URL + `", "filter": "amount >= 10 and direction = sideways"}`)
+	require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), `"field":"/filter"`)
+	assert.Equal(t, http.StatusUnprocessableEntity, subscribe(`{"url": "ftp://example.com"}`).Code)
+
+	w = subscribe(`{"url": "` + receiver.URL + `", "filter": "amount >= 10 and direction = credit"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	transfer := func(amount float64) {
+		_, _, err := s.transfers().Transfer(ctx, TransferRequest{FromAccountNumber: 9001, ToAccountNumber: 9002, Amount: amount}, engine, "test")
+		require.Nil(t, err)
+	}
+	transfer(5)
+	transfer(25)
+
+	runner := &webhookRunner{store: store, httpClient: receiver.Client(), batchSize: 10}
+
+	// A failing receiver keeps the cursor where it was
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	require.Nil(t, runner.run(ctx))
+	assert.Empty(t, received)
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	require.Nil(t, runner.run(ctx))
+	require.Len(t, received, 1)
+	assert.Equal(t, 25.0, received[0].Amount)
+	assert.Equal(t, DirectionCredit, received[0].Direction)
+	assert.NotEmpty(t, received[0].Reference)
+
+	// Nothing is delivered twice
+	require.Nil(t, runner.run(ctx))
+	assert.Len(t, received, 1)
+}
+
+func TestPollEvents(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9101, Balance: 10000, Currency: "USD"}))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9102, Currency: "USD"}))
+
+	s := NewAPIServer(&Config{EventPollMaxWait: 5 * time.Second}, store)
+	poll := func(query string) (*EventPage, time.Duration) {
+		r := httptest.NewRequest("GET", "/v1/account/2/events/poll?"+query, nil)
+		r = mux.SetURLVars(r, map[string]string{"id": "2"})
+		w := httptest.NewRecorder()
+		start := time.Now()
+		makeHTTPHandle(s.handlePollEvents)(w, r)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var page EventPage
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &page))
+		return &page, time.Since(start)
+	}
+
+	page, _ := poll("wait=0")
+	assert.Empty(t, page.Events)
+	assert.Equal(t, int64(0), page.Cursor)
+
+	// A waiting poll is woken by the transfer instead of running out
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		engine, _ := NewTransferEngine("balance", store, &Config{})
+		s.transfers().Transfer(ctx, TransferRequest{FromAccountNumber: 9101, ToAccountNumber: 9102, Amount: 10}, engine, "test")
+	}()
+	page, took := poll("since=0")
+	require.Len(t, page.Events, 1)
+	assert.Less(t, took, time.Second)
+	assert.Equal(t, DirectionCredit, page.Events[0].Direction)
+	assert.Equal(t, page.Events[0].ID, page.Cursor)
+
+	page, _ = poll("since=" + strconv.FormatInt(page.Cursor, 10) + "&wait=0")
+	assert.Empty(t, page.Events)
+	assert.NotEqual(t, int64(0), page.Cursor)
+}
+
+func TestEventStreamSSE(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9111, Balance: 10000, Currency: "USD"}))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9112, Balance: 5000, Currency: "USD"}))
+	engine, _ := NewTransferEngine("balance", store, &Config{})
+	publishBalanceChange(ctx, store, &Account{ID: 2, Balance: 5000, Currency: "USD"}, -100)
+
+	s := NewAPIServer(&Config{EventStreamKeepAlive: 50 * time.Millisecond}, store)
+	router := mux.NewRouter()
+	router.HandleFunc("/v1/account/{id}/events", makeHTTPHandle(s.handleStreamEvents))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	reqCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(reqCtx, "GET", server.URL+"/v1/account/2/events", nil)
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	// Events from before the stream opened aren't replayed, idle streams get keep-alives
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		s.transfers().Transfer(ctx, TransferRequest{FromAccountNumber: 9111, ToAccountNumber: 9112, Amount: 10}, engine, "test")
+	}()
+
+	var received strings.Builder
+	buf := make([]byte, 4096)
+	for !strings.Contains(received.String(), "event: transfer_received") {
+		n, err := resp.Body.Read(buf)
+		require.Nil(t, err)
+		received.Write(buf[:n])
+	}
+	stream := received.String()
+	assert.Contains(t, stream, ": keep-alive")
+	assert.NotContains(t, stream, "id: 1\n")
+	assert.Contains(t, stream, "id: 3\nevent: transfer_received\ndata: {", "the sender's debit is id 2")
+	assert.Contains(t, stream, `"direction":"credit"`)
+
+	// A reconnect resumes after Last-Event-ID
+	req, _ = http.NewRequestWithContext(reqCtx, "GET", server.URL+"/v1/account/2/events", nil)
+	req.Header.Set("Last-Event-ID", "0")
+	resume, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	defer resume.Body.Close()
+	n, err := io.ReadAtLeast(resume.Body, buf, len("id: 1\nevent: balance_changed"))
+	require.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(buf[:n]), "id: 1\nevent: balance_changed"), string(buf[:n]))
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// With STORAGE_BACKEND=eventsourced every change to an account's money is
+// appended to its stream in account_stream, in the same transaction as the
+// ledger entry: AccountCreated with the opening balance, then Deposited,
+// Withdrawn or Transferred for each entry that moves it. The balance an
+// account is read with is folded from its stream, starting at the latest
+// snapshot, which is taken every EventSnapshotEvery events.
+//
+// account.balance is kept as a projection of the streams so lists, searches
+// and the version checks on writes work unchanged. `gobank rebuild-projection`
+// replays every stream and rewrites balances that disagree. Profile fields
+// such as names, status and credentials aren't money and stay in the account
+// row, their history is in the audit log.
+
+const (
+	StreamAccountCreated = "AccountCreated"
+	StreamDeposited      = "Deposited"
+	StreamWithdrawn      = "Withdrawn"
+	StreamTransferred    = "Transferred"
+)
+
+// StreamEvent is one change on an account's stream. Amount is signed cents,
+// Counterparty is the other customer account of a transfer.
+type StreamEvent struct {
+	AccountID    int       `json:"account_id"`
+	Seq          int64     `json:"seq"`
+	Type         string    `json:"type"`
+	Amount       int64     `json:"amount"`
+	Currency     string    `json:"currency"`
+	Counterparty int       `json:"counterparty,omitempty"`
+	Reference    string    `json:"reference,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// AccountState is an account's money as of its Seq'th event
+type AccountState struct {
+	AccountID int       `json:"account_id"`
+	Seq       int64     `json:"seq"`
+	Balance   int64     `json:"balance"`
+	Currency  string    `json:"currency"`
+	AsOf      time.Time `json:"as_of"`
+}
+
+func (st *AccountState) apply(e *StreamEvent) {
+	st.Seq = e.Seq
+	st.Balance += e.Amount
+	st.Currency = e.Currency
+	st.AsOf = e.CreatedAt
+}
+
+// streamEvents are the events an entry appends, one per customer account
+// whose balance it moves
+func streamEvents(entry *LedgerEntry) []*StreamEvent {
+	currencies := map[int]string{}
+	for _, p := range entry.Postings {
+		if p.AccountID != 0 && currencies[p.AccountID] == "" {
+			currencies[p.AccountID] = p.Currency
+		}
+	}
+
+	changes := entry.balanceChanges()
+	events := []*StreamEvent{}
+	for _, c := range changes {
+		if c.amount == 0 {
+			continue
+		}
+		e := &StreamEvent{AccountID: c.accountID, Type: StreamDeposited, Amount: c.amount, Currency: currencies[c.accountID], Reference: entry.Reference, CreatedAt: entry.CreatedAt}
+		if c.amount < 0 {
+			e.Type = StreamWithdrawn
+		}
+		for _, other := range changes {
+			if other.accountID != c.accountID {
+				e.Type, e.Counterparty = StreamTransferred, other.accountID
+				break
+			}
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// Storage backends that keep account event streams
+type eventSourcedStore interface {
+	GetAccountStream(ctx context.Context, accountID int, until time.Time, limit int) ([]*StreamEvent, error)
+	GetAccountState(ctx context.Context, accountID int, at time.Time) (*AccountState, error)
+}
+
+type EventSourcedStorage struct {
+	*PostgresStorage
+
+	snapshotEvery int
+}
+
+func NewEventSourcedStorage(cfg *Config, pg *PostgresStorage) *EventSourcedStorage {
+	return &EventSourcedStorage{PostgresStorage: pg, snapshotEvery: max(cfg.EventSnapshotEvery, 1)}
+}
+
+func (s *EventSourcedStorage) WithRequestID(id string) Storage {
+	scoped := *s
+	scoped.PostgresStorage = s.PostgresStorage.WithRequestID(id).(*PostgresStorage)
+	return &scoped
+}
+
+func (s *EventSourcedStorage) CreateAccount(ctx context.Context, acc *Account) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.insertAccount(ctx, tx, acc); err != nil {
+		return err
+	}
+	created := &StreamEvent{AccountID: acc.ID, Type: StreamAccountCreated, Amount: acc.Balance, Currency: acc.Currency, CreatedAt: acc.CreatedAt}
+	if err := s.appendEvents(ctx, tx, []*StreamEvent{created}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *EventSourcedStorage) PostLedgerEntry(ctx context.Context, entry *LedgerEntry, tx Transaction) error {
+	if tx == nil {
+		own, err := s.BeginTransaction(ctx)
+		if err != nil {
+			return err
+		}
+		defer own.Rollback()
+		if err := s.PostLedgerEntry(ctx, entry, own); err != nil {
+			return err
+		}
+		return own.Commit()
+	}
+
+	// The balance updates lock the accounts' rows, so their streams are
+	// appended to one transaction at a time
+	if err := s.PostgresStorage.PostLedgerEntry(ctx, entry, tx); err != nil {
+		return err
+	}
+
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+	return s.appendEvents(ctx, tx, streamEvents(entry))
+}
+
+// appendEvents adds the events at the end of their streams and snapshots a
+// stream whenever its length reaches a multiple of snapshotEvery
+func (s *EventSourcedStorage) appendEvents(ctx context.Context, tx Transaction, events []*StreamEvent) error {
+	for _, e := range events {
+		_, err := tx.ExecContext(ctx, s.tagQuery(`insert into account_stream (account_id, seq, type, amount, currency, counterparty, reference, created_at)
+		select $1, coalesce(max(seq), 0) + 1, $2, $3, $4, nullif($5, 0), nullif($6, '')::uuid, $7 from account_stream where account_id = $1`),
+			e.AccountID, e.Type, e.Amount, e.Currency, e.Counterparty, e.Reference, e.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to append %s to account %d's stream: %v", e.Type, e.AccountID, err)
+		}
+
+		_, err = tx.ExecContext(ctx, s.tagQuery(`with head as (
+			select seq, currency, created_at from account_stream where account_id = $1 order by seq desc limit 1
+		), base as (
+			select coalesce(max(seq), 0) as seq, coalesce((array_agg(balance order by seq desc))[1], 0) as balance
+			from account_snapshot where account_id = $1
+		)
+		insert into account_snapshot (account_id, seq, balance, currency, as_of)
+		select $1, head.seq, base.balance + (select coalesce(sum(amount), 0) from account_stream where account_id = $1 and seq > base.seq), head.currency, head.created_at
+		from head, base
+		where head.seq % $2 = 0`),
+			e.AccountID, s.snapshotEvery)
+		if err != nil {
+			return fmt.Errorf("failed to snapshot account %d: %v", e.AccountID, err)
+		}
+	}
+	return nil
+}
+
+// GetAccountState folds the stream up to at, the zero time meaning now,
+// from the latest snapshot taken by then
+func (s *EventSourcedStorage) GetAccountState(ctx context.Context, accountID int, at time.Time) (*AccountState, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	var until any
+	if !at.IsZero() {
+		until = at
+	}
+
+	state := &AccountState{AccountID: accountID}
+	err := s.db.QueryRowContext(ctx, s.tagQuery(`select seq, balance, currency, as_of from account_snapshot
+	where account_id = $1 and ($2::timestamp is null or as_of <= $2)
+	order by seq desc limit 1`), accountID, until).Scan(&state.Seq, &state.Balance, &state.Currency, &state.AsOf)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	events, err := s.queryStream(ctx, `select account_id, seq, type, amount, currency, coalesce(counterparty, 0), coalesce(reference::text, ''), created_at
+	from account_stream where account_id = $1 and seq > $2 and ($3::timestamp is null or created_at <= $3) order by seq`,
+		accountID, state.Seq, until)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range events {
+		state.apply(e)
+	}
+	return state, nil
+}
+
+// GetBalanceAt folds the stream rather than summing postings, the stream is
+// the source of truth here
+func (s *EventSourcedStorage) GetBalanceAt(ctx context.Context, accountID int, at time.Time) (int64, error) {
+	state, err := s.GetAccountState(ctx, accountID, at)
+	if err != nil {
+		return 0, err
+	}
+	return state.Balance, nil
+}
+
+// GetAccountStream returns the first limit events up to until, oldest first
+func (s *EventSourcedStorage) GetAccountStream(ctx context.Context, accountID int, until time.Time, limit int) ([]*StreamEvent, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	var at any
+	if !until.IsZero() {
+		at = until
+	}
+	return s.queryStream(ctx, `select account_id, seq, type, amount, currency, coalesce(counterparty, 0), coalesce(reference::text, ''), created_at
+	from account_stream where account_id = $1 and ($2::timestamp is null or created_at <= $2) order by seq limit $3`,
+		accountID, at, limit)
+}
+
+func (s *EventSourcedStorage) queryStream(ctx context.Context, query string, args ...any) ([]*StreamEvent, error) {
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*StreamEvent{}
+	for rows.Next() {
+		e := &StreamEvent{}
+		if err := rows.Scan(&e.AccountID, &e.Seq, &e.Type, &e.Amount, &e.Currency, &e.Counterparty, &e.Reference, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *EventSourcedStorage) GetAccountbyID(ctx context.Context, id int) (*Account, error) {
+	acc, err := s.PostgresStorage.GetAccountbyID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.withStreamBalance(ctx, acc)
+}
+
+func (s *EventSourcedStorage) GetAccountByNumber(ctx context.Context, number int64) (*Account, error) {
+	acc, err := s.PostgresStorage.GetAccountByNumber(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+	return s.withStreamBalance(ctx, acc)
+}
+
+func (s *EventSourcedStorage) withStreamBalance(ctx context.Context, acc *Account) (*Account, error) {
+	state, err := s.GetAccountState(ctx, acc.ID, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	if state.Seq == 0 {
+		log.Printf("Account %d has no event stream, using its projected balance", acc.ID)
+		return acc, nil
+	}
+	if state.Balance != acc.Balance {
+		log.Printf("Account %d's projected balance %d disagrees with its stream's %d, run gobank rebuild-projection", acc.ID, acc.Balance, state.Balance)
+	}
+	acc.Balance = state.Balance
+	return acc, nil
+}
+
+// RebuildProjection replays every stream and corrects the balances that
+// disagree, returning the accounts it corrected
+func (s *EventSourcedStorage) RebuildProjection(ctx context.Context) ([]*AccountState, error) {
+	accounts, err := s.PostgresStorage.GetAccounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	fixed := []*AccountState{}
+	for _, acc := range accounts {
+		state, err := s.GetAccountState(ctx, acc.ID, time.Time{})
+		if err != nil {
+			return fixed, err
+		}
+		if state.Seq == 0 || state.Balance == acc.Balance {
+			continue
+		}
+
+		qctx, cancel := s.queryContext(ctx)
+		_, err = s.db.ExecContext(qctx, s.tagQuery("UPDATE account SET balance = $1, version = version + 1 WHERE id = $2 AND version = $3"),
+			state.Balance, acc.ID, acc.Version)
+		cancel()
+		if err != nil {
+			return fixed, err
+		}
+		fixed = append(fixed, state)
+	}
+	return fixed, nil
+}
+
+type AccountReplay struct {
+	State  *AccountState  `json:"state"`
+	Events []*StreamEvent `json:"events"`
+}
+
+const maxStreamEvents = 1000
+
+// GET /admin/accounts/{id}/stream?at=, the account's events and the state
+// they add up to, as of at when given
+func (s *APIServer) handleGetAccountStream(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	var at time.Time
+	if v := r.URL.Query().Get("at"); v != "" {
+		if at, err = time.Parse(time.RFC3339, v); err != nil {
+			return invalidParam("query", "at", "type", "must be an RFC 3339 timestamp")
+		}
+	}
+	limit := maxStreamEvents
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxStreamEvents {
+			return invalidParam("query", "limit", "range", fmt.Sprintf("must be between 1 and %d", maxStreamEvents))
+		}
+	}
+
+	store, ok := storageAs[eventSourcedStore](s.forRequest(r).store)
+	if !ok {
+		return newHTTPError(http.StatusNotImplemented, "NOT_EVENT_SOURCED", "the %s storage backend doesn't keep event streams", s.config.StorageBackend)
+	}
+
+	state, err := store.GetAccountState(r.Context(), id, at)
+	if err != nil {
+		return err
+	}
+	if state.Seq == 0 {
+		return fmt.Errorf("%w: id %d has no events by then", ErrAccountNotFound, id)
+	}
+	events, err := store.GetAccountStream(r.Context(), id, at, limit)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, &AccountReplay{State: state, Events: events})
+}
+
+// gobank rebuild-projection
+func rebuildProjectionCommand(args []string) int {
+	cmd := flag.NewFlagSet("rebuild-projection", flag.ExitOnError)
+	cmd.Parse(args)
+
+	cfg := LoadConfig()
+	pg, err := NewPostgresStorage(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open database: %v\n", err)
+		return 1
+	}
+
+	fixed, err := NewEventSourcedStorage(cfg, pg).RebuildProjection(context.Background())
+	for _, state := range fixed {
+		fmt.Printf("account %d: balance set to %d from %d events\n", state.AccountID, state.Balance, state.Seq)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Rebuild failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Corrected %d balances\n", len(fixed))
+	return 0
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamEvents(t *testing.T) {
+	ctx := context.Background()
+	from := &Account{ID: 1, Currency: "USD"}
+	to := &Account{ID: 2, Currency: "EUR"}
+
+	events := streamEvents(transferEntry(ctx, from, to, Conversion{FromCurrency: "USD", ToCurrency: "EUR", Debit: 10, Credit: 9}))
+	require.Len(t, events, 2)
+	assert.Equal(t, StreamTransferred, events[0].Type)
+	assert.Equal(t, int64(-1000), events[0].Amount)
+	assert.Equal(t, 2, events[0].Counterparty)
+	assert.Equal(t, "EUR", events[1].Currency)
+	assert.Equal(t, int64(900), events[1].Amount)
+
+	events = streamEvents(fundingEntry(ctx, from, 500))
+	require.Len(t, events, 1)
+	assert.Equal(t, StreamDeposited, events[0].Type)
+
+	fee := newLedgerEntry(ctx, "overdraft_fee").account(from, -25).ledger(LedgerOverdraftFees, "USD", 25)
+	assert.Equal(t, StreamWithdrawn, streamEvents(fee)[0].Type)
+}
+
+func TestAccountStateFold(t *testing.T) {
+	day := time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)
+	events := []*StreamEvent{
+		{Seq: 1, Type: StreamAccountCreated, Amount: 10000, Currency: "USD", CreatedAt: day},
+		{Seq: 2, Type: StreamWithdrawn, Amount: -2500, Currency: "USD", CreatedAt: day.Add(time.Hour)},
+		{Seq: 3, Type: StreamDeposited, Amount: 700, Currency: "USD", CreatedAt: day.Add(2 * time.Hour)},
+	}
+
+	// Folding from a snapshot at seq 2 gives the same state as the full replay
+	full := &AccountState{}
+	for _, e := range events {
+		full.apply(e)
+	}
+	fromSnapshot := &AccountState{Seq: 2, Balance: 7500, Currency: "USD"}
+	fromSnapshot.apply(events[2])
+	assert.Equal(t, full, fromSnapshot)
+	assert.Equal(t, int64(8200), full.Balance)
+}
+
+// streamStore keeps streams in memory the way EventSourcedStorage does in postgres
+type streamStore struct {
+	*memoryStorage
+	streams map[int][]*StreamEvent
+}
+
+func (s *streamStore) GetAccountStream(ctx context.Context, accountID int, until time.Time, limit int) ([]*StreamEvent, error) {
+	events := []*StreamEvent{}
+	for _, e := range s.streams[accountID] {
+		if (until.IsZero() || !e.CreatedAt.After(until)) && len(events) < limit {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (s *streamStore) GetAccountState(ctx context.Context, accountID int, at time.Time) (*AccountState, error) {
+	events, _ := s.GetAccountStream(ctx, accountID, at, maxStreamEvents)
+	state := &AccountState{AccountID: accountID}
+	for _, e := range events {
+		state.apply(e)
+	}
+	return state, nil
+}
+
+func TestAccountStreamEndpoint(t *testing.T) {
+	day := time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)
+	store := &streamStore{memoryStorage: newMemoryStorage(), streams: map[int][]*StreamEvent{1: {
+		{AccountID: 1, Seq: 1, Type: StreamAccountCreated, Amount: 10000, Currency: "USD", CreatedAt: day},
+		{AccountID: 1, Seq: 2, Type: StreamWithdrawn, Amount: -2500, Currency: "USD", CreatedAt: day.Add(48 * time.Hour)},
+	}}}
+
+	get := func(store Storage, query string) (int, *AccountReplay) {
+		s := NewAPIServer(&Config{AdminToken: "admin", StorageBackend: "test"}, store)
+		req := httptest.NewRequest("GET", "/v1/admin/accounts/1/stream"+query, nil)
+		req.Header.Set("x-admin-token", "admin")
+		rr := httptest.NewRecorder()
+		s.routes(nil).ServeHTTP(rr, req)
+
+		replay := &AccountReplay{}
+		json.Unmarshal(rr.Body.Bytes(), replay)
+		return rr.Code, replay
+	}
+
+	code, replay := get(store, "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, int64(7500), replay.State.Balance)
+	assert.Len(t, replay.Events, 2)
+
+	code, replay = get(store, "?at="+day.Add(24*time.Hour).Format(time.RFC3339))
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, int64(10000), replay.State.Balance)
+	assert.Len(t, replay.Events, 1)
+
+	code, _ = get(store, "?at=yesterday")
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	code, _ = get(newMemoryStorage(), "?limit="+strconv.Itoa(maxStreamEvents))
+	assert.Equal(t, http.StatusNotImplemented, code)
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	_ "golang.org/x/crypto/ripemd160" // OpenPGP's fallback hash for keys without preferences
+)
+
+// The export job pushes two files per day to the back office over SFTP:
+// transactions_YYYYMMDD with every ledger posting made that day, and
+// balances_YYYYMMDD with each account's balance at the close of the day.
+// Files are CSV with a header row, or fixed-width records without one, and
+// get a .pgp suffix when encrypted.
+//
+// Each file is tracked in export_delivery. A delivery only counts once the
+// server reports the uploaded file at the expected size, failed or missing
+// files from the last exportLookbackDays are retried on every run.
+
+const (
+	ExportDelivered = "delivered"
+	ExportFailed    = "failed"
+
+	exportLookbackDays = 7
+)
+
+type ExportDelivery struct {
+	FileName    string     `json:"file_name"`
+	Day         time.Time  `json:"day"`
+	Status      string     `json:"status"`
+	Bytes       int64      `json:"bytes"`
+	SHA256      string     `json:"sha256"`
+	Attempts    int        `json:"attempts"`
+	Error       string     `json:"error,omitempty"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// ClosingBalance is an account's balance as it stood at a point in time
+type ClosingBalance struct {
+	AccountID int
+	Number    int64
+	Currency  string
+	Balance   int64
+}
+
+// exportDestination stores a file and only returns nil once it's confirmed
+type exportDestination interface {
+	Deliver(name string, data []byte) error
+}
+
+type sftpDestination struct {
+	addr, user, keyFile, hostKey, dir string
+}
+
+func (d *sftpDestination) Deliver(name string, data []byte) error {
+	client, err := dialSFTP(d.addr, d.user, d.keyFile, d.hostKey)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	size, err := client.Upload(path.Join(d.dir, name), data)
+	if err != nil {
+		return err
+	}
+	if size != int64(len(data)) {
+		return fmt.Errorf("server has %d bytes of %s, sent %d", size, name, len(data))
+	}
+	return nil
+}
+
+type exportColumn struct {
+	name  string
+	width int
+	right bool // numbers are right aligned in fixed-width files
+}
+
+var transactionColumns = []exportColumn{
+	{"entry_id", 12, true}, {"created_at", 20, false}, {"kind", 20, false}, {"reference", 36, false},
+	{"account", 50, false}, {"currency", 3, false}, {"amount", 15, true}, {"category", 50, false}, {"memo", 140, false},
+}
+
+var balanceColumns = []exportColumn{
+	{"account_id", 10, true}, {"account_number", 12, true}, {"currency", 3, false}, {"balance", 15, true}, {"as_of", 10, false},
+}
+
+type exporter struct {
+	store      Storage
+	dest       exportDestination
+	format     string
+	recipients openpgp.EntityList // empty means unencrypted
+}
+
+func newExporter(cfg *Config, store Storage, dest exportDestination) (*exporter, error) {
+	if cfg.ExportFormat != "csv" && cfg.ExportFormat != "fixed" {
+		return nil, fmt.Errorf("unknown export format %q", cfg.ExportFormat)
+	}
+
+	e := &exporter{store: store, dest: dest, format: cfg.ExportFormat}
+	if cfg.ExportPGPKeyFile != "" {
+		f, err := os.Open(cfg.ExportPGPKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if e.recipients, err = openpgp.ReadArmoredKeyRing(f); err != nil {
+			return nil, fmt.Errorf("export PGP key: %v", err)
+		}
+	}
+	return e, nil
+}
+
+// run delivers every file from the last few complete days that isn't delivered yet
+func (e *exporter) run(ctx context.Context, now time.Time) error {
+	today := startOfDay(now)
+	deliveries, err := e.store.GetExportDeliveries(ctx, today.AddDate(0, 0, -exportLookbackDays))
+	if err != nil {
+		return err
+	}
+	previous := map[string]*ExportDelivery{}
+	for _, d := range deliveries {
+		previous[d.FileName] = d
+	}
+
+	for i := exportLookbackDays; i >= 1; i-- {
+		// Failures are logged and retried on the next run
+		e.exportDay(ctx, today.AddDate(0, 0, -i), previous)
+	}
+	return nil
+}
+
+// exportDay delivers the day's files that aren't delivered yet, returning
+// the last failure. previous is looked up when nil.
+func (e *exporter) exportDay(ctx context.Context, day time.Time, previous map[string]*ExportDelivery) error {
+	if previous == nil {
+		deliveries, err := e.store.GetExportDeliveries(ctx, day)
+		if err != nil {
+			return err
+		}
+		previous = map[string]*ExportDelivery{}
+		for _, d := range deliveries {
+			previous[d.FileName] = d
+		}
+	}
+
+	var failed error
+	for _, file := range []struct {
+		kind  string
+		build func(context.Context, time.Time) ([]exportColumn, [][]string, error)
+	}{{"transactions", e.transactions}, {"balances", e.balances}} {
+		name := e.fileName(file.kind, day)
+		if d := previous[name]; d != nil && d.Status == ExportDelivered {
+			continue
+		}
+		if err := e.deliver(ctx, name, day, previous[name], file.build); err != nil {
+			log.Printf("Export of %s failed: %v", name, err)
+			failed = fmt.Errorf("export of %s: %w", name, err)
+		}
+	}
+	return failed
+}
+
+func (e *exporter) fileName(kind string, day time.Time) string {
+	ext := "csv"
+	if e.format == "fixed" {
+		ext = "txt"
+	}
+	name := fmt.Sprintf("%s_%s.%s", kind, day.Format("20060102"), ext)
+	if len(e.recipients) > 0 {
+		name += ".pgp"
+	}
+	return name
+}
+
+func (e *exporter) deliver(ctx context.Context, name string, day time.Time, previous *ExportDelivery, build func(context.Context, time.Time) ([]exportColumn, [][]string, error)) error {
+	columns, rows, err := build(ctx, day)
+	if err != nil {
+		return err
+	}
+	data, err := e.encode(name, columns, rows)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	delivery := &ExportDelivery{FileName: name, Day: day, Bytes: int64(len(data)), SHA256: hex.EncodeToString(sum[:]), Attempts: 1, UpdatedAt: time.Now().UTC()}
+	if previous != nil {
+		delivery.Attempts = previous.Attempts + 1
+	}
+
+	deliverErr := e.dest.Deliver(name, data)
+	if deliverErr != nil {
+		delivery.Status, delivery.Error = ExportFailed, deliverErr.Error()
+	} else {
+		delivery.Status, delivery.DeliveredAt = ExportDelivered, &delivery.UpdatedAt
+	}
+
+	if err := e.store.RecordExportDelivery(ctx, delivery); err != nil {
+		return err
+	}
+	return deliverErr
+}
+
+func (e *exporter) transactions(ctx context.Context, day time.Time) ([]exportColumn, [][]string, error) {
+	entries, err := e.store.GetLedgerEntries(ctx, day, day.AddDate(0, 0, 1))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows := [][]string{}
+	for _, entry := range entries {
+		for _, p := range entry.Postings {
+			account := p.LedgerAccount
+			if p.AccountID != 0 {
+				account = strconv.Itoa(p.AccountID)
+			}
+			rows = append(rows, []string{
+				strconv.FormatInt(entry.ID, 10), entry.CreatedAt.UTC().Format(time.RFC3339), entry.Kind, entry.Reference,
+				account, p.Currency, strconv.FormatInt(p.Amount, 10), entry.Category, entry.Memo,
+			})
+		}
+	}
+	return transactionColumns, rows, nil
+}
+
+func (e *exporter) balances(ctx context.Context, day time.Time) ([]exportColumn, [][]string, error) {
+	balances, err := e.store.GetClosingBalances(ctx, day.AddDate(0, 0, 1))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows := make([][]string, len(balances))
+	for i, b := range balances {
+		rows[i] = []string{
+			strconv.Itoa(b.AccountID), strconv.FormatInt(b.Number, 10), b.Currency, strconv.FormatInt(b.Balance, 10), day.Format("2006-01-02"),
+		}
+	}
+	return balanceColumns, rows, nil
+}
+
+// encode lays the rows out in the configured format and encrypts them when
+// a recipient key is set. Amounts are signed cents.
+func (e *exporter) encode(name string, columns []exportColumn, rows [][]string) ([]byte, error) {
+	var plain bytes.Buffer
+	if e.format == "fixed" {
+		for _, row := range rows {
+			plain.WriteString(fixedWidthRecord(columns, row))
+			plain.WriteString("\r\n")
+		}
+	} else {
+		w := csv.NewWriter(&plain)
+		header := make([]string, len(columns))
+		for i, c := range columns {
+			header[i] = c.name
+		}
+		w.Write(header)
+		w.WriteAll(rows)
+		if err := w.Error(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(e.recipients) == 0 {
+		return plain.Bytes(), nil
+	}
+
+	var encrypted bytes.Buffer
+	w, err := openpgp.Encrypt(&encrypted, e.recipients, nil, &openpgp.FileHints{FileName: strings.TrimSuffix(name, ".pgp"), IsBinary: true}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(plain.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return encrypted.Bytes(), nil
+}
+
+// fixedWidthRecord pads each value to its column, longer values are cut off
+func fixedWidthRecord(columns []exportColumn, row []string) string {
+	var b strings.Builder
+	for i, c := range columns {
+		v := strings.NewReplacer("\r", " ", "\n", " ").Replace(row[i])
+		if r := []rune(v); len(r) > c.width {
+			v = string(r[:c.width])
+		}
+		pad := strings.Repeat(" ", c.width-len([]rune(v)))
+		if c.right {
+			b.WriteString(pad + v)
+		} else {
+			b.WriteString(v + pad)
+		}
+	}
+	return b.String()
+}
+
+func (s *APIServer) sftpExporter() (*exporter, error) {
+	dest := &sftpDestination{
+		addr:    s.config.ExportSFTPAddr,
+		user:    s.config.ExportSFTPUser,
+		keyFile: s.config.ExportSFTPKeyFile,
+		hostKey: s.config.ExportSFTPHostKey,
+		dir:     s.config.ExportSFTPDir,
+	}
+	return newExporter(s.config, s.store, dest)
+}
+
+func (s *APIServer) exportJob() (Job, error) {
+	exporter, err := s.sftpExporter()
+	if err != nil {
+		return Job{}, err
+	}
+
+	return Job{
+		Name:     "sftp-export",
+		Interval: s.config.SchedulerInterval,
+		Run: func(ctx context.Context) error {
+			return exporter.run(ctx, time.Now().UTC())
+		},
+	}, nil
+}
+
+// GET /admin/exports, the last 30 days of deliveries
+func (s *APIServer) handleGetExports(w http.ResponseWriter, r *http.Request) error {
+	since := startOfDay(time.Now().UTC()).AddDate(0, 0, -30)
+	deliveries, err := s.forRequest(r).store.GetExportDeliveries(r.Context(), since)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, deliveries)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/csv"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+type fakeDestination struct {
+	files map[string][]byte
+	fail  bool
+}
+
+func (d *fakeDestination) Deliver(name string, data []byte) error {
+	if d.fail {
+		return errors.New("connection refused")
+	}
+	d.files[name] = data
+	return nil
+}
+
+func TestExportDelivery(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 6101, Balance: 10000, Currency: "USD"}))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 6102, Currency: "USD"}))
+
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	transfers := NewTransferService(store, TransferLimits{}, staticRateProvider{}, nil, nil)
+	_, _, err = transfers.Transfer(ctx, TransferRequest{FromAccountNumber: 6101, ToAccountNumber: 6102, Amount: 25, Memo: "rent, March"}, engine, "test")
+	require.Nil(t, err)
+
+	dest := &fakeDestination{files: map[string][]byte{}, fail: true}
+	exporter, err := newExporter(&Config{ExportFormat: "csv"}, store, dest)
+	require.Nil(t, err)
+
+	today := startOfDay(time.Now().UTC())
+	tomorrow := today.AddDate(0, 0, 1).Add(time.Hour)
+	name := "transactions_" + today.Format("20060102") + ".csv"
+
+	// Failures are recorded and retried on the next run
+	require.Nil(t, exporter.run(ctx, tomorrow))
+	deliveries, err := store.GetExportDeliveries(ctx, today)
+	require.Nil(t, err)
+	require.Len(t, deliveries, 2)
+	assert.Equal(t, ExportFailed, deliveries[1].Status)
+	assert.Equal(t, "connection refused", deliveries[1].Error)
+
+	dest.fail = false
+	require.Nil(t, exporter.run(ctx, tomorrow))
+	deliveries, _ = store.GetExportDeliveries(ctx, today)
+	assert.Equal(t, name, deliveries[1].FileName)
+	assert.Equal(t, ExportDelivered, deliveries[1].Status)
+	assert.Equal(t, 2, deliveries[1].Attempts)
+	assert.NotNil(t, deliveries[1].DeliveredAt)
+	assert.Len(t, dest.files, 2*exportLookbackDays)
+
+	rows, err := csv.NewReader(bytes.NewReader(dest.files[name])).ReadAll()
+	require.Nil(t, err)
+	require.Len(t, rows, 3)
+	assert.Equal(t, "memo", rows[0][8])
+	assert.Equal(t, []string{"1", "USD", "-2500", "rent, March"}, []string{rows[1][4], rows[1][5], rows[1][6], rows[1][8]})
+
+	// Balances are as of each day's close
+	rows, _ = csv.NewReader(bytes.NewReader(dest.files["balances_"+today.Format("20060102")+".csv"])).ReadAll()
+	assert.Equal(t, []string{"1", "6101", "USD", "7500"}, rows[1][:4])
+	rows, _ = csv.NewReader(bytes.NewReader(dest.files["balances_"+today.AddDate(0, 0, -1).Format("20060102")+".csv"])).ReadAll()
+	assert.Equal(t, []string{"1", "6101", "USD", "10000"}, rows[1][:4])
+
+	// Delivered files aren't sent again
+	dest.files = map[string][]byte{}
+	require.Nil(t, exporter.run(ctx, tomorrow))
+	assert.Empty(t, dest.files)
+}
+
+func TestExportFixedWidthEncrypted(t *testing.T) {
+	entity, err := openpgp.NewEntity("Back Office", "", "backoffice@example.com", &packet.Config{DefaultHash: crypto.SHA256})
+	require.Nil(t, err)
+	var armored bytes.Buffer
+	w, err := armor.Encode(&armored, openpgp.PublicKeyType, nil)
+	require.Nil(t, err)
+	require.Nil(t, entity.Serialize(w))
+	require.Nil(t, w.Close())
+	keyFile := filepath.Join(t.TempDir(), "backoffice.asc")
+	require.Nil(t, os.WriteFile(keyFile, armored.Bytes(), 0o600))
+
+	exporter, err := newExporter(&Config{ExportFormat: "fixed", ExportPGPKeyFile: keyFile}, newMemoryStorage(), nil)
+	require.Nil(t, err)
+	name := exporter.fileName("balances", time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC))
+	assert.Equal(t, "balances_20260301.txt.pgp", name)
+
+	data, err := exporter.encode(name, balanceColumns, [][]string{{"1", "6101", "USD", "-2500", "2026-03-01"}})
+	require.Nil(t, err)
+
+	md, err := openpgp.ReadMessage(bytes.NewReader(data), openpgp.EntityList{entity}, nil, nil)
+	require.Nil(t, err)
+	plain, err := io.ReadAll(md.UnverifiedBody)
+	require.Nil(t, err)
+	assert.Equal(t, "         1        6101USD          -25002026-03-01\r\n", string(plain))
+	assert.Equal(t, "balances_20260301.txt", md.LiteralData.FileName)
+
+	_, err = newExporter(&Config{ExportFormat: "xml"}, newMemoryStorage(), nil)
+	assert.Error(t, err)
+}
+
+func TestFixedWidthRecordTruncates(t *testing.T) {
+	columns := []exportColumn{{"a", 3, false}, {"b", 4, true}}
+	assert.Equal(t, "ab    7", fixedWidthRecord(columns, []string{"ab", "7"}))
+	assert.Equal(t, "déf1234", fixedWidthRecord(columns, []string{"déf\nghi", "1234"}))
+	assert.Equal(t, 7, len([]rune(fixedWidthRecord(columns, []string{strings.Repeat("x", 10), "1"}))))
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// External transfers send money to an account at another bank over a
+// simulated ACH or wire rail. The amount is booked out against the external
+// clearing ledger straight away and the transfer stays pending until the
+// settlement job picks it up, EXTERNAL_ACH_SETTLEMENT_DELAY or
+// EXTERNAL_WIRE_SETTLEMENT_DELAY after it was made. The simulated receiving
+// bank then either accepts it, it's settled, or returns it with an ACH
+// return code and the amount is booked back in.
+//
+// Destination account numbers ending in 0002, 0003 or 0004 are returned with
+// R02 (account closed), R03 (no account) and R04 (invalid account number),
+// every other transfer settles. Each status change is published as an
+// account event, so webhook subscriptions see it like balance changes.
+//
+// Only the token's (or API key's) own account sends, under the checks of
+// customer transfers: the transaction PIN, email verification and the daily
+// and KYC limits, which external transfers count towards. The fraud rules
+// screen them as well, transfers to the same routing and account number
+// count as the same beneficiary. They can't be held, so a review blocks
+// them too. The debit and the transfer are written in one transaction.
+
+const (
+	TransferKindExternal       = "external_transfer"
+	TransferKindExternalReturn = "external_return"
+	LedgerExternalClearing     = "clearing:external"
+
+	RailACH  = "ach"
+	RailWire = "wire"
+
+	ExternalPending  = "pending"
+	ExternalSettled  = "settled"
+	ExternalReturned = "returned"
+)
+
+// Returns of the simulated receiving bank by the destination account number's last four digits
+var simulatedReturns = map[string]string{
+	"0002": "R02",
+	"0003": "R03",
+	"0004": "R04",
+}
+
+type ExternalTransfer struct {
+	ID              int        `json:"id"`
+	Reference       string     `json:"reference"`
+	AccountID       int        `json:"account_id"`
+	Rail            string     `json:"rail"`
+	RoutingNumber   string     `json:"routing_number"`
+	AccountNumber   string     `json:"account_number"`
+	BeneficiaryName string     `json:"beneficiary_name"`
+	Amount          float64    `json:"amount"`
+	Currency        string     `json:"currency"`
+	Memo            string     `json:"memo,omitempty"`
+	Status          string     `json:"status"`
+	ReturnCode      string     `json:"return_code,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	SettlesAt       time.Time  `json:"settles_at"`
+	ResolvedAt      *time.Time `json:"resolved_at,omitempty"`
+}
+
+type ExternalTransferRequest struct {
+	FromAccountNumber int64   `json:"fromAccount" validate:"required,positive"`
+	Rail              string  `json:"rail" validate:"required,oneof=ach wire"`
+	RoutingNumber     string  `json:"routingNumber" validate:"required,min=9,max=9"`
+	AccountNumber     string  `json:"accountNumber" validate:"required,min=4,max=17"`
+	BeneficiaryName   string  `json:"beneficiaryName" validate:"required,max=100"`
+	Amount            float64 `json:"amount" validate:"positive"`
+	Memo              string  `json:"memo,omitempty" validate:"max=140"`
+	PIN               string  `json:"pin,omitempty" validate:"numeric,min=4,max=6"`
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// validRoutingNumber checks an ABA routing number's checksum digit
+func validRoutingNumber(number string) bool {
+	if len(number) != 9 || !isDigits(number) {
+		return false
+	}
+	weights := [3]int{3, 7, 1}
+	sum := 0
+	for i := range number {
+		sum += int(number[i]-'0') * weights[i%3]
+	}
+	return sum%10 == 0
+}
+
+func (s *APIServer) settlementDelay(rail string) time.Duration {
+	if rail == RailWire {
+		return s.config.ExternalWireSettlementDelay
+	}
+	return s.config.ExternalACHSettlementDelay
+}
+
+// POST /transfer/external, from the token's account
+func (s *APIServer) handleExternalTransfer(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	acc, r, err := s.tokenAccount(r)
+	if err != nil {
+		return err
+	}
+	var req ExternalTransferRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+	if req.FromAccountNumber != acc.Number {
+		return newHTTPError(http.StatusForbidden, "PERMISSION_DENIED", "transfers can only be sent from your own account")
+	}
+	if !validRoutingNumber(req.RoutingNumber) {
+		return invalidField("routingNumber", "checksum", "not a valid ABA routing number")
+	}
+	if !isDigits(req.AccountNumber) {
+		return invalidField("accountNumber", "numeric", "must only contain digits")
+	}
+
+	t, err := s.sendExternalTransfer(r.Context(), req, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusAccepted, t)
+}
+
+func (s *APIServer) sendExternalTransfer(ctx context.Context, req ExternalTransferRequest, actor string) (*ExternalTransfer, error) {
+	acc, err := s.store.GetAccountByNumber(ctx, req.FromAccountNumber)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAccountUsable(acc); err != nil {
+		return nil, err
+	}
+	if err := checkEmailVerified(acc); err != nil {
+		return nil, err
+	}
+
+	amount := toCents(req.Amount)
+	if err := checkTransactionPIN(ctx, s.store, s.transferLimits.PIN, acc, amount, req.PIN); err != nil {
+		return nil, err
+	}
+	sent, err := s.store.GetExternalTransfers(ctx, acc.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkExternalLimits(ctx, acc, sent, amount); err != nil {
+		return nil, err
+	}
+	reference := newTransferReference()
+	action, err := s.screenExternal(ctx, acc, req, sent, reference)
+	if err != nil {
+		return nil, err
+	}
+	if action != FraudActionAllow {
+		return nil, ErrTransferBlocked
+	}
+
+	available, err := spendable(ctx, s.store, acc)
+	if err != nil {
+		return nil, err
+	}
+	if amount > available {
+		return nil, fmt.Errorf("%w: %.2f available", ErrInsufficientFunds, float64(available)/100)
+	}
+
+	now := time.Now().UTC()
+	t := &ExternalTransfer{
+		Reference:       reference,
+		AccountID:       acc.ID,
+		Rail:            req.Rail,
+		RoutingNumber:   req.RoutingNumber,
+		AccountNumber:   req.AccountNumber,
+		BeneficiaryName: strings.TrimSpace(req.BeneficiaryName),
+		Amount:          req.Amount,
+		Currency:        acc.Currency,
+		Memo:            req.Memo,
+		Status:          ExternalPending,
+		CreatedAt:       now,
+		SettlesAt:       now.Add(s.settlementDelay(req.Rail)),
+	}
+
+	ctx = withTransferReference(ctx, t.Reference)
+	for attempt := 1; ; attempt++ {
+		if acc, err = s.store.GetAccountbyID(ctx, acc.ID); err != nil {
+			return nil, err
+		}
+		err = s.openExternal(ctx, t, acc)
+		if !errors.Is(err, ErrConflict) || attempt == transferConflictRetries {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	auditBalanceChange(ctx, s.store, actor, acc, -amount)
+	publishExternalTransfer(ctx, s.store, t)
+	return t, nil
+}
+
+// openExternal books t's amount out of acc and records t in one transaction
+func (s *APIServer) openExternal(ctx context.Context, t *ExternalTransfer, acc *Account) error {
+	tx, err := s.store.BeginTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.store.PostLedgerEntry(ctx, externalEntry(ctx, t, TransferKindExternal, acc, -toCents(t.Amount)), tx); err != nil {
+		return err
+	}
+	if err := s.store.CreateExternalTransfer(ctx, t, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// checkExternalLimits applies the daily and KYC limits with the external
+// transfers sent today on top of the customer transfers, returns don't count
+func (s *APIServer) checkExternalLimits(ctx context.Context, acc *Account, sent []*ExternalTransfer, amount int64) error {
+	today, err := accountDay(ctx, s.store, acc.ID, time.Now())
+	if err != nil {
+		return err
+	}
+	usage, err := s.store.GetDailyTransferUsage(ctx, acc.ID, today)
+	if err != nil {
+		return fmt.Errorf("could not load transfer usage: %v", err)
+	}
+	for _, t := range sent {
+		if t.Status != ExternalReturned && !t.CreatedAt.Before(today) {
+			usage.Amount += toCents(t.Amount)
+			usage.Count++
+		}
+	}
+
+	limits, err := kycLimits(ctx, s.store, s.transferLimits, acc.ID)
+	if err != nil {
+		return err
+	}
+	return limits.Check(*usage, amount)
+}
+
+// screenExternal runs the fraud rules over the account's customer and
+// external transfers and records the decision under reference
+func (s *APIServer) screenExternal(ctx context.Context, acc *Account, req ExternalTransferRequest, sent []*ExternalTransfer, reference string) (string, error) {
+	rules := s.transferLimits.Fraud
+	if !rules.enabled() {
+		return FraudActionAllow, nil
+	}
+
+	since := time.Now().Add(-rules.VelocityWindow)
+	history, err := s.store.GetTransferHistory(ctx, acc.ID, 0, since)
+	if err != nil {
+		return "", fmt.Errorf("could not load transfer history: %v", err)
+	}
+	total := history.Average * int64(history.Count)
+	for _, t := range sent {
+		history.Count++
+		total += toCents(t.Amount)
+		if !t.CreatedAt.Before(since) {
+			history.Recent++
+		}
+		if t.RoutingNumber == req.RoutingNumber && t.AccountNumber == req.AccountNumber {
+			history.PaidBefore = true
+		}
+	}
+	if history.Count > 0 {
+		history.Average = total / int64(history.Count)
+	}
+
+	action, matched := rules.evaluate(history, toCents(req.Amount))
+	decision := &FraudDecision{
+		Reference:   reference,
+		AccountID:   acc.ID,
+		FromAccount: acc.Number,
+		Amount:      req.Amount,
+		Action:      action,
+		Rules:       matched,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if err := s.store.CreateFraudDecision(ctx, decision); err != nil {
+		log.Printf("Failed to record the fraud decision on external transfer %s: %v", reference, err)
+	}
+	if action != FraudActionAllow {
+		log.Printf("External transfer %s from %d matched fraud rules %v, action %s", reference, acc.Number, matched, action)
+	}
+	return action, nil
+}
+
+// externalEntry moves amount into (or out of, when negative) acc against the
+// external clearing ledger
+func externalEntry(ctx context.Context, t *ExternalTransfer, kind string, acc *Account, amount int64) *LedgerEntry {
+	entry := newLedgerEntry(ctx, kind).
+		account(acc, amount).
+		ledger(LedgerExternalClearing, t.Currency, -amount)
+	entry.Memo = fmt.Sprintf("%s to %s %s", strings.ToUpper(t.Rail), t.RoutingNumber, t.AccountNumber)
+	return entry
+}
+
+// bookExternal books amount into t's account on its own, returns go through it
+func (s *APIServer) bookExternal(ctx context.Context, t *ExternalTransfer, kind string, amount int64, actor string) error {
+	var before Account
+	err := postWithRetry(ctx, s.store, t.AccountID, func(acc *Account) *LedgerEntry {
+		before = *acc
+		return externalEntry(ctx, t, kind, acc, amount)
+	})
+	if err != nil {
+		return err
+	}
+	auditBalanceChange(ctx, s.store, actor, &before, amount)
+	return nil
+}
+
+// publishExternalTransfer tells the account's subscribers about the transfer's status
+func publishExternalTransfer(ctx context.Context, store Storage, t *ExternalTransfer) {
+	acc, err := store.GetAccountbyID(ctx, t.AccountID)
+	if err != nil {
+		log.Printf("Failed to load account %d for external transfer %d: %v", t.AccountID, t.ID, err)
+		return
+	}
+
+	event := &AccountEvent{
+		AccountID: t.AccountID,
+		Type:      "external_transfer_" + t.Status,
+		Direction: DirectionDebit,
+		Amount:    t.Amount,
+		Balance:   float64(acc.Balance) / 100,
+		Currency:  t.Currency,
+		Reference: t.Reference,
+		CreatedAt: time.Now().UTC(),
+	}
+	if t.Status == ExternalReturned {
+		event.Direction = DirectionCredit
+	}
+
+	if err := store.RecordAccountEvent(ctx, event); err != nil {
+		log.Printf("Failed to record %s event for account %d: %v", event.Type, event.AccountID, err)
+		return
+	}
+	accountEvents.notify(event.AccountID)
+}
+
+// GET /account/{id}/external-transfers
+func (s *APIServer) handleGetExternalTransfers(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	transfers, err := s.forRequest(r).store.GetExternalTransfers(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, transfers)
+}
+
+// externalSettlementJob hands due transfers to the simulated receiving bank
+func (s *APIServer) externalSettlementJob() Job {
+	return Job{
+		Name:     "external-settlement",
+		Interval: s.config.SchedulerInterval,
+		Run: func(ctx context.Context) error {
+			now := time.Now().UTC()
+			due, err := s.store.GetDueExternalTransfers(ctx, now, 100)
+			if err != nil {
+				return err
+			}
+			setJobQueueDepth("external_settlement", len(due))
+
+			for _, t := range due {
+				if err := s.settleExternalTransfer(ctx, t, now); err != nil {
+					log.Printf("Failed to settle external transfer %d: %v", t.ID, err)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+func (s *APIServer) settleExternalTransfer(ctx context.Context, t *ExternalTransfer, now time.Time) error {
+	code := simulatedReturns[t.AccountNumber[len(t.AccountNumber)-4:]]
+
+	// Claiming the outcome keeps other instances off the transfer
+	t.ResolvedAt = &now
+	t.Status, t.ReturnCode = ExternalSettled, code
+	if code != "" {
+		t.Status = ExternalReturned
+	}
+	claimed, err := s.store.ResolveExternalTransfer(ctx, t, ExternalPending)
+	if err != nil || !claimed {
+		return err
+	}
+
+	if t.Status == ExternalReturned {
+		ctx = withTransferReference(ctx, t.Reference)
+		if err := s.bookExternal(ctx, t, TransferKindExternalReturn, toCents(t.Amount), "external-settlement"); err != nil {
+			// Back to pending, the next run books the return again
+			t.Status, t.ReturnCode, t.ResolvedAt = ExternalPending, "", nil
+			if _, revertErr := s.store.ResolveExternalTransfer(ctx, t, ExternalReturned); revertErr != nil {
+				log.Printf("External transfer %d is marked returned but wasn't booked back: %v", t.ID, revertErr)
+			}
+			return err
+		}
+	}
+	publishExternalTransfer(ctx, s.store, t)
+	return nil
+}
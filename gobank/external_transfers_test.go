@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidRoutingNumber(t *testing.T) {
+	assert.True(t, validRoutingNumber("021000021"))
+	assert.True(t, validRoutingNumber("011000015"))
+	assert.False(t, validRoutingNumber("021000022"))
+	assert.False(t, validRoutingNumber("02100002"))
+	assert.False(t, validRoutingNumber("02100002a"))
+}
+
+func sendExternal(t *testing.T, s *APIServer, acc *Account, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/transfer/external", strings.NewReader(body))
+	if acc != nil {
+		token, err := createJWT(acc)
+		require.Nil(t, err)
+		r.Header.Set("x-jwt-token", token)
+	}
+	w := httptest.NewRecorder()
+	makeHTTPHandle(s.handleExternalTransfer)(w, r)
+	return w
+}
+
+func TestExternalTransfers(t *testing.T) {
+	t.Setenv("JWT_SECRET", "external-secret")
+	ctx := context.Background()
+	store := newMemoryStorage()
+	acc := &Account{Number: 5401, Balance: 10000, Currency: "USD", Status: AccountActive}
+	require.Nil(t, store.CreateAccount(ctx, acc))
+	s := NewAPIServer(&Config{ExternalACHSettlementDelay: time.Hour}, store)
+
+	send := func(body string) *httptest.ResponseRecorder {
+		return sendExternal(t, s, acc, body)
+	}
+	request := func(rail, account, amount string) string {
+		return `{"fromAccount": 5401, "rail": "` + rail + `", "routingNumber": "021000021", "accountNumber": "` + account +
+			`", "beneficiaryName": "Jane Doe", "amount": ` + amount + `}`
+	}
+
+	w := send(strings.Replace(request(RailACH, "123456789", "10"), "021000021", "021000022", 1))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), `"field":"/routingNumber"`)
+	assert.Equal(t, http.StatusUnprocessableEntity, send(request(RailACH, "12-3456", "10")).Code)
+	assert.Equal(t, http.StatusBadRequest, send(request(RailACH, "123456789", "500")).Code, "more than the balance")
+
+	// Booked out straight away, wires settle without delay here
+	require.Equal(t, http.StatusAccepted, send(request(RailACH, "123456789", "30")).Code)
+	require.Equal(t, http.StatusAccepted, send(request(RailWire, "550000003", "20")).Code)
+	assert.Equal(t, int64(5000), mustAccount(t, store, acc.ID).Balance)
+
+	require.Nil(t, s.externalSettlementJob().Run(ctx))
+	transfers, err := store.GetExternalTransfers(ctx, acc.ID)
+	require.Nil(t, err)
+	require.Len(t, transfers, 2)
+	wire, ach := transfers[0], transfers[1]
+	assert.Equal(t, ExternalReturned, wire.Status)
+	assert.Equal(t, "R03", wire.ReturnCode)
+	assert.Equal(t, ExternalPending, ach.Status)
+	assert.Equal(t, int64(7000), mustAccount(t, store, acc.ID).Balance, "the return is booked back in")
+	assert.Equal(t, TransferKindExternalReturn, store.entries[len(store.entries)-1].Kind)
+
+	store.external[0].SettlesAt = time.Now().Add(-time.Minute)
+	require.Nil(t, s.externalSettlementJob().Run(ctx))
+	transfers, _ = store.GetExternalTransfers(ctx, acc.ID)
+	assert.Equal(t, ExternalSettled, transfers[1].Status)
+	assert.Equal(t, int64(7000), mustAccount(t, store, acc.ID).Balance)
+
+	// Each status change is an event webhooks can filter on
+	events, err := store.GetAccountEvents(ctx, acc.ID, 0, 100)
+	require.Nil(t, err)
+	var types []string
+	for _, e := range events {
+		if e.Type != EventBalanceChanged {
+			types = append(types, e.Type)
+		}
+	}
+	assert.Equal(t, []string{EventExternalTransferPending, EventExternalTransferPending, EventExternalTransferReturned, EventExternalTransferSettled}, types)
+
+	filter, err := parseEventFilter("type = external_transfer_returned")
+	require.Nil(t, err)
+	assert.True(t, filter.Matches(&AccountEvent{Type: EventExternalTransferReturned}))
+	assert.False(t, filter.Matches(&AccountEvent{Type: EventExternalTransferSettled}))
+}
+
+func TestExternalTransferChecks(t *testing.T) {
+	t.Setenv("JWT_SECRET", "external-secret")
+	ctx := context.Background()
+	store := newMemoryStorage()
+	acc, err := NewAccount("Ext", "Sender", "password")
+	require.Nil(t, err)
+	acc.Number, acc.Balance, acc.EmailVerified = 5411, 100000, true
+	require.Nil(t, store.CreateAccount(ctx, acc))
+	other := &Account{Number: 5412, Currency: "USD", Status: AccountActive, Email: "other@example.com"}
+	require.Nil(t, store.CreateAccount(ctx, other))
+
+	s := NewAPIServer(&Config{TransactionPINThreshold: 100, DailyTransferAmount: 500,
+		FraudNewBeneficiaryAmount: 200, FraudNewBeneficiaryAction: FraudActionBlock}, store)
+	require.Nil(t, s.accounts().SetPIN(ctx, acc.ID, SetPINRequest{PIN: "1234", Password: "password"}, "account:5411"))
+	request := func(from int64, account, amount, pin string) string {
+		return `{"fromAccount": ` + strconv.FormatInt(from, 10) + `, "rail": "ach", "routingNumber": "021000021", "accountNumber": "` + account +
+			`", "beneficiaryName": "Jane Doe", "amount": ` + amount + `, "pin": "` + pin + `"}`
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, sendExternal(t, s, nil, request(5411, "123456789", "10", "")).Code)
+	assert.Equal(t, http.StatusForbidden, sendExternal(t, s, other, request(5411, "123456789", "10", "")).Code, "only from the token's account")
+	w := sendExternal(t, s, other, request(5412, "123456789", "10", ""))
+	assert.Contains(t, w.Body.String(), "EMAIL_NOT_VERIFIED")
+
+	w = sendExternal(t, s, acc, request(5411, "123456789", "150", ""))
+	assert.Contains(t, w.Body.String(), "PIN_REQUIRED")
+	require.Equal(t, http.StatusAccepted, sendExternal(t, s, acc, request(5411, "123456789", "150", "1234")).Code)
+
+	// Paying a new beneficiary this much is blocked, the one paid before isn't
+	w = sendExternal(t, s, acc, request(5411, "987654321", "250", "1234"))
+	assert.Contains(t, w.Body.String(), "TRANSFER_BLOCKED")
+	require.Equal(t, http.StatusAccepted, sendExternal(t, s, acc, request(5411, "123456789", "250", "1234")).Code)
+
+	w = sendExternal(t, s, acc, request(5411, "123456789", "150", "1234"))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "external transfers count towards the daily limit")
+
+	// Every transfer has its debit and nothing else was booked
+	assert.Equal(t, int64(100000-15000-25000), mustAccount(t, store, acc.ID).Balance)
+	require.Len(t, store.external, 2)
+	var booked []string
+	for _, e := range store.entries {
+		if e.Kind == TransferKindExternal {
+			booked = append(booked, e.Reference)
+		}
+	}
+	assert.Equal(t, []string{store.external[0].Reference, store.external[1].Reference}, booked)
+}
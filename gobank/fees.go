@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Fees are charged from a schedule per currency, kept in fee_schedule with
+// every change as a new row. A schedule has a monthly maintenance fee, a fee
+// for ending the month below a minimum balance, and tiers of transfer fees
+// by amount. The fee job charges the monthly fees for the previous month,
+// at most once per account, kind and month like overdraft fees are per day.
+// Monthly fees take no more than the balance of an account without an
+// overdraft. Transfer fees are charged in each customer transfer's own
+// ledger entry, so a transfer never settles without its fee. All fees are
+// posted to the ledger against income:fees. Changing a schedule needs
+// admin approvals, see multisig.go. Amounts are in cents like
+// Account.Balance.
+
+const (
+	FeeMaintenance  = "maintenance_fee"
+	FeeBelowMinimum = "below_minimum_fee"
+
+	LedgerFees = "income:fees"
+)
+
+type FeeSchedule struct {
+	ID              int       `json:"id"`
+	Currency        string    `json:"currency"`
+	MonthlyFee      int64     `json:"monthly_fee"`
+	MinimumBalance  int64     `json:"minimum_balance"`
+	BelowMinimumFee int64     `json:"below_minimum_fee"`
+	TransferTiers   []FeeTier `json:"transfer_tiers"`
+	CreatedBy       string    `json:"created_by"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// FeeTier applies to transfers up to UpTo cents, the last tier has no upper bound
+type FeeTier struct {
+	UpTo int64   `json:"up_to,omitempty"`
+	Flat int64   `json:"flat"`
+	Rate float64 `json:"rate"`
+}
+
+// FeeCharge records a monthly fee so it's charged once per period
+type FeeCharge struct {
+	ID        int       `json:"id"`
+	AccountID int       `json:"account_id"`
+	Kind      string    `json:"kind"`
+	Period    time.Time `json:"period"`
+	Amount    int64     `json:"amount"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type SetFeeScheduleRequest struct {
+	MonthlyFee      float64          `json:"monthly_fee" validate:"min=0"`
+	MinimumBalance  float64          `json:"minimum_balance" validate:"min=0"`
+	BelowMinimumFee float64          `json:"below_minimum_fee" validate:"min=0"`
+	TransferTiers   []FeeTierRequest `json:"transfer_tiers"`
+}
+
+type FeeTierRequest struct {
+	UpTo float64 `json:"up_to" validate:"min=0"`
+	Flat float64 `json:"flat" validate:"min=0"`
+	Rate float64 `json:"rate" validate:"min=0,max=1"`
+}
+
+// tier picks the first tier covering amount
+func (fs *FeeSchedule) tier(amount int64) *FeeTier {
+	for i := range fs.TransferTiers {
+		if t := &fs.TransferTiers[i]; t.UpTo == 0 || amount <= t.UpTo {
+			return t
+		}
+	}
+	return nil
+}
+
+// transferFee is the flat part of the amount's tier plus its rate, in whole cents
+func (fs *FeeSchedule) transferFee(amount int64) int64 {
+	t := fs.tier(amount)
+	if t == nil {
+		return 0
+	}
+	return t.Flat + int64(math.Round(float64(amount)*t.Rate))
+}
+
+// schedule validates the request and converts it to cents, tiers must
+// rise and only the last may be unbounded
+func (req SetFeeScheduleRequest) schedule(currency string) (*FeeSchedule, error) {
+	fs := &FeeSchedule{
+		Currency:        currency,
+		MonthlyFee:      toCents(req.MonthlyFee),
+		MinimumBalance:  toCents(req.MinimumBalance),
+		BelowMinimumFee: toCents(req.BelowMinimumFee),
+		TransferTiers:   []FeeTier{},
+	}
+	for i, t := range req.TransferTiers {
+		tier := FeeTier{UpTo: toCents(t.UpTo), Flat: toCents(t.Flat), Rate: t.Rate}
+		last := i == len(req.TransferTiers)-1
+		if tier.UpTo == 0 && !last {
+			return nil, invalidField(fmt.Sprintf("transfer_tiers/%d/up_to", i), "required", "only the last tier may leave up_to unset")
+		}
+		if i > 0 && tier.UpTo != 0 && tier.UpTo <= fs.TransferTiers[i-1].UpTo {
+			return nil, invalidField(fmt.Sprintf("transfer_tiers/%d/up_to", i), "ascending", "tiers must be in ascending order of up_to")
+		}
+		fs.TransferTiers = append(fs.TransferTiers, tier)
+	}
+	return fs, nil
+}
+
+// feeSchedule loads the currency's schedule, currencies without one are free
+func feeSchedule(ctx context.Context, store Storage, currency string) (*FeeSchedule, error) {
+	fs, err := store.GetFeeSchedule(ctx, currency)
+	if errors.Is(err, ErrFeeScheduleNotFound) {
+		return &FeeSchedule{Currency: currency}, nil
+	}
+	return fs, err
+}
+
+// transferFee is what a customer transfer of amount cents from acc costs
+func (s *transferService) transferFee(ctx context.Context, acc *Account, amount int64) (int64, error) {
+	if transferKind(ctx) != TransferKindTransfer {
+		return 0, nil
+	}
+	fs, err := feeSchedule(ctx, s.store, acc.Currency)
+	if err != nil {
+		return 0, fmt.Errorf("could not load fee schedule: %v", err)
+	}
+	return fs.transferFee(amount), nil
+}
+
+type feeRunner struct {
+	store Storage
+}
+
+func (s *APIServer) feeJob() Job {
+	runner := &feeRunner{store: s.store}
+
+	return Job{
+		Name:     "fees",
+		Interval: s.config.SchedulerInterval,
+		Run: func(ctx context.Context) error {
+			return runner.run(ctx, time.Now().UTC())
+		},
+	}
+}
+
+// run charges last month's fees to the accounts that were open through it
+func (f *feeRunner) run(ctx context.Context, now time.Time) error {
+	periodEnd := startOfMonth(now.UTC())
+	period := periodEnd.AddDate(0, -1, 0)
+
+	accounts, err := f.store.GetAccounts(ctx)
+	if err != nil {
+		return err
+	}
+	setJobQueueDepth("fees", len(accounts))
+
+	schedules := map[string]*FeeSchedule{}
+	for _, acc := range accounts {
+		if acc.Status == AccountClosed || !acc.CreatedAt.Before(periodEnd) {
+			continue
+		}
+		fs, ok := schedules[acc.Currency]
+		if !ok {
+			if fs, err = feeSchedule(ctx, f.store, acc.Currency); err != nil {
+				return err
+			}
+			schedules[acc.Currency] = fs
+		}
+
+		if err := f.charge(ctx, acc, FeeMaintenance, fs.MonthlyFee, period, now); err != nil {
+			log.Printf("Failed to charge %s to account %d: %v", FeeMaintenance, acc.ID, err)
+		}
+		if fs.BelowMinimumFee == 0 {
+			continue
+		}
+		closing, err := f.store.GetBalanceAt(ctx, acc.ID, periodEnd)
+		if err != nil {
+			log.Printf("Failed to load the closing balance of account %d: %v", acc.ID, err)
+			continue
+		}
+		if closing < fs.MinimumBalance {
+			if err := f.charge(ctx, acc, FeeBelowMinimum, fs.BelowMinimumFee, period, now); err != nil {
+				log.Printf("Failed to charge %s to account %d: %v", FeeBelowMinimum, acc.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (f *feeRunner) charge(ctx context.Context, acc *Account, kind string, amount int64, period, now time.Time) error {
+	if amount == 0 {
+		return nil
+	}
+
+	// Earlier charges in this run moved the balance, post against a fresh version
+	acc, err := f.store.GetAccountbyID(ctx, acc.ID)
+	if err != nil {
+		return err
+	}
+	// Without an overdraft the balance can't go below zero, see balanceCheck
+	if acc.OverdraftLimit == 0 {
+		if amount = min(amount, max(acc.Balance, 0)); amount == 0 {
+			return nil
+		}
+	}
+
+	tx, err := f.store.BeginTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	charged, err := f.store.RecordFeeCharge(ctx, &FeeCharge{
+		AccountID: acc.ID,
+		Kind:      kind,
+		Period:    period,
+		Amount:    amount,
+		CreatedAt: now,
+	}, tx)
+	if err != nil || !charged {
+		return err
+	}
+
+	entry := newLedgerEntry(ctx, kind).
+		account(acc, -amount).
+		ledger(LedgerFees, acc.Currency, amount)
+	entry.Memo = fmt.Sprintf("%s %s", strings.ReplaceAll(kind, "_", " "), period.Format("January 2006"))
+	if err := f.store.PostLedgerEntry(ctx, entry, tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	auditBalanceChange(ctx, f.store, "fees", acc, -amount)
+	return nil
+}
+
+// runFeeSchedule stores an approved fee schedule
+func runFeeSchedule(ctx context.Context, s *APIServer, raw json.RawMessage) (any, error) {
+	var fs FeeSchedule
+	if err := json.Unmarshal(raw, &fs); err != nil {
+		return nil, err
+	}
+	fs.CreatedAt = time.Now().UTC()
+	if err := s.store.SaveFeeSchedule(ctx, &fs); err != nil {
+		return nil, err
+	}
+	return &fs, nil
+}
+
+// GET /admin/fees, the current schedule of each currency
+func (s *APIServer) handleGetFeeSchedules(w http.ResponseWriter, r *http.Request) error {
+	schedules, err := s.forRequest(r).store.GetFeeSchedules(r.Context())
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, schedules)
+}
+
+func feeScheduleCurrency(r *http.Request) (string, error) {
+	currency := strings.ToUpper(mux.Vars(r)["currency"])
+	if !validCurrency.MatchString(currency) {
+		return "", invalidParam("path", "currency", "iso4217", "must be a three letter currency code")
+	}
+	return currency, nil
+}
+
+// GET /admin/fees/{currency}
+func (s *APIServer) handleGetFeeSchedule(w http.ResponseWriter, r *http.Request) error {
+	currency, err := feeScheduleCurrency(r)
+	if err != nil {
+		return err
+	}
+
+	fs, err := feeSchedule(r.Context(), s.forRequest(r).store, currency)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, fs)
+}
+
+// PUT /admin/fees/{currency}, a new schedule always needs approval
+func (s *APIServer) handleSetFeeSchedule(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+	currency, err := feeScheduleCurrency(r)
+	if err != nil {
+		return err
+	}
+
+	var req SetFeeScheduleRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+	fs, err := req.schedule(currency)
+	if err != nil {
+		return err
+	}
+	fs.CreatedBy = auditActor(r, s.config)
+
+	op, err := s.requestOperation(r.Context(), "fee_schedule", fs, fs.CreatedBy)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusAccepted, op)
+}
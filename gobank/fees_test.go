@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFeeScheduleTiers(t *testing.T) {
+	_, err := SetFeeScheduleRequest{TransferTiers: []FeeTierRequest{{Flat: 1}, {UpTo: 100}}}.schedule("USD")
+	assert.NotNil(t, err, "only the last tier is unbounded")
+	_, err = SetFeeScheduleRequest{TransferTiers: []FeeTierRequest{{UpTo: 100}, {UpTo: 50}}}.schedule("USD")
+	assert.NotNil(t, err)
+
+	fs, err := SetFeeScheduleRequest{TransferTiers: []FeeTierRequest{{UpTo: 100}, {UpTo: 1000, Flat: 0.5}, {Flat: 1, Rate: 0.001}}}.schedule("USD")
+	require.Nil(t, err)
+	assert.Equal(t, int64(0), fs.transferFee(10000))
+	assert.Equal(t, int64(50), fs.transferFee(10001))
+	assert.Equal(t, int64(300), fs.transferFee(200000))
+}
+
+func TestFees(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9701, Balance: 100000, Currency: "USD", EmailVerified: true}))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9702, Balance: 2000, Currency: "USD"}))
+	require.Nil(t, store.SaveFeeSchedule(ctx, &FeeSchedule{
+		Currency:        "USD",
+		MonthlyFee:      300,
+		MinimumBalance:  5000,
+		BelowMinimumFee: 1000,
+		TransferTiers:   []FeeTier{{UpTo: 10000}, {Flat: 25, Rate: 0.01}},
+	}))
+
+	s := NewAPIServer(&Config{}, store)
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	transfer := func(amount float64) (*TransferReceipt, error) {
+		receipt, _, err := s.transfers().Transfer(ctx, TransferRequest{FromAccountNumber: 9701, ToAccountNumber: 9702, Amount: amount}, engine, "account:9701")
+		return receipt, err
+	}
+
+	receipt, err := transfer(50)
+	require.Nil(t, err)
+	assert.Zero(t, receipt.Fee, "within the free tier")
+	receipt, err = transfer(500)
+	require.Nil(t, err)
+	assert.Equal(t, 5.25, receipt.Fee)
+	assert.Equal(t, int64(100000-5000-50000-525), store.accounts[1].Balance)
+
+	// The fee is part of the transfer's own entry, not posted after it
+	entry := store.entries[len(store.entries)-1]
+	assert.Equal(t, TransferKindTransfer, entry.Kind)
+	assert.Equal(t, receipt.Reference, entry.Reference)
+	assert.Contains(t, entry.Postings, Posting{LedgerAccount: LedgerFees, Currency: "USD", Amount: 525})
+
+	// The fee has to fit in the available balance as well
+	_, err = transfer(445)
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+
+	w := httptest.NewRecorder()
+	makeHTTPHandle(s.handleFeeCalculator)(w, httptest.NewRequest("GET", "/v1/calculators/fees?type=transfer&amount=500", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	preview := &FeePreview{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), preview))
+	assert.Equal(t, receipt.Fee, preview.Fee)
+
+	// Monthly fees are charged once per month, below the minimum costs extra
+	runner := &feeRunner{store: store}
+	next := startOfMonth(time.Now().UTC()).AddDate(0, 1, 2)
+	require.Nil(t, runner.run(ctx, next))
+	require.Nil(t, runner.run(ctx, next.Add(time.Hour)))
+	assert.Equal(t, int64(44475-300), store.accounts[1].Balance)
+	assert.Equal(t, int64(57000-300), store.accounts[2].Balance)
+
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9703, Balance: 1000, Currency: "USD"}))
+	require.Nil(t, runner.run(ctx, next))
+	assert.Equal(t, int64(0), store.accounts[3].Balance, "fees stop at zero without an overdraft")
+	assert.Len(t, store.charges, 4)
+}
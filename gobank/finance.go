@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Bank-level reports for finance. There are no ledger postings yet, so the
+// trial balance is derived from customer balances, accrued overdraft fees
+// and cashback paid, with the settlement line as the balancing entry for
+// funds held against customer balances. Customer balances aren't kept per
+// day, the finance-snapshot job records each currency's totals instead. All
+// amounts are in cents and reported per currency.
+
+const (
+	LedgerAsset     = "asset"
+	LedgerLiability = "liability"
+	LedgerIncome    = "income"
+	LedgerExpense   = "expense"
+)
+
+type BalanceTotal struct {
+	Currency   string `json:"currency"`
+	Deposits   int64  `json:"deposits"`
+	Overdrafts int64  `json:"overdrafts"`
+}
+
+type DailyIncome struct {
+	Day             time.Time `json:"day"`
+	Currency        string    `json:"currency"`
+	FeeIncome       int64     `json:"fee_income"`
+	CashbackExpense int64     `json:"cashback_expense"`
+}
+
+type LiabilitySnapshot struct {
+	Day        time.Time `json:"day"`
+	Currency   string    `json:"currency"`
+	Deposits   int64     `json:"deposits"`
+	Overdrafts int64     `json:"overdrafts"`
+	TakenAt    time.Time `json:"taken_at"`
+}
+
+type TrialBalanceLine struct {
+	Account  string `json:"account"`
+	Type     string `json:"type"`
+	Currency string `json:"currency"`
+	Debit    int64  `json:"debit"`
+	Credit   int64  `json:"credit"`
+}
+
+type TrialBalance struct {
+	AsOf  time.Time          `json:"as_of"`
+	Lines []TrialBalanceLine `json:"lines"`
+}
+
+type FinanceDay struct {
+	Day             string `json:"day"`
+	Currency        string `json:"currency"`
+	FeeIncome       int64  `json:"fee_income"`
+	CashbackExpense int64  `json:"cashback_expense"`
+	NetIncome       int64  `json:"net_income"`
+	Deposits        *int64 `json:"deposits"` // nil when no snapshot was taken that day
+	Overdrafts      *int64 `json:"overdrafts"`
+}
+
+func balanceTotals(accounts []*Account) []*BalanceTotal {
+	byCurrency := map[string]*BalanceTotal{}
+	for _, acc := range accounts {
+		total, ok := byCurrency[acc.Currency]
+		if !ok {
+			total = &BalanceTotal{Currency: acc.Currency}
+			byCurrency[acc.Currency] = total
+		}
+		if acc.Balance > 0 {
+			total.Deposits += acc.Balance
+		} else {
+			total.Overdrafts -= acc.Balance
+		}
+	}
+
+	totals := make([]*BalanceTotal, 0, len(byCurrency))
+	for _, total := range byCurrency {
+		totals = append(totals, total)
+	}
+	sort.Slice(totals, func(i, j int) bool { return totals[i].Currency < totals[j].Currency })
+	return totals
+}
+
+// buildTrialBalance lists each currency's accounts, debits equal credits per currency
+func buildTrialBalance(asOf time.Time, totals []*BalanceTotal, income []*DailyIncome) *TrialBalance {
+	type book struct {
+		deposits, overdrafts, fees, cashback int64
+	}
+	books := map[string]*book{}
+	get := func(currency string) *book {
+		if b, ok := books[currency]; ok {
+			return b
+		}
+		books[currency] = &book{}
+		return books[currency]
+	}
+
+	for _, t := range totals {
+		b := get(t.Currency)
+		b.deposits += t.Deposits
+		b.overdrafts += t.Overdrafts
+	}
+	for _, day := range income {
+		b := get(day.Currency)
+		b.fees += day.FeeIncome
+		b.cashback += day.CashbackExpense
+	}
+
+	currencies := make([]string, 0, len(books))
+	for currency := range books {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+
+	tb := &TrialBalance{AsOf: asOf, Lines: []TrialBalanceLine{}}
+	for _, currency := range currencies {
+		b := books[currency]
+		settlement := b.deposits + b.fees - b.overdrafts - b.cashback
+
+		lines := []TrialBalanceLine{
+			{Account: "settlement", Type: LedgerAsset},
+			{Account: "customer_overdrafts", Type: LedgerAsset, Debit: b.overdrafts},
+			{Account: "customer_deposits", Type: LedgerLiability, Credit: b.deposits},
+			{Account: "overdraft_fee_income", Type: LedgerIncome, Credit: b.fees},
+			{Account: "cashback_expense", Type: LedgerExpense, Debit: b.cashback},
+		}
+		if settlement >= 0 {
+			lines[0].Debit = settlement
+		} else {
+			lines[0].Credit = -settlement
+		}
+
+		for _, line := range lines {
+			line.Currency = currency
+			tb.Lines = append(tb.Lines, line)
+		}
+	}
+
+	return tb
+}
+
+// buildFinanceDays joins income with the liability snapshot of the same day and currency
+func buildFinanceDays(income []*DailyIncome, snapshots []*LiabilitySnapshot) []*FinanceDay {
+	days := map[string]*FinanceDay{}
+	get := func(day time.Time, currency string) *FinanceDay {
+		key := day.Format("2006-01-02") + "/" + currency
+		if d, ok := days[key]; ok {
+			return d
+		}
+		days[key] = &FinanceDay{Day: day.Format("2006-01-02"), Currency: currency}
+		return days[key]
+	}
+
+	for _, in := range income {
+		d := get(in.Day, in.Currency)
+		d.FeeIncome += in.FeeIncome
+		d.CashbackExpense += in.CashbackExpense
+		d.NetIncome = d.FeeIncome - d.CashbackExpense
+	}
+	for _, snap := range snapshots {
+		d := get(snap.Day, snap.Currency)
+		deposits, overdrafts := snap.Deposits, snap.Overdrafts
+		d.Deposits, d.Overdrafts = &deposits, &overdrafts
+	}
+
+	result := make([]*FinanceDay, 0, len(days))
+	for _, d := range days {
+		result = append(result, d)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Day != result[j].Day {
+			return result[i].Day < result[j].Day
+		}
+		return result[i].Currency < result[j].Currency
+	})
+	return result
+}
+
+func (s *APIServer) financeSnapshotJob() Job {
+	return Job{
+		Name:     "finance-snapshot",
+		Interval: s.config.SchedulerInterval,
+		Run: func(ctx context.Context) error {
+			// Re-run through the day, the last snapshot taken stands for the day's close
+			now := time.Now().UTC()
+			totals, err := s.store.GetBalanceTotals(ctx)
+			if err != nil {
+				return err
+			}
+			for _, t := range totals {
+				snap := &LiabilitySnapshot{Day: startOfDay(now), Currency: t.Currency, Deposits: t.Deposits, Overdrafts: t.Overdrafts, TakenAt: now}
+				if err := s.store.RecordLiabilitySnapshot(ctx, snap); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+func wantsCSV(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "csv"
+}
+
+func writeCSV(w http.ResponseWriter, filename string, header []string, rows [][]string) error {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	if err := cw.WriteAll(rows); err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+func optionalCents(v *int64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatInt(*v, 10)
+}
+
+// GET /admin/finance/trial-balance, ?format=csv for accounting imports
+func (s *APIServer) handleTrialBalance(w http.ResponseWriter, r *http.Request) error {
+	store := s.forRequest(r).store
+	now := time.Now().UTC()
+
+	totals, err := store.GetBalanceTotals(r.Context())
+	if err != nil {
+		return err
+	}
+	income, err := store.GetDailyIncome(r.Context(), time.Time{}, now)
+	if err != nil {
+		return err
+	}
+	tb := buildTrialBalance(now, totals, income)
+
+	if wantsCSV(r) {
+		rows := make([][]string, len(tb.Lines))
+		for i, line := range tb.Lines {
+			rows[i] = []string{line.Account, line.Type, line.Currency, strconv.FormatInt(line.Debit, 10), strconv.FormatInt(line.Credit, 10)}
+		}
+		return writeCSV(w, "trial-balance-"+now.Format("2006-01-02")+".csv",
+			[]string{"account", "type", "currency", "debit", "credit"}, rows)
+	}
+
+	return WriteJSON(w, http.StatusOK, tb)
+}
+
+// GET /admin/finance/daily?from=2024-01-01&to=2024-01-31, both days
+// included, the last 30 days by default
+func (s *APIServer) handleFinanceDaily(w http.ResponseWriter, r *http.Request) error {
+	to := startOfDay(time.Now().UTC())
+	from := to.AddDate(0, 0, -29)
+	for param, day := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := r.URL.Query().Get(param); v != "" {
+			parsed, err := time.Parse("2006-01-02", v)
+			if err != nil {
+				return invalidParam("query", param, "type", "must be a date like 2006-01-02")
+			}
+			*day = parsed
+		}
+	}
+	if to.Before(from) {
+		return invalidParam("query", "from", "max", "must not be after to")
+	}
+	until := to.AddDate(0, 0, 1)
+
+	store := s.forRequest(r).store
+	income, err := store.GetDailyIncome(r.Context(), from, until)
+	if err != nil {
+		return err
+	}
+	snapshots, err := store.GetLiabilitySnapshots(r.Context(), from, until)
+	if err != nil {
+		return err
+	}
+	days := buildFinanceDays(income, snapshots)
+
+	if wantsCSV(r) {
+		rows := make([][]string, len(days))
+		for i, d := range days {
+			rows[i] = []string{d.Day, d.Currency,
+				strconv.FormatInt(d.FeeIncome, 10), strconv.FormatInt(d.CashbackExpense, 10), strconv.FormatInt(d.NetIncome, 10),
+				optionalCents(d.Deposits), optionalCents(d.Overdrafts)}
+		}
+		return writeCSV(w, "finance-"+from.Format("2006-01-02")+"-"+to.Format("2006-01-02")+".csv",
+			[]string{"day", "currency", "fee_income", "cashback_expense", "net_income", "deposits", "overdrafts"}, rows)
+	}
+
+	return WriteJSON(w, http.StatusOK, days)
+}
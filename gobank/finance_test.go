@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrialBalance(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	totals := balanceTotals([]*Account{
+		{Currency: "USD", Balance: 10000},
+		{Currency: "USD", Balance: -2500},
+		{Currency: "EUR", Balance: 400},
+	})
+	require.Len(t, totals, 2)
+	assert.Equal(t, &BalanceTotal{Currency: "USD", Deposits: 10000, Overdrafts: 2500}, totals[1])
+
+	tb := buildTrialBalance(day, totals, []*DailyIncome{
+		{Day: day, Currency: "USD", FeeIncome: 300, CashbackExpense: 100},
+	})
+	require.Len(t, tb.Lines, 10)
+
+	debits, credits := map[string]int64{}, map[string]int64{}
+	for _, line := range tb.Lines {
+		debits[line.Currency] += line.Debit
+		credits[line.Currency] += line.Credit
+	}
+	assert.Equal(t, credits, debits)
+	assert.Equal(t, int64(10300), credits["USD"])
+}
+
+func TestFinanceDays(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	days := buildFinanceDays(
+		[]*DailyIncome{{Day: day, Currency: "USD", FeeIncome: 300, CashbackExpense: 100}},
+		[]*LiabilitySnapshot{{Day: day.AddDate(0, 0, 1), Currency: "USD", Deposits: 9000}},
+	)
+	require.Len(t, days, 2)
+	assert.Equal(t, int64(200), days[0].NetIncome)
+	assert.Nil(t, days[0].Deposits)
+	assert.Equal(t, int64(9000), *days[1].Deposits)
+
+	w := httptest.NewRecorder()
+	require.Nil(t, writeCSV(w, "finance.csv", []string{"day", "deposits"}, [][]string{{days[0].Day, optionalCents(days[0].Deposits)}}))
+	assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+	assert.Equal(t, "day,deposits\n2024-03-01,\n", w.Body.String())
+	assert.True(t, strings.Contains(w.Header().Get("Content-Disposition"), "finance.csv"))
+}
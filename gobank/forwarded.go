@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Behind a load balancer RemoteAddr is the balancer, the client's address
+// and scheme arrive in X-Forwarded-For and X-Forwarded-Proto. Anyone can
+// send those headers, so they're only read when the connection comes from a
+// trusted proxy, and X-Forwarded-For is walked from the right, skipping
+// trusted hops, so a client can't prepend an address of its choosing.
+
+type forwardedKey struct{}
+
+type forwarded struct {
+	ip     string
+	scheme string
+}
+
+type trustedProxies []*net.IPNet
+
+func parseTrustedProxies(list string) (trustedProxies, error) {
+	var proxies trustedProxies
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", entry, err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (p trustedProxies) contains(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p trustedProxies) resolve(r *http.Request) forwarded {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	fwd := forwarded{ip: peer, scheme: "http"}
+	if r.TLS != nil {
+		fwd.scheme = "https"
+	}
+	if !p.contains(peer) {
+		return fwd
+	}
+
+	// The nearest untrusted hop is the client, if every hop is trusted the
+	// request started inside the network and the first one is
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		fwd.ip = hop
+		if !p.contains(hop) {
+			break
+		}
+	}
+
+	if proto := strings.ToLower(strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0])); proto == "http" || proto == "https" {
+		fwd.scheme = proto
+	}
+	return fwd
+}
+
+func withForwardedHeaders(next http.Handler, proxies trustedProxies) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fwd := proxies.resolve(r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), forwardedKey{}, fwd)))
+	})
+}
+
+// requestScheme is "https" when the client connected over TLS, directly or to a trusted proxy
+func requestScheme(r *http.Request) string {
+	if fwd, ok := r.Context().Value(forwardedKey{}).(forwarded); ok {
+		return fwd.scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// withHTTPSRedirect sends plain HTTP clients to the same URL over HTTPS.
+// Probes talk to the instance directly, so /readyz is answered either way.
+func withHTTPSRedirect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestScheme(r) == "https" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		target := "https://" + r.Host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwardedHeaders(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.5")
+	require.Nil(t, err)
+	_, err = parseTrustedProxies("10.0.0.0/33")
+	assert.Error(t, err)
+
+	var seenIP, seenScheme string
+	handler := withForwardedHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenIP, seenScheme = clientIP(r), requestScheme(r)
+	}), proxies)
+
+	request := func(remote, xff, proto string) {
+		r := httptest.NewRequest("GET", "/v1/account", nil)
+		r.RemoteAddr = remote + ":41000"
+		if xff != "" {
+			r.Header.Set("X-Forwarded-For", xff)
+		}
+		if proto != "" {
+			r.Header.Set("X-Forwarded-Proto", proto)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	// Headers from a client that isn't a proxy are ignored
+	request("203.0.113.9", "1.2.3.4", "https")
+	assert.Equal(t, "203.0.113.9", seenIP)
+	assert.Equal(t, "http", seenScheme)
+
+	request("10.1.2.3", "198.51.100.7", "https")
+	assert.Equal(t, "198.51.100.7", seenIP)
+	assert.Equal(t, "https", seenScheme)
+
+	// A spoofed leftmost entry loses to the address the proxy appended
+	request("10.1.2.3", "1.2.3.4, 198.51.100.7, 192.168.1.5", "")
+	assert.Equal(t, "198.51.100.7", seenIP)
+	assert.Equal(t, "http", seenScheme)
+
+	// Only trusted hops, the request came from inside
+	request("192.168.1.5", "10.9.9.9", "")
+	assert.Equal(t, "10.9.9.9", seenIP)
+
+	request("10.1.2.3", "not-an-ip", "gopher")
+	assert.Equal(t, "10.1.2.3", seenIP)
+	assert.Equal(t, "http", seenScheme)
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	proxies, _ := parseTrustedProxies("10.0.0.0/8")
+	handler := withForwardedHeaders(withHTTPSRedirect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})), proxies)
+
+	serve := func(path, proto string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://bank.example"+path, nil)
+		r.RemoteAddr = "10.0.0.2:5000"
+		r.Header.Set("X-Forwarded-Proto", proto)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve("/v1/account?include_closed=true", "http")
+	assert.Equal(t, http.StatusPermanentRedirect, w.Code)
+	assert.Equal(t, "https://bank.example/v1/account?include_closed=true", w.Header().Get("Location"))
+
+	assert.Equal(t, http.StatusOK, serve("/v1/account", "https").Code)
+	assert.Equal(t, http.StatusOK, serve("/readyz", "http").Code)
+}
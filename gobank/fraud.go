@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Customer transfers are screened by the fraud rules before they move any
+// money. A rule that matches asks for its action, review or block:
+//
+//	velocity: more than FRAUD_VELOCITY_COUNT transfers within FRAUD_VELOCITY_WINDOW
+//	unusual_amount: over FRAUD_UNUSUAL_FACTOR times the account's average
+//	transfer, once it has made FRAUD_UNUSUAL_MIN_HISTORY of them
+//	new_beneficiary: over FRAUD_NEW_BENEFICIARY_AMOUNT to an account it never paid
+//
+// The strictest action wins. Blocked transfers fail with TRANSFER_BLOCKED,
+// reviewed ones are held with the amount reserved like transfers over the
+// approval threshold, and wait in /admin/fraud/reviews until an admin
+// approves or rejects them. Every decision is recorded, allows included.
+
+const (
+	FraudActionAllow  = "allow"
+	FraudActionReview = "review"
+	FraudActionBlock  = "block"
+
+	FraudRuleVelocity       = "velocity"
+	FraudRuleUnusualAmount  = "unusual_amount"
+	FraudRuleNewBeneficiary = "new_beneficiary"
+)
+
+// FraudRules are part of TransferLimits, a zero threshold turns its rule off
+type FraudRules struct {
+	VelocityCount  int
+	VelocityWindow time.Duration
+	VelocityAction string
+
+	UnusualFactor     float64
+	UnusualMinHistory int
+	UnusualAction     string
+
+	NewBeneficiaryAbove  int64 // in cents
+	NewBeneficiaryAction string
+}
+
+func NewFraudRules(cfg *Config) FraudRules {
+	return FraudRules{
+		VelocityCount:  cfg.FraudVelocityCount,
+		VelocityWindow: cfg.FraudVelocityWindow,
+		VelocityAction: fraudAction(cfg.FraudVelocityAction),
+
+		UnusualFactor:     cfg.FraudUnusualFactor,
+		UnusualMinHistory: cfg.FraudUnusualMinHistory,
+		UnusualAction:     fraudAction(cfg.FraudUnusualAction),
+
+		NewBeneficiaryAbove:  toCents(cfg.FraudNewBeneficiaryAmount),
+		NewBeneficiaryAction: fraudAction(cfg.FraudNewBeneficiaryAction),
+	}
+}
+
+// fraudAction reads a configured action, anything but block asks for review
+func fraudAction(action string) string {
+	if action == FraudActionBlock {
+		return FraudActionBlock
+	}
+	return FraudActionReview
+}
+
+func (r FraudRules) enabled() bool {
+	return r.VelocityCount > 0 || r.UnusualFactor > 0 || r.NewBeneficiaryAbove > 0
+}
+
+// TransferHistory sums up an account's past customer transfers for the rules
+type TransferHistory struct {
+	Count      int
+	Average    int64 // in cents
+	Recent     int   // within the velocity window
+	PaidBefore bool  // to the destination being screened
+}
+
+// evaluate returns the rules amount matches and the strictest of their actions
+func (r FraudRules) evaluate(history *TransferHistory, amount int64) (string, []string) {
+	action, matched := FraudActionAllow, []string{}
+	match := func(rule, ruleAction string) {
+		matched = append(matched, rule)
+		if action != FraudActionBlock {
+			action = ruleAction
+		}
+	}
+
+	if r.VelocityCount > 0 && history.Recent+1 > r.VelocityCount {
+		match(FraudRuleVelocity, r.VelocityAction)
+	}
+	if r.UnusualFactor > 0 && history.Count >= r.UnusualMinHistory && history.Average > 0 &&
+		float64(amount) > r.UnusualFactor*float64(history.Average) {
+		match(FraudRuleUnusualAmount, r.UnusualAction)
+	}
+	if r.NewBeneficiaryAbove > 0 && !history.PaidBefore && amount > r.NewBeneficiaryAbove {
+		match(FraudRuleNewBeneficiary, r.NewBeneficiaryAction)
+	}
+	return action, matched
+}
+
+type FraudDecision struct {
+	ID          int       `json:"id"`
+	Reference   string    `json:"reference"`
+	AccountID   int       `json:"account_id"`
+	FromAccount int64     `json:"from_account"`
+	ToAccount   int64     `json:"to_account"`
+	Amount      float64   `json:"amount"`
+	Action      string    `json:"action"`
+	Rules       []string  `json:"rules"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// FraudReview is a reviewed transfer that hasn't been approved or rejected
+type FraudReview struct {
+	Decision *FraudDecision   `json:"decision"`
+	Transfer *PendingTransfer `json:"transfer"`
+}
+
+// screenTransfer decides on a customer transfer and records the decision. The
+// returned context carries the reference the decision was recorded under.
+func (s *transferService) screenTransfer(ctx context.Context, req TransferRequest) (context.Context, string, error) {
+	rules := s.limits.Fraud
+	if !rules.enabled() || transferKind(ctx) != TransferKindTransfer {
+		return ctx, FraudActionAllow, nil
+	}
+
+	from, err := s.store.GetAccountByNumber(ctx, req.FromAccountNumber)
+	if err != nil {
+		return ctx, "", fmt.Errorf("invalid source account")
+	}
+	to, err := s.store.GetAccountByNumber(ctx, req.ToAccountNumber)
+	if err != nil {
+		return ctx, "", fmt.Errorf("invalid destination account")
+	}
+	history, err := s.store.GetTransferHistory(ctx, from.ID, to.ID, time.Now().Add(-rules.VelocityWindow))
+	if err != nil {
+		return ctx, "", fmt.Errorf("could not load transfer history: %v", err)
+	}
+
+	reference := transferReference(ctx)
+	if reference == "" {
+		reference = newTransferReference()
+		ctx = withTransferReference(ctx, reference)
+	}
+	action, matched := rules.evaluate(history, toCents(req.Amount))
+	decision := &FraudDecision{
+		Reference:   reference,
+		AccountID:   from.ID,
+		FromAccount: req.FromAccountNumber,
+		ToAccount:   req.ToAccountNumber,
+		Amount:      req.Amount,
+		Action:      action,
+		Rules:       matched,
+		CreatedAt:   time.Now().UTC(),
+	}
+	// The decision applies even when it couldn't be recorded
+	if err := s.store.CreateFraudDecision(ctx, decision); err != nil {
+		log.Printf("Failed to record the fraud decision on transfer %s: %v", reference, err)
+	}
+	if action != FraudActionAllow {
+		log.Printf("Transfer %s from %d matched fraud rules %v, action %s", reference, req.FromAccountNumber, matched, action)
+	}
+	return ctx, action, nil
+}
+
+// GET /admin/fraud/decisions, ?action= lists only allow, review or block
+func (s *APIServer) handleGetFraudDecisions(w http.ResponseWriter, r *http.Request) error {
+	action := r.URL.Query().Get("action")
+	switch action {
+	case "", FraudActionAllow, FraudActionReview, FraudActionBlock:
+	default:
+		return invalidParam("query", "action", "oneof", "must be allow, review or block")
+	}
+	decisions, err := s.forRequest(r).store.GetFraudDecisions(r.Context(), action, 500)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, decisions)
+}
+
+// GET /admin/fraud/reviews, transfers held by the rules that are still pending
+func (s *APIServer) handleGetFraudReviews(w http.ResponseWriter, r *http.Request) error {
+	store := s.forRequest(r).store
+	pending, err := store.GetPendingTransfers(r.Context(), TransferPendingApproval)
+	if err != nil {
+		return err
+	}
+	byReference := make(map[string]*PendingTransfer, len(pending))
+	for _, pt := range pending {
+		byReference[pt.Reference] = pt
+	}
+
+	decisions, err := store.GetFraudDecisions(r.Context(), FraudActionReview, 500)
+	if err != nil {
+		return err
+	}
+	reviews := []*FraudReview{}
+	for _, d := range decisions {
+		if pt, ok := byReference[d.Reference]; ok {
+			reviews = append(reviews, &FraudReview{Decision: d, Transfer: pt})
+		}
+	}
+	return WriteJSON(w, http.StatusOK, reviews)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFraudRulesEvaluate(t *testing.T) {
+	rules := FraudRules{
+		VelocityCount: 3, VelocityAction: FraudActionReview,
+		UnusualFactor: 5, UnusualMinHistory: 2, UnusualAction: FraudActionBlock,
+		NewBeneficiaryAbove: 50000, NewBeneficiaryAction: FraudActionReview,
+	}
+
+	action, matched := rules.evaluate(&TransferHistory{Count: 10, Average: 2000, Recent: 1, PaidBefore: true}, 5000)
+	assert.Equal(t, FraudActionAllow, action)
+	assert.Empty(t, matched)
+
+	action, matched = rules.evaluate(&TransferHistory{Count: 10, Average: 2000, Recent: 3, PaidBefore: true}, 5000)
+	assert.Equal(t, FraudActionReview, action)
+	assert.Equal(t, []string{FraudRuleVelocity}, matched)
+
+	// The strictest action wins
+	action, matched = rules.evaluate(&TransferHistory{Count: 10, Average: 2000, Recent: 3}, 60000)
+	assert.Equal(t, FraudActionBlock, action)
+	assert.Equal(t, []string{FraudRuleVelocity, FraudRuleUnusualAmount, FraudRuleNewBeneficiary}, matched)
+
+	// Accounts without enough history have no usual amount yet
+	action, matched = rules.evaluate(&TransferHistory{Count: 1, Average: 100, PaidBefore: true}, 40000)
+	assert.Equal(t, FraudActionAllow, action)
+	assert.Empty(t, matched)
+}
+
+func TestFraudScreening(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9601, Balance: 500000, Currency: "USD", EmailVerified: true}))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9602, Currency: "USD"}))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9603, Currency: "USD"}))
+
+	limits := TransferLimits{Fraud: FraudRules{
+		VelocityCount: 3, VelocityWindow: time.Hour, VelocityAction: FraudActionBlock,
+		NewBeneficiaryAbove: 50000, NewBeneficiaryAction: FraudActionReview,
+	}}
+	transfers := NewTransferService(store, limits, staticRateProvider{}, nil, nil)
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	transfer := func(to int64, amount float64) (*TransferReceipt, error) {
+		receipt, _, err := transfers.Transfer(ctx, TransferRequest{FromAccountNumber: 9601, ToAccountNumber: to, Amount: amount}, engine, "account:9601")
+		return receipt, err
+	}
+
+	_, err = transfer(9602, 100)
+	require.Nil(t, err)
+
+	// A large first payment to 9603 waits for review with the amount reserved
+	held, err := transfer(9603, 600)
+	require.Nil(t, err)
+	assert.Equal(t, TransferPendingApproval, held.Status)
+	assert.Equal(t, int64(490000), store.accounts[1].Balance)
+
+	_, err = transfer(9602, 600)
+	require.Nil(t, err, "9602 has been paid before")
+	_, err = transfer(9602, 10)
+	require.Nil(t, err)
+	_, err = transfer(9602, 10)
+	assert.ErrorIs(t, err, ErrTransferBlocked, "a fourth transfer within the hour")
+
+	s := NewAPIServer(&Config{}, store)
+	w := httptest.NewRecorder()
+	require.Nil(t, s.handleGetFraudReviews(w, httptest.NewRequest("GET", "/admin/fraud/reviews", nil)))
+	var reviews []*FraudReview
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &reviews))
+	require.Len(t, reviews, 1)
+	assert.Equal(t, held.Reference, reviews[0].Decision.Reference)
+	assert.Equal(t, []string{FraudRuleNewBeneficiary}, reviews[0].Decision.Rules)
+	assert.Equal(t, TransferPendingApproval, reviews[0].Transfer.Status)
+
+	// Approving takes the transfer off the queue
+	_, err = transfers.ApproveTransfer(ctx, held.Reference, engine, "admin")
+	require.Nil(t, err)
+	w = httptest.NewRecorder()
+	require.Nil(t, s.handleGetFraudReviews(w, httptest.NewRequest("GET", "/admin/fraud/reviews", nil)))
+	assert.JSONEq(t, "[]", w.Body.String())
+
+	var decisions []*FraudDecision
+	w = httptest.NewRecorder()
+	require.Nil(t, s.handleGetFraudDecisions(w, httptest.NewRequest("GET", "/admin/fraud/decisions", nil)))
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &decisions))
+	require.Len(t, decisions, 5, "allows are recorded too")
+	assert.Equal(t, FraudActionBlock, decisions[0].Action)
+	assert.Equal(t, []string{FraudRuleVelocity}, decisions[0].Rules)
+
+	w = httptest.NewRecorder()
+	makeHTTPHandle(s.handleGetFraudDecisions)(w, httptest.NewRequest("GET", "/admin/fraud/decisions?action=maybe", nil))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+}
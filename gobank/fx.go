@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Used for accounts created without an explicit currency
+const DefaultCurrency = "USD"
+
+// ISO 4217 alphabetic code
+var validCurrency = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// RateProvider quotes how many units of `to` one unit of `from` buys
+type RateProvider interface {
+	Rate(from, to string) (float64, error)
+}
+
+// Conversion is the debit and credit side of one transfer. Same-currency
+// transfers have a rate of 1 and equal amounts.
+type Conversion struct {
+	FromCurrency string
+	ToCurrency   string
+	Rate         float64
+	Debit        float64
+	Credit       float64
+}
+
+func sameCurrency(currency string, amount float64) Conversion {
+	return Conversion{FromCurrency: currency, ToCurrency: currency, Rate: 1, Debit: amount, Credit: amount}
+}
+
+func (c Conversion) IsFX() bool {
+	return c.FromCurrency != c.ToCurrency
+}
+
+// convert quotes a transfer of amount (in the source currency) between the accounts
+func convert(rates RateProvider, from, to *Account, amount float64) (Conversion, error) {
+	if from.Currency == to.Currency {
+		return sameCurrency(from.Currency, amount), nil
+	}
+
+	rate, err := rates.Rate(from.Currency, to.Currency)
+	if err != nil {
+		return Conversion{}, err
+	}
+
+	return Conversion{
+		FromCurrency: from.Currency,
+		ToCurrency:   to.Currency,
+		Rate:         rate,
+		Debit:        amount,
+		Credit:       math.Round(amount*rate*100) / 100,
+	}, nil
+}
+
+func NewRateProvider(cfg *Config) (RateProvider, error) {
+	switch cfg.FXProvider {
+	case "static":
+		return parseStaticRates(cfg.FXRates)
+	case "http":
+		if cfg.FXRatesURL == "" {
+			return nil, fmt.Errorf("FX_RATES_URL is required for the http rate provider")
+		}
+		return newHTTPRateProvider(cfg.FXRatesURL, cfg.FXRatesTTL), nil
+	}
+	return nil, fmt.Errorf("unknown FX provider %q", cfg.FXProvider)
+}
+
+// staticRateProvider serves a fixed table, the inverse of a configured pair is derived
+type staticRateProvider map[string]float64
+
+// parseStaticRates reads "USD:EUR=0.92,USD:GBP=0.79"
+func parseStaticRates(spec string) (staticRateProvider, error) {
+	rates := staticRateProvider{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		pair, value, ok := strings.Cut(entry, "=")
+		from, to, okPair := strings.Cut(pair, ":")
+		rate, err := strconv.ParseFloat(value, 64)
+		if !ok || !okPair || err != nil || rate <= 0 || !validCurrency.MatchString(from) || !validCurrency.MatchString(to) {
+			return nil, fmt.Errorf("invalid FX rate %q", entry)
+		}
+
+		rates[from+":"+to] = rate
+		if _, ok := rates[to+":"+from]; !ok {
+			rates[to+":"+from] = 1 / rate
+		}
+	}
+	return rates, nil
+}
+
+func (p staticRateProvider) Rate(from, to string) (float64, error) {
+	rate, ok := p[from+":"+to]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s to %s", ErrNoFXRate, from, to)
+	}
+	return rate, nil
+}
+
+// httpRateProvider fetches GET {url}?from=USD&to=EUR returning {"rate": 0.92}
+// and caches quotes for ttl.
+type httpRateProvider struct {
+	url        string
+	ttl        time.Duration
+	httpClient *http.Client
+
+	mu     sync.Mutex
+	quotes map[string]cachedRate
+}
+
+type cachedRate struct {
+	rate      float64
+	expiresAt time.Time
+}
+
+func newHTTPRateProvider(url string, ttl time.Duration) *httpRateProvider {
+	return &httpRateProvider{
+		url:        url,
+		ttl:        ttl,
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+		quotes:     map[string]cachedRate{},
+	}
+}
+
+func (p *httpRateProvider) Rate(from, to string) (float64, error) {
+	key := from + ":" + to
+
+	p.mu.Lock()
+	cached, ok := p.quotes[key]
+	p.mu.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.rate, nil
+	}
+
+	query := url.Values{}
+	query.Set("from", from)
+	query.Set("to", to)
+
+	resp, err := p.httpClient.Get(p.url + "?" + query.Encode())
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrUpstreamUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, fmt.Errorf("%w: %s to %s", ErrNoFXRate, from, to)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%w: rate provider returned %d", ErrUpstreamUnavailable, resp.StatusCode)
+	}
+
+	var body struct {
+		Rate float64 `json:"rate"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Rate <= 0 {
+		return 0, fmt.Errorf("%w: invalid rate for %s to %s", ErrUpstreamUnavailable, from, to)
+	}
+
+	p.mu.Lock()
+	p.quotes[key] = cachedRate{rate: body.Rate, expiresAt: time.Now().Add(p.ttl)}
+	p.mu.Unlock()
+
+	return body.Rate, nil
+}
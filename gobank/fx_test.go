@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticRateProvider(t *testing.T) {
+	rates, err := parseStaticRates("USD:EUR=0.8, EUR:GBP=0.85")
+	require.Nil(t, err)
+
+	rate, err := rates.Rate("EUR", "USD")
+	require.Nil(t, err)
+	assert.Equal(t, 1.25, rate)
+
+	_, err = rates.Rate("USD", "JPY")
+	assert.ErrorIs(t, err, ErrNoFXRate)
+
+	_, err = parseStaticRates("usd:EUR=1")
+	assert.Error(t, err)
+}
+
+func TestConvert(t *testing.T) {
+	rates := staticRateProvider{"USD:EUR": 0.9173}
+	from := &Account{Currency: "USD"}
+
+	conv, err := convert(rates, from, &Account{Currency: "USD"}, 10)
+	require.Nil(t, err)
+	assert.False(t, conv.IsFX())
+	assert.Equal(t, 10.0, conv.Credit)
+
+	// Credits are rounded to whole cents
+	conv, err = convert(rates, from, &Account{Currency: "EUR"}, 10)
+	require.Nil(t, err)
+	assert.True(t, conv.IsFX())
+	assert.Equal(t, 9.17, conv.Credit)
+	assert.Equal(t, 0.9173, conv.Rate)
+}
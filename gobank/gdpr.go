@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Customers download their personal data with GET /me/data-export and ask
+// for it to be erased with DELETE /me. Erasure closes the account straight
+// away, so it needs a zero balance and no legal holds, and anonymizes it
+// once GDPR_ERASURE_RETENTION has passed. Anonymizing blanks the holder's
+// name, email, nickname, metadata and password and the personal values in
+// their audit log, and deletes what only identifies them: KYC documents,
+// linked identities, login IPs, aliases, beneficiaries, notifications,
+// webhooks and API keys. The account row and number, transfers and ledger
+// entries are kept so the books still balance.
+
+const (
+	ErasureScheduled = "scheduled"
+	ErasureCompleted = "erased"
+
+	AuditErasureRequested = "account.erasure_requested"
+	AuditAccountErased    = "account.erased"
+
+	// Stands in for personal values in the audit log of an erased account
+	erasedValue = "[erased]"
+)
+
+type ErasureRequest struct {
+	AccountID   int        `json:"account_id"`
+	Status      string     `json:"status"`
+	RequestedAt time.Time  `json:"requested_at"`
+	EraseAt     time.Time  `json:"erase_at"`
+	ErasedAt    *time.Time `json:"erased_at,omitempty"`
+}
+
+// DataExport is everything kept about a customer, GET /me/data-export
+type DataExport struct {
+	ExportedAt         time.Time             `json:"exported_at"`
+	Account            *Account              `json:"account"`
+	Preferences        *AccountPreferences   `json:"preferences"`
+	KYCSubmissions     []*KYCSubmission      `json:"kyc_submissions"`
+	Aliases            []*AccountAlias       `json:"aliases"`
+	Beneficiaries      []*Beneficiary        `json:"beneficiaries"`
+	StandingOrders     []*StandingOrder      `json:"standing_orders"`
+	ScheduledTransfers []*ScheduledTransfer  `json:"scheduled_transfers"`
+	SweepRules         []*SweepRule          `json:"sweep_rules"`
+	Mandates           []*Mandate            `json:"mandates"`
+	Cards              []*Card               `json:"cards"`
+	Cheques            []*Cheque             `json:"cheques"`
+	ExternalTransfers  []*ExternalTransfer   `json:"external_transfers"`
+	EventSubscriptions []*EventSubscription  `json:"event_subscriptions"`
+	Notifications      []*Notification       `json:"notifications"`
+	Transactions       []*AccountTransaction `json:"transactions"`
+	AuditLog           []*AuditEntry         `json:"audit_log"`
+	Erasure            *ErasureRequest       `json:"erasure,omitempty"`
+}
+
+// erasedAuditField reports whether an audited field holds personal data
+func erasedAuditField(field string) bool {
+	switch field {
+	case "first_name", "last_name", "email", "nickname", "alias":
+		return true
+	}
+	return strings.HasPrefix(field, "metadata.")
+}
+
+func eraseAuditChanges(changes []FieldChange) []FieldChange {
+	for i, c := range changes {
+		if !erasedAuditField(c.Field) {
+			continue
+		}
+		if c.Old != nil {
+			changes[i].Old = erasedValue
+		}
+		if c.New != nil {
+			changes[i].New = erasedValue
+		}
+	}
+	return changes
+}
+
+func (s *APIServer) dataExport(ctx context.Context, acc *Account) (*DataExport, error) {
+	export := &DataExport{ExportedAt: time.Now().UTC(), Account: acc}
+	var err error
+	if export.Preferences, err = s.store.GetPreferences(ctx, acc.ID); err != nil {
+		return nil, err
+	}
+	if export.KYCSubmissions, err = s.store.GetKYCSubmissions(ctx, acc.ID); err != nil {
+		return nil, err
+	}
+	if export.Aliases, err = s.store.GetAliases(ctx, acc.ID); err != nil {
+		return nil, err
+	}
+	if export.Beneficiaries, err = s.store.GetBeneficiaries(ctx, acc.ID); err != nil {
+		return nil, err
+	}
+	if export.StandingOrders, err = s.store.GetStandingOrders(ctx, acc.ID); err != nil {
+		return nil, err
+	}
+	if export.ScheduledTransfers, err = s.store.GetScheduledTransfers(ctx, acc.ID); err != nil {
+		return nil, err
+	}
+	if export.SweepRules, err = s.store.GetSweepRules(ctx, acc.ID); err != nil {
+		return nil, err
+	}
+	if export.Mandates, err = s.store.GetMandates(ctx, acc.ID); err != nil {
+		return nil, err
+	}
+	if export.Cards, err = s.store.GetCards(ctx, acc.ID); err != nil {
+		return nil, err
+	}
+	if export.Cheques, err = s.store.GetCheques(ctx, acc.ID); err != nil {
+		return nil, err
+	}
+	if export.ExternalTransfers, err = s.store.GetExternalTransfers(ctx, acc.ID); err != nil {
+		return nil, err
+	}
+	if export.EventSubscriptions, err = s.store.GetEventSubscriptions(ctx, acc.ID); err != nil {
+		return nil, err
+	}
+	for _, sub := range export.EventSubscriptions {
+		sub.Secret = ""
+	}
+	if export.Notifications, err = s.store.GetNotifications(ctx, acc.ID, false, math.MaxInt32); err != nil {
+		return nil, err
+	}
+	if export.Transactions, err = s.allTransactions(ctx, acc.ID); err != nil {
+		return nil, err
+	}
+	if export.AuditLog, err = s.store.GetAuditLog(ctx, acc.ID); err != nil {
+		return nil, err
+	}
+	if export.Erasure, err = s.store.GetErasureRequest(ctx, acc.ID); err != nil && !errors.Is(err, ErrErasureNotFound) {
+		return nil, err
+	}
+	return export, nil
+}
+
+// allTransactions pages through the account's whole history, newest first
+func (s *APIServer) allTransactions(ctx context.Context, accountID int) ([]*AccountTransaction, error) {
+	all := []*AccountTransaction{}
+	filter := TransactionFilter{Limit: maxTransactionLimit}
+	for {
+		page, err := s.store.GetAccountTransactions(ctx, accountID, filter)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, page...)
+		if len(page) < filter.Limit {
+			return all, nil
+		}
+		filter.Before = page[len(page)-1].EntryID
+	}
+}
+
+type ErasureService interface {
+	Request(ctx context.Context, acc *Account, actor string) (*ErasureRequest, error)
+	Erase(ctx context.Context, accountID int) error
+}
+
+type erasureService struct {
+	store     Storage
+	accounts  AccountService
+	retention time.Duration
+}
+
+func NewErasureService(store Storage, accounts AccountService, retention time.Duration) ErasureService {
+	return &erasureService{store: store, accounts: accounts, retention: retention}
+}
+
+func (s *APIServer) erasures() ErasureService {
+	return NewErasureService(s.store, s.accounts(), s.config.ErasureRetention)
+}
+
+// Request closes the account and schedules its erasure, asking again
+// returns the request already made
+func (s *erasureService) Request(ctx context.Context, acc *Account, actor string) (*ErasureRequest, error) {
+	existing, err := s.store.GetErasureRequest(ctx, acc.ID)
+	if err == nil {
+		return existing, nil
+	}
+	if !errors.Is(err, ErrErasureNotFound) {
+		return nil, err
+	}
+
+	if acc.Status != AccountClosed {
+		if _, err := s.accounts.CloseAccount(ctx, acc.ID, actor); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now().UTC()
+	req := &ErasureRequest{AccountID: acc.ID, Status: ErasureScheduled, RequestedAt: now, EraseAt: now.Add(s.retention)}
+	if err := s.store.CreateErasureRequest(ctx, req); err != nil {
+		return nil, err
+	}
+	recordAudit(ctx, s.store, actor, acc.ID, AuditErasureRequested, []FieldChange{
+		{Field: "erase_at", Old: nil, New: req.EraseAt},
+	})
+
+	if s.retention > 0 {
+		return req, nil
+	}
+	if err := s.Erase(ctx, acc.ID); err != nil {
+		return nil, err
+	}
+	return s.store.GetErasureRequest(ctx, acc.ID)
+}
+
+func (s *erasureService) Erase(ctx context.Context, accountID int) error {
+	if err := s.store.EraseAccount(ctx, accountID, time.Now().UTC()); err != nil {
+		return fmt.Errorf("could not erase account %d: %w", accountID, err)
+	}
+	recordAudit(ctx, s.store, "erasure", accountID, AuditAccountErased, []FieldChange{})
+	return nil
+}
+
+func (s *APIServer) erasureJob() Job {
+	return Job{
+		Name:     "erasure",
+		Interval: s.config.SchedulerInterval,
+		Run: func(ctx context.Context) error {
+			due, err := s.store.GetDueErasures(ctx, time.Now().UTC(), 100)
+			if err != nil {
+				return err
+			}
+			setJobQueueDepth("erasures", len(due))
+
+			erasures := s.erasures()
+			for _, req := range due {
+				if err := erasures.Erase(ctx, req.AccountID); err != nil {
+					log.Printf("Erasure failed: %v", err)
+					continue
+				}
+				log.Printf("Erased account %d", req.AccountID)
+			}
+			return nil
+		},
+	}
+}
+
+// GET /me/data-export
+func (s *APIServer) handleDataExport(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	acc, r, err := s.tokenAccount(r)
+	if err != nil {
+		return err
+	}
+	export, err := s.dataExport(r.Context(), acc)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="gobank-data-export-%d.json"`, acc.Number))
+	return WriteJSON(w, http.StatusOK, export)
+}
+
+// DELETE /me
+func (s *APIServer) handleRequestErasure(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	acc, r, err := s.tokenAccount(r)
+	if err != nil {
+		return err
+	}
+	req, err := s.erasures().Request(r.Context(), acc, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+
+	if req.ErasedAt != nil {
+		return WriteJSON(w, http.StatusOK, req)
+	}
+	return WriteJSON(w, http.StatusAccepted, req)
+}
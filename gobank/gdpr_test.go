@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDataExportAndErasure(t *testing.T) {
+	t.Setenv("JWT_SECRET", "gdpr-secret")
+	ctx := context.Background()
+	store := newMemoryStorage()
+	acc := &Account{FirstName: "Ada", LastName: "Lovelace", Number: 9841, Currency: "USD", Status: AccountActive,
+		Email: "ada@example.com", EmailVerified: true, Nickname: "Main", Metadata: AccountMetadata{"team": "engines"}}
+	require.Nil(t, store.CreateAccount(ctx, acc))
+	require.Nil(t, store.UpdateAccount(ctx, acc))
+	require.Nil(t, store.CreateBeneficiary(ctx, &Beneficiary{AccountID: acc.ID, Name: "Charles Babbage", AccountNumber: 9842}))
+	require.Nil(t, store.CreateNotification(ctx, &Notification{AccountID: acc.ID, Message: "Welcome Ada"}))
+	_, err := store.RecordLoginIP(ctx, acc.ID, "192.0.2.7", time.Now())
+	require.Nil(t, err)
+	recordAudit(ctx, store, "admin", acc.ID, AuditAccountUpdated, []FieldChange{
+		{Field: "last_name", Old: "Byron", New: "Lovelace"},
+		{Field: "overdraft_limit", Old: 0, New: 100},
+	})
+
+	token, err := createJWT(acc)
+	require.Nil(t, err)
+	s := NewAPIServer(&Config{ErasureRetention: 24 * time.Hour}, store)
+	call := func(handler apiFunc, method, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("x-jwt-token", token)
+		w := httptest.NewRecorder()
+		makeHTTPHandle(handler)(w, r)
+		return w
+	}
+
+	w := call(s.handleDataExport, "GET", "/me/data-export")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, `attachment; filename="gobank-data-export-9841.json"`, w.Header().Get("Content-Disposition"))
+	export := &DataExport{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), export))
+	assert.Equal(t, "ada@example.com", export.Account.Email)
+	require.Len(t, export.Beneficiaries, 1)
+	assert.Equal(t, "Charles Babbage", export.Beneficiaries[0].Name)
+	require.Len(t, export.Notifications, 1)
+	require.Len(t, export.AuditLog, 1)
+	assert.Nil(t, export.Erasure)
+
+	// Erasure closes the account at once and waits out the retention window
+	w = call(s.handleRequestErasure, "DELETE", "/me")
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	req := &ErasureRequest{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), req))
+	assert.Equal(t, ErasureScheduled, req.Status)
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), req.EraseAt, time.Minute)
+
+	closed, err := store.GetAccountbyID(ctx, acc.ID)
+	require.Nil(t, err)
+	assert.Equal(t, AccountClosed, closed.Status)
+	assert.Equal(t, "Ada", closed.FirstName)
+
+	w = call(s.handleRequestErasure, "DELETE", "/me")
+	require.Equal(t, http.StatusAccepted, w.Code)
+
+	job := s.erasureJob()
+	require.Nil(t, job.Run(ctx))
+	due, err := store.GetErasureRequest(ctx, acc.ID)
+	require.Nil(t, err)
+	assert.Nil(t, due.ErasedAt, "retention hasn't passed")
+
+	store.erasures[acc.ID].EraseAt = time.Now().Add(-time.Minute)
+	require.Nil(t, job.Run(ctx))
+
+	erased, err := store.GetAccountbyID(ctx, acc.ID)
+	require.Nil(t, err)
+	assert.Empty(t, erased.FirstName)
+	assert.Empty(t, erased.LastName)
+	assert.Empty(t, erased.Email)
+	assert.Empty(t, erased.Nickname)
+	assert.Nil(t, erased.Metadata)
+	assert.False(t, erased.ValidatePassword(""))
+	assert.Equal(t, int64(9841), erased.Number, "the ledger still refers to the number")
+
+	w = call(s.handleDataExport, "GET", "/me/data-export")
+	require.Equal(t, http.StatusOK, w.Code)
+	export = &DataExport{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), export))
+	assert.Empty(t, export.Beneficiaries)
+	assert.Empty(t, export.Notifications)
+	assert.Equal(t, ErasureCompleted, export.Erasure.Status)
+	assert.Equal(t, []FieldChange{
+		{Field: "last_name", Old: erasedValue, New: erasedValue},
+		{Field: "overdraft_limit", Old: 0.0, New: 100.0},
+	}, export.AuditLog[0].Changes)
+}
+
+func TestImmediateErasure(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	acc := &Account{FirstName: "Grace", Number: 9851, Currency: "USD", Status: AccountActive}
+	require.Nil(t, store.CreateAccount(ctx, acc))
+
+	s := NewAPIServer(&Config{}, store)
+	req, err := s.erasures().Request(ctx, acc, "test")
+	require.Nil(t, err)
+	assert.Equal(t, ErasureCompleted, req.Status)
+
+	erased, err := store.GetAccountbyID(ctx, acc.ID)
+	require.Nil(t, err)
+	assert.Empty(t, erased.FirstName)
+
+	// Money has to leave the account first
+	funded := &Account{FirstName: "Alan", Number: 9852, Balance: 100, Currency: "USD", Status: AccountActive}
+	require.Nil(t, store.CreateAccount(ctx, funded))
+	_, err = s.erasures().Request(ctx, funded, "test")
+	assert.ErrorIs(t, err, ErrBalanceNotZero)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/SIDDHARTH-PADIGAR/gobank/gobankpb"
+	jwt "github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcServer exposes the same operations as the REST API, see proto/gobank.proto
+type grpcServer struct {
+	gobankpb.UnimplementedGoBankServer
+
+	api    *APIServer
+	engine TransferEngine
+}
+
+func (s *APIServer) serveGRPC(engine TransferEngine) {
+	lis, err := net.Listen("tcp", s.config.GRPCListenAddr)
+	if err != nil {
+		log.Fatalf("gRPC server failed to listen: %v", err)
+	}
+
+	server := grpc.NewServer(grpc.UnaryInterceptor(grpcRequestID))
+	gobankpb.RegisterGoBankServer(server, &grpcServer{api: s, engine: engine})
+
+	log.Println("gRPC server running on port:", s.config.GRPCListenAddr)
+
+	if err := server.Serve(lis); err != nil {
+		log.Fatalf("gRPC server failed: %v", err)
+	}
+}
+
+// Same request ID handling as the HTTP middleware, via the x-request-id metadata key
+func grpcRequestID(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	id := newRequestID()
+	if ids := md.Get("x-request-id"); len(ids) > 0 && validRequestID.MatchString(ids[0]) {
+		id = ids[0]
+	}
+
+	grpc.SetHeader(ctx, metadata.Pairs("x-request-id", id))
+	return handler(context.WithValue(ctx, requestIDKey{}, id), req)
+}
+
+func (g *grpcServer) CreateAccount(ctx context.Context, req *gobankpb.CreateAccountRequest) (*gobankpb.Account, error) {
+	create := &CreateAccountRequest{
+		FirstName: req.GetFirstName(),
+		LastName:  req.GetLastName(),
+		Password:  req.GetPassword(),
+		Currency:  req.GetCurrency(),
+	}
+	if err := validateRequest(create); err != nil {
+		return nil, grpcError(err)
+	}
+
+	account, err := g.api.forRequestID(requestIDFromContext(ctx)).accounts().CreateAccount(ctx, create, grpcActor(ctx))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return toProtoAccount(account), nil
+}
+
+func (g *grpcServer) Login(ctx context.Context, req *gobankpb.LoginRequest) (*gobankpb.LoginResponse, error) {
+	login := LoginRequest{Number: req.GetNumber(), Password: req.GetPassword()}
+	if err := validateRequest(&login); err != nil {
+		return nil, grpcError(err)
+	}
+
+	resp, err := g.api.forRequestID(requestIDFromContext(ctx)).accounts().Login(ctx, login)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &gobankpb.LoginResponse{Number: resp.Number, Token: resp.Token}, nil
+}
+
+// Same check as withJWTAuth: the token must belong to the requested account
+func (g *grpcServer) GetAccount(ctx context.Context, req *gobankpb.GetAccountRequest) (*gobankpb.Account, error) {
+	if key, ok := grpcAPIKey(ctx, g.api.store); ok {
+		if !key.allowsAccount(int(req.GetId()), false) {
+			return nil, status.Error(codes.PermissionDenied, "Permission denied")
+		}
+		account, err := g.api.forRequestID(requestIDFromContext(ctx)).accounts().GetAccount(ctx, int(req.GetId()))
+		if err != nil {
+			return nil, grpcError(err)
+		}
+		return toProtoAccount(account), nil
+	}
+
+	token, ok := grpcToken(ctx)
+	if !ok || tokenRevoked(g.api.revocations, token) {
+		return nil, status.Error(codes.PermissionDenied, "Permission denied")
+	}
+	number, ok := jwtAccountNumber(token)
+	if !ok {
+		return nil, status.Error(codes.PermissionDenied, "Permission denied")
+	}
+
+	account, err := g.api.forRequestID(requestIDFromContext(ctx)).accounts().GetAccount(ctx, int(req.GetId()))
+	if err != nil || account.Number != number {
+		return nil, status.Error(codes.PermissionDenied, "Permission denied")
+	}
+
+	return toProtoAccount(account), nil
+}
+
+func (g *grpcServer) Transfer(ctx context.Context, req *gobankpb.TransferRequest) (*gobankpb.TransferResponse, error) {
+	transfer := TransferRequest{
+		FromAccountNumber: req.GetFromAccount(),
+		ToAccountNumber:   req.GetToAccount(),
+		Amount:            req.GetAmount(),
+	}
+	if err := validateRequest(&transfer); err != nil {
+		return nil, grpcError(err)
+	}
+
+	receipt, _, err := g.api.forRequestID(requestIDFromContext(ctx)).transfers().Transfer(ctx, transfer, g.engine, grpcActor(ctx))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &gobankpb.TransferResponse{
+		Status:          receipt.Status,
+		FromAccount:     receipt.FromAccount,
+		ToAccount:       receipt.ToAccount,
+		Amount:          receipt.Amount,
+		Currency:        receipt.Currency,
+		ConvertedAmount: receipt.ConvertedAmount,
+		ToCurrency:      receipt.ToCurrency,
+		FxRate:          receipt.FxRate,
+		TransferredAt:   timestamppb.New(receipt.TransferredAt),
+		Reference:       receipt.Reference,
+	}, nil
+}
+
+func toProtoAccount(account *Account) *gobankpb.Account {
+	return &gobankpb.Account{
+		Id:            int32(account.ID),
+		FirstName:     account.FirstName,
+		LastName:      account.LastName,
+		AccountNumber: account.Number,
+		Balance:       account.Balance,
+		Currency:      account.Currency,
+		CreatedAt:     timestamppb.New(account.CreatedAt),
+	}
+}
+
+func grpcToken(ctx context.Context) (*jwt.Token, bool) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	tokens := md.Get("x-jwt-token")
+	if len(tokens) == 0 {
+		return nil, false
+	}
+
+	token, err := validateJWT(tokens[0])
+	if err != nil || !token.Valid {
+		return nil, false
+	}
+	return token, true
+}
+
+// grpcAPIKey authenticates the x-api-key metadata when no JWT is sent
+func grpcAPIKey(ctx context.Context, store Storage) (*APIKey, bool) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	keys := md.Get("x-api-key")
+	if len(keys) == 0 || len(md.Get("x-jwt-token")) > 0 {
+		return nil, false
+	}
+
+	key, err := NewAPIKeyService(store).Authenticate(ctx, keys[0])
+	if err != nil {
+		return nil, false
+	}
+	return key, true
+}
+
+func grpcTokenAccountNumber(ctx context.Context) (int64, bool) {
+	token, ok := grpcToken(ctx)
+	if !ok {
+		return 0, false
+	}
+	return jwtAccountNumber(token)
+}
+
+func grpcActor(ctx context.Context) string {
+	if number, ok := grpcTokenAccountNumber(ctx); ok {
+		return "account:" + strconv.FormatInt(number, 10)
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return "anonymous@" + host
+		}
+	}
+	return "anonymous"
+}
+
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusUnauthorized:        codes.Unauthenticated,
+	http.StatusForbidden:           codes.PermissionDenied,
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusUnprocessableEntity: codes.InvalidArgument,
+	http.StatusLocked:              codes.FailedPrecondition,
+	http.StatusTooManyRequests:     codes.ResourceExhausted,
+	http.StatusServiceUnavailable:  codes.Unavailable,
+	http.StatusInternalServerError: codes.Internal,
+}
+
+// Translates errors with the same rules as the REST API
+func grpcError(err error) error {
+	httpStatus, apiErr := apiErrorFor(err)
+
+	code, ok := grpcCodes[httpStatus]
+	if !ok {
+		code = codes.Unknown
+	}
+	return status.Error(code, apiErr.Error)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/SIDDHARTH-PADIGAR/gobank/gobankpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newGRPCTestClient serves s over an in-memory connection
+func newGRPCTestClient(t *testing.T, s *APIServer) gobankpb.GoBankClient {
+	engine, err := NewTransferEngine("balance", s.store, &Config{})
+	require.Nil(t, err)
+
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(grpc.UnaryInterceptor(grpcRequestID))
+	gobankpb.RegisterGoBankServer(server, &grpcServer{api: s, engine: engine})
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return gobankpb.NewGoBankClient(conn)
+}
+
+func grpcTestAccounts(t *testing.T, store Storage, numbers ...int64) []*Account {
+	var accounts []*Account
+	for _, number := range numbers {
+		acc, err := NewAccount("Gail", "Rpc", "password")
+		require.Nil(t, err)
+		acc.Number, acc.Balance = number, 10000
+		require.Nil(t, store.CreateAccount(context.Background(), acc))
+		accounts = append(accounts, acc)
+	}
+	return accounts
+}
+
+func TestGRPCGetAccount(t *testing.T) {
+	t.Setenv("JWT_SECRET", "grpc-secret")
+	ctx := context.Background()
+	store := newMemoryStorage()
+	accounts := grpcTestAccounts(t, store, 7701, 7702)
+	s := NewAPIServer(&Config{}, store)
+	client := newGRPCTestClient(t, s)
+
+	token, err := createJWT(accounts[0])
+	require.Nil(t, err)
+	withToken := metadata.AppendToOutgoingContext(ctx, "x-jwt-token", token)
+	acc, err := client.GetAccount(withToken, &gobankpb.GetAccountRequest{Id: int32(accounts[0].ID)})
+	require.Nil(t, err)
+	assert.Equal(t, int64(7701), acc.AccountNumber)
+	assert.Equal(t, int64(10000), acc.Balance)
+
+	_, err = client.GetAccount(withToken, &gobankpb.GetAccountRequest{Id: int32(accounts[1].ID)})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "someone else's account")
+	_, err = client.GetAccount(ctx, &gobankpb.GetAccountRequest{Id: int32(accounts[0].ID)})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "no token")
+
+	// API keys are held to their own account, admin keys see every one
+	key, err := s.apiKeys().Create(ctx, CreateAPIKeyRequest{Name: "read", Scope: "read", AccountID: accounts[0].ID}, "admin")
+	require.Nil(t, err)
+	withKey := metadata.AppendToOutgoingContext(ctx, "x-api-key", key.Key)
+	acc, err = client.GetAccount(withKey, &gobankpb.GetAccountRequest{Id: int32(accounts[0].ID)})
+	require.Nil(t, err)
+	assert.Equal(t, int64(7701), acc.AccountNumber)
+	_, err = client.GetAccount(withKey, &gobankpb.GetAccountRequest{Id: int32(accounts[1].ID)})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	admin, err := s.apiKeys().Create(ctx, CreateAPIKeyRequest{Name: "ops", Scope: "admin"}, "admin")
+	require.Nil(t, err)
+	_, err = client.GetAccount(metadata.AppendToOutgoingContext(ctx, "x-api-key", admin.Key), &gobankpb.GetAccountRequest{Id: 999})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestGRPCTransfer(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	accounts := grpcTestAccounts(t, store, 7711, 7712)
+	client := newGRPCTestClient(t, NewAPIServer(&Config{}, store))
+
+	resp, err := client.Transfer(ctx, &gobankpb.TransferRequest{FromAccount: 7711, ToAccount: 7712, Amount: 25})
+	require.Nil(t, err)
+	assert.Equal(t, int64(7711), resp.FromAccount)
+	assert.Equal(t, 25.0, resp.Amount)
+	require.NotEmpty(t, resp.Reference)
+	receipt, err := store.GetTransferReceipt(ctx, resp.Reference)
+	require.Nil(t, err)
+	assert.Equal(t, int64(7712), receipt.ToAccount)
+	assert.Equal(t, int64(7500), mustAccount(t, store, accounts[0].ID).Balance)
+	assert.Equal(t, int64(12500), mustAccount(t, store, accounts[1].ID).Balance)
+
+	for _, req := range []*gobankpb.TransferRequest{
+		{FromAccount: 7711, ToAccount: 7712},
+		{FromAccount: 0, ToAccount: 7712, Amount: 5},
+		{FromAccount: 7711, ToAccount: 7712, Amount: -5},
+	} {
+		_, err = client.Transfer(ctx, req)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), req.String())
+	}
+	assert.Equal(t, int64(7500), mustAccount(t, store, accounts[0].ID).Balance)
+}
+
+func TestGRPCLogin(t *testing.T) {
+	t.Setenv("JWT_SECRET", "grpc-secret")
+	ctx := context.Background()
+	store := newMemoryStorage()
+	grpcTestAccounts(t, store, 7721)
+	client := newGRPCTestClient(t, NewAPIServer(&Config{}, store))
+
+	resp, err := client.Login(ctx, &gobankpb.LoginRequest{Number: 7721, Password: "password"})
+	require.Nil(t, err)
+	assert.Equal(t, int64(7721), resp.Number)
+	token, err := validateJWT(resp.Token)
+	require.Nil(t, err)
+	number, ok := jwtAccountNumber(token)
+	assert.True(t, ok)
+	assert.Equal(t, int64(7721), number)
+
+	_, err = client.Login(ctx, &gobankpb.LoginRequest{Number: 7721, Password: "wrong"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.Login(ctx, &gobankpb.LoginRequest{Password: "password"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestGRPCError(t *testing.T) {
+	for httpStatus, code := range grpcCodes {
+		err := grpcError(newHTTPError(httpStatus, "TEST", "failed"))
+		assert.Equal(t, code, status.Code(err), http.StatusText(httpStatus))
+		assert.Equal(t, "failed", status.Convert(err).Message())
+	}
+
+	verr := validateRequest(&TransferRequest{FromAccountNumber: 1})
+	require.Error(t, verr)
+	assert.Equal(t, codes.InvalidArgument, status.Code(grpcError(verr)))
+	assert.Equal(t, codes.NotFound, status.Code(grpcError(ErrAccountNotFound)))
+	assert.Equal(t, codes.InvalidArgument, status.Code(grpcError(errors.New("plain"))), "plain errors are bad requests")
+	assert.Equal(t, codes.Unknown, status.Code(grpcError(ErrConflict)), "no gRPC code for 409")
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Admins place legal holds (garnishments, court orders) on an account, either
+// a fixed amount or a percentage of the balance, 100 being a full hold. Held
+// money can't be sent, an account on hold can't use its overdraft and can't
+// be closed or merged away. A hold stays until it's released with a reason
+// and the document authorising the release.
+
+const (
+	AuditLegalHoldPlaced   = "legal_hold.placed"
+	AuditLegalHoldReleased = "legal_hold.released"
+)
+
+type LegalHold struct {
+	ID               int        `json:"id"`
+	AccountID        int        `json:"account_id"`
+	Amount           int64      `json:"amount,omitempty"`
+	Percent          float64    `json:"percent,omitempty"`
+	Reason           string     `json:"reason"`
+	Reference        string     `json:"reference"` // court order or case number
+	PlacedBy         string     `json:"placed_by"`
+	PlacedAt         time.Time  `json:"placed_at"`
+	ReleasedAt       *time.Time `json:"released_at,omitempty"`
+	ReleasedBy       string     `json:"released_by,omitempty"`
+	ReleaseReason    string     `json:"release_reason,omitempty"`
+	ReleaseReference string     `json:"release_reference,omitempty"`
+}
+
+func (h *LegalHold) active() bool {
+	return h.ReleasedAt == nil
+}
+
+type PlaceLegalHoldRequest struct {
+	Amount    float64 `json:"amount" validate:"min=0"`
+	Percent   float64 `json:"percent" validate:"min=0,max=100"`
+	Reason    string  `json:"reason" validate:"required,max=500"`
+	Reference string  `json:"reference" validate:"required,max=100"`
+}
+
+type ReleaseLegalHoldRequest struct {
+	Reason    string `json:"reason" validate:"required,max=500"`
+	Reference string `json:"reference" validate:"required,max=100"`
+}
+
+// LegalHolds is an account's holds with what they leave available
+type LegalHolds struct {
+	AccountID int          `json:"account_id"`
+	Balance   int64        `json:"balance"`
+	Held      int64        `json:"held"`
+	Available int64        `json:"available"`
+	Holds     []*LegalHold `json:"holds"`
+}
+
+// heldAmount is what the active holds take out of the balance, percentages
+// apply to the current balance and nothing more than the balance is held
+func heldAmount(balance int64, holds []*LegalHold) int64 {
+	var held int64
+	var percent float64
+	for _, h := range holds {
+		if h.active() {
+			held += h.Amount
+			percent += h.Percent
+		}
+	}
+	held += int64(math.Round(float64(max(balance, 0)) * min(percent, 100) / 100))
+	return min(held, max(balance, 0))
+}
+
+// availableBalance is what a transfer may take from the account
+func availableBalance(acc *Account, holds []*LegalHold) int64 {
+	for _, h := range holds {
+		if h.active() {
+			return acc.Balance - heldAmount(acc.Balance, holds)
+		}
+	}
+	return acc.Balance + acc.OverdraftLimit
+}
+
+// checkAvailable refuses a debit of amount cents beyond the available
+// balance, less what's reserved for pending transfers
+func checkAvailable(ctx context.Context, store Storage, acc *Account, amount int64) error {
+	holds, err := store.GetLegalHolds(ctx, acc.ID, true)
+	if err != nil {
+		return fmt.Errorf("could not load legal holds: %v", err)
+	}
+	reservations, err := store.GetReservations(ctx, acc.ID, true)
+	if err != nil {
+		return fmt.Errorf("could not load reservations: %v", err)
+	}
+	reserved := reservedAmount(reservations, time.Now())
+	if availableBalance(acc, holds)-reserved >= amount {
+		return nil
+	}
+	if held := heldAmount(acc.Balance, holds); held > 0 {
+		return fmt.Errorf("%w, %.2f %s is under legal hold", ErrInsufficientFunds, float64(held)/100, acc.Currency)
+	}
+	if reserved > 0 {
+		return fmt.Errorf("%w, %.2f %s is reserved", ErrInsufficientFunds, float64(reserved)/100, acc.Currency)
+	}
+	return ErrInsufficientFunds
+}
+
+func checkNoLegalHolds(ctx context.Context, store Storage, accountID int) error {
+	holds, err := store.GetLegalHolds(ctx, accountID, true)
+	if err != nil {
+		return fmt.Errorf("could not load legal holds: %v", err)
+	}
+	if len(holds) > 0 {
+		return fmt.Errorf("%w (%d active)", ErrLegalHold, len(holds))
+	}
+	return nil
+}
+
+func (s *accountService) GetLegalHolds(ctx context.Context, id int) (*LegalHolds, error) {
+	acc, err := s.store.GetAccountbyID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	holds, err := s.store.GetLegalHolds(ctx, id, false)
+	if err != nil {
+		return nil, err
+	}
+
+	held := heldAmount(acc.Balance, holds)
+	return &LegalHolds{
+		AccountID: acc.ID,
+		Balance:   acc.Balance,
+		Held:      held,
+		Available: max(availableBalance(acc, holds), 0),
+		Holds:     holds,
+	}, nil
+}
+
+func (s *accountService) PlaceLegalHold(ctx context.Context, id int, req PlaceLegalHoldRequest, actor string) (*LegalHold, error) {
+	if (req.Amount > 0) == (req.Percent > 0) {
+		return nil, invalidField("amount", "exclusive", "set either amount or percent")
+	}
+
+	acc, err := s.store.GetAccountbyID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if acc.Status == AccountClosed {
+		return nil, ErrAccountClosed
+	}
+	before, err := s.heldNow(ctx, acc)
+	if err != nil {
+		return nil, err
+	}
+
+	hold := &LegalHold{
+		AccountID: id,
+		Amount:    toCents(req.Amount),
+		Percent:   req.Percent,
+		Reason:    strings.TrimSpace(req.Reason),
+		Reference: strings.TrimSpace(req.Reference),
+		PlacedBy:  actor,
+		PlacedAt:  time.Now().UTC(),
+	}
+	if err := s.store.CreateLegalHold(ctx, hold); err != nil {
+		return nil, err
+	}
+
+	after, err := s.heldNow(ctx, acc)
+	if err != nil {
+		return nil, err
+	}
+	recordAudit(ctx, s.store, actor, id, AuditLegalHoldPlaced, []FieldChange{
+		{Field: "legal_hold", Old: nil, New: hold.ID},
+		{Field: "held", Old: before, New: after},
+	})
+	return hold, nil
+}
+
+func (s *accountService) ReleaseLegalHold(ctx context.Context, id, holdID int, req ReleaseLegalHoldRequest, actor string) (*LegalHold, error) {
+	acc, err := s.store.GetAccountbyID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	before, err := s.heldNow(ctx, acc)
+	if err != nil {
+		return nil, err
+	}
+
+	hold, err := s.store.ReleaseLegalHold(ctx, id, holdID, actor, strings.TrimSpace(req.Reason), strings.TrimSpace(req.Reference), time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := s.heldNow(ctx, acc)
+	if err != nil {
+		return nil, err
+	}
+	recordAudit(ctx, s.store, actor, id, AuditLegalHoldReleased, []FieldChange{
+		{Field: "legal_hold", Old: hold.ID, New: nil},
+		{Field: "held", Old: before, New: after},
+	})
+	return hold, nil
+}
+
+func (s *accountService) heldNow(ctx context.Context, acc *Account) (int64, error) {
+	holds, err := s.store.GetLegalHolds(ctx, acc.ID, true)
+	if err != nil {
+		return 0, err
+	}
+	return heldAmount(acc.Balance, holds), nil
+}
+
+// GET /admin/accounts/{id}/holds
+func (s *APIServer) handleGetLegalHolds(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	holds, err := s.forRequest(r).accounts().GetLegalHolds(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, holds)
+}
+
+// POST /admin/accounts/{id}/holds
+func (s *APIServer) handlePlaceLegalHold(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	s = s.forRequest(r)
+
+	var req PlaceLegalHoldRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+	hold, err := s.accounts().PlaceLegalHold(r.Context(), id, req, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusCreated, hold)
+}
+
+// POST /admin/accounts/{id}/holds/{holdID}/release
+func (s *APIServer) handleReleaseLegalHold(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	holdID, err := pathID(r, "holdID")
+	if err != nil {
+		return err
+	}
+
+	var req ReleaseLegalHoldRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+
+	hold, err := s.forRequest(r).accounts().ReleaseLegalHold(r.Context(), id, holdID, req, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, hold)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeldAmount(t *testing.T) {
+	holds := []*LegalHold{{Amount: 2000}, {Percent: 25}}
+	assert.Equal(t, int64(4500), heldAmount(10000, holds))
+	assert.Equal(t, int64(1500), heldAmount(1500, holds[:1]), "an amount hold is capped at the balance")
+	assert.Equal(t, int64(0), heldAmount(-500, holds), "nothing to hold on an overdrawn account")
+	assert.Equal(t, int64(10000), heldAmount(10000, []*LegalHold{{Percent: 100}, {Amount: 500}}), "never more than the balance")
+
+	acc := &Account{Balance: 10000, OverdraftLimit: 5000}
+	assert.Equal(t, int64(15000), availableBalance(acc, nil))
+	assert.Equal(t, int64(5500), availableBalance(acc, holds), "no overdraft while on hold")
+}
+
+func TestLegalHolds(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	from := &Account{Number: 7101, Balance: 10000, Currency: "USD", EmailVerified: true}
+	require.Nil(t, store.CreateAccount(ctx, from))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 7102, Currency: "USD"}))
+
+	accounts := NewAccountService(store)
+	transfers := NewTransferService(store, TransferLimits{}, staticRateProvider{}, nil, nil)
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	transfer := func(amount float64) error {
+		_, _, err := transfers.Transfer(ctx, TransferRequest{FromAccountNumber: 7101, ToAccountNumber: 7102, Amount: amount}, engine, "test")
+		return err
+	}
+
+	_, err = accounts.PlaceLegalHold(ctx, from.ID, PlaceLegalHoldRequest{Amount: 10, Percent: 10, Reason: "garnishment", Reference: "case 1"}, "admin")
+	assert.Error(t, err, "amount and percent together")
+
+	hold, err := accounts.PlaceLegalHold(ctx, from.ID, PlaceLegalHoldRequest{Percent: 60, Reason: "garnishment", Reference: "court order 2026/118"}, "admin")
+	require.Nil(t, err)
+
+	summary, err := accounts.GetLegalHolds(ctx, from.ID)
+	require.Nil(t, err)
+	assert.Equal(t, int64(6000), summary.Held)
+	assert.Equal(t, int64(4000), summary.Available)
+
+	err = transfer(50)
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	assert.Contains(t, err.Error(), "legal hold")
+	require.Nil(t, transfer(20))
+
+	_, err = accounts.CloseAccount(ctx, from.ID, "admin")
+	assert.ErrorIs(t, err, ErrLegalHold)
+
+	released, err := accounts.ReleaseLegalHold(ctx, from.ID, hold.ID, ReleaseLegalHoldRequest{Reason: "order satisfied", Reference: "release 2026/118"}, "admin")
+	require.Nil(t, err)
+	assert.NotNil(t, released.ReleasedAt)
+	_, err = accounts.ReleaseLegalHold(ctx, from.ID, hold.ID, ReleaseLegalHoldRequest{Reason: "again", Reference: "x"}, "admin")
+	assert.ErrorIs(t, err, ErrLegalHoldNotFound)
+
+	require.Nil(t, transfer(50))
+
+	actions := []string{}
+	for _, entry := range store.audit {
+		actions = append(actions, entry.Action)
+	}
+	assert.Contains(t, actions, AuditLegalHoldPlaced)
+	assert.Contains(t, actions, AuditLegalHoldReleased)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// POST /payments/iso20022 takes an ISO 20022 pain.001 customer credit
+// transfer initiation and answers with a pain.002 status report. Each
+// transaction becomes a TransferRequest from its payment information's
+// debtor account and goes through the same checks as POST /transfer, in
+// async mode it's queued instead. Accounts are identified by their internal
+// number under Id/Othr/Id, IBANs aren't supported. Only the token's (or
+// API key's) own account may be the debtor, payments from any other account
+// are rejected with AC01.
+//
+// A file whose NbOfTxs or CtrlSum doesn't add up is rejected as a whole
+// before anything is executed. Otherwise every transaction is reported on
+// its own: ACSC once booked, ACCP when queued, PDNG while it waits for
+// approval and RJCT with an ISO reason code when it failed. The group and
+// payment information statuses summarize their transactions, PART when
+// only some were rejected.
+
+const (
+	isoNamespace     = "urn:iso:std:iso:20022:tech:xsd:"
+	pain001Namespace = isoNamespace + "pain.001."
+
+	isoDateTime = "2006-01-02T15:04:05"
+
+	isoSettled  = "ACSC"
+	isoAccepted = "ACCP"
+	isoPending  = "PDNG"
+	isoPartial  = "PART"
+	isoRejected = "RJCT"
+)
+
+// Reason codes for rejected transactions by API error code
+var isoReasonCodes = map[string]string{
+	"ACCOUNT_NOT_FOUND":   "AC01",
+	"ACCOUNT_CLOSED":      "AC04",
+	"ACCOUNT_FROZEN":      "AC06",
+	"ACCOUNT_DORMANT":     "AC06",
+	"LEGAL_HOLD":          "AC06",
+	"INSUFFICIENT_FUNDS":  "AM04",
+	"LIMIT_EXCEEDED":      "AM02",
+	"FX_RATE_UNAVAILABLE": "AM03",
+	"TRANSFER_BLOCKED":    "FR01",
+	"VALIDATION_FAILED":   "CH16",
+}
+
+type pain001Document struct {
+	XMLName    xml.Name
+	Initiation struct {
+		GroupHeader struct {
+			MessageID    string `xml:"MsgId"`
+			Transactions string `xml:"NbOfTxs"`
+			ControlSum   string `xml:"CtrlSum"`
+		} `xml:"GrpHdr"`
+		Payments []pain001Payment `xml:"PmtInf"`
+	} `xml:"CstmrCdtTrfInitn"`
+}
+
+type pain001Payment struct {
+	ID           string               `xml:"PmtInfId"`
+	Debtor       isoAccount           `xml:"DbtrAcct"`
+	Transactions []pain001Transaction `xml:"CdtTrfTxInf"`
+}
+
+type pain001Transaction struct {
+	PaymentID struct {
+		InstructionID string `xml:"InstrId"`
+		EndToEndID    string `xml:"EndToEndId"`
+	} `xml:"PmtId"`
+	Amount struct {
+		Currency string `xml:"Ccy,attr"`
+		Value    string `xml:",chardata"`
+	} `xml:"Amt>InstdAmt"`
+	Creditor   isoAccount `xml:"CdtrAcct"`
+	Remittance string     `xml:"RmtInf>Ustrd"`
+}
+
+type isoAccount struct {
+	IBAN  string `xml:"Id>IBAN"`
+	Other string `xml:"Id>Othr>Id"`
+}
+
+// number is the internal account number the account is identified by
+func (a isoAccount) number() (int64, error) {
+	if a.IBAN != "" {
+		return 0, errors.New("IBANs aren't supported, use the account number under Othr")
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(a.Other), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is not an account number", a.Other)
+	}
+	return n, nil
+}
+
+type pain002Document struct {
+	XMLName xml.Name      `xml:"urn:iso:std:iso:20022:tech:xsd:pain.002.001.03 Document"`
+	Report  pain002Report `xml:"CstmrPmtStsRpt"`
+}
+
+type pain002Report struct {
+	GroupHeader struct {
+		MessageID string `xml:"MsgId"`
+		CreatedAt string `xml:"CreDtTm"`
+	} `xml:"GrpHdr"`
+	OriginalGroup struct {
+		MessageID    string         `xml:"OrgnlMsgId"`
+		MessageName  string         `xml:"OrgnlMsgNmId"`
+		Transactions string         `xml:"OrgnlNbOfTxs,omitempty"`
+		Status       string         `xml:"GrpSts"`
+		Reasons      []isoStsReason `xml:"StsRsnInf,omitempty"`
+	} `xml:"OrgnlGrpInfAndSts"`
+	Payments []pain002Payment `xml:"OrgnlPmtInfAndSts"`
+}
+
+type pain002Payment struct {
+	ID           string               `xml:"OrgnlPmtInfId"`
+	Status       string               `xml:"PmtInfSts"`
+	Transactions []pain002Transaction `xml:"TxInfAndSts"`
+}
+
+type pain002Transaction struct {
+	InstructionID string         `xml:"OrgnlInstrId,omitempty"`
+	EndToEndID    string         `xml:"OrgnlEndToEndId,omitempty"`
+	Status        string         `xml:"TxSts"`
+	Reasons       []isoStsReason `xml:"StsRsnInf,omitempty"`
+}
+
+type isoStsReason struct {
+	Reason *isoReasonCode `xml:"Rsn"`
+	Info   string         `xml:"AddtlInf,omitempty"`
+}
+
+type isoReasonCode struct {
+	Code string `xml:"Cd"`
+}
+
+func (r isoStsReason) code() string {
+	if r.Reason == nil {
+		return ""
+	}
+	return r.Reason.Code
+}
+
+// isoReason describes a status, ISO 20022 caps the text at 105 characters
+func isoReason(code, format string, args ...any) []isoStsReason {
+	info := fmt.Sprintf(format, args...)
+	if len(info) > 105 {
+		info = info[:105]
+	}
+	reason := isoStsReason{Info: info}
+	if code != "" {
+		reason.Reason = &isoReasonCode{Code: code}
+	}
+	return []isoStsReason{reason}
+}
+
+func rejection(err error) []isoStsReason {
+	_, apiErr := apiErrorFor(err)
+	code, ok := isoReasonCodes[apiErr.Code]
+	if !ok {
+		code = "NARR"
+	}
+	return isoReason(code, "%s", apiErr.Error)
+}
+
+// summaryStatus is the status of a group of transactions with the given statuses
+func summaryStatus(statuses []string) string {
+	rejected := 0
+	for _, status := range statuses {
+		if status == isoRejected {
+			rejected++
+		}
+	}
+	switch {
+	case len(statuses) == 0:
+		return isoRejected
+	case rejected == len(statuses):
+		return isoRejected
+	case rejected > 0:
+		return isoPartial
+	}
+	for _, status := range statuses[1:] {
+		if status != statuses[0] {
+			return isoAccepted
+		}
+	}
+	return statuses[0]
+}
+
+// checkGroupHeader compares NbOfTxs and CtrlSum with the transactions in the file
+func checkGroupHeader(doc *pain001Document) []isoStsReason {
+	count, sum := 0, int64(0)
+	for _, p := range doc.Initiation.Payments {
+		for _, tx := range p.Transactions {
+			count++
+			amount, _ := strconv.ParseFloat(strings.TrimSpace(tx.Amount.Value), 64)
+			sum += toCents(amount)
+		}
+	}
+
+	header := doc.Initiation.GroupHeader
+	if n, err := strconv.Atoi(strings.TrimSpace(header.Transactions)); err != nil || n != count {
+		return isoReason("AM18", "NbOfTxs is %q, the file has %d transactions", header.Transactions, count)
+	}
+	if header.ControlSum != "" {
+		control, err := strconv.ParseFloat(strings.TrimSpace(header.ControlSum), 64)
+		if err != nil || toCents(control) != sum {
+			return isoReason("AM10", "CtrlSum is %q, the transactions add up to %.2f", header.ControlSum, float64(sum)/100)
+		}
+	}
+	return nil
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(v)
+}
+
+// POST /payments/iso20022
+func (s *APIServer) handlePaymentInitiation(engine TransferEngine) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		s := s.forRequest(r)
+
+		owner, r, err := s.tokenAccount(r)
+		if err != nil {
+			return err
+		}
+		var doc pain001Document
+		err = xml.NewDecoder(r.Body).Decode(&doc)
+		r.Body.Close()
+		var sizeErr *http.MaxBytesError
+		if errors.As(err, &sizeErr) {
+			return bodyTooLarge(sizeErr.Limit)
+		}
+		if err != nil {
+			return invalidField("", "xml", "is not valid XML")
+		}
+		if doc.XMLName.Local != "Document" || !strings.HasPrefix(doc.XMLName.Space, pain001Namespace) {
+			return invalidField("", "message_type", "must be a pain.001 Document")
+		}
+
+		report := pain002Document{}
+		report.Report.GroupHeader.MessageID = strings.ReplaceAll(newTransferReference(), "-", "")
+		report.Report.GroupHeader.CreatedAt = time.Now().UTC().Format(isoDateTime)
+		group := &report.Report.OriginalGroup
+		group.MessageID = doc.Initiation.GroupHeader.MessageID
+		group.MessageName = strings.TrimPrefix(doc.XMLName.Space, isoNamespace)
+		group.Transactions = doc.Initiation.GroupHeader.Transactions
+
+		if reasons := checkGroupHeader(&doc); reasons != nil {
+			group.Status, group.Reasons = isoRejected, reasons
+			return writeXML(w, http.StatusOK, report)
+		}
+
+		actor := auditActor(r, s.config)
+		var statuses []string
+		for _, p := range doc.Initiation.Payments {
+			payment := s.initiatePayment(r.Context(), owner, p, engine, actor)
+			report.Report.Payments = append(report.Report.Payments, payment)
+			for _, tx := range payment.Transactions {
+				statuses = append(statuses, tx.Status)
+			}
+		}
+		group.Status = summaryStatus(statuses)
+		return writeXML(w, http.StatusOK, report)
+	}
+}
+
+// initiatePayment performs one payment information block's transactions in
+// order, the debtor has to be owner's account
+func (s *APIServer) initiatePayment(ctx context.Context, owner *Account, p pain001Payment, engine TransferEngine, actor string) pain002Payment {
+	payment := pain002Payment{ID: p.ID}
+	var statuses []string
+
+	debtor, debtorErr := p.Debtor.number()
+	if debtorErr == nil && debtor != owner.Number {
+		debtorErr = fmt.Errorf("%d is not your account", debtor)
+	}
+	var from *Account
+	if debtorErr == nil {
+		from, debtorErr = s.store.GetAccountByNumber(ctx, debtor)
+	}
+
+	for _, tx := range p.Transactions {
+		status := pain002Transaction{InstructionID: tx.PaymentID.InstructionID, EndToEndID: tx.PaymentID.EndToEndID}
+		if debtorErr != nil {
+			status.Status, status.Reasons = isoRejected, isoReason("AC01", "debtor account: %v", debtorErr)
+		} else {
+			status.Status, status.Reasons = s.initiateTransaction(ctx, from, tx, engine, actor)
+		}
+		payment.Transactions = append(payment.Transactions, status)
+		statuses = append(statuses, status.Status)
+	}
+
+	payment.Status = summaryStatus(statuses)
+	return payment
+}
+
+func (s *APIServer) initiateTransaction(ctx context.Context, from *Account, tx pain001Transaction, engine TransferEngine, actor string) (string, []isoStsReason) {
+	creditor, err := tx.Creditor.number()
+	if err != nil {
+		return isoRejected, isoReason("AC03", "creditor account: %v", err)
+	}
+	amount, err := strconv.ParseFloat(strings.TrimSpace(tx.Amount.Value), 64)
+	if err != nil || amount <= 0 {
+		return isoRejected, isoReason("AM12", "%q is not a valid amount", tx.Amount.Value)
+	}
+	// Instructed amounts are in the debtor's currency, the transfer converts
+	if tx.Amount.Currency != from.Currency {
+		return isoRejected, isoReason("AM03", "debtor account is in %s, not %s", from.Currency, tx.Amount.Currency)
+	}
+
+	req := TransferRequest{
+		FromAccountNumber: from.Number,
+		ToAccountNumber:   creditor,
+		Amount:            amount,
+		Memo:              strings.TrimSpace(tx.Remittance),
+	}
+	if err := validateRequest(&req); err != nil {
+		return isoRejected, rejection(err)
+	}
+	if _, err := s.store.GetAccountByNumber(ctx, creditor); err != nil {
+		return isoRejected, isoReason("AC03", "creditor account %d not found", creditor)
+	}
+
+	if s.config.TransferMode == TransferModeAsync {
+		job, err := s.enqueueTransfer(ctx, req, actor)
+		if err != nil {
+			return isoRejected, rejection(err)
+		}
+		return isoAccepted, isoReason("", "queued as %s", job.ID)
+	}
+
+	receipt, _, err := s.transfers().Transfer(ctx, req, engine, actor)
+	if err != nil {
+		return isoRejected, rejection(err)
+	}
+	if receipt.Status == TransferPendingApproval {
+		return isoPending, isoReason("", "transfer %s awaits approval", receipt.Reference)
+	}
+	return isoSettled, isoReason("", "transfer %s", receipt.Reference)
+}
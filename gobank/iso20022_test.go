@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func pain001(count, sum string, transactions ...string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<Document xmlns="urn:iso:std:iso:20022:tech:xsd:pain.001.001.03">
+  <CstmrCdtTrfInitn>
+    <GrpHdr><MsgId>MSG-1</MsgId><CreDtTm>2026-10-14T09:00:00</CreDtTm><NbOfTxs>` + count + `</NbOfTxs><CtrlSum>` + sum + `</CtrlSum></GrpHdr>
+    <PmtInf>
+      <PmtInfId>PMT-1</PmtInfId>
+      <DbtrAcct><Id><Othr><Id>5501</Id></Othr></Id></DbtrAcct>
+      ` + strings.Join(transactions, "\n") + `
+    </PmtInf>
+  </CstmrCdtTrfInitn>
+</Document>`
+}
+
+func creditTransfer(id, amount, currency, creditor string) string {
+	return `<CdtTrfTxInf><PmtId><InstrId>` + id + `</InstrId><EndToEndId>E2E-` + id + `</EndToEndId></PmtId>
+	<Amt><InstdAmt Ccy="` + currency + `">` + amount + `</InstdAmt></Amt>
+	<CdtrAcct><Id><Othr><Id>` + creditor + `</Id></Othr></Id></CdtrAcct>
+	<RmtInf><Ustrd>Invoice ` + id + `</Ustrd></RmtInf></CdtTrfTxInf>`
+}
+
+func TestPaymentInitiation(t *testing.T) {
+	t.Setenv("JWT_SECRET", "iso-secret")
+	ctx := context.Background()
+	store := newMemoryStorage()
+	from := &Account{Number: 5501, Balance: 10000, Currency: "USD", Status: AccountActive}
+	to := &Account{Number: 5502, Currency: "USD", Status: AccountActive}
+	require.Nil(t, store.CreateAccount(ctx, from))
+	require.Nil(t, store.CreateAccount(ctx, to))
+	s := NewAPIServer(&Config{}, store)
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+
+	token, err := createJWT(from)
+	require.Nil(t, err)
+	post := func(body string) (*httptest.ResponseRecorder, pain002Document) {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		r.Header.Set("x-jwt-token", token)
+		w := httptest.NewRecorder()
+		makeHTTPHandle(s.handlePaymentInitiation(engine))(w, r)
+		var report pain002Document
+		if w.Code == http.StatusOK {
+			require.Nil(t, xml.Unmarshal(w.Body.Bytes(), &report), w.Body.String())
+		}
+		return w, report
+	}
+
+	w, _ := post(`{"fromAccount": 5501}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	w, _ = post(`<Document xmlns="urn:iso:std:iso:20022:tech:xsd:camt.053.001.02"/>`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	// Headers that don't match the transactions reject the file untouched
+	_, report := post(pain001("2", "30.00", creditTransfer("1", "30.00", "USD", "5502")))
+	assert.Equal(t, isoRejected, report.Report.OriginalGroup.Status)
+	assert.Equal(t, "AM18", report.Report.OriginalGroup.Reasons[0].code())
+	_, report = post(pain001("1", "31.00", creditTransfer("1", "30.00", "USD", "5502")))
+	assert.Equal(t, "AM10", report.Report.OriginalGroup.Reasons[0].code())
+	assert.Equal(t, int64(10000), mustAccount(t, store, from.ID).Balance)
+
+	w, report = post(pain001("4", "1090.00",
+		creditTransfer("1", "30.00", "USD", "5502"),
+		creditTransfer("2", "10.00", "EUR", "5502"),
+		creditTransfer("3", "1000.00", "USD", "5502"),
+		creditTransfer("4", "50.00", "USD", "9999")))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/xml", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), `<Document xmlns="urn:iso:std:iso:20022:tech:xsd:pain.002.001.03">`)
+
+	group := report.Report.OriginalGroup
+	assert.Equal(t, "MSG-1", group.MessageID)
+	assert.Equal(t, "pain.001.001.03", group.MessageName)
+	assert.Equal(t, isoPartial, group.Status)
+	require.Len(t, report.Report.Payments, 1)
+	payment := report.Report.Payments[0]
+	assert.Equal(t, "PMT-1", payment.ID)
+	assert.Equal(t, isoPartial, payment.Status)
+
+	statuses := map[string]string{}
+	reasons := map[string]string{}
+	for _, tx := range payment.Transactions {
+		statuses[tx.InstructionID] = tx.Status
+		reasons[tx.InstructionID] = tx.Reasons[0].code()
+	}
+	assert.Equal(t, map[string]string{"1": isoSettled, "2": isoRejected, "3": isoRejected, "4": isoRejected}, statuses)
+	assert.Equal(t, map[string]string{"1": "", "2": "AM03", "3": "AM04", "4": "AC03"}, reasons)
+	assert.Equal(t, "E2E-1", payment.Transactions[0].EndToEndID)
+
+	assert.Equal(t, int64(7000), mustAccount(t, store, from.ID).Balance)
+	assert.Equal(t, int64(3000), mustAccount(t, store, to.ID).Balance)
+
+	// A debtor other than the token's account rejects every transaction of its payment
+	file := pain001("2", "", creditTransfer("1", "5", "USD", "5501"), creditTransfer("2", "5", "USD", "5501"))
+	_, report = post(strings.Replace(file, "<Id>5501</Id>", "<Id>5502</Id>", 1))
+	assert.Equal(t, isoRejected, report.Report.OriginalGroup.Status)
+	for _, tx := range report.Report.Payments[0].Transactions {
+		assert.Equal(t, isoRejected, tx.Status)
+		assert.Equal(t, "AC01", tx.Reasons[0].code())
+	}
+	assert.Equal(t, int64(3000), mustAccount(t, store, to.ID).Balance, "nothing left the foreign account")
+
+	// Without credentials nothing is read at all
+	w = httptest.NewRecorder()
+	makeHTTPHandle(s.handlePaymentInitiation(engine))(w, httptest.NewRequest("POST", "/", strings.NewReader(pain001("1", "", creditTransfer("1", "5", "USD", "5502")))))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, int64(7000), mustAccount(t, store, from.ID).Balance)
+}
+
+func TestSummaryStatus(t *testing.T) {
+	assert.Equal(t, isoSettled, summaryStatus([]string{isoSettled, isoSettled}))
+	assert.Equal(t, isoAccepted, summaryStatus([]string{isoSettled, isoPending}))
+	assert.Equal(t, isoPartial, summaryStatus([]string{isoSettled, isoRejected}))
+	assert.Equal(t, isoRejected, summaryStatus([]string{isoRejected}))
+	assert.Equal(t, isoRejected, summaryStatus(nil))
+}
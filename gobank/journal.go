@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The request journal records inbound requests as JSON lines so they can be
+// re-sent with `gobank replay`. Credentials never reach the journal: auth
+// headers are dropped and sensitive JSON fields are redacted, so replayed
+// logins and JWT-protected calls need credentials supplied with -header.
+
+var journalDroppedHeaders = map[string]bool{
+	"Authorization":   true,
+	"Cookie":          true,
+	"X-Jwt-Token":     true,
+	"X-Admin-Token":   true,
+	"X-Captcha-Token": true,
+}
+
+var journalRedactedFields = []string{"password", "token", "secret", "pin", "credential"}
+
+const journalRedacted = "[REDACTED]"
+
+type JournalEntry struct {
+	Time      time.Time         `json:"time"`
+	RequestID string            `json:"request_id,omitempty"`
+	Method    string            `json:"method"`
+	Path      string            `json:"path"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Body      json.RawMessage   `json:"body,omitempty"`
+	// Set when the body wasn't JSON or was over the size limit and wasn't recorded
+	BodyOmitted bool `json:"body_omitted,omitempty"`
+	Status      int  `json:"status"`
+}
+
+type requestJournal struct {
+	mu      sync.Mutex
+	w       io.Writer
+	maxBody int64
+}
+
+func openRequestJournal(cfg *Config) (*requestJournal, error) {
+	f, err := os.OpenFile(cfg.RequestJournalPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &requestJournal{w: f, maxBody: cfg.RequestJournalMaxBody}, nil
+}
+
+func (j *requestJournal) record(entry *JournalEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to encode journal entry: %v", err)
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.w.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write journal entry: %v", err)
+	}
+}
+
+func withRequestJournal(next http.Handler, j *requestJournal) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := &JournalEntry{
+			Time:      time.Now().UTC(),
+			RequestID: requestIDFromContext(r.Context()),
+			Method:    r.Method,
+			Path:      r.URL.RequestURI(),
+			Headers:   sanitizeJournalHeaders(r.Header),
+		}
+
+		// Read a bounded prefix and hand the handler the complete body
+		if r.Body != nil {
+			prefix, _ := io.ReadAll(io.LimitReader(r.Body, j.maxBody+1))
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(prefix), r.Body), r.Body}
+
+			if len(prefix) > 0 {
+				body, ok := sanitizeJournalBody(prefix)
+				if int64(len(prefix)) > j.maxBody || !ok {
+					entry.BodyOmitted = true
+				} else {
+					entry.Body = body
+				}
+			}
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		entry.Status = sw.status
+		j.record(entry)
+	})
+}
+
+func sanitizeJournalHeaders(h http.Header) map[string]string {
+	headers := map[string]string{}
+	for name := range h {
+		if journalDroppedHeaders[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+		headers[name] = h.Get(name)
+	}
+	return headers
+}
+
+// sanitizeJournalBody redacts sensitive fields anywhere in a JSON body, ok is
+// false when the body isn't JSON and can't be checked
+func sanitizeJournalBody(body []byte) (json.RawMessage, bool) {
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, false
+	}
+
+	sanitized, err := json.Marshal(redactJournalValue(v))
+	if err != nil {
+		return nil, false
+	}
+	return sanitized, true
+}
+
+func redactJournalValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if isSensitiveField(key) {
+				v[key] = journalRedacted
+				continue
+			}
+			v[key] = redactJournalValue(value)
+		}
+	case []any:
+		for i := range v {
+			v[i] = redactJournalValue(v[i])
+		}
+	}
+	return v
+}
+
+func isSensitiveField(name string) bool {
+	name = strings.ToLower(name)
+	for _, f := range journalRedactedFields {
+		if strings.Contains(name, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerFlags collects repeated -header "Name: value" flags
+type headerFlags http.Header
+
+func (h headerFlags) String() string {
+	return fmt.Sprint(http.Header(h))
+}
+
+func (h headerFlags) Set(v string) error {
+	name, value, ok := strings.Cut(v, ":")
+	if !ok {
+		return fmt.Errorf("header must look like \"Name: value\"")
+	}
+	http.Header(h).Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	return nil
+}
+
+// gobank replay -journal requests.journal -target http://localhost:8080 [-speed 1] [-header "x-jwt-token: ..."]
+func replayCommand(args []string) int {
+	cmd := flag.NewFlagSet("replay", flag.ExitOnError)
+	journalPath := cmd.String("journal", "requests.journal", "journal file to replay")
+	target := cmd.String("target", "http://localhost:8080", "base URL of the instance to send requests to")
+	speed := cmd.Float64("speed", 1, "replay speed relative to the recorded timing, 0 sends as fast as possible")
+	extra := headerFlags{}
+	cmd.Var(extra, "header", "header added to every request, may be repeated")
+	cmd.Parse(args)
+
+	f, err := os.Open(*journalPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open journal: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	base := strings.TrimRight(*target, "/")
+	sent, mismatched, failed := 0, 0, 0
+	var first time.Time
+	started := time.Now()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		entry := &JournalEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping invalid journal line: %v\n", err)
+			continue
+		}
+
+		// Keep the recorded spacing between requests, scaled by speed
+		if first.IsZero() {
+			first = entry.Time
+		}
+		if *speed > 0 {
+			due := started.Add(time.Duration(float64(entry.Time.Sub(first)) / *speed))
+			time.Sleep(time.Until(due))
+		}
+
+		status, err := replayEntry(client, base, entry, http.Header(extra))
+		sent++
+		if err != nil {
+			failed++
+			fmt.Printf("ERR  %s %s: %v\n", entry.Method, entry.Path, err)
+			continue
+		}
+		if status != entry.Status {
+			mismatched++
+			fmt.Printf("DIFF %s %s: recorded %d, got %d\n", entry.Method, entry.Path, entry.Status, status)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read journal: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Replayed %d requests in %s: %d status mismatches, %d errors\n",
+		sent, time.Since(started).Round(time.Millisecond), mismatched, failed)
+	if mismatched > 0 || failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func replayEntry(client *http.Client, base string, entry *JournalEntry, extra http.Header) (int, error) {
+	var body io.Reader
+	if len(entry.Body) > 0 {
+		body = bytes.NewReader(entry.Body)
+	}
+
+	req, err := http.NewRequest(entry.Method, base+entry.Path, body)
+	if err != nil {
+		return 0, err
+	}
+	for name, value := range entry.Headers {
+		req.Header.Set(name, value)
+	}
+	for name := range extra {
+		req.Header.Set(name, extra.Get(name))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	return resp.StatusCode, nil
+}
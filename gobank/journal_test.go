@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestJournal(t *testing.T) {
+	out := &bytes.Buffer{}
+	journal := &requestJournal{w: out, maxBody: 1024}
+
+	var received string
+	handler := withRequestJournal(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+		w.WriteHeader(http.StatusCreated)
+	}), journal)
+
+	body := `{"firstName":"A","password":"hunter2","nested":{"pin":"1234"}}`
+	req := httptest.NewRequest("POST", "/account?x=1", strings.NewReader(body))
+	req.Header.Set("x-jwt-token", "secret-jwt")
+	req.Header.Set("X-Device-ID", "device-1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// The handler still sees the original body
+	assert.Equal(t, body, received)
+
+	line := out.String()
+	assert.NotContains(t, line, "hunter2")
+	assert.NotContains(t, line, "1234")
+	assert.NotContains(t, line, "secret-jwt")
+
+	entry := &JournalEntry{}
+	require.Nil(t, json.Unmarshal([]byte(line), entry))
+	assert.Equal(t, "/account?x=1", entry.Path)
+	assert.Equal(t, http.StatusCreated, entry.Status)
+	assert.Equal(t, "device-1", entry.Headers["X-Device-Id"])
+	assert.JSONEq(t, `{"firstName":"A","password":"[REDACTED]","nested":{"pin":"[REDACTED]"}}`, string(entry.Body))
+
+	// Bodies that can't be checked for credentials aren't recorded
+	out.Reset()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/login", strings.NewReader("password=hunter2")))
+	assert.NotContains(t, out.String(), "hunter2")
+	assert.Contains(t, out.String(), `"body_omitted":true`)
+}
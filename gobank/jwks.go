@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// With JWT_KEYS set tokens are signed with asymmetric keys instead of the
+// shared JWT_SECRET. JWT_KEYS is a comma separated list of kid=path to PEM
+// files, RSA keys sign with RS256 and Ed25519 keys with EdDSA. The first key
+// must be a private key and signs new tokens, the others may be public keys
+// and only verify. Tokens carry the kid of their key so a rotation goes:
+// put the new key first, keep the old one after it until tokens signed with
+// it have expired, then drop it. The public keys are served as a JWKS at
+// /.well-known/jwks.json for other services to verify tokens with. Tokens
+// without a kid are HS256 from before the switch and keep verifying against
+// JWT_SECRET while it's set.
+
+type jwtKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer // nil for keys that only verify
+	Public  crypto.PublicKey
+}
+
+type JWTKeyring struct {
+	current *jwtKey
+	keys    map[string]*jwtKey
+	order   []string
+}
+
+// jwtKeys signs and verifies tokens when JWT_KEYS is set, main loads it
+var jwtKeys *JWTKeyring
+
+// LoadJWTKeyring reads the keys in JWT_KEYS, nil when it's empty
+func LoadJWTKeyring(cfg *Config) (*JWTKeyring, error) {
+	if strings.TrimSpace(cfg.JWTKeys) == "" {
+		return nil, nil
+	}
+
+	ring := &JWTKeyring{keys: map[string]*jwtKey{}}
+	for i, entry := range strings.Split(cfg.JWTKeys, ",") {
+		id, path, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || id == "" || path == "" {
+			return nil, fmt.Errorf("JWT_KEYS entry %q must be kid=path", entry)
+		}
+		if _, dup := ring.keys[id]; dup {
+			return nil, fmt.Errorf("JWT_KEYS has kid %q twice", id)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parseJWTKey(id, data)
+		if err != nil {
+			return nil, fmt.Errorf("JWT key %s: %v", id, err)
+		}
+		if i == 0 {
+			if key.Private == nil {
+				return nil, fmt.Errorf("JWT key %s signs new tokens and must be a private key", id)
+			}
+			ring.current = key
+		}
+		ring.keys[id] = key
+		ring.order = append(ring.order, id)
+	}
+	return ring, nil
+}
+
+// parseJWTKey accepts PKCS#1 and PKCS#8 private keys and PKIX public keys
+func parseJWTKey(id string, data []byte) (*jwtKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	var parsed any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &jwtKey{ID: id}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Method, key.Private, key.Public = jwt.SigningMethodRS256, k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.Method, key.Public = jwt.SigningMethodRS256, k
+	case ed25519.PrivateKey:
+		key.Method, key.Private, key.Public = jwt.SigningMethodEdDSA, k, k.Public()
+	case ed25519.PublicKey:
+		key.Method, key.Public = jwt.SigningMethodEdDSA, k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, use RSA or Ed25519", parsed)
+	}
+	return key, nil
+}
+
+func (k *JWTKeyring) sign(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(k.current.Method, claims)
+	token.Header["kid"] = k.current.ID
+	return token.SignedString(k.current.Private)
+}
+
+// keyFunc picks the verification key by kid, a token has to use its key's algorithm
+func (k *JWTKeyring) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		secret := os.Getenv("JWT_SECRET")
+		if _, hmac := token.Method.(*jwt.SigningMethodHMAC); !hmac || secret == "" {
+			return nil, fmt.Errorf("token has no kid")
+		}
+		return []byte(secret), nil
+	}
+
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %v for kid %q", token.Header["alg"], kid)
+	}
+	return key.Public, nil
+}
+
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS lists the public half of every key, the signing key first
+func (k *JWTKeyring) JWKS() *JWKS {
+	set := &JWKS{Keys: []JWK{}}
+	if k == nil {
+		return set
+	}
+	for _, id := range k.order {
+		key := k.keys[id]
+		jwk := JWK{KeyID: id, Use: "sig", Algorithm: key.Method.Alg()}
+		switch pub := key.Public.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType, jwk.Curve = "OKP", "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+// GET /.well-known/jwks.json, empty while tokens are signed with JWT_SECRET
+func (s *APIServer) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	WriteJSON(w, http.StatusOK, jwtKeys.JWKS())
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePEM(t *testing.T, name, kind string, der []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.Nil(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600))
+	return path
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	t.Setenv("JWT_SECRET", "legacy-secret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	require.Nil(t, err)
+	rsaPublic, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.Nil(t, err)
+
+	rsaPath := writePEM(t, "old.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+	edPath := writePEM(t, "new.pem", "PRIVATE KEY", edDER)
+	rsaPublicPath := writePEM(t, "old.pub", "PUBLIC KEY", rsaPublic)
+
+	previous := jwtKeys
+	t.Cleanup(func() { jwtKeys = previous })
+	acc := &Account{Number: 9931}
+
+	legacy, err := createJWT(acc)
+	require.Nil(t, err)
+
+	jwtKeys, err = LoadJWTKeyring(&Config{JWTKeys: "old=" + rsaPath})
+	require.Nil(t, err)
+	old, err := createJWT(acc)
+	require.Nil(t, err)
+	token, err := validateJWT(old)
+	require.Nil(t, err)
+	assert.Equal(t, "RS256", token.Method.Alg())
+	_, err = validateJWT(legacy)
+	assert.Nil(t, err, "HS256 tokens from before the switch still verify")
+
+	// After the rotation the old key only verifies
+	jwtKeys, err = LoadJWTKeyring(&Config{JWTKeys: "new=" + edPath + ",old=" + rsaPublicPath})
+	require.Nil(t, err)
+	rotated, err := createJWT(acc)
+	require.Nil(t, err)
+	token, err = validateJWT(rotated)
+	require.Nil(t, err)
+	assert.Equal(t, "new", token.Header["kid"])
+	assert.Equal(t, "EdDSA", token.Method.Alg())
+	_, err = validateJWT(old)
+	assert.Nil(t, err)
+
+	// A token can't switch its key's algorithm
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwtClaims(acc, time.Now()))
+	forged.Header["kid"] = "new"
+	signed, err := forged.SignedString([]byte("legacy-secret"))
+	require.Nil(t, err)
+	_, err = validateJWT(signed)
+	assert.NotNil(t, err)
+
+	jwtKeys, err = LoadJWTKeyring(&Config{JWTKeys: "new=" + edPath})
+	require.Nil(t, err)
+	_, err = validateJWT(old)
+	assert.NotNil(t, err, "dropped keys no longer verify")
+
+	_, err = LoadJWTKeyring(&Config{JWTKeys: "old=" + rsaPublicPath})
+	assert.NotNil(t, err, "the signing key must be private")
+
+	w := httptest.NewRecorder()
+	NewAPIServer(&Config{}, newMemoryStorage()).handleJWKS(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	var set JWKS
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &set))
+	require.Len(t, set.Keys, 1)
+	assert.Equal(t, JWK{KeyType: "OKP", KeyID: "new", Use: "sig", Algorithm: "EdDSA", Curve: "Ed25519", X: set.Keys[0].X}, set.Keys[0])
+}
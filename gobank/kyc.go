@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Account holders submit an identity document for KYC, an admin reviews it
+// and verifies or rejects the account. Only an HMAC of the document number
+// is kept, keyed with KYC_HASH_KEY, so numbers can be matched without being
+// stored: a document verifies one account at most. An account's status is
+// that of its latest submission, "unverified" before the first. Until it's
+// verified the account's daily transfer limits are capped at
+// UNVERIFIED_DAILY_TRANSFER_AMOUNT_LIMIT and _COUNT_LIMIT.
+
+const (
+	KYCUnverified = "unverified"
+	KYCPending    = "pending"
+	KYCVerified   = "verified"
+	KYCRejected   = "rejected"
+
+	AuditKYCSubmitted = "kyc.submitted"
+	AuditKYCReviewed  = "kyc.reviewed"
+)
+
+var validDocumentNumber = regexp.MustCompile(`^[A-Z0-9]{4,30}$`)
+
+type KYCSubmission struct {
+	ID                 int        `json:"id"`
+	AccountID          int        `json:"account_id"`
+	DocumentType       string     `json:"document_type"`
+	DocumentNumberHash string     `json:"document_number_hash"`
+	Status             string     `json:"status"`
+	Reason             string     `json:"reason,omitempty"` // why it was rejected
+	SubmittedAt        time.Time  `json:"submitted_at"`
+	ReviewedBy         string     `json:"reviewed_by,omitempty"`
+	ReviewedAt         *time.Time `json:"reviewed_at,omitempty"`
+}
+
+// KYCStatus is an account's verification status with its submissions, newest first
+type KYCStatus struct {
+	AccountID   int              `json:"account_id"`
+	Status      string           `json:"status"`
+	Submissions []*KYCSubmission `json:"submissions"`
+}
+
+type SubmitKYCRequest struct {
+	DocumentType   string `json:"documentType" validate:"required,oneof=passport national_id driving_licence"`
+	DocumentNumber string `json:"documentNumber" validate:"required,max=40"`
+}
+
+type ReviewKYCRequest struct {
+	Decision string `json:"decision" validate:"required,oneof=verified rejected"`
+	Reason   string `json:"reason,omitempty" validate:"max=500"`
+}
+
+// normalizeDocumentNumber uppercases the number without spaces or hyphens,
+// the way it's printed doesn't change its hash
+func normalizeDocumentNumber(number string) (string, error) {
+	number = strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(number))
+	if !validDocumentNumber.MatchString(number) {
+		return "", invalidField("documentNumber", "format", "must be 4 to 30 letters and digits")
+	}
+	return number, nil
+}
+
+func hashDocumentNumber(key, documentType, number string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(documentType + ":" + number))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// kycLimits are the transfer limits of the account, capped lower until its KYC is verified
+func kycLimits(ctx context.Context, store Storage, limits TransferLimits, accountID int) (TransferLimits, error) {
+	if limits.UnverifiedDailyAmount == 0 && limits.UnverifiedDailyCount == 0 {
+		return limits, nil
+	}
+	status, err := store.GetKYCStatus(ctx, accountID)
+	if err != nil {
+		return limits, fmt.Errorf("could not load KYC status: %v", err)
+	}
+	if status == KYCVerified {
+		return limits, nil
+	}
+	limits.DailyAmount = lowerLimit(limits.DailyAmount, limits.UnverifiedDailyAmount)
+	limits.DailyCount = int(lowerLimit(int64(limits.DailyCount), int64(limits.UnverifiedDailyCount)))
+	return limits, nil
+}
+
+// lowerLimit is the stricter of two limits where zero means unlimited
+func lowerLimit(limit, capped int64) int64 {
+	if capped == 0 || (limit > 0 && limit < capped) {
+		return limit
+	}
+	return capped
+}
+
+// senderLimits are the limits of the account sending from number, the
+// regular ones when it can't be loaded
+func (s *APIServer) senderLimits(ctx context.Context, number int64) TransferLimits {
+	acc, err := s.store.GetAccountByNumber(ctx, number)
+	if err != nil {
+		return s.transferLimits
+	}
+	limits, err := kycLimits(ctx, s.store, s.transferLimits, acc.ID)
+	if err != nil {
+		log.Printf("Failed to load transfer limits of account %d: %v", acc.ID, err)
+	}
+	return limits
+}
+
+type KYCService interface {
+	Get(ctx context.Context, accountID int) (*KYCStatus, error)
+	Submit(ctx context.Context, accountID int, req SubmitKYCRequest, actor string) (*KYCSubmission, error)
+	Review(ctx context.Context, id int, req ReviewKYCRequest, actor string) (*KYCSubmission, error)
+}
+
+type kycService struct {
+	store    Storage
+	notifier Notifier
+	hashKey  string
+}
+
+func NewKYCService(store Storage, notifier Notifier, hashKey string) KYCService {
+	return &kycService{store: store, notifier: notifier, hashKey: hashKey}
+}
+
+func (s *APIServer) kyc() KYCService {
+	return NewKYCService(s.store, s.notifier, s.config.KYCHashKey)
+}
+
+func (s *kycService) Get(ctx context.Context, accountID int) (*KYCStatus, error) {
+	if _, err := s.store.GetAccountbyID(ctx, accountID); err != nil {
+		return nil, err
+	}
+	submissions, err := s.store.GetKYCSubmissions(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	status := &KYCStatus{AccountID: accountID, Status: KYCUnverified, Submissions: submissions}
+	if len(submissions) > 0 {
+		status.Status = submissions[0].Status
+	}
+	return status, nil
+}
+
+func (s *kycService) Submit(ctx context.Context, accountID int, req SubmitKYCRequest, actor string) (*KYCSubmission, error) {
+	number, err := normalizeDocumentNumber(req.DocumentNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	acc, err := s.store.GetAccountbyID(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if acc.Status == AccountClosed {
+		return nil, ErrAccountClosed
+	}
+	before, err := s.store.GetKYCStatus(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	switch before {
+	case KYCPending:
+		return nil, ErrKYCPending
+	case KYCVerified:
+		return nil, ErrKYCVerified
+	}
+
+	sub := &KYCSubmission{
+		AccountID:          accountID,
+		DocumentType:       req.DocumentType,
+		DocumentNumberHash: hashDocumentNumber(s.hashKey, req.DocumentType, number),
+		Status:             KYCPending,
+		SubmittedAt:        time.Now().UTC(),
+	}
+	if err := s.store.CreateKYCSubmission(ctx, sub); err != nil {
+		return nil, err
+	}
+
+	recordAudit(ctx, s.store, actor, accountID, AuditKYCSubmitted, []FieldChange{
+		{Field: "kyc_status", Old: before, New: KYCPending},
+	})
+	return sub, nil
+}
+
+func (s *kycService) Review(ctx context.Context, id int, req ReviewKYCRequest, actor string) (*KYCSubmission, error) {
+	reason := strings.TrimSpace(req.Reason)
+	if req.Decision == KYCRejected && reason == "" {
+		return nil, invalidField("reason", "required", "is required to reject a submission")
+	}
+
+	sub, err := s.store.ReviewKYCSubmission(ctx, id, req.Decision, reason, actor, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	recordAudit(ctx, s.store, actor, sub.AccountID, AuditKYCReviewed, []FieldChange{
+		{Field: "kyc_status", Old: KYCPending, New: sub.Status},
+	})
+
+	message := "Your identity is verified, your account's full transfer limits now apply"
+	if sub.Status == KYCRejected {
+		message = fmt.Sprintf("We couldn't verify your identity: %s. You can submit another document.", sub.Reason)
+	}
+	if err := s.notifier.Notify(sub.AccountID, "Identity verification", message); err != nil {
+		log.Printf("Failed to notify account %d: %v", sub.AccountID, err)
+	}
+	return sub, nil
+}
+
+// GET /account/{id}/kyc
+func (s *APIServer) handleGetKYC(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	status, err := s.forRequest(r).kyc().Get(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, status)
+}
+
+// POST /account/{id}/kyc
+func (s *APIServer) handleSubmitKYC(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	s = s.forRequest(r)
+
+	var req SubmitKYCRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+	sub, err := s.kyc().Submit(r.Context(), id, req, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusCreated, sub)
+}
+
+// GET /admin/kyc, the review queue oldest first, ?status= lists verified or rejected ones
+func (s *APIServer) handleGetKYCSubmissions(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "":
+		status = KYCPending
+	case KYCPending, KYCVerified, KYCRejected:
+	default:
+		return invalidParam("query", "status", "oneof", "must be pending, verified or rejected")
+	}
+
+	submissions, err := s.store.GetKYCSubmissionsByStatus(r.Context(), status)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, submissions)
+}
+
+// POST /admin/kyc/{submissionID}/review
+func (s *APIServer) handleReviewKYC(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "submissionID")
+	if err != nil {
+		return err
+	}
+	s = s.forRequest(r)
+
+	var req ReviewKYCRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+	sub, err := s.kyc().Review(r.Context(), id, req, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, sub)
+}
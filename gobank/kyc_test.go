@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKYCWorkflow(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	ada := &Account{Number: 9811, Currency: "USD", Status: AccountActive}
+	alan := &Account{Number: 9812, Currency: "USD", Status: AccountActive}
+	require.Nil(t, store.CreateAccount(ctx, ada))
+	require.Nil(t, store.CreateAccount(ctx, alan))
+
+	notifier := &capturingNotifier{}
+	kyc := NewKYCService(store, notifier, "kyc-key")
+
+	status, err := kyc.Get(ctx, ada.ID)
+	require.Nil(t, err)
+	assert.Equal(t, KYCUnverified, status.Status)
+	assert.Empty(t, status.Submissions)
+
+	var verr *ValidationError
+	_, err = kyc.Submit(ctx, ada.ID, SubmitKYCRequest{DocumentType: "passport", DocumentNumber: "12"}, "test")
+	assert.True(t, errors.As(err, &verr))
+
+	// Only the hash is kept, however the number is written
+	first, err := kyc.Submit(ctx, ada.ID, SubmitKYCRequest{DocumentType: "passport", DocumentNumber: "ab 1234-567"}, "test")
+	require.Nil(t, err)
+	assert.Equal(t, KYCPending, first.Status)
+	assert.Equal(t, hashDocumentNumber("kyc-key", "passport", "AB1234567"), first.DocumentNumberHash)
+
+	_, err = kyc.Submit(ctx, ada.ID, SubmitKYCRequest{DocumentType: "passport", DocumentNumber: "AB1234567"}, "test")
+	assert.ErrorIs(t, err, ErrKYCPending)
+
+	_, err = kyc.Review(ctx, first.ID, ReviewKYCRequest{Decision: KYCRejected}, "admin")
+	assert.True(t, errors.As(err, &verr))
+	rejected, err := kyc.Review(ctx, first.ID, ReviewKYCRequest{Decision: KYCRejected, Reason: "photo is unreadable"}, "admin")
+	require.Nil(t, err)
+	assert.Equal(t, KYCRejected, rejected.Status)
+	assert.Equal(t, "admin", rejected.ReviewedBy)
+	require.Len(t, notifier.messages, 1)
+	assert.Contains(t, notifier.messages[0], "photo is unreadable")
+
+	_, err = kyc.Review(ctx, first.ID, ReviewKYCRequest{Decision: KYCVerified}, "admin")
+	assert.ErrorIs(t, err, ErrKYCNotFound)
+
+	// Rejected accounts may try again
+	second, err := kyc.Submit(ctx, ada.ID, SubmitKYCRequest{DocumentType: "passport", DocumentNumber: "AB1234567"}, "test")
+	require.Nil(t, err)
+	_, err = kyc.Review(ctx, second.ID, ReviewKYCRequest{Decision: KYCVerified}, "admin")
+	require.Nil(t, err)
+
+	status, err = kyc.Get(ctx, ada.ID)
+	require.Nil(t, err)
+	assert.Equal(t, KYCVerified, status.Status)
+	require.Len(t, status.Submissions, 2)
+	assert.Equal(t, second.ID, status.Submissions[0].ID)
+
+	_, err = kyc.Submit(ctx, ada.ID, SubmitKYCRequest{DocumentType: "national_id", DocumentNumber: "X98765"}, "test")
+	assert.ErrorIs(t, err, ErrKYCVerified)
+
+	// A document verifies one account
+	other, err := kyc.Submit(ctx, alan.ID, SubmitKYCRequest{DocumentType: "passport", DocumentNumber: "AB1234567"}, "test")
+	require.Nil(t, err)
+	_, err = kyc.Review(ctx, other.ID, ReviewKYCRequest{Decision: KYCVerified}, "admin")
+	assert.ErrorIs(t, err, ErrKYCDocumentInUse)
+
+	actions := []string{}
+	for _, entry := range store.audit {
+		actions = append(actions, entry.Action)
+	}
+	assert.Equal(t, []string{AuditKYCSubmitted, AuditKYCReviewed, AuditKYCSubmitted, AuditKYCReviewed, AuditKYCSubmitted}, actions)
+}
+
+func TestKYCHandlers(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9821, Currency: "USD", Status: AccountActive}))
+	s := NewAPIServer(&Config{}, store)
+
+	w := httptest.NewRecorder()
+	r := mux.SetURLVars(httptest.NewRequest("POST", "/account/1/kyc", strings.NewReader(`{"documentType": "driving_licence", "documentNumber": "DL-0042-77"}`)), map[string]string{"id": "1"})
+	makeHTTPHandle(s.handleSubmitKYC)(w, r)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	makeHTTPHandle(s.handleGetKYCSubmissions)(w, httptest.NewRequest("GET", "/admin/kyc", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var queue []*KYCSubmission
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &queue))
+	require.Len(t, queue, 1)
+	assert.Equal(t, "driving_licence", queue[0].DocumentType)
+
+	w = httptest.NewRecorder()
+	makeHTTPHandle(s.handleGetKYCSubmissions)(w, httptest.NewRequest("GET", "/admin/kyc?status=lost", nil))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	w = httptest.NewRecorder()
+	r = mux.SetURLVars(httptest.NewRequest("POST", "/admin/kyc/1/review", strings.NewReader(`{"decision": "verified"}`)), map[string]string{"submissionID": "1"})
+	makeHTTPHandle(s.handleReviewKYC)(w, r)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	r = mux.SetURLVars(httptest.NewRequest("POST", "/account/1/kyc", strings.NewReader(`{"documentType": "passport", "documentNumber": "P1234567"}`)), map[string]string{"id": "1"})
+	makeHTTPHandle(s.handleSubmitKYC)(w, r)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestUnverifiedTransferLimits(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	from := &Account{Number: 9831, Balance: 500000, Currency: "USD", Status: AccountActive}
+	require.Nil(t, store.CreateAccount(ctx, from))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9832, Currency: "USD", Status: AccountActive}))
+
+	s := NewAPIServer(&Config{DailyTransferAmount: 2000, UnverifiedDailyTransferAmount: 100}, store)
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	transfer := func(amount float64) error {
+		_, _, err := s.transfers().Transfer(ctx, TransferRequest{FromAccountNumber: 9831, ToAccountNumber: 9832, Amount: amount}, engine, "test")
+		return err
+	}
+
+	require.Nil(t, transfer(80))
+	err = transfer(30)
+	var herr *httpError
+	require.True(t, errors.As(err, &herr))
+	assert.Equal(t, "LIMIT_EXCEEDED", herr.Code)
+
+	quota, err := s.transferQuota(ctx, from.ID)
+	require.Nil(t, err)
+	assert.Equal(t, 100.0, quota.DailyAmount)
+
+	// Verified accounts get the regular limits back
+	kyc := NewKYCService(store, &capturingNotifier{}, "")
+	sub, err := kyc.Submit(ctx, from.ID, SubmitKYCRequest{DocumentType: "passport", DocumentNumber: "P7654321"}, "test")
+	require.Nil(t, err)
+	_, err = kyc.Review(ctx, sub.ID, ReviewKYCRequest{Decision: KYCVerified}, "admin")
+	require.Nil(t, err)
+	require.Nil(t, transfer(30))
+
+	quota, err = s.transferQuota(ctx, from.ID)
+	require.Nil(t, err)
+	assert.Equal(t, 2000.0, quota.DailyAmount)
+
+	assert.Equal(t, int64(500), lowerLimit(0, 500))
+	assert.Equal(t, int64(300), lowerLimit(300, 500))
+	assert.Equal(t, int64(300), lowerLimit(300, 0))
+}
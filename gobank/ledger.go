@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Balances only change through ledger entries. An entry is a set of postings
+// that sum to zero in every currency: money leaving one account lands in
+// another. Customer accounts are identified by AccountID, the bank's side of
+// fees, cashback, FX and funding by a named ledger account. Postings are
+// signed in cents, credits positive and debits negative.
+//
+// account.balance is maintained alongside the postings in the same
+// transaction so reads stay cheap. `gobank reconcile` re-derives every
+// balance from the postings and reports entries or accounts that disagree.
+
+const (
+	LedgerOpeningBalances = "equity:opening_balances" // balances that predate the ledger
+	LedgerFunding         = "equity:funding"          // seeded and manually funded money
+	LedgerFXClearing      = "clearing:fx"
+	LedgerOverdraftFees   = "income:overdraft_fees"
+	LedgerCashback        = "expense:cashback"
+)
+
+type Posting struct {
+	AccountID     int    `json:"account_id,omitempty"`
+	LedgerAccount string `json:"ledger_account,omitempty"`
+	Currency      string `json:"currency"`
+	Amount        int64  `json:"amount"`
+	Version       int64  `json:"-"` // the account's version when the entry was built
+}
+
+type LedgerEntry struct {
+	ID        int64     `json:"id"`
+	Kind      string    `json:"kind"`
+	Reference string    `json:"reference,omitempty"`
+	Memo      string    `json:"memo,omitempty"`
+	Category  string    `json:"category,omitempty"`
+	Postings  []Posting `json:"postings"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newLedgerEntry(ctx context.Context, kind string) *LedgerEntry {
+	return &LedgerEntry{Kind: kind, Reference: transferReference(ctx), CreatedAt: time.Now().UTC()}
+}
+
+type transferDetailsKey struct{}
+
+type transferDetails struct {
+	memo     string
+	category string
+	fee      int64
+}
+
+// withTransferDetails sets the memo, category and fee the transfer's ledger entry is stored with
+func withTransferDetails(ctx context.Context, memo, category string, fee int64) context.Context {
+	return context.WithValue(ctx, transferDetailsKey{}, transferDetails{memo: memo, category: category, fee: fee})
+}
+
+// account posts amount in the account's own currency. Posting fails with
+// ErrConflict if acc is stale by then.
+func (e *LedgerEntry) account(acc *Account, amount int64) *LedgerEntry {
+	return e.accountIn(acc, acc.Currency, amount)
+}
+
+func (e *LedgerEntry) accountIn(acc *Account, currency string, amount int64) *LedgerEntry {
+	e.Postings = append(e.Postings, Posting{AccountID: acc.ID, Currency: currency, Amount: amount, Version: acc.Version})
+	return e
+}
+
+func (e *LedgerEntry) ledger(name, currency string, amount int64) *LedgerEntry {
+	e.Postings = append(e.Postings, Posting{LedgerAccount: name, Currency: currency, Amount: amount})
+	return e
+}
+
+// validate rejects entries that would create or destroy money
+func (e *LedgerEntry) validate() error {
+	if len(e.Postings) < 2 {
+		return fmt.Errorf("ledger entry %s needs at least two postings", e.Kind)
+	}
+
+	sums := map[string]int64{}
+	for _, p := range e.Postings {
+		if (p.AccountID == 0) == (p.LedgerAccount == "") {
+			return fmt.Errorf("ledger entry %s: each posting needs either an account or a ledger account", e.Kind)
+		}
+		sums[p.Currency] += p.Amount
+	}
+	for currency, sum := range sums {
+		if sum != 0 {
+			return fmt.Errorf("ledger entry %s is unbalanced by %d in %q", e.Kind, sum, currency)
+		}
+	}
+	return nil
+}
+
+type balanceChange struct {
+	accountID int
+	amount    int64
+	version   int64
+}
+
+// balanceChanges nets the entry's postings per customer account, so an
+// account posted to twice is still updated (and version checked) once
+func (e *LedgerEntry) balanceChanges() []balanceChange {
+	changes := []balanceChange{}
+	index := map[int]int{}
+	for _, p := range e.Postings {
+		if p.AccountID == 0 {
+			continue
+		}
+		if i, ok := index[p.AccountID]; ok {
+			changes[i].amount += p.Amount
+			continue
+		}
+		index[p.AccountID] = len(changes)
+		changes = append(changes, balanceChange{accountID: p.AccountID, amount: p.Amount, version: p.Version})
+	}
+	return changes
+}
+
+// transferEntry moves conv.Debit out of from and conv.Credit into to. The two
+// legs of a cross-currency transfer balance through the FX clearing account,
+// the fee goes from from to income:fees in the same entry.
+func transferEntry(ctx context.Context, from, to *Account, conv Conversion) *LedgerEntry {
+	entry := newLedgerEntry(ctx, transferKind(ctx)).
+		accountIn(from, conv.FromCurrency, -toCents(conv.Debit)).
+		accountIn(to, conv.ToCurrency, toCents(conv.Credit))
+	details, _ := ctx.Value(transferDetailsKey{}).(transferDetails)
+	entry.Memo, entry.Category = details.memo, details.category
+	if details.fee != 0 {
+		entry.accountIn(from, conv.FromCurrency, -details.fee).
+			ledger(LedgerFees, conv.FromCurrency, details.fee)
+	}
+
+	if conv.IsFX() {
+		entry.ledger(LedgerFXClearing, conv.FromCurrency, toCents(conv.Debit)).
+			ledger(LedgerFXClearing, conv.ToCurrency, -toCents(conv.Credit))
+	}
+	return entry
+}
+
+// fundingEntry credits an account with money from outside the ledger
+func fundingEntry(ctx context.Context, acc *Account, amount int64) *LedgerEntry {
+	return newLedgerEntry(ctx, "funding").
+		account(acc, amount).
+		ledger(LedgerFunding, acc.Currency, -amount)
+}
+
+const (
+	DiscrepancyUnbalancedEntry = "unbalanced_entry"
+	DiscrepancyBalanceMismatch = "balance_mismatch"
+)
+
+type LedgerDiscrepancy struct {
+	Type      string `json:"type"`
+	EntryID   int64  `json:"entry_id,omitempty"`
+	AccountID int    `json:"account_id,omitempty"`
+	Currency  string `json:"currency,omitempty"`
+	Expected  int64  `json:"expected"` // zero for entries, the postings' sum for balances
+	Actual    int64  `json:"actual"`
+}
+
+type LedgerReport struct {
+	Entries       int                  `json:"entries"`
+	Accounts      int                  `json:"accounts"`
+	Discrepancies []*LedgerDiscrepancy `json:"discrepancies"`
+}
+
+func (r *LedgerReport) sort() {
+	sort.Slice(r.Discrepancies, func(i, j int) bool {
+		a, b := r.Discrepancies[i], r.Discrepancies[j]
+		if a.Type != b.Type {
+			return a.Type > b.Type
+		}
+		if a.EntryID != b.EntryID {
+			return a.EntryID < b.EntryID
+		}
+		return a.AccountID < b.AccountID
+	})
+}
+
+// gobank reconcile, exits 1 when the ledger and balances disagree
+func reconcileCommand(args []string) int {
+	cmd := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	cmd.Parse(args)
+
+	pg, err := NewPostgresStorage(LoadConfig())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open database: %v\n", err)
+		return 1
+	}
+
+	report, err := pg.ReconcileLedger(context.Background())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Reconciliation failed: %v\n", err)
+		return 1
+	}
+
+	for _, d := range report.Discrepancies {
+		switch d.Type {
+		case DiscrepancyUnbalancedEntry:
+			fmt.Printf("entry %d is unbalanced by %d in %s\n", d.EntryID, d.Actual, d.Currency)
+		case DiscrepancyBalanceMismatch:
+			fmt.Printf("account %d has balance %d, its postings sum to %d\n", d.AccountID, d.Actual, d.Expected)
+		}
+	}
+
+	fmt.Printf("Checked %d entries and %d accounts, %d discrepancies\n", report.Entries, report.Accounts, len(report.Discrepancies))
+	if len(report.Discrepancies) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLedgerEntryValidate(t *testing.T) {
+	ctx := context.Background()
+	acc := &Account{ID: 1, Currency: "USD"}
+
+	assert.Nil(t, fundingEntry(ctx, acc, 500).validate())
+	assert.Error(t, newLedgerEntry(ctx, "bad").account(acc, 500).validate(), "single posting")
+	assert.Error(t, newLedgerEntry(ctx, "bad").account(acc, 500).ledger(LedgerFunding, "USD", -499).validate(), "unbalanced")
+	assert.Error(t, newLedgerEntry(ctx, "bad").account(acc, 500).ledger(LedgerFunding, "EUR", -500).validate(), "balanced across currencies only")
+
+	entry := newLedgerEntry(ctx, "bad").account(acc, 500)
+	entry.Postings = append(entry.Postings, Posting{AccountID: 2, LedgerAccount: LedgerFunding, Currency: "USD", Amount: -500})
+	assert.Error(t, entry.validate(), "posting with both sides")
+}
+
+func TestTransferEntry(t *testing.T) {
+	ctx := withTransferReference(context.Background(), "ref")
+	from := &Account{ID: 1, Currency: "USD"}
+	to := &Account{ID: 2, Currency: "EUR"}
+
+	entry := transferEntry(ctx, from, from, sameCurrency("USD", 10))
+	require.Nil(t, entry.validate())
+	assert.Len(t, entry.Postings, 2)
+	assert.Equal(t, "ref", entry.Reference)
+
+	// The FX legs net each currency out through the clearing account
+	entry = transferEntry(ctx, from, to, Conversion{FromCurrency: "USD", ToCurrency: "EUR", Rate: 0.9, Debit: 10, Credit: 9})
+	require.Nil(t, entry.validate())
+	assert.Equal(t, []Posting{
+		{AccountID: 1, Currency: "USD", Amount: -1000},
+		{AccountID: 2, Currency: "EUR", Amount: 900},
+		{LedgerAccount: LedgerFXClearing, Currency: "USD", Amount: 1000},
+		{LedgerAccount: LedgerFXClearing, Currency: "EUR", Amount: -900},
+	}, entry.Postings)
+}
+
+func TestLedgerReconciles(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	from := &Account{Number: 7001, Balance: 10000, Currency: "USD"}
+	to := &Account{Number: 7002, Currency: "USD"}
+	require.Nil(t, store.CreateAccount(ctx, from))
+	require.Nil(t, store.CreateAccount(ctx, to))
+
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	_, _, err = NewTransferService(store, TransferLimits{}, staticRateProvider{}, nil, nil).Transfer(ctx, TransferRequest{FromAccountNumber: 7001, ToAccountNumber: 7002, Amount: 40}, engine, "test")
+	require.Nil(t, err)
+
+	// Posting against the account as read before the transfer is a conflict
+	assert.ErrorIs(t, store.PostLedgerEntry(ctx, fundingEntry(ctx, to, 250), nil), ErrConflict)
+	to, err = store.GetAccountbyID(ctx, to.ID)
+	require.Nil(t, err)
+	require.Nil(t, store.PostLedgerEntry(ctx, fundingEntry(ctx, to, 250), nil))
+	assert.Empty(t, store.reconcile())
+
+	// Unbalanced entries never reach the ledger
+	assert.Error(t, store.PostLedgerEntry(ctx, newLedgerEntry(ctx, "bad").account(to, 100), nil))
+
+	// A balance written around the ledger shows up as a mismatch
+	store.accounts[to.ID].Balance += 1
+	discrepancies := store.reconcile()
+	require.Len(t, discrepancies, 1)
+	assert.Equal(t, DiscrepancyBalanceMismatch, discrepancies[0].Type)
+	assert.Equal(t, to.ID, discrepancies[0].AccountID)
+	assert.Equal(t, int64(4250), discrepancies[0].Expected)
+}
+
+func TestBalanceCheck(t *testing.T) {
+	err := fmt.Errorf("update: %w", &pq.Error{Code: "23514", Constraint: balanceCheck})
+	assert.True(t, isCheckViolation(err, balanceCheck))
+	assert.False(t, isCheckViolation(&pq.Error{Code: "23505", Constraint: balanceCheck}, balanceCheck))
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type TransferLimits struct {
+	DailyAmount int64 // in cents, zero means unlimited
+	DailyCount  int   // zero means unlimited
+
+	// Caps for accounts without verified KYC, zero keeps the ones above
+	UnverifiedDailyAmount int64
+	UnverifiedDailyCount  int
+
+	ApprovalAbove int64 // in cents, larger transfers wait for an admin, zero disables
+
+	PIN PINPolicy
+
+	Fraud FraudRules
+
+	Retry TransferRetryPolicy
+}
+
+type TransferUsage struct {
+	Amount int64
+	Count  int
+}
+
+func NewTransferLimits(cfg *Config) TransferLimits {
+	return TransferLimits{
+		DailyAmount: toCents(cfg.DailyTransferAmount),
+		DailyCount:  cfg.DailyTransferCount,
+
+		UnverifiedDailyAmount: toCents(cfg.UnverifiedDailyTransferAmount),
+		UnverifiedDailyCount:  cfg.UnverifiedDailyTransferCount,
+
+		ApprovalAbove: toCents(cfg.TransferApprovalThreshold),
+
+		PIN: PINPolicy{
+			Above:       toCents(cfg.TransactionPINThreshold),
+			MaxAttempts: cfg.PINMaxAttempts,
+			Lockout:     cfg.PINLockout,
+		},
+
+		Fraud: NewFraudRules(cfg),
+
+		Retry: NewTransferRetryPolicy(cfg),
+	}
+}
+
+// Remaining allowance for the day, -1 when the limit is disabled
+func (l TransferLimits) Remaining(usage TransferUsage) (amount int64, count int) {
+	amount, count = -1, -1
+	if l.DailyAmount > 0 {
+		amount = max(l.DailyAmount-usage.Amount, 0)
+	}
+	if l.DailyCount > 0 {
+		count = max(l.DailyCount-usage.Count, 0)
+	}
+	return amount, count
+}
+
+func (l TransferLimits) Check(usage TransferUsage, amount int64) error {
+	if l.DailyCount > 0 && usage.Count+1 > l.DailyCount {
+		return newHTTPError(http.StatusTooManyRequests, "LIMIT_EXCEEDED",
+			"daily transfer count limit of %d reached", l.DailyCount)
+	}
+
+	if l.DailyAmount > 0 && usage.Amount+amount > l.DailyAmount {
+		return newHTTPError(http.StatusTooManyRequests, "LIMIT_EXCEEDED",
+			"daily transfer amount limit of %.2f exceeded", float64(l.DailyAmount)/100)
+	}
+
+	return nil
+}
+
+func setTransferLimitHeaders(w http.ResponseWriter, limits TransferLimits, usage TransferUsage) {
+	amount, count := limits.Remaining(usage)
+	if amount >= 0 {
+		w.Header().Set("X-Transfer-Remaining-Amount", fmt.Sprintf("%.2f", float64(amount)/100))
+	}
+	if count >= 0 {
+		w.Header().Set("X-Transfer-Remaining-Count", strconv.Itoa(count))
+	}
+}
+
+// Start of the UTC day containing t
+func startOfDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// Local midnight starting the day containing t in loc
+func startOfLocalDay(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// accountDay is the start of the account's day containing t, daily limits
+// reset at midnight in the account's timezone
+func accountDay(ctx context.Context, store Storage, accountID int, t time.Time) (time.Time, error) {
+	loc, err := accountLocation(ctx, store, accountID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return startOfLocalDay(t, loc), nil
+}
+
+func toCents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+// RateLimitQuota is the caller's bucket of one rate limit rule
+type RateLimitQuota struct {
+	Rule         string `json:"rule"`
+	Limit        int    `json:"limit"`
+	Remaining    int    `json:"remaining"`
+	ResetSeconds int    `json:"reset_seconds"` // until the bucket is full again
+}
+
+// TransferQuota is an account's use of the daily transfer limits, the
+// remaining fields are left out for limits that aren't set
+type TransferQuota struct {
+	AccountID       int       `json:"account_id"`
+	DailyAmount     float64   `json:"daily_amount,omitempty"`
+	AmountUsed      float64   `json:"amount_used"`
+	AmountRemaining *float64  `json:"amount_remaining,omitempty"`
+	DailyCount      int       `json:"daily_count,omitempty"`
+	CountUsed       int       `json:"count_used"`
+	CountRemaining  *int      `json:"count_remaining,omitempty"`
+	ResetsAt        time.Time `json:"resets_at"`
+	Timezone        string    `json:"timezone"` // the account's, ResetsAt is its next midnight
+}
+
+type CallerLimits struct {
+	RateLimits []*RateLimitQuota `json:"rate_limits"`
+	Transfers  *TransferQuota    `json:"transfers,omitempty"` // with an x-jwt-token only
+}
+
+// GET /limits, the rate limit buckets the caller is keyed into without
+// spending from them, and with a token or API key the account's daily
+// transfer usage
+func (s *APIServer) handleGetLimits(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	limits := &CallerLimits{RateLimits: []*RateLimitQuota{}}
+	if s.rateLimiter != nil {
+		for _, rule := range s.rateLimiter.rules {
+			key := rule.key(r)
+			if key == "" {
+				continue
+			}
+			res, err := s.rateLimiter.store.Peek(rule.name+":"+key, rule.limit)
+			if err != nil {
+				return err
+			}
+			limits.RateLimits = append(limits.RateLimits, &RateLimitQuota{
+				Rule:         rule.name,
+				Limit:        res.Limit,
+				Remaining:    res.Remaining,
+				ResetSeconds: int(math.Ceil(res.Reset.Seconds())),
+			})
+		}
+	}
+
+	if r.Header.Get("x-jwt-token") != "" || r.Header.Get("x-api-key") != "" {
+		acc, _, err := s.tokenAccount(r)
+		if err != nil {
+			return err
+		}
+		if limits.Transfers, err = s.transferQuota(r.Context(), acc.ID); err != nil {
+			return err
+		}
+	}
+
+	return WriteJSON(w, http.StatusOK, limits)
+}
+
+func (s *APIServer) transferQuota(ctx context.Context, accountID int) (*TransferQuota, error) {
+	today, err := accountDay(ctx, s.store, accountID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	usage, err := s.store.GetDailyTransferUsage(ctx, accountID, today)
+	if err != nil {
+		return nil, err
+	}
+	limits, err := kycLimits(ctx, s.store, s.transferLimits, accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &TransferQuota{
+		AccountID:   accountID,
+		DailyAmount: float64(limits.DailyAmount) / 100,
+		AmountUsed:  float64(usage.Amount) / 100,
+		DailyCount:  limits.DailyCount,
+		CountUsed:   usage.Count,
+		ResetsAt:    today.AddDate(0, 0, 1),
+		Timezone:    today.Location().String(),
+	}
+	amount, count := limits.Remaining(*usage)
+	if amount >= 0 {
+		remaining := float64(amount) / 100
+		q.AmountRemaining = &remaining
+	}
+	if count >= 0 {
+		q.CountRemaining = &count
+	}
+	return q, nil
+}
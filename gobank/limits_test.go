@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransferLimitsCheck(t *testing.T) {
+	limits := TransferLimits{DailyAmount: 10000, DailyCount: 2}
+
+	assert.Nil(t, limits.Check(TransferUsage{Amount: 5000, Count: 1}, 5000))
+
+	err := limits.Check(TransferUsage{Amount: 5000, Count: 1}, 5001)
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusTooManyRequests, err.(*httpError).Status)
+	}
+
+	assert.Error(t, limits.Check(TransferUsage{Amount: 0, Count: 2}, 1))
+}
+
+func TestTransferLimitsRemaining(t *testing.T) {
+	limits := TransferLimits{DailyAmount: 10000}
+
+	amount, count := limits.Remaining(TransferUsage{Amount: 12000, Count: 3})
+	assert.Equal(t, int64(0), amount)
+	assert.Equal(t, -1, count)
+}
+
+// barrierStorage holds the first posts back until all of them have been
+// made, every one of those transfers has passed its checks by then
+type barrierStorage struct {
+	*memoryStorage
+	held    atomic.Int32
+	waiting sync.WaitGroup
+}
+
+func (s *barrierStorage) PostLedgerEntry(ctx context.Context, entry *LedgerEntry, tx Transaction) error {
+	if s.held.Add(-1) >= 0 {
+		s.waiting.Done()
+		s.waiting.Wait()
+	}
+	return s.memoryStorage.PostLedgerEntry(ctx, entry, tx)
+}
+
+func TestConcurrentTransfersDailyLimit(t *testing.T) {
+	ctx := context.Background()
+	store := &barrierStorage{memoryStorage: newMemoryStorage()}
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9871, Balance: 100000, Currency: "USD"}))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9872, Currency: "USD"}))
+
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	limits := TransferLimits{DailyAmount: 5000, Retry: TransferRetryPolicy{Attempts: 20}}
+	s := NewTransferService(store, limits, staticRateProvider{}, nil, nil)
+
+	// All of them pass the checks before any has been booked
+	errs := make([]error, 10)
+	store.held.Store(int32(len(errs)))
+	store.waiting.Add(len(errs))
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, errs[i] = s.Transfer(ctx, TransferRequest{FromAccountNumber: 9871, ToAccountNumber: 9872, Amount: 10}, engine, "test")
+		}()
+	}
+	wg.Wait()
+
+	var sent int
+	for _, err := range errs {
+		if err == nil {
+			sent++
+			continue
+		}
+		_, apiErr := apiErrorFor(err)
+		assert.Equal(t, "LIMIT_EXCEEDED", apiErr.Code, err.Error())
+	}
+	assert.Equal(t, 5, sent)
+	from := mustAccount(t, store, 1)
+	assert.Equal(t, int64(95000), from.Balance)
+	usage, err := store.GetDailyTransferUsage(ctx, from.ID, startOfLocalDay(time.Now(), time.UTC))
+	require.Nil(t, err)
+	assert.Equal(t, TransferUsage{Amount: 5000, Count: 5}, *usage)
+}
+
+func TestHandleGetLimits(t *testing.T) {
+	t.Setenv("JWT_SECRET", "limits-secret")
+	ctx := context.Background()
+	store := newMemoryStorage()
+	from := &Account{Number: 9971, Balance: 100000, Currency: "USD", Status: AccountActive, EmailVerified: true}
+	require.Nil(t, store.CreateAccount(ctx, from))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9972, Currency: "USD", Status: AccountActive}))
+
+	s := NewAPIServer(&Config{DailyTransferAmount: 500}, store)
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	_, _, err = s.transfers().Transfer(ctx, TransferRequest{FromAccountNumber: 9971, ToAccountNumber: 9972, Amount: 120}, engine, "test")
+	require.Nil(t, err)
+
+	s.rateLimiter = &rateLimiter{store: NewMemoryRateLimitStore()}
+	login := s.rateLimiter.wrap(func(w http.ResponseWriter, r *http.Request) {},
+		rateLimitRule{name: "login-ip", limit: perMinute(5), key: rateLimitByIP},
+		rateLimitRule{name: "login-account", limit: perMinute(5), key: rateLimitByLoginNumber},
+	)
+	login(httptest.NewRecorder(), httptest.NewRequest("POST", "/login", nil))
+
+	get := func(token string) (int, *CallerLimits) {
+		r := httptest.NewRequest("GET", "/limits", nil)
+		if token != "" {
+			r.Header.Set("x-jwt-token", token)
+		}
+		w := httptest.NewRecorder()
+		makeHTTPHandle(s.handleGetLimits)(w, r)
+		limits := &CallerLimits{}
+		json.Unmarshal(w.Body.Bytes(), limits)
+		return w.Code, limits
+	}
+
+	code, limits := get("")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []*RateLimitQuota{{Rule: "login-ip", Limit: 5, Remaining: 4, ResetSeconds: 12}}, limits.RateLimits)
+	assert.Nil(t, limits.Transfers)
+
+	token, err := createJWT(from)
+	require.Nil(t, err)
+	code, limits = get(token)
+	require.Equal(t, http.StatusOK, code)
+	require.NotNil(t, limits.Transfers)
+	assert.Equal(t, 500.0, limits.Transfers.DailyAmount)
+	assert.Equal(t, 120.0, limits.Transfers.AmountUsed)
+	assert.Equal(t, 380.0, *limits.Transfers.AmountRemaining)
+	assert.Equal(t, 1, limits.Transfers.CountUsed)
+	assert.Nil(t, limits.Transfers.CountRemaining, "no count limit")
+	assert.Equal(t, 4, limits.RateLimits[0].Remaining, "looking doesn't spend")
+
+	code, _ = get("not-a-token")
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestAccountTimezoneDailyLimits(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	acc := &Account{Number: 9861, Currency: "USD", Status: AccountActive}
+	require.Nil(t, store.CreateAccount(ctx, acc))
+	s := NewAPIServer(&Config{DailyTransferAmount: 500}, store)
+
+	prefs, err := s.accounts().GetPreferences(ctx, acc.ID)
+	require.Nil(t, err)
+	assert.Equal(t, "UTC", prefs.Timezone)
+
+	for _, tz := range []string{"Mars/Olympus", "Local", ""} {
+		_, err = s.accounts().UpdatePreferences(ctx, acc.ID, UpdatePreferencesRequest{Timezone: &tz}, "test")
+		var verr *ValidationError
+		assert.True(t, errors.As(err, &verr), tz)
+	}
+	tz := "America/New_York"
+	r := mux.SetURLVars(httptest.NewRequest("PATCH", "/account/1/preferences", strings.NewReader(`{"timezone": "America/New_York"}`)), map[string]string{"id": "1"})
+	w := httptest.NewRecorder()
+	makeHTTPHandle(s.handleUpdatePreferences)(w, r)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	prefs = &AccountPreferences{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), prefs))
+	assert.Equal(t, tz, prefs.Timezone)
+	require.Len(t, store.audit, 1)
+	assert.Equal(t, []FieldChange{{Field: "timezone", Old: "UTC", New: tz}}, store.audit[0].Changes)
+
+	// 02:00 UTC is still the evening before in New York
+	day, err := accountDay(ctx, store, acc.ID, time.Date(2026, 3, 10, 2, 0, 0, 0, time.UTC))
+	require.Nil(t, err)
+	assert.Equal(t, time.Date(2026, 3, 9, 4, 0, 0, 0, time.UTC), day.UTC())
+
+	store.transfers = append(store.transfers,
+		memoryTransfer{fromAccountID: acc.ID, amount: 100, kind: TransferKindTransfer, createdAt: time.Date(2026, 3, 9, 3, 0, 0, 0, time.UTC)},
+		memoryTransfer{fromAccountID: acc.ID, amount: 200, kind: TransferKindTransfer, createdAt: time.Date(2026, 3, 10, 2, 0, 0, 0, time.UTC)},
+	)
+	usage, err := store.GetDailyTransferUsage(ctx, acc.ID, day)
+	require.Nil(t, err)
+	assert.Equal(t, TransferUsage{Amount: 200, Count: 1}, *usage)
+
+	// The clocks go forward on 8 March, that day is 23 hours long
+	dst := startOfLocalDay(time.Date(2026, 3, 8, 12, 0, 0, 0, time.UTC), day.Location())
+	assert.Equal(t, 23*time.Hour, dst.AddDate(0, 0, 1).Sub(dst))
+
+	quota, err := s.transferQuota(ctx, acc.ID)
+	require.Nil(t, err)
+	assert.Equal(t, tz, quota.Timezone)
+	local := quota.ResetsAt.In(day.Location())
+	assert.Equal(t, 0, local.Hour())
+	assert.WithinDuration(t, time.Now(), quota.ResetsAt, 25*time.Hour)
+}
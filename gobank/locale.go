@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Responses carrying amounts in cents can also carry them formatted for
+// display. A client asks with ?locale=de-DE, or gets the best supported
+// match of its Accept-Language header; responses then gain a "formatted"
+// object with one string per amount, keyed by the amount's JSON path, and
+// the locale's tag as "locale". The raw cents stay as they are. Amounts are
+// always shown with two decimals, like they're stored, whatever the
+// currency's usual minor unit.
+
+type Locale struct {
+	Tag     string
+	Decimal string
+	Group   string
+	// Symbol after the amount, separated by a no-break space, rather than before it
+	SymbolAfter bool
+}
+
+var locales = map[string]*Locale{
+	"en-US": {Tag: "en-US", Decimal: ".", Group: ","},
+	"en-GB": {Tag: "en-GB", Decimal: ".", Group: ","},
+	"de-DE": {Tag: "de-DE", Decimal: ",", Group: ".", SymbolAfter: true},
+	"es-ES": {Tag: "es-ES", Decimal: ",", Group: ".", SymbolAfter: true},
+	"fr-FR": {Tag: "fr-FR", Decimal: ",", Group: "\u202f", SymbolAfter: true},
+	"ja-JP": {Tag: "ja-JP", Decimal: ".", Group: ","},
+}
+
+// Locales used for a bare language tag or another region of the language
+var defaultLocales = map[string]string{
+	"en": "en-US",
+	"de": "de-DE",
+	"es": "es-ES",
+	"fr": "fr-FR",
+	"ja": "ja-JP",
+}
+
+// Currencies without a symbol here are shown with their code
+var currencySymbols = map[string]string{
+	"USD": "$",
+	"EUR": "€",
+	"GBP": "£",
+	"JPY": "¥",
+	"INR": "₹",
+	"CAD": "CA$",
+	"AUD": "A$",
+}
+
+// findLocale matches a language tag like fr-CH to a supported locale
+func findLocale(tag string) *Locale {
+	tag = strings.TrimSpace(tag)
+	for t, l := range locales {
+		if strings.EqualFold(t, tag) {
+			return l
+		}
+	}
+	lang, _, _ := strings.Cut(tag, "-")
+	return locales[defaultLocales[strings.ToLower(lang)]]
+}
+
+// acceptedLocale is the best supported match of an Accept-Language header
+func acceptedLocale(header string) *Locale {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	tags := []weighted{}
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if tag = strings.TrimSpace(tag); tag != "" && tag != "*" && q > 0 {
+			tags = append(tags, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	for _, t := range tags {
+		if l := findLocale(t.tag); l != nil {
+			return l
+		}
+	}
+	return nil
+}
+
+// requestLocale is the locale the request asked for, nil when it didn't ask
+// for one or Accept-Language has no supported match
+func requestLocale(r *http.Request) (*Locale, error) {
+	if tag := r.URL.Query().Get("locale"); tag != "" {
+		l := findLocale(tag)
+		if l == nil {
+			return nil, invalidParam("query", "locale", "oneof", "is not a supported locale")
+		}
+		return l, nil
+	}
+	return acceptedLocale(r.Header.Get("Accept-Language")), nil
+}
+
+// Format renders cents of currency like 1.234,56 € or -$1,234.56
+func (l *Locale) Format(cents int64, currency string) string {
+	sign := ""
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+
+	units := strconv.FormatInt(cents/100, 10)
+	var b strings.Builder
+	for i, c := range units {
+		if i > 0 && (len(units)-i)%3 == 0 {
+			b.WriteString(l.Group)
+		}
+		b.WriteRune(c)
+	}
+	number := b.String() + l.Decimal + strconv.FormatInt(cents%100+100, 10)[1:]
+
+	symbol, ok := currencySymbols[currency]
+	if !ok {
+		symbol = currency
+	}
+	if l.SymbolAfter {
+		return sign + number + "\u00a0" + symbol
+	}
+	if !ok {
+		// Codes need a space to stay readable
+		return sign + symbol + "\u00a0" + number
+	}
+	return sign + symbol + number
+}
+
+// writeLocalized writes v like WriteJSON, adding amounts formatted for the
+// request's locale when it asked for one. amounts are in cents of currency,
+// keyed by their path in v's JSON.
+func writeLocalized(w http.ResponseWriter, r *http.Request, status int, v any, currency string, amounts map[string]int64) error {
+	w.Header().Add("Vary", "Accept-Language")
+	l, err := requestLocale(r)
+	if err != nil {
+		return err
+	}
+	if l == nil {
+		return WriteJSON(w, status, v)
+	}
+
+	body, err := json.Marshal(responseValue(w, v))
+	if err != nil {
+		return err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return err
+	}
+
+	formatted := make(map[string]string, len(amounts))
+	for path, cents := range amounts {
+		formatted[path] = l.Format(cents, currency)
+	}
+	if fields["formatted"], err = json.Marshal(formatted); err != nil {
+		return err
+	}
+	fields["locale"], _ = json.Marshal(l.Tag)
+
+	w.Header().Set("Content-Language", l.Tag)
+	return WriteJSON(w, status, fields)
+}
+
+// accountAmounts are the amounts of an account response
+func accountAmounts(acc *Account) map[string]int64 {
+	amounts := map[string]int64{
+		"balance":         acc.Balance,
+		"overdraft_limit": acc.OverdraftLimit,
+	}
+	if acc.AvailableBalance != nil {
+		amounts["available_balance"] = *acc.AvailableBalance
+	}
+	return amounts
+}
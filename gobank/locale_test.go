@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocaleFormat(t *testing.T) {
+	for _, tc := range []struct {
+		tag      string
+		cents    int64
+		currency string
+		want     string
+	}{
+		{"en-US", 123456789, "USD", "$1,234,567.89"},
+		{"en-US", -5, "USD", "-$0.05"},
+		{"en-GB", 100000, "GBP", "£1,000.00"},
+		{"en-US", 1250, "CHF", "CHF\u00a012.50"},
+		{"de-DE", 123456, "EUR", "1.234,56\u00a0€"},
+		{"de-DE", -99, "USD", "-0,99\u00a0$"},
+		{"fr-FR", 1234567, "EUR", "12\u202f345,67\u00a0€"},
+		{"ja-JP", 500000, "JPY", "¥5,000.00"},
+	} {
+		assert.Equal(t, tc.want, locales[tc.tag].Format(tc.cents, tc.currency), tc.tag)
+	}
+}
+
+func TestAcceptedLocale(t *testing.T) {
+	assert.Equal(t, "fr-FR", acceptedLocale("fr-CH, fr;q=0.9, en;q=0.8, *;q=0.5").Tag)
+	assert.Equal(t, "de-DE", acceptedLocale("pt-BR, en;q=0.5, de;q=0.7").Tag)
+	assert.Equal(t, "en-GB", acceptedLocale("EN-gb").Tag)
+	assert.Nil(t, acceptedLocale("pt-BR, en;q=0"))
+	assert.Nil(t, acceptedLocale(""))
+}
+
+func TestLocalizedAccountResponse(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	acc := &Account{Number: 9901, Balance: 123456, Currency: "EUR", Status: AccountActive}
+	require.Nil(t, store.CreateAccount(ctx, acc))
+	s := NewAPIServer(&Config{}, store)
+
+	get := func(query, acceptLanguage string) (*httptest.ResponseRecorder, map[string]any) {
+		r := mux.SetURLVars(httptest.NewRequest("GET", "/account/1"+query, nil), map[string]string{"id": "1"})
+		if acceptLanguage != "" {
+			r.Header.Set("Accept-Language", acceptLanguage)
+		}
+		w := httptest.NewRecorder()
+		makeHTTPHandle(s.handleGetAccountByID)(w, r)
+		body := map[string]any{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w, body
+	}
+
+	w, body := get("", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, body, "formatted")
+	assert.Contains(t, w.Header().Values("Vary"), "Accept-Language")
+
+	w, body = get("", "de-AT, en;q=0.5")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "de-DE", w.Header().Get("Content-Language"))
+	assert.Equal(t, "de-DE", body["locale"])
+	assert.Equal(t, 123456.0, body["balance"], "raw cents stay")
+	formatted := body["formatted"].(map[string]any)
+	assert.Equal(t, "1.234,56\u00a0€", formatted["balance"])
+	assert.Equal(t, "0,00\u00a0€", formatted["overdraft_limit"])
+
+	// The query parameter wins over the header
+	_, body = get("?locale=en-US", "de-DE")
+	assert.Equal(t, "€1,234.56", body["formatted"].(map[string]any)["balance"])
+
+	w, _ = get("?locale=xx-YY", "")
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+}
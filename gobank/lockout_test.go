@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginLockout(t *testing.T) {
+	t.Setenv("JWT_SECRET", "lockout-secret")
+	ctx := context.Background()
+	store := newMemoryStorage()
+	acc, err := NewAccount("Lou", "Locke", "password")
+	require.Nil(t, err)
+	acc.Number = 9921
+	require.Nil(t, store.CreateAccount(ctx, acc))
+
+	s := NewAPIServer(&Config{LoginMaxAttempts: 3, LoginLockout: time.Hour}, store)
+	login := func(password string) (int, ApiError) {
+		body, _ := json.Marshal(LoginRequest{Number: 9921, Password: password})
+		w := httptest.NewRecorder()
+		makeHTTPHandle(s.handleLogin)(w, httptest.NewRequest("POST", "/v1/login", bytes.NewReader(body)))
+		var apiErr ApiError
+		json.Unmarshal(w.Body.Bytes(), &apiErr)
+		return w.Code, apiErr
+	}
+
+	code, apiErr := login("wrong")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	require.NotNil(t, apiErr.RemainingAttempts)
+	assert.Equal(t, 2, *apiErr.RemainingAttempts)
+
+	// A successful login starts the count over
+	code, _ = login("password")
+	require.Equal(t, http.StatusOK, code)
+	login("wrong")
+	login("wrong")
+	code, apiErr = login("wrong")
+	assert.Equal(t, http.StatusLocked, code)
+	assert.Equal(t, "ACCOUNT_LOCKED", apiErr.Code)
+	assert.NotNil(t, apiErr.LockedUntil)
+	code, _ = login("password")
+	assert.Equal(t, http.StatusLocked, code, "the right password waits for the lock too")
+
+	r := mux.SetURLVars(httptest.NewRequest("POST", "/v1/admin/accounts/1/unlock", nil), map[string]string{"id": "1"})
+	w := httptest.NewRecorder()
+	makeHTTPHandle(s.handleUnlockAccount)(w, r)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	code, _ = login("password")
+	assert.Equal(t, http.StatusOK, code)
+
+	var actions []string
+	for _, entry := range store.audit {
+		actions = append(actions, entry.Action)
+	}
+	assert.Subset(t, actions, []string{AuditLoginFailed, AuditAccountLocked, AuditAccountUnlocked})
+}
@@ -1,73 +1,227 @@
-package main
-
-import (
-	"flag"
-	"fmt"
-	"log"
-)
-
-func seedAccount(store Storage, fname, lname, pw string) *Account {
-	acc, err := NewAccount(fname, lname, pw)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	if err := store.CreateAccount(acc); err != nil {
-		log.Fatal(err)
-	}
-
-	fmt.Printf("New Account Created - ID: %d, Number: %d\n", acc.ID, acc.Number)
-
-	// Add initial balance
-	tx, err := store.BeginTransaction()
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer tx.Rollback()
-
-	initialBalance := 1000.00
-	if err := store.UpdateAccountBalance(acc.ID, initialBalance, tx); err != nil {
-		log.Fatalf("Failed to update account balance: %v", err)
-	}
-
-	if err := tx.Commit(); err != nil {
-		log.Fatal(err)
-	}
-
-	// Verify the balance after transaction
-	updatedAccount, err := store.GetAccountByNumber(acc.Number)
-	if err != nil {
-		log.Fatalf("Failed to retrieve updated account: %v", err)
-	}
-
-	fmt.Printf("Account Balance After Seeding: $%.2f\n", float64(updatedAccount.Balance)/100)
-
-	return acc
-}
-
-func seedAccounts(s Storage) {
-	seedAccount(s, "Transfer", "Test", "transfer123")
-}
-
-func main() {
-	seed := flag.Bool("seed", false, "seed the DB")
-	flag.Parse()
-
-	store, err := NewPostgresStorage()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	if err := store.init(); err != nil {
-		log.Fatal(err)
-	}
-
-	if *seed {
-		fmt.Println("Seeding DB...")
-		//Seed stuff
-		seedAccounts(store)
-	}
-
-	server := NewAPIServer(":8080", store)
-	server.Run()
-}
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+func seedAccount(store Storage, fname, lname, pw string) *Account {
+	ctx := context.Background()
+
+	acc, err := NewAccount(fname, lname, pw)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := store.CreateAccount(ctx, acc); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("New Account Created - ID: %d, Number: %d\n", acc.ID, acc.Number)
+
+	// Add initial balance
+	tx, err := store.BeginTransaction(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	initialBalance := 1000.00
+	if err := store.PostLedgerEntry(ctx, fundingEntry(ctx, acc, toCents(initialBalance)), tx); err != nil {
+		log.Fatalf("Failed to update account balance: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Verify the balance after transaction
+	updatedAccount, err := store.GetAccountByNumber(ctx, acc.Number)
+	if err != nil {
+		log.Fatalf("Failed to retrieve updated account: %v", err)
+	}
+
+	fmt.Printf("Account Balance After Seeding: $%.2f\n", float64(updatedAccount.Balance)/100)
+
+	return acc
+}
+
+func seedAccounts(s Storage) {
+	seedAccount(s, "Transfer", "Test", "transfer123")
+}
+
+const usage = `usage: gobank <command> [flags]
+
+commands:
+  serve               run the API server (the default)
+  migrate             apply pending migrations for a phase and exit
+  admin               create-account, credit and list accounts
+  reconcile           check balances against the ledger
+  rebuild-projection  recompute balances from the account event streams
+  replay              replay recorded requests against a server
+  verify-contracts    check a server against the recorded contracts
+  anonymize           scrub a copy of the database
+  export              write all accounts and ledger entries to a file
+  import              load an export into an empty database
+  restore             check a backup and load it into an empty database`
+
+func main() {
+	cfg := LoadConfig()
+	hasher, err := NewPasswordHasher(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	passwords = hasher
+	notificationRules = NewNotificationRules(cfg)
+
+	if jwtKeys, err = LoadJWTKeyring(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// Bare flags keep working as `gobank -seed` did before subcommands
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		os.Exit(serveCommand(args))
+	case "migrate":
+		os.Exit(migrateCommand(args))
+	case "admin":
+		os.Exit(adminCommand(args))
+	case "verify-contracts":
+		os.Exit(verifyContractsCommand(args))
+	case "replay":
+		os.Exit(replayCommand(args))
+	case "anonymize":
+		os.Exit(anonymizeCommand(args))
+	case "export":
+		os.Exit(exportCommand(args))
+	case "import":
+		os.Exit(importCommand(args))
+	case "restore":
+		os.Exit(restoreCommand(args))
+	case "reconcile":
+		os.Exit(reconcileCommand(args))
+	case "rebuild-projection":
+		os.Exit(rebuildProjectionCommand(args))
+	case "help":
+		fmt.Println(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n%s\n", command, usage)
+		os.Exit(2)
+	}
+}
+
+func serveCommand(args []string) int {
+	cmd := flag.NewFlagSet("serve", flag.ExitOnError)
+	seed := cmd.Bool("seed", false, "seed the DB")
+	migrate := cmd.String("migrate", "", "deprecated, use gobank migrate -phase")
+	cmd.Parse(args)
+
+	if *migrate != "" {
+		return migrateCommand([]string{"-phase", *migrate})
+	}
+
+	cfg := LoadConfig()
+	store, err := openStorage(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *seed {
+		fmt.Println("Seeding DB...")
+		//Seed stuff
+		seedAccounts(store)
+	}
+
+	server := NewAPIServer(cfg, store)
+	server.Run()
+	return 0
+}
+
+func migrateCommand(args []string) int {
+	cmd := flag.NewFlagSet("migrate", flag.ExitOnError)
+	phaseName := cmd.String("phase", string(PreDeploy), "pre-deploy or post-deploy")
+	cmd.Parse(args)
+
+	phase, err := ParseMigrationPhase(*phaseName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	pg, err := NewPostgresStorage(LoadConfig())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open database: %v\n", err)
+		return 1
+	}
+	if err := pg.init(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to prepare migrations: %v\n", err)
+		return 1
+	}
+	if err := pg.Migrate(phase); err != nil {
+		fmt.Fprintf(os.Stderr, "Migration failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// openStorage connects to Postgres, checks the schema and wraps it in the
+// configured backend
+func openStorage(cfg *Config) (Storage, error) {
+	pg, err := NewPostgresStorage(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := pg.init(); err != nil {
+		return nil, err
+	}
+
+	if cfg.AutoMigrate {
+		if err := pg.Migrate(PreDeploy); err != nil {
+			return nil, err
+		}
+	}
+
+	// Refuse to boot against a schema this build can't work with
+	if err := pg.VerifySchema(); err != nil {
+		return nil, fmt.Errorf("Incompatible database schema: %v", err)
+	}
+	if cfg.DBPrepareStatements {
+		if err := pg.PrepareStatements(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+
+	var store Storage
+	switch cfg.StorageBackend {
+	case "postgres":
+		store = pg
+	case "corebanking":
+		// Keeps its own account cache
+		return NewCoreBankingStorage(cfg, pg), nil
+	case "eventsourced":
+		store = NewEventSourcedStorage(cfg, pg)
+	default:
+		return nil, fmt.Errorf("Unknown storage backend %q", cfg.StorageBackend)
+	}
+
+	if cfg.AccountCacheTTL <= 0 {
+		return store, nil
+	}
+	cache, err := NewAccountCache(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewCachedStorage(store, cache), nil
+}
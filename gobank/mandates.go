@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A mandate lets a creditor account pull money from a payer's account. The
+// creditor sets it up, it does nothing until the payer approves it, and
+// either side can cancel it. While it's active the creditor submits
+// collections, each up to what's left of MaxAmount for the daily, weekly or
+// monthly period it falls in. The collection job performs them once due as
+// transfers of kind "direct_debit", which don't count towards the payer's
+// daily limits. A collection that fails for lack of funds is retried after
+// MANDATE_COLLECTION_RETRY_DELAY and given up after
+// MANDATE_COLLECTION_MAX_ATTEMPTS, both sides are told.
+
+const (
+	TransferKindDirectDebit = "direct_debit"
+
+	MandatePending   = "pending"
+	MandateActive    = "active"
+	MandateCancelled = "cancelled"
+
+	CollectionPending   = "pending"
+	CollectionCollected = "collected"
+	CollectionFailed    = "failed"
+)
+
+type Mandate struct {
+	ID                int        `json:"id"`
+	PayerAccountID    int        `json:"payer_account_id"`
+	CreditorAccountID int        `json:"creditor_account_id"`
+	Reference         string     `json:"reference"` // the creditor's, shown to the payer on every collection
+	MaxAmount         float64    `json:"max_amount"`
+	Frequency         string     `json:"frequency"`
+	Status            string     `json:"status"`
+	CreatedAt         time.Time  `json:"created_at"`
+	ApprovedAt        *time.Time `json:"approved_at,omitempty"`
+	CancelledAt       *time.Time `json:"cancelled_at,omitempty"`
+}
+
+type CreateMandateRequest struct {
+	PayerAccountNumber int64   `json:"payerAccount" validate:"required,positive"`
+	Reference          string  `json:"reference" validate:"required,max=35"`
+	MaxAmount          float64 `json:"maxAmount" validate:"positive"`
+	Frequency          string  `json:"frequency" validate:"required,oneof=daily weekly monthly"`
+}
+
+type MandateCollection struct {
+	ID                int        `json:"id"`
+	MandateID         int        `json:"mandate_id"`
+	Amount            float64    `json:"amount"`
+	Status            string     `json:"status"`
+	CollectAt         time.Time  `json:"collect_at"`
+	RetryAt           *time.Time `json:"retry_at,omitempty"`
+	Attempts          int        `json:"attempts"`
+	LastError         string     `json:"last_error,omitempty"`
+	TransferReference string     `json:"transfer_reference,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+}
+
+type CreateCollectionRequest struct {
+	Amount    float64   `json:"amount" validate:"positive"`
+	CollectAt time.Time `json:"collectAt"`
+}
+
+func (m *Mandate) party(accountID int) bool {
+	return m.PayerAccountID == accountID || m.CreditorAccountID == accountID
+}
+
+// mandatePeriod is the start of the limit period t falls in, weeks start on Monday
+func mandatePeriod(t time.Time, frequency string) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch frequency {
+	case FrequencyDaily:
+		return day
+	case FrequencyWeekly:
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// checkMandateLimit fails with ErrMandateLimitExceeded when collecting amount
+// at collectAt would take the period over the mandate's maximum. Collections
+// that count are those with one of the statuses, other than skip.
+func checkMandateLimit(m *Mandate, collections []*MandateCollection, skip int, amount float64, collectAt time.Time, statuses ...string) error {
+	period := mandatePeriod(collectAt, m.Frequency)
+	used := toCents(amount)
+	for _, c := range collections {
+		if c.ID == skip || !mandatePeriod(c.CollectAt, m.Frequency).Equal(period) {
+			continue
+		}
+		for _, status := range statuses {
+			if c.Status == status {
+				used += toCents(c.Amount)
+			}
+		}
+	}
+	if used > toCents(m.MaxAmount) {
+		return fmt.Errorf("%w: %.2f %s from %s", ErrMandateLimitExceeded, m.MaxAmount, m.Frequency, period.Format(time.DateOnly))
+	}
+	return nil
+}
+
+func mandateID(r *http.Request) (int, error) {
+	return pathID(r, "mandateID")
+}
+
+// mandate loads one of the account's mandates, others look like they don't exist
+func (s *APIServer) mandate(ctx context.Context, accountID, id int) (*Mandate, error) {
+	m, err := s.store.GetMandate(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !m.party(accountID) {
+		return nil, fmt.Errorf("%w: %d", ErrMandateNotFound, id)
+	}
+	return m, nil
+}
+
+// GET /account/{id}/mandates
+func (s *APIServer) handleGetMandates(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	mandates, err := s.store.GetMandates(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, mandates)
+}
+
+// POST /account/{id}/mandates, the creditor sets it up for the payer to approve
+func (s *APIServer) handleCreateMandate(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	creditorID, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	var req CreateMandateRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+
+	payer, err := s.store.GetAccountByNumber(r.Context(), req.PayerAccountNumber)
+	if err != nil {
+		return invalidField("payerAccount", "exists", "is not an account")
+	}
+	if payer.ID == creditorID {
+		return invalidField("payerAccount", "different", "must not be the collecting account")
+	}
+
+	m := &Mandate{
+		PayerAccountID:    payer.ID,
+		CreditorAccountID: creditorID,
+		Reference:         req.Reference,
+		MaxAmount:         req.MaxAmount,
+		Frequency:         req.Frequency,
+		Status:            MandatePending,
+		CreatedAt:         time.Now().UTC(),
+	}
+	if err := s.store.CreateMandate(r.Context(), m); err != nil {
+		return err
+	}
+
+	if err := s.notifier.Notify(payer.ID, "Direct debit mandate to approve", fmt.Sprintf(
+		"Mandate %d (%s) asks to collect up to %.2f %s, approve it to allow collections", m.ID, m.Reference, m.MaxAmount, m.Frequency)); err != nil {
+		log.Printf("Failed to notify account %d: %v", payer.ID, err)
+	}
+
+	return WriteJSON(w, http.StatusCreated, m)
+}
+
+// POST /account/{id}/mandates/{mandateID}/approve, by the payer
+func (s *APIServer) handleApproveMandate(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	mID, err := mandateID(r)
+	if err != nil {
+		return err
+	}
+
+	m, err := s.mandate(r.Context(), id, mID)
+	if err != nil {
+		return err
+	}
+	if m.PayerAccountID != id {
+		return newHTTPError(http.StatusForbidden, "MANDATE_PAYER_ONLY", "only the paying account can approve mandate %d", m.ID)
+	}
+
+	now := time.Now().UTC()
+	m.Status, m.ApprovedAt = MandateActive, &now
+	ok, err := s.store.UpdateMandateStatus(r.Context(), m, MandatePending)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: mandate %d is not pending", ErrMandateInactive, m.ID)
+	}
+
+	return WriteJSON(w, http.StatusOK, m)
+}
+
+// DELETE /account/{id}/mandates/{mandateID}, by either side
+func (s *APIServer) handleCancelMandate(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	mID, err := mandateID(r)
+	if err != nil {
+		return err
+	}
+
+	m, err := s.mandate(r.Context(), id, mID)
+	if err != nil {
+		return err
+	}
+
+	from := m.Status
+	if from == MandateCancelled {
+		return fmt.Errorf("%w: mandate %d is cancelled", ErrMandateInactive, m.ID)
+	}
+	now := time.Now().UTC()
+	m.Status, m.CancelledAt = MandateCancelled, &now
+	ok, err := s.store.UpdateMandateStatus(r.Context(), m, from)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: mandate %d changed, retry", ErrConflict, m.ID)
+	}
+
+	return WriteJSON(w, http.StatusOK, m)
+}
+
+// mandateCollections loads one of the account's mandates with its collections
+func (s *APIServer) mandateCollections(r *http.Request, accountID int) (*Mandate, []*MandateCollection, error) {
+	mID, err := mandateID(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m, err := s.mandate(r.Context(), accountID, mID)
+	if err != nil {
+		return nil, nil, err
+	}
+	collections, err := s.store.GetMandateCollections(r.Context(), m.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, collections, nil
+}
+
+// GET /account/{id}/mandates/{mandateID}/collections, both sides list them
+func (s *APIServer) handleGetMandateCollections(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	_, collections, err := s.mandateCollections(r, id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, collections)
+}
+
+// POST /account/{id}/mandates/{mandateID}/collections, only the creditor submits them
+func (s *APIServer) handleCreateMandateCollection(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	m, collections, err := s.mandateCollections(r, id)
+	if err != nil {
+		return err
+	}
+
+	if m.CreditorAccountID != id {
+		return newHTTPError(http.StatusForbidden, "MANDATE_CREDITOR_ONLY", "only the collecting account can submit collections on mandate %d", m.ID)
+	}
+	if m.Status != MandateActive {
+		return fmt.Errorf("%w: mandate %d is %s", ErrMandateInactive, m.ID, m.Status)
+	}
+
+	var req CreateCollectionRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	collectAt := req.CollectAt.UTC()
+	if req.CollectAt.IsZero() {
+		collectAt = now
+	} else if collectAt.Before(now.Add(-time.Minute)) {
+		return invalidField("collectAt", "future", "must not be in the past")
+	}
+
+	// Pending collections count, they're already promised to the creditor
+	if err := checkMandateLimit(m, collections, 0, req.Amount, collectAt, CollectionPending, CollectionCollected); err != nil {
+		return err
+	}
+
+	c := &MandateCollection{
+		MandateID: m.ID,
+		Amount:    req.Amount,
+		Status:    CollectionPending,
+		CollectAt: collectAt,
+		CreatedAt: now,
+	}
+	if err := s.store.CreateMandateCollection(r.Context(), c); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusCreated, c)
+}
+
+// mandateCollectionRunner performs due collections through the transfer service
+type mandateCollectionRunner struct {
+	api         *APIServer
+	engine      TransferEngine
+	notifier    Notifier
+	maxAttempts int
+	retryDelay  time.Duration
+}
+
+func (s *APIServer) mandateCollectionJob(engine TransferEngine) Job {
+	runner := &mandateCollectionRunner{
+		api:         s,
+		engine:      engine,
+		notifier:    s.notifier,
+		maxAttempts: s.config.MandateCollectionMaxAttempts,
+		retryDelay:  s.config.MandateCollectionRetryDelay,
+	}
+
+	return Job{
+		Name:     "mandate-collections",
+		Interval: s.config.SchedulerInterval,
+		Run:      runner.run,
+	}
+}
+
+func (r *mandateCollectionRunner) run(ctx context.Context) error {
+	now := time.Now().UTC()
+
+	due, err := r.api.store.GetDueMandateCollections(ctx, now, 100)
+	if err != nil {
+		return err
+	}
+	setJobQueueDepth("mandate_collections", len(due))
+
+	for _, c := range due {
+		// Lease the row so another instance doesn't collect it as well
+		claimed, err := r.api.store.ClaimMandateCollection(ctx, c.ID, now, now.Add(r.retryDelay))
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+
+		r.collect(ctx, c, now)
+
+		if err := r.api.store.UpdateMandateCollection(ctx, c); err != nil {
+			log.Printf("Failed to update mandate collection %d: %v", c.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// collect performs one collection. Only a lack of funds is worth retrying, a
+// cancelled mandate or a used up limit won't change by waiting.
+func (r *mandateCollectionRunner) collect(ctx context.Context, c *MandateCollection, now time.Time) {
+	m, err := r.pull(ctx, c)
+	if err == nil {
+		c.Status = CollectionCollected
+		c.RetryAt = nil
+		c.LastError = ""
+		return
+	}
+
+	c.LastError = err.Error()
+	if m == nil {
+		// The mandate's gone or the lookup failed, try again next time unless it's gone
+		retryAt := now.Add(r.retryDelay)
+		c.RetryAt = &retryAt
+		if errors.Is(err, ErrMandateNotFound) {
+			c.Status, c.RetryAt = CollectionFailed, nil
+		}
+		log.Printf("Mandate collection %d failed: %v", c.ID, err)
+		return
+	}
+
+	c.Attempts++
+
+	if errors.Is(err, ErrInsufficientFunds) && c.Attempts < r.maxAttempts {
+		retryAt := now.Add(r.retryDelay)
+		c.RetryAt = &retryAt
+		r.notify(m.PayerAccountID, fmt.Sprintf("Direct debit of %.2f for %s failed due to insufficient funds, retrying at %s",
+			c.Amount, m.Reference, retryAt.Format(time.RFC3339)))
+		return
+	}
+
+	c.Status = CollectionFailed
+	c.RetryAt = nil
+	message := fmt.Sprintf("Direct debit of %.2f for %s failed after %d attempts: %v", c.Amount, m.Reference, c.Attempts, err)
+	r.notify(m.PayerAccountID, message)
+	r.notify(m.CreditorAccountID, message)
+}
+
+// pull moves the money, the mandate is nil when it couldn't be loaded
+func (r *mandateCollectionRunner) pull(ctx context.Context, c *MandateCollection) (*Mandate, error) {
+	m, err := r.api.store.GetMandate(ctx, c.MandateID)
+	if err != nil {
+		return nil, err
+	}
+	if m.Status != MandateActive {
+		return m, fmt.Errorf("%w: mandate %d is %s", ErrMandateInactive, m.ID, m.Status)
+	}
+
+	// Checked again against what was actually collected, submissions can race
+	collections, err := r.api.store.GetMandateCollections(ctx, m.ID)
+	if err != nil {
+		return m, err
+	}
+	if err := checkMandateLimit(m, collections, c.ID, c.Amount, c.CollectAt, CollectionCollected); err != nil {
+		return m, err
+	}
+
+	payer, err := r.api.store.GetAccountbyID(ctx, m.PayerAccountID)
+	if err != nil {
+		return m, err
+	}
+	creditor, err := r.api.store.GetAccountbyID(ctx, m.CreditorAccountID)
+	if err != nil {
+		return m, err
+	}
+
+	receipt, _, err := r.api.transfers().Transfer(withTransferKind(ctx, TransferKindDirectDebit), TransferRequest{
+		FromAccountNumber: payer.Number,
+		ToAccountNumber:   creditor.Number,
+		Amount:            c.Amount,
+		Memo:              m.Reference,
+	}, r.engine, "mandate:"+strconv.Itoa(m.ID))
+	if err != nil {
+		return m, err
+	}
+	c.TransferReference = receipt.Reference
+	return m, nil
+}
+
+func (r *mandateCollectionRunner) notify(accountID int, message string) {
+	if err := r.notifier.Notify(accountID, "Direct debit failed", message); err != nil {
+		log.Printf("Failed to notify account %d: %v", accountID, err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMandates(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	payer := &Account{Number: 5101, Balance: 8000, Currency: "USD", Status: AccountActive}
+	creditor := &Account{Number: 5102, Currency: "USD", Status: AccountActive}
+	require.Nil(t, store.CreateAccount(ctx, payer))
+	require.Nil(t, store.CreateAccount(ctx, creditor))
+
+	notifier := &capturingNotifier{}
+	s := NewAPIServer(&Config{MandateCollectionMaxAttempts: 2, MandateCollectionRetryDelay: time.Hour}, store)
+	s.notifier = notifier
+	call := func(h apiFunc, method string, accountID int, body string) *httptest.ResponseRecorder {
+		r := mux.SetURLVars(httptest.NewRequest(method, "/", strings.NewReader(body)), map[string]string{"id": strconv.Itoa(accountID), "mandateID": "1"})
+		w := httptest.NewRecorder()
+		makeHTTPHandle(h)(w, r)
+		return w
+	}
+
+	w := call(s.handleCreateMandate, "POST", creditor.ID, `{"payerAccount": 5101, "reference": "GYM-0042", "maxAmount": 100, "frequency": "monthly"}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	assert.Len(t, notifier.messages, 1, "the payer is asked to approve")
+
+	// Nothing can be collected before the payer approves, and only the payer can
+	collection := `{"amount": 60}`
+	assert.Equal(t, http.StatusConflict, call(s.handleCreateMandateCollection, "POST", creditor.ID, collection).Code)
+	assert.Equal(t, http.StatusForbidden, call(s.handleApproveMandate, "POST", creditor.ID, "").Code)
+	require.Equal(t, http.StatusOK, call(s.handleApproveMandate, "POST", payer.ID, "").Code)
+
+	w = call(s.handleCreateMandateCollection, "POST", creditor.ID, collection)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	w = call(s.handleCreateMandateCollection, "POST", creditor.ID, `{"amount": 50}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code, "60 + 50 is over the monthly 100")
+	assert.Equal(t, http.StatusForbidden, call(s.handleCreateMandateCollection, "POST", payer.ID, collection).Code)
+
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	runner := &mandateCollectionRunner{api: s, engine: engine, notifier: notifier, maxAttempts: 2, retryDelay: time.Hour}
+	require.Nil(t, runner.run(ctx))
+
+	from, _ := store.GetAccountbyID(ctx, payer.ID)
+	to, _ := store.GetAccountbyID(ctx, creditor.ID)
+	assert.Equal(t, int64(2000), from.Balance)
+	assert.Equal(t, int64(6000), to.Balance)
+	assert.Equal(t, TransferKindDirectDebit, store.transfers[0].kind)
+
+	var collections []*MandateCollection
+	w = call(s.handleGetMandateCollections, "GET", payer.ID, "")
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &collections))
+	require.Len(t, collections, 1)
+	assert.Equal(t, CollectionCollected, collections[0].Status)
+	assert.NotEmpty(t, collections[0].TransferReference)
+
+	// A collection the payer can't cover is retried, then given up
+	require.Nil(t, store.CreateMandateCollection(ctx, &MandateCollection{MandateID: 1, Amount: 30, Status: CollectionPending, CollectAt: time.Now()}))
+	require.Nil(t, runner.run(ctx))
+	collections, _ = store.GetMandateCollections(ctx, 1)
+	assert.Equal(t, CollectionPending, collections[1].Status)
+	assert.Equal(t, 1, collections[1].Attempts)
+
+	store.collects[1].RetryAt = nil
+	require.Nil(t, runner.run(ctx))
+	collections, _ = store.GetMandateCollections(ctx, 1)
+	assert.Equal(t, CollectionFailed, collections[1].Status)
+	assert.Contains(t, notifier.messages[len(notifier.messages)-1], "failed after 2 attempts")
+
+	// Either side can cancel, collections stop with it
+	require.Equal(t, http.StatusOK, call(s.handleCancelMandate, "DELETE", payer.ID, "").Code)
+	assert.Equal(t, http.StatusConflict, call(s.handleCreateMandateCollection, "POST", creditor.ID, `{"amount": 10}`).Code)
+	assert.Equal(t, http.StatusNotFound, call(s.handleGetMandateCollections, "GET", 99, "").Code)
+}
+
+func TestMandatePeriod(t *testing.T) {
+	thursday := time.Date(2024, time.February, 29, 15, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC), mandatePeriod(thursday, FrequencyDaily))
+	assert.Equal(t, time.Date(2024, time.February, 26, 0, 0, 0, 0, time.UTC), mandatePeriod(thursday, FrequencyWeekly))
+	assert.Equal(t, time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC), mandatePeriod(thursday, FrequencyMonthly))
+
+	sunday := time.Date(2024, time.March, 3, 23, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2024, time.February, 26, 0, 0, 0, 0, time.UTC), mandatePeriod(sunday, FrequencyWeekly))
+}
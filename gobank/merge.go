@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Merging folds a duplicate account into the one that survives: its balance
+// moves over as an adjustment, its transfers and schedules are relinked, and
+// it's closed with merged_into pointing at the survivor. Everything happens in
+// one transaction, audit entries included.
+
+const AuditAccountMerged = "account.merged"
+
+type MergeAccountsRequest struct {
+	SurvivorID int `json:"survivor_id" validate:"required,positive"`
+}
+
+type AccountMerge struct {
+	MergedAccountID   int       `json:"merged_account_id"`
+	SurvivorAccountID int       `json:"survivor_account_id"`
+	Balance           int64     `json:"balance"`
+	Currency          string    `json:"currency"`
+	TransfersRelinked int       `json:"transfers_relinked"`
+	Actor             string    `json:"actor"`
+	CreatedAt         time.Time `json:"created_at"`
+}
+
+// Duplicates are only merged when they plainly belong to the same person
+func samePerson(a, b *Account) bool {
+	return strings.EqualFold(strings.TrimSpace(a.FirstName), strings.TrimSpace(b.FirstName)) &&
+		strings.EqualFold(strings.TrimSpace(a.LastName), strings.TrimSpace(b.LastName))
+}
+
+func (s *accountService) MergeAccounts(ctx context.Context, mergedID, survivorID int, actor string) (*AccountMerge, error) {
+	if mergedID == survivorID {
+		return nil, fmt.Errorf("cannot merge an account into itself")
+	}
+
+	merged, err := s.store.GetAccountbyID(ctx, mergedID)
+	if err != nil {
+		return nil, err
+	}
+	survivor, err := s.store.GetAccountbyID(ctx, survivorID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, acc := range []*Account{merged, survivor} {
+		if err := checkAccountUsable(acc); err != nil {
+			return nil, fmt.Errorf("account %d can't be merged: %w", acc.ID, err)
+		}
+	}
+	if err := checkNoLegalHolds(ctx, s.store, merged.ID); err != nil {
+		return nil, fmt.Errorf("account %d can't be merged: %w", merged.ID, err)
+	}
+	if !samePerson(merged, survivor) {
+		return nil, fmt.Errorf("accounts belong to different people")
+	}
+	if merged.Currency != survivor.Currency {
+		return nil, fmt.Errorf("accounts hold different currencies (%s and %s)", merged.Currency, survivor.Currency)
+	}
+
+	now := time.Now().UTC()
+	merge := &AccountMerge{
+		MergedAccountID:   merged.ID,
+		SurvivorAccountID: survivor.ID,
+		Balance:           merged.Balance,
+		Currency:          merged.Currency,
+		Actor:             actor,
+		CreatedAt:         now,
+	}
+
+	tx, err := s.store.BeginTransaction(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// The adjustment pair, a negative balance moves over as well
+	if merged.Balance != 0 {
+		entry := newLedgerEntry(ctx, TransferKindAdjustment).
+			account(merged, -merged.Balance).
+			account(survivor, merged.Balance)
+		if err := s.store.PostLedgerEntry(ctx, entry, tx); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.store.MergeAccounts(ctx, merge, tx); err != nil {
+		return nil, err
+	}
+
+	mergedAfter := *merged
+	mergedAfter.Balance = 0
+	mergedAfter.Status = AccountClosed
+	mergedAfter.MergedInto = survivor.ID
+	survivorAfter := *survivor
+	survivorAfter.Balance += merged.Balance
+
+	for _, entry := range []*AuditEntry{
+		{AccountID: merged.ID, Actor: actor, Action: AuditAccountMerged, Changes: diffAccounts(merged, &mergedAfter), CreatedAt: now},
+		{AccountID: survivor.ID, Actor: actor, Action: AuditAccountMerged, Changes: diffAccounts(survivor, &survivorAfter), CreatedAt: now},
+	} {
+		if err := s.store.RecordAudit(ctx, entry, tx); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit merge: %v", err)
+	}
+
+	return merge, nil
+}
+
+// POST /admin/accounts/{id}/merge merges {id} into survivor_id
+func (s *APIServer) handleMergeAccounts(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	var req MergeAccountsRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+
+	merge, err := s.forRequest(r).accounts().MergeAccounts(r.Context(), id, req.SurvivorID, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, merge)
+}
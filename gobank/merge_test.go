@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeAccounts(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	survivor := &Account{FirstName: "Ada", LastName: "Lovelace", Number: 3001, Balance: 1000, Currency: "USD"}
+	duplicate := &Account{FirstName: "ada", LastName: "Lovelace ", Number: 3002, Balance: 250, Currency: "USD"}
+	other := &Account{FirstName: "Alan", LastName: "Turing", Number: 3003, Currency: "USD"}
+	for _, acc := range []*Account{survivor, duplicate, other} {
+		require.Nil(t, store.CreateAccount(ctx, acc))
+	}
+	store.transfers = append(store.transfers, memoryTransfer{fromAccountID: other.ID, toAccountID: duplicate.ID, amount: 250})
+
+	accounts := NewAccountService(store)
+
+	_, err := accounts.MergeAccounts(ctx, duplicate.ID, other.ID, "admin")
+	assert.Error(t, err)
+	_, err = accounts.MergeAccounts(ctx, duplicate.ID, duplicate.ID, "admin")
+	assert.Error(t, err)
+
+	merge, err := accounts.MergeAccounts(ctx, duplicate.ID, survivor.ID, "admin")
+	require.Nil(t, err)
+	assert.Equal(t, int64(250), merge.Balance)
+	assert.Equal(t, 1, merge.TransfersRelinked)
+
+	merged, _ := store.GetAccountbyID(ctx, duplicate.ID)
+	kept, _ := store.GetAccountbyID(ctx, survivor.ID)
+	assert.Equal(t, int64(0), merged.Balance)
+	assert.Equal(t, survivor.ID, merged.MergedInto)
+	assert.NotNil(t, merged.ClosedAt)
+	assert.Equal(t, int64(1250), kept.Balance)
+	assert.Equal(t, survivor.ID, store.transfers[0].toAccountID)
+	assert.Len(t, store.audit, 2)
+
+	// The closed account can't be merged again
+	_, err = accounts.MergeAccounts(ctx, duplicate.ID, survivor.ID, "admin")
+	assert.ErrorIs(t, err, ErrAccountClosed)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Routes are registered per method, a handler only ever sees the method it
+// was registered for. A request for a route's path with a method it
+// doesn't take gets a 405 whose Allow header lists the ones it does.
+
+var routeMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+
+// allowedMethods are the methods router has a route for r's path with
+func allowedMethods(router *mux.Router, r *http.Request) []string {
+	allowed := []string{}
+	for _, method := range routeMethods {
+		probe := r.WithContext(r.Context())
+		probe.Method = method
+		var match mux.RouteMatch
+		if router.Match(probe, &match) && match.MatchErr == nil {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
+
+func methodNotAllowedHandler(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", strings.Join(allowedMethods(router, r), ", "))
+		WriteJSON(w, http.StatusMethodNotAllowed, ApiError{
+			Error: fmt.Sprintf("method %s not allowed", r.Method),
+			Code:  "METHOD_NOT_ALLOWED",
+		})
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMethodNotAllowed(t *testing.T) {
+	cfg := &Config{TransferEngine: "balance"}
+	store := newMemoryStorage()
+	engine, err := NewTransferEngine(cfg.TransferEngine, store, cfg)
+	require.Nil(t, err)
+	router := NewAPIServer(cfg, store).routes(engine)
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	w := serve("PUT", "/v1/account/7")
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "GET, PATCH, DELETE", w.Header().Get("Allow"))
+	var apiErr ApiError
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &apiErr))
+	assert.Equal(t, "METHOD_NOT_ALLOWED", apiErr.Code)
+	assert.Equal(t, "method PUT not allowed", apiErr.Error)
+
+	assert.Equal(t, "POST", serve("GET", "/v1/transfer").Header().Get("Allow"))
+	assert.Equal(t, "GET, PATCH", serve("DELETE", "/v1/account/7/preferences").Header().Get("Allow"))
+
+	// Legacy paths answer the same way
+	w = serve("DELETE", "/account")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "GET, POST", w.Header().Get("Allow"))
+
+	assert.Equal(t, http.StatusNotFound, serve("GET", "/v1/nowhere").Code)
+}
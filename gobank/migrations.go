@@ -0,0 +1,1112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Migrations follow the expand/contract pattern so deploys never need downtime:
+// pre-deploy migrations only add things and are safe for the running release,
+// post-deploy migrations remove or tighten things and run once the previous
+// release is fully retired.
+type MigrationPhase string
+
+const (
+	PreDeploy  MigrationPhase = "pre-deploy"
+	PostDeploy MigrationPhase = "post-deploy"
+)
+
+func ParseMigrationPhase(s string) (MigrationPhase, error) {
+	switch MigrationPhase(s) {
+	case PreDeploy, PostDeploy:
+		return MigrationPhase(s), nil
+	}
+	return "", fmt.Errorf("unknown migration phase %q", s)
+}
+
+type Migration struct {
+	Version int
+	Name    string
+	Phase   MigrationPhase
+	SQL     string
+}
+
+type AppliedMigration struct {
+	Version   int
+	Name      string
+	Phase     MigrationPhase
+	AppliedAt time.Time
+}
+
+// New migrations are appended here with the next version number
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_account",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists account (
+			id serial primary key,
+			first_name varchar(100),
+			last_name varchar(100),
+			account_number serial,
+			encrypted_password varchar(100),
+			balance serial,
+			created_at timestamp
+		)`,
+	},
+	{
+		Version: 2,
+		Name:    "ensure_account_number",
+		Phase:   PreDeploy,
+		SQL: `DO $$ BEGIN
+			IF NOT EXISTS (
+				SELECT 1
+				FROM information_schema.columns
+				WHERE table_name = 'account' AND column_name = 'account_number'
+			) THEN
+				ALTER TABLE account ADD COLUMN account_number serial;
+			END IF;
+		END $$`,
+	},
+	{
+		Version: 3,
+		Name:    "create_transfer",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists transfer (
+			id serial primary key,
+			from_account_id integer references account(id),
+			to_account_id integer references account(id),
+			amount bigint not null,
+			created_at timestamp not null default now()
+		);
+		create index if not exists transfer_from_account_created_at_idx
+			on transfer (from_account_id, created_at)`,
+	},
+	{
+		Version: 4,
+		Name:    "create_audit_log",
+		Phase:   PreDeploy,
+		// No foreign key, history has to outlive the account it describes
+		SQL: `create table if not exists audit_log (
+			id serial primary key,
+			account_id integer not null,
+			actor varchar(100) not null,
+			action varchar(50) not null,
+			changes jsonb not null,
+			created_at timestamp not null
+		);
+		create index if not exists audit_log_account_created_at_idx
+			on audit_log (account_id, created_at)`,
+	},
+	{
+		Version: 5,
+		Name:    "create_scheduled_transfer",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists scheduled_transfer (
+			id serial primary key,
+			from_account_id integer not null references account(id),
+			to_account_number bigint not null,
+			amount bigint not null,
+			frequency varchar(10) not null,
+			status varchar(20) not null,
+			next_run_at timestamp not null,
+			retry_at timestamp,
+			attempts integer not null default 0,
+			last_error text not null default '',
+			created_at timestamp not null
+		);
+		create index if not exists scheduled_transfer_due_idx
+			on scheduled_transfer (coalesce(retry_at, next_run_at)) where status = 'active'`,
+	},
+	{
+		Version: 6,
+		Name:    "add_currency",
+		Phase:   PreDeploy,
+		SQL: `alter table account add column if not exists currency char(3) not null default 'USD';
+		alter table transfer add column if not exists currency char(3) not null default 'USD';
+		alter table transfer add column if not exists converted_amount bigint;
+		alter table transfer add column if not exists to_currency char(3) not null default 'USD';
+		alter table transfer add column if not exists fx_rate numeric(18, 8) not null default 1`,
+	},
+	{
+		Version: 7,
+		Name:    "add_overdraft",
+		Phase:   PreDeploy,
+		SQL: `alter table account add column if not exists overdraft_limit bigint not null default 0;
+		create table if not exists overdraft_fee (
+			id serial primary key,
+			account_id integer not null references account(id) on delete cascade,
+			amount bigint not null,
+			overdrawn bigint not null,
+			accrued_on date not null,
+			created_at timestamp not null,
+			unique (account_id, accrued_on)
+		)`,
+	},
+	{
+		Version: 8,
+		Name:    "add_account_merge",
+		Phase:   PreDeploy,
+		SQL: `alter table account add column if not exists merged_into integer references account(id);
+		alter table account add column if not exists closed_at timestamp;
+		alter table transfer add column if not exists kind varchar(20) not null default 'transfer';
+		create table if not exists account_merge (
+			merged_account_id integer primary key references account(id),
+			survivor_account_id integer not null references account(id),
+			balance bigint not null,
+			currency char(3) not null,
+			transfers_relinked integer not null,
+			actor varchar(100) not null,
+			created_at timestamp not null
+		)`,
+	},
+	{
+		Version: 9,
+		Name:    "add_account_status",
+		Phase:   PreDeploy,
+		SQL: `alter table account add column if not exists status varchar(20) not null default 'active';
+		update account set status = 'closed' where closed_at is not null`,
+	},
+	{
+		Version: 10,
+		Name:    "create_sweep_rule",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists sweep_rule (
+			id serial primary key,
+			account_id integer not null references account(id),
+			to_account_number bigint not null,
+			threshold bigint not null,
+			frequency varchar(10) not null,
+			status varchar(20) not null,
+			next_run_at timestamp not null,
+			created_at timestamp not null
+		);
+		create index if not exists sweep_rule_due_idx on sweep_rule (next_run_at) where status = 'active';
+		create table if not exists sweep_execution (
+			id serial primary key,
+			rule_id integer not null references sweep_rule(id),
+			amount bigint not null,
+			status varchar(20) not null,
+			error text not null default '',
+			executed_at timestamp not null
+		);
+		create index if not exists sweep_execution_rule_idx on sweep_execution (rule_id, executed_at)`,
+	},
+	{
+		Version: 11,
+		Name:    "create_cashback",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists cashback (
+			id serial primary key,
+			account_id integer not null references account(id),
+			rule varchar(100) not null,
+			transfer_amount bigint not null,
+			amount bigint not null,
+			created_at timestamp not null
+		);
+		create index if not exists cashback_account_created_at_idx on cashback (account_id, created_at)`,
+	},
+	{
+		Version: 12,
+		Name:    "create_password_reset",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists password_reset (
+			id serial primary key,
+			account_id integer not null references account(id),
+			token_hash char(64) not null unique,
+			expires_at timestamp not null,
+			used_at timestamp,
+			created_at timestamp not null
+		)`,
+	},
+	{
+		Version: 13,
+		Name:    "create_liability_snapshot",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists liability_snapshot (
+			day date not null,
+			currency char(3) not null,
+			deposits bigint not null,
+			overdrafts bigint not null,
+			taken_at timestamp not null,
+			primary key (day, currency)
+		)`,
+	},
+	{
+		Version: 14,
+		Name:    "add_account_email",
+		Phase:   PreDeploy,
+		SQL: `alter table account add column if not exists email varchar(254);
+		alter table account add column if not exists email_verified boolean not null default false;
+		create unique index if not exists account_email_key on account (email);
+		create table if not exists email_verification (
+			id serial primary key,
+			account_id integer not null references account(id),
+			token_hash char(64) not null unique,
+			expires_at timestamp not null,
+			used_at timestamp,
+			created_at timestamp not null
+		)`,
+	},
+	{
+		Version: 15,
+		Name:    "add_account_dormancy",
+		Phase:   PreDeploy,
+		SQL: `alter table account add column if not exists last_activity_at timestamp;
+		update account a set last_activity_at = coalesce(
+			(select max(t.created_at) from transfer t where t.from_account_id = a.id), a.created_at, now())
+		where last_activity_at is null;
+		alter table account alter column last_activity_at set not null;
+		alter table account alter column last_activity_at set default now();
+		alter table account add column if not exists dormancy_notified_at timestamp;
+		create index if not exists account_last_activity_idx on account (last_activity_at) where status = 'active'`,
+	},
+	{
+		Version: 16,
+		Name:    "add_transfer_reference",
+		Phase:   PreDeploy,
+		SQL: `alter table transfer add column if not exists reference uuid;
+		create unique index if not exists transfer_reference_key on transfer (reference)`,
+	},
+	{
+		Version: 17,
+		Name:    "create_account_event",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists account_event (
+			id bigserial primary key,
+			account_id integer not null references account(id),
+			type varchar(30) not null,
+			direction varchar(10) not null,
+			amount bigint not null,
+			balance bigint not null,
+			currency varchar(3) not null,
+			reference uuid,
+			created_at timestamp not null
+		);
+		create index if not exists account_event_account_idx on account_event (account_id, id);
+		create table if not exists event_subscription (
+			id serial primary key,
+			account_id integer not null references account(id),
+			url text not null,
+			filter text not null default '',
+			secret varchar(64) not null,
+			last_event_id bigint not null default 0,
+			status varchar(20) not null,
+			created_at timestamp not null
+		)`,
+	},
+	{
+		Version: 18,
+		Name:    "create_ledger",
+		Phase:   PreDeploy,
+		// Existing balances become opening entries so the ledger reconciles from the start
+		SQL: `create table if not exists ledger_entry (
+			id bigserial primary key,
+			kind varchar(20) not null,
+			reference uuid,
+			created_at timestamp not null
+		);
+		create table if not exists postings (
+			id bigserial primary key,
+			entry_id bigint not null references ledger_entry(id),
+			account_id integer references account(id),
+			ledger_account varchar(50),
+			currency varchar(3) not null,
+			amount bigint not null,
+			check ((account_id is null) <> (ledger_account is null))
+		);
+		create index if not exists postings_entry_idx on postings (entry_id);
+		create index if not exists postings_account_idx on postings (account_id);
+		DO $$
+		DECLARE
+			acc record;
+			entry bigint;
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM ledger_entry) THEN
+				FOR acc IN SELECT id, balance, currency FROM account WHERE balance <> 0 LOOP
+					INSERT INTO ledger_entry (kind, created_at) VALUES ('opening', now()) RETURNING id INTO entry;
+					INSERT INTO postings (entry_id, account_id, currency, amount) VALUES (entry, acc.id, acc.currency, acc.balance);
+					INSERT INTO postings (entry_id, ledger_account, currency, amount) VALUES (entry, 'equity:opening_balances', acc.currency, -acc.balance);
+				END LOOP;
+			END IF;
+		END $$`,
+	},
+	{
+		Version: 19,
+		Name:    "create_transaction_enrichments",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists transaction_enrichments (
+			reference uuid not null,
+			enricher varchar(50) not null,
+			data jsonb not null,
+			created_at timestamp not null,
+			primary key (reference, enricher)
+		)`,
+	},
+	{
+		Version: 20,
+		Name:    "add_account_version",
+		Phase:   PreDeploy,
+		SQL:     `alter table account add column if not exists version bigint not null default 0`,
+	},
+	{
+		Version: 21,
+		Name:    "add_ledger_entry_memo_category",
+		Phase:   PreDeploy,
+		SQL: `alter table ledger_entry add column if not exists memo varchar(140);
+		alter table ledger_entry add column if not exists category varchar(50);
+		create index if not exists ledger_entry_category_idx on ledger_entry (lower(category))`,
+	},
+	{
+		Version: 22,
+		Name:    "create_account_search_indexes",
+		Phase:   PreDeploy,
+		SQL: `create index if not exists account_search_first_name_idx on account (lower(first_name) text_pattern_ops);
+		create index if not exists account_search_last_name_idx on account (lower(last_name) text_pattern_ops);
+		create index if not exists account_search_full_name_idx on account (lower(first_name || ' ' || last_name) text_pattern_ops);
+		create index if not exists account_search_number_idx on account (account_number)`,
+	},
+	{
+		Version: 23,
+		Name:    "create_export_delivery",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists export_delivery (
+			file_name varchar(100) primary key,
+			day date not null,
+			status varchar(20) not null,
+			bytes bigint not null,
+			sha256 char(64) not null,
+			attempts integer not null,
+			error text,
+			delivered_at timestamp,
+			updated_at timestamp not null
+		);
+		create index if not exists export_delivery_day_idx on export_delivery (day);
+		create index if not exists ledger_entry_created_at_idx on ledger_entry (created_at)`,
+	},
+	{
+		Version: 24,
+		Name:    "create_legal_hold",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists legal_hold (
+			id serial primary key,
+			account_id integer not null references account (id),
+			amount bigint not null default 0 check (amount >= 0),
+			percent numeric(5, 2) not null default 0 check (percent >= 0 and percent <= 100),
+			reason text not null,
+			reference varchar(100) not null,
+			placed_by varchar(100) not null,
+			placed_at timestamp not null,
+			released_at timestamp,
+			released_by varchar(100),
+			release_reason text,
+			release_reference varchar(100)
+		);
+		create index if not exists legal_hold_active_idx on legal_hold (account_id) where released_at is null`,
+	},
+	{
+		// Existing accounts start their stream at their current balance
+		Version: 25,
+		Name:    "create_account_stream",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists account_stream (
+			account_id integer not null references account (id),
+			seq bigint not null,
+			type varchar(30) not null,
+			amount bigint not null,
+			currency char(3) not null,
+			counterparty integer,
+			reference uuid,
+			created_at timestamp not null,
+			primary key (account_id, seq)
+		);
+		create index if not exists account_stream_created_at_idx on account_stream (account_id, created_at);
+		create table if not exists account_snapshot (
+			account_id integer not null references account (id),
+			seq bigint not null,
+			balance bigint not null,
+			currency char(3) not null,
+			as_of timestamp not null,
+			primary key (account_id, seq)
+		);
+		insert into account_stream (account_id, seq, type, amount, currency, created_at)
+		select id, 1, 'AccountCreated', balance, currency, now() from account
+		on conflict do nothing`,
+	},
+	{
+		Version: 26,
+		Name:    "create_pending_operation",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists pending_operation (
+			id serial primary key,
+			kind varchar(50) not null,
+			params text not null,
+			status varchar(20) not null,
+			requested_by varchar(100) not null,
+			required integer not null,
+			result text,
+			error text,
+			created_at timestamp not null,
+			expires_at timestamp not null,
+			executed_at timestamp
+		);
+		create index if not exists pending_operation_status_idx on pending_operation (status);
+		create table if not exists operation_approval (
+			operation_id integer not null references pending_operation (id),
+			approver varchar(100) not null,
+			signature text not null,
+			signed_at timestamp not null,
+			primary key (operation_id, approver)
+		)`,
+	},
+	{
+		Version: 27,
+		Name:    "create_postings_account_entry_index",
+		Phase:   PreDeploy,
+		SQL:     `create index if not exists postings_account_entry_idx on postings (account_id, entry_id) include (amount)`,
+	},
+	{
+		Version: 28,
+		Name:    "create_eod_run",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists eod_run (
+			day date primary key,
+			status varchar(20) not null,
+			cut_off timestamp not null,
+			started_at timestamp not null,
+			updated_at timestamp not null,
+			finished_at timestamp
+		);
+		create table if not exists eod_step (
+			day date not null references eod_run (day),
+			name varchar(50) not null,
+			status varchar(20) not null,
+			attempts integer not null,
+			detail text,
+			error text,
+			started_at timestamp,
+			finished_at timestamp,
+			primary key (day, name)
+		)`,
+	},
+	{
+		Version: 29,
+		Name:    "create_pending_transfer",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists reservation (
+			id serial primary key,
+			account_id integer not null references account (id),
+			amount bigint not null check (amount > 0),
+			currency char(3) not null,
+			kind varchar(30) not null,
+			reference varchar(100) not null,
+			status varchar(20) not null,
+			created_at timestamp not null,
+			expires_at timestamp,
+			resolved_at timestamp
+		);
+		create index if not exists reservation_active_idx on reservation (account_id) where status = 'active';
+		create table if not exists pending_transfer (
+			reference uuid primary key,
+			status varchar(20) not null,
+			from_account bigint not null,
+			to_account bigint not null,
+			amount bigint not null,
+			currency char(3) not null,
+			memo varchar(140),
+			category varchar(50),
+			reservation_id integer not null references reservation (id),
+			requested_by varchar(100) not null,
+			resolved_by varchar(100),
+			reason text,
+			error text,
+			created_at timestamp not null,
+			resolved_at timestamp
+		);
+		create index if not exists pending_transfer_status_idx on pending_transfer (status, created_at)`,
+	},
+	{
+		Version: 30,
+		Name:    "add_reservation_captured",
+		Phase:   PreDeploy,
+		SQL: `alter table reservation add column if not exists captured bigint not null default 0;
+		create index if not exists reservation_expiry_idx on reservation (expires_at) where status = 'active'`,
+	},
+	{
+		Version: 31,
+		Name:    "create_fees",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists fee_schedule (
+			id serial primary key,
+			currency char(3) not null,
+			monthly_fee bigint not null default 0,
+			minimum_balance bigint not null default 0,
+			below_minimum_fee bigint not null default 0,
+			transfer_tiers jsonb not null default '[]',
+			created_by varchar(100) not null,
+			created_at timestamp not null
+		);
+		create index if not exists fee_schedule_currency_idx on fee_schedule (currency, id desc);
+		create table if not exists fee_charge (
+			id serial primary key,
+			account_id integer not null references account(id) on delete cascade,
+			kind varchar(20) not null,
+			period date not null,
+			amount bigint not null,
+			created_at timestamp not null,
+			unique (account_id, kind, period)
+		)`,
+	},
+	{
+		Version: 32,
+		Name:    "create_transfer_job",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists transfer_job (
+			id uuid primary key,
+			status varchar(20) not null,
+			request text not null,
+			actor varchar(100) not null,
+			attempts integer not null default 0,
+			next_attempt_at timestamp not null,
+			last_error text not null default '',
+			receipt text,
+			created_at timestamp not null,
+			updated_at timestamp not null
+		);
+		create index if not exists transfer_job_due_idx on transfer_job (next_attempt_at) where status in ('queued', 'processing')`,
+	},
+	{
+		// Enforced for new writes right away, existing rows are checked once
+		// the post-deploy migration validates it
+		Version: 33,
+		Name:    "add_account_balance_check",
+		Phase:   PreDeploy,
+		SQL: `do $$
+		begin
+			if not exists (select 1 from pg_constraint where conname = 'account_balance_not_negative') then
+				alter table account add constraint account_balance_not_negative
+					check (balance >= 0 or overdraft_limit > 0) not valid;
+			end if;
+		end $$`,
+	},
+	{
+		Version: 34,
+		Name:    "validate_account_balance_check",
+		Phase:   PostDeploy,
+		SQL:     `alter table account validate constraint account_balance_not_negative`,
+	},
+	{
+		Version: 35,
+		Name:    "create_account_pin",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists account_pin (
+			account_id integer primary key references account(id) on delete cascade,
+			pin_hash varchar(255) not null,
+			failed_attempts integer not null default 0,
+			locked_until timestamp,
+			updated_at timestamp not null
+		)`,
+	},
+	{
+		Version: 36,
+		Name:    "create_login_lockout",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists login_lockout (
+			account_id integer primary key references account(id) on delete cascade,
+			failed_attempts integer not null default 0,
+			locked_until timestamp,
+			updated_at timestamp not null
+		)`,
+	},
+	{
+		Version: 37,
+		Name:    "create_oidc_identity",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists oidc_identity (
+			id serial primary key,
+			issuer varchar(255) not null,
+			subject varchar(255) not null,
+			account_id integer not null references account(id) on delete cascade,
+			email varchar(254) not null,
+			created_at timestamp not null,
+			unique (issuer, subject)
+		)`,
+	},
+	{
+		Version: 38,
+		Name:    "create_api_key",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists api_key (
+			id serial primary key,
+			name varchar(100) not null,
+			scope varchar(20) not null,
+			account_id integer references account(id) on delete cascade,
+			prefix varchar(20) not null,
+			key_hash char(64) not null unique,
+			created_by varchar(100) not null,
+			created_at timestamp not null,
+			last_used_at timestamp,
+			revoked_at timestamp
+		)`,
+	},
+	{
+		Version: 39,
+		Name:    "create_account_preferences",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists account_preferences (
+			account_id integer primary key references account(id) on delete cascade,
+			statement_email boolean not null default false,
+			updated_at timestamp not null
+		)`,
+	},
+	{
+		Version: 40,
+		Name:    "create_statement_delivery",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists statement_delivery (
+			account_id integer not null references account(id) on delete cascade,
+			period date not null,
+			sent_at timestamp not null,
+			primary key (account_id, period)
+		)`,
+	},
+	{
+		Version: 41,
+		Name:    "add_notification_preferences",
+		Phase:   PreDeploy,
+		SQL: `alter table account_preferences
+			add column if not exists notify_large_transfers boolean not null default true,
+			add column if not exists notify_low_balance boolean not null default true,
+			add column if not exists notify_new_logins boolean not null default true`,
+	},
+	{
+		Version: 42,
+		Name:    "create_notification",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists notification (
+			id bigserial primary key,
+			account_id integer not null references account(id) on delete cascade,
+			type varchar(50) not null,
+			message text not null,
+			created_at timestamp not null,
+			read_at timestamp
+		);
+		create index if not exists notification_account_idx on notification (account_id, id)`,
+	},
+	{
+		Version: 43,
+		Name:    "create_login_ip",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists login_ip (
+			account_id integer not null references account(id) on delete cascade,
+			ip varchar(45) not null,
+			first_seen timestamp not null,
+			last_seen timestamp not null,
+			primary key (account_id, ip)
+		)`,
+	},
+	{
+		Version: 44,
+		Name:    "create_fraud_decision",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists fraud_decision (
+			id serial primary key,
+			reference uuid not null,
+			account_id integer not null references account(id) on delete cascade,
+			from_account bigint not null,
+			to_account bigint not null,
+			amount bigint not null,
+			action varchar(10) not null,
+			rules text[] not null default '{}',
+			created_at timestamp not null
+		);
+		create index if not exists fraud_decision_action_idx on fraud_decision (action, id)`,
+	},
+	{
+		Version: 45,
+		Name:    "index_transfer_created_at",
+		Phase:   PreDeploy,
+		// Transfer volume per day scans by date across all accounts
+		SQL: `create index if not exists transfer_created_at_idx on transfer (created_at)`,
+	},
+	{
+		Version: 46,
+		Name:    "create_mandate",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists mandate (
+			id serial primary key,
+			payer_account_id integer not null references account(id) on delete cascade,
+			creditor_account_id integer not null references account(id) on delete cascade,
+			reference varchar(35) not null,
+			max_amount bigint not null,
+			frequency varchar(10) not null,
+			status varchar(10) not null,
+			created_at timestamp not null,
+			approved_at timestamp,
+			cancelled_at timestamp
+		);
+		create index if not exists mandate_payer_idx on mandate (payer_account_id);
+		create index if not exists mandate_creditor_idx on mandate (creditor_account_id);
+		create table if not exists mandate_collection (
+			id serial primary key,
+			mandate_id integer not null references mandate(id) on delete cascade,
+			amount bigint not null,
+			status varchar(10) not null,
+			collect_at timestamp not null,
+			retry_at timestamp,
+			attempts integer not null default 0,
+			last_error text not null default '',
+			transfer_reference uuid,
+			created_at timestamp not null
+		);
+		create index if not exists mandate_collection_mandate_idx on mandate_collection (mandate_id, id);
+		create index if not exists mandate_collection_due_idx on mandate_collection (coalesce(retry_at, collect_at)) where status = 'pending'`,
+	},
+	{
+		Version: 47,
+		Name:    "create_cheque",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists cheque (
+			id serial primary key,
+			account_id integer not null references account(id) on delete cascade,
+			number varchar(20) not null,
+			drawer varchar(100) not null default '',
+			amount bigint not null check (amount > 0),
+			currency char(3) not null,
+			status varchar(10) not null,
+			reservation_id integer not null references reservation(id),
+			deposited_at timestamp not null,
+			clears_at timestamp not null,
+			resolved_at timestamp,
+			bounce_reason text not null default ''
+		);
+		create index if not exists cheque_account_idx on cheque (account_id, id);
+		create index if not exists cheque_pending_idx on cheque (clears_at) where status = 'pending'`,
+	},
+	{
+		Version: 48,
+		Name:    "create_cards",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists cards (
+			id serial primary key,
+			account_id integer not null references account(id) on delete cascade,
+			masked_pan varchar(19) not null,
+			status varchar(10) not null,
+			transaction_limit bigint not null default 0,
+			daily_limit bigint not null default 0,
+			expires_at timestamp not null,
+			created_at timestamp not null
+		);
+		create index if not exists cards_account_idx on cards (account_id)`,
+	},
+	{
+		Version: 49,
+		Name:    "create_external_transfer",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists external_transfer (
+			id serial primary key,
+			reference uuid not null unique,
+			account_id integer not null references account(id) on delete cascade,
+			rail varchar(4) not null,
+			routing_number char(9) not null,
+			account_number varchar(17) not null,
+			beneficiary_name varchar(100) not null,
+			amount bigint not null,
+			currency char(3) not null,
+			memo varchar(140) not null default '',
+			status varchar(10) not null,
+			return_code varchar(3) not null default '',
+			created_at timestamp not null,
+			settles_at timestamp not null,
+			resolved_at timestamp
+		);
+		create index if not exists external_transfer_account_idx on external_transfer (account_id);
+		create index if not exists external_transfer_pending_idx on external_transfer (settles_at) where status = 'pending'`,
+	},
+	{
+		Version: 50,
+		Name:    "create_standing_order",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists beneficiary (
+			id serial primary key,
+			account_id integer not null references account(id) on delete cascade,
+			name varchar(70) not null,
+			account_number bigint not null,
+			created_at timestamp not null
+		);
+		create index if not exists beneficiary_account_idx on beneficiary (account_id);
+		create table if not exists standing_order (
+			id serial primary key,
+			account_id integer not null references account(id) on delete cascade,
+			beneficiary_id integer references beneficiary(id) on delete set null,
+			amount bigint not null,
+			frequency varchar(10) not null,
+			reference varchar(140) not null default '',
+			start_date timestamp not null,
+			end_date timestamp,
+			on_insufficient_funds varchar(5) not null,
+			status varchar(10) not null,
+			next_run_at timestamp not null,
+			retry_at timestamp,
+			attempts integer not null default 0,
+			last_error text not null default '',
+			created_at timestamp not null
+		);
+		create index if not exists standing_order_account_idx on standing_order (account_id);
+		create index if not exists standing_order_due_idx
+			on standing_order (coalesce(retry_at, next_run_at)) where status = 'active'`,
+	},
+	{
+		Version: 51,
+		Name:    "add_account_nickname_metadata",
+		Phase:   PreDeploy,
+		SQL: `alter table account
+			add column if not exists nickname varchar(50) not null default '',
+			add column if not exists metadata jsonb not null default '{}';
+		create index if not exists account_search_nickname_idx on account (lower(nickname) text_pattern_ops) where nickname <> '';
+		create index if not exists account_metadata_idx on account using gin (metadata jsonb_path_ops)`,
+	},
+	{
+		// One pending submission per account, a document verifies one account
+		Version: 52,
+		Name:    "create_kyc_submission",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists kyc_submission (
+			id serial primary key,
+			account_id integer not null references account(id) on delete cascade,
+			document_type varchar(20) not null,
+			document_number_hash char(64) not null,
+			status varchar(10) not null,
+			reason text not null default '',
+			submitted_at timestamp not null,
+			reviewed_by varchar(100) not null default '',
+			reviewed_at timestamp
+		);
+		create index if not exists kyc_submission_account_idx on kyc_submission (account_id);
+		create unique index if not exists kyc_submission_pending_key on kyc_submission (account_id) where status = 'pending';
+		create unique index if not exists kyc_submission_document_key on kyc_submission (document_number_hash) where status = 'verified'`,
+	},
+	{
+		Version: 53,
+		Name:    "create_account_erasure",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists account_erasure (
+			account_id integer primary key references account(id),
+			requested_at timestamp not null,
+			erase_at timestamp not null,
+			erased_at timestamp
+		);
+		create index if not exists account_erasure_due_idx on account_erasure (erase_at) where erased_at is null`,
+	},
+	{
+		Version: 54,
+		Name:    "add_preferences_timezone",
+		Phase:   PreDeploy,
+		SQL: `alter table account_preferences
+			add column if not exists timezone varchar(64) not null default 'UTC'`,
+	},
+	{
+		// An account registers a value once, a verified value pays one account
+		Version: 55,
+		Name:    "create_account_alias",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists account_alias (
+			id serial primary key,
+			account_id integer not null references account(id) on delete cascade,
+			type varchar(10) not null,
+			value varchar(254) not null,
+			code_hash varchar(64) not null default '',
+			code_expires_at timestamp not null,
+			attempts integer not null default 0,
+			created_at timestamp not null,
+			verified_at timestamp,
+			constraint account_alias_account_value_key unique (account_id, value)
+		);
+		create unique index if not exists account_alias_verified_key on account_alias (value) where verified_at is not null`,
+	},
+	{
+		Version: 56,
+		Name:    "create_split_bill",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists split_bill (
+			id serial primary key,
+			account_id integer not null references account(id) on delete cascade,
+			account_number bigint not null,
+			description varchar(100) not null,
+			amount bigint not null check (amount > 0),
+			currency char(3) not null,
+			status varchar(10) not null,
+			created_at timestamp not null,
+			resolved_at timestamp
+		);
+		create index if not exists split_bill_account_idx on split_bill (account_id, id);
+		create table if not exists split_share (
+			id serial primary key,
+			split_id integer not null references split_bill(id) on delete cascade,
+			account_id integer not null references account(id) on delete cascade,
+			account_number bigint not null,
+			amount bigint not null check (amount > 0),
+			status varchar(10) not null,
+			transfer_reference uuid,
+			responded_at timestamp,
+			constraint split_share_split_account_key unique (split_id, account_id)
+		);
+		create index if not exists split_share_account_idx on split_share (account_id, id)`,
+	},
+	{
+		// Parties are account numbers, as on the transfer receipt
+		Version: 57,
+		Name:    "create_transfer_dispute",
+		Phase:   PreDeploy,
+		SQL: `create table if not exists transfer_dispute (
+			id serial primary key,
+			reference uuid not null,
+			from_account bigint not null,
+			to_account bigint not null,
+			amount bigint not null,
+			currency char(3) not null,
+			reason varchar(500) not null,
+			status varchar(10) not null,
+			resolution varchar(500) not null default '',
+			resolved_by varchar(100) not null default '',
+			created_at timestamp not null,
+			resolved_at timestamp,
+			constraint transfer_dispute_reference_key unique (reference)
+		);
+		create index if not exists transfer_dispute_from_idx on transfer_dispute (from_account, id);
+		create index if not exists transfer_dispute_to_idx on transfer_dispute (to_account, id);
+		create index if not exists transfer_dispute_open_idx on transfer_dispute (id) where status = 'open'`,
+	},
+}
+
+// checkSchemaCompatibility refuses to run this build when it needs
+// pre-deploy migrations that haven't been applied yet, or when a newer
+// release has already contracted the schema with a post-deploy migration.
+func checkSchemaCompatibility(known []Migration, applied []AppliedMigration) error {
+	appliedVersions := make(map[int]bool, len(applied))
+	for _, a := range applied {
+		appliedVersions[a.Version] = true
+	}
+
+	knownVersions := make(map[int]bool, len(known))
+	for _, m := range known {
+		knownVersions[m.Version] = true
+		if m.Phase == PreDeploy && !appliedVersions[m.Version] {
+			return fmt.Errorf("schema is missing pre-deploy migration %d (%s)", m.Version, m.Name)
+		}
+	}
+
+	for _, a := range applied {
+		if a.Phase == PostDeploy && !knownVersions[a.Version] {
+			return fmt.Errorf("schema has post-deploy migration %d (%s) from a newer release", a.Version, a.Name)
+		}
+	}
+
+	return nil
+}
+
+// pendingMigrations returns the migrations to run for a phase in version order.
+// Running post-deploy also applies any outstanding pre-deploy migrations.
+func pendingMigrations(known []Migration, applied []AppliedMigration, phase MigrationPhase) []Migration {
+	appliedVersions := make(map[int]bool, len(applied))
+	for _, a := range applied {
+		appliedVersions[a.Version] = true
+	}
+
+	pending := []Migration{}
+	for _, m := range known {
+		if appliedVersions[m.Version] {
+			continue
+		}
+		if phase == PreDeploy && m.Phase != PreDeploy {
+			continue
+		}
+		pending = append(pending, m)
+	}
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Version < pending[j].Version
+	})
+
+	return pending
+}
+
+func (s *PostgresStorage) createMigrationsTable() error {
+	query := `create table if not exists schema_migrations (
+		version integer primary key,
+		name varchar(100) not null,
+		phase varchar(20) not null,
+		applied_at timestamp not null
+	)`
+	_, err := s.db.Exec(query)
+	if err != nil {
+		log.Printf("Error creating schema_migrations table: %v", err)
+	}
+	return err
+}
+
+func (s *PostgresStorage) AppliedMigrations() ([]AppliedMigration, error) {
+	rows, err := s.db.Query("SELECT version, name, phase, applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := []AppliedMigration{}
+	for rows.Next() {
+		a := AppliedMigration{}
+		if err := rows.Scan(&a.Version, &a.Name, &a.Phase, &a.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied = append(applied, a)
+	}
+
+	return applied, rows.Err()
+}
+
+func (s *PostgresStorage) Migrate(phase MigrationPhase) error {
+	applied, err := s.AppliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range pendingMigrations(migrations, applied, phase) {
+		if err := s.applyMigration(m); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Name, err)
+		}
+		log.Printf("Applied %s migration %d: %s", m.Phase, m.Version, m.Name)
+	}
+
+	return nil
+}
+
+func (s *PostgresStorage) applyMigration(m Migration) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO schema_migrations (version, name, phase, applied_at) VALUES ($1, $2, $3, $4)",
+		m.Version, m.Name, m.Phase, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStorage) VerifySchema() error {
+	applied, err := s.AppliedMigrations()
+	if err != nil {
+		return err
+	}
+	return checkSchemaCompatibility(migrations, applied)
+}
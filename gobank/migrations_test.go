@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testMigrations = []Migration{
+	{Version: 1, Name: "one", Phase: PreDeploy},
+	{Version: 2, Name: "two", Phase: PostDeploy},
+	{Version: 3, Name: "three", Phase: PreDeploy},
+}
+
+func TestCheckSchemaCompatibility(t *testing.T) {
+	// Post-deploy migrations of this release may still be pending
+	applied := []AppliedMigration{{Version: 1, Phase: PreDeploy}, {Version: 3, Phase: PreDeploy}}
+	assert.Nil(t, checkSchemaCompatibility(testMigrations, applied))
+
+	// Missing pre-deploy migration
+	applied = []AppliedMigration{{Version: 1, Phase: PreDeploy}}
+	assert.Error(t, checkSchemaCompatibility(testMigrations, applied))
+
+	// Newer release already contracted the schema
+	applied = []AppliedMigration{
+		{Version: 1, Phase: PreDeploy},
+		{Version: 3, Phase: PreDeploy},
+		{Version: 4, Phase: PostDeploy},
+	}
+	assert.Error(t, checkSchemaCompatibility(testMigrations, applied))
+
+	// Newer pre-deploy migrations are backwards compatible
+	applied[2].Phase = PreDeploy
+	assert.Nil(t, checkSchemaCompatibility(testMigrations, applied))
+}
+
+func TestPendingMigrations(t *testing.T) {
+	applied := []AppliedMigration{{Version: 1, Phase: PreDeploy}}
+
+	pre := pendingMigrations(testMigrations, applied, PreDeploy)
+	assert.Len(t, pre, 1)
+	assert.Equal(t, 3, pre[0].Version)
+
+	post := pendingMigrations(testMigrations, applied, PostDeploy)
+	assert.Len(t, post, 2)
+	assert.Equal(t, 2, post[0].Version)
+}
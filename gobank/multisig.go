@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// High-impact admin actions don't run when they're requested. They're stored
+// as pending operations and run once AdminApprovalsRequired of the keys in
+// AdminApproverKeys have signed them. An approver signs the operation's
+// signing message, which covers its ID, kind and parameters, with their
+// ed25519 key (`gobank admin sign`) and posts the signature to
+// /admin/operations/{id}/approve. Unapproved operations expire after
+// AdminOperationTTL.
+//
+// Manual adjustments above AdjustmentApprovalThreshold, deleting export
+// deliveries and fee schedule changes go through here, new kinds register
+// in adminOperations.
+
+const (
+	OperationPending   = "pending"
+	OperationExecuting = "executing"
+	OperationExecuted  = "executed"
+	OperationFailed    = "failed"
+
+	AuditAdjustment = "balance.adjusted"
+
+	LedgerAdjustments = "equity:adjustments"
+)
+
+type PendingOperation struct {
+	ID             int                  `json:"id"`
+	Kind           string               `json:"kind"`
+	Params         json.RawMessage      `json:"params"`
+	Digest         string               `json:"digest"`
+	SigningMessage string               `json:"signing_message"`
+	Status         string               `json:"status"`
+	RequestedBy    string               `json:"requested_by"`
+	Approvals      []*OperationApproval `json:"approvals"`
+	Required       int                  `json:"required"`
+	Result         json.RawMessage      `json:"result,omitempty"`
+	Error          string               `json:"error,omitempty"`
+	CreatedAt      time.Time            `json:"created_at"`
+	ExpiresAt      time.Time            `json:"expires_at"`
+	ExecutedAt     *time.Time           `json:"executed_at,omitempty"`
+}
+
+type OperationApproval struct {
+	Approver  string    `json:"approver"`
+	Signature string    `json:"signature"`
+	SignedAt  time.Time `json:"signed_at"`
+}
+
+type ApproveOperationRequest struct {
+	Approver  string `json:"approver" validate:"required,max=100"`
+	Signature string `json:"signature" validate:"required"`
+}
+
+// sign fills in what approvers sign, a digest of the kind and parameters
+// so an operation can't be changed after it's approved
+func (op *PendingOperation) sign() {
+	sum := sha256.Sum256(append([]byte(op.Kind+"\n"), op.Params...))
+	op.Digest = hex.EncodeToString(sum[:])
+	op.SigningMessage = fmt.Sprintf("gobank operation %d %s", op.ID, op.Digest)
+}
+
+// adminOperation runs an approved operation's parameters
+type adminOperation func(ctx context.Context, s *APIServer, params json.RawMessage) (any, error)
+
+var adminOperations = map[string]adminOperation{
+	"adjustment":    runAdjustment,
+	"delete_export": runDeleteExport,
+	"fee_schedule":  runFeeSchedule,
+}
+
+// parseApproverKeys reads "name:base64 public key" pairs
+func parseApproverKeys(list string) (map[string]ed25519.PublicKey, error) {
+	keys := map[string]ed25519.PublicKey{}
+	for _, entry := range splitList(list) {
+		name, encoded, ok := strings.Cut(entry, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("approver key %q is not name:key", entry)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("approver key for %s is not a base64 ed25519 public key", name)
+		}
+		keys[name] = ed25519.PublicKey(key)
+	}
+	return keys, nil
+}
+
+// requestOperation stores an operation for approval
+func (s *APIServer) requestOperation(ctx context.Context, kind string, params any, actor string) (*PendingOperation, error) {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	op := &PendingOperation{
+		Kind:        kind,
+		Params:      raw,
+		Status:      OperationPending,
+		RequestedBy: actor,
+		Approvals:   []*OperationApproval{},
+		Required:    s.config.AdminApprovalsRequired,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(s.config.AdminOperationTTL),
+	}
+	if err := s.store.CreatePendingOperation(ctx, op); err != nil {
+		return nil, err
+	}
+	op.sign()
+	return op, nil
+}
+
+// approveOperation checks the signature, records it and runs the operation
+// once it has enough approvals
+func (s *APIServer) approveOperation(ctx context.Context, id int, req ApproveOperationRequest) (*PendingOperation, error) {
+	keys, err := parseApproverKeys(s.config.AdminApproverKeys)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := keys[req.Approver]
+	if !ok {
+		return nil, newHTTPError(http.StatusForbidden, "UNKNOWN_APPROVER", "%s is not an approver", req.Approver)
+	}
+
+	op, err := s.store.GetPendingOperation(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	op.sign()
+	if op.Status != OperationPending {
+		return nil, fmt.Errorf("%w: %d is %s", ErrOperationNotPending, id, op.Status)
+	}
+	if time.Now().After(op.ExpiresAt) {
+		return nil, newHTTPError(http.StatusConflict, "OPERATION_EXPIRED", "operation %d expired at %s", id, op.ExpiresAt.Format(time.RFC3339))
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(req.Signature)
+	if err != nil || !ed25519.Verify(key, []byte(op.SigningMessage), signature) {
+		return nil, newHTTPError(http.StatusForbidden, "INVALID_SIGNATURE", "signature doesn't match %q for %s", op.SigningMessage, req.Approver)
+	}
+
+	approval := &OperationApproval{Approver: req.Approver, Signature: req.Signature, SignedAt: time.Now().UTC()}
+	if err := s.store.AddOperationApproval(ctx, id, approval); err != nil {
+		return nil, err
+	}
+	if op, err = s.store.GetPendingOperation(ctx, id); err != nil {
+		return nil, err
+	}
+	op.sign()
+	if len(op.Approvals) < op.Required {
+		return op, nil
+	}
+
+	// Another approval may have got here at the same time, only one runs it
+	if claimed, err := s.store.SetOperationStatus(ctx, op, OperationPending, OperationExecuting); err != nil || !claimed {
+		return op, err
+	}
+	s.runOperation(ctx, op)
+	return op, nil
+}
+
+func (s *APIServer) runOperation(ctx context.Context, op *PendingOperation) {
+	run, ok := adminOperations[op.Kind]
+	var result any
+	err := fmt.Errorf("unknown operation kind %q", op.Kind)
+	if ok {
+		result, err = run(ctx, s, op.Params)
+	}
+
+	now := time.Now().UTC()
+	op.ExecutedAt = &now
+	op.Status = OperationExecuted
+	if err != nil {
+		op.Status, op.Error = OperationFailed, err.Error()
+	} else if op.Result, err = json.Marshal(result); err != nil {
+		op.Status, op.Error = OperationFailed, err.Error()
+	}
+	if _, err := s.store.SetOperationStatus(ctx, op, OperationExecuting, op.Status); err != nil {
+		log.Printf("Failed to record the outcome of operation %d: %v", op.ID, err)
+	}
+}
+
+type AdjustmentRequest struct {
+	Amount float64 `json:"amount" validate:"required"`
+	Reason string  `json:"reason" validate:"required,max=500"`
+}
+
+type adjustmentParams struct {
+	AccountID int     `json:"account_id"`
+	Amount    float64 `json:"amount"`
+	Reason    string  `json:"reason"`
+	Actor     string  `json:"actor"`
+}
+
+// runAdjustment credits or debits an account against the adjustments ledger
+func runAdjustment(ctx context.Context, s *APIServer, raw json.RawMessage) (any, error) {
+	var p adjustmentParams
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return nil, err
+	}
+
+	acc, err := s.store.GetAccountbyID(ctx, p.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if acc.Status == AccountClosed {
+		return nil, ErrAccountClosed
+	}
+
+	delta := toCents(p.Amount)
+	entry := newLedgerEntry(ctx, TransferKindAdjustment).
+		account(acc, delta).
+		ledger(LedgerAdjustments, acc.Currency, -delta)
+	entry.Memo = p.Reason
+	if err := s.store.PostLedgerEntry(ctx, entry, nil); err != nil {
+		return nil, err
+	}
+	auditBalanceChange(ctx, s.store, p.Actor, acc, delta)
+	recordAudit(ctx, s.store, p.Actor, acc.ID, AuditAdjustment, []FieldChange{{Field: "reason", Old: nil, New: p.Reason}})
+
+	return s.store.GetAccountbyID(ctx, acc.ID)
+}
+
+type deleteExportParams struct {
+	FileName string `json:"file_name"`
+}
+
+func runDeleteExport(ctx context.Context, s *APIServer, raw json.RawMessage) (any, error) {
+	var p deleteExportParams
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return nil, err
+	}
+	if err := s.store.DeleteExportDelivery(ctx, p.FileName); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// POST /admin/accounts/{id}/adjustments, runs right away up to
+// AdjustmentApprovalThreshold and waits for approval above it
+func (s *APIServer) handleAdjustment(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	var req AdjustmentRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+
+	s = s.forRequest(r)
+	params := adjustmentParams{AccountID: id, Amount: req.Amount, Reason: strings.TrimSpace(req.Reason), Actor: auditActor(r, s.config)}
+	if math.Abs(req.Amount) <= s.config.AdjustmentApprovalThreshold {
+		raw, _ := json.Marshal(params)
+		account, err := runAdjustment(r.Context(), s, raw)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, account)
+	}
+
+	op, err := s.requestOperation(r.Context(), "adjustment", params, params.Actor)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusAccepted, op)
+}
+
+// DELETE /admin/exports/{fileName}, always needs approval
+func (s *APIServer) handleDeleteExport(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+	params := deleteExportParams{FileName: mux.Vars(r)["fileName"]}
+	op, err := s.requestOperation(r.Context(), "delete_export", params, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusAccepted, op)
+}
+
+// GET /admin/operations, ?status= filters on one status
+func (s *APIServer) handleGetOperations(w http.ResponseWriter, r *http.Request) error {
+	ops, err := s.forRequest(r).store.GetPendingOperations(r.Context(), r.URL.Query().Get("status"))
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		op.sign()
+	}
+	return WriteJSON(w, http.StatusOK, ops)
+}
+
+// GET /admin/operations/{operationID}
+func (s *APIServer) handleGetOperation(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "operationID")
+	if err != nil {
+		return err
+	}
+	op, err := s.forRequest(r).store.GetPendingOperation(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	op.sign()
+	return WriteJSON(w, http.StatusOK, op)
+}
+
+// POST /admin/operations/{operationID}/approve
+func (s *APIServer) handleApproveOperation(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "operationID")
+	if err != nil {
+		return err
+	}
+	var req ApproveOperationRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+
+	op, err := s.forRequest(r).approveOperation(r.Context(), id, req)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, op)
+}
+
+// gobank admin keygen prints a new approver key pair
+func adminKeygen(ctx context.Context, store Storage, args []string, out io.Writer) error {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "private key: %s\npublic key:  %s\n", base64.StdEncoding.EncodeToString(private.Seed()), base64.StdEncoding.EncodeToString(public))
+	return nil
+}
+
+// gobank admin sign -key FILE -message MSG signs an operation's signing message
+func adminSign(ctx context.Context, store Storage, args []string, out io.Writer) error {
+	cmd := flag.NewFlagSet("sign", flag.ExitOnError)
+	keyFile := cmd.String("key", "", "file holding the base64 private key from keygen, required")
+	message := cmd.String("message", "", "the operation's signing_message, required")
+	cmd.Parse(args)
+
+	if *keyFile == "" || *message == "" {
+		return fmt.Errorf("-key and -message are required")
+	}
+	data, err := os.ReadFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return fmt.Errorf("%s doesn't hold a base64 ed25519 private key", *keyFile)
+	}
+
+	signature := ed25519.Sign(ed25519.NewKeyFromSeed(seed), []byte(*message))
+	fmt.Fprintln(out, base64.StdEncoding.EncodeToString(signature))
+	return nil
+}
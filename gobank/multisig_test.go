@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiSignatureAdjustment(t *testing.T) {
+	store := newMemoryStorage()
+	acc := &Account{Number: 8101, Balance: 10000, Currency: "USD"}
+	require.Nil(t, store.CreateAccount(context.Background(), acc))
+
+	keys := map[string]ed25519.PrivateKey{}
+	approvers := []string{}
+	for _, name := range []string{"alice", "bob", "carol"} {
+		public, private, err := ed25519.GenerateKey(nil)
+		require.Nil(t, err)
+		keys[name] = private
+		approvers = append(approvers, name+":"+base64.StdEncoding.EncodeToString(public))
+	}
+
+	cfg := &Config{AdminToken: "admin", StorageBackend: "test", AdminApproverKeys: strings.Join(approvers, ","),
+		AdminApprovalsRequired: 2, AdminOperationTTL: time.Hour, AdjustmentApprovalThreshold: 100}
+	router := NewAPIServer(cfg, store).routes(nil)
+	do := func(method, path string, body any) (int, *PendingOperation) {
+		data, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, "/v1"+path, bytes.NewReader(data))
+		req.Header.Set("x-admin-token", "admin")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		op := &PendingOperation{}
+		json.Unmarshal(rr.Body.Bytes(), op)
+		return rr.Code, op
+	}
+	approve := func(op *PendingOperation, name, message string) (int, *PendingOperation) {
+		key, ok := keys[name]
+		if !ok {
+			key = keys["alice"]
+		}
+		signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(message)))
+		return do("POST", "/admin/operations/"+strconv.Itoa(op.ID)+"/approve", ApproveOperationRequest{Approver: name, Signature: signature})
+	}
+
+	// Under the threshold it runs right away
+	code, _ := do("POST", "/admin/accounts/1/adjustments", AdjustmentRequest{Amount: 50, Reason: "goodwill"})
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, int64(15000), store.accounts[1].Balance)
+
+	code, op := do("POST", "/admin/accounts/1/adjustments", AdjustmentRequest{Amount: -120, Reason: "reversed duplicate deposit"})
+	require.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, OperationPending, op.Status)
+	assert.Equal(t, int64(15000), store.accounts[1].Balance, "nothing moves before approval")
+
+	code, _ = approve(op, "alice", "gobank operation 1 tampered")
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = approve(op, "mallory", op.SigningMessage)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	code, got := approve(op, "alice", op.SigningMessage)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, OperationPending, got.Status)
+	code, _ = approve(op, "alice", op.SigningMessage)
+	assert.Equal(t, http.StatusConflict, code, "one approval per approver")
+
+	code, got = approve(op, "bob", op.SigningMessage)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, OperationExecuted, got.Status)
+	assert.Len(t, got.Approvals, 2)
+	assert.Equal(t, int64(3000), store.accounts[1].Balance)
+
+	code, _ = approve(op, "carol", op.SigningMessage)
+	assert.Equal(t, http.StatusConflict, code, "already executed")
+
+	// Failed operations are recorded with their error
+	store.exports = map[string]*ExportDelivery{}
+	code, op = do("DELETE", "/admin/exports/transactions-2026-02-01.csv", nil)
+	require.Equal(t, http.StatusAccepted, code)
+	approve(op, "alice", op.SigningMessage)
+	_, got = approve(op, "carol", op.SigningMessage)
+	assert.Equal(t, OperationFailed, got.Status)
+	assert.Contains(t, got.Error, "not found")
+}
+
+func TestAdminSign(t *testing.T) {
+	out := &bytes.Buffer{}
+	require.Nil(t, adminKeygen(context.Background(), nil, nil, out))
+	lines := strings.Split(out.String(), "\n")
+	private := strings.TrimSpace(strings.TrimPrefix(lines[0], "private key:"))
+	public, err := base64.StdEncoding.DecodeString(strings.TrimSpace(strings.TrimPrefix(lines[1], "public key:")))
+	require.Nil(t, err)
+
+	keyFile := filepath.Join(t.TempDir(), "approver.key")
+	require.Nil(t, os.WriteFile(keyFile, []byte(private+"\n"), 0o600))
+
+	out.Reset()
+	require.Nil(t, adminSign(context.Background(), nil, []string{"-key", keyFile, "-message", "gobank operation 1 abc"}, out))
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(out.String()))
+	require.Nil(t, err)
+	assert.True(t, ed25519.Verify(public, []byte("gobank operation 1 abc"), signature))
+}
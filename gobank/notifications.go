@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// In-app notifications are kept in the notification table and read from
+// /account/{id}/notifications. They're raised for large transfers in or
+// out, for a balance dropping below the low balance mark and for logins
+// from an IP the account hasn't logged in from before. Each kind can be
+// turned off in the account's preferences. Like events, notifications are
+// written after the fact and a failed write is only logged.
+
+const (
+	NotificationLargeTransfer = "large_transfer"
+	NotificationLowBalance    = "low_balance"
+	NotificationNewLogin      = "new_login"
+)
+
+type Notification struct {
+	ID        int64      `json:"id"`
+	AccountID int        `json:"account_id"`
+	Type      string     `json:"type"`
+	Message   string     `json:"message"`
+	CreatedAt time.Time  `json:"created_at"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+}
+
+// NotificationRules are the amounts, in major units, that raise
+// notifications, zero turns a rule off
+type NotificationRules struct {
+	LargeTransfer float64
+	LowBalance    float64
+}
+
+// notificationRules applies to every balance change, main loads it
+var notificationRules NotificationRules
+
+func NewNotificationRules(cfg *Config) NotificationRules {
+	return NotificationRules{LargeTransfer: cfg.NotifyLargeTransfer, LowBalance: cfg.NotifyLowBalance}
+}
+
+type MarkNotificationsReadRequest struct {
+	UpTo int64 `json:"up_to" validate:"min=0"` // the newest notification read, zero for all
+}
+
+// notifyBalanceChange raises the notifications a balance change calls for
+func notifyBalanceChange(ctx context.Context, store Storage, event *AccountEvent) {
+	rules := notificationRules
+	large := rules.LargeTransfer > 0 && event.Amount >= rules.LargeTransfer
+	before := event.Balance + event.Amount
+	if event.Direction == DirectionCredit {
+		before = event.Balance - event.Amount
+	}
+	low := rules.LowBalance > 0 && event.Balance < rules.LowBalance && before >= rules.LowBalance
+	if !large && !low {
+		return
+	}
+
+	prefs, err := store.GetPreferences(ctx, event.AccountID)
+	if err != nil {
+		log.Printf("Failed to load the notification preferences of account %d: %v", event.AccountID, err)
+		return
+	}
+	if large && prefs.NotifyLargeTransfers {
+		verb := "left"
+		if event.Direction == DirectionCredit {
+			verb = "arrived in"
+		}
+		notify(ctx, store, event.AccountID, NotificationLargeTransfer,
+			fmt.Sprintf("%.2f %s %s your account.", event.Amount, event.Currency, verb))
+	}
+	if low && prefs.NotifyLowBalance {
+		notify(ctx, store, event.AccountID, NotificationLowBalance,
+			fmt.Sprintf("Your balance is down to %.2f %s.", event.Balance, event.Currency))
+	}
+}
+
+// notifyLogin raises a notification when a login comes from an unfamiliar IP
+func (s *APIServer) notifyLogin(r *http.Request, number int64) {
+	ctx, store, ip := r.Context(), s.forRequest(r).store, clientIP(r)
+	acc, err := store.GetAccountByNumber(ctx, number)
+	if err != nil {
+		log.Printf("Failed to load account %d after its login: %v", number, err)
+		return
+	}
+
+	unfamiliar, err := store.RecordLoginIP(ctx, acc.ID, ip, time.Now().UTC())
+	if err != nil {
+		log.Printf("Failed to record the login IP of account %d: %v", acc.ID, err)
+		return
+	}
+	if !unfamiliar {
+		return
+	}
+
+	prefs, err := store.GetPreferences(ctx, acc.ID)
+	if err != nil {
+		log.Printf("Failed to load the notification preferences of account %d: %v", acc.ID, err)
+		return
+	}
+	if prefs.NotifyNewLogins {
+		notify(ctx, store, acc.ID, NotificationNewLogin, fmt.Sprintf("New login to your account from %s.", ip))
+	}
+}
+
+func notify(ctx context.Context, store Storage, accountID int, kind, message string) {
+	n := &Notification{AccountID: accountID, Type: kind, Message: message, CreatedAt: time.Now().UTC()}
+	if err := store.CreateNotification(ctx, n); err != nil {
+		log.Printf("Failed to record %s notification for account %d: %v", kind, accountID, err)
+	}
+}
+
+const (
+	defaultNotificationLimit = 50
+	maxNotificationLimit     = 200
+)
+
+// GET /account/{id}/notifications?unread=&limit=, newest first, unread=true leaves out read ones
+func (s *APIServer) handleGetNotifications(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	query := r.URL.Query()
+	unread, _ := strconv.ParseBool(query.Get("unread"))
+	limit := defaultNotificationLimit
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxNotificationLimit {
+			return invalidParam("query", "limit", "range", fmt.Sprintf("must be between 1 and %d", maxNotificationLimit))
+		}
+	}
+
+	notifications, err := s.forRequest(r).store.GetNotifications(r.Context(), id, unread, limit)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, notifications)
+}
+
+// POST /account/{id}/notifications/read
+func (s *APIServer) handleMarkNotificationsRead(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	var req MarkNotificationsReadRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+
+	marked, err := s.forRequest(r).store.MarkNotificationsRead(r.Context(), id, req.UpTo, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, map[string]int64{"marked": marked})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotifications(t *testing.T) {
+	t.Setenv("JWT_SECRET", "notify-secret")
+	previous := notificationRules
+	t.Cleanup(func() { notificationRules = previous })
+	notificationRules = NotificationRules{LargeTransfer: 1000, LowBalance: 50}
+
+	ctx := context.Background()
+	store := newMemoryStorage()
+	acc, err := NewAccount("Nora", "Tify", "password")
+	require.Nil(t, err)
+	acc.Number, acc.Balance = 9961, 200000
+	require.Nil(t, store.CreateAccount(ctx, acc))
+
+	// 1500 out is large, 40 later takes the balance under 50 once
+	publishBalanceChange(ctx, store, acc, -150000)
+	acc.Balance = 50000
+	publishBalanceChange(ctx, store, acc, -46000)
+	acc.Balance = 4000
+	publishBalanceChange(ctx, store, acc, -1000)
+
+	require.Nil(t, store.SavePreferences(ctx, &AccountPreferences{AccountID: acc.ID, NotifyNewLogins: true}))
+	acc.Balance = 3000
+	publishBalanceChange(ctx, store, acc, 200000)
+
+	s := NewAPIServer(&Config{}, store)
+	login := func(ip string) {
+		body, _ := json.Marshal(LoginRequest{Number: 9961, Password: "password"})
+		r := httptest.NewRequest("POST", "/v1/login", bytes.NewReader(body))
+		r.RemoteAddr = ip + ":4321"
+		w := httptest.NewRecorder()
+		makeHTTPHandle(s.handleLogin)(w, r)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+	login("198.51.100.1")
+	login("198.51.100.1")
+	login("203.0.113.9")
+
+	get := func(query string) []Notification {
+		r := mux.SetURLVars(httptest.NewRequest("GET", "/v1/account/1/notifications"+query, nil), map[string]string{"id": "1"})
+		w := httptest.NewRecorder()
+		makeHTTPHandle(s.handleGetNotifications)(w, r)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var notifications []Notification
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &notifications))
+		return notifications
+	}
+
+	notifications := get("")
+	var kinds []string
+	for _, n := range notifications {
+		kinds = append(kinds, n.Type)
+	}
+	assert.Equal(t, []string{NotificationNewLogin, NotificationLowBalance, NotificationLargeTransfer}, kinds,
+		"a first login isn't news and turned off kinds aren't raised")
+	assert.Equal(t, "New login to your account from 203.0.113.9.", notifications[0].Message)
+	assert.Equal(t, "Your balance is down to 40.00 USD.", notifications[1].Message)
+
+	r := mux.SetURLVars(httptest.NewRequest("POST", "/v1/account/1/notifications/read", bytes.NewBufferString(`{"up_to": 2}`)), map[string]string{"id": "1"})
+	w := httptest.NewRecorder()
+	makeHTTPHandle(s.handleMarkNotificationsRead)(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"marked": 2}`, w.Body.String())
+	assert.Len(t, get("?unread=true"), 1)
+}
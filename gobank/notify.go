@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Notifier delivers messages to account holders
+type Notifier interface {
+	Notify(accountID int, subject, message string) error
+}
+
+// NewNotifier picks the delivery channel from NOTIFIER: "log" (default), or
+// "email" / "sms" to hand messages to the gateway at NOTIFIER_GATEWAY_URL,
+// which resolves the account's contact details.
+func NewNotifier(cfg *Config) (Notifier, error) {
+	switch cfg.Notifier {
+	case "", "log":
+		return logNotifier{}, nil
+	case "email", "sms":
+		if cfg.NotifierGatewayURL == "" {
+			return nil, fmt.Errorf("NOTIFIER_GATEWAY_URL is required for the %s notifier", cfg.Notifier)
+		}
+		return &gatewayNotifier{
+			channel:    cfg.Notifier,
+			url:        cfg.NotifierGatewayURL,
+			apiKey:     cfg.NotifierGatewayAPIKey,
+			httpClient: &http.Client{Timeout: 5 * time.Second},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown notifier %q", cfg.Notifier)
+}
+
+// logNotifier writes notifications to the server log, used until a real channel is configured
+type logNotifier struct{}
+
+func (logNotifier) Notify(accountID int, subject, message string) error {
+	log.Printf("Notification for account %d: %s - %s", accountID, subject, message)
+	return nil
+}
+
+type gatewayMessage struct {
+	Channel   string `json:"channel"`
+	AccountID int    `json:"account_id"`
+	Subject   string `json:"subject"`
+	Message   string `json:"message"`
+}
+
+// gatewayNotifier posts messages to an email or SMS delivery gateway
+type gatewayNotifier struct {
+	channel    string
+	url        string
+	apiKey     string
+	httpClient *http.Client
+}
+
+func (n *gatewayNotifier) Notify(accountID int, subject, message string) error {
+	payload, err := json.Marshal(gatewayMessage{Channel: n.channel, AccountID: accountID, Subject: subject, Message: message})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", n.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+n.apiKey)
+	}
+
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s gateway unreachable: %v", n.channel, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s gateway returned %d", n.channel, resp.StatusCode)
+	}
+	return nil
+}
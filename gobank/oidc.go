@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// Customers can log in through an external OpenID Connect provider, such
+// as Google or Keycloak, with the authorization code flow and PKCE.
+// GET /login/oidc redirects to the provider, which sends the browser back
+// to OIDC_REDIRECT_URL, the route of GET /login/oidc/callback. The callback
+// verifies the ID token and answers with a gobank JWT like /login does.
+//
+// An identity is looked up by issuer and subject in oidc_identity. The first
+// login of a subject links it to the account with the same email, only when
+// both the provider and gobank have verified that address. Subjects without
+// a linked account are refused, external logins don't open accounts.
+
+const (
+	AuditIdentityLinked = "account.identity_linked"
+
+	oidcCookie    = "gobank_oidc"
+	oidcCookieTTL = 10 * time.Minute
+)
+
+type OIDCIdentity struct {
+	ID        int       `json:"id"`
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	AccountID int       `json:"account_id"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type oidcLogin struct {
+	issuer   string
+	verifier *oidc.IDTokenVerifier
+	oauth    oauth2.Config
+}
+
+// NewOIDCLogin discovers the provider's endpoints, nil when no issuer is configured
+func NewOIDCLogin(ctx context.Context, cfg *Config) (*oidcLogin, error) {
+	if cfg.OIDCIssuerURL == "" {
+		return nil, nil
+	}
+	if cfg.OIDCClientID == "" || cfg.OIDCRedirectURL == "" {
+		return nil, fmt.Errorf("OIDC_CLIENT_ID and OIDC_REDIRECT_URL must be set with OIDC_ISSUER_URL")
+	}
+
+	provider, err := oidc.NewProvider(ctx, cfg.OIDCIssuerURL)
+	if err != nil {
+		return nil, err
+	}
+	return &oidcLogin{
+		issuer:   cfg.OIDCIssuerURL,
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.OIDCClientID}),
+		oauth: oauth2.Config{
+			ClientID:     cfg.OIDCClientID,
+			ClientSecret: cfg.OIDCClientSecret,
+			RedirectURL:  cfg.OIDCRedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       append([]string{oidc.ScopeOpenID}, strings.Fields(cfg.OIDCScopes)...),
+		},
+	}, nil
+}
+
+var errOIDCDisabled = newHTTPError(http.StatusNotFound, "OIDC_DISABLED", "OIDC login is not configured")
+
+// GET /login/oidc, the state, nonce and PKCE verifier wait in a short-lived cookie
+func (s *APIServer) handleOIDCLogin(w http.ResponseWriter, r *http.Request) error {
+	if s.oidc == nil {
+		return errOIDCDisabled
+	}
+
+	state, nonce, verifier := newTokenID(), newTokenID(), oauth2.GenerateVerifier()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    state + "." + nonce + "." + verifier,
+		Path:     "/",
+		MaxAge:   int(oidcCookieTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, s.oidc.oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), http.StatusFound)
+	return nil
+}
+
+// GET /login/oidc/callback
+func (s *APIServer) handleOIDCCallback(w http.ResponseWriter, r *http.Request) error {
+	if s.oidc == nil {
+		return errOIDCDisabled
+	}
+
+	// The cookie is good for one attempt
+	cookie, err := r.Cookie(oidcCookie)
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: "/", MaxAge: -1, HttpOnly: true, Secure: true})
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest, "OIDC_STATE_MISSING", "login session expired, start again at /login/oidc")
+	}
+	parts := strings.Split(cookie.Value, ".")
+	query := r.URL.Query()
+	if len(parts) != 3 || subtle.ConstantTimeCompare([]byte(parts[0]), []byte(query.Get("state"))) != 1 {
+		return newHTTPError(http.StatusBadRequest, "OIDC_STATE_MISMATCH", "state doesn't match the login session")
+	}
+	if msg := query.Get("error"); msg != "" {
+		return newHTTPError(http.StatusUnauthorized, "OIDC_DENIED", "identity provider refused the login: %s", msg)
+	}
+
+	token, err := s.oidc.oauth.Exchange(r.Context(), query.Get("code"), oauth2.VerifierOption(parts[2]))
+	if err != nil {
+		return newHTTPError(http.StatusUnauthorized, "OIDC_EXCHANGE_FAILED", "could not redeem the authorization code: %v", err)
+	}
+	raw, ok := token.Extra("id_token").(string)
+	if !ok {
+		return newHTTPError(http.StatusUnauthorized, "OIDC_NO_ID_TOKEN", "identity provider returned no ID token")
+	}
+	idToken, err := s.oidc.verifier.Verify(r.Context(), raw)
+	if err != nil || subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(parts[1])) != 1 {
+		return newHTTPError(http.StatusUnauthorized, "OIDC_INVALID_ID_TOKEN", "ID token failed verification")
+	}
+
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return err
+	}
+	email := ""
+	if claims.EmailVerified {
+		email = claims.Email
+	}
+
+	resp, err := s.forRequest(r).accounts().LoginExternal(r.Context(), s.oidc.issuer, idToken.Subject, email)
+	if err != nil {
+		return err
+	}
+	s.notifyLogin(r, resp.Number)
+	return WriteJSON(w, http.StatusOK, resp)
+}
+
+// LoginExternal logs in the account linked to an issuer's subject, linking
+// it on first use by verifiedEmail when one is given
+func (s *accountService) LoginExternal(ctx context.Context, issuer, subject, verifiedEmail string) (*LoginResponse, error) {
+	identity, err := s.store.GetOIDCIdentity(ctx, issuer, subject)
+	if errors.Is(err, ErrIdentityNotLinked) && verifiedEmail != "" {
+		identity, err = s.linkIdentity(ctx, issuer, subject, verifiedEmail)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	acc, err := s.store.GetAccountbyID(ctx, identity.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.checkLoginLocked(ctx, acc); err != nil {
+		return nil, err
+	}
+	return s.issueLogin(ctx, acc)
+}
+
+func (s *accountService) linkIdentity(ctx context.Context, issuer, subject, email string) (*OIDCIdentity, error) {
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return nil, ErrIdentityNotLinked
+	}
+	acc, err := s.store.GetAccountByEmail(ctx, email)
+	if errors.Is(err, ErrAccountNotFound) || (err == nil && !acc.EmailVerified) {
+		return nil, ErrIdentityNotLinked
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &OIDCIdentity{Issuer: issuer, Subject: subject, AccountID: acc.ID, Email: email, CreatedAt: time.Now().UTC()}
+	if err := s.store.CreateOIDCIdentity(ctx, identity); err != nil {
+		return nil, err
+	}
+	recordAudit(ctx, s.store, "oidc:"+issuer, acc.ID, AuditIdentityLinked, []FieldChange{{Field: "oidc_subject", Old: "", New: subject}})
+	return identity, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeProvider is an OpenID Connect provider that signs in whoever subject says
+type fakeProvider struct {
+	*httptest.Server
+	keys    *JWTKeyring
+	subject string
+	email   string
+	nonce   string
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	keys, err := LoadJWTKeyring(&Config{JWTKeys: "idp=" + writePEM(t, "idp.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))})
+	require.Nil(t, err)
+
+	p := &fakeProvider{keys: keys}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, map[string]any{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, p.keys.JWKS())
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		idToken, err := p.keys.sign(jwt.MapClaims{
+			"iss": p.URL, "aud": "gobank", "sub": p.subject, "nonce": p.nonce,
+			"email": p.email, "email_verified": true,
+			"iat": now.Unix(), "exp": now.Add(time.Minute).Unix(),
+		})
+		require.Nil(t, err)
+		WriteJSON(w, http.StatusOK, map[string]any{"access_token": "at", "token_type": "Bearer", "id_token": idToken})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func TestOIDCLogin(t *testing.T) {
+	t.Setenv("JWT_SECRET", "oidc-secret")
+	ctx := context.Background()
+	provider := newFakeProvider(t)
+	store := newMemoryStorage()
+	acc, err := NewAccount("Ida", "Provider", "password")
+	require.Nil(t, err)
+	acc.Email, acc.EmailVerified = "ida@example.com", true
+	require.Nil(t, store.CreateAccount(ctx, acc))
+
+	cfg := &Config{OIDCIssuerURL: provider.URL, OIDCClientID: "gobank", OIDCRedirectURL: "https://bank.example/v1/login/oidc/callback", OIDCScopes: "email"}
+	s := NewAPIServer(cfg, store)
+	s.oidc, err = NewOIDCLogin(ctx, cfg)
+	require.Nil(t, err)
+
+	login := func(subject, email string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		makeHTTPHandle(s.handleOIDCLogin)(w, httptest.NewRequest("GET", "/v1/login/oidc", nil))
+		require.Equal(t, http.StatusFound, w.Code)
+		redirect, err := url.Parse(w.Header().Get("Location"))
+		require.Nil(t, err)
+		assert.Equal(t, "S256", redirect.Query().Get("code_challenge_method"))
+		provider.subject, provider.email, provider.nonce = subject, email, redirect.Query().Get("nonce")
+
+		r := httptest.NewRequest("GET", "/v1/login/oidc/callback?code=abc&state="+redirect.Query().Get("state"), nil)
+		r.AddCookie(w.Result().Cookies()[0])
+		w = httptest.NewRecorder()
+		makeHTTPHandle(s.handleOIDCCallback)(w, r)
+		return w
+	}
+
+	// The first login links the subject by verified email
+	w := login("sub-1", "ida@example.com")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp LoginResponse
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, acc.Number, resp.Number)
+	require.Len(t, store.idents, 1)
+	assert.Equal(t, acc.ID, store.idents[0].AccountID)
+
+	// Linked subjects get in whatever email they carry now
+	w = login("sub-1", "changed@example.com")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = login("sub-2", "stranger@example.com")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	var apiErr ApiError
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &apiErr))
+	assert.Equal(t, "IDENTITY_NOT_LINKED", apiErr.Code)
+
+	// A callback without the login session's state is refused
+	w = httptest.NewRecorder()
+	makeHTTPHandle(s.handleOIDCCallback)(w, httptest.NewRequest("GET", "/v1/login/oidc/callback?code=abc&state=forged", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
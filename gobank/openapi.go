@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiOperation describes one route for the generated OpenAPI document.
+// Request and Response are zero values of the Go types the handler decodes
+// and encodes, their schemas are derived by reflection.
+type apiOperation struct {
+	Method   string
+	Path     string
+	Summary  string
+	Auth     string // "", "jwt" or "admin"
+	Request  any
+	Response any
+
+	ContentType string // of the request and response bodies, application/json when empty
+}
+
+// rawSchema is used as a Response when the handler doesn't return a named type
+type rawSchema map[string]any
+
+var apiOperations = []apiOperation{
+	{Method: "POST", Path: "/login", Summary: "Log in and receive a JWT", Request: LoginRequest{}, Response: LoginResponse{}},
+	{Method: "GET", Path: "/login/oidc", Summary: "Redirect to the OpenID Connect provider to log in", Response: rawSchema{"type": "string", "description": "302 to the provider"}},
+	{Method: "GET", Path: "/login/oidc/callback", Summary: "Finish an OpenID Connect login and receive a JWT", Response: LoginResponse{}},
+	{Method: "POST", Path: "/logout", Summary: "Revoke the JWT in x-jwt-token", Auth: "jwt", Response: rawSchema{
+		"type":       "object",
+		"properties": map[string]any{"status": map[string]any{"type": "string"}},
+	}},
+	{Method: "GET", Path: "/me/data-export", Summary: "Download everything kept about the token's account holder as JSON", Auth: "jwt", Response: DataExport{}},
+	{Method: "DELETE", Path: "/me", Summary: "Close the token's account and erase its personal data after the retention window, ledger records are kept", Auth: "jwt", Response: ErasureRequest{}},
+	{Method: "POST", Path: "/password/forgot", Summary: "Send a password reset token to the account holder", Request: ForgotPasswordRequest{}, Response: rawSchema{
+		"type":       "object",
+		"properties": map[string]any{"status": map[string]any{"type": "string"}},
+	}},
+	{Method: "POST", Path: "/password/reset", Summary: "Set a new password with a reset token", Request: ResetPasswordRequest{}, Response: rawSchema{
+		"type":       "object",
+		"properties": map[string]any{"status": map[string]any{"type": "string"}},
+	}},
+	{Method: "GET", Path: "/verify", Summary: "Verify an account's email address with ?token=", Response: rawSchema{
+		"type": "object",
+		"properties": map[string]any{
+			"account_number": map[string]any{"type": "integer"},
+			"email":          map[string]any{"type": "string"},
+			"email_verified": map[string]any{"type": "boolean"},
+		},
+	}},
+	{Method: "GET", Path: "/resolve", Summary: "Look up who a verified phone or email alias pays with ?alias=", Auth: "jwt", Response: AliasResolution{}},
+	{Method: "GET", Path: "/limits", Summary: "The caller's rate limit buckets and, with an x-jwt-token or x-api-key, daily transfer usage", Response: CallerLimits{}},
+	{Method: "GET", Path: "/account", Summary: "List all accounts", Response: []PublicAccount{}},
+	{Method: "POST", Path: "/account", Summary: "Create an account", Request: CreateAccountRequest{}, Response: Account{}},
+	{Method: "GET", Path: "/account/search", Summary: "Search accounts by name or nickname prefix or exact account number, ?q=&metadata=key:value&limit=&offset=", Auth: "admin", Response: AccountSearchPage{}},
+	{Method: "GET", Path: "/account/{id}", Summary: "Get an account, ?locale= or Accept-Language adds formatted amounts", Auth: "jwt", Response: Account{}},
+	{Method: "PATCH", Path: "/account/{id}", Summary: "Set the account's nickname and metadata, null metadata values remove their key", Auth: "jwt", Request: UpdateAccountRequest{}, Response: Account{}},
+	{Method: "DELETE", Path: "/account/{id}", Summary: "Close an account with a zero balance", Auth: "jwt", Response: Account{}},
+	{Method: "POST", Path: "/transfer", Summary: "Transfer funds between accounts, in async mode it's queued and answers 202 with a TransferJob", Request: TransferRequest{}, Response: TransferReceipt{}},
+	{Method: "POST", Path: "/payments/iso20022", Summary: "Perform the transfers of an ISO 20022 pain.001 file, answers with a pain.002 status report", Auth: "jwt",
+		Request: rawSchema{"type": "string"}, Response: rawSchema{"type": "string"}, ContentType: "application/xml"},
+	{Method: "POST", Path: "/transfer/external", Summary: "Send money from the token's account to an account at another bank over ACH or wire, pending until it settles or is returned", Auth: "jwt", Request: ExternalTransferRequest{}, Response: ExternalTransfer{}},
+	{Method: "GET", Path: "/transfer/{reference}", Summary: "Look up a transfer receipt by its reference", Response: TransferReceipt{}},
+	{Method: "GET", Path: "/transfer/status/{id}", Summary: "Status of a transfer queued in async mode, with its receipt once it succeeded", Response: TransferJob{}},
+	{Method: "POST", Path: "/transfer/{reference}/approve", Summary: "Approve a transfer waiting for approval, releasing its reservation and performing it", Auth: "admin", Response: TransferReceipt{}},
+	{Method: "POST", Path: "/transfer/{reference}/reject", Summary: "Reject a transfer waiting for approval, releasing its reservation", Auth: "admin", Request: RejectTransferRequest{}, Response: PendingTransfer{}},
+	{Method: "POST", Path: "/transfer/{reference}/dispute", Summary: "Dispute a transfer the account paid, within DISPUTE_WINDOW of it", Auth: "jwt", Request: OpenDisputeRequest{}, Response: Dispute{}},
+	{Method: "GET", Path: "/transfer/{reference}/dispute", Summary: "The transfer's dispute, for its payer and payee", Auth: "jwt", Response: Dispute{}},
+	{Method: "GET", Path: "/account/{id}/notifications", Summary: "In-app notifications, newest first, ?unread=true&limit=", Auth: "jwt", Response: []Notification{}},
+	{Method: "POST", Path: "/account/{id}/notifications/read", Summary: "Mark notifications read up to up_to, all of them when it's zero", Auth: "jwt", Request: MarkNotificationsReadRequest{}, Response: rawSchema{
+		"type": "object", "properties": map[string]any{"marked": map[string]any{"type": "integer"}},
+	}},
+	{Method: "GET", Path: "/account/{id}/preferences", Summary: "The account holder's preferences", Auth: "jwt", Response: AccountPreferences{}},
+	{Method: "PATCH", Path: "/account/{id}/preferences", Summary: "Change preferences, such as opting in to monthly statements by email", Auth: "jwt", Request: UpdatePreferencesRequest{}, Response: AccountPreferences{}},
+	{Method: "GET", Path: "/account/{id}/kyc", Summary: "The account's KYC status and submissions, transfer limits are lower until it's verified", Auth: "jwt", Response: KYCStatus{}},
+	{Method: "POST", Path: "/account/{id}/kyc", Summary: "Submit an identity document for KYC review, only a hash of its number is kept", Auth: "jwt", Request: SubmitKYCRequest{}, Response: KYCSubmission{}},
+	{Method: "GET", Path: "/admin/api-keys", Summary: "API keys for integrations, without the keys themselves", Auth: "admin", Response: []APIKey{}},
+	{Method: "POST", Path: "/admin/api-keys", Summary: "Mint a read, transfer or admin scoped API key, the key is only returned here", Auth: "admin", Request: CreateAPIKeyRequest{}, Response: CreateAPIKeyResponse{}},
+	{Method: "DELETE", Path: "/admin/api-keys/{keyID}", Summary: "Revoke an API key", Auth: "admin", Response: APIKey{}},
+	{Method: "POST", Path: "/admin/cheques/{chequeID}/bounce", Summary: "Bounce a cheque that hasn't cleared, booking the deposit back out", Auth: "admin", Request: BounceChequeRequest{}, Response: Cheque{}},
+	{Method: "GET", Path: "/admin/transfers/pending", Summary: "Transfers waiting for approval, ?status= lists approved, completed, failed or rejected ones", Auth: "admin", Response: []PendingTransfer{}},
+	{Method: "GET", Path: "/admin/fraud/decisions", Summary: "Recent fraud screening decisions, newest first, ?action=allow, review or block", Auth: "admin", Response: []FraudDecision{}},
+	{Method: "GET", Path: "/admin/fraud/reviews", Summary: "Transfers held by the fraud rules, resolve them with /transfer/{reference}/approve or reject", Auth: "admin", Response: []FraudReview{}},
+	{Method: "GET", Path: "/transfer/{reference}/enrichments", Summary: "Annotations added after the transfer committed, one per enricher", Response: []TransferEnrichment{}},
+	{Method: "GET", Path: "/account/{id}/balance", Summary: "Balance from the ledger as of ?at=, an RFC 3339 timestamp defaulting to now", Auth: "jwt", Response: HistoricalBalance{}},
+	{Method: "GET", Path: "/account/{id}/holds", Summary: "Authorization holds with the booked and available balance", Auth: "jwt", Response: Authorizations{}},
+	{Method: "POST", Path: "/account/{id}/holds", Summary: "Reserve funds for a pending payment, expiring after 7 days unless expires_at is set", Auth: "jwt", Request: AuthorizeRequest{}, Response: Reservation{}},
+	{Method: "POST", Path: "/account/{id}/holds/{holdID}/capture", Summary: "Book up to the held amount and release the rest", Auth: "jwt", Request: CaptureRequest{}, Response: Reservation{}},
+	{Method: "POST", Path: "/account/{id}/holds/{holdID}/release", Summary: "Release a hold without booking anything", Auth: "jwt", Response: Reservation{}},
+	{Method: "GET", Path: "/account/{id}/aliases", Summary: "Phone and email aliases others can pay the account at", Auth: "jwt", Response: []AccountAlias{}},
+	{Method: "POST", Path: "/account/{id}/aliases", Summary: "Register an alias and send it a code, it's payable once verified", Auth: "jwt", Request: RegisterAliasRequest{}, Response: AccountAlias{}},
+	{Method: "POST", Path: "/account/{id}/aliases/{aliasID}/verify", Summary: "Verify an alias with the code it was sent", Auth: "jwt", Request: VerifyAliasRequest{}, Response: AccountAlias{}},
+	{Method: "DELETE", Path: "/account/{id}/aliases/{aliasID}", Summary: "Remove an alias, it can't be paid any more", Auth: "jwt", Response: rawSchema{
+		"type":       "object",
+		"properties": map[string]any{"deleted": map[string]any{"type": "integer"}},
+	}},
+	{Method: "GET", Path: "/account/{id}/splits", Summary: "Bills the account split with others, newest first, with what's been paid", Auth: "jwt", Response: []SplitBill{}},
+	{Method: "POST", Path: "/account/{id}/splits", Summary: "Split a bill, asking each participant for an even or given share", Auth: "jwt", Request: CreateSplitRequest{}, Response: SplitBill{}},
+	{Method: "GET", Path: "/account/{id}/splits/{splitID}", Summary: "A split bill with its shares and what's been paid", Auth: "jwt", Response: SplitBill{}},
+	{Method: "DELETE", Path: "/account/{id}/splits/{splitID}", Summary: "Cancel an open split, shares already paid stay paid", Auth: "jwt", Response: SplitBill{}},
+	{Method: "GET", Path: "/account/{id}/split-shares", Summary: "Shares of split bills other accounts asked this one to pay", Auth: "jwt", Response: []SplitShare{}},
+	{Method: "POST", Path: "/account/{id}/split-shares/{shareID}/pay", Summary: "Pay a share with a transfer to the account that split the bill", Auth: "jwt", Request: PaySplitShareRequest{}, Response: PaySplitShareResponse{}},
+	{Method: "POST", Path: "/account/{id}/split-shares/{shareID}/decline", Summary: "Decline a share", Auth: "jwt", Response: SplitShare{}},
+	{Method: "GET", Path: "/account/{id}/beneficiaries", Summary: "Saved payees", Auth: "jwt", Response: []Beneficiary{}},
+	{Method: "POST", Path: "/account/{id}/beneficiaries", Summary: "Save a payee for standing orders", Auth: "jwt", Request: CreateBeneficiaryRequest{}, Response: Beneficiary{}},
+	{Method: "DELETE", Path: "/account/{id}/beneficiaries/{beneficiaryID}", Summary: "Delete a payee no live standing order pays", Auth: "jwt", Response: rawSchema{
+		"type":       "object",
+		"properties": map[string]any{"deleted": map[string]any{"type": "integer"}},
+	}},
+	{Method: "GET", Path: "/account/{id}/standing-orders", Summary: "Standing orders to saved payees", Auth: "jwt", Response: []StandingOrder{}},
+	{Method: "POST", Path: "/account/{id}/standing-orders", Summary: "Pay a saved payee on a schedule between a start and an optional end date", Auth: "jwt", Request: CreateStandingOrderRequest{}, Response: StandingOrder{}},
+	{Method: "DELETE", Path: "/account/{id}/standing-orders/{orderID}", Summary: "Cancel a standing order", Auth: "jwt", Response: StandingOrder{}},
+	{Method: "POST", Path: "/account/{id}/standing-orders/{orderID}/pause", Summary: "Pause a standing order, nothing is paid until it's resumed", Auth: "jwt", Response: StandingOrder{}},
+	{Method: "POST", Path: "/account/{id}/standing-orders/{orderID}/resume", Summary: "Resume a paused standing order, skipping the payments that fell due while it was paused", Auth: "jwt", Response: StandingOrder{}},
+	{Method: "GET", Path: "/account/{id}/scheduled-transfers", Summary: "List recurring transfers", Auth: "jwt", Response: []ScheduledTransfer{}},
+	{Method: "POST", Path: "/account/{id}/scheduled-transfers", Summary: "Create a recurring transfer", Auth: "jwt", Request: CreateScheduledTransferRequest{}, Response: ScheduledTransfer{}},
+	{Method: "DELETE", Path: "/account/{id}/scheduled-transfers/{scheduledID}", Summary: "Cancel a recurring transfer", Auth: "jwt", Response: rawSchema{
+		"type":       "object",
+		"properties": map[string]any{"cancelled": map[string]any{"type": "integer"}},
+	}},
+	{Method: "GET", Path: "/account/{id}/cards", Summary: "Cards issued against the account", Auth: "jwt", Response: []Card{}},
+	{Method: "POST", Path: "/account/{id}/cards", Summary: "Issue a card with optional per-transaction and daily limits", Auth: "jwt", Request: CardLimitsRequest{}, Response: Card{}},
+	{Method: "POST", Path: "/account/{id}/cards/{cardID}/freeze", Summary: "Freeze a card, authorizations are declined until it's unfrozen", Auth: "jwt", Response: Card{}},
+	{Method: "POST", Path: "/account/{id}/cards/{cardID}/unfreeze", Summary: "Unfreeze a card", Auth: "jwt", Response: Card{}},
+	{Method: "PUT", Path: "/account/{id}/cards/{cardID}/limits", Summary: "Set a card's spending limits, zero for none", Auth: "jwt", Request: CardLimitsRequest{}, Response: Card{}},
+	{Method: "POST", Path: "/cards/{cardID}/authorize", Summary: "Authorize a card payment, placing a hold on the card's account", Auth: "admin", Request: CardAuthorizeRequest{}, Response: Reservation{}},
+	{Method: "GET", Path: "/account/{id}/external-transfers", Summary: "Transfers to other banks and whether they settled or were returned", Auth: "jwt", Response: []ExternalTransfer{}},
+	{Method: "GET", Path: "/account/{id}/disputes", Summary: "Disputes of transfers the account paid or received, newest first", Auth: "jwt", Response: []Dispute{}},
+	{Method: "GET", Path: "/account/{id}/cheques", Summary: "Deposited cheques, pending ones aren't in the available balance yet", Auth: "jwt", Response: []Cheque{}},
+	{Method: "POST", Path: "/account/{id}/cheques", Summary: "Deposit a cheque, booked now and available once it clears", Auth: "jwt", Request: DepositChequeRequest{}, Response: Cheque{}},
+	{Method: "GET", Path: "/account/{id}/mandates", Summary: "Direct debit mandates the account pays or collects on", Auth: "jwt", Response: []Mandate{}},
+	{Method: "POST", Path: "/account/{id}/mandates", Summary: "Ask a payer for a mandate to collect up to a limit per period, pending until the payer approves", Auth: "jwt", Request: CreateMandateRequest{}, Response: Mandate{}},
+	{Method: "DELETE", Path: "/account/{id}/mandates/{mandateID}", Summary: "Cancel a mandate, by either side", Auth: "jwt", Response: Mandate{}},
+	{Method: "POST", Path: "/account/{id}/mandates/{mandateID}/approve", Summary: "Approve a pending mandate, by the payer", Auth: "jwt", Response: Mandate{}},
+	{Method: "GET", Path: "/account/{id}/mandates/{mandateID}/collections", Summary: "Collections on a mandate", Auth: "jwt", Response: []MandateCollection{}},
+	{Method: "POST", Path: "/account/{id}/mandates/{mandateID}/collections", Summary: "Submit a collection, performed at collectAt or right away", Auth: "jwt", Request: CreateCollectionRequest{}, Response: MandateCollection{}},
+	{Method: "GET", Path: "/account/{id}/sweeps", Summary: "List sweep rules", Auth: "jwt", Response: []SweepRule{}},
+	{Method: "POST", Path: "/account/{id}/sweeps", Summary: "Sweep everything above a threshold to another account on a schedule", Auth: "jwt", Request: CreateSweepRuleRequest{}, Response: SweepRule{}},
+	{Method: "DELETE", Path: "/account/{id}/sweeps/{sweepID}", Summary: "Cancel a sweep rule", Auth: "jwt", Response: rawSchema{
+		"type":       "object",
+		"properties": map[string]any{"cancelled": map[string]any{"type": "integer"}},
+	}},
+	{Method: "GET", Path: "/account/{id}/sweeps/{sweepID}/executions", Summary: "Execution history of a sweep rule", Auth: "jwt", Response: []SweepExecution{}},
+	{Method: "POST", Path: "/account/{id}/freeze", Summary: "Freeze an account, blocking logins and transfers", Auth: "admin", Response: Account{}},
+	{Method: "POST", Path: "/account/{id}/unfreeze", Summary: "Unfreeze an account", Auth: "admin", Response: Account{}},
+	{Method: "POST", Path: "/account/{id}/reactivate", Summary: "Reactivate a dormant account by re-entering the password", Auth: "jwt", Request: ReactivateAccountRequest{}, Response: Account{}},
+	{Method: "GET", Path: "/account/{id}/subscriptions", Summary: "List event subscriptions", Auth: "jwt", Response: []EventSubscription{}},
+	{Method: "POST", Path: "/account/{id}/subscriptions", Summary: "Subscribe a webhook to balance events, optionally filtered", Auth: "jwt", Request: CreateEventSubscriptionRequest{}, Response: EventSubscription{}},
+	{Method: "DELETE", Path: "/account/{id}/subscriptions/{subscriptionID}", Summary: "Cancel an event subscription", Auth: "jwt", Response: rawSchema{
+		"type":       "object",
+		"properties": map[string]any{"cancelled": map[string]any{"type": "integer"}},
+	}},
+	{Method: "GET", Path: "/account/{id}/transactions", Summary: "Ledger history newest first, ?category= filters, ?before= pages by entry_id", Auth: "jwt", Response: []AccountTransaction{}},
+	{Method: "GET", Path: "/account/{id}/analytics", Summary: "Inflows, outflows, categories and largest transactions of a ?period=month or week, ?date= picks which", Auth: "jwt", Response: AccountAnalytics{}},
+	{Method: "GET", Path: "/ws", Summary: "WebSocket feed of account events, subscribe with {\"type\": \"subscribe\", \"account_id\": 1}", Auth: "jwt", Response: WSMessage{}},
+	{Method: "GET", Path: "/account/{id}/events", Summary: "Server-Sent Events stream of balance_changed and transfer_received events after Last-Event-ID or ?since=", Auth: "jwt", Response: rawSchema{
+		"type": "string", "description": "text/event-stream, data is an AccountEvent",
+	}},
+	{Method: "GET", Path: "/account/{id}/events/poll", Summary: "Wait for balance events after ?since=, at most ?wait= seconds", Auth: "jwt", Response: EventPage{}},
+	{Method: "GET", Path: "/account/{id}/cashback", Summary: "Cashback earned this month and overall", Auth: "jwt", Response: CashbackSummary{}},
+	{Method: "GET", Path: "/admin/exports", Summary: "Back-office file deliveries of the last 30 days", Auth: "admin", Response: []ExportDelivery{}},
+	{Method: "GET", Path: "/calculators/interest", Summary: "Preview daily compounded interest, ?principal=&rate= (annual fraction)&days=", Response: InterestPreview{}},
+	{Method: "GET", Path: "/calculators/fees", Summary: "Preview a fee as production would charge it, ?amount=&type=overdraft or transfer&days=&currency=", Response: FeePreview{}},
+	{Method: "PUT", Path: "/account/{id}/pin", Summary: "Set the transaction PIN for transfers and holds above the PIN threshold", Auth: "jwt", Request: SetPINRequest{}, Response: rawSchema{
+		"type":       "object",
+		"properties": map[string]any{"status": map[string]any{"type": "string"}},
+	}},
+	{Method: "GET", Path: "/account/{id}/overdraft", Summary: "Overdraft limit, usage and accrued fees", Auth: "jwt", Response: OverdraftStatus{}},
+	{Method: "PUT", Path: "/account/{id}/overdraft", Summary: "Opt into or change the overdraft limit, zero opts out", Auth: "jwt", Request: SetOverdraftRequest{}, Response: OverdraftStatus{}},
+	{Method: "POST", Path: "/admin/accounts/{id}/unlock", Summary: "Lift a login lockout and clear the failed attempts", Auth: "admin", Response: rawSchema{
+		"type":       "object",
+		"properties": map[string]any{"status": map[string]any{"type": "string"}},
+	}},
+	{Method: "POST", Path: "/admin/accounts/{id}/merge", Summary: "Merge a duplicate account into survivor_id", Auth: "admin", Request: MergeAccountsRequest{}, Response: AccountMerge{}},
+	{Method: "GET", Path: "/admin/finance/trial-balance", Summary: "Bank trial balance per currency, ?format=csv for CSV", Auth: "admin", Response: TrialBalance{}},
+	{Method: "GET", Path: "/admin/fees", Summary: "The current fee schedule of each currency", Auth: "admin", Response: []FeeSchedule{}},
+	{Method: "GET", Path: "/admin/fees/{currency}", Summary: "A currency's current fee schedule, empty when its accounts aren't charged", Auth: "admin", Response: FeeSchedule{}},
+	{Method: "PUT", Path: "/admin/fees/{currency}", Summary: "Replace a currency's fee schedule, runs once approved", Auth: "admin", Request: SetFeeScheduleRequest{}, Response: PendingOperation{}},
+	{Method: "GET", Path: "/admin/stats", Summary: "Account counts by status and balance totals per currency", Auth: "admin", Response: SystemStats{}},
+	{Method: "GET", Path: "/admin/stats/transfers", Summary: "Customer transfer count and amount per day and currency, ?from=&to= (days, the last 30 by default)", Auth: "admin", Response: TransferVolumeStats{}},
+	{Method: "GET", Path: "/admin/stats/top-accounts", Summary: "Accounts with the most transfers sent or received, ?days=30&limit=10", Auth: "admin", Response: TopAccountsStats{}},
+	{Method: "GET", Path: "/admin/backups", Summary: "Completed backups, newest first", Auth: "admin", Response: []BackupManifest{}},
+	{Method: "POST", Path: "/admin/backups", Summary: "Snapshot all accounts and ledger entries to the backup target, restore with gobank restore", Auth: "admin", Response: BackupManifest{}},
+	{Method: "GET", Path: "/admin/finance/daily", Summary: "Daily income and liability totals, ?format=csv for CSV", Auth: "admin", Response: []FinanceDay{}},
+	{Method: "GET", Path: "/admin/accounts/{id}/holds", Summary: "Legal holds on an account and the balance they leave available", Auth: "admin", Response: LegalHolds{}},
+	{Method: "POST", Path: "/admin/accounts/{id}/holds", Summary: "Place a legal hold of an amount or a percentage of the balance", Auth: "admin", Request: PlaceLegalHoldRequest{}, Response: LegalHold{}},
+	{Method: "POST", Path: "/admin/accounts/{id}/holds/{holdID}/release", Summary: "Release a legal hold, citing the authorising document", Auth: "admin", Request: ReleaseLegalHoldRequest{}, Response: LegalHold{}},
+	{Method: "GET", Path: "/admin/kyc", Summary: "KYC submissions waiting for review oldest first, ?status= lists verified or rejected ones", Auth: "admin", Response: []KYCSubmission{}},
+	{Method: "POST", Path: "/admin/kyc/{submissionID}/review", Summary: "Verify or reject a KYC submission, rejecting needs a reason", Auth: "admin", Request: ReviewKYCRequest{}, Response: KYCSubmission{}},
+	{Method: "GET", Path: "/admin/disputes", Summary: "Open transfer disputes oldest first, ?status= lists reversed or rejected ones", Auth: "admin", Response: []Dispute{}},
+	{Method: "POST", Path: "/admin/disputes/{disputeID}/resolve", Summary: "Reject a dispute or reverse its transfer with a compensating ledger entry", Auth: "admin", Request: ResolveDisputeRequest{}, Response: Dispute{}},
+	{Method: "POST", Path: "/admin/accounts/{id}/adjustments", Summary: "Manually credit or debit an account, above the threshold this waits for approvals", Auth: "admin", Request: AdjustmentRequest{}, Response: Account{}},
+	{Method: "DELETE", Path: "/admin/exports/{fileName}", Summary: "Request deletion of an export delivery record, runs once approved", Auth: "admin", Response: PendingOperation{}},
+	{Method: "GET", Path: "/admin/eod", Summary: "The last 30 end of day runs with their steps", Auth: "admin", Response: []EODRun{}},
+	{Method: "GET", Path: "/admin/eod/{day}", Summary: "A business day's end of day run and each step's checkpoint", Auth: "admin", Response: EODRun{}},
+	{Method: "POST", Path: "/admin/eod/{day}/run", Summary: "Start or resume a day's end of day run, completed steps aren't repeated", Auth: "admin", Response: EODRun{}},
+	{Method: "POST", Path: "/admin/eod/{day}/steps/{step}/skip", Summary: "Skip a failed or blocked step so the next resume continues past it", Auth: "admin", Request: SkipEODStepRequest{}, Response: EODRun{}},
+	{Method: "GET", Path: "/admin/operations", Summary: "Operations waiting for or holding admin approvals", Auth: "admin", Response: []PendingOperation{}},
+	{Method: "GET", Path: "/admin/operations/{operationID}", Summary: "A pending operation with its signing message and approvals", Auth: "admin", Response: PendingOperation{}},
+	{Method: "POST", Path: "/admin/operations/{operationID}/approve", Summary: "Sign a pending operation, it runs once enough approvers have signed", Auth: "admin", Request: ApproveOperationRequest{}, Response: PendingOperation{}},
+	{Method: "GET", Path: "/admin/accounts/{id}/stream", Summary: "Replay an account's event stream, as of ?at= when given (eventsourced storage only)", Auth: "admin", Response: AccountReplay{}},
+	{Method: "GET", Path: "/admin/accounts/{id}/history", Summary: "Field-level change history of an account", Auth: "admin", Response: []AuditEntry{}},
+	{Method: "GET", Path: "/readyz", Summary: "Readiness, 503 while the database is unreachable, with connection pool stats", Response: ReadyStatus{}},
+	{Method: "GET", Path: "/openapi.json", Summary: "This document", Response: rawSchema{"type": "object"}},
+	{Method: "GET", Path: "/.well-known/jwks.json", Summary: "Public keys that verify issued JWTs, by kid", Response: JWKS{}},
+	{Method: "GET", Path: "/docs", Summary: "Swagger UI", Response: rawSchema{"type": "string", "format": "html"}},
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIDoc  map[string]any
+)
+
+func (s *APIServer) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	openAPIOnce.Do(func() {
+		openAPIDoc = buildOpenAPI(apiOperations)
+	})
+	WriteJSON(w, http.StatusOK, openAPIDoc)
+}
+
+var pathParam = regexp.MustCompile(`\{(\w+)\}`)
+
+func buildOpenAPI(ops []apiOperation) map[string]any {
+	gen := &schemaGenerator{components: map[string]any{}}
+	errorSchema := gen.schema(reflect.TypeOf(ApiError{}))
+
+	paths := map[string]any{}
+	for _, op := range ops {
+		contentType := op.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		operation := map[string]any{
+			"summary": op.Summary,
+			"responses": map[string]any{
+				"200": map[string]any{
+					"description": "OK",
+					"content":     map[string]any{contentType: map[string]any{"schema": gen.valueSchema(op.Response)}},
+				},
+				"default": map[string]any{
+					"description": "Error",
+					"content":     map[string]any{"application/json": map[string]any{"schema": errorSchema}},
+				},
+			},
+		}
+
+		params := []any{}
+		for _, m := range pathParam.FindAllStringSubmatch(op.Path, -1) {
+			// IDs are integers, other parameters such as transfer references are opaque strings
+			paramType := "integer"
+			if !strings.HasSuffix(strings.ToLower(m[1]), "id") {
+				paramType = "string"
+			}
+			params = append(params, map[string]any{
+				"name": m[1], "in": "path", "required": true,
+				"schema": map[string]any{"type": paramType},
+			})
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+
+		if op.Request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{contentType: map[string]any{"schema": gen.valueSchema(op.Request)}},
+			}
+		}
+
+		if op.Auth != "" {
+			// API keys are accepted wherever a JWT or the admin token is
+			operation["security"] = []any{map[string]any{op.Auth: []any{}}, map[string]any{"api_key": []any{}}}
+		}
+
+		item, ok := paths[op.Path].(map[string]any)
+		if !ok {
+			item = map[string]any{}
+			paths[op.Path] = item
+		}
+		item[strings.ToLower(op.Method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "GoBank API",
+			"version":     "1.0.0",
+			"description": "Amounts are JSON numbers unless the request's Content-Type or Accept has the amounts=string parameter, then they're decimal strings like \"10.50\".",
+		},
+		"servers": []any{map[string]any{"url": currentAPIVersion}},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": gen.components,
+			"securitySchemes": map[string]any{
+				"jwt":     map[string]any{"type": "apiKey", "in": "header", "name": "x-jwt-token"},
+				"admin":   map[string]any{"type": "apiKey", "in": "header", "name": "x-admin-token"},
+				"api_key": map[string]any{"type": "apiKey", "in": "header", "name": "x-api-key"},
+			},
+		},
+	}
+}
+
+// schemaGenerator turns Go types into JSON schemas, named structs become components
+type schemaGenerator struct {
+	components map[string]any
+}
+
+func (g *schemaGenerator) valueSchema(v any) any {
+	if raw, ok := v.(rawSchema); ok {
+		return map[string]any(raw)
+	}
+	return g.schema(reflect.TypeOf(v))
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	rawJSONType = reflect.TypeOf(json.RawMessage{})
+)
+
+func (g *schemaGenerator) schema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == rawJSONType:
+		return map[string]any{"type": "object"}
+	case t.Kind() == reflect.String:
+		return map[string]any{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case t.Kind() == reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]any{"type": "number"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case t.Kind() == reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case t.Kind() == reflect.Struct:
+		return g.structSchema(t)
+	}
+
+	// interfaces and anything else accept any value
+	return map[string]any{}
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]any {
+	ref := map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	if _, ok := g.components[t.Name()]; ok {
+		return ref
+	}
+	// Placeholder first so self-referencing types terminate
+	g.components[t.Name()] = map[string]any{}
+
+	properties := map[string]any{}
+	required := []any{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := field.Name
+		if tag, ok := field.Tag.Lookup("json"); ok {
+			name = strings.Split(tag, ",")[0]
+		}
+		if name == "-" {
+			continue
+		}
+		properties[name] = g.schema(field.Type)
+
+		if tag, ok := field.Tag.Lookup("validate"); ok {
+			if applyValidation(properties[name].(map[string]any), tag) {
+				required = append(required, name)
+			}
+		}
+	}
+
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	g.components[t.Name()] = schema
+	return ref
+}
+
+// applyValidation documents validate tag rules on a property schema and
+// reports whether the field is required
+func applyValidation(prop map[string]any, tag string) bool {
+	required := false
+	for _, rule := range strings.Split(tag, ",") {
+		rule, arg, _ := strings.Cut(rule, "=")
+		limit, _ := strconv.ParseFloat(arg, 64)
+		isString := prop["type"] == "string"
+
+		switch {
+		case rule == "required":
+			required = true
+		case rule == "min" && isString:
+			prop["minLength"] = int(limit)
+		case rule == "max" && isString:
+			prop["maxLength"] = int(limit)
+		case rule == "min":
+			prop["minimum"] = limit
+		case rule == "max":
+			prop["maximum"] = limit
+		case rule == "positive":
+			prop["minimum"] = 0
+			prop["exclusiveMinimum"] = true
+		case rule == "numeric":
+			prop["pattern"] = "^[0-9]*$"
+		case rule == "oneof":
+			prop["enum"] = strings.Fields(arg)
+		}
+	}
+	return required
+}
+
+// Swagger UI assets come from the public CDN, only this page is served by gobank
+const docsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>GoBank API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({ url: "/openapi.json", dom_id: "#swagger-ui" });
+  </script>
+</body>
+</html>
+`
+
+func handleDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(docsPage))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAPIDocumentsAllRoutes(t *testing.T) {
+	cfg := &Config{TransferEngine: "balance"}
+	store := newMemoryStorage()
+	engine, err := NewTransferEngine(cfg.TransferEngine, store, cfg)
+	require.Nil(t, err)
+
+	documented := map[string]bool{}
+	for _, op := range apiOperations {
+		documented[op.Method+" "+op.Path] = true
+	}
+
+	router := NewAPIServer(cfg, store).routes(engine)
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || route.GetHandler() == nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		assert.Nil(t, err, "route %s isn't restricted to its methods", path)
+		for _, method := range methods {
+			assert.True(t, documented[method+" "+strings.TrimPrefix(path, currentAPIVersion)], "route %s %s is missing from apiOperations", method, path)
+		}
+		return nil
+	})
+}
+
+func TestBuildOpenAPI(t *testing.T) {
+	doc := buildOpenAPI(apiOperations)
+
+	schemas := doc["components"].(map[string]any)["schemas"].(map[string]any)
+	require.Contains(t, schemas, "Account")
+
+	// Credentials are tagged json:"-" and must never be documented
+	props := schemas["Account"].(map[string]any)["properties"].(map[string]any)
+	assert.NotContains(t, props, "EncryptedPassword")
+	assert.Contains(t, props, "account_number")
+
+	paths := doc["paths"].(map[string]any)
+	accountByID := paths["/account/{id}"].(map[string]any)
+	assert.Contains(t, accountByID, "get")
+	assert.Contains(t, accountByID, "delete")
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Accounts opt into an overdraft by setting a limit, transfers may then take
+// the balance negative down to -limit. While overdrawn, a fee of
+// OverdraftDailyFeeRate on the overdrawn amount is charged once per day and
+// recorded in overdraft_fee. Amounts are in cents like Account.Balance.
+
+type OverdraftFee struct {
+	ID        int       `json:"id"`
+	AccountID int       `json:"account_id"`
+	Amount    int64     `json:"amount"`
+	Overdrawn int64     `json:"overdrawn"`
+	AccruedOn time.Time `json:"accrued_on"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type OverdraftStatus struct {
+	AccountID    int     `json:"account_id"`
+	Limit        int64   `json:"limit"`
+	Balance      int64   `json:"balance"`
+	Used         int64   `json:"used"`
+	Available    int64   `json:"available"`
+	FeesAccrued  int64   `json:"fees_accrued"`
+	DailyFeeRate float64 `json:"daily_fee_rate"`
+}
+
+type SetOverdraftRequest struct {
+	Limit float64 `json:"limit" validate:"min=0"`
+}
+
+type OverdraftService interface {
+	GetStatus(ctx context.Context, accountID int) (*OverdraftStatus, error)
+	SetLimit(ctx context.Context, accountID int, limit float64, actor string) (*OverdraftStatus, error)
+	AccrueFees(ctx context.Context, now time.Time) error
+}
+
+type overdraftService struct {
+	store        Storage
+	maxLimit     int64
+	dailyFeeRate float64
+}
+
+func NewOverdraftService(store Storage, cfg *Config) OverdraftService {
+	return &overdraftService{
+		store:        store,
+		maxLimit:     toCents(cfg.OverdraftMaxLimit),
+		dailyFeeRate: cfg.OverdraftDailyFeeRate,
+	}
+}
+
+func (s *APIServer) overdrafts() OverdraftService {
+	return NewOverdraftService(s.store, s.config)
+}
+
+// overdraftFee is the day's charge for a balance, overdrawn amounts are charged in whole cents
+func overdraftFee(balance int64, dailyRate float64) int64 {
+	return dailyCharge(-balance, dailyRate)
+}
+
+// dailyCharge is a day's accrual at dailyRate on a positive amount, in whole cents
+func dailyCharge(amount int64, dailyRate float64) int64 {
+	if amount <= 0 || dailyRate <= 0 {
+		return 0
+	}
+	return int64(math.Round(float64(amount) * dailyRate))
+}
+
+// accrue totals days of daily charges, each day's charge added to the amount
+// before the next, the way a fee debited from an overdrawn balance grows it
+func accrue(amount int64, dailyRate float64, days int) int64 {
+	var total int64
+	for i := 0; i < days; i++ {
+		total += dailyCharge(amount+total, dailyRate)
+	}
+	return total
+}
+
+func (s *overdraftService) GetStatus(ctx context.Context, accountID int) (*OverdraftStatus, error) {
+	account, err := s.store.GetAccountbyID(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	fees, err := s.store.GetOverdraftFeeTotal(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	used := max(-account.Balance, 0)
+	return &OverdraftStatus{
+		AccountID:    account.ID,
+		Limit:        account.OverdraftLimit,
+		Balance:      account.Balance,
+		Used:         used,
+		Available:    max(account.OverdraftLimit-used, 0),
+		FeesAccrued:  fees,
+		DailyFeeRate: s.dailyFeeRate,
+	}, nil
+}
+
+func (s *overdraftService) SetLimit(ctx context.Context, accountID int, limit float64, actor string) (*OverdraftStatus, error) {
+	cents := toCents(limit)
+	if cents < 0 {
+		return nil, fmt.Errorf("overdraft limit can't be negative")
+	}
+	if cents > s.maxLimit {
+		return nil, fmt.Errorf("overdraft limit can't exceed %.2f", float64(s.maxLimit)/100)
+	}
+
+	before, err := s.store.GetAccountbyID(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if cents > 0 {
+		if err := checkEmailVerified(before); err != nil {
+			return nil, err
+		}
+	}
+	if before.Balance < -cents {
+		return nil, fmt.Errorf("overdraft limit can't be lowered below the overdrawn amount of %.2f", float64(-before.Balance)/100)
+	}
+
+	after := *before
+	after.OverdraftLimit = cents
+	if err := s.store.UpdateAccount(ctx, &after); err != nil {
+		return nil, err
+	}
+	recordAudit(ctx, s.store, actor, accountID, AuditAccountUpdated, diffAccounts(before, &after))
+
+	return s.GetStatus(ctx, accountID)
+}
+
+// AccrueFees charges the day's fee to every overdrawn account. Each account
+// is charged at most once per UTC day, so reruns and other instances are safe.
+func (s *overdraftService) AccrueFees(ctx context.Context, now time.Time) error {
+	accounts, err := s.store.GetOverdrawnAccounts(ctx)
+	if err != nil {
+		return err
+	}
+	setJobQueueDepth("overdraft_fees", len(accounts))
+
+	day := startOfDay(now)
+	for _, account := range accounts {
+		if err := s.chargeFee(ctx, account, day, now); err != nil {
+			log.Printf("Failed to charge overdraft fee to account %d: %v", account.ID, err)
+		}
+	}
+	return nil
+}
+
+func (s *overdraftService) chargeFee(ctx context.Context, account *Account, day, now time.Time) error {
+	amount := overdraftFee(account.Balance, s.dailyFeeRate)
+	if amount == 0 {
+		return nil
+	}
+
+	tx, err := s.store.BeginTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	charged, err := s.store.RecordOverdraftFee(ctx, &OverdraftFee{
+		AccountID: account.ID,
+		Amount:    amount,
+		Overdrawn: -account.Balance,
+		AccruedOn: day,
+		CreatedAt: now,
+	}, tx)
+	if err != nil || !charged {
+		return err
+	}
+
+	entry := newLedgerEntry(ctx, "overdraft_fee").
+		account(account, -amount).
+		ledger(LedgerOverdraftFees, account.Currency, amount)
+	if err := s.store.PostLedgerEntry(ctx, entry, tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	auditBalanceChange(ctx, s.store, "overdraft-fees", account, -amount)
+	return nil
+}
+
+func (s *APIServer) overdraftFeeJob() Job {
+	return Job{
+		Name:     "overdraft-fees",
+		Interval: s.config.SchedulerInterval,
+		Run: func(ctx context.Context) error {
+			return s.overdrafts().AccrueFees(ctx, time.Now().UTC())
+		},
+	}
+}
+
+// GET /account/{id}/overdraft
+func (s *APIServer) handleGetOverdraft(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	status, err := s.overdrafts().GetStatus(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, status)
+}
+
+// PUT /account/{id}/overdraft
+func (s *APIServer) handleSetOverdraft(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	var req SetOverdraftRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+
+	status, err := s.overdrafts().SetLimit(r.Context(), id, req.Limit, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, status)
+}
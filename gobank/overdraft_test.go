@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverdraft(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	from := &Account{Number: 2001, Balance: 1000, Currency: "USD"}
+	to := &Account{Number: 2002, Currency: "USD"}
+	require.Nil(t, store.CreateAccount(ctx, from))
+	require.Nil(t, store.CreateAccount(ctx, to))
+
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	transfers := NewTransferService(store, TransferLimits{}, staticRateProvider{}, nil, nil)
+	overdrafts := NewOverdraftService(store, &Config{OverdraftMaxLimit: 100, OverdraftDailyFeeRate: 0.01})
+
+	transfer := func(amount float64) error {
+		_, _, err := transfers.Transfer(ctx, TransferRequest{FromAccountNumber: 2001, ToAccountNumber: 2002, Amount: amount}, engine, "test")
+		return err
+	}
+
+	assert.ErrorIs(t, transfer(30), ErrInsufficientFunds)
+
+	_, err = overdrafts.SetLimit(ctx, from.ID, 150, "test")
+	assert.Error(t, err)
+	_, err = overdrafts.SetLimit(ctx, from.ID, 50, "test")
+	require.Nil(t, err)
+
+	require.Nil(t, transfer(30))
+	assert.ErrorIs(t, transfer(40.01), ErrInsufficientFunds)
+
+	// Can't opt out while overdrawn
+	_, err = overdrafts.SetLimit(ctx, from.ID, 0, "test")
+	assert.Error(t, err)
+
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	require.Nil(t, overdrafts.AccrueFees(ctx, now))
+	require.Nil(t, overdrafts.AccrueFees(ctx, now.Add(time.Hour)))
+
+	status, err := overdrafts.GetStatus(ctx, from.ID)
+	require.Nil(t, err)
+	assert.Equal(t, int64(-2020), status.Balance)
+	assert.Equal(t, int64(20), status.FeesAccrued)
+	assert.Equal(t, int64(2020), status.Used)
+	assert.Equal(t, int64(2980), status.Available)
+}
+
+func TestOverdraftFee(t *testing.T) {
+	assert.Equal(t, int64(0), overdraftFee(100, 0.01))
+	assert.Equal(t, int64(0), overdraftFee(-100, 0))
+	assert.Equal(t, int64(1), overdraftFee(-100, 0.01))
+	assert.Equal(t, int64(3), overdraftFee(-6000, 0.0005))
+}
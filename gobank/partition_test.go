@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// partitionedStorage simulates the connection dropping during Commit. Both
+// balance updates have executed inside the transaction by then, Commit
+// returns an error either way but the changes are only applied when
+// commitApplies is set, which is the server committing before the
+// acknowledgement got lost.
+type partitionedStorage struct {
+	*memoryStorage
+
+	commitApplies bool
+	lookupsFail   bool // the partition outlasts the commit
+}
+
+type faultyTx struct {
+	Transaction
+	applies bool
+}
+
+func (tx *faultyTx) Commit() error {
+	if tx.applies {
+		if err := tx.Transaction.Commit(); err != nil {
+			return err
+		}
+	} else {
+		tx.Transaction.Rollback()
+	}
+	return errors.New("read tcp: connection reset by peer")
+}
+
+func (s *partitionedStorage) BeginTransaction(ctx context.Context) (Transaction, error) {
+	tx, err := s.memoryStorage.BeginTransaction(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyTx{Transaction: tx, applies: s.commitApplies}, nil
+}
+
+// The memory store only defers writes made on its own transaction type
+func (s *partitionedStorage) PostLedgerEntry(ctx context.Context, entry *LedgerEntry, tx Transaction) error {
+	return s.memoryStorage.PostLedgerEntry(ctx, entry, unwrapTx(tx))
+}
+
+func (s *partitionedStorage) RecordTransfer(ctx context.Context, fromAccountID, toAccountID int, conv Conversion, tx Transaction) error {
+	return s.memoryStorage.RecordTransfer(ctx, fromAccountID, toAccountID, conv, unwrapTx(tx))
+}
+
+func unwrapTx(tx Transaction) Transaction {
+	if faulty, ok := tx.(*faultyTx); ok {
+		return faulty.Transaction
+	}
+	return tx
+}
+
+func (s *partitionedStorage) GetTransferReceipt(ctx context.Context, reference string) (*TransferReceipt, error) {
+	if s.lookupsFail {
+		return nil, fmt.Errorf("dial tcp: i/o timeout")
+	}
+	return s.memoryStorage.GetTransferReceipt(ctx, reference)
+}
+
+func TestTransferCommitPartition(t *testing.T) {
+	ctx := context.Background()
+
+	setup := func(commitApplies, lookupsFail bool) (*partitionedStorage, func() (*TransferReceipt, error)) {
+		store := &partitionedStorage{memoryStorage: newMemoryStorage(), commitApplies: commitApplies, lookupsFail: lookupsFail}
+		require.Nil(t, store.CreateAccount(ctx, &Account{Number: 8001, Balance: 10000, Currency: "USD"}))
+		require.Nil(t, store.CreateAccount(ctx, &Account{Number: 8002, Currency: "USD"}))
+
+		engine, err := NewTransferEngine("balance", store, &Config{})
+		require.Nil(t, err)
+		transfers := NewTransferService(store, TransferLimits{}, staticRateProvider{}, nil, nil)
+		return store, func() (*TransferReceipt, error) {
+			receipt, _, err := transfers.Transfer(ctx, TransferRequest{FromAccountNumber: 8001, ToAccountNumber: 8002, Amount: 25}, engine, "test")
+			return receipt, err
+		}
+	}
+
+	balances := func(store *partitionedStorage) (int64, int64) {
+		from, _ := store.GetAccountByNumber(ctx, 8001)
+		to, _ := store.GetAccountByNumber(ctx, 8002)
+		// Money is never created or destroyed, whatever Commit did
+		require.Equal(t, int64(10000), from.Balance+to.Balance)
+		return from.Balance, to.Balance
+	}
+
+	t.Run("commit lost before it applied", func(t *testing.T) {
+		store, transfer := setup(false, false)
+
+		_, err := transfer()
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, ErrTransferUnconfirmed)
+		from, _ := balances(store)
+		assert.Equal(t, int64(10000), from)
+		assert.Empty(t, store.transfers)
+
+		// Nothing happened, so retrying is safe
+		store.commitApplies = true
+		_, err = transfer()
+		require.Nil(t, err)
+		from, _ = balances(store)
+		assert.Equal(t, int64(7500), from)
+	})
+
+	t.Run("acknowledgement lost after commit", func(t *testing.T) {
+		store, transfer := setup(true, false)
+
+		receipt, err := transfer()
+		require.Nil(t, err)
+		from, to := balances(store)
+		assert.Equal(t, int64(7500), from)
+		assert.Equal(t, int64(2500), to)
+
+		stored, err := store.GetTransferReceipt(ctx, receipt.Reference)
+		require.Nil(t, err)
+		assert.Equal(t, receipt.Reference, stored.Reference)
+	})
+
+	t.Run("outcome unknown until the partition heals", func(t *testing.T) {
+		store, transfer := setup(true, true)
+
+		_, err := transfer()
+		require.ErrorIs(t, err, ErrTransferUnconfirmed)
+		require.Len(t, store.transfers, 1)
+		reference := store.transfers[0].reference
+		assert.Contains(t, err.Error(), reference)
+
+		status, apiErr := apiErrorFor(err)
+		assert.Equal(t, 503, status)
+		assert.Equal(t, "TRANSFER_UNCONFIRMED", apiErr.Code)
+
+		// Reconciling by reference shows it went through exactly once
+		store.lookupsFail = false
+		_, err = store.GetTransferReceipt(ctx, reference)
+		require.Nil(t, err)
+		from, _ := balances(store)
+		assert.Equal(t, int64(7500), from)
+	})
+}
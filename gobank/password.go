@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Passwords are hashed with bcrypt or Argon2id, picked by PASSWORD_HASH.
+// Hashes describe how they were made, bcrypt's carry their cost and
+// Argon2id's are PHC strings like $argon2id$v=19$m=65536,t=3,p=2$salt$key,
+// so any stored hash can be verified whatever the current settings. A login
+// whose hash used another algorithm or weaker parameters than configured
+// stores a fresh one, raising the cost takes effect as people log in.
+
+const (
+	PasswordBcrypt   = "bcrypt"
+	PasswordArgon2id = "argon2id"
+
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// Argon2Params are the Argon2id cost settings, Memory is in KiB
+type Argon2Params struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+type PasswordHasher struct {
+	Algorithm  string
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+// passwords hashes every new password, main configures it from the environment
+var passwords = &PasswordHasher{
+	Algorithm:  PasswordBcrypt,
+	BcryptCost: bcrypt.DefaultCost,
+	Argon2:     Argon2Params{Memory: 64 * 1024, Time: 3, Threads: 2},
+}
+
+func NewPasswordHasher(cfg *Config) (*PasswordHasher, error) {
+	h := &PasswordHasher{
+		Algorithm:  cfg.PasswordHash,
+		BcryptCost: cfg.BcryptCost,
+		Argon2: Argon2Params{
+			Memory:  uint32(cfg.Argon2Memory),
+			Time:    uint32(cfg.Argon2Time),
+			Threads: uint8(cfg.Argon2Threads),
+		},
+	}
+
+	switch h.Algorithm {
+	case PasswordBcrypt:
+		if h.BcryptCost < bcrypt.MinCost || h.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("BCRYPT_COST must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case PasswordArgon2id:
+		if cfg.Argon2Memory < 8*cfg.Argon2Threads || cfg.Argon2Time < 1 || cfg.Argon2Threads < 1 || cfg.Argon2Threads > 255 {
+			return nil, fmt.Errorf("ARGON2_TIME and ARGON2_THREADS must be positive and ARGON2_MEMORY at least 8 KiB per thread")
+		}
+	default:
+		return nil, fmt.Errorf("unknown password hash %q", h.Algorithm)
+	}
+	return h, nil
+}
+
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	if h.Algorithm != PasswordArgon2id {
+		encpw, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		return string(encpw), err
+	}
+
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	p := h.Argon2
+	key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify checks password against a hash made with either algorithm
+func (h *PasswordHasher) Verify(hash, password string) bool {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	p, salt, key, err := parseArgon2Hash(hash)
+	if err != nil {
+		return false
+	}
+	got := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(got, key) == 1
+}
+
+// NeedsRehash is true for hashes from the other algorithm or with weaker
+// parameters than configured, stronger ones are left alone
+func (h *PasswordHasher) NeedsRehash(hash string) bool {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		if h.Algorithm != PasswordBcrypt {
+			return true
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost < h.BcryptCost
+	}
+
+	if h.Algorithm != PasswordArgon2id {
+		return true
+	}
+	p, _, key, err := parseArgon2Hash(hash)
+	if err != nil {
+		return true
+	}
+	return p.Memory < h.Argon2.Memory || p.Time < h.Argon2.Time || p.Threads < h.Argon2.Threads || len(key) < argon2KeyLength
+}
+
+func parseArgon2Hash(hash string) (p Argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != PasswordArgon2id {
+		return p, nil, nil, fmt.Errorf("malformed argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, fmt.Errorf("malformed argon2id parameters: %v", err)
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return p, nil, nil, err
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return p, nil, nil, err
+	}
+	return p, salt, key, nil
+}
+
+// rehashPassword replaces a hash that NeedsRehash after a successful login.
+// Failing only means the old hash is kept until next time.
+func (s *accountService) rehashPassword(ctx context.Context, acc *Account, password string) {
+	encpw, err := passwords.Hash(password)
+	if err == nil {
+		err = s.store.RehashPassword(ctx, acc.ID, acc.EncryptedPassword, encpw)
+	}
+	if err != nil {
+		log.Printf("Failed to rehash the password of account %d: %v", acc.ID, err)
+		return
+	}
+	acc.EncryptedPassword = encpw
+}
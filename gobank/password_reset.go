@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// A forgotten password is replaced through a single-use token sent to the
+// account holder with the configured Notifier. Only the token's SHA-256 is
+// stored, it expires after PasswordResetTTL and requesting a new one voids
+// any earlier token for the account.
+
+const AuditPasswordReset = "account.password_reset"
+
+const minPasswordLength = 8
+
+type PasswordReset struct {
+	ID        int
+	AccountID int
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+type ForgotPasswordRequest struct {
+	Number int64 `json:"number" validate:"required,positive"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,max=72"`
+}
+
+type PasswordResetService interface {
+	Forgot(ctx context.Context, number int64) error
+	Reset(ctx context.Context, token, password string) error
+}
+
+type passwordResetService struct {
+	store    Storage
+	notifier Notifier
+	ttl      time.Duration
+}
+
+func NewPasswordResetService(store Storage, notifier Notifier, ttl time.Duration) PasswordResetService {
+	return &passwordResetService{store: store, notifier: notifier, ttl: ttl}
+}
+
+func (s *APIServer) passwordResets() PasswordResetService {
+	return NewPasswordResetService(s.store, s.notifier, s.config.PasswordResetTTL)
+}
+
+func newResetToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Forgot doesn't reveal whether the account exists, unknown and unusable
+// accounts are only logged
+func (s *passwordResetService) Forgot(ctx context.Context, number int64) error {
+	acc, err := s.store.GetAccountByNumber(ctx, number)
+	if err != nil {
+		log.Printf("Password reset requested for unknown account number %d", number)
+		return nil
+	}
+	if err := checkAccountUsable(acc); err != nil {
+		log.Printf("Password reset refused for account %d: %v", acc.ID, err)
+		return nil
+	}
+
+	now := time.Now().UTC()
+	token := newResetToken()
+	reset := &PasswordReset{
+		AccountID: acc.ID,
+		TokenHash: hashResetToken(token),
+		ExpiresAt: now.Add(s.ttl),
+		CreatedAt: now,
+	}
+	if err := s.store.CreatePasswordReset(ctx, reset); err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("Use this token to reset your password, it expires in %s: %s", s.ttl, token)
+	if err := s.notifier.Notify(acc.ID, "Password reset", message); err != nil {
+		log.Printf("Failed to send password reset to account %d: %v", acc.ID, err)
+	}
+	return nil
+}
+
+func (s *passwordResetService) Reset(ctx context.Context, token, password string) error {
+	if len(password) < minPasswordLength {
+		return invalidField("password", "min", fmt.Sprintf("must be at least %d characters", minPasswordLength))
+	}
+
+	now := time.Now().UTC()
+	reset, err := s.store.GetPasswordReset(ctx, hashResetToken(token))
+	if err != nil {
+		return err
+	}
+	if reset.UsedAt != nil || !now.Before(reset.ExpiresAt) {
+		return ErrInvalidResetToken
+	}
+
+	encpw, err := passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	// Fails with ErrInvalidResetToken if a concurrent reset used the token first
+	if err := s.store.ResetPassword(ctx, reset.ID, encpw, now); err != nil {
+		return err
+	}
+
+	recordAudit(ctx, s.store, "password-reset", reset.AccountID, AuditPasswordReset, []FieldChange{})
+	return nil
+}
+
+// POST /password/forgot
+func (s *APIServer) handleForgotPassword(w http.ResponseWriter, r *http.Request) error {
+	var req ForgotPasswordRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+
+	if err := s.forRequest(r).passwordResets().Forgot(r.Context(), req.Number); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusAccepted, map[string]string{"status": "if the account exists, a reset token has been sent"})
+}
+
+// POST /password/reset
+func (s *APIServer) handleResetPassword(w http.ResponseWriter, r *http.Request) error {
+	var req ResetPasswordRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+
+	if err := s.forRequest(r).passwordResets().Reset(r.Context(), req.Token, req.Password); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, map[string]string{"status": "password updated"})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type capturingNotifier struct {
+	messages []string
+}
+
+func (n *capturingNotifier) Notify(accountID int, subject, message string) error {
+	n.messages = append(n.messages, message)
+	return nil
+}
+
+func TestPasswordReset(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	acc, err := NewAccount("Grace", "Hopper", "old-password")
+	require.Nil(t, err)
+	require.Nil(t, store.CreateAccount(ctx, acc))
+
+	notifier := &capturingNotifier{}
+	resets := NewPasswordResetService(store, notifier, time.Minute)
+	token := func() string {
+		require.NotEmpty(t, notifier.messages)
+		return regexp.MustCompile(`[0-9a-f]{64}`).FindString(notifier.messages[len(notifier.messages)-1])
+	}
+
+	// Unknown accounts look the same to the caller but nothing is sent
+	require.Nil(t, resets.Forgot(ctx, acc.Number+1))
+	assert.Empty(t, notifier.messages)
+
+	require.Nil(t, resets.Forgot(ctx, acc.Number))
+	first := token()
+	require.Nil(t, resets.Forgot(ctx, acc.Number))
+	second := token()
+	assert.NotEqual(t, hashResetToken(second), store.resets[0].TokenHash)
+
+	// Only the newest token works, and only once
+	assert.ErrorIs(t, resets.Reset(ctx, first, "new-password"), ErrInvalidResetToken)
+	assert.Error(t, resets.Reset(ctx, second, "short"))
+	require.Nil(t, resets.Reset(ctx, second, "new-password"))
+	assert.ErrorIs(t, resets.Reset(ctx, second, "newer-password"), ErrInvalidResetToken)
+
+	stored, _ := store.GetAccountbyID(ctx, acc.ID)
+	assert.True(t, stored.ValidatePassword("new-password"))
+	assert.Len(t, store.audit, 1)
+
+	// Expired tokens are refused
+	expiring := NewPasswordResetService(store, notifier, -time.Second)
+	require.Nil(t, expiring.Forgot(ctx, acc.Number))
+	assert.ErrorIs(t, resets.Reset(ctx, token(), "new-password"), ErrInvalidResetToken)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordHasher(t *testing.T) {
+	_, err := NewPasswordHasher(&Config{PasswordHash: "md5"})
+	assert.NotNil(t, err)
+
+	weak := &PasswordHasher{Algorithm: PasswordArgon2id, Argon2: Argon2Params{Memory: 1024, Time: 1, Threads: 1}}
+	hash, err := weak.Hash("correct horse")
+	require.Nil(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$"))
+	assert.True(t, weak.Verify(hash, "correct horse"))
+	assert.False(t, weak.Verify(hash, "wrong horse"))
+	assert.False(t, weak.NeedsRehash(hash))
+
+	strong := &PasswordHasher{Algorithm: PasswordArgon2id, Argon2: Argon2Params{Memory: 2048, Time: 1, Threads: 1}}
+	assert.True(t, strong.Verify(hash, "correct horse"), "older parameters still verify")
+	assert.True(t, strong.NeedsRehash(hash))
+
+	bcrypted, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	require.Nil(t, err)
+	assert.True(t, strong.Verify(string(bcrypted), "correct horse"))
+	assert.True(t, strong.NeedsRehash(string(bcrypted)))
+	assert.True(t, (&PasswordHasher{Algorithm: PasswordBcrypt, BcryptCost: bcrypt.MinCost + 1}).NeedsRehash(string(bcrypted)))
+	assert.False(t, (&PasswordHasher{Algorithm: PasswordBcrypt, BcryptCost: bcrypt.MinCost}).NeedsRehash(string(bcrypted)))
+	assert.True(t, (&PasswordHasher{Algorithm: PasswordBcrypt, BcryptCost: bcrypt.MinCost}).NeedsRehash(hash))
+}
+
+func TestLoginRehashesPassword(t *testing.T) {
+	t.Setenv("JWT_SECRET", "rehash-secret")
+	ctx := context.Background()
+	store := newMemoryStorage()
+	acc, err := NewAccount("Ada", "Lovelace", "correct horse")
+	require.Nil(t, err)
+	require.Nil(t, store.CreateAccount(ctx, acc))
+
+	previous := passwords
+	passwords = &PasswordHasher{Algorithm: PasswordArgon2id, Argon2: Argon2Params{Memory: 1024, Time: 1, Threads: 1}}
+	t.Cleanup(func() { passwords = previous })
+
+	_, err = NewAccountService(store).Login(ctx, LoginRequest{Number: acc.Number, Password: "correct horse"})
+	require.Nil(t, err)
+	stored, err := store.GetAccountbyID(ctx, acc.ID)
+	require.Nil(t, err)
+	assert.True(t, strings.HasPrefix(stored.EncryptedPassword, "$argon2id$"))
+	assert.True(t, stored.ValidatePassword("correct horse"))
+}
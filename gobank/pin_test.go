@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransactionPIN(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	acc, err := NewAccount("Pat", "Pin", "password")
+	require.Nil(t, err)
+	acc.Number, acc.Balance, acc.EmailVerified = 9911, 100000, true
+	require.Nil(t, store.CreateAccount(ctx, acc))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9912, Currency: "USD"}))
+
+	s := NewAPIServer(&Config{TransactionPINThreshold: 100, PINMaxAttempts: 2, PINLockout: time.Hour}, store)
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	transfer := func(amount float64, pin string) error {
+		_, _, err := s.transfers().Transfer(ctx, TransferRequest{FromAccountNumber: 9911, ToAccountNumber: 9912, Amount: amount, PIN: pin}, engine, "account:9911")
+		return err
+	}
+
+	require.Nil(t, transfer(100, ""), "at the threshold no PIN is needed")
+	assert.ErrorIs(t, transfer(101, "1234"), ErrPINNotSet)
+
+	var verr *ValidationError
+	assert.ErrorAs(t, s.accounts().SetPIN(ctx, acc.ID, SetPINRequest{PIN: "1234", Password: "wrong"}, "account:9911"), &verr)
+	require.Nil(t, s.accounts().SetPIN(ctx, acc.ID, SetPINRequest{PIN: "1234", Password: "password"}, "account:9911"))
+
+	assert.ErrorIs(t, transfer(150, ""), ErrPINRequired)
+	require.Nil(t, transfer(150, "1234"))
+
+	// A success in between starts the count over, two failures in a row lock the PIN
+	assert.ErrorIs(t, transfer(150, "0000"), ErrInvalidPIN)
+	require.Nil(t, transfer(150, "1234"))
+	assert.ErrorIs(t, transfer(150, "0000"), ErrInvalidPIN)
+	assert.ErrorIs(t, transfer(150, "0000"), ErrPINLocked)
+	assert.ErrorIs(t, transfer(150, "1234"), ErrPINLocked)
+	require.Nil(t, transfer(20, ""), "small transfers aren't locked out")
+	assert.Equal(t, int64(100000-10000-30000-2000), store.accounts[1].Balance)
+
+	// Setting the PIN again lifts the lockout
+	require.Nil(t, s.accounts().SetPIN(ctx, acc.ID, SetPINRequest{PIN: "4321", Password: "password"}, "account:9911"))
+	require.Nil(t, transfer(150, "4321"))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	_ "time/tzdata" // timezones resolve on hosts without a zoneinfo database
+)
+
+// Account holders' preferences, one row per account in account_preferences.
+// Accounts without a row have every preference at its default: statements
+// by email off, notifications on, timezone UTC. The timezone is an IANA
+// name such as "Europe/Berlin", daily transfer limits reset and monthly
+// statements are cut at midnight in it.
+
+const AuditPreferencesUpdated = "account.preferences_updated"
+
+type AccountPreferences struct {
+	AccountID      int       `json:"account_id"`
+	StatementEmail bool      `json:"statement_email"` // monthly statement mailed to the verified email
+	Timezone       string    `json:"timezone"`
+	UpdatedAt      time.Time `json:"updated_at,omitempty"`
+
+	// Which in-app notifications are raised, see notifications.go
+	NotifyLargeTransfers bool `json:"notify_large_transfers"`
+	NotifyLowBalance     bool `json:"notify_low_balance"`
+	NotifyNewLogins      bool `json:"notify_new_logins"`
+}
+
+func defaultPreferences(accountID int) *AccountPreferences {
+	return &AccountPreferences{AccountID: accountID, NotifyLargeTransfers: true, NotifyLowBalance: true, NotifyNewLogins: true, Timezone: "UTC"}
+}
+
+// Location is the account's timezone, UTC when it has none
+func (p *AccountPreferences) Location() *time.Location {
+	if loc, err := loadTimezone(p.Timezone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+// loadTimezone accepts IANA names only, not the server's "Local"
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "" || name == "Local" {
+		return nil, fmt.Errorf("unknown timezone %q", name)
+	}
+	return time.LoadLocation(name)
+}
+
+// accountLocation loads the timezone from the account's preferences
+func accountLocation(ctx context.Context, store Storage, accountID int) (*time.Location, error) {
+	prefs, err := store.GetPreferences(ctx, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the timezone of account %d: %v", accountID, err)
+	}
+	return prefs.Location(), nil
+}
+
+// UpdatePreferencesRequest leaves preferences that aren't sent unchanged
+type UpdatePreferencesRequest struct {
+	StatementEmail       *bool   `json:"statement_email"`
+	NotifyLargeTransfers *bool   `json:"notify_large_transfers"`
+	NotifyLowBalance     *bool   `json:"notify_low_balance"`
+	NotifyNewLogins      *bool   `json:"notify_new_logins"`
+	Timezone             *string `json:"timezone"`
+}
+
+func (s *accountService) GetPreferences(ctx context.Context, id int) (*AccountPreferences, error) {
+	if _, err := s.store.GetAccountbyID(ctx, id); err != nil {
+		return nil, err
+	}
+	return s.store.GetPreferences(ctx, id)
+}
+
+func (s *accountService) UpdatePreferences(ctx context.Context, id int, req UpdatePreferencesRequest, actor string) (*AccountPreferences, error) {
+	prefs, err := s.GetPreferences(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []FieldChange{}
+	if req.Timezone != nil && *req.Timezone != prefs.Timezone {
+		if _, err := loadTimezone(*req.Timezone); err != nil {
+			return nil, invalidField("timezone", "timezone", "must be an IANA timezone such as Europe/Berlin")
+		}
+		changes = append(changes, FieldChange{Field: "timezone", Old: prefs.Timezone, New: *req.Timezone})
+		prefs.Timezone = *req.Timezone
+	}
+	for _, p := range []struct {
+		field string
+		value *bool
+		pref  *bool
+	}{
+		{"statement_email", req.StatementEmail, &prefs.StatementEmail},
+		{"notify_large_transfers", req.NotifyLargeTransfers, &prefs.NotifyLargeTransfers},
+		{"notify_low_balance", req.NotifyLowBalance, &prefs.NotifyLowBalance},
+		{"notify_new_logins", req.NotifyNewLogins, &prefs.NotifyNewLogins},
+	} {
+		if p.value != nil && *p.value != *p.pref {
+			changes = append(changes, FieldChange{Field: p.field, Old: strconv.FormatBool(*p.pref), New: strconv.FormatBool(*p.value)})
+			*p.pref = *p.value
+		}
+	}
+	if len(changes) == 0 {
+		return prefs, nil
+	}
+
+	prefs.UpdatedAt = time.Now().UTC()
+	if err := s.store.SavePreferences(ctx, prefs); err != nil {
+		return nil, err
+	}
+	recordAudit(ctx, s.store, actor, id, AuditPreferencesUpdated, changes)
+	return prefs, nil
+}
+
+// GET /account/{id}/preferences
+func (s *APIServer) handleGetPreferences(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	prefs, err := s.forRequest(r).accounts().GetPreferences(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, prefs)
+}
+
+// PATCH /account/{id}/preferences
+func (s *APIServer) handleUpdatePreferences(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	s = s.forRequest(r)
+
+	var req UpdatePreferencesRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+	prefs, err := s.accounts().UpdatePreferences(r.Context(), id, req, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, prefs)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// The queries every transfer and login runs are prepared once at startup,
+// after the schema is verified. database/sql prepares them again on each
+// pooled connection the first time they run there, from then on Postgres
+// only binds and executes. Prepared statements can't carry the request ID
+// comment, inside transactions it's still in application_name. Setting
+// DB_PREPARE_STATEMENTS=false goes back to tagged, re-parsed queries.
+
+const (
+	accountByIDQuery     = "SELECT " + accountColumns + " FROM account WHERE id = $1"
+	accountByNumberQuery = "SELECT " + accountColumns + " FROM account WHERE account_number = $1"
+
+	insertAccountQuery = `insert into account
+	(first_name, last_name, account_number, encrypted_password, balance, currency, status, overdraft_limit, email, last_activity_at, created_at)
+	values ($1, $2, $3, $4, $5, $6, $7, $8, nullif($9, ''), $10, $11)
+	returning id`
+
+	updateBalanceQuery = "UPDATE account SET balance = balance + $1, version = version + 1 WHERE id = $2 AND version = $3"
+
+	// Transaction only runs statements, so the entry and its postings go in one
+	insertLedgerEntryQuery = `with entry as (
+		insert into ledger_entry (kind, reference, memo, category, created_at)
+		values ($1, nullif($2, '')::uuid, nullif($3, ''), nullif($4, ''), $5) returning id
+	)
+	insert into postings (entry_id, account_id, ledger_account, currency, amount)
+	select entry.id, nullif(p.account_id, 0), nullif(p.ledger_account, ''), p.currency, p.amount
+	from entry, unnest($6::int[], $7::text[], $8::text[], $9::bigint[]) as p(account_id, ledger_account, currency, amount)`
+
+	insertTransferQuery = `insert into transfer
+	(from_account_id, to_account_id, amount, currency, converted_amount, to_currency, fx_rate, kind, reference, created_at)
+	values ($1, $2, $3, $4, $5, $6, $7, $8, nullif($9, '')::uuid, $10)`
+
+	insertAuditQuery = `insert into audit_log (account_id, actor, action, changes, created_at)
+	values ($1, $2, $3, $4, $5)`
+
+	touchActivityQuery = `UPDATE account
+	SET last_activity_at = greatest(last_activity_at, $1), dormancy_notified_at = NULL WHERE id = $2`
+)
+
+var preparedQueries = []string{
+	accountByIDQuery,
+	accountByNumberQuery,
+	insertAccountQuery,
+	updateBalanceQuery,
+	insertLedgerEntryQuery,
+	insertTransferQuery,
+	insertAuditQuery,
+	touchActivityQuery,
+}
+
+// PrepareStatements prepares preparedQueries, the tables have to exist
+func (s *PostgresStorage) PrepareStatements(ctx context.Context) error {
+	stmts := make(map[string]*sql.Stmt, len(preparedQueries))
+	for _, query := range preparedQueries {
+		stmt, err := s.db.PrepareContext(ctx, query)
+		if err != nil {
+			for _, prepared := range stmts {
+				prepared.Close()
+			}
+			return fmt.Errorf("failed to prepare %q: %v", query, err)
+		}
+		stmts[query] = stmt
+	}
+	s.stmts = stmts
+	return nil
+}
+
+// txStatementer is a *sql.Tx, directly or wrapped
+type txStatementer interface {
+	StmtContext(ctx context.Context, stmt *sql.Stmt) *sql.Stmt
+}
+
+// preparedStmt returns query's prepared statement for use on the pool or
+// inside on, nil when it isn't prepared or on is a transaction of another
+// backend
+func (s *PostgresStorage) preparedStmt(ctx context.Context, on any, query string) *sql.Stmt {
+	stmt, ok := s.stmts[query]
+	if !ok {
+		return nil
+	}
+	switch on := on.(type) {
+	case nil, *sql.DB:
+		return stmt
+	case txStatementer:
+		return on.StmtContext(ctx, stmt)
+	}
+	return nil
+}
+
+// exec runs query on the pool without tx, inside it otherwise
+func (s *PostgresStorage) exec(ctx context.Context, tx Transaction, query string, args ...any) (sql.Result, error) {
+	if stmt := s.preparedStmt(ctx, tx, query); stmt != nil {
+		return stmt.ExecContext(ctx, args...)
+	}
+	if tx != nil {
+		return tx.ExecContext(ctx, s.tagQuery(query), args...)
+	}
+	return s.db.ExecContext(ctx, s.tagQuery(query), args...)
+}
+
+func (s *PostgresStorage) queryRow(ctx context.Context, q rowQueryer, query string, args ...any) *sql.Row {
+	if stmt := s.preparedStmt(ctx, q, query); stmt != nil {
+		return stmt.QueryRowContext(ctx, args...)
+	}
+	return q.QueryRowContext(ctx, s.tagQuery(query), args...)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingDriver accepts any statement and counts how often each is prepared
+type countingDriver struct {
+	mu       sync.Mutex
+	prepares map[string]int
+}
+
+func (d *countingDriver) Open(name string) (driver.Conn, error) {
+	return &countingConn{d}, nil
+}
+
+func (d *countingDriver) count(query string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.prepares[query]
+}
+
+type countingConn struct{ d *countingDriver }
+
+func (c *countingConn) Prepare(query string) (driver.Stmt, error) {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	c.d.prepares[query]++
+	return countingStmt{}, nil
+}
+
+func (c *countingConn) Close() error              { return nil }
+func (c *countingConn) Begin() (driver.Tx, error) { return countingTx{}, nil }
+
+type countingStmt struct{}
+
+func (countingStmt) Close() error  { return nil }
+func (countingStmt) NumInput() int { return -1 }
+func (countingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+func (countingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, driver.ErrSkip
+}
+
+type countingTx struct{}
+
+func (countingTx) Commit() error   { return nil }
+func (countingTx) Rollback() error { return nil }
+
+var registerCountingDriver sync.Once
+
+func TestPreparedStatements(t *testing.T) {
+	ctx := context.Background()
+	d := &countingDriver{prepares: map[string]int{}}
+	registerCountingDriver.Do(func() { sql.Register("counting", d) })
+	db, err := sql.Open("counting", "")
+	require.Nil(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	s := &PostgresStorage{db: db}
+	require.Nil(t, s.PrepareStatements(ctx))
+	for _, query := range preparedQueries {
+		assert.Equal(t, 1, d.count(query))
+	}
+
+	// Reused on the pool and inside transactions
+	require.Nil(t, s.TouchAccountActivity(ctx, 1, time.Now()))
+	require.Nil(t, s.TouchAccountActivity(ctx, 2, time.Now()))
+	tx, err := s.BeginTransaction(ctx)
+	require.Nil(t, err)
+	_, err = s.exec(ctx, tx, updateBalanceQuery, 100, 1, 1)
+	require.Nil(t, err)
+	require.Nil(t, tx.Commit())
+	assert.Equal(t, 1, d.count(touchActivityQuery))
+	assert.Equal(t, 1, d.count(updateBalanceQuery))
+
+	// Without prepared statements queries are tagged and parsed every time
+	unprepared := (&PostgresStorage{db: db}).WithRequestID("req-1").(*PostgresStorage)
+	require.Nil(t, unprepared.TouchAccountActivity(ctx, 1, time.Now()))
+	require.Nil(t, unprepared.TouchAccountActivity(ctx, 1, time.Now()))
+	tagged := "/* request_id=req-1 */ " + touchActivityQuery
+	assert.Equal(t, 2, d.count(tagged))
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type RateLimit struct {
+	Rate  float64 // tokens refilled per second
+	Burst int     // bucket capacity
+}
+
+func perMinute(n int) RateLimit {
+	return RateLimit{Rate: float64(n) / 60, Burst: n}
+}
+
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration
+	Reset      time.Duration // until the bucket is full again
+}
+
+type RateLimitStore interface {
+	Take(key string, limit RateLimit) (RateLimitResult, error)
+	// Peek reports the bucket like Take would without taking a token
+	Peek(key string, limit RateLimit) (RateLimitResult, error)
+}
+
+func NewRateLimitStore(cfg *Config) (RateLimitStore, error) {
+	if cfg.RedisURL == "" {
+		return NewMemoryRateLimitStore(), nil
+	}
+
+	opts, err := redis.ParseURL(cfg.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %v", err)
+	}
+	return &RedisRateLimitStore{client: redis.NewClient(opts)}, nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	limit  RateLimit // of the last Take, buckets of different rules refill at their own rate
+}
+
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	now     func() time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets: map[string]*tokenBucket{},
+		now:     time.Now,
+	}
+}
+
+// Buckets that have refilled completely carry no state and can be dropped
+const memoryRateLimitSweepSize = 10000
+
+func (s *MemoryRateLimitStore) Take(key string, limit RateLimit) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if len(s.buckets) > memoryRateLimitSweepSize {
+		s.sweep(now)
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		s.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	b.limit = limit
+
+	return takeToken(&b.tokens, limit), nil
+}
+
+func (s *MemoryRateLimitStore) Peek(key string, limit RateLimit) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens := float64(limit.Burst)
+	if b, ok := s.buckets[key]; ok {
+		tokens = math.Min(tokens, b.tokens+s.now().Sub(b.last).Seconds()*limit.Rate)
+	}
+	return bucketState(tokens, limit), nil
+}
+
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate >= float64(b.limit.Burst) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func takeToken(tokens *float64, limit RateLimit) RateLimitResult {
+	if *tokens < 1 {
+		res := bucketState(*tokens, limit)
+		res.RetryAfter = time.Duration((1 - *tokens) / limit.Rate * float64(time.Second))
+		return res
+	}
+
+	*tokens--
+	res := bucketState(*tokens, limit)
+	res.Allowed = true
+	return res
+}
+
+// bucketState describes a bucket holding tokens
+func bucketState(tokens float64, limit RateLimit) RateLimitResult {
+	return RateLimitResult{
+		Allowed:   tokens >= 1,
+		Limit:     limit.Burst,
+		Remaining: int(tokens),
+		Reset:     time.Duration((float64(limit.Burst) - tokens) / limit.Rate * float64(time.Second)),
+	}
+}
+
+// Refill and take atomically so multiple API instances share one bucket
+var redisTokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local state = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens = tonumber(state[1]) or burst
+local last = tonumber(state[2]) or now
+
+tokens = math.min(burst, tokens + (now - last) * rate)
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+redis.call("HSET", KEYS[1], "tokens", tokens, "last", now)
+redis.call("EXPIRE", KEYS[1], math.ceil(burst / rate))
+
+return {allowed, tostring(tokens)}
+`)
+
+type RedisRateLimitStore struct {
+	client *redis.Client
+}
+
+func (s *RedisRateLimitStore) Take(key string, limit RateLimit) (RateLimitResult, error) {
+	now := float64(time.Now().UnixMicro()) / 1e6
+
+	res, err := redisTokenBucketScript.Run(context.Background(), s.client,
+		[]string{"ratelimit:" + key}, limit.Rate, limit.Burst, now).Slice()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	tokens, err := strconv.ParseFloat(res[1].(string), 64)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	state := bucketState(tokens, limit)
+	state.Allowed = res[0].(int64) == 1
+	if !state.Allowed {
+		state.RetryAfter = time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+	}
+	return state, nil
+}
+
+func (s *RedisRateLimitStore) Peek(key string, limit RateLimit) (RateLimitResult, error) {
+	state, err := s.client.HMGet(context.Background(), "ratelimit:"+key, "tokens", "last").Result()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	tokens := float64(limit.Burst)
+	if t, ok := state[0].(string); ok {
+		last, _ := state[1].(string)
+		stored, err1 := strconv.ParseFloat(t, 64)
+		at, err2 := strconv.ParseFloat(last, 64)
+		if err1 == nil && err2 == nil {
+			now := float64(time.Now().UnixMicro()) / 1e6
+			tokens = math.Min(tokens, stored+(now-at)*limit.Rate)
+		}
+	}
+	return bucketState(tokens, limit), nil
+}
+
+type rateLimitRule struct {
+	name  string
+	limit RateLimit
+	// Returns the bucket key for the request, empty to skip the rule
+	key func(r *http.Request) string
+}
+
+// rateLimiter applies rules against one store and keeps them for GET /limits
+type rateLimiter struct {
+	store RateLimitStore
+	rules []rateLimitRule
+}
+
+func (l *rateLimiter) wrap(handler http.HandlerFunc, rules ...rateLimitRule) http.HandlerFunc {
+	l.rules = append(l.rules, rules...)
+	return withRateLimit(handler, l.store, rules...)
+}
+
+// setRateLimitHeaders describes the most depleted bucket the request drew from
+func setRateLimitHeaders(w http.ResponseWriter, res RateLimitResult) {
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(res.Reset.Seconds()))))
+}
+
+func withRateLimit(handler http.HandlerFunc, store RateLimitStore, rules ...rateLimitRule) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var tightest *RateLimitResult
+		for _, rule := range rules {
+			key := rule.key(r)
+			if key == "" {
+				continue
+			}
+
+			res, err := store.Take(rule.name+":"+key, rule.limit)
+			if err != nil {
+				// Fail open, losing the limiter shouldn't take down logins
+				log.Printf("Rate limit store error: %v", err)
+				continue
+			}
+
+			if tightest == nil || res.Remaining < tightest.Remaining {
+				tightest = &res
+			}
+			if !res.Allowed {
+				setRateLimitHeaders(w, res)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(res.RetryAfter.Seconds()))))
+				WriteJSON(w, http.StatusTooManyRequests, ApiError{Error: "too many requests", Code: "RATE_LIMITED"})
+				return
+			}
+		}
+
+		if tightest != nil {
+			setRateLimitHeaders(w, *tightest)
+		}
+		handler(w, r)
+	})
+}
+
+// clientIP is the caller's address, resolved through trusted proxies by withForwardedHeaders
+func clientIP(r *http.Request) string {
+	if fwd, ok := r.Context().Value(forwardedKey{}).(forwarded); ok {
+		return fwd.ip
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func rateLimitByIP(r *http.Request) string {
+	return clientIP(r)
+}
+
+// Keys on the account number in the login payload, leaving the body readable for the handler
+func rateLimitByLoginNumber(r *http.Request) string {
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	var req LoginRequest
+	if err := json.Unmarshal(body, &req); err != nil || req.Number == 0 {
+		return ""
+	}
+	return strconv.FormatInt(req.Number, 10)
+}
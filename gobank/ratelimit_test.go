@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryRateLimitStore()
+	store.now = func() time.Time { return now }
+
+	limit := perMinute(2)
+
+	res, _ := store.Take("ip:1", limit)
+	assert.True(t, res.Allowed)
+	res, _ = store.Take("ip:1", limit)
+	assert.True(t, res.Allowed)
+
+	res, _ = store.Take("ip:1", limit)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 30*time.Second, res.RetryAfter.Round(time.Second))
+	assert.Equal(t, 60*time.Second, res.Reset.Round(time.Second))
+
+	// Other keys have their own bucket
+	res, _ = store.Take("ip:2", limit)
+	assert.True(t, res.Allowed)
+
+	now = now.Add(30 * time.Second)
+	res, _ = store.Take("ip:1", limit)
+	assert.True(t, res.Allowed)
+}
+
+func TestMemoryRateLimitStorePeek(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryRateLimitStore()
+	store.now = func() time.Time { return now }
+	limit := perMinute(4)
+
+	res, _ := store.Peek("ip:1", limit)
+	assert.Equal(t, RateLimitResult{Allowed: true, Limit: 4, Remaining: 4}, res)
+
+	store.Take("ip:1", limit)
+	store.Take("ip:1", limit)
+	for i := 0; i < 2; i++ {
+		res, _ = store.Peek("ip:1", limit)
+		assert.Equal(t, 2, res.Remaining, "peeking takes nothing")
+	}
+	assert.Equal(t, 30*time.Second, res.Reset.Round(time.Second))
+}
+
+func TestMemoryRateLimitStoreSweep(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryRateLimitStore()
+	store.now = func() time.Time { return now }
+	slow, fast := perMinute(2), RateLimit{Rate: 100, Burst: 1}
+
+	store.Take("login:1", slow)
+	store.Take("login:1", slow)
+	for i := 0; i <= memoryRateLimitSweepSize; i++ {
+		store.Take(fmt.Sprintf("ip:%d", i), fast)
+	}
+
+	// A second refills the fast buckets but not the slow one
+	now = now.Add(time.Second)
+	res, _ := store.Take("ip:0", fast)
+	assert.True(t, res.Allowed)
+	assert.Len(t, store.buckets, 2, "only the drained buckets are kept")
+
+	res, _ = store.Take("login:1", slow)
+	assert.False(t, res.Allowed, "swept with its own rate")
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	handler := withRateLimit(func(w http.ResponseWriter, r *http.Request) {}, store,
+		rateLimitRule{name: "wide", limit: perMinute(10), key: rateLimitByIP},
+		rateLimitRule{name: "narrow", limit: perMinute(2), key: rateLimitByIP},
+	)
+	call := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "/login", nil))
+		return w
+	}
+
+	// The narrower rule is the one reported
+	w := call()
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "1", w.Header().Get("X-RateLimit-Remaining"))
+	assert.Equal(t, "30", w.Header().Get("X-RateLimit-Reset"))
+
+	call()
+	w = call()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "0", w.Header().Get("X-RateLimit-Remaining"))
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Every transfer gets a random UUID reference, recorded with the transfer
+// row so the receipt can be looked up again after the response is gone.
+
+type TransferReceipt struct {
+	Reference       string    `json:"reference"`
+	Status          string    `json:"status"`
+	Kind            string    `json:"kind"`
+	FromAccount     int64     `json:"from_account"`
+	ToAccount       int64     `json:"to_account"`
+	Amount          float64   `json:"amount"`
+	Currency        string    `json:"currency"`
+	ConvertedAmount float64   `json:"converted_amount,omitempty"` // set for cross-currency transfers
+	ToCurrency      string    `json:"to_currency,omitempty"`
+	FxRate          float64   `json:"fx_rate,omitempty"`
+	Fee             float64   `json:"fee,omitempty"` // charged on top of the amount, see fees.go
+	TransferredAt   time.Time `json:"transferred_at"`
+}
+
+// Only completed transfers are recorded, so stored receipts are always settled
+const TransferSettled = "success"
+
+func newReceipt(reference string, from, to *Account, conv Conversion, kind string, at time.Time) *TransferReceipt {
+	receipt := &TransferReceipt{
+		Reference:     reference,
+		Status:        TransferSettled,
+		Kind:          kind,
+		FromAccount:   from.Number,
+		ToAccount:     to.Number,
+		Amount:        conv.Debit,
+		Currency:      conv.FromCurrency,
+		TransferredAt: at,
+	}
+	if conv.IsFX() {
+		receipt.ConvertedAmount = conv.Credit
+		receipt.ToCurrency = conv.ToCurrency
+		receipt.FxRate = conv.Rate
+	}
+	return receipt
+}
+
+// newTransferReference returns a random (version 4) UUID
+func newTransferReference() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+var validReference = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+type transferReferenceKey struct{}
+
+// withTransferReference sets the reference RecordTransfer stores for transfers under ctx
+func withTransferReference(ctx context.Context, reference string) context.Context {
+	return context.WithValue(ctx, transferReferenceKey{}, reference)
+}
+
+// Adjustments and other internal movements carry no reference
+func transferReference(ctx context.Context) string {
+	reference, _ := ctx.Value(transferReferenceKey{}).(string)
+	return reference
+}
+
+// GET /transfer/{reference}, the reference is unguessable so it works like
+// the receipt itself: whoever was given it can look the transfer up
+func (s *APIServer) handleGetTransfer(w http.ResponseWriter, r *http.Request) error {
+	reference := mux.Vars(r)["reference"]
+	if !validReference.MatchString(reference) {
+		return newHTTPError(http.StatusBadRequest, "INVALID_REFERENCE", "transfer reference must be a UUID")
+	}
+
+	store := s.forRequest(r).store
+	receipt, err := store.GetTransferReceipt(r.Context(), reference)
+	if err != nil {
+		if receipt, err = pendingTransferReceipt(r.Context(), store, reference, err); err != nil {
+			return err
+		}
+	}
+
+	return WriteJSON(w, http.StatusOK, receipt)
+}
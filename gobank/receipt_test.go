@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransferReceipt(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{TransferEngine: "balance"}
+	store := newMemoryStorage()
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 7001, Balance: 5000, Currency: "USD"}))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 7002, Currency: "USD"}))
+
+	engine, err := NewTransferEngine(cfg.TransferEngine, store, cfg)
+	require.Nil(t, err)
+	s := NewAPIServer(cfg, store)
+	router := s.routes(engine)
+
+	receipt, _, err := s.transfers().Transfer(ctx, TransferRequest{FromAccountNumber: 7001, ToAccountNumber: 7002, Amount: 12.5}, engine, "test")
+	require.Nil(t, err)
+	assert.Regexp(t, validReference, receipt.Reference)
+	assert.Equal(t, TransferSettled, receipt.Status)
+
+	get := func(reference string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/transfer/"+reference, nil))
+		return w
+	}
+
+	w := get(receipt.Reference)
+	require.Equal(t, http.StatusOK, w.Code)
+	var found TransferReceipt
+	require.Nil(t, json.NewDecoder(w.Body).Decode(&found))
+	assert.Equal(t, receipt.Reference, found.Reference)
+	assert.Equal(t, int64(7001), found.FromAccount)
+	assert.Equal(t, int64(7002), found.ToAccount)
+	assert.Equal(t, 12.5, found.Amount)
+	assert.Equal(t, TransferKindTransfer, found.Kind)
+
+	assert.Equal(t, http.StatusNotFound, get(newTransferReference()).Code)
+	assert.Equal(t, http.StatusBadRequest, get("not-a-uuid").Code)
+}
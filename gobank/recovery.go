@@ -0,0 +1,36 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+// Panics in handlers are counted here by route, the request's goroutine
+// recovers and answers 500 instead of taking the process down
+var handlerPanics = expvar.NewMap("handler_panics")
+
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// net/http's way of aborting a response on purpose, it handles that itself
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			id := requestIDFromContext(r.Context())
+			log.Printf("Panic serving %s %s, request %s: %v\n%s", r.Method, r.URL.Path, id, v, debug.Stack())
+			handlerPanics.Add(routeSpanName("", r), 1)
+
+			// Too late for a body if the handler already started its response
+			WriteJSON(w, http.StatusInternalServerError, ApiError{Error: "internal server error", Code: "INTERNAL_ERROR", RequestID: id})
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithRecovery(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(withRecovery)
+	router.HandleFunc("/boom/{id}", func(w http.ResponseWriter, r *http.Request) {
+		var accounts map[int]*Account
+		accounts[1].Balance++
+	})
+
+	before := int64(0)
+	if v, ok := handlerPanics.Get("GET /boom/{id}").(*expvar.Int); ok {
+		before = v.Value()
+	}
+
+	w := httptest.NewRecorder()
+	withRequestID(router).ServeHTTP(w, httptest.NewRequest("GET", "/boom/7", nil))
+
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	var apiErr ApiError
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &apiErr))
+	assert.Equal(t, "INTERNAL_ERROR", apiErr.Code)
+	assert.Equal(t, w.Header().Get("X-Request-ID"), apiErr.RequestID)
+	assert.NotEmpty(t, apiErr.RequestID)
+	assert.Equal(t, before+1, handlerPanics.Get("GET /boom/{id}").(*expvar.Int).Value())
+
+	// Deliberate aborts are left to net/http
+	router.HandleFunc("/abort", func(w http.ResponseWriter, r *http.Request) { panic(http.ErrAbortHandler) })
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/abort", nil))
+	})
+}
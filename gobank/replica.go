@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// With DATABASE_REPLICA_URL set the account lookups, GetAccounts,
+// GetAccountbyID and GetAccountByNumber, read from a streaming replica.
+// Everything else, transactions included, stays on the primary. Requests
+// that write and transfers read from the primary as well, a lagging replica
+// would hand them versions that have moved on. A read carrying a
+// consistency token waits until the replica has replayed up to it.
+//
+// A failing replica is skipped for DB_REPLICA_RETRY while the primary
+// answers. A row the replica doesn't have is looked up on the primary too,
+// it may have been written moments ago.
+
+type replicaPool struct {
+	db    *sql.DB
+	retry time.Duration
+
+	mu        sync.Mutex
+	downUntil time.Time
+}
+
+func newReplicaPool(cfg *Config) (*replicaPool, error) {
+	db, err := sql.Open("postgres", cfg.DatabaseReplicaURL)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	db.SetMaxIdleConns(cfg.DBMaxIdleConns)
+	db.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
+
+	p := &replicaPool{db: db, retry: cfg.DBReplicaRetry}
+	// The primary can serve until the replica is up
+	if err := db.Ping(); err != nil {
+		p.markDown(err)
+	}
+	return p, nil
+}
+
+func (p *replicaPool) available() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !time.Now().Before(p.downUntil)
+}
+
+func (p *replicaPool) markDown(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Now().Before(p.downUntil) {
+		return
+	}
+	p.downUntil = time.Now().Add(p.retry)
+	log.Printf("Read replica failed, reading from the primary for %s: %v", p.retry, err)
+}
+
+type primaryReadKey struct{}
+
+// withPrimaryReads makes the storage read from the primary for ctx
+func withPrimaryReads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryReadKey{}, true)
+}
+
+// readReplica returns the replica to read from for ctx, nil for the primary
+func (s *PostgresStorage) readReplica(ctx context.Context) *replicaPool {
+	if s.replica == nil || !s.replica.available() {
+		return nil
+	}
+	if primary, _ := ctx.Value(primaryReadKey{}).(bool); primary {
+		return nil
+	}
+	return s.replica
+}
+
+// readRow scans one row from the replica, or the primary when the replica
+// fails or doesn't have the row
+func (s *PostgresStorage) readRow(ctx context.Context, scan func(*sql.Row) error, query string, args ...any) error {
+	if replica := s.readReplica(ctx); replica != nil {
+		err := scan(replica.db.QueryRowContext(ctx, s.tagQuery(query), args...))
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			replica.markDown(err)
+		}
+	}
+	return scan(s.queryRow(ctx, s.db, query, args...))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// namedDriver answers every query with one row holding the database's name,
+// unless the name is "down" (queries fail) or "empty" (no rows)
+type namedDriver struct {
+	queries sync.Map // name -> *atomic.Int64
+}
+
+func (d *namedDriver) Open(name string) (driver.Conn, error) {
+	counter, _ := d.queries.LoadOrStore(name, new(atomic.Int64))
+	return &namedConn{name: name, queries: counter.(*atomic.Int64)}, nil
+}
+
+func (d *namedDriver) count(name string) int64 {
+	counter, ok := d.queries.Load(name)
+	if !ok {
+		return 0
+	}
+	return counter.(*atomic.Int64).Load()
+}
+
+type namedConn struct {
+	name    string
+	queries *atomic.Int64
+}
+
+func (c *namedConn) Prepare(query string) (driver.Stmt, error) { return namedStmt{c}, nil }
+func (c *namedConn) Close() error                              { return nil }
+func (c *namedConn) Begin() (driver.Tx, error)                 { return nil, errors.New("read only") }
+
+type namedStmt struct{ c *namedConn }
+
+func (namedStmt) Close() error  { return nil }
+func (namedStmt) NumInput() int { return -1 }
+func (namedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("read only")
+}
+func (s namedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.c.queries.Add(1)
+	switch s.c.name {
+	case "down":
+		return nil, errors.New("connection refused")
+	case "empty":
+		return &namedRows{}, nil
+	}
+	return &namedRows{value: s.c.name}, nil
+}
+
+type namedRows struct {
+	value string
+	done  bool
+}
+
+func (r *namedRows) Columns() []string { return []string{"name"} }
+func (r *namedRows) Close() error      { return nil }
+func (r *namedRows) Next(dest []driver.Value) error {
+	if r.done || r.value == "" {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = r.value
+	return nil
+}
+
+var registerNamedDriver sync.Once
+
+func TestReplicaReads(t *testing.T) {
+	d := &namedDriver{}
+	registerNamedDriver.Do(func() { sql.Register("named", d) })
+	open := func(name string) *sql.DB {
+		db, err := sql.Open("named", name)
+		require.Nil(t, err)
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+	storage := func(replica string) *PostgresStorage {
+		return &PostgresStorage{db: open("primary"), replica: &replicaPool{db: open(replica), retry: time.Minute}}
+	}
+	read := func(s *PostgresStorage, ctx context.Context) string {
+		var name string
+		require.Nil(t, s.readRow(ctx, func(row *sql.Row) error { return row.Scan(&name) }, "select name"))
+		return name
+	}
+	ctx := context.Background()
+
+	s := storage("replica")
+	assert.Equal(t, "replica", read(s, ctx))
+	assert.Equal(t, "primary", read(s, withPrimaryReads(ctx)))
+
+	// A row the replica doesn't have yet comes from the primary
+	s = storage("empty")
+	assert.Equal(t, "primary", read(s, ctx))
+	assert.True(t, s.replica.available())
+
+	// A failing replica is skipped until the retry interval has passed
+	s = storage("down")
+	assert.Equal(t, "primary", read(s, ctx))
+	assert.False(t, s.replica.available())
+	assert.Equal(t, "primary", read(s, ctx))
+	assert.Equal(t, int64(1), d.count("down"))
+
+	s.replica.downUntil = time.Now()
+	read(s, ctx)
+	assert.Equal(t, int64(2), d.count("down"))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+)
+
+type requestIDKey struct{}
+
+// Client supplied IDs are only accepted in this shape since they end up in SQL comments
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Storage backends that can tag their queries with a request ID
+type requestScopedStorage interface {
+	WithRequestID(id string) Storage
+}
+
+// forRequest returns a copy of the server whose storage is scoped to the request's ID
+func (s *APIServer) forRequest(r *http.Request) *APIServer {
+	return s.forRequestID(requestIDFromContext(r.Context())).withConsistentReads(r.Context())
+}
+
+func (s *APIServer) forRequestID(id string) *APIServer {
+	scopable, ok := s.store.(requestScopedStorage)
+	if id == "" || !ok {
+		return s
+	}
+
+	scoped := *s
+	scoped.store = scopable.WithRequestID(id)
+	return &scoped
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithRequestID(t *testing.T) {
+	var seen string
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFromContext(r.Context())
+	}))
+	serve := func(id string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		if id != "" {
+			r.Header.Set("X-Request-ID", id)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, seen, w.Header().Get("X-Request-ID"), "the handler sees the echoed ID")
+		return seen
+	}
+
+	assert.Equal(t, "req-1.A_b", serve("req-1.A_b"))
+	assert.Equal(t, strings.Repeat("a", 64), serve(strings.Repeat("a", 64)))
+
+	for _, id := range []string{"", strings.Repeat("a", 65), "x */ drop table account; /*", "has space", "tab\t", "ümlaut"} {
+		got := serve(id)
+		assert.NotEqual(t, id, got)
+		assert.Regexp(t, "^[0-9a-f]{16}$", got, "replaced with a generated ID")
+	}
+	assert.NotEqual(t, serve(""), serve(""), "generated IDs differ")
+}
+
+func TestTagQuery(t *testing.T) {
+	s := &PostgresStorage{}
+	assert.Equal(t, "SELECT 1", s.tagQuery("SELECT 1"))
+
+	scoped := s.WithRequestID("req-42").(*PostgresStorage)
+	assert.Equal(t, "/* request_id=req-42 */ SELECT 1", scoped.tagQuery("SELECT 1"))
+	assert.Equal(t, "SELECT 1", s.tagQuery("SELECT 1"), "the original stays untagged")
+}
+
+func TestForRequest(t *testing.T) {
+	s := &APIServer{store: &PostgresStorage{}}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	assert.Same(t, s, s.forRequest(r), "nothing to scope without an ID")
+
+	r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, "req-7"))
+	scoped, ok := s.forRequest(r).store.(*PostgresStorage)
+	require.True(t, ok)
+	assert.Equal(t, "req-7", scoped.requestID)
+	assert.Empty(t, s.store.(*PostgresStorage).requestID)
+
+	// Storage that can't carry the ID is used as is
+	memory := &APIServer{store: newMemoryStorage()}
+	assert.Same(t, memory, memory.forRequest(r))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+// Tokens carry a random jti. POST /logout puts the presented token's jti on
+// the revocation list until the token would have expired anyway, and
+// withJWTAuth refuses revoked tokens. Tokens issued before jti was added
+// can't be revoked and run out on their own.
+//
+// The list lives in Redis when REDIS_URL is set so every instance sees a
+// logout, otherwise in memory. A list that can't be read refuses the token.
+
+// RevocationList remembers revoked token IDs until they expire
+type RevocationList interface {
+	Revoke(jti string, until time.Time) error
+	IsRevoked(jti string) (bool, error)
+}
+
+func NewRevocationList(cfg *Config) (RevocationList, error) {
+	if cfg.RedisURL == "" {
+		return NewMemoryRevocationList(), nil
+	}
+
+	opts, err := redis.ParseURL(cfg.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %v", err)
+	}
+	return &RedisRevocationList{client: redis.NewClient(opts)}, nil
+}
+
+type MemoryRevocationList struct {
+	mu      sync.Mutex
+	revoked map[string]time.Time
+	now     func() time.Time
+}
+
+func NewMemoryRevocationList() *MemoryRevocationList {
+	return &MemoryRevocationList{revoked: map[string]time.Time{}, now: time.Now}
+}
+
+func (l *MemoryRevocationList) Revoke(jti string, until time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	for k, expires := range l.revoked {
+		if now.After(expires) {
+			delete(l.revoked, k)
+		}
+	}
+	l.revoked[jti] = until
+	return nil
+}
+
+func (l *MemoryRevocationList) IsRevoked(jti string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	expires, ok := l.revoked[jti]
+	return ok && !l.now().After(expires), nil
+}
+
+type RedisRevocationList struct {
+	client *redis.Client
+}
+
+func (l *RedisRevocationList) Revoke(jti string, until time.Time) error {
+	ttl := time.Until(until)
+	if ttl <= 0 {
+		return nil
+	}
+	return l.client.Set(context.Background(), "revoked:"+jti, 1, ttl).Err()
+}
+
+func (l *RedisRevocationList) IsRevoked(jti string) (bool, error) {
+	n, err := l.client.Exists(context.Background(), "revoked:"+jti).Result()
+	return n > 0, err
+}
+
+func newTokenID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func jwtTokenID(token *jwt.Token) string {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return ""
+	}
+	jti, _ := claims["jti"].(string)
+	return jti
+}
+
+// tokenRevoked reports whether a validated token may no longer be used
+func tokenRevoked(list RevocationList, token *jwt.Token) bool {
+	jti := jwtTokenID(token)
+	if jti == "" {
+		return false
+	}
+
+	revoked, err := list.IsRevoked(jti)
+	if err != nil {
+		log.Printf("Revocation list error: %v", err)
+		return true
+	}
+	return revoked
+}
+
+// POST /logout revokes the token in x-jwt-token
+func (s *APIServer) handleLogout(w http.ResponseWriter, r *http.Request) error {
+	token, err := validateJWT(r.Header.Get("x-jwt-token"))
+	if err != nil || !token.Valid || tokenRevoked(s.revocations, token) {
+		return newHTTPError(http.StatusUnauthorized, "INVALID_TOKEN", "token is missing, invalid or already revoked")
+	}
+
+	jti := jwtTokenID(token)
+	if jti == "" {
+		return newHTTPError(http.StatusUnprocessableEntity, "TOKEN_NOT_REVOCABLE", "token predates logout support, it expires on its own")
+	}
+	exp, err := token.Claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return newHTTPError(http.StatusUnprocessableEntity, "TOKEN_NOT_REVOCABLE", "token has no expiry")
+	}
+
+	if err := s.revocations.Revoke(jti, exp.Time); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, map[string]string{"status": "logged out"})
+}
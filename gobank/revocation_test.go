@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogoutRevokesToken(t *testing.T) {
+	t.Setenv("JWT_SECRET", "logout-secret")
+	store := newMemoryStorage()
+	account := &Account{Number: 6101, Currency: "USD"}
+	require.Nil(t, store.CreateAccount(context.Background(), account))
+
+	s := NewAPIServer(&Config{}, store)
+	router := s.routes(nil)
+	token, err := createJWT(account)
+	require.Nil(t, err)
+
+	do := func(method, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("x-jwt-token", token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	accountPath := "/v1/account/" + strconv.Itoa(account.ID)
+
+	assert.Equal(t, http.StatusOK, do("GET", accountPath))
+	assert.Equal(t, http.StatusOK, do("POST", "/v1/logout"))
+	assert.Equal(t, http.StatusForbidden, do("GET", accountPath))
+	assert.Equal(t, http.StatusUnauthorized, do("POST", "/v1/logout"), "already revoked")
+
+	// A fresh login gets a new jti and isn't affected
+	token, err = createJWT(account)
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusOK, do("GET", accountPath))
+}
+
+func TestMemoryRevocationListExpires(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	list := NewMemoryRevocationList()
+	list.now = func() time.Time { return now }
+
+	require.Nil(t, list.Revoke("a", now.Add(time.Minute)))
+	revoked, _ := list.IsRevoked("a")
+	assert.True(t, revoked)
+
+	now = now.Add(2 * time.Minute)
+	revoked, _ = list.IsRevoked("a")
+	assert.False(t, revoked, "the token has expired by itself")
+
+	require.Nil(t, list.Revoke("b", now.Add(time.Minute)))
+	assert.NotContains(t, list.revoked, "a")
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	FrequencyDaily   = "daily"
+	FrequencyWeekly  = "weekly"
+	FrequencyMonthly = "monthly"
+
+	ScheduledActive    = "active"
+	ScheduledCancelled = "cancelled"
+)
+
+type ScheduledTransfer struct {
+	ID              int        `json:"id"`
+	FromAccountID   int        `json:"from_account_id"`
+	ToAccountNumber int64      `json:"to_account_number"`
+	Amount          float64    `json:"amount"`
+	Frequency       string     `json:"frequency"`
+	Status          string     `json:"status"`
+	NextRunAt       time.Time  `json:"next_run_at"`
+	RetryAt         *time.Time `json:"retry_at,omitempty"`
+	Attempts        int        `json:"attempts"`
+	LastError       string     `json:"last_error,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+type CreateScheduledTransferRequest struct {
+	ToAccountNumber int64     `json:"toAccount" validate:"required,positive"`
+	Amount          float64   `json:"amount" validate:"positive"`
+	Frequency       string    `json:"frequency" validate:"required,oneof=daily weekly monthly"`
+	StartAt         time.Time `json:"startAt"`
+	PIN             string    `json:"pin,omitempty" validate:"numeric,min=4,max=6"` // checked once here when the amount needs it
+}
+
+// nextOccurrence advances t by one period. Monthly schedules stay on the same
+// day of the month, clamped to the last day for shorter months.
+func nextOccurrence(t time.Time, frequency string) time.Time {
+	switch frequency {
+	case FrequencyDaily:
+		return t.AddDate(0, 0, 1)
+	case FrequencyWeekly:
+		return t.AddDate(0, 0, 7)
+	}
+
+	firstOfNext := time.Date(t.Year(), t.Month()+1, 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	lastDay := firstOfNext.AddDate(0, 1, -1).Day()
+	return firstOfNext.AddDate(0, 0, min(t.Day(), lastDay)-1)
+}
+
+// GET /account/{id}/scheduled-transfers
+func (s *APIServer) handleGetScheduledTransfers(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	scheduled, err := s.store.GetScheduledTransfers(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, scheduled)
+}
+
+// POST /account/{id}/scheduled-transfers
+func (s *APIServer) handleCreateScheduledTransfer(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	accountID, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	var req CreateScheduledTransferRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+
+	from, err := s.store.GetAccountbyID(r.Context(), accountID)
+	if err != nil {
+		return err
+	}
+	if _, err := s.store.GetAccountByNumber(r.Context(), req.ToAccountNumber); err != nil {
+		return invalidField("toAccount", "exists", "is not an account")
+	}
+	if from.Number == req.ToAccountNumber {
+		return invalidField("toAccount", "different", "must not be the paying account")
+	}
+	if err := checkTransactionPIN(r.Context(), s.store, s.transferLimits.PIN, from, toCents(req.Amount), req.PIN); err != nil {
+		return err
+	}
+
+	startAt := req.StartAt
+	if startAt.IsZero() {
+		startAt = time.Now()
+	}
+
+	scheduled := &ScheduledTransfer{
+		FromAccountID:   accountID,
+		ToAccountNumber: req.ToAccountNumber,
+		Amount:          req.Amount,
+		Frequency:       req.Frequency,
+		Status:          ScheduledActive,
+		NextRunAt:       startAt.UTC(),
+		CreatedAt:       time.Now().UTC(),
+	}
+	if err := s.store.CreateScheduledTransfer(r.Context(), scheduled); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, scheduled)
+}
+
+// DELETE /account/{id}/scheduled-transfers/{scheduledID}
+func (s *APIServer) handleCancelScheduledTransfer(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	scheduledID, err := pathID(r, "scheduledID")
+	if err != nil {
+		return err
+	}
+
+	if err := s.forRequest(r).store.CancelScheduledTransfer(r.Context(), id, scheduledID); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, map[string]int{"cancelled": scheduledID})
+}
+
+// scheduledTransferRunner executes due scheduled transfers through the same
+// validation, limits and engine as /transfer
+type scheduledTransferRunner struct {
+	api         *APIServer
+	engine      TransferEngine
+	notifier    Notifier
+	maxAttempts int
+	retryDelay  time.Duration
+}
+
+func (s *APIServer) scheduledTransferJob(engine TransferEngine) Job {
+	runner := &scheduledTransferRunner{
+		api:         s,
+		engine:      engine,
+		notifier:    s.notifier,
+		maxAttempts: s.config.ScheduledTransferMaxAttempts,
+		retryDelay:  s.config.ScheduledTransferRetryDelay,
+	}
+
+	return Job{
+		Name:     "scheduled-transfers",
+		Interval: s.config.SchedulerInterval,
+		Run:      runner.run,
+	}
+}
+
+func (r *scheduledTransferRunner) run(ctx context.Context) error {
+	now := time.Now().UTC()
+
+	due, err := r.api.store.GetDueScheduledTransfers(ctx, now, 100)
+	if err != nil {
+		return err
+	}
+	setJobQueueDepth("scheduled_transfers", len(due))
+
+	for _, st := range due {
+		// Lease the row so another instance doesn't pick it up mid-run
+		claimed, err := r.api.store.ClaimScheduledTransfer(ctx, st.ID, now, now.Add(r.retryDelay))
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+
+		r.execute(ctx, st, now)
+
+		if err := r.api.store.UpdateScheduledTransfer(ctx, st); err != nil {
+			log.Printf("Failed to update scheduled transfer %d: %v", st.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// execute runs one occurrence and moves the schedule on. Failures are retried
+// after retryDelay, once maxAttempts is reached that occurrence is skipped.
+// The PIN was checked when the schedule was set up.
+func (r *scheduledTransferRunner) execute(ctx context.Context, st *ScheduledTransfer, now time.Time) {
+	from, err := r.api.store.GetAccountbyID(ctx, st.FromAccountID)
+	if err == nil {
+		_, _, err = r.api.transfers().Transfer(withPINVerified(ctx), TransferRequest{
+			FromAccountNumber: from.Number,
+			ToAccountNumber:   st.ToAccountNumber,
+			Amount:            st.Amount,
+		}, r.engine, "scheduler:"+strconv.Itoa(st.ID))
+	}
+
+	if err == nil {
+		st.NextRunAt = nextOccurrence(st.NextRunAt, st.Frequency)
+		st.RetryAt = nil
+		st.Attempts = 0
+		st.LastError = ""
+		return
+	}
+
+	st.Attempts++
+	st.LastError = err.Error()
+
+	reason := "failed"
+	if errors.Is(err, ErrInsufficientFunds) {
+		reason = "failed due to insufficient funds"
+	}
+
+	if st.Attempts < r.maxAttempts {
+		retryAt := now.Add(r.retryDelay)
+		st.RetryAt = &retryAt
+		r.notify(st, fmt.Sprintf("Scheduled transfer of %.2f to %d %s, retrying at %s",
+			st.Amount, st.ToAccountNumber, reason, retryAt.Format(time.RFC3339)))
+		return
+	}
+
+	r.notify(st, fmt.Sprintf("Scheduled transfer of %.2f to %d %s after %d attempts and was skipped",
+		st.Amount, st.ToAccountNumber, reason, st.Attempts))
+	st.NextRunAt = nextOccurrence(st.NextRunAt, st.Frequency)
+	st.RetryAt = nil
+	st.Attempts = 0
+}
+
+func (r *scheduledTransferRunner) notify(st *ScheduledTransfer, message string) {
+	if err := r.notifier.Notify(st.FromAccountID, "Scheduled transfer failed", message); err != nil {
+		log.Printf("Failed to notify account %d: %v", st.FromAccountID, err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextOccurrence(t *testing.T) {
+	jan31 := time.Date(2024, time.January, 31, 9, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, time.Date(2024, time.February, 1, 9, 0, 0, 0, time.UTC), nextOccurrence(jan31, FrequencyDaily))
+	assert.Equal(t, time.Date(2024, time.February, 7, 9, 0, 0, 0, time.UTC), nextOccurrence(jan31, FrequencyWeekly))
+
+	// Monthly schedules clamp to the end of shorter months
+	assert.Equal(t, time.Date(2024, time.February, 29, 9, 0, 0, 0, time.UTC), nextOccurrence(jan31, FrequencyMonthly))
+	assert.Equal(t, time.Date(2024, time.May, 15, 9, 0, 0, 0, time.UTC),
+		nextOccurrence(time.Date(2024, time.April, 15, 9, 0, 0, 0, time.UTC), FrequencyMonthly))
+}
+
+func TestScheduledTransferAbovePINThreshold(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	acc, err := NewAccount("Sam", "Schedule", "password")
+	require.Nil(t, err)
+	acc.Number, acc.Balance, acc.EmailVerified = 9941, 100000, true
+	require.Nil(t, store.CreateAccount(ctx, acc))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9942, Currency: "USD"}))
+
+	s := NewAPIServer(&Config{TransactionPINThreshold: 100}, store)
+	require.Nil(t, s.accounts().SetPIN(ctx, acc.ID, SetPINRequest{PIN: "1234", Password: "password"}, "account:9941"))
+
+	create := func(body string) *httptest.ResponseRecorder {
+		id := strconv.Itoa(acc.ID)
+		r := mux.SetURLVars(httptest.NewRequest("POST", "/account/"+id+"/scheduled-transfers", strings.NewReader(body)),
+			map[string]string{"id": id})
+		w := httptest.NewRecorder()
+		makeHTTPHandle(s.handleCreateScheduledTransfer)(w, r)
+		return w
+	}
+	w := create(`{"toAccount": 9942, "amount": 150, "frequency": "monthly"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+	w = create(`{"toAccount": 9942, "amount": 150, "frequency": "monthly", "pin": "1234"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	scheduled, err := store.GetScheduledTransfers(ctx, acc.ID)
+	require.Nil(t, err)
+	require.Len(t, scheduled, 1)
+
+	// Each occurrence runs without the PIN, it was checked when scheduling
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	runner := &scheduledTransferRunner{api: s, engine: engine, notifier: &capturingNotifier{}, maxAttempts: 3, retryDelay: time.Minute}
+	st := scheduled[0]
+	runner.execute(ctx, st, time.Now())
+	assert.Equal(t, 0, st.Attempts)
+	assert.Empty(t, st.LastError)
+
+	payee, err := store.GetAccountByNumber(ctx, 9942)
+	require.Nil(t, err)
+	assert.Equal(t, int64(15000), payee.Balance)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Account search matches q as a case-insensitive prefix of the first name,
+// last name, "first last" or nickname, and a numeric q exactly against the
+// account number. Prefix matches on lower() are served by text_pattern_ops
+// indexes, so a search never scans the account table. metadata=key:value
+// parameters narrow it to accounts with all of those metadata values, a
+// search by metadata alone needs no q.
+
+type AccountSearch struct {
+	Query    string
+	Metadata AccountMetadata
+	Limit    int
+	Offset   int
+}
+
+type AccountSearchPage struct {
+	Accounts   []*Account `json:"accounts"`
+	NextOffset int        `json:"next_offset,omitempty"` // absent on the last page
+}
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+	minSearchLength    = 2
+)
+
+// searchNumber is the account number a query names, zero when it isn't one
+func (q AccountSearch) searchNumber() int64 {
+	n, err := strconv.ParseInt(q.Query, 10, 64)
+	if err != nil || n <= 0 {
+		return 0
+	}
+	return n
+}
+
+// likePrefix escapes the query for use as a LIKE prefix pattern
+func (q AccountSearch) likePrefix() string {
+	escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(q.Query))
+	return escaped + "%"
+}
+
+// matches mirrors the SQL match
+func (q AccountSearch) matches(acc *Account) bool {
+	if !acc.Metadata.contains(q.Metadata) {
+		return false
+	}
+	if n := q.searchNumber(); n != 0 && acc.Number == n {
+		return true
+	}
+	prefix := strings.ToLower(q.Query)
+	for _, name := range []string{acc.FirstName, acc.LastName, acc.FirstName + " " + acc.LastName} {
+		if strings.HasPrefix(strings.ToLower(name), prefix) {
+			return true
+		}
+	}
+	return acc.Nickname != "" && strings.HasPrefix(strings.ToLower(acc.Nickname), prefix)
+}
+
+// filterAccounts applies the search to an already loaded account list, for
+// storages without an index to search
+func filterAccounts(accounts []*Account, search AccountSearch) []*Account {
+	matched := []*Account{}
+	for _, acc := range accounts {
+		if search.matches(acc) {
+			matched = append(matched, acc)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if la, lb := strings.ToLower(a.LastName), strings.ToLower(b.LastName); la != lb {
+			return la < lb
+		}
+		if fa, fb := strings.ToLower(a.FirstName), strings.ToLower(b.FirstName); fa != fb {
+			return fa < fb
+		}
+		return a.ID < b.ID
+	})
+
+	if search.Offset >= len(matched) {
+		return []*Account{}
+	}
+	matched = matched[search.Offset:]
+	if len(matched) > search.Limit {
+		matched = matched[:search.Limit]
+	}
+	return matched
+}
+
+// GET /account/search?q=&metadata=key:value&limit=&offset=, ordered by last then first name
+func (s *APIServer) handleSearchAccounts(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	search := AccountSearch{Query: strings.TrimSpace(query.Get("q")), Limit: defaultSearchLimit}
+	for _, v := range query["metadata"] {
+		key, value, ok := strings.Cut(v, ":")
+		if msg := checkMetadataKey(key); !ok || msg != "" {
+			return invalidParam("query", "metadata", "format", "must be key:value with a valid metadata key")
+		}
+		if search.Metadata == nil {
+			search.Metadata = AccountMetadata{}
+		}
+		search.Metadata[key] = value
+	}
+	metadataOnly := search.Query == "" && search.Metadata != nil
+	if !metadataOnly && len([]rune(search.Query)) < minSearchLength && search.searchNumber() == 0 {
+		return invalidParam("query", "q", "min", fmt.Sprintf("must be an account number or at least %d characters", minSearchLength))
+	}
+
+	var err error
+	if v := query.Get("limit"); v != "" {
+		if search.Limit, err = strconv.Atoi(v); err != nil || search.Limit < 1 || search.Limit > maxSearchLimit {
+			return invalidParam("query", "limit", "range", fmt.Sprintf("must be between 1 and %d", maxSearchLimit))
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		if search.Offset, err = strconv.Atoi(v); err != nil || search.Offset < 0 {
+			return invalidParam("query", "offset", "min", "must be a non-negative integer")
+		}
+	}
+
+	// One extra row tells us whether there's another page
+	limit := search.Limit
+	search.Limit++
+	accounts, err := s.forRequest(r).store.SearchAccounts(r.Context(), search)
+	if err != nil {
+		return err
+	}
+
+	page := &AccountSearchPage{Accounts: accounts}
+	if len(accounts) > limit {
+		page.Accounts = accounts[:limit]
+		page.NextOffset = search.Offset + limit
+	}
+	return WriteJSON(w, http.StatusOK, page)
+}
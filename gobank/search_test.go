@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchAccounts(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	for _, acc := range []*Account{
+		{FirstName: "Ada", LastName: "Lovelace", Number: 41001},
+		{FirstName: "Alan", LastName: "Turing", Number: 41002},
+		{FirstName: "Grace", LastName: "Hopper", Number: 41003},
+		{FirstName: "Adele", LastName: "Goldberg", Number: 41004},
+	} {
+		require.Nil(t, store.CreateAccount(ctx, acc))
+	}
+
+	s := NewAPIServer(&Config{}, store)
+	search := func(query string) (int, *AccountSearchPage) {
+		w := httptest.NewRecorder()
+		makeHTTPHandle(s.handleSearchAccounts)(w, httptest.NewRequest("GET", "/v1/account/search?"+query, nil))
+
+		page := &AccountSearchPage{}
+		if w.Code == http.StatusOK {
+			require.Nil(t, json.Unmarshal(w.Body.Bytes(), page))
+		}
+		return w.Code, page
+	}
+
+	names := func(page *AccountSearchPage) []string {
+		out := []string{}
+		for _, acc := range page.Accounts {
+			out = append(out, acc.FirstName+" "+acc.LastName)
+		}
+		return out
+	}
+
+	// Prefix of either name, ordered by last name
+	_, page := search("q=AD")
+	assert.Equal(t, []string{"Adele Goldberg", "Ada Lovelace"}, names(page))
+	_, page = search("q=hop")
+	assert.Equal(t, []string{"Grace Hopper"}, names(page))
+	_, page = search("q=alan+tu")
+	assert.Equal(t, []string{"Alan Turing"}, names(page))
+
+	// Numbers match exactly, not as a prefix
+	_, page = search("q=41002")
+	assert.Equal(t, []string{"Alan Turing"}, names(page))
+	_, page = search("q=4100")
+	assert.Empty(t, page.Accounts)
+
+	// LIKE wildcards in the query are literal
+	_, page = search("q=%25a")
+	assert.Empty(t, page.Accounts)
+
+	_, page = search("q=ad&limit=1")
+	assert.Equal(t, []string{"Adele Goldberg"}, names(page))
+	assert.Equal(t, 1, page.NextOffset)
+	_, page = search("q=ad&limit=1&offset=1")
+	assert.Equal(t, []string{"Ada Lovelace"}, names(page))
+	assert.Zero(t, page.NextOffset)
+
+	code, _ := search("q=a")
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	code, _ = search("q=ad&limit=500")
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+}
+
+func TestSearchAccountsByNicknameAndMetadata(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	for _, acc := range []*Account{
+		{FirstName: "Ada", LastName: "Lovelace", Number: 42001, Nickname: "Holiday fund", Metadata: AccountMetadata{"purpose": "savings"}},
+		{FirstName: "Alan", LastName: "Turing", Number: 42002, Metadata: AccountMetadata{"purpose": "savings", "team": "bletchley"}},
+		{FirstName: "Grace", LastName: "Hopper", Number: 42003, Metadata: AccountMetadata{"purpose": "payroll"}},
+	} {
+		require.Nil(t, store.CreateAccount(ctx, acc))
+		require.Nil(t, store.UpdateAccount(ctx, acc))
+	}
+
+	s := NewAPIServer(&Config{}, store)
+	search := func(query string) (int, []int64) {
+		w := httptest.NewRecorder()
+		makeHTTPHandle(s.handleSearchAccounts)(w, httptest.NewRequest("GET", "/v1/account/search?"+query, nil))
+		page := &AccountSearchPage{}
+		numbers := []int64{}
+		if w.Code == http.StatusOK {
+			require.Nil(t, json.Unmarshal(w.Body.Bytes(), page))
+			for _, acc := range page.Accounts {
+				numbers = append(numbers, acc.Number)
+			}
+		}
+		return w.Code, numbers
+	}
+
+	_, numbers := search("q=holi")
+	assert.Equal(t, []int64{42001}, numbers)
+
+	// Metadata alone needs no q
+	_, numbers = search("metadata=purpose:savings")
+	assert.ElementsMatch(t, []int64{42001, 42002}, numbers)
+	_, numbers = search("metadata=purpose:savings&metadata=team:bletchley")
+	assert.Equal(t, []int64{42002}, numbers)
+	_, numbers = search("q=gr&metadata=purpose:savings")
+	assert.Empty(t, numbers)
+
+	code, _ := search("metadata=purpose")
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The services hold the business rules shared by the REST and gRPC APIs and
+// the background jobs. They take plain request types and return domain
+// errors, transport concerns stay in the handlers.
+
+type AccountService interface {
+	CreateAccount(ctx context.Context, req *CreateAccountRequest, actor string) (*Account, error)
+	Login(ctx context.Context, req LoginRequest) (*LoginResponse, error)
+	GetAccount(ctx context.Context, id int) (*Account, error)
+	UpdateAccount(ctx context.Context, id int, req UpdateAccountRequest, actor string) (*Account, error)
+	ListAccounts(ctx context.Context, includeClosed bool) ([]*Account, error)
+	CloseAccount(ctx context.Context, id int, actor string) (*Account, error)
+	FreezeAccount(ctx context.Context, id int, actor string) (*Account, error)
+	UnfreezeAccount(ctx context.Context, id int, actor string) (*Account, error)
+	MergeAccounts(ctx context.Context, mergedID, survivorID int, actor string) (*AccountMerge, error)
+	ReactivateAccount(ctx context.Context, id int, password, actor string) (*Account, error)
+	GetLegalHolds(ctx context.Context, id int) (*LegalHolds, error)
+	PlaceLegalHold(ctx context.Context, id int, req PlaceLegalHoldRequest, actor string) (*LegalHold, error)
+	ReleaseLegalHold(ctx context.Context, id, holdID int, req ReleaseLegalHoldRequest, actor string) (*LegalHold, error)
+	GetAuthorizations(ctx context.Context, id int) (*Authorizations, error)
+	Authorize(ctx context.Context, id int, req AuthorizeRequest, actor string) (*Reservation, error)
+	SetPIN(ctx context.Context, id int, req SetPINRequest, actor string) error
+	UnlockAccount(ctx context.Context, id int, actor string) error
+	LoginExternal(ctx context.Context, issuer, subject, verifiedEmail string) (*LoginResponse, error)
+	GetPreferences(ctx context.Context, id int) (*AccountPreferences, error)
+	UpdatePreferences(ctx context.Context, id int, req UpdatePreferencesRequest, actor string) (*AccountPreferences, error)
+	CaptureAuthorization(ctx context.Context, id, holdID int, req CaptureRequest, actor string) (*Reservation, error)
+	ReleaseAuthorization(ctx context.Context, id, holdID int, actor string) (*Reservation, error)
+}
+
+type TransferService interface {
+	Transfer(ctx context.Context, req TransferRequest, engine TransferEngine, actor string) (*TransferReceipt, *TransferUsage, error)
+	ApproveTransfer(ctx context.Context, reference string, engine TransferEngine, actor string) (*TransferReceipt, error)
+	RejectTransfer(ctx context.Context, reference, reason, actor string) (*PendingTransfer, error)
+}
+
+type accountService struct {
+	store   Storage
+	lockout LoginLockoutPolicy
+}
+
+func NewAccountService(store Storage) AccountService {
+	return &accountService{store: store}
+}
+
+// How often a transfer is attempted when the accounts keep changing under it
+const transferConflictRetries = 3
+
+type transferService struct {
+	store      Storage
+	limits     TransferLimits
+	rates      RateProvider
+	cashback   *CashbackProgram
+	enrichment *EnrichmentPipeline
+}
+
+// cashback and enrichment may be nil when no cashback rules or enrichers are configured
+func NewTransferService(store Storage, limits TransferLimits, rates RateProvider, cashback *CashbackProgram, enrichment *EnrichmentPipeline) TransferService {
+	return &transferService{store: store, limits: limits, rates: rates, cashback: cashback, enrichment: enrichment}
+}
+
+// Services are cheap to build, they're created per call so they pick up
+// request-scoped storage from forRequest
+func (s *APIServer) accounts() AccountService {
+	return &accountService{
+		store:   s.store,
+		lockout: LoginLockoutPolicy{MaxAttempts: s.config.LoginMaxAttempts, Lockout: s.config.LoginLockout},
+	}
+}
+
+func (s *APIServer) transfers() TransferService {
+	return NewTransferService(s.store, s.transferLimits, s.rates, s.cashback, s.enrichment)
+}
+
+func (s *accountService) Login(ctx context.Context, req LoginRequest) (*LoginResponse, error) {
+	acc, err := s.store.GetAccountByNumber(ctx, int64(req.Number))
+	if err != nil {
+		return nil, err
+	}
+
+	failures, err := s.checkLoginLocked(ctx, acc)
+	if err != nil {
+		return nil, err
+	}
+	if !acc.ValidatePassword(req.Password) {
+		return nil, s.loginFailed(ctx, acc)
+	}
+	if failures.FailedAttempts > 0 {
+		if err := s.store.ClearLoginFailures(ctx, acc.ID); err != nil {
+			return nil, err
+		}
+	}
+	if passwords.NeedsRehash(acc.EncryptedPassword) {
+		s.rehashPassword(ctx, acc, req.Password)
+	}
+	return s.issueLogin(ctx, acc)
+}
+
+// issueLogin hands an authenticated owner a JWT
+func (s *accountService) issueLogin(ctx context.Context, acc *Account) (*LoginResponse, error) {
+	// Dormant owners log in to reactivate their account
+	if err := checkAccountUsable(acc); err != nil && !errors.Is(err, ErrAccountDormant) {
+		return nil, err
+	}
+	touchActivity(ctx, s.store, acc.ID)
+
+	token, err := createJWT(acc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoginResponse{
+		Number: acc.Number,
+		Token:  token,
+	}, nil
+}
+
+func (s *accountService) CreateAccount(ctx context.Context, req *CreateAccountRequest, actor string) (*Account, error) {
+	account, err := NewAccount(req.FirstName, req.LastName, req.Password)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Currency != "" {
+		if !validCurrency.MatchString(req.Currency) {
+			return nil, invalidField("currency", "currency", "must be a 3-letter ISO 4217 code")
+		}
+		account.Currency = req.Currency
+	}
+
+	if req.Email != "" {
+		if account.Email, err = normalizeEmail(req.Email); err != nil {
+			return nil, err
+		}
+	}
+
+	// Extensive logging
+	fmt.Printf("Account Creation Details:\n")
+	fmt.Printf("First Name: %s\n", account.FirstName)
+	fmt.Printf("Last Name: %s\n", account.LastName)
+	fmt.Printf("Account Number: %d\n", account.Number)
+	fmt.Printf("Created At: %v\n", account.CreatedAt)
+
+	if err := s.store.CreateAccount(ctx, account); err != nil {
+		return nil, err
+	}
+
+	recordAudit(ctx, s.store, actor, account.ID, AuditAccountCreated, diffAccounts(nil, account))
+
+	return account, nil
+}
+
+// GetAccount returns the account with its available balance next to the booked one
+func (s *accountService) GetAccount(ctx context.Context, id int) (*Account, error) {
+	acc, err := s.store.GetAccountbyID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return withAvailableBalance(ctx, s.store, acc)
+}
+
+// ListAccounts leaves out closed accounts unless includeClosed is set
+func (s *accountService) ListAccounts(ctx context.Context, includeClosed bool) ([]*Account, error) {
+	accounts, err := s.store.GetAccounts(ctx)
+	if err != nil || includeClosed {
+		return accounts, err
+	}
+
+	open := make([]*Account, 0, len(accounts))
+	for _, account := range accounts {
+		if account.Status != AccountClosed {
+			open = append(open, account)
+		}
+	}
+	return open, nil
+}
+
+// checkAccountUsable rejects accounts that can't log in or move money
+func checkAccountUsable(acc *Account) error {
+	switch acc.Status {
+	case AccountClosed:
+		return ErrAccountClosed
+	case AccountFrozen:
+		return ErrAccountFrozen
+	case AccountDormant:
+		return ErrAccountDormant
+	}
+	return nil
+}
+
+func (s *accountService) FreezeAccount(ctx context.Context, id int, actor string) (*Account, error) {
+	return s.setStatus(ctx, id, AccountActive, AccountFrozen, actor)
+}
+
+func (s *accountService) UnfreezeAccount(ctx context.Context, id int, actor string) (*Account, error) {
+	return s.setStatus(ctx, id, AccountFrozen, AccountActive, actor)
+}
+
+func (s *accountService) setStatus(ctx context.Context, id int, from, to, actor string) (*Account, error) {
+	before, err := s.store.GetAccountbyID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if before.Status == AccountClosed {
+		return nil, ErrAccountClosed
+	}
+	if before.Status != from {
+		return nil, newHTTPError(http.StatusConflict, "INVALID_STATUS", "account is %s, not %s", before.Status, from)
+	}
+
+	if err := s.store.SetAccountStatus(ctx, id, from, to); err != nil {
+		return nil, err
+	}
+
+	after := *before
+	after.Status = to
+	recordAudit(ctx, s.store, actor, id, AuditAccountUpdated, diffAccounts(before, &after))
+	return &after, nil
+}
+
+// CloseAccount replaces deletion, the account stays around for audit and
+// history. Only accounts with a zero balance can be closed.
+func (s *accountService) CloseAccount(ctx context.Context, id int, actor string) (*Account, error) {
+	before, err := s.store.GetAccountbyID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if before.Status == AccountClosed {
+		return nil, ErrAccountClosed
+	}
+	if err := checkNoLegalHolds(ctx, s.store, id); err != nil {
+		return nil, err
+	}
+	if before.Balance != 0 {
+		return nil, fmt.Errorf("%w, it holds %.2f %s", ErrBalanceNotZero, float64(before.Balance)/100, before.Currency)
+	}
+
+	closedAt := time.Now().UTC()
+	if err := s.store.CloseAccount(ctx, id, closedAt); err != nil {
+		return nil, err
+	}
+
+	after := *before
+	after.Status = AccountClosed
+	after.ClosedAt = &closedAt
+	recordAudit(ctx, s.store, actor, id, AuditAccountClosed, diffAccounts(before, &after))
+	return &after, nil
+}
+
+// Transfer validates, limit-checks and performs a transfer. It returns the
+// source account's daily usage whenever it was loaded, so callers can report
+// the remaining allowance.
+func (s *transferService) Transfer(ctx context.Context, req TransferRequest, engine TransferEngine, actor string) (*TransferReceipt, *TransferUsage, error) {
+	req, err := s.resolvePayee(ctx, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, span := tracer.Start(ctx, "transferService.Transfer", trace.WithAttributes(
+		attribute.Int64("transfer.from", req.FromAccountNumber),
+		attribute.Int64("transfer.to", req.ToAccountNumber),
+		attribute.String("transfer.kind", transferKind(ctx)),
+	))
+	receipt, usage, err := s.transfer(ctx, req, engine, actor)
+	if receipt != nil {
+		span.SetAttributes(attribute.String("transfer.reference", receipt.Reference))
+	}
+	endSpan(span, err)
+	return receipt, usage, err
+}
+
+func (s *transferService) transfer(ctx context.Context, req TransferRequest, engine TransferEngine, actor string) (*TransferReceipt, *TransferUsage, error) {
+	//Validate transfer request
+	if err := traced(ctx, "transfer.validate", func(ctx context.Context) error {
+		return s.validateTransfer(ctx, req)
+	}); err != nil {
+		return nil, nil, err
+	}
+	if err := s.checkPIN(ctx, req); err != nil {
+		return nil, nil, err
+	}
+
+	//Enforce daily limits for the source account, sweeps are exempt
+	var usage TransferUsage
+	if transferKind(ctx) == TransferKindTransfer {
+		if err := traced(ctx, "transfer.limits", func(ctx context.Context) (err error) {
+			usage, err = s.checkTransferLimits(ctx, req)
+			return err
+		}); err != nil {
+			return nil, &usage, err
+		}
+		ctx = withDailyLimits(ctx)
+	}
+
+	// The fraud rules may block a transfer or hold it for review
+	ctx, action, err := s.screenTransfer(ctx, req)
+	if err != nil {
+		return nil, &usage, err
+	}
+	if action == FraudActionBlock {
+		return nil, &usage, ErrTransferBlocked
+	}
+
+	// Large transfers wait for an admin with the amount reserved
+	if action == FraudActionReview || s.limits.needsApproval(ctx, toCents(req.Amount)) {
+		receipt, err := s.holdForApproval(ctx, req, actor)
+		return receipt, &usage, err
+	}
+
+	// Run the engine against this request's storage
+	if bound, ok := engine.(storageBoundEngine); ok {
+		engine = bound.WithStorage(s.store)
+	}
+
+	receipt, err := s.execute(ctx, req, engine, actor)
+	if err != nil {
+		return nil, &usage, err
+	}
+
+	usage.Amount += toCents(req.Amount)
+	usage.Count++
+	s.afterTransfer(ctx, req, receipt)
+	return receipt, &usage, nil
+}
+
+// execute performs the transfer, a concurrent write to either account or a
+// serialization failure is retried on fresh reads
+func (s *transferService) execute(ctx context.Context, req TransferRequest, engine TransferEngine, actor string) (*TransferReceipt, error) {
+	ctx = withTxIsolation(withPrimaryReads(ctx), s.limits.Retry.Isolation)
+	for attempt := 1; ; attempt++ {
+		attemptCtx, span := tracer.Start(ctx, "transfer.execute", trace.WithAttributes(attribute.Int("transfer.attempt", attempt)))
+		receipt, err := s.performTransfer(attemptCtx, req, engine, actor)
+		endSpan(span, err)
+		reason := retryReason(err)
+		if reason == "" {
+			return receipt, err
+		}
+		if attempt == s.limits.Retry.attempts() {
+			transferRetries.Add("exhausted", 1)
+			if reason == "serialization_failure" && !errors.Is(err, ErrSerializationFailure) {
+				err = fmt.Errorf("%w: %v", ErrSerializationFailure, err)
+			}
+			return receipt, err
+		}
+		transferRetries.Add(reason, 1)
+		log.Printf("Transfer from %d failed with a %s, retrying (attempt %d)", req.FromAccountNumber, strings.ReplaceAll(reason, "_", " "), attempt)
+		if err := s.limits.Retry.wait(ctx, attempt); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Customer transfers count as activity and may earn cashback, sweeps and adjustments don't
+func (s *transferService) afterTransfer(ctx context.Context, req TransferRequest, receipt *TransferReceipt) {
+	if transferKind(ctx) != TransferKindTransfer {
+		return
+	}
+	if from, err := s.store.GetAccountByNumber(ctx, req.FromAccountNumber); err == nil {
+		touchActivity(ctx, s.store, from.ID)
+		if s.cashback != nil {
+			s.cashback.pay(ctx, s.store, from, req)
+		}
+	}
+	if s.enrichment != nil {
+		s.enrichment.Submit(&EnrichmentInput{Receipt: receipt, Category: req.Category})
+	}
+}
+
+// checkPIN verifies the PIN of customer transfers above the PIN threshold
+func (s *transferService) checkPIN(ctx context.Context, req TransferRequest) error {
+	if transferKind(ctx) != TransferKindTransfer || !s.limits.PIN.required(toCents(req.Amount)) {
+		return nil
+	}
+	from, err := s.store.GetAccountByNumber(ctx, req.FromAccountNumber)
+	if err != nil {
+		return fmt.Errorf("invalid source account")
+	}
+	return checkTransactionPIN(ctx, s.store, s.limits.PIN, from, toCents(req.Amount), req.PIN)
+}
+
+func (s *transferService) validateTransfer(ctx context.Context, req TransferRequest) error {
+	// Validate if amount is positive
+	if req.Amount <= 0 {
+		return fmt.Errorf("transfer amount must be positive")
+	}
+
+	// Fetch source account
+	fromAccount, err := s.store.GetAccountByNumber(ctx, req.FromAccountNumber)
+	if err != nil {
+		return fmt.Errorf("invalid source account")
+	}
+
+	// Fetch destination account
+	toAccount, err := s.store.GetAccountByNumber(ctx, req.ToAccountNumber)
+	if err != nil {
+		return fmt.Errorf("invalid destination account")
+	}
+
+	// Prevent transfers to the same account
+	if fromAccount.Number == toAccount.Number {
+		return fmt.Errorf("cannot transfer to the same account")
+	}
+
+	if err := checkAccountUsable(fromAccount); err != nil {
+		return err
+	}
+	if err := checkEmailVerified(fromAccount); err != nil {
+		return err
+	}
+	// Dormant accounts can still be paid into
+	if err := checkAccountUsable(toAccount); err != nil && !errors.Is(err, ErrAccountDormant) {
+		return fmt.Errorf("destination %w", err)
+	}
+
+	// Check for sufficient balance, balances are held in cents. Accounts
+	// with an overdraft may go negative down to their limit, legal holds
+	// take their share out first. The transfer fee has to fit as well.
+	fee, err := s.transferFee(ctx, fromAccount, toCents(req.Amount))
+	if err != nil {
+		return err
+	}
+	return checkAvailable(ctx, s.store, fromAccount, toCents(req.Amount)+fee)
+}
+
+func (s *transferService) checkTransferLimits(ctx context.Context, req TransferRequest) (TransferUsage, error) {
+	fromAccount, err := s.store.GetAccountByNumber(ctx, req.FromAccountNumber)
+	if err != nil {
+		return TransferUsage{}, fmt.Errorf("invalid source account")
+	}
+	return s.checkDailyLimits(ctx, fromAccount, toCents(req.Amount))
+}
+
+// checkDailyLimits checks amount against what from has sent today
+func (s *transferService) checkDailyLimits(ctx context.Context, from *Account, amount int64) (TransferUsage, error) {
+	today, err := accountDay(ctx, s.store, from.ID, time.Now())
+	if err != nil {
+		return TransferUsage{}, err
+	}
+	usage, err := s.store.GetDailyTransferUsage(ctx, from.ID, today)
+	if err != nil {
+		return TransferUsage{}, fmt.Errorf("could not load transfer usage: %v", err)
+	}
+
+	limits, err := kycLimits(ctx, s.store, s.limits, from.ID)
+	if err != nil {
+		return *usage, err
+	}
+	return *usage, limits.Check(*usage, amount)
+}
+
+type dailyLimitsKey struct{}
+
+// withDailyLimits makes performTransfer check the daily limits again, on
+// every attempt
+func withDailyLimits(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dailyLimitsKey{}, true)
+}
+
+// Performing the actual transfer
+func (s *transferService) performTransfer(ctx context.Context, req TransferRequest, engine TransferEngine, actor string) (*TransferReceipt, error) {
+	log.Printf("Transfer Request - From: %d, To: %d, Amount: %f, Engine: %s",
+		req.FromAccountNumber, req.ToAccountNumber, req.Amount, engine.Name())
+	// Fetch source and destination accounts by number
+	fromAccount, err := s.store.GetAccountByNumber(ctx, int64(req.FromAccountNumber))
+	if err != nil {
+		return nil, fmt.Errorf("source account not found")
+	}
+
+	toAccount, err := s.store.GetAccountByNumber(ctx, int64(req.ToAccountNumber))
+	if err != nil {
+		return nil, fmt.Errorf("destination account not found")
+	}
+
+	// Cross-currency transfers are credited at the provider's current rate
+	conv, err := convert(s.rates, fromAccount, toAccount, req.Amount)
+	if err != nil {
+		return nil, err
+	}
+
+	// Checked again on the rows being posted against, their version makes
+	// the post fail if the balance moved in between. The fee is posted in
+	// the transfer's own entry so it's charged exactly when the transfer is.
+	fee, err := s.transferFee(ctx, fromAccount, toCents(conv.Debit))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAvailable(ctx, s.store, fromAccount, toCents(conv.Debit)+fee); err != nil {
+		return nil, err
+	}
+
+	// The usage is read after the source account, a concurrent transfer
+	// committed in between is counted and one committed later moves the
+	// version, so the post fails and the retry counts it. The check in
+	// transfer happens before any of that and only rejects early.
+	if checks, _ := ctx.Value(dailyLimitsKey{}).(bool); checks {
+		if _, err := s.checkDailyLimits(ctx, fromAccount, toCents(req.Amount)); err != nil {
+			return nil, err
+		}
+	}
+
+	// The engine records the transfer under this reference, the balance
+	// events link back to it. Approved transfers keep the one they were given.
+	reference := transferReference(ctx)
+	if reference == "" {
+		reference = newTransferReference()
+		ctx = withTransferReference(ctx, reference)
+	}
+	ctx = withTransferDetails(ctx, strings.TrimSpace(req.Memo), strings.TrimSpace(req.Category), fee)
+	if err := engine.Execute(ctx, fromAccount, toAccount, conv); err != nil {
+		return nil, err
+	}
+
+	// Record the balance movements against both accounts
+	auditBalanceChange(ctx, s.store, actor, fromAccount, -toCents(conv.Debit)-fee)
+	auditBalanceChange(ctx, s.store, actor, toAccount, toCents(conv.Credit))
+
+	receipt := newReceipt(reference, fromAccount, toAccount, conv, transferKind(ctx), time.Now().UTC())
+	receipt.Fee = float64(fee) / 100
+	return receipt, nil
+}
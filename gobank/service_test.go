@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransferService(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	from := &Account{Number: 1001, Balance: 5000, Currency: "USD"}
+	to := &Account{Number: 1002, Currency: "EUR"}
+	require.Nil(t, store.CreateAccount(ctx, from))
+	require.Nil(t, store.CreateAccount(ctx, to))
+
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	transfers := NewTransferService(store, TransferLimits{DailyCount: 2}, staticRateProvider{"USD:EUR": 0.5}, nil, nil)
+
+	transfer := func(from, to int64, amount float64) error {
+		_, _, err := transfers.Transfer(ctx, TransferRequest{FromAccountNumber: from, ToAccountNumber: to, Amount: amount}, engine, "test")
+		return err
+	}
+
+	assert.Error(t, transfer(1001, 1002, 0))
+	assert.Error(t, transfer(1001, 1001, 10))
+	assert.ErrorIs(t, transfer(1001, 1002, 50.01), ErrInsufficientFunds)
+
+	require.Nil(t, transfer(1001, 1002, 20))
+	fromAfter, _ := store.GetAccountbyID(ctx, from.ID)
+	toAfter, _ := store.GetAccountbyID(ctx, to.ID)
+	assert.Equal(t, int64(3000), fromAfter.Balance)
+	assert.Equal(t, int64(1000), toAfter.Balance)
+	assert.Len(t, store.audit, 2)
+
+	require.Nil(t, transfer(1001, 1002, 1))
+	var herr *httpError
+	assert.ErrorAs(t, transfer(1001, 1002, 1), &herr)
+}
+
+func TestCloseAccount(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	funded := &Account{Number: 1101, Balance: 100, Status: AccountActive}
+	empty := &Account{Number: 1102, Status: AccountActive}
+	require.Nil(t, store.CreateAccount(ctx, funded))
+	require.Nil(t, store.CreateAccount(ctx, empty))
+
+	accounts := NewAccountService(store)
+
+	_, err := accounts.CloseAccount(ctx, funded.ID, "test")
+	assert.ErrorIs(t, err, ErrBalanceNotZero)
+
+	closed, err := accounts.CloseAccount(ctx, empty.ID, "test")
+	require.Nil(t, err)
+	assert.Equal(t, AccountClosed, closed.Status)
+	assert.NotNil(t, closed.ClosedAt)
+
+	_, err = accounts.CloseAccount(ctx, empty.ID, "test")
+	assert.ErrorIs(t, err, ErrAccountClosed)
+
+	// The record is kept but only listed on request
+	listed, _ := accounts.ListAccounts(ctx, false)
+	assert.Len(t, listed, 1)
+	listed, _ = accounts.ListAccounts(ctx, true)
+	assert.Len(t, listed, 2)
+}
+
+func TestFreezeAccount(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	from := &Account{Number: 1201, Balance: 5000, Status: AccountActive}
+	to := &Account{Number: 1202, Status: AccountActive}
+	require.Nil(t, store.CreateAccount(ctx, from))
+	require.Nil(t, store.CreateAccount(ctx, to))
+
+	accounts := NewAccountService(store)
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	transfer := func() error {
+		_, _, err := NewTransferService(store, TransferLimits{}, staticRateProvider{}, nil, nil).Transfer(ctx,
+			TransferRequest{FromAccountNumber: 1201, ToAccountNumber: 1202, Amount: 1}, engine, "test")
+		return err
+	}
+
+	frozen, err := accounts.FreezeAccount(ctx, from.ID, "admin")
+	require.Nil(t, err)
+	assert.Equal(t, AccountFrozen, frozen.Status)
+	assert.ErrorIs(t, transfer(), ErrAccountFrozen)
+
+	_, err = accounts.FreezeAccount(ctx, from.ID, "admin")
+	assert.Error(t, err)
+
+	_, err = accounts.UnfreezeAccount(ctx, from.ID, "admin")
+	require.Nil(t, err)
+	assert.Nil(t, transfer())
+}
+
+// racingStorage lets another writer debit the source account right before
+// each of the first conflicts posts
+type racingStorage struct {
+	*memoryStorage
+	conflicts int
+	debit     int64
+}
+
+func (s *racingStorage) PostLedgerEntry(ctx context.Context, entry *LedgerEntry, tx Transaction) error {
+	if s.conflicts > 0 {
+		s.conflicts--
+		s.mu.Lock()
+		racer := s.accounts[entry.Postings[0].AccountID]
+		racer.Balance -= s.debit
+		racer.Version++
+		s.mu.Unlock()
+	}
+	return s.memoryStorage.PostLedgerEntry(ctx, entry, tx)
+}
+
+func TestTransferConflictRetries(t *testing.T) {
+	ctx := context.Background()
+
+	setup := func(conflicts int, debit int64) (*racingStorage, error) {
+		store := &racingStorage{memoryStorage: newMemoryStorage(), conflicts: conflicts, debit: debit}
+		require.Nil(t, store.CreateAccount(ctx, &Account{Number: 1301, Balance: 5000, Currency: "USD"}))
+		require.Nil(t, store.CreateAccount(ctx, &Account{Number: 1302, Currency: "USD"}))
+
+		engine, err := NewTransferEngine("balance", store, &Config{})
+		require.Nil(t, err)
+		_, _, err = NewTransferService(store, TransferLimits{}, staticRateProvider{}, nil, nil).
+			Transfer(ctx, TransferRequest{FromAccountNumber: 1301, ToAccountNumber: 1302, Amount: 30}, engine, "test")
+		return store, err
+	}
+
+	store, err := setup(1, 1000)
+	require.Nil(t, err)
+	from, _ := store.GetAccountByNumber(ctx, 1301)
+	assert.Equal(t, int64(1000), from.Balance, "both debits applied, neither lost")
+
+	// The retry sees the balance the other writer left behind
+	store, err = setup(1, 4000)
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	from, _ = store.GetAccountByNumber(ctx, 1301)
+	assert.Equal(t, int64(1000), from.Balance)
+
+	_, err = setup(transferConflictRetries, 10)
+	assert.ErrorIs(t, err, ErrConflict)
+	status, apiErr := apiErrorFor(err)
+	assert.Equal(t, 409, status)
+	assert.Equal(t, "CONFLICT", apiErr.Code)
+}
+
+func TestUpdateAccountVersion(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 1401, Currency: "USD"}))
+
+	first, _ := store.GetAccountByNumber(ctx, 1401)
+	second, _ := store.GetAccountByNumber(ctx, 1401)
+	first.FirstName = "Ada"
+	require.Nil(t, store.UpdateAccount(ctx, first))
+	second.FirstName = "Grace"
+	assert.ErrorIs(t, store.UpdateAccount(ctx, second), ErrConflict)
+
+	// The winner can keep writing with the version it got back
+	first.LastName = "Lovelace"
+	require.Nil(t, store.UpdateAccount(ctx, first))
+}
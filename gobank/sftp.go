@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A minimal SFTP (version 3) client, just enough to upload a file, move it
+// into place and check what arrived: open, write, close, remove, rename and
+// stat. Requests are sent one at a time, which is plenty for a few daily
+// files. See draft-ietf-secsh-filexfer-02.
+
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpWrite    = 6
+	sftpRemove   = 13
+	sftpRename   = 18
+	sftpStat     = 17
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpAttrs    = 105
+	sftpProtocol = 3
+
+	sftpFlagWrite    = 0x02
+	sftpFlagCreate   = 0x08
+	sftpFlagTruncate = 0x10
+	sftpAttrSize     = 0x01
+
+	sftpStatusOK     = 0
+	sftpStatusNoFile = 2
+
+	// Servers must accept at least 32KB of data per write
+	sftpChunkSize = 32 * 1024
+)
+
+type sftpStatusError struct {
+	Code    uint32
+	Message string
+}
+
+func (e *sftpStatusError) Error() string {
+	return fmt.Sprintf("sftp: status %d: %s", e.Code, e.Message)
+}
+
+type sftpClient struct {
+	mu     sync.Mutex
+	w      io.WriteCloser
+	r      io.Reader
+	nextID uint32
+	close  func() error
+}
+
+// dialSFTP opens an SSH connection with the sftp subsystem. The host key
+// must match hostKey, an authorized_keys style line.
+func dialSFTP(addr, user, keyFile, hostKey string) (*sftpClient, error) {
+	pem, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("sftp: private key: %v", err)
+	}
+	known, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hostKey))
+	if err != nil {
+		return nil, fmt.Errorf("sftp: host key: %v", err)
+	}
+
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.FixedHostKey(known),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := conn.NewSession()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	w, err := session.StdinPipe()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	client, err := newSFTPClient(r, w)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	client.close = func() error {
+		session.Close()
+		return conn.Close()
+	}
+	return client, nil
+}
+
+// newSFTPClient runs the version handshake over an open subsystem stream
+func newSFTPClient(r io.Reader, w io.WriteCloser) (*sftpClient, error) {
+	c := &sftpClient{r: r, w: w, close: w.Close}
+
+	if err := c.send(sftpInit, uint32(sftpProtocol)); err != nil {
+		return nil, err
+	}
+	typ, payload, err := c.recv()
+	if err != nil {
+		return nil, err
+	}
+	if typ != sftpVersion || len(payload) < 4 {
+		return nil, fmt.Errorf("sftp: unexpected handshake reply %d", typ)
+	}
+	if v := binary.BigEndian.Uint32(payload); v < sftpProtocol {
+		return nil, fmt.Errorf("sftp: server speaks version %d, need %d", v, sftpProtocol)
+	}
+	return c, nil
+}
+
+func (c *sftpClient) Close() error {
+	return c.close()
+}
+
+// Upload writes data to name through a temporary file, replacing any
+// existing file, and returns the size the server reports for it
+func (c *sftpClient) Upload(name string, data []byte) (int64, error) {
+	partial := path.Join(path.Dir(name), "."+path.Base(name)+".part")
+
+	handle, err := c.open(partial)
+	if err != nil {
+		return 0, err
+	}
+	for offset := 0; offset < len(data); offset += sftpChunkSize {
+		chunk := data[offset:min(offset+sftpChunkSize, len(data))]
+		if err := c.expectStatus(sftpWrite, handle, uint64(offset), chunk); err != nil {
+			c.expectStatus(sftpClose, handle)
+			return 0, err
+		}
+	}
+	if err := c.expectStatus(sftpClose, handle); err != nil {
+		return 0, err
+	}
+
+	// Version 3 rename refuses to overwrite, so a re-delivery removes first
+	var serr *sftpStatusError
+	if err := c.expectStatus(sftpRemove, name); err != nil && !(errors.As(err, &serr) && serr.Code == sftpStatusNoFile) {
+		return 0, err
+	}
+	if err := c.expectStatus(sftpRename, partial, name); err != nil {
+		return 0, err
+	}
+	return c.size(name)
+}
+
+func (c *sftpClient) open(name string) (string, error) {
+	typ, payload, err := c.request(sftpOpen, name, uint32(sftpFlagWrite|sftpFlagCreate|sftpFlagTruncate), uint32(0))
+	if err != nil {
+		return "", err
+	}
+	if typ != sftpHandle {
+		return "", unexpectedReply(typ, payload)
+	}
+	handle, _, err := readString(payload)
+	return handle, err
+}
+
+func (c *sftpClient) size(name string) (int64, error) {
+	typ, payload, err := c.request(sftpStat, name)
+	if err != nil {
+		return 0, err
+	}
+	if typ != sftpAttrs {
+		return 0, unexpectedReply(typ, payload)
+	}
+	if len(payload) < 12 || binary.BigEndian.Uint32(payload)&sftpAttrSize == 0 {
+		return 0, fmt.Errorf("sftp: server didn't report the size of %s", name)
+	}
+	return int64(binary.BigEndian.Uint64(payload[4:])), nil
+}
+
+func (c *sftpClient) expectStatus(typ byte, args ...any) error {
+	reply, payload, err := c.request(typ, args...)
+	if err != nil {
+		return err
+	}
+	if reply != sftpStatus {
+		return unexpectedReply(reply, payload)
+	}
+	return statusError(payload)
+}
+
+// request sends a packet with a fresh request ID and reads its reply,
+// returning the reply's payload after the ID
+func (c *sftpClient) request(typ byte, args ...any) (byte, []byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nextID++
+	id := c.nextID
+	if err := c.send(typ, append([]any{id}, args...)...); err != nil {
+		return 0, nil, err
+	}
+
+	reply, payload, err := c.recv()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(payload) < 4 || binary.BigEndian.Uint32(payload) != id {
+		return 0, nil, fmt.Errorf("sftp: reply for the wrong request")
+	}
+	return reply, payload[4:], nil
+}
+
+func (c *sftpClient) send(typ byte, args ...any) error {
+	packet := []byte{0, 0, 0, 0, typ}
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case uint32:
+			packet = binary.BigEndian.AppendUint32(packet, v)
+		case uint64:
+			packet = binary.BigEndian.AppendUint64(packet, v)
+		case string:
+			packet = binary.BigEndian.AppendUint32(packet, uint32(len(v)))
+			packet = append(packet, v...)
+		case []byte:
+			packet = binary.BigEndian.AppendUint32(packet, uint32(len(v)))
+			packet = append(packet, v...)
+		default:
+			panic(fmt.Sprintf("sftp: can't encode %T", arg))
+		}
+	}
+	binary.BigEndian.PutUint32(packet, uint32(len(packet)-4))
+	_, err := c.w.Write(packet)
+	return err
+}
+
+func (c *sftpClient) recv() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > 256*1024 {
+		return 0, nil, fmt.Errorf("sftp: bad packet length %d", length)
+	}
+	payload := make([]byte, length-1)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[4], payload, nil
+}
+
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 4 || uint32(len(b)-4) < binary.BigEndian.Uint32(b) {
+		return "", nil, fmt.Errorf("sftp: truncated string")
+	}
+	n := binary.BigEndian.Uint32(b)
+	return string(b[4 : 4+n]), b[4+n:], nil
+}
+
+func statusError(payload []byte) error {
+	if len(payload) < 4 {
+		return fmt.Errorf("sftp: truncated status")
+	}
+	code := binary.BigEndian.Uint32(payload)
+	if code == sftpStatusOK {
+		return nil
+	}
+	msg, _, _ := readString(payload[4:])
+	return &sftpStatusError{Code: code, Message: strings.TrimSpace(msg)}
+}
+
+func unexpectedReply(typ byte, payload []byte) error {
+	if typ == sftpStatus {
+		if err := statusError(payload); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("sftp: unexpected reply %d", typ)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSFTPServer answers the requests sftpClient sends, keeping files in memory
+type fakeSFTPServer struct {
+	files   map[string][]byte
+	open    map[string]string // handle to path
+	renames []string
+}
+
+func (f *fakeSFTPServer) serve(r io.Reader, w io.Writer) {
+	c := &sftpClient{r: r, w: nopWriteCloser{w}}
+	for {
+		typ, payload, err := c.recv()
+		if err != nil {
+			return
+		}
+		if typ == sftpInit {
+			c.send(sftpVersion, uint32(sftpProtocol))
+			continue
+		}
+
+		id, payload := binary.BigEndian.Uint32(payload), payload[4:]
+		str := func() string {
+			s, rest, _ := readString(payload)
+			payload = rest
+			return s
+		}
+		status := func(code uint32) { c.send(sftpStatus, id, code, "", "") }
+
+		switch typ {
+		case sftpOpen:
+			name := str()
+			f.files[name] = nil
+			f.open["h1"] = name
+			c.send(sftpHandle, id, "h1")
+		case sftpWrite:
+			name := f.open[str()]
+			offset := binary.BigEndian.Uint64(payload)
+			data, _, _ := readString(payload[8:])
+			buf := f.files[name]
+			for uint64(len(buf)) < offset+uint64(len(data)) {
+				buf = append(buf, 0)
+			}
+			copy(buf[offset:], data)
+			f.files[name] = buf
+			status(sftpStatusOK)
+		case sftpClose:
+			delete(f.open, str())
+			status(sftpStatusOK)
+		case sftpRemove:
+			name := str()
+			if _, ok := f.files[name]; !ok {
+				status(sftpStatusNoFile)
+				continue
+			}
+			delete(f.files, name)
+			status(sftpStatusOK)
+		case sftpRename:
+			from, to := str(), str()
+			f.files[to] = f.files[from]
+			delete(f.files, from)
+			f.renames = append(f.renames, from+" -> "+to)
+			status(sftpStatusOK)
+		case sftpStat:
+			data, ok := f.files[str()]
+			if !ok {
+				status(sftpStatusNoFile)
+				continue
+			}
+			c.send(sftpAttrs, id, uint32(sftpAttrSize), uint64(len(data)))
+		default:
+			status(8) // unsupported
+		}
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestSFTPUpload(t *testing.T) {
+	clientR, serverW := io.Pipe()
+	serverR, clientW := io.Pipe()
+	server := &fakeSFTPServer{files: map[string][]byte{"out/balances.csv": []byte("old")}, open: map[string]string{}}
+	go server.serve(serverR, serverW)
+	defer clientW.Close()
+
+	client, err := newSFTPClient(clientR, clientW)
+	require.Nil(t, err)
+
+	// Bigger than one write so it's chunked
+	data := make([]byte, sftpChunkSize*2+10)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	size, err := client.Upload("out/balances.csv", data)
+	require.Nil(t, err)
+	assert.Equal(t, int64(len(data)), size)
+	assert.Equal(t, data, server.files["out/balances.csv"])
+	assert.Equal(t, []string{"out/.balances.csv.part -> out/balances.csv"}, server.renames)
+	assert.Len(t, server.files, 1)
+
+	_, err = client.size("out/missing.csv")
+	var serr *sftpStatusError
+	require.ErrorAs(t, err, &serr)
+	assert.Equal(t, uint32(sftpStatusNoFile), serr.Code)
+}
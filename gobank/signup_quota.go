@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Account creation is counted per client IP and per device (X-Device-ID) for
+// each UTC day. Past the soft limit a solved CAPTCHA is required, past the
+// hard limit signups are refused until the next day. Admins bypass both.
+const (
+	deviceIDHeader     = "X-Device-ID"
+	captchaTokenHeader = "X-Captcha-Token"
+)
+
+var validDeviceID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// QuotaCounter keeps counters that expire on their own
+type QuotaCounter interface {
+	Count(key string) (int, error)
+	Incr(key string, ttl time.Duration) (int, error)
+}
+
+func NewQuotaCounter(cfg *Config) (QuotaCounter, error) {
+	if cfg.RedisURL == "" {
+		return NewMemoryQuotaCounter(), nil
+	}
+
+	opts, err := redis.ParseURL(cfg.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %v", err)
+	}
+	return &RedisQuotaCounter{client: redis.NewClient(opts)}, nil
+}
+
+type quotaEntry struct {
+	count     int
+	expiresAt time.Time
+}
+
+type MemoryQuotaCounter struct {
+	mu      sync.Mutex
+	entries map[string]*quotaEntry
+	now     func() time.Time
+}
+
+func NewMemoryQuotaCounter() *MemoryQuotaCounter {
+	return &MemoryQuotaCounter{entries: map[string]*quotaEntry{}, now: time.Now}
+}
+
+func (c *MemoryQuotaCounter) Count(key string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || c.now().After(e.expiresAt) {
+		return 0, nil
+	}
+	return e.count, nil
+}
+
+func (c *MemoryQuotaCounter) Incr(key string, ttl time.Duration) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for k, e := range c.entries {
+		if now.After(e.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+
+	e, ok := c.entries[key]
+	if !ok {
+		e = &quotaEntry{expiresAt: now.Add(ttl)}
+		c.entries[key] = e
+	}
+	e.count++
+	return e.count, nil
+}
+
+type RedisQuotaCounter struct {
+	client *redis.Client
+}
+
+func (c *RedisQuotaCounter) Count(key string) (int, error) {
+	n, err := c.client.Get(context.Background(), "quota:"+key).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
+
+func (c *RedisQuotaCounter) Incr(key string, ttl time.Duration) (int, error) {
+	ctx := context.Background()
+	pipe := c.client.TxPipeline()
+	incr := pipe.Incr(ctx, "quota:"+key)
+	pipe.ExpireNX(ctx, "quota:"+key, ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return int(incr.Val()), nil
+}
+
+// CaptchaVerifier checks a token solved by the client. The default verifier
+// speaks the siteverify protocol shared by reCAPTCHA, hCaptcha and Turnstile.
+type CaptchaVerifier interface {
+	Verify(token, remoteIP string) (bool, error)
+}
+
+type siteVerifyCaptcha struct {
+	url        string
+	secret     string
+	httpClient *http.Client
+}
+
+func NewCaptchaVerifier(cfg *Config) CaptchaVerifier {
+	if cfg.CaptchaVerifyURL == "" {
+		return nil
+	}
+	return &siteVerifyCaptcha{
+		url:        cfg.CaptchaVerifyURL,
+		secret:     cfg.CaptchaSecret,
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (c *siteVerifyCaptcha) Verify(token, remoteIP string) (bool, error) {
+	resp, err := c.httpClient.PostForm(c.url, url.Values{
+		"secret":   {c.secret},
+		"response": {token},
+		"remoteip": {remoteIP},
+	})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return false, fmt.Errorf("invalid captcha verify response: %v", err)
+	}
+	return body.Success, nil
+}
+
+type signupQuota struct {
+	counter   QuotaCounter
+	captcha   CaptchaVerifier
+	softLimit int
+	hardLimit int
+	config    *Config
+}
+
+// signupQuotaKeys are the counters a signup request is charged against
+func signupQuotaKeys(r *http.Request, day time.Time) []string {
+	suffix := ":" + day.Format("2006-01-02")
+	keys := []string{"signup:ip:" + clientIP(r) + suffix}
+	if device := r.Header.Get(deviceIDHeader); validDeviceID.MatchString(device) {
+		keys = append(keys, "signup:device:"+device+suffix)
+	}
+	return keys
+}
+
+func withSignupQuota(handler http.HandlerFunc, q *signupQuota) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isAdminToken(r.Header.Get("x-admin-token"), q.config) {
+			handler(w, r)
+			return
+		}
+
+		now := time.Now().UTC()
+		day := startOfDay(now)
+		keys := signupQuotaKeys(r, day)
+
+		used := 0
+		for _, key := range keys {
+			n, err := q.counter.Count(key)
+			if err != nil {
+				// Fail open like the rate limiter
+				log.Printf("Signup quota store error: %v", err)
+				continue
+			}
+			used = max(used, n)
+		}
+
+		if q.hardLimit > 0 && used >= q.hardLimit {
+			retryAfter := day.Add(24 * time.Hour).Sub(now)
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			WriteJSON(w, http.StatusTooManyRequests, ApiError{Error: "daily account creation limit reached", Code: "SIGNUP_QUOTA_EXCEEDED"})
+			return
+		}
+
+		if q.softLimit > 0 && used >= q.softLimit && !q.verifyCaptcha(r) {
+			WriteJSON(w, http.StatusForbidden, ApiError{Error: "captcha required", Code: "CAPTCHA_REQUIRED"})
+			return
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(sw, r)
+		if sw.status >= 400 {
+			return
+		}
+
+		for _, key := range keys {
+			if _, err := q.counter.Incr(key, 25*time.Hour); err != nil {
+				log.Printf("Signup quota store error: %v", err)
+			}
+		}
+	})
+}
+
+func (q *signupQuota) verifyCaptcha(r *http.Request) bool {
+	token := r.Header.Get(captchaTokenHeader)
+	if q.captcha == nil || token == "" {
+		return false
+	}
+
+	ok, err := q.captcha.Verify(token, clientIP(r))
+	if err != nil {
+		log.Printf("Captcha verification failed: %v", err)
+		return false
+	}
+	return ok
+}
+
+// statusWriter remembers the status code written by a handler
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the connection, event streams flush through it
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Hijack hands the connection to the WebSocket upgrader, which doesn't unwrap writers
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
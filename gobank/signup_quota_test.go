@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type stubCaptcha bool
+
+func (c stubCaptcha) Verify(token, remoteIP string) (bool, error) {
+	return bool(c), nil
+}
+
+func TestWithSignupQuota(t *testing.T) {
+	q := &signupQuota{
+		counter:   NewMemoryQuotaCounter(),
+		captcha:   stubCaptcha(true),
+		softLimit: 1,
+		hardLimit: 2,
+		config:    &Config{AdminToken: "secret"},
+	}
+	handler := withSignupQuota(func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, map[string]string{})
+	}, q)
+
+	signup := func(headers map[string]string) int {
+		req := httptest.NewRequest("POST", "/account", nil)
+		req.RemoteAddr = "10.0.0.1:4000"
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, signup(nil))
+	assert.Equal(t, http.StatusForbidden, signup(nil))
+	assert.Equal(t, http.StatusOK, signup(map[string]string{captchaTokenHeader: "solved"}))
+	assert.Equal(t, http.StatusTooManyRequests, signup(map[string]string{captchaTokenHeader: "solved"}))
+
+	// Admins aren't subject to the quota
+	assert.Equal(t, http.StatusOK, signup(map[string]string{"x-admin-token": "secret"}))
+}
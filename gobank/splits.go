@@ -0,0 +1,591 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A customer splits a bill by asking other accounts for a share of it.
+// Shares are even, the requester's own share included, unless amounts are
+// given for each participant, the requester covers whatever the shares
+// don't. Each participant pays or declines their share, paying is an
+// ordinary transfer to the requester so limits, fees and PINs apply. A
+// share being paid is claimed first so it can't be paid twice. A payment
+// held for approval or fraud review keeps the share held until an admin
+// approves the transfer, which pays it, or rejects it, which leaves it to
+// pay again. The split completes once no share is pending or held, the
+// requester can cancel it before then and the pending shares with it.
+
+const (
+	SplitOpen      = "open"
+	SplitCompleted = "completed"
+	SplitCancelled = "cancelled"
+
+	SharePending   = "pending"
+	SharePaying    = "paying" // claimed while the transfer runs
+	ShareHeld      = "held"   // its transfer waits for approval
+	SharePaid      = "paid"
+	ShareDeclined  = "declined"
+	ShareCancelled = "cancelled"
+
+	AuditSplitCreated   = "split.created"
+	AuditSplitCancelled = "split.cancelled"
+
+	maxSplitParticipants = 20
+)
+
+type SplitBill struct {
+	ID            int        `json:"id"`
+	AccountID     int        `json:"account_id"` // the requester, who's paid the shares
+	AccountNumber int64      `json:"account_number"`
+	Description   string     `json:"description"`
+	Amount        float64    `json:"amount"`
+	Currency      string     `json:"currency"`
+	Status        string     `json:"status"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ResolvedAt    *time.Time `json:"resolved_at,omitempty"`
+
+	Shares  []*SplitShare `json:"shares"`
+	Summary SplitSummary  `json:"summary"`
+}
+
+// SplitShare is what one participant owes, RequestedBy is the requester's account number
+type SplitShare struct {
+	ID                int        `json:"id"`
+	SplitID           int        `json:"split_id"`
+	AccountID         int        `json:"account_id"`
+	AccountNumber     int64      `json:"account_number"`
+	Amount            float64    `json:"amount"`
+	Currency          string     `json:"currency"`
+	Description       string     `json:"description"`
+	RequestedBy       int64      `json:"requested_by"`
+	Status            string     `json:"status"`
+	TransferReference string     `json:"transfer_reference,omitempty"`
+	RespondedAt       *time.Time `json:"responded_at,omitempty"`
+}
+
+// SplitSummary adds up the shares for the requester
+type SplitSummary struct {
+	Paid          float64 `json:"paid"`
+	Outstanding   float64 `json:"outstanding"`
+	Declined      float64 `json:"declined"`
+	PaidCount     int     `json:"paid_count"`
+	PendingCount  int     `json:"pending_count"`
+	DeclinedCount int     `json:"declined_count"`
+}
+
+type SplitParticipant struct {
+	AccountNumber int64   `json:"accountNumber" validate:"required,positive"`
+	Amount        float64 `json:"amount,omitempty" validate:"min=0.01"` // left out for an even split
+}
+
+type CreateSplitRequest struct {
+	Description  string             `json:"description" validate:"required,max=100"`
+	Amount       float64            `json:"amount" validate:"positive"`
+	Participants []SplitParticipant `json:"participants" validate:"required"`
+}
+
+type PaySplitShareRequest struct {
+	PIN string `json:"pin,omitempty" validate:"numeric,min=4,max=6"` // needed above TRANSACTION_PIN_THRESHOLD
+}
+
+type PaySplitShareResponse struct {
+	Share   *SplitShare      `json:"share"`
+	Receipt *TransferReceipt `json:"receipt"`
+}
+
+func (split *SplitBill) summarize() {
+	var paid, outstanding, declined int64
+	split.Summary = SplitSummary{}
+	for _, share := range split.Shares {
+		switch share.Status {
+		case SharePaid:
+			paid += toCents(share.Amount)
+			split.Summary.PaidCount++
+		case SharePending, SharePaying, ShareHeld:
+			outstanding += toCents(share.Amount)
+			split.Summary.PendingCount++
+		case ShareDeclined:
+			declined += toCents(share.Amount)
+			split.Summary.DeclinedCount++
+		}
+	}
+	split.Summary.Paid = float64(paid) / 100
+	split.Summary.Outstanding = float64(outstanding) / 100
+	split.Summary.Declined = float64(declined) / 100
+}
+
+// splitShares works out each participant's share in cents
+func splitShares(total int64, participants []SplitParticipant) ([]int64, error) {
+	amounts := make([]int64, len(participants))
+	if participants[0].Amount == 0 {
+		each := total / int64(len(participants)+1)
+		for i, p := range participants {
+			if p.Amount != 0 {
+				return nil, invalidField("participants", "mixed", "must all have an amount or none")
+			}
+			amounts[i] = each
+		}
+		if each == 0 {
+			return nil, invalidField("amount", "min", "is too small to split between this many accounts")
+		}
+		return amounts, nil
+	}
+
+	var sum int64
+	for i, p := range participants {
+		if p.Amount == 0 {
+			return nil, invalidField("participants", "mixed", "must all have an amount or none")
+		}
+		amounts[i] = toCents(p.Amount)
+		sum += amounts[i]
+	}
+	if sum > total {
+		return nil, invalidField("participants", "max", "shares add up to more than the amount")
+	}
+	return amounts, nil
+}
+
+type SplitService interface {
+	Create(ctx context.Context, accountID int, req CreateSplitRequest, actor string) (*SplitBill, error)
+	Get(ctx context.Context, accountID, id int) (*SplitBill, error)
+	List(ctx context.Context, accountID int) ([]*SplitBill, error)
+	Shares(ctx context.Context, accountID int) ([]*SplitShare, error)
+	Pay(ctx context.Context, accountID, shareID int, req PaySplitShareRequest, engine TransferEngine, actor string) (*SplitShare, *TransferReceipt, error)
+	Decline(ctx context.Context, accountID, shareID int) (*SplitShare, error)
+	Cancel(ctx context.Context, accountID, id int, actor string) (*SplitBill, error)
+	Settle(ctx context.Context, reference string) error
+}
+
+type splitService struct {
+	store     Storage
+	transfers TransferService
+	notifier  Notifier
+}
+
+func NewSplitService(store Storage, transfers TransferService, notifier Notifier) SplitService {
+	return &splitService{store: store, transfers: transfers, notifier: notifier}
+}
+
+func (s *APIServer) splits() SplitService {
+	return NewSplitService(s.store, s.transfers(), s.notifier)
+}
+
+func (s *splitService) Create(ctx context.Context, accountID int, req CreateSplitRequest, actor string) (*SplitBill, error) {
+	if len(req.Participants) == 0 {
+		return nil, invalidField("participants", "required", "is required")
+	}
+	if len(req.Participants) > maxSplitParticipants {
+		return nil, invalidField("participants", "max", fmt.Sprintf("may list at most %d accounts", maxSplitParticipants))
+	}
+	acc, err := s.store.GetAccountbyID(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAccountUsable(acc); err != nil {
+		return nil, err
+	}
+
+	amounts, err := splitShares(toCents(req.Amount), req.Participants)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	split := &SplitBill{
+		AccountID:     accountID,
+		AccountNumber: acc.Number,
+		Description:   strings.TrimSpace(req.Description),
+		Amount:        req.Amount,
+		Currency:      acc.Currency,
+		Status:        SplitOpen,
+		CreatedAt:     now,
+	}
+
+	// Participants are open accounts in the requester's currency, once each
+	verr := &ValidationError{}
+	seen := map[int64]bool{acc.Number: true}
+	for i, p := range req.Participants {
+		field := jsonPointer("participants", strconv.Itoa(i), "accountNumber")
+		participant, err := s.store.GetAccountByNumber(ctx, p.AccountNumber)
+		switch {
+		case seen[p.AccountNumber]:
+			verr.Fields = append(verr.Fields, FieldError{Field: field, Code: "unique", Message: "is already in the split"})
+		case err != nil || participant.Status == AccountClosed:
+			verr.Fields = append(verr.Fields, FieldError{Field: field, Code: "exists", Message: "is not an open account"})
+		case participant.Currency != acc.Currency:
+			verr.Fields = append(verr.Fields, FieldError{Field: field, Code: "currency", Message: "must hold " + acc.Currency})
+		default:
+			split.Shares = append(split.Shares, &SplitShare{
+				AccountID:     participant.ID,
+				AccountNumber: participant.Number,
+				Amount:        float64(amounts[i]) / 100,
+				Currency:      acc.Currency,
+				Description:   split.Description,
+				RequestedBy:   acc.Number,
+				Status:        SharePending,
+			})
+		}
+		seen[p.AccountNumber] = true
+	}
+	if len(verr.Fields) > 0 {
+		return nil, verr
+	}
+
+	if err := s.store.CreateSplit(ctx, split); err != nil {
+		return nil, err
+	}
+	recordAudit(ctx, s.store, actor, accountID, AuditSplitCreated, []FieldChange{{Field: "split", Old: nil, New: split.ID}})
+
+	for _, share := range split.Shares {
+		message := fmt.Sprintf("Account %d asked you to pay %.2f %s for %q", acc.Number, share.Amount, share.Currency, split.Description)
+		if err := s.notifier.Notify(share.AccountID, "Split bill", message); err != nil {
+			log.Printf("Failed to notify account %d of split %d: %v", share.AccountID, split.ID, err)
+		}
+	}
+	split.summarize()
+	return split, nil
+}
+
+// Get loads one of the account's splits, others look like they don't exist
+func (s *splitService) Get(ctx context.Context, accountID, id int) (*SplitBill, error) {
+	split, err := s.store.GetSplit(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if split.AccountID != accountID {
+		return nil, fmt.Errorf("%w: %d", ErrSplitNotFound, id)
+	}
+	split.summarize()
+	return split, nil
+}
+
+func (s *splitService) List(ctx context.Context, accountID int) ([]*SplitBill, error) {
+	splits, err := s.store.GetSplits(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	for _, split := range splits {
+		split.summarize()
+	}
+	return splits, nil
+}
+
+func (s *splitService) Shares(ctx context.Context, accountID int) ([]*SplitShare, error) {
+	return s.store.GetSplitShares(ctx, accountID)
+}
+
+// share loads one of the account's shares that's still pending
+func (s *splitService) share(ctx context.Context, accountID, id int) (*SplitShare, error) {
+	share, err := s.store.GetSplitShare(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if share.AccountID != accountID {
+		return nil, fmt.Errorf("%w: %d", ErrSplitShareNotFound, id)
+	}
+	if share.Status != SharePending {
+		return nil, ErrSplitShareResolved
+	}
+	return share, nil
+}
+
+func (s *splitService) Pay(ctx context.Context, accountID, shareID int, req PaySplitShareRequest, engine TransferEngine, actor string) (*SplitShare, *TransferReceipt, error) {
+	share, err := s.share(ctx, accountID, shareID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	share.Status = SharePaying
+	claimed, err := s.store.ResolveSplitShare(ctx, share, SharePending)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !claimed {
+		return nil, nil, ErrSplitShareResolved
+	}
+
+	receipt, _, err := s.transfers.Transfer(ctx, TransferRequest{
+		FromAccountNumber: share.AccountNumber,
+		ToAccountNumber:   share.RequestedBy,
+		Amount:            share.Amount,
+		Memo:              "Split: " + share.Description,
+		PIN:               req.PIN,
+	}, engine, actor)
+	if err != nil {
+		share.Status = SharePending
+		if _, rerr := s.store.ResolveSplitShare(ctx, share, SharePaying); rerr != nil {
+			log.Printf("Failed to release split share %d: %v", share.ID, rerr)
+		}
+		return nil, nil, err
+	}
+
+	// No money has moved yet for a held transfer
+	if receipt.Status == TransferPendingApproval {
+		share.Status, share.TransferReference = ShareHeld, receipt.Reference
+		if _, err := s.store.ResolveSplitShare(ctx, share, SharePaying); err != nil {
+			return nil, receipt, fmt.Errorf("split share %d is held by %s but not marked held: %v", share.ID, receipt.Reference, err)
+		}
+		return share, receipt, nil
+	}
+
+	now := time.Now().UTC()
+	share.Status, share.TransferReference, share.RespondedAt = SharePaid, receipt.Reference, &now
+	if _, err := s.store.ResolveSplitShare(ctx, share, SharePaying); err != nil {
+		return nil, receipt, fmt.Errorf("split share %d was paid by %s but not marked paid: %v", share.ID, receipt.Reference, err)
+	}
+	s.responded(ctx, share)
+	return share, receipt, nil
+}
+
+// Settle moves a held share on once its transfer is resolved, paid when it
+// completed and pending again when it was rejected or failed
+func (s *splitService) Settle(ctx context.Context, reference string) error {
+	share, err := s.store.GetSplitShareByTransfer(ctx, reference)
+	if errors.Is(err, ErrSplitShareNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if share.Status != ShareHeld {
+		return nil
+	}
+	pt, err := s.store.GetPendingTransfer(ctx, reference)
+	if err != nil {
+		return err
+	}
+
+	switch pt.Status {
+	case TransferCompleted:
+		now := time.Now().UTC()
+		share.Status, share.RespondedAt = SharePaid, &now
+	case TransferRejected, TransferFailed:
+		share.Status, share.TransferReference = SharePending, ""
+	default:
+		return nil
+	}
+	settled, err := s.store.ResolveSplitShare(ctx, share, ShareHeld)
+	if err != nil || !settled {
+		return err
+	}
+	if share.Status == SharePaid {
+		s.responded(ctx, share)
+	}
+	return nil
+}
+
+func (s *splitService) Decline(ctx context.Context, accountID, shareID int) (*SplitShare, error) {
+	share, err := s.share(ctx, accountID, shareID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	share.Status, share.RespondedAt = ShareDeclined, &now
+	declined, err := s.store.ResolveSplitShare(ctx, share, SharePending)
+	if err != nil {
+		return nil, err
+	}
+	if !declined {
+		return nil, ErrSplitShareResolved
+	}
+	s.responded(ctx, share)
+	return share, nil
+}
+
+// responded tells the requester and completes the split after its last share
+func (s *splitService) responded(ctx context.Context, share *SplitShare) {
+	split, err := s.store.GetSplit(ctx, share.SplitID)
+	if err != nil {
+		log.Printf("Failed to load split %d: %v", share.SplitID, err)
+		return
+	}
+	split.summarize()
+
+	message := fmt.Sprintf("Account %d %s their %.2f %s share of %q", share.AccountNumber, share.Status, share.Amount, share.Currency, split.Description)
+	if split.Status == SplitOpen && split.Summary.PendingCount == 0 {
+		now := time.Now().UTC()
+		split.Status, split.ResolvedAt = SplitCompleted, &now
+		if _, err := s.store.ResolveSplit(ctx, split, SplitOpen); err != nil {
+			log.Printf("Failed to complete split %d: %v", split.ID, err)
+		}
+		message += fmt.Sprintf(", %.2f %s of it was paid", split.Summary.Paid, split.Currency)
+	}
+	if err := s.notifier.Notify(split.AccountID, "Split bill", message); err != nil {
+		log.Printf("Failed to notify account %d of split %d: %v", split.AccountID, split.ID, err)
+	}
+}
+
+// Cancel stops the split, shares already paid stay paid
+func (s *splitService) Cancel(ctx context.Context, accountID, id int, actor string) (*SplitBill, error) {
+	split, err := s.Get(ctx, accountID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	split.Status, split.ResolvedAt = SplitCancelled, &now
+	cancelled, err := s.store.ResolveSplit(ctx, split, SplitOpen)
+	if err != nil {
+		return nil, err
+	}
+	if !cancelled {
+		return nil, ErrSplitResolved
+	}
+
+	for _, share := range split.Shares {
+		if share.Status != SharePending {
+			continue
+		}
+		share.Status, share.RespondedAt = ShareCancelled, &now
+		if _, err := s.store.ResolveSplitShare(ctx, share, SharePending); err != nil {
+			log.Printf("Failed to cancel split share %d: %v", share.ID, err)
+		}
+	}
+	recordAudit(ctx, s.store, actor, accountID, AuditSplitCancelled, []FieldChange{{Field: "split", Old: split.ID, New: nil}})
+
+	split.summarize()
+	return split, nil
+}
+
+func splitID(r *http.Request) (int, error) {
+	return pathID(r, "splitID")
+}
+
+func splitShareID(r *http.Request) (int, error) {
+	return pathID(r, "shareID")
+}
+
+// GET /account/{id}/splits
+func (s *APIServer) handleGetSplits(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	splits, err := s.forRequest(r).splits().List(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, splits)
+}
+
+// POST /account/{id}/splits
+func (s *APIServer) handleCreateSplit(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	s = s.forRequest(r)
+
+	var req CreateSplitRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+	split, err := s.splits().Create(r.Context(), id, req, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusCreated, split)
+}
+
+// GET /account/{id}/splits/{splitID}
+func (s *APIServer) handleGetSplit(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	sID, err := splitID(r)
+	if err != nil {
+		return err
+	}
+
+	split, err := s.forRequest(r).splits().Get(r.Context(), id, sID)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, split)
+}
+
+// DELETE /account/{id}/splits/{splitID}
+func (s *APIServer) handleCancelSplit(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	sID, err := splitID(r)
+	if err != nil {
+		return err
+	}
+	s = s.forRequest(r)
+
+	split, err := s.splits().Cancel(r.Context(), id, sID, auditActor(r, s.config))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, split)
+}
+
+// GET /account/{id}/split-shares, the shares other accounts asked this one to pay
+func (s *APIServer) handleGetSplitShares(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	shares, err := s.forRequest(r).splits().Shares(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, shares)
+}
+
+// POST /account/{id}/split-shares/{shareID}/pay
+func (s *APIServer) handlePaySplitShare(engine TransferEngine) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		id, err := getID(r)
+		if err != nil {
+			return err
+		}
+		shareID, err := splitShareID(r)
+		if err != nil {
+			return err
+		}
+		s := s.forRequest(r)
+
+		var req PaySplitShareRequest
+		if err := decodeRequest(r, &req); err != nil {
+			return err
+		}
+		share, receipt, err := s.splits().Pay(r.Context(), id, shareID, req, engine, auditActor(r, s.config))
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, &PaySplitShareResponse{Share: share, Receipt: receipt})
+	}
+}
+
+// POST /account/{id}/split-shares/{shareID}/decline
+func (s *APIServer) handleDeclineSplitShare(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	shareID, err := splitShareID(r)
+	if err != nil {
+		return err
+	}
+
+	share, err := s.forRequest(r).splits().Decline(r.Context(), id, shareID)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, share)
+}
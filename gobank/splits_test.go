@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitShares(t *testing.T) {
+	shares, err := splitShares(10000, []SplitParticipant{{AccountNumber: 1}, {AccountNumber: 2}})
+	require.Nil(t, err)
+	assert.Equal(t, []int64{3333, 3333}, shares, "the requester covers the remainder")
+
+	shares, err = splitShares(10000, []SplitParticipant{{AccountNumber: 1, Amount: 60}, {AccountNumber: 2, Amount: 40}})
+	require.Nil(t, err)
+	assert.Equal(t, []int64{6000, 4000}, shares)
+
+	_, err = splitShares(10000, []SplitParticipant{{AccountNumber: 1, Amount: 60}, {AccountNumber: 2, Amount: 40.01}})
+	assert.Error(t, err)
+	_, err = splitShares(10000, []SplitParticipant{{AccountNumber: 1, Amount: 60}, {AccountNumber: 2}})
+	assert.Error(t, err)
+	_, err = splitShares(1, []SplitParticipant{{AccountNumber: 1}})
+	assert.Error(t, err)
+}
+
+func TestSplitBill(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	ada := &Account{FirstName: "Ada", Number: 9901, Currency: "USD", Status: AccountActive}
+	alan := &Account{FirstName: "Alan", Number: 9902, Balance: 5000, Currency: "USD", Status: AccountActive}
+	grace := &Account{FirstName: "Grace", Number: 9903, Balance: 5000, Currency: "USD", Status: AccountActive}
+	euro := &Account{FirstName: "Emmy", Number: 9904, Balance: 5000, Currency: "EUR", Status: AccountActive}
+	for _, acc := range []*Account{ada, alan, grace, euro} {
+		require.Nil(t, store.CreateAccount(ctx, acc))
+	}
+
+	s := NewAPIServer(&Config{}, store)
+	notifier := &capturingNotifier{}
+	s.notifier = notifier
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	splits := s.splits()
+
+	var verr *ValidationError
+	_, err = splits.Create(ctx, ada.ID, CreateSplitRequest{Description: "Dinner", Amount: 90, Participants: []SplitParticipant{
+		{AccountNumber: 9902}, {AccountNumber: 9902}, {AccountNumber: 9904}, {AccountNumber: 9901},
+	}}, "test")
+	require.True(t, errors.As(err, &verr))
+	require.Len(t, verr.Fields, 3)
+	assert.Equal(t, FieldError{Field: "/participants/1/accountNumber", Code: "unique", Message: "is already in the split"}, verr.Fields[0])
+	assert.Equal(t, "/participants/2/accountNumber", verr.Fields[1].Field)
+	assert.Equal(t, "currency", verr.Fields[1].Code)
+	assert.Equal(t, "/participants/3/accountNumber", verr.Fields[2].Field)
+
+	split, err := splits.Create(ctx, ada.ID, CreateSplitRequest{Description: "Dinner", Amount: 90, Participants: []SplitParticipant{
+		{AccountNumber: 9902}, {AccountNumber: 9903},
+	}}, "test")
+	require.Nil(t, err)
+	require.Len(t, split.Shares, 2)
+	assert.Equal(t, 30.0, split.Shares[0].Amount)
+	assert.Equal(t, SplitSummary{Outstanding: 60, PendingCount: 2}, split.Summary)
+	assert.Len(t, notifier.messages, 2)
+
+	owed, err := splits.Shares(ctx, alan.ID)
+	require.Nil(t, err)
+	require.Len(t, owed, 1)
+	assert.Equal(t, int64(9901), owed[0].RequestedBy)
+
+	_, _, err = splits.Pay(ctx, grace.ID, owed[0].ID, PaySplitShareRequest{}, engine, "test")
+	assert.ErrorIs(t, err, ErrSplitShareNotFound, "another account's share")
+
+	share, receipt, err := splits.Pay(ctx, alan.ID, owed[0].ID, PaySplitShareRequest{}, engine, "test")
+	require.Nil(t, err)
+	assert.Equal(t, SharePaid, share.Status)
+	assert.Equal(t, receipt.Reference, share.TransferReference)
+	_, _, err = splits.Pay(ctx, alan.ID, owed[0].ID, PaySplitShareRequest{}, engine, "test")
+	assert.ErrorIs(t, err, ErrSplitShareResolved, "paid once")
+
+	split, err = splits.Get(ctx, ada.ID, split.ID)
+	require.Nil(t, err)
+	assert.Equal(t, SplitOpen, split.Status)
+	assert.Equal(t, SplitSummary{Paid: 30, Outstanding: 30, PaidCount: 1, PendingCount: 1}, split.Summary)
+
+	_, err = splits.Decline(ctx, grace.ID, split.Shares[1].ID)
+	require.Nil(t, err)
+	split, err = splits.Get(ctx, ada.ID, split.ID)
+	require.Nil(t, err)
+	assert.Equal(t, SplitCompleted, split.Status)
+	assert.Equal(t, SplitSummary{Paid: 30, Declined: 30, PaidCount: 1, DeclinedCount: 1}, split.Summary)
+
+	received, err := store.GetAccountbyID(ctx, ada.ID)
+	require.Nil(t, err)
+	assert.Equal(t, int64(3000), received.Balance)
+
+	_, err = splits.Cancel(ctx, ada.ID, split.ID, "test")
+	assert.ErrorIs(t, err, ErrSplitResolved)
+	_, err = splits.Get(ctx, alan.ID, split.ID)
+	assert.ErrorIs(t, err, ErrSplitNotFound, "only the requester sees the split")
+}
+
+func TestCancelSplit(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	ada := &Account{FirstName: "Ada", Number: 9911, Currency: "USD", Status: AccountActive}
+	alan := &Account{FirstName: "Alan", Number: 9912, Balance: 5000, Currency: "USD", Status: AccountActive}
+	grace := &Account{FirstName: "Grace", Number: 9913, Currency: "USD", Status: AccountActive}
+	for _, acc := range []*Account{ada, alan, grace} {
+		require.Nil(t, store.CreateAccount(ctx, acc))
+	}
+
+	s := NewAPIServer(&Config{}, store)
+	s.notifier = &capturingNotifier{}
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	split, err := s.splits().Create(ctx, ada.ID, CreateSplitRequest{Description: "Taxi", Amount: 50, Participants: []SplitParticipant{
+		{AccountNumber: 9912, Amount: 20}, {AccountNumber: 9913, Amount: 20},
+	}}, "test")
+	require.Nil(t, err)
+
+	// The balance can't cover the share, the failed transfer leaves it pending
+	id := strconv.Itoa(split.Shares[1].ID)
+	w := httptest.NewRecorder()
+	r := mux.SetURLVars(httptest.NewRequest("POST", "/account/3/split-shares/"+id+"/pay", strings.NewReader(`{}`)),
+		map[string]string{"id": "3", "shareID": id})
+	makeHTTPHandle(s.handlePaySplitShare(engine))(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+	id = strconv.Itoa(split.Shares[0].ID)
+	w = httptest.NewRecorder()
+	r = mux.SetURLVars(httptest.NewRequest("POST", "/account/2/split-shares/"+id+"/pay", strings.NewReader(`{}`)),
+		map[string]string{"id": "2", "shareID": id})
+	makeHTTPHandle(s.handlePaySplitShare(engine))(w, r)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	paid := &PaySplitShareResponse{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), paid))
+	assert.Equal(t, SharePaid, paid.Share.Status)
+	assert.Equal(t, int64(9911), paid.Receipt.ToAccount)
+
+	cancelled, err := s.splits().Cancel(ctx, ada.ID, split.ID, "test")
+	require.Nil(t, err)
+	assert.Equal(t, SplitCancelled, cancelled.Status)
+	assert.Equal(t, SharePaid, cancelled.Shares[0].Status, "paid shares stay paid")
+	assert.Equal(t, ShareCancelled, cancelled.Shares[1].Status)
+
+	_, err = s.splits().Decline(ctx, grace.ID, split.Shares[1].ID)
+	assert.ErrorIs(t, err, ErrSplitShareResolved)
+
+	actions := []string{}
+	for _, entry := range store.audit {
+		if strings.HasPrefix(entry.Action, "split.") {
+			actions = append(actions, entry.Action)
+		}
+	}
+	assert.Equal(t, []string{AuditSplitCreated, AuditSplitCancelled}, actions)
+}
+
+func TestHeldSplitShare(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	ada := &Account{FirstName: "Ada", Number: 9941, Currency: "USD", Status: AccountActive}
+	alan := &Account{FirstName: "Alan", Number: 9942, Balance: 100000, Currency: "USD", Status: AccountActive}
+	grace := &Account{FirstName: "Grace", Number: 9943, Balance: 100000, Currency: "USD", Status: AccountActive}
+	for _, acc := range []*Account{ada, alan, grace} {
+		require.Nil(t, store.CreateAccount(ctx, acc))
+	}
+
+	s := NewAPIServer(&Config{TransferApprovalThreshold: 100}, store)
+	s.notifier = &capturingNotifier{}
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	split, err := s.splits().Create(ctx, ada.ID, CreateSplitRequest{Description: "Rent", Amount: 600, Participants: []SplitParticipant{
+		{AccountNumber: 9942, Amount: 300}, {AccountNumber: 9943, Amount: 300},
+	}}, "test")
+	require.Nil(t, err)
+
+	// Both payments wait for an admin, nothing is paid yet
+	approved, receipt, err := s.splits().Pay(ctx, alan.ID, split.Shares[0].ID, PaySplitShareRequest{}, engine, "test")
+	require.Nil(t, err)
+	assert.Equal(t, TransferPendingApproval, receipt.Status)
+	assert.Equal(t, ShareHeld, approved.Status)
+	rejected, _, err := s.splits().Pay(ctx, grace.ID, split.Shares[1].ID, PaySplitShareRequest{}, engine, "test")
+	require.Nil(t, err)
+	_, _, err = s.splits().Pay(ctx, grace.ID, split.Shares[1].ID, PaySplitShareRequest{}, engine, "test")
+	assert.ErrorIs(t, err, ErrSplitShareResolved, "held shares can't be paid again")
+
+	got, err := s.splits().Get(ctx, ada.ID, split.ID)
+	require.Nil(t, err)
+	assert.Equal(t, SplitSummary{Outstanding: 600, PendingCount: 2}, got.Summary)
+
+	w := httptest.NewRecorder()
+	r := mux.SetURLVars(httptest.NewRequest("POST", "/transfer/"+approved.TransferReference+"/approve", nil),
+		map[string]string{"reference": approved.TransferReference})
+	makeHTTPHandle(s.handleApproveTransfer(engine))(w, r)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	r = mux.SetURLVars(httptest.NewRequest("POST", "/transfer/"+rejected.TransferReference+"/reject", strings.NewReader(`{"reason": "unusual"}`)),
+		map[string]string{"reference": rejected.TransferReference})
+	makeHTTPHandle(s.handleRejectTransfer)(w, r)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	got, err = s.splits().Get(ctx, ada.ID, split.ID)
+	require.Nil(t, err)
+	assert.Equal(t, SharePaid, got.Shares[0].Status)
+	assert.Equal(t, SharePending, got.Shares[1].Status, "a rejected payment leaves the share to pay again")
+	assert.Empty(t, got.Shares[1].TransferReference)
+	assert.Equal(t, SplitOpen, got.Status)
+	assert.Equal(t, SplitSummary{Paid: 300, Outstanding: 300, PaidCount: 1, PendingCount: 1}, got.Summary)
+
+	received, err := store.GetAccountbyID(ctx, ada.ID)
+	require.Nil(t, err)
+	assert.Equal(t, int64(30000), received.Balance)
+}
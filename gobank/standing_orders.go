@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A standing order pays a saved beneficiary a fixed amount daily, weekly or
+// monthly from StartDate until EndDate, or until it's cancelled when there's
+// no end date. The standing-orders job performs each occurrence as a
+// transfer of kind "standing_order" which, like direct debits, doesn't count
+// towards the daily limits: the account holder authorized the payments when
+// setting the order up.
+//
+// When the account can't cover an occurrence, OnInsufficientFunds decides
+// what happens: "skip" moves on to the next occurrence straight away,
+// "retry" tries again after STANDING_ORDER_RETRY_DELAY and skips it after
+// STANDING_ORDER_MAX_ATTEMPTS. Other failures are always retried. A paused
+// order pays nothing, occurrences that fell due while it was paused are
+// skipped when it's resumed.
+
+const (
+	TransferKindStandingOrder = "standing_order"
+
+	StandingOrderActive    = "active"
+	StandingOrderPaused    = "paused"
+	StandingOrderCompleted = "completed"
+	StandingOrderCancelled = "cancelled"
+
+	OnInsufficientFundsSkip  = "skip"
+	OnInsufficientFundsRetry = "retry"
+)
+
+type StandingOrder struct {
+	ID                  int        `json:"id"`
+	AccountID           int        `json:"account_id"`
+	BeneficiaryID       int        `json:"beneficiary_id"`
+	Amount              float64    `json:"amount"`
+	Frequency           string     `json:"frequency"`
+	Reference           string     `json:"reference,omitempty"`
+	StartDate           time.Time  `json:"start_date"`
+	EndDate             *time.Time `json:"end_date,omitempty"`
+	OnInsufficientFunds string     `json:"on_insufficient_funds"`
+	Status              string     `json:"status"`
+	NextRunAt           time.Time  `json:"next_run_at"`
+	RetryAt             *time.Time `json:"retry_at,omitempty"`
+	Attempts            int        `json:"attempts"`
+	LastError           string     `json:"last_error,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+}
+
+type CreateStandingOrderRequest struct {
+	BeneficiaryID       int        `json:"beneficiaryId" validate:"required,positive"`
+	Amount              float64    `json:"amount" validate:"positive"`
+	Frequency           string     `json:"frequency" validate:"required,oneof=daily weekly monthly"`
+	Reference           string     `json:"reference,omitempty" validate:"max=140"`
+	StartDate           time.Time  `json:"startDate" validate:"required"`
+	EndDate             *time.Time `json:"endDate,omitempty"`
+	OnInsufficientFunds string     `json:"onInsufficientFunds,omitempty" validate:"oneof=skip retry"`
+}
+
+// live orders still have payments to make, now or after they're resumed
+func (o *StandingOrder) live() bool {
+	return o.Status == StandingOrderActive || o.Status == StandingOrderPaused
+}
+
+// advance moves the order to its next occurrence after from, completing it
+// once that's past the end date
+func (o *StandingOrder) advance(from time.Time) {
+	o.NextRunAt = nextOccurrence(from, o.Frequency)
+	o.RetryAt = nil
+	o.Attempts = 0
+	if o.EndDate != nil && o.NextRunAt.After(*o.EndDate) {
+		o.Status = StandingOrderCompleted
+	}
+}
+
+func standingOrderID(r *http.Request) (int, error) {
+	return pathID(r, "orderID")
+}
+
+// standingOrder loads one of the account's standing orders, others look like they don't exist
+func (s *APIServer) standingOrder(r *http.Request) (*StandingOrder, error) {
+	id, err := getID(r)
+	if err != nil {
+		return nil, err
+	}
+	oID, err := standingOrderID(r)
+	if err != nil {
+		return nil, err
+	}
+	o, err := s.store.GetStandingOrder(r.Context(), oID)
+	if err != nil {
+		return nil, err
+	}
+	if o.AccountID != id {
+		return nil, fmt.Errorf("%w: %d", ErrStandingOrderNotFound, oID)
+	}
+	return o, nil
+}
+
+// GET /account/{id}/standing-orders
+func (s *APIServer) handleGetStandingOrders(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	orders, err := s.store.GetStandingOrders(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, orders)
+}
+
+// POST /account/{id}/standing-orders
+func (s *APIServer) handleCreateStandingOrder(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	accountID, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	var req CreateStandingOrderRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+
+	if _, err := s.beneficiary(r.Context(), accountID, req.BeneficiaryID); err != nil {
+		return invalidField("beneficiaryId", "exists", "is not a beneficiary of the account")
+	}
+	start := req.StartDate.UTC()
+	if req.EndDate != nil && req.EndDate.Before(start) {
+		return invalidField("endDate", "after", "must not be before startDate")
+	}
+	if req.OnInsufficientFunds == "" {
+		req.OnInsufficientFunds = OnInsufficientFundsRetry
+	}
+
+	o := &StandingOrder{
+		AccountID:           accountID,
+		BeneficiaryID:       req.BeneficiaryID,
+		Amount:              req.Amount,
+		Frequency:           req.Frequency,
+		Reference:           strings.TrimSpace(req.Reference),
+		StartDate:           start,
+		EndDate:             req.EndDate,
+		OnInsufficientFunds: req.OnInsufficientFunds,
+		Status:              StandingOrderActive,
+		NextRunAt:           start,
+		CreatedAt:           time.Now().UTC(),
+	}
+	if err := s.store.CreateStandingOrder(r.Context(), o); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusCreated, o)
+}
+
+// POST /account/{id}/standing-orders/{orderID}/pause
+func (s *APIServer) handlePauseStandingOrder(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	o, err := s.standingOrder(r)
+	if err != nil {
+		return err
+	}
+	o.Status = StandingOrderPaused
+	return s.transitionStandingOrder(w, r, o, StandingOrderActive)
+}
+
+// POST /account/{id}/standing-orders/{orderID}/resume
+func (s *APIServer) handleResumeStandingOrder(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	o, err := s.standingOrder(r)
+	if err != nil {
+		return err
+	}
+
+	// Start again from the first occurrence that isn't in the past
+	o.Status = StandingOrderActive
+	o.RetryAt, o.Attempts = nil, 0
+	for now := time.Now().UTC(); o.Status == StandingOrderActive && o.NextRunAt.Before(now); {
+		o.advance(o.NextRunAt)
+	}
+	return s.transitionStandingOrder(w, r, o, StandingOrderPaused)
+}
+
+// DELETE /account/{id}/standing-orders/{orderID}
+func (s *APIServer) handleCancelStandingOrder(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	o, err := s.standingOrder(r)
+	if err != nil {
+		return err
+	}
+	if !o.live() {
+		return fmt.Errorf("%w: standing order %d is %s", ErrStandingOrderInactive, o.ID, o.Status)
+	}
+	from := o.Status
+	o.Status = StandingOrderCancelled
+	return s.transitionStandingOrder(w, r, o, from)
+}
+
+func (s *APIServer) transitionStandingOrder(w http.ResponseWriter, r *http.Request, o *StandingOrder, from string) error {
+	ok, err := s.store.UpdateStandingOrder(r.Context(), o, from)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: standing order %d is not %s", ErrStandingOrderInactive, o.ID, from)
+	}
+	return WriteJSON(w, http.StatusOK, o)
+}
+
+// standingOrderRunner pays due standing orders
+type standingOrderRunner struct {
+	api         *APIServer
+	engine      TransferEngine
+	notifier    Notifier
+	maxAttempts int
+	retryDelay  time.Duration
+}
+
+func (s *APIServer) standingOrderJob(engine TransferEngine) Job {
+	runner := &standingOrderRunner{
+		api:         s,
+		engine:      engine,
+		notifier:    s.notifier,
+		maxAttempts: s.config.StandingOrderMaxAttempts,
+		retryDelay:  s.config.StandingOrderRetryDelay,
+	}
+
+	return Job{
+		Name:     "standing-orders",
+		Interval: s.config.SchedulerInterval,
+		Run:      runner.run,
+	}
+}
+
+func (r *standingOrderRunner) run(ctx context.Context) error {
+	now := time.Now().UTC()
+
+	due, err := r.api.store.GetDueStandingOrders(ctx, now, 100)
+	if err != nil {
+		return err
+	}
+	setJobQueueDepth("standing_orders", len(due))
+
+	for _, o := range due {
+		// Lease the row so another instance doesn't pay it as well
+		claimed, err := r.api.store.ClaimStandingOrder(ctx, o.ID, now, now.Add(r.retryDelay))
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+
+		r.pay(ctx, o, now)
+
+		// Losing the race means the order was paused or cancelled meanwhile
+		if _, err := r.api.store.UpdateStandingOrder(ctx, o, StandingOrderActive); err != nil {
+			log.Printf("Failed to update standing order %d: %v", o.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// pay performs the order's due occurrence and moves it on
+func (r *standingOrderRunner) pay(ctx context.Context, o *StandingOrder, now time.Time) {
+	b, err := r.api.store.GetBeneficiary(ctx, o.BeneficiaryID)
+	var from *Account
+	if err == nil {
+		from, err = r.api.store.GetAccountbyID(ctx, o.AccountID)
+	}
+	if err == nil {
+		ctx := withTransferKind(ctx, TransferKindStandingOrder)
+		_, _, err = r.api.transfers().Transfer(ctx, TransferRequest{
+			FromAccountNumber: from.Number,
+			ToAccountNumber:   b.AccountNumber,
+			Amount:            o.Amount,
+			Memo:              o.Reference,
+		}, r.engine, "standing-order:"+strconv.Itoa(o.ID))
+	}
+
+	if err == nil {
+		o.LastError = ""
+		o.advance(o.NextRunAt)
+		return
+	}
+
+	o.Attempts++
+	o.LastError = err.Error()
+	insufficient := errors.Is(err, ErrInsufficientFunds)
+
+	if (!insufficient || o.OnInsufficientFunds == OnInsufficientFundsRetry) && o.Attempts < r.maxAttempts {
+		retryAt := now.Add(r.retryDelay)
+		o.RetryAt = &retryAt
+		r.notify(o, fmt.Sprintf("Standing order %d of %.2f failed, retrying at %s: %v", o.ID, o.Amount, retryAt.Format(time.RFC3339), err))
+		return
+	}
+
+	r.notify(o, fmt.Sprintf("Standing order %d of %.2f due %s was skipped: %v", o.ID, o.Amount, o.NextRunAt.Format(time.DateOnly), err))
+	o.advance(o.NextRunAt)
+}
+
+func (r *standingOrderRunner) notify(o *StandingOrder, message string) {
+	if err := r.notifier.Notify(o.AccountID, "Standing order failed", message); err != nil {
+		log.Printf("Failed to notify account %d: %v", o.AccountID, err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStandingOrders(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	payer := &Account{Number: 5601, Balance: 5000, Currency: "USD", Status: AccountActive}
+	payee := &Account{Number: 5602, Currency: "USD", Status: AccountActive}
+	require.Nil(t, store.CreateAccount(ctx, payer))
+	require.Nil(t, store.CreateAccount(ctx, payee))
+	notifier := &capturingNotifier{}
+	s := NewAPIServer(&Config{}, store)
+	s.notifier = notifier
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	runner := &standingOrderRunner{api: s, engine: engine, notifier: notifier, maxAttempts: 2, retryDelay: time.Hour}
+
+	call := func(h apiFunc, method, body string, vars map[string]string) *httptest.ResponseRecorder {
+		vars["id"] = strconv.Itoa(payer.ID)
+		w := httptest.NewRecorder()
+		makeHTTPHandle(h)(w, mux.SetURLVars(httptest.NewRequest(method, "/", strings.NewReader(body)), vars))
+		return w
+	}
+	order := func() *StandingOrder {
+		o, err := store.GetStandingOrder(ctx, store.orders[len(store.orders)-1].ID)
+		require.Nil(t, err)
+		return o
+	}
+
+	assert.Equal(t, http.StatusUnprocessableEntity, call(s.handleCreateBeneficiary, "POST", `{"name": "Self", "accountNumber": 5601}`, map[string]string{}).Code)
+	w := call(s.handleCreateBeneficiary, "POST", `{"name": "Landlord", "accountNumber": 5602}`, map[string]string{})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var b Beneficiary
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &b))
+
+	start := time.Now().UTC().Add(-time.Minute)
+	end := start.AddDate(0, 0, 2)
+	body := `{"beneficiaryId": ` + strconv.Itoa(b.ID) + `, "amount": 20, "frequency": "daily", "reference": "Rent",
+		"startDate": "` + start.Format(time.RFC3339Nano) + `", "endDate": "` + end.Format(time.RFC3339Nano) + `"}`
+	assert.Equal(t, http.StatusUnprocessableEntity, call(s.handleCreateStandingOrder, "POST", strings.Replace(body, `"beneficiaryId": `+strconv.Itoa(b.ID), `"beneficiaryId": 99`, 1), map[string]string{}).Code)
+	w = call(s.handleCreateStandingOrder, "POST", body, map[string]string{})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	o := order()
+	assert.Equal(t, OnInsufficientFundsRetry, o.OnInsufficientFunds)
+	vars := map[string]string{"orderID": strconv.Itoa(o.ID)}
+
+	// Paid and moved on to the next day
+	require.Nil(t, runner.run(ctx))
+	assert.Equal(t, int64(3000), mustAccount(t, store, payer.ID).Balance)
+	assert.Equal(t, int64(2000), mustAccount(t, store, payee.ID).Balance)
+	assert.Equal(t, start.AddDate(0, 0, 1), order().NextRunAt)
+	assert.Equal(t, TransferKindStandingOrder, store.entries[len(store.entries)-1].Kind)
+	assert.Equal(t, "Rent", store.entries[len(store.entries)-1].Memo)
+
+	// The beneficiary can't go while an order pays it
+	assert.Equal(t, http.StatusConflict, call(s.handleDeleteBeneficiary, "DELETE", "", map[string]string{"beneficiaryID": strconv.Itoa(b.ID)}).Code)
+
+	// Paused orders pay nothing and skip what fell due meanwhile
+	require.Equal(t, http.StatusOK, call(s.handlePauseStandingOrder, "POST", "", vars).Code)
+	assert.Equal(t, http.StatusConflict, call(s.handlePauseStandingOrder, "POST", "", vars).Code)
+	store.orders[0].NextRunAt = start
+	require.Nil(t, runner.run(ctx))
+	assert.Equal(t, int64(3000), mustAccount(t, store, payer.ID).Balance)
+	require.Equal(t, http.StatusOK, call(s.handleResumeStandingOrder, "POST", "", vars).Code)
+	o = order()
+	assert.Equal(t, StandingOrderActive, o.Status)
+	assert.Equal(t, start.AddDate(0, 0, 1), o.NextRunAt)
+
+	// Retried when the account can't cover it, then skipped
+	store.accounts[payer.ID].Balance = 1000
+	store.orders[0].NextRunAt = start
+	require.Nil(t, runner.run(ctx))
+	o = order()
+	assert.Equal(t, 1, o.Attempts)
+	require.NotNil(t, o.RetryAt)
+	store.orders[0].RetryAt = &start
+	require.Nil(t, runner.run(ctx))
+	o = order()
+	assert.Equal(t, 0, o.Attempts)
+	assert.Equal(t, start.AddDate(0, 0, 1), o.NextRunAt)
+	assert.Contains(t, notifier.messages[len(notifier.messages)-1], "was skipped")
+
+	// With skip it moves on at once, the last occurrence completes the order
+	store.orders[0].OnInsufficientFunds = OnInsufficientFundsSkip
+	store.orders[0].NextRunAt, store.orders[0].EndDate = start, &start
+	require.Nil(t, runner.run(ctx))
+	o = order()
+	assert.Equal(t, StandingOrderCompleted, o.Status)
+	assert.Equal(t, int64(1000), mustAccount(t, store, payer.ID).Balance)
+	assert.Equal(t, http.StatusConflict, call(s.handleCancelStandingOrder, "DELETE", "", vars).Code)
+
+	require.Equal(t, http.StatusOK, call(s.handleDeleteBeneficiary, "DELETE", "", map[string]string{"beneficiaryID": strconv.Itoa(b.ID)}).Code)
+	beneficiaries, _ := store.GetBeneficiaries(ctx, payer.ID)
+	assert.Empty(t, beneficiaries)
+}
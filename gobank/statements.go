@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/smtp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Account holders who opt in with the statement_email preference get last
+// month's statement mailed to their verified email early each month. Sent
+// statements are claimed in statement_delivery so every replica of the job
+// mails a month once, a failed send gives the claim back for the next run.
+// Months run from midnight to midnight in the account's timezone, so a
+// statement goes out once its last day has ended where the holder lives.
+// Delivery goes through a Mailer, MAILER picks "log" (default) or "smtp".
+
+type MailMessage struct {
+	To      string
+	Subject string
+	Body    string // plain text
+}
+
+// Mailer delivers email to an address, unlike a Notifier which resolves the account's contact
+type Mailer interface {
+	Send(ctx context.Context, msg *MailMessage) error
+}
+
+func NewMailer(cfg *Config) (Mailer, error) {
+	switch cfg.Mailer {
+	case "", "log":
+		return logMailer{}, nil
+	case "smtp":
+		if cfg.SMTPAddr == "" || cfg.MailFrom == "" {
+			return nil, fmt.Errorf("SMTP_ADDR and MAIL_FROM are required for the smtp mailer")
+		}
+		m := &smtpMailer{addr: cfg.SMTPAddr, from: cfg.MailFrom}
+		if cfg.SMTPUsername != "" {
+			host, _, _ := strings.Cut(cfg.SMTPAddr, ":")
+			m.auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host)
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("unknown mailer %q", cfg.Mailer)
+}
+
+// logMailer writes mail to the server log, used until SMTP is configured
+type logMailer struct{}
+
+func (logMailer) Send(ctx context.Context, msg *MailMessage) error {
+	log.Printf("Mail to %s: %s (%d bytes)", msg.To, msg.Subject, len(msg.Body))
+	return nil
+}
+
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth // nil for relays that don't authenticate
+}
+
+func (m *smtpMailer) Send(ctx context.Context, msg *MailMessage) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\nTo: %s\r\nSubject: %s\r\n", m.from, msg.To, msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	if err := smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, b.Bytes()); err != nil {
+		return fmt.Errorf("smtp delivery to %s failed: %v", m.addr, err)
+	}
+	return nil
+}
+
+// Statement is an account's activity over a month, amounts in major units
+type Statement struct {
+	AccountID      int                   `json:"account_id"`
+	Number         int64                 `json:"number"`
+	Name           string                `json:"name"`
+	Currency       string                `json:"currency"`
+	PeriodStart    time.Time             `json:"period_start"`
+	PeriodEnd      time.Time             `json:"period_end"`
+	OpeningBalance float64               `json:"opening_balance"`
+	ClosingBalance float64               `json:"closing_balance"`
+	Transactions   []*AccountTransaction `json:"transactions"`
+}
+
+var statementTemplate = template.Must(template.New("statement").Parse(`Statement for {{.Name}}, account {{.Number}}
+{{.PeriodStart.Format "2 January 2006"}} to {{(.PeriodEnd.AddDate 0 0 -1).Format "2 January 2006"}}
+
+Opening balance  {{printf "%.2f" .OpeningBalance}} {{.Currency}}
+{{range .Transactions}}
+{{.CreatedAt.Format "2006-01-02"}}  {{printf "%-6s" .Direction}} {{printf "%12.2f" .Amount}}  {{.Kind}}{{with .Memo}} - {{.}}{{end}}{{end}}
+{{if not .Transactions}}
+No transactions this month.
+{{end}}
+Closing balance  {{printf "%.2f" .ClosingBalance}} {{.Currency}}
+`))
+
+func renderStatement(st *Statement) (string, error) {
+	var b bytes.Buffer
+	if err := statementTemplate.Execute(&b, st); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+type statementRunner struct {
+	store  Storage
+	mailer Mailer
+}
+
+func (s *APIServer) statementJob() Job {
+	runner := &statementRunner{store: s.store, mailer: s.mailer}
+
+	return Job{
+		Name:     "statements",
+		Interval: s.config.SchedulerInterval,
+		Run: func(ctx context.Context) error {
+			return runner.run(ctx, time.Now().UTC())
+		},
+	}
+}
+
+// run mails last month's statement to the accounts that opted in, the
+// month that last ended in each account's timezone
+func (st *statementRunner) run(ctx context.Context, now time.Time) error {
+	ids, err := st.store.GetStatementOptIns(ctx)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	setJobQueueDepth("statements", len(ids))
+
+	// Accounts in the same timezone share a period, its postings are loaded once
+	periods := map[int64]map[int][]*AccountTransaction{}
+	for _, id := range ids {
+		loc, err := accountLocation(ctx, st.store, id)
+		if err != nil {
+			log.Printf("Failed to send the statement of account %d: %v", id, err)
+			continue
+		}
+		periodEnd := startOfMonth(now.In(loc))
+		period := periodEnd.AddDate(0, -1, 0)
+
+		postings, ok := periods[period.Unix()]
+		if !ok {
+			if postings, err = st.postings(ctx, period, periodEnd); err != nil {
+				return err
+			}
+			periods[period.Unix()] = postings
+		}
+
+		if err := st.send(ctx, id, period, periodEnd, postings[id], now); err != nil {
+			log.Printf("Failed to send the %s statement of account %d: %v", period.Format("2006-01"), id, err)
+		}
+	}
+	return nil
+}
+
+// postings groups the period's ledger postings by account
+func (st *statementRunner) postings(ctx context.Context, period, periodEnd time.Time) (map[int][]*AccountTransaction, error) {
+	entries, err := st.store.GetLedgerEntries(ctx, period.UTC(), periodEnd.UTC())
+	if err != nil {
+		return nil, err
+	}
+	postings := map[int][]*AccountTransaction{}
+	for _, e := range entries {
+		for _, p := range e.Postings {
+			if p.AccountID != 0 {
+				postings[p.AccountID] = append(postings[p.AccountID], newAccountTransaction(e, p.Amount, p.Currency))
+			}
+		}
+	}
+	return postings, nil
+}
+
+func (st *statementRunner) send(ctx context.Context, id int, period, periodEnd time.Time, transactions []*AccountTransaction, now time.Time) error {
+	acc, err := st.store.GetAccountbyID(ctx, id)
+	if err != nil {
+		return err
+	}
+	// Accounts opened after the period have nothing to report
+	if acc.Email == "" || !acc.EmailVerified || !acc.CreatedAt.Before(periodEnd) {
+		return nil
+	}
+
+	// Claims are keyed by the month whatever the timezone, so changing it
+	// doesn't mail a month twice
+	month := time.Date(period.Year(), period.Month(), 1, 0, 0, 0, 0, time.UTC)
+	claimed, err := st.store.ClaimStatement(ctx, id, month, now)
+	if err != nil || !claimed {
+		return err
+	}
+
+	statement, err := buildStatement(ctx, st.store, acc, period, periodEnd, transactions)
+	if err == nil {
+		err = st.mail(ctx, acc, statement)
+	}
+	if err != nil {
+		if rerr := st.store.ReleaseStatement(ctx, id, month); rerr != nil {
+			log.Printf("Failed to release the %s statement claim of account %d: %v", period.Format("2006-01"), id, rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (st *statementRunner) mail(ctx context.Context, acc *Account, statement *Statement) error {
+	body, err := renderStatement(statement)
+	if err != nil {
+		return err
+	}
+	return st.mailer.Send(ctx, &MailMessage{
+		To:      acc.Email,
+		Subject: fmt.Sprintf("Your GoBank statement for %s", statement.PeriodStart.Format("January 2006")),
+		Body:    body,
+	})
+}
+
+// buildStatement works the opening balance back from the closing one so both
+// come from the same postings as the transactions. Dates are shown in the
+// period's timezone.
+func buildStatement(ctx context.Context, store Storage, acc *Account, period, periodEnd time.Time, transactions []*AccountTransaction) (*Statement, error) {
+	closing, err := store.GetBalanceAt(ctx, acc.ID, periodEnd.Add(-time.Nanosecond).UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(transactions, func(i, j int) bool { return transactions[i].EntryID < transactions[j].EntryID })
+	var net int64
+	for _, tx := range transactions {
+		tx.CreatedAt = tx.CreatedAt.In(period.Location())
+		cents := int64(math.Round(tx.Amount * 100))
+		if tx.Direction == DirectionDebit {
+			cents = -cents
+		}
+		net += cents
+	}
+
+	return &Statement{
+		AccountID:      acc.ID,
+		Number:         acc.Number,
+		Name:           acc.FirstName + " " + acc.LastName,
+		Currency:       acc.Currency,
+		PeriodStart:    period,
+		PeriodEnd:      periodEnd,
+		OpeningBalance: float64(closing-net) / 100,
+		ClosingBalance: float64(closing) / 100,
+		Transactions:   transactions,
+	}, nil
+}
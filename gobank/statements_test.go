@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingMailer struct {
+	sent []*MailMessage
+	err  error
+}
+
+func (m *recordingMailer) Send(ctx context.Context, msg *MailMessage) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func TestStatementMailer(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	acc, err := NewAccount("Stella", "Ment", "password")
+	require.Nil(t, err)
+	acc.Email, acc.EmailVerified = "stella@example.com", true
+	acc.CreatedAt = time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC)
+	require.Nil(t, store.CreateAccount(ctx, acc))
+	other, err := NewAccount("Otto", "Out", "password")
+	require.Nil(t, err)
+	require.Nil(t, store.CreateAccount(ctx, other))
+
+	store.entries = append(store.entries,
+		&LedgerEntry{ID: 1, Kind: "deposit", CreatedAt: time.Date(2026, 2, 20, 0, 0, 0, 0, time.UTC), Postings: []Posting{{AccountID: acc.ID, Currency: "USD", Amount: 10000}}},
+		&LedgerEntry{ID: 2, Kind: "transfer", Memo: "rent", CreatedAt: time.Date(2026, 3, 3, 0, 0, 0, 0, time.UTC), Postings: []Posting{{AccountID: acc.ID, Currency: "USD", Amount: -2550}}},
+		&LedgerEntry{ID: 3, Kind: "transfer", CreatedAt: time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC), Postings: []Posting{{AccountID: acc.ID, Currency: "USD", Amount: -100}}},
+	)
+
+	// Only accounts that opted in get statements
+	s := NewAPIServer(&Config{}, store)
+	r := mux.SetURLVars(httptest.NewRequest("PATCH", "/v1/account/1/preferences", bytes.NewBufferString(`{"statement_email": true}`)), map[string]string{"id": fmt.Sprint(acc.ID)})
+	w := httptest.NewRecorder()
+	makeHTTPHandle(s.handleUpdatePreferences)(w, r)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Nil(t, store.SavePreferences(ctx, &AccountPreferences{AccountID: other.ID}))
+
+	mailer := &recordingMailer{err: fmt.Errorf("relay down")}
+	runner := &statementRunner{store: store, mailer: mailer}
+	now := time.Date(2026, 4, 2, 6, 0, 0, 0, time.UTC)
+
+	// A failed send is retried on the next run
+	require.Nil(t, runner.run(ctx, now))
+	assert.Empty(t, mailer.sent)
+	mailer.err = nil
+	require.Nil(t, runner.run(ctx, now))
+	require.Len(t, mailer.sent, 1)
+	require.Nil(t, runner.run(ctx, now))
+	assert.Len(t, mailer.sent, 1, "a month is mailed once")
+
+	msg := mailer.sent[0]
+	assert.Equal(t, "stella@example.com", msg.To)
+	assert.Equal(t, "Your GoBank statement for March 2026", msg.Subject)
+	assert.Contains(t, msg.Body, "1 March 2026 to 31 March 2026")
+	assert.Contains(t, msg.Body, "Opening balance  100.00 USD")
+	assert.Contains(t, msg.Body, "25.50  transfer - rent")
+	assert.Contains(t, msg.Body, "Closing balance  74.50 USD")
+}
+
+func TestStatementInAccountTimezone(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	acc := &Account{FirstName: "Kenji", LastName: "Sato", Number: 9871, Currency: "JPY", Status: AccountActive,
+		Email: "kenji@example.com", EmailVerified: true, CreatedAt: time.Date(2026, 1, 5, 0, 0, 0, 0, time.UTC)}
+	require.Nil(t, store.CreateAccount(ctx, acc))
+	require.Nil(t, store.SavePreferences(ctx, &AccountPreferences{AccountID: acc.ID, StatementEmail: true, Timezone: "Asia/Tokyo"}))
+
+	// 1 March 01:00 and 1 April 05:00 in Tokyo
+	store.entries = append(store.entries,
+		&LedgerEntry{ID: 1, Kind: "deposit", CreatedAt: time.Date(2026, 2, 28, 16, 0, 0, 0, time.UTC), Postings: []Posting{{AccountID: acc.ID, Currency: "JPY", Amount: 5000}}},
+		&LedgerEntry{ID: 2, Kind: "deposit", CreatedAt: time.Date(2026, 3, 31, 20, 0, 0, 0, time.UTC), Postings: []Posting{{AccountID: acc.ID, Currency: "JPY", Amount: 700}}},
+	)
+
+	mailer := &recordingMailer{}
+	runner := &statementRunner{store: store, mailer: mailer}
+
+	// Still March in UTC, April has begun in Tokyo
+	require.Nil(t, runner.run(ctx, time.Date(2026, 3, 31, 22, 0, 0, 0, time.UTC)))
+	require.Len(t, mailer.sent, 1)
+	body := mailer.sent[0].Body
+	assert.Contains(t, body, "1 March 2026 to 31 March 2026")
+	assert.Contains(t, body, "2026-03-01  credit        50.00  deposit")
+	assert.NotContains(t, body, "7.00")
+	assert.Contains(t, body, "Closing balance  50.00 JPY")
+
+	// Changing timezone doesn't mail the month again
+	require.Nil(t, store.SavePreferences(ctx, &AccountPreferences{AccountID: acc.ID, StatementEmail: true, Timezone: "UTC"}))
+	require.Nil(t, runner.run(ctx, time.Date(2026, 4, 1, 1, 0, 0, 0, time.UTC)))
+	assert.Len(t, mailer.sent, 1)
+}
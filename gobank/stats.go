@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// System-wide statistics for the admin dashboard. Each is a single
+// aggregate query, the transfer ones read the transfer table's created_at
+// index. Dashboards poll, so results are kept for STATS_CACHE_TTL per query
+// string, zero turns the cache off. Amounts are in cents in the currency
+// they were sent in.
+
+type AccountCounts struct {
+	Total   int `json:"total"`
+	Active  int `json:"active"`
+	Frozen  int `json:"frozen"`
+	Dormant int `json:"dormant"`
+	Closed  int `json:"closed"`
+}
+
+type SystemStats struct {
+	Accounts    *AccountCounts  `json:"accounts"`
+	Balances    []*BalanceTotal `json:"balances"`
+	GeneratedAt time.Time       `json:"generated_at"`
+}
+
+type TransferVolume struct {
+	Day      string `json:"day"`
+	Currency string `json:"currency"`
+	Count    int    `json:"count"`
+	Amount   int64  `json:"amount"`
+}
+
+type TransferVolumeStats struct {
+	From        string            `json:"from"`
+	To          string            `json:"to"`
+	Days        []*TransferVolume `json:"days"`
+	GeneratedAt time.Time         `json:"generated_at"`
+}
+
+// AccountActivity counts the customer transfers an account sent or received
+type AccountActivity struct {
+	AccountID int    `json:"account_id"`
+	Number    int64  `json:"number"`
+	Currency  string `json:"currency"`
+	Transfers int    `json:"transfers"`
+	Amount    int64  `json:"amount"`
+}
+
+type TopAccountsStats struct {
+	Since       time.Time          `json:"since"`
+	Accounts    []*AccountActivity `json:"accounts"`
+	GeneratedAt time.Time          `json:"generated_at"`
+}
+
+// statsCache keeps computed statistics by key until they're ttl old
+type statsCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]cachedStats
+}
+
+type cachedStats struct {
+	value     any
+	expiresAt time.Time
+}
+
+func newStatsCache(ttl time.Duration) *statsCache {
+	return &statsCache{ttl: ttl, entries: map[string]cachedStats{}}
+}
+
+// cachedStat returns the cached value of key, or loads and caches it
+func cachedStat[T any](c *statsCache, key string, load func() (T, error)) (T, error) {
+	now := time.Now()
+	if c != nil && c.ttl > 0 {
+		c.mu.Lock()
+		entry, ok := c.entries[key]
+		c.mu.Unlock()
+		if ok && now.Before(entry.expiresAt) {
+			return entry.value.(T), nil
+		}
+	}
+
+	value, err := load()
+	if err != nil || c == nil || c.ttl <= 0 {
+		return value, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, entry := range c.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cachedStats{value: value, expiresAt: now.Add(c.ttl)}
+	return value, nil
+}
+
+func statsKey(r *http.Request) string {
+	return r.URL.Path + "?" + r.URL.RawQuery
+}
+
+// GET /admin/stats
+func (s *APIServer) handleGetStats(w http.ResponseWriter, r *http.Request) error {
+	store := s.forRequest(r).store
+	stats, err := cachedStat(s.stats, statsKey(r), func() (*SystemStats, error) {
+		counts, err := store.GetAccountCounts(r.Context())
+		if err != nil {
+			return nil, err
+		}
+		totals, err := store.GetBalanceTotals(r.Context())
+		if err != nil {
+			return nil, err
+		}
+		return &SystemStats{Accounts: counts, Balances: totals, GeneratedAt: time.Now().UTC()}, nil
+	})
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, stats)
+}
+
+// GET /admin/stats/transfers?from=2024-01-01&to=2024-01-31, both days
+// included, the last 30 days by default
+func (s *APIServer) handleGetTransferVolume(w http.ResponseWriter, r *http.Request) error {
+	to := startOfDay(time.Now().UTC())
+	from := to.AddDate(0, 0, -29)
+	for param, day := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := r.URL.Query().Get(param); v != "" {
+			parsed, err := time.Parse("2006-01-02", v)
+			if err != nil {
+				return invalidParam("query", param, "type", "must be a date like 2006-01-02")
+			}
+			*day = parsed
+		}
+	}
+	if to.Before(from) {
+		return invalidParam("query", "from", "max", "must not be after to")
+	}
+
+	store := s.forRequest(r).store
+	stats, err := cachedStat(s.stats, statsKey(r), func() (*TransferVolumeStats, error) {
+		days, err := store.GetTransferVolume(r.Context(), from, to.AddDate(0, 0, 1))
+		if err != nil {
+			return nil, err
+		}
+		return &TransferVolumeStats{From: from.Format("2006-01-02"), To: to.Format("2006-01-02"), Days: days, GeneratedAt: time.Now().UTC()}, nil
+	})
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, stats)
+}
+
+// GET /admin/stats/top-accounts?days=30&limit=10
+func (s *APIServer) handleGetTopAccounts(w http.ResponseWriter, r *http.Request) error {
+	days, limit := 30, 10
+	for param, value := range map[string]*int{"days": &days, "limit": &limit} {
+		if v := r.URL.Query().Get(param); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 366 {
+				return invalidParam("query", param, "range", "must be a number between 1 and 366")
+			}
+			*value = n
+		}
+	}
+	if limit > 100 {
+		return invalidParam("query", "limit", "max", "must be at most 100")
+	}
+
+	store := s.forRequest(r).store
+	stats, err := cachedStat(s.stats, statsKey(r), func() (*TopAccountsStats, error) {
+		since := startOfDay(time.Now().UTC()).AddDate(0, 0, 1-days)
+		accounts, err := store.GetTopAccounts(r.Context(), since, limit)
+		if err != nil {
+			return nil, err
+		}
+		return &TopAccountsStats{Since: since, Accounts: accounts, GeneratedAt: time.Now().UTC()}, nil
+	})
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminStats(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9701, Balance: 100000, Currency: "USD", Status: AccountActive, EmailVerified: true}))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9702, Balance: 5000, Currency: "USD", Status: AccountActive, EmailVerified: true}))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9703, Currency: "USD", Status: AccountFrozen}))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9704, Balance: -2000, Currency: "EUR", Status: AccountActive}))
+
+	transfers := NewTransferService(store, TransferLimits{}, staticRateProvider{}, nil, nil)
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	for _, req := range []TransferRequest{
+		{FromAccountNumber: 9701, ToAccountNumber: 9702, Amount: 100},
+		{FromAccountNumber: 9701, ToAccountNumber: 9702, Amount: 50},
+		{FromAccountNumber: 9702, ToAccountNumber: 9701, Amount: 25},
+	} {
+		_, _, err := transfers.Transfer(ctx, req, engine, "test")
+		require.Nil(t, err)
+	}
+
+	s := NewAPIServer(&Config{StatsCacheTTL: time.Minute}, store)
+	get := func(handler apiFunc, target string, v any) int {
+		w := httptest.NewRecorder()
+		makeHTTPHandle(handler)(w, httptest.NewRequest("GET", target, nil))
+		if v != nil && w.Code == http.StatusOK {
+			require.Nil(t, json.Unmarshal(w.Body.Bytes(), v))
+		}
+		return w.Code
+	}
+
+	var stats SystemStats
+	require.Equal(t, http.StatusOK, get(s.handleGetStats, "/admin/stats", &stats))
+	assert.Equal(t, &AccountCounts{Total: 4, Active: 3, Frozen: 1}, stats.Accounts)
+	assert.Equal(t, []*BalanceTotal{{Currency: "EUR", Overdrafts: 2000}, {Currency: "USD", Deposits: 105000}}, stats.Balances)
+
+	today := time.Now().UTC().Format("2006-01-02")
+	var volume TransferVolumeStats
+	require.Equal(t, http.StatusOK, get(s.handleGetTransferVolume, "/admin/stats/transfers", &volume))
+	assert.Equal(t, today, volume.To)
+	assert.Equal(t, []*TransferVolume{{Day: today, Currency: "USD", Count: 3, Amount: 17500}}, volume.Days)
+	assert.Equal(t, http.StatusUnprocessableEntity, get(s.handleGetTransferVolume, "/admin/stats/transfers?from=2024-02-01&to=2024-01-01", nil))
+
+	var top TopAccountsStats
+	require.Equal(t, http.StatusOK, get(s.handleGetTopAccounts, "/admin/stats/top-accounts?limit=1", &top))
+	assert.Equal(t, []*AccountActivity{{AccountID: 1, Number: 9701, Currency: "USD", Transfers: 3, Amount: 17500}}, top.Accounts)
+	assert.Equal(t, http.StatusUnprocessableEntity, get(s.handleGetTopAccounts, "/admin/stats/top-accounts?limit=500", nil))
+
+	// Cached results are served until they expire
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9705, Currency: "USD", Status: AccountActive}))
+	var cached SystemStats
+	get(s.handleGetStats, "/admin/stats", &cached)
+	assert.Equal(t, stats.GeneratedAt, cached.GeneratedAt)
+	assert.Equal(t, 4, cached.Accounts.Total)
+
+	s.stats = newStatsCache(0)
+	var fresh SystemStats
+	get(s.handleGetStats, "/admin/stats", &fresh)
+	assert.Equal(t, 5, fresh.Accounts.Total)
+}
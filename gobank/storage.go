@@ -1,290 +1,4247 @@
-package main
-
-import (
-	"database/sql"
-	"fmt"
-	"log"
-	"time"
-
-	_ "github.com/lib/pq"
-)
-
-type Storage interface {
-	CreateAccount(*Account) error
-	DeleteAccount(int) error
-	UpdateAccount(*Account) error
-	GetAccounts() ([]*Account, error)
-	GetAccountbyID(int) (*Account, error)
-	GetAccountByNumber(int64) (*Account, error)
-	BeginTransaction() (Transaction, error)
-	UpdateAccountBalance(accountID int, amount float64, tx Transaction) error
-}
-
-type Transaction interface {
-	Exec(qyeru string, args ...interface{}) (sql.Result, error)
-	Commit() error
-	Rollback() error
-}
-
-type PostgresStorage struct {
-	db *sql.DB
-}
-
-func NewPostgresStorage() (*PostgresStorage, error) {
-	connStr := "user=postgres password=siddharth_22 dbname=postgres sslmode=disable"
-	db, err := sql.Open("postgres", connStr)
-	if err != nil {
-		return nil, err
-	}
-	if err := db.Ping(); err != nil {
-		return nil, err
-	}
-
-	return &PostgresStorage{
-		db: db,
-	}, nil
-}
-
-func (s *PostgresStorage) init() error {
-	if err := s.createAccountTable(); err != nil {
-		return err
-	}
-	if err := s.ensureAccountNumberColumn(); err != nil {
-		return err
-	}
-	return nil
-}
-
-func (s *PostgresStorage) createAccountTable() error {
-	query := `create table if not exists account (
-		id serial primary key,
-		first_name varchar(100),
-		last_name varchar(100),
-		account_number serial,
-		encrypted_password varchar(100),
-		balance serial,
-		created_at timestamp
-	)`
-	_, err := s.db.Exec(query)
-	if err != nil {
-		log.Printf("Error creating account table: %v", err)
-	} else {
-		log.Println("Account table created successfully or already exists.")
-	}
-	return err
-}
-
-func (s *PostgresStorage) ensureAccountNumberColumn() error {
-	query := `
-	DO $$ BEGIN
-		IF NOT EXISTS (
-			SELECT 1
-			FROM information_schema.columns
-			WHERE table_name = 'account' AND column_name = 'account_number'
-		) THEN
-			ALTER TABLE account ADD COLUMN account_number serial;
-		END IF;
-	END $$;
-	`
-	_, err := s.db.Exec(query)
-	if err != nil {
-		log.Printf("Error ensuring account_number column: %v", err)
-	} else {
-		log.Println("Account_number column exists or was added successfully.")
-	}
-	return err
-}
-
-func (s *PostgresStorage) CreateAccount(acc *Account) error {
-
-	if acc.CreatedAt.IsZero() {
-		acc.CreatedAt = time.Now()
-	}
-
-	query := `insert into account 
-	(first_name, last_name, account_number, encrypted_password, balance, created_at)
-	values ($1, $2, $3, $4, $5, $6)`
-
-	_, err := s.db.Query(
-		query,
-		acc.FirstName,
-		acc.LastName,
-		acc.Number,
-		acc.EncryptedPassword,
-		acc.Balance,
-		acc.CreatedAt)
-
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (s *PostgresStorage) GetAccountByNumber(number int64) (*Account, error) {
-	log.Printf("Attempting to find account with number: %d", number)
-
-	// Use QueryRow instead of Query to ensure single row
-	row := s.db.QueryRow("SELECT id, first_name, last_name, account_number, encrypted_password, balance, created_at FROM account WHERE account_number = $1", number)
-
-	account := &Account{}
-
-	// Explicitly declare variables for each column
-	var (
-		id                int
-		firstName         string
-		lastName          string
-		accountNumber     int64
-		encryptedPassword string
-		balance           int64
-		createdAt         time.Time
-	)
-
-	// Scan into explicit variables
-	err := row.Scan(
-		&id,
-		&firstName,
-		&lastName,
-		&accountNumber,
-		&encryptedPassword,
-		&balance,
-		&createdAt,
-	)
-
-	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Printf("No account found with number: %d", number)
-			return nil, fmt.Errorf("account with number [%d] not found", number)
-		}
-
-		log.Printf("Error scanning account: %v", err)
-		return nil, err
-	}
-
-	// Manually construct the account
-	account.ID = int(id)
-	account.FirstName = firstName
-	account.LastName = lastName
-	account.Number = accountNumber
-	account.EncryptedPassword = encryptedPassword
-	account.Balance = balance
-	account.CreatedAt = createdAt
-
-	log.Printf("Found account: ID=%d, Number=%d", account.ID, account.Number)
-
-	return account, nil
-}
-
-func (s *PostgresStorage) UpdateAccount(*Account) error {
-	return nil
-}
-
-func (s *PostgresStorage) DeleteAccount(id int) error {
-	_, err := s.db.Query("DELETE FROM account WHERE id = $1", id)
-
-	return err
-}
-
-func (s *PostgresStorage) GetAccountbyID(id int) (*Account, error) {
-	row := s.db.QueryRow("SELECT id, first_name, last_name, account_number, encrypted_password, balance, created_at FROM account WHERE id = $1", id)
-
-	account := &Account{}
-	err := row.Scan(
-		&account.ID,
-		&account.FirstName,
-		&account.LastName,
-		&account.Number,
-		&account.EncryptedPassword,
-		&account.Balance,
-		&account.CreatedAt,
-	)
-
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("account with id %d not found", id)
-		}
-		log.Printf("Get Account by ID Scan Error: %v", err)
-		return nil, err
-	}
-
-	return account, nil
-}
-
-func (s *PostgresStorage) GetAccounts() ([]*Account, error) {
-	rows, err := s.db.Query("SELECT id, first_name, last_name, account_number, encrypted_password, balance, created_at FROM account")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	accounts := []*Account{}
-	for rows.Next() {
-		account := &Account{}
-		err := rows.Scan(
-			&account.ID,
-			&account.FirstName,
-			&account.LastName,
-			&account.Number,
-			&account.EncryptedPassword,
-			&account.Balance,
-			&account.CreatedAt,
-		)
-
-		if err != nil {
-			log.Printf("Individual Account Scan Error: %v", err)
-			continue
-		}
-		accounts = append(accounts, account)
-	}
-
-	if err = rows.Err(); err != nil {
-		return nil, err
-	}
-
-	return accounts, nil
-}
-
-func scanIntoAccount(rows *sql.Rows) (*Account, error) {
-	account := new(Account)
-	err := rows.Scan(
-		&account.ID,
-		&account.FirstName,
-		&account.LastName,
-		&account.Number,
-		&account.EncryptedPassword,
-		&account.Balance,
-		&account.CreatedAt,
-	)
-
-	if err != nil {
-		log.Printf("Scan Error Details: %+v", err)
-		log.Printf("Error Type: %T", err)
-		return nil, fmt.Errorf("scan error: %v", err)
-	}
-
-	return account, nil
-}
-
-func (s *PostgresStorage) BeginTransaction() (Transaction, error) {
-	return s.db.Begin()
-}
-
-func (s *PostgresStorage) UpdateAccountBalance(accountID int, amount float64, tx Transaction) error {
-	// Convert float64 to int64 cents to avoid floating point precision issues
-	amountInCents := int64(amount * 100)
-
-	query := "UPDATE account SET balance = balance + $1 WHERE id = $2"
-
-	var err error
-	if tx != nil {
-		_, err = tx.Exec(query, amountInCents, accountID)
-	} else {
-		_, err = s.db.Exec(query, amountInCents, accountID)
-	}
-
-	if err != nil {
-		return fmt.Errorf("failed to update account balance: %v", err)
-	}
-
-	return nil
-}
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type Storage interface {
+	CreateAccount(ctx context.Context, acc *Account) error
+	CloseAccount(ctx context.Context, id int, closedAt time.Time) error
+	SetAccountStatus(ctx context.Context, id int, from, to string) error
+	UpdateAccount(ctx context.Context, acc *Account) error
+	GetAccounts(ctx context.Context) ([]*Account, error)
+	GetAccountbyID(ctx context.Context, id int) (*Account, error)
+	GetAccountByNumber(ctx context.Context, number int64) (*Account, error)
+	BeginTransaction(ctx context.Context) (Transaction, error)
+	PostLedgerEntry(ctx context.Context, entry *LedgerEntry, tx Transaction) error
+	RecordTransfer(ctx context.Context, fromAccountID, toAccountID int, conv Conversion, tx Transaction) error
+	GetDailyTransferUsage(ctx context.Context, accountID int, day time.Time) (*TransferUsage, error)
+	GetTransferReceipt(ctx context.Context, reference string) (*TransferReceipt, error)
+	CreateTransferJob(ctx context.Context, job *TransferJob) error
+	GetTransferJob(ctx context.Context, id string) (*TransferJob, error)
+	GetDueTransferJobs(ctx context.Context, now time.Time, limit int) ([]*TransferJob, error)
+	ClaimTransferJob(ctx context.Context, id string, now, leaseUntil time.Time) (bool, error)
+	UpdateTransferJob(ctx context.Context, job *TransferJob) error
+	RecordAudit(ctx context.Context, entry *AuditEntry, tx Transaction) error
+	GetAuditLog(ctx context.Context, accountID int) ([]*AuditEntry, error)
+	CreateScheduledTransfer(ctx context.Context, st *ScheduledTransfer) error
+	GetScheduledTransfers(ctx context.Context, accountID int) ([]*ScheduledTransfer, error)
+	CancelScheduledTransfer(ctx context.Context, accountID, id int) error
+	GetDueScheduledTransfers(ctx context.Context, now time.Time, limit int) ([]*ScheduledTransfer, error)
+	ClaimScheduledTransfer(ctx context.Context, id int, now, leaseUntil time.Time) (bool, error)
+	UpdateScheduledTransfer(ctx context.Context, st *ScheduledTransfer) error
+	GetOverdrawnAccounts(ctx context.Context) ([]*Account, error)
+	SearchAccounts(ctx context.Context, search AccountSearch) ([]*Account, error)
+	RecordOverdraftFee(ctx context.Context, fee *OverdraftFee, tx Transaction) (bool, error)
+	GetOverdraftFeeTotal(ctx context.Context, accountID int) (int64, error)
+	SaveFeeSchedule(ctx context.Context, fs *FeeSchedule) error
+	GetFeeSchedule(ctx context.Context, currency string) (*FeeSchedule, error)
+	GetFeeSchedules(ctx context.Context) ([]*FeeSchedule, error)
+	RecordFeeCharge(ctx context.Context, charge *FeeCharge, tx Transaction) (bool, error)
+	MergeAccounts(ctx context.Context, merge *AccountMerge, tx Transaction) error
+	CreateSweepRule(ctx context.Context, rule *SweepRule) error
+	GetSweepRules(ctx context.Context, accountID int) ([]*SweepRule, error)
+	CancelSweepRule(ctx context.Context, accountID, id int) error
+	GetDueSweepRules(ctx context.Context, now time.Time, limit int) ([]*SweepRule, error)
+	AdvanceSweepRule(ctx context.Context, id int, from, to time.Time) (bool, error)
+	RecordSweepExecution(ctx context.Context, execution *SweepExecution) error
+	GetSweepExecutions(ctx context.Context, accountID, ruleID int) ([]*SweepExecution, error)
+	RecordCashback(ctx context.Context, c *Cashback, tx Transaction) error
+	GetCashbackTotal(ctx context.Context, accountID int, since time.Time) (int64, error)
+	GetCashbackCredits(ctx context.Context, accountID int, limit int) ([]*Cashback, error)
+	CreatePasswordReset(ctx context.Context, reset *PasswordReset) error
+	GetPasswordReset(ctx context.Context, tokenHash string) (*PasswordReset, error)
+	ResetPassword(ctx context.Context, resetID int, encryptedPassword string, usedAt time.Time) error
+	RehashPassword(ctx context.Context, id int, oldHash, newHash string) error
+	SavePIN(ctx context.Context, pin *AccountPIN) error
+	GetPIN(ctx context.Context, accountID int) (*AccountPIN, error)
+	RecordPINFailure(ctx context.Context, accountID int, maxAttempts int, lockUntil time.Time) (*AccountPIN, error)
+	ResetPINFailures(ctx context.Context, accountID int) error
+	GetLoginFailures(ctx context.Context, accountID int) (*LoginFailures, error)
+	RecordLoginFailure(ctx context.Context, accountID int, maxAttempts int, lockUntil, now time.Time) (*LoginFailures, error)
+	ClearLoginFailures(ctx context.Context, accountID int) error
+	GetAccountByEmail(ctx context.Context, email string) (*Account, error)
+	GetOIDCIdentity(ctx context.Context, issuer, subject string) (*OIDCIdentity, error)
+	CreateOIDCIdentity(ctx context.Context, identity *OIDCIdentity) error
+	CreateAPIKey(ctx context.Context, key *APIKey) error
+	GetAPIKeyByHash(ctx context.Context, hash string) (*APIKey, error)
+	ListAPIKeys(ctx context.Context) ([]*APIKey, error)
+	RevokeAPIKey(ctx context.Context, id int, at time.Time) (*APIKey, error)
+	TouchAPIKey(ctx context.Context, id int, at time.Time) error
+	GetPreferences(ctx context.Context, accountID int) (*AccountPreferences, error)
+	SavePreferences(ctx context.Context, prefs *AccountPreferences) error
+	GetStatementOptIns(ctx context.Context) ([]int, error)
+	ClaimStatement(ctx context.Context, accountID int, period, at time.Time) (bool, error)
+	ReleaseStatement(ctx context.Context, accountID int, period time.Time) error
+	CreateNotification(ctx context.Context, n *Notification) error
+	GetNotifications(ctx context.Context, accountID int, unreadOnly bool, limit int) ([]*Notification, error)
+	MarkNotificationsRead(ctx context.Context, accountID int, upTo int64, at time.Time) (int64, error)
+	RecordLoginIP(ctx context.Context, accountID int, ip string, at time.Time) (bool, error)
+	GetBalanceTotals(ctx context.Context) ([]*BalanceTotal, error)
+	GetDailyIncome(ctx context.Context, from, to time.Time) ([]*DailyIncome, error)
+	RecordLiabilitySnapshot(ctx context.Context, snap *LiabilitySnapshot) error
+	GetLiabilitySnapshots(ctx context.Context, from, to time.Time) ([]*LiabilitySnapshot, error)
+	CreateEmailVerification(ctx context.Context, v *EmailVerification) error
+	VerifyEmail(ctx context.Context, tokenHash string, now time.Time) (int, error)
+	TouchAccountActivity(ctx context.Context, id int, at time.Time) error
+	GetInactiveAccounts(ctx context.Context, before time.Time, skipNotified bool, limit int) ([]*Account, error)
+	MarkDormancyNotified(ctx context.Context, id int, at time.Time) (bool, error)
+	RecordAccountEvent(ctx context.Context, event *AccountEvent) error
+	GetAccountEvents(ctx context.Context, accountID int, after int64, limit int) ([]*AccountEvent, error)
+	GetLatestAccountEventID(ctx context.Context, accountID int) (int64, error)
+	CreateEventSubscription(ctx context.Context, sub *EventSubscription) error
+	GetEventSubscriptions(ctx context.Context, accountID int) ([]*EventSubscription, error)
+	GetActiveEventSubscriptions(ctx context.Context, limit int) ([]*EventSubscription, error)
+	CancelEventSubscription(ctx context.Context, accountID, id int) error
+	AdvanceEventSubscription(ctx context.Context, id int, from, to int64) (bool, error)
+	GetAccountTransactions(ctx context.Context, accountID int, filter TransactionFilter) ([]*AccountTransaction, error)
+	GetCategoryFlows(ctx context.Context, accountID int, from, to time.Time) ([]*CategoryFlow, error)
+	GetLargestTransactions(ctx context.Context, accountID int, from, to time.Time, limit int) ([]*AccountTransaction, error)
+	RecordTransferEnrichment(ctx context.Context, e *TransferEnrichment) error
+	GetTransferEnrichments(ctx context.Context, reference string) ([]*TransferEnrichment, error)
+	GetLedgerEntries(ctx context.Context, from, until time.Time) ([]*LedgerEntry, error)
+	GetClosingBalances(ctx context.Context, at time.Time) ([]*ClosingBalance, error)
+	GetBalanceAt(ctx context.Context, accountID int, at time.Time) (int64, error)
+	RecordExportDelivery(ctx context.Context, d *ExportDelivery) error
+	GetExportDeliveries(ctx context.Context, since time.Time) ([]*ExportDelivery, error)
+	DeleteExportDelivery(ctx context.Context, fileName string) error
+	CreateLegalHold(ctx context.Context, hold *LegalHold) error
+	GetLegalHolds(ctx context.Context, accountID int, activeOnly bool) ([]*LegalHold, error)
+	ReleaseLegalHold(ctx context.Context, accountID, id int, by, reason, reference string, at time.Time) (*LegalHold, error)
+	CreateKYCSubmission(ctx context.Context, sub *KYCSubmission) error
+	GetKYCSubmissions(ctx context.Context, accountID int) ([]*KYCSubmission, error)
+	GetKYCSubmissionsByStatus(ctx context.Context, status string) ([]*KYCSubmission, error)
+	GetKYCStatus(ctx context.Context, accountID int) (string, error)
+	ReviewKYCSubmission(ctx context.Context, id int, status, reason, by string, at time.Time) (*KYCSubmission, error)
+	CreateErasureRequest(ctx context.Context, req *ErasureRequest) error
+	GetErasureRequest(ctx context.Context, accountID int) (*ErasureRequest, error)
+	GetDueErasures(ctx context.Context, now time.Time, limit int) ([]*ErasureRequest, error)
+	EraseAccount(ctx context.Context, accountID int, at time.Time) error
+	SaveAlias(ctx context.Context, alias *AccountAlias) error
+	GetAliases(ctx context.Context, accountID int) ([]*AccountAlias, error)
+	GetVerifiedAlias(ctx context.Context, value string) (*AccountAlias, error)
+	VerifyAlias(ctx context.Context, accountID, id int, codeHash string, at time.Time) (*AccountAlias, error)
+	DeleteAlias(ctx context.Context, accountID, id int) (*AccountAlias, error)
+	CreateSplit(ctx context.Context, split *SplitBill) error
+	GetSplit(ctx context.Context, id int) (*SplitBill, error)
+	GetSplits(ctx context.Context, accountID int) ([]*SplitBill, error)
+	GetSplitShare(ctx context.Context, id int) (*SplitShare, error)
+	GetSplitShares(ctx context.Context, accountID int) ([]*SplitShare, error)
+	GetSplitShareByTransfer(ctx context.Context, reference string) (*SplitShare, error)
+	ResolveSplit(ctx context.Context, split *SplitBill, from string) (bool, error)
+	ResolveSplitShare(ctx context.Context, share *SplitShare, from string) (bool, error)
+	CreateDispute(ctx context.Context, dispute *Dispute) error
+	GetDispute(ctx context.Context, id int) (*Dispute, error)
+	GetTransferDispute(ctx context.Context, reference string) (*Dispute, error)
+	GetAccountDisputes(ctx context.Context, accountNumber int64) ([]*Dispute, error)
+	GetDisputes(ctx context.Context, status string) ([]*Dispute, error)
+	ResolveDispute(ctx context.Context, dispute *Dispute, from string) (bool, error)
+	CreatePendingOperation(ctx context.Context, op *PendingOperation) error
+	GetPendingOperation(ctx context.Context, id int) (*PendingOperation, error)
+	GetPendingOperations(ctx context.Context, status string) ([]*PendingOperation, error)
+	AddOperationApproval(ctx context.Context, id int, approval *OperationApproval) error
+	SetOperationStatus(ctx context.Context, op *PendingOperation, from, to string) (bool, error)
+	ClaimEODRun(ctx context.Context, day, cutOff, now, staleBefore time.Time) (*EODRun, error)
+	SaveEODStep(ctx context.Context, day time.Time, step *EODStep) error
+	FinishEODRun(ctx context.Context, day time.Time, status string, at time.Time) error
+	GetEODRun(ctx context.Context, day time.Time) (*EODRun, error)
+	GetEODRuns(ctx context.Context, limit int) ([]*EODRun, error)
+	CreateReservation(ctx context.Context, r *Reservation) error
+	GetReservations(ctx context.Context, accountID int, activeOnly bool) ([]*Reservation, error)
+	GetReservation(ctx context.Context, id int) (*Reservation, error)
+	ResolveReservation(ctx context.Context, r *Reservation, from string) (bool, error)
+	ExpireReservations(ctx context.Context, now time.Time) (int64, error)
+	CreatePendingTransfer(ctx context.Context, pt *PendingTransfer) error
+	GetPendingTransfer(ctx context.Context, reference string) (*PendingTransfer, error)
+	GetPendingTransfers(ctx context.Context, status string) ([]*PendingTransfer, error)
+	UpdatePendingTransfer(ctx context.Context, pt *PendingTransfer, from string) (bool, error)
+	GetTransferHistory(ctx context.Context, fromAccountID, toAccountID int, since time.Time) (*TransferHistory, error)
+	CreateFraudDecision(ctx context.Context, d *FraudDecision) error
+	GetFraudDecisions(ctx context.Context, action string, limit int) ([]*FraudDecision, error)
+	GetAccountCounts(ctx context.Context) (*AccountCounts, error)
+	GetTransferVolume(ctx context.Context, from, to time.Time) ([]*TransferVolume, error)
+	GetTopAccounts(ctx context.Context, since time.Time, limit int) ([]*AccountActivity, error)
+	CreateMandate(ctx context.Context, m *Mandate) error
+	GetMandate(ctx context.Context, id int) (*Mandate, error)
+	GetMandates(ctx context.Context, accountID int) ([]*Mandate, error)
+	UpdateMandateStatus(ctx context.Context, m *Mandate, from string) (bool, error)
+	CreateMandateCollection(ctx context.Context, c *MandateCollection) error
+	GetMandateCollections(ctx context.Context, mandateID int) ([]*MandateCollection, error)
+	GetDueMandateCollections(ctx context.Context, now time.Time, limit int) ([]*MandateCollection, error)
+	ClaimMandateCollection(ctx context.Context, id int, now, leaseUntil time.Time) (bool, error)
+	UpdateMandateCollection(ctx context.Context, c *MandateCollection) error
+	CreateCheque(ctx context.Context, c *Cheque) error
+	GetCheque(ctx context.Context, id int) (*Cheque, error)
+	GetCheques(ctx context.Context, accountID int) ([]*Cheque, error)
+	GetDueCheques(ctx context.Context, now time.Time, limit int) ([]*Cheque, error)
+	ResolveCheque(ctx context.Context, c *Cheque, from string) (bool, error)
+	CreateCard(ctx context.Context, card *Card) error
+	GetCard(ctx context.Context, id int) (*Card, error)
+	GetCards(ctx context.Context, accountID int) ([]*Card, error)
+	SetCardStatus(ctx context.Context, id int, from, to string) error
+	UpdateCardLimits(ctx context.Context, card *Card) error
+	CreateExternalTransfer(ctx context.Context, t *ExternalTransfer, tx Transaction) error
+	GetExternalTransfers(ctx context.Context, accountID int) ([]*ExternalTransfer, error)
+	GetDueExternalTransfers(ctx context.Context, now time.Time, limit int) ([]*ExternalTransfer, error)
+	ResolveExternalTransfer(ctx context.Context, t *ExternalTransfer, from string) (bool, error)
+	CreateBeneficiary(ctx context.Context, b *Beneficiary) error
+	GetBeneficiary(ctx context.Context, id int) (*Beneficiary, error)
+	GetBeneficiaries(ctx context.Context, accountID int) ([]*Beneficiary, error)
+	DeleteBeneficiary(ctx context.Context, id int) error
+	CreateStandingOrder(ctx context.Context, o *StandingOrder) error
+	GetStandingOrder(ctx context.Context, id int) (*StandingOrder, error)
+	GetStandingOrders(ctx context.Context, accountID int) ([]*StandingOrder, error)
+	GetDueStandingOrders(ctx context.Context, now time.Time, limit int) ([]*StandingOrder, error)
+	ClaimStandingOrder(ctx context.Context, id int, now, leaseUntil time.Time) (bool, error)
+	UpdateStandingOrder(ctx context.Context, o *StandingOrder, from string) (bool, error)
+}
+
+type Transaction interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	Commit() error
+	Rollback() error
+}
+
+type PostgresStorage struct {
+	db *sql.DB
+
+	// Upper bound for a single query, on top of the caller's context
+	queryTimeout time.Duration
+
+	// Set on request-scoped copies, see WithRequestID
+	requestID string
+
+	// By query, nil until PrepareStatements
+	stmts map[string]*sql.Stmt
+
+	// Serves account lookups when configured, see replica.go
+	replica *replicaPool
+}
+
+func NewPostgresStorage(cfg *Config) (*PostgresStorage, error) {
+	db, err := sql.Open("postgres", cfg.DatabaseURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	db.SetMaxIdleConns(cfg.DBMaxIdleConns)
+	db.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
+
+	s := &PostgresStorage{
+		db:           db,
+		queryTimeout: cfg.DBQueryTimeout,
+	}
+	if cfg.DatabaseReplicaURL != "" {
+		if s.replica, err = newReplicaPool(cfg); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// WithRequestID returns a copy sharing the connection pool whose queries carry
+// the request ID, so DB-side slow query logs can be matched to API requests.
+func (s *PostgresStorage) WithRequestID(id string) Storage {
+	scoped := *s
+	scoped.requestID = id
+	return &scoped
+}
+
+func (s *PostgresStorage) tagQuery(query string) string {
+	if s.requestID == "" {
+		return query
+	}
+	return "/* request_id=" + s.requestID + " */ " + query
+}
+
+// ConsistencyToken is the primary's current WAL position. Anything committed
+// before the call is visible once a server has replayed up to it.
+func (s *PostgresStorage) ConsistencyToken(ctx context.Context) (string, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	var lsn string
+	err := s.db.QueryRowContext(ctx, s.tagQuery("SELECT pg_current_wal_lsn()::text")).Scan(&lsn)
+	return lsn, err
+}
+
+var validLSN = regexp.MustCompile(`^[0-9A-Fa-f]{1,8}/[0-9A-Fa-f]{1,8}$`)
+
+func (s *PostgresStorage) WaitForConsistencyToken(ctx context.Context, token string, timeout time.Duration) error {
+	if !validLSN.MatchString(token) {
+		return ErrInvalidConsistencyToken
+	}
+
+	// On a primary pg_last_wal_replay_lsn is null and the check passes immediately
+	// With a replica the wait is for the replica, it serves the reads that follow
+	query := "SELECT coalesce(pg_last_wal_replay_lsn(), pg_current_wal_lsn()) >= $1::pg_lsn"
+	deadline := time.Now().Add(timeout)
+	for {
+		var caughtUp bool
+		err := s.readRow(ctx, func(row *sql.Row) error { return row.Scan(&caughtUp) }, query, token)
+		if err != nil {
+			return err
+		}
+		if caughtUp {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrConsistencyTimeout
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// queryContext bounds one query by queryTimeout. Cancellation of the caller's
+// context, e.g. a client disconnecting, still aborts the query.
+func (s *PostgresStorage) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, span := startStorageSpan(ctx, 1)
+	var cancel context.CancelFunc
+	if s.queryTimeout <= 0 {
+		ctx, cancel = context.WithCancel(ctx)
+	} else {
+		ctx, cancel = context.WithTimeout(ctx, s.queryTimeout)
+	}
+	return ctx, func() {
+		cancel()
+		span.End()
+	}
+}
+
+func (s *PostgresStorage) Stats() sql.DBStats {
+	return s.db.Stats()
+}
+
+func (s *PostgresStorage) Ping(ctx context.Context) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	return s.db.PingContext(ctx)
+}
+
+func (s *PostgresStorage) init() error {
+	return s.createMigrationsTable()
+}
+
+const accountColumns = `id, first_name, last_name, account_number, encrypted_password, balance, currency,
+	status, overdraft_limit, coalesce(merged_into, 0), closed_at, coalesce(email, ''), email_verified, last_activity_at, created_at, version,
+	nickname, metadata`
+
+func (s *PostgresStorage) CreateAccount(ctx context.Context, acc *Account) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	return s.insertAccount(ctx, s.db, acc)
+}
+
+// rowQueryer is a *sql.DB or a *sql.Tx
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (s *PostgresStorage) insertAccount(ctx context.Context, q rowQueryer, acc *Account) error {
+	if acc.CreatedAt.IsZero() {
+		acc.CreatedAt = time.Now()
+	}
+	if acc.LastActivityAt.IsZero() {
+		acc.LastActivityAt = acc.CreatedAt
+	}
+
+	err := s.queryRow(ctx, q, insertAccountQuery,
+		acc.FirstName,
+		acc.LastName,
+		acc.Number,
+		acc.EncryptedPassword,
+		acc.Balance,
+		acc.Currency,
+		acc.Status,
+		acc.OverdraftLimit,
+		acc.Email,
+		acc.LastActivityAt,
+		acc.CreatedAt).Scan(&acc.ID)
+
+	if isUniqueViolation(err, "account_email_key") {
+		return ErrEmailTaken
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// isUniqueViolation reports whether err is a unique constraint failure on the named index
+func isUniqueViolation(err error, constraint string) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == constraint
+}
+
+// isCheckViolation reports whether err is a failure of the named check constraint
+func isCheckViolation(err error, constraint string) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23514" && pqErr.Constraint == constraint
+}
+
+// balanceCheck is the constraint keeping balances of accounts without an
+// overdraft from going negative. It's the last line against a debit that
+// passed the application's checks on stale data.
+const balanceCheck = "account_balance_not_negative"
+
+func (s *PostgresStorage) GetAccountByNumber(ctx context.Context, number int64) (*Account, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	log.Printf("Attempting to find account with number: %d", number)
+
+	account := &Account{}
+
+	// Explicitly declare variables for each column
+	var (
+		id                int
+		firstName         string
+		lastName          string
+		accountNumber     int64
+		encryptedPassword string
+		balance           int64
+		currency          string
+		status            string
+		overdraftLimit    int64
+		mergedInto        int
+		closedAt          *time.Time
+		email             string
+		emailVerified     bool
+		lastActivityAt    time.Time
+		createdAt         time.Time
+		version           int64
+		nickname          string
+		metadata          AccountMetadata
+	)
+
+	// Scan into explicit variables
+	err := s.readRow(ctx, func(row *sql.Row) error {
+		return row.Scan(
+			&id,
+			&firstName,
+			&lastName,
+			&accountNumber,
+			&encryptedPassword,
+			&balance,
+			&currency,
+			&status,
+			&overdraftLimit,
+			&mergedInto,
+			&closedAt,
+			&email,
+			&emailVerified,
+			&lastActivityAt,
+			&createdAt,
+			&version,
+			&nickname,
+			&metadata,
+		)
+	}, accountByNumberQuery, number)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			log.Printf("No account found with number: %d", number)
+			return nil, fmt.Errorf("%w: number %d", ErrAccountNotFound, number)
+		}
+
+		log.Printf("Error scanning account: %v", err)
+		return nil, err
+	}
+
+	// Manually construct the account
+	account.ID = int(id)
+	account.FirstName = firstName
+	account.LastName = lastName
+	account.Number = accountNumber
+	account.EncryptedPassword = encryptedPassword
+	account.Balance = balance
+	account.Currency = currency
+	account.Status = status
+	account.OverdraftLimit = overdraftLimit
+	account.MergedInto = mergedInto
+	account.ClosedAt = closedAt
+	account.Email = email
+	account.EmailVerified = emailVerified
+	account.LastActivityAt = lastActivityAt
+	account.CreatedAt = createdAt
+	account.Version = version
+	account.Nickname = nickname
+	account.Metadata = metadata
+
+	log.Printf("Found account: ID=%d, Number=%d", account.ID, account.Number)
+
+	return account, nil
+}
+
+// SetAccountStatus moves the account from one status to another, it fails
+// if the account isn't in the from status anymore
+func (s *PostgresStorage) SetAccountStatus(ctx context.Context, id int, from, to string) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		s.tagQuery("UPDATE account SET status = $1 WHERE id = $2 AND status = $3"),
+		to, id, from)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("account %d is no longer %s", id, from)
+	}
+	return nil
+}
+
+// UpdateAccount saves the account's editable fields, balances only change
+// through PostLedgerEntry. It fails with ErrConflict when the row changed
+// since acc was read.
+func (s *PostgresStorage) UpdateAccount(ctx context.Context, acc *Account) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		s.tagQuery(`UPDATE account SET first_name = $1, last_name = $2, overdraft_limit = $3, nickname = $4, metadata = $5, version = version + 1
+		WHERE id = $6 AND version = $7`),
+		acc.FirstName, acc.LastName, acc.OverdraftLimit, acc.Nickname, acc.Metadata, acc.ID, acc.Version)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return s.versionMismatch(ctx, acc.ID)
+	}
+	acc.Version++
+	return nil
+}
+
+// versionMismatch tells a stale version from a missing account after a
+// versioned update touched no rows
+func (s *PostgresStorage) versionMismatch(ctx context.Context, id int) error {
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, s.tagQuery("SELECT exists(SELECT 1 FROM account WHERE id = $1)"), id).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
+	return fmt.Errorf("%w: account %d", ErrConflict, id)
+}
+
+// CloseAccount keeps the row for history, it fails with ErrBalanceNotZero
+// unless the account is empty at the moment it's closed
+func (s *PostgresStorage) CloseAccount(ctx context.Context, id int, closedAt time.Time) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		s.tagQuery("UPDATE account SET status = $1, closed_at = $2 WHERE id = $3 AND balance = 0 AND status <> $1"),
+		AccountClosed, closedAt, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		acc, err := s.GetAccountbyID(ctx, id)
+		if err != nil {
+			return err
+		}
+		if acc.Status == AccountClosed {
+			return ErrAccountClosed
+		}
+		return ErrBalanceNotZero
+	}
+	return nil
+}
+
+func (s *PostgresStorage) GetAccountbyID(ctx context.Context, id int) (*Account, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	account := &Account{}
+	err := s.readRow(ctx, func(row *sql.Row) error {
+		return row.Scan(
+			&account.ID,
+			&account.FirstName,
+			&account.LastName,
+			&account.Number,
+			&account.EncryptedPassword,
+			&account.Balance,
+			&account.Currency,
+			&account.Status,
+			&account.OverdraftLimit,
+			&account.MergedInto,
+			&account.ClosedAt,
+			&account.Email,
+			&account.EmailVerified,
+			&account.LastActivityAt,
+			&account.CreatedAt,
+			&account.Version,
+			&account.Nickname,
+			&account.Metadata,
+		)
+	}, accountByIDQuery, id)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+		}
+		log.Printf("Get Account by ID Scan Error: %v", err)
+		return nil, err
+	}
+
+	return account, nil
+}
+
+func (s *PostgresStorage) GetAccounts(ctx context.Context) ([]*Account, error) {
+	query := "SELECT " + accountColumns + " FROM account"
+	if replica := s.readReplica(ctx); replica != nil {
+		accounts, err := s.queryAccountsOn(ctx, replica.db, query)
+		if err == nil || ctx.Err() != nil {
+			return accounts, err
+		}
+		replica.markDown(err)
+	}
+	return s.queryAccounts(ctx, query)
+}
+
+func (s *PostgresStorage) queryAccounts(ctx context.Context, query string, args ...interface{}) ([]*Account, error) {
+	return s.queryAccountsOn(ctx, s.db, query, args...)
+}
+
+func (s *PostgresStorage) queryAccountsOn(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]*Account, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, s.tagQuery(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []*Account{}
+	for rows.Next() {
+		account, err := scanIntoAccount(rows)
+		if err != nil {
+			log.Printf("Individual Account Scan Error: %v", err)
+			continue
+		}
+		accounts = append(accounts, account)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return accounts, nil
+}
+
+func scanIntoAccount(rows *sql.Rows) (*Account, error) {
+	account := new(Account)
+	err := rows.Scan(
+		&account.ID,
+		&account.FirstName,
+		&account.LastName,
+		&account.Number,
+		&account.EncryptedPassword,
+		&account.Balance,
+		&account.Currency,
+		&account.Status,
+		&account.OverdraftLimit,
+		&account.MergedInto,
+		&account.ClosedAt,
+		&account.Email,
+		&account.EmailVerified,
+		&account.LastActivityAt,
+		&account.CreatedAt,
+		&account.Version,
+		&account.Nickname,
+		&account.Metadata,
+	)
+
+	if err != nil {
+		log.Printf("Scan Error Details: %+v", err)
+		log.Printf("Error Type: %T", err)
+		return nil, fmt.Errorf("scan error: %v", err)
+	}
+
+	return account, nil
+}
+
+func (s *PostgresStorage) BeginTransaction(ctx context.Context) (Transaction, error) {
+	// The transaction lives as long as ctx, queryTimeout applies per statement
+	spanCtx, span := startDBSpan(ctx, "db.transaction")
+	sqlTx, err := s.db.BeginTx(ctx, txOptions(ctx))
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	tx := &tracedTx{Tx: sqlTx, ctx: spanCtx, span: span, started: time.Now()}
+
+	if s.queryTimeout > 0 {
+		timeout := strconv.FormatInt(s.queryTimeout.Milliseconds(), 10)
+		if _, err := tx.ExecContext(ctx, "SELECT set_config('statement_timeout', $1, true)", timeout); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	// Shows up in pg_stat_activity and the server log for the transaction's lifetime
+	if s.requestID != "" {
+		if _, err := tx.ExecContext(ctx, "SELECT set_config('application_name', $1, true)", "gobank:"+s.requestID); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	return tx, nil
+}
+
+// PostLedgerEntry writes a balanced entry and moves the balances of the
+// customer accounts it posts to. Without tx it runs in its own transaction.
+func (s *PostgresStorage) PostLedgerEntry(ctx context.Context, entry *LedgerEntry, tx Transaction) error {
+	if err := entry.validate(); err != nil {
+		return err
+	}
+
+	if tx == nil {
+		own, err := s.BeginTransaction(ctx)
+		if err != nil {
+			return err
+		}
+		defer own.Rollback()
+		if err := s.PostLedgerEntry(ctx, entry, own); err != nil {
+			return err
+		}
+		return own.Commit()
+	}
+
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	accountIDs := make([]int64, len(entry.Postings))
+	ledgerAccounts := make([]string, len(entry.Postings))
+	currencies := make([]string, len(entry.Postings))
+	amounts := make([]int64, len(entry.Postings))
+	for i, p := range entry.Postings {
+		accountIDs[i], ledgerAccounts[i], currencies[i], amounts[i] = int64(p.AccountID), p.LedgerAccount, p.Currency, p.Amount
+	}
+
+	// Each account's row only changes if nobody else wrote it since it was read
+	for _, change := range entry.balanceChanges() {
+		res, err := s.exec(ctx, tx, updateBalanceQuery, change.amount, change.accountID, change.version)
+		if isCheckViolation(err, balanceCheck) {
+			return fmt.Errorf("%w: account %d has no overdraft", ErrInsufficientFunds, change.accountID)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update account balance: %w", err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return s.versionMismatch(ctx, change.accountID)
+		}
+	}
+
+	_, err := s.exec(ctx, tx, insertLedgerEntryQuery, entry.Kind, entry.Reference, entry.Memo, entry.Category, entry.CreatedAt,
+		pq.Array(accountIDs), pq.Array(ledgerAccounts), pq.Array(currencies), pq.Array(amounts))
+	if err != nil {
+		return fmt.Errorf("failed to record ledger entry: %w", err)
+	}
+
+	return nil
+}
+
+func (s *PostgresStorage) GetAccountTransactions(ctx context.Context, accountID int, filter TransactionFilter) ([]*AccountTransaction, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	query := `select e.id, e.kind, coalesce(e.reference::text, ''), coalesce(e.memo, ''), coalesce(e.category, ''), e.created_at, p.amount, p.currency
+	from postings p join ledger_entry e on e.id = p.entry_id
+	where p.account_id = $1
+		and ($2 = '' or lower(e.category) = lower($2))
+		and ($3 = 0 or e.id < $3)
+	order by e.id desc
+	limit $4`
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(query), accountID, filter.Category, filter.Before, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := []*AccountTransaction{}
+	for rows.Next() {
+		var entry LedgerEntry
+		var amount int64
+		var currency string
+		if err := rows.Scan(&entry.ID, &entry.Kind, &entry.Reference, &entry.Memo, &entry.Category, &entry.CreatedAt, &amount, &currency); err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, newAccountTransaction(&entry, amount, currency))
+	}
+	return transactions, rows.Err()
+}
+
+// GetLedgerEntries returns the entries created in [from, until) with their postings, oldest first
+func (s *PostgresStorage) GetLedgerEntries(ctx context.Context, from, until time.Time) ([]*LedgerEntry, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(`select e.id, e.kind, coalesce(e.reference::text, ''), coalesce(e.memo, ''), coalesce(e.category, ''), e.created_at,
+		coalesce(p.account_id, 0), coalesce(p.ledger_account, ''), p.currency, p.amount
+	from ledger_entry e join postings p on p.entry_id = e.id
+	where e.created_at >= $1 and e.created_at < $2
+	order by e.id, p.id`), from, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*LedgerEntry{}
+	for rows.Next() {
+		var e LedgerEntry
+		var p Posting
+		if err := rows.Scan(&e.ID, &e.Kind, &e.Reference, &e.Memo, &e.Category, &e.CreatedAt, &p.AccountID, &p.LedgerAccount, &p.Currency, &p.Amount); err != nil {
+			return nil, err
+		}
+		if n := len(entries); n == 0 || entries[n-1].ID != e.ID {
+			entries = append(entries, &e)
+		}
+		last := entries[len(entries)-1]
+		last.Postings = append(last.Postings, p)
+	}
+	return entries, rows.Err()
+}
+
+// GetClosingBalances winds each account's balance back to what it was at,
+// in one statement so the balances and postings are from the same snapshot
+func (s *PostgresStorage) GetClosingBalances(ctx context.Context, at time.Time) ([]*ClosingBalance, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(`select a.id, a.account_number, a.currency, a.balance - coalesce((
+		select sum(p.amount) from postings p join ledger_entry e on e.id = p.entry_id
+		where p.account_id = a.id and e.created_at >= $1
+	), 0)
+	from account a
+	where a.created_at < $1
+	order by a.id`), at)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	balances := []*ClosingBalance{}
+	for rows.Next() {
+		b := &ClosingBalance{}
+		if err := rows.Scan(&b.AccountID, &b.Number, &b.Currency, &b.Balance); err != nil {
+			return nil, err
+		}
+		balances = append(balances, b)
+	}
+	return balances, rows.Err()
+}
+
+// GetBalanceAt sums the account's postings in entries made up to at, an
+// index-only scan of postings_account_entry_idx
+func (s *PostgresStorage) GetBalanceAt(ctx context.Context, accountID int, at time.Time) (int64, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	var balance int64
+	err := s.db.QueryRowContext(ctx, s.tagQuery(`select coalesce(sum(p.amount), 0)
+	from postings p join ledger_entry e on e.id = p.entry_id
+	where p.account_id = $1 and e.created_at <= $2`), accountID, at).Scan(&balance)
+	return balance, err
+}
+
+func (s *PostgresStorage) RecordExportDelivery(ctx context.Context, d *ExportDelivery) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, s.tagQuery(`insert into export_delivery
+	(file_name, day, status, bytes, sha256, attempts, error, delivered_at, updated_at)
+	values ($1, $2, $3, $4, $5, $6, nullif($7, ''), $8, $9)
+	on conflict (file_name) do update
+	set status = excluded.status, bytes = excluded.bytes, sha256 = excluded.sha256, attempts = excluded.attempts,
+		error = excluded.error, delivered_at = excluded.delivered_at, updated_at = excluded.updated_at`),
+		d.FileName, d.Day, d.Status, d.Bytes, d.SHA256, d.Attempts, d.Error, d.DeliveredAt, d.UpdatedAt)
+	return err
+}
+
+// GetExportDeliveries lists deliveries for days from since, newest first
+func (s *PostgresStorage) GetExportDeliveries(ctx context.Context, since time.Time) ([]*ExportDelivery, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(`select file_name, day, status, bytes, sha256, attempts, coalesce(error, ''), delivered_at, updated_at
+	from export_delivery where day >= $1 order by day desc, file_name`), since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*ExportDelivery{}
+	for rows.Next() {
+		d := &ExportDelivery{}
+		if err := rows.Scan(&d.FileName, &d.Day, &d.Status, &d.Bytes, &d.SHA256, &d.Attempts, &d.Error, &d.DeliveredAt, &d.UpdatedAt); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// DeleteExportDelivery forgets a delivery so the next export run sends the file again
+func (s *PostgresStorage) DeleteExportDelivery(ctx context.Context, fileName string) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, s.tagQuery("delete from export_delivery where file_name = $1"), fileName)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("%w: %s", ErrExportNotFound, fileName)
+	}
+	return err
+}
+
+func (s *PostgresStorage) CreateLegalHold(ctx context.Context, hold *LegalHold) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	return s.db.QueryRowContext(ctx, s.tagQuery(`insert into legal_hold
+	(account_id, amount, percent, reason, reference, placed_by, placed_at)
+	values ($1, $2, $3, $4, $5, $6, $7)
+	returning id`),
+		hold.AccountID, hold.Amount, hold.Percent, hold.Reason, hold.Reference, hold.PlacedBy, hold.PlacedAt).Scan(&hold.ID)
+}
+
+const legalHoldColumns = `id, account_id, amount, percent, reason, reference, placed_by, placed_at,
+	released_at, coalesce(released_by, ''), coalesce(release_reason, ''), coalesce(release_reference, '')`
+
+func scanLegalHold(row interface{ Scan(...any) error }) (*LegalHold, error) {
+	h := &LegalHold{}
+	err := row.Scan(&h.ID, &h.AccountID, &h.Amount, &h.Percent, &h.Reason, &h.Reference, &h.PlacedBy, &h.PlacedAt,
+		&h.ReleasedAt, &h.ReleasedBy, &h.ReleaseReason, &h.ReleaseReference)
+	return h, err
+}
+
+func (s *PostgresStorage) GetLegalHolds(ctx context.Context, accountID int, activeOnly bool) ([]*LegalHold, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		s.tagQuery("select "+legalHoldColumns+" from legal_hold where account_id = $1 and (not $2 or released_at is null) order by id"),
+		accountID, activeOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	holds := []*LegalHold{}
+	for rows.Next() {
+		h, err := scanLegalHold(rows)
+		if err != nil {
+			return nil, err
+		}
+		holds = append(holds, h)
+	}
+	return holds, rows.Err()
+}
+
+// ReleaseLegalHold releases an active hold and returns it as released
+func (s *PostgresStorage) ReleaseLegalHold(ctx context.Context, accountID, id int, by, reason, reference string, at time.Time) (*LegalHold, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	hold, err := scanLegalHold(s.db.QueryRowContext(ctx, s.tagQuery(`update legal_hold
+	set released_at = $1, released_by = $2, release_reason = $3, release_reference = $4
+	where id = $5 and account_id = $6 and released_at is null
+	returning `+legalHoldColumns),
+		at, by, reason, reference, id, accountID))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", ErrLegalHoldNotFound, id)
+	}
+	return hold, err
+}
+
+func (s *PostgresStorage) CreateKYCSubmission(ctx context.Context, sub *KYCSubmission) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	err := s.db.QueryRowContext(ctx, s.tagQuery(`insert into kyc_submission
+	(account_id, document_type, document_number_hash, status, submitted_at)
+	values ($1, $2, $3, $4, $5)
+	returning id`),
+		sub.AccountID, sub.DocumentType, sub.DocumentNumberHash, sub.Status, sub.SubmittedAt).Scan(&sub.ID)
+	if isUniqueViolation(err, "kyc_submission_pending_key") {
+		return ErrKYCPending
+	}
+	return err
+}
+
+const kycSubmissionColumns = `id, account_id, document_type, document_number_hash, status, reason, submitted_at,
+	reviewed_by, reviewed_at`
+
+func scanKYCSubmission(row interface{ Scan(...any) error }) (*KYCSubmission, error) {
+	sub := &KYCSubmission{}
+	err := row.Scan(&sub.ID, &sub.AccountID, &sub.DocumentType, &sub.DocumentNumberHash, &sub.Status, &sub.Reason, &sub.SubmittedAt,
+		&sub.ReviewedBy, &sub.ReviewedAt)
+	return sub, err
+}
+
+func (s *PostgresStorage) getKYCSubmissions(ctx context.Context, where string, args ...any) ([]*KYCSubmission, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery("select "+kycSubmissionColumns+" from kyc_submission "+where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	submissions := []*KYCSubmission{}
+	for rows.Next() {
+		sub, err := scanKYCSubmission(rows)
+		if err != nil {
+			return nil, err
+		}
+		submissions = append(submissions, sub)
+	}
+	return submissions, rows.Err()
+}
+
+// GetKYCSubmissions lists the account's submissions newest first
+func (s *PostgresStorage) GetKYCSubmissions(ctx context.Context, accountID int) ([]*KYCSubmission, error) {
+	return s.getKYCSubmissions(ctx, "where account_id = $1 order by id desc", accountID)
+}
+
+// GetKYCSubmissionsByStatus lists submissions oldest first, the review queue's order
+func (s *PostgresStorage) GetKYCSubmissionsByStatus(ctx context.Context, status string) ([]*KYCSubmission, error) {
+	return s.getKYCSubmissions(ctx, "where status = $1 order by id", status)
+}
+
+// GetKYCStatus is the status of the account's latest submission
+func (s *PostgresStorage) GetKYCStatus(ctx context.Context, accountID int) (string, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	var status string
+	err := s.db.QueryRowContext(ctx,
+		s.tagQuery("select status from kyc_submission where account_id = $1 order by id desc limit 1"), accountID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return KYCUnverified, nil
+	}
+	return status, err
+}
+
+// ReviewKYCSubmission verifies or rejects a pending submission and returns it reviewed
+func (s *PostgresStorage) ReviewKYCSubmission(ctx context.Context, id int, status, reason, by string, at time.Time) (*KYCSubmission, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	sub, err := scanKYCSubmission(s.db.QueryRowContext(ctx, s.tagQuery(`update kyc_submission
+	set status = $1, reason = $2, reviewed_by = $3, reviewed_at = $4
+	where id = $5 and status = 'pending'
+	returning `+kycSubmissionColumns),
+		status, reason, by, at, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", ErrKYCNotFound, id)
+	}
+	if isUniqueViolation(err, "kyc_submission_document_key") {
+		return nil, ErrKYCDocumentInUse
+	}
+	return sub, err
+}
+
+// SaveAlias adds an unverified alias, or gives the account's pending one
+// a new code and attempts
+func (s *PostgresStorage) SaveAlias(ctx context.Context, alias *AccountAlias) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	err := s.db.QueryRowContext(ctx, s.tagQuery(`insert into account_alias
+	(account_id, type, value, code_hash, code_expires_at, created_at) values ($1, $2, $3, $4, $5, $6)
+	on conflict (account_id, value) do update set code_hash = excluded.code_hash,
+		code_expires_at = excluded.code_expires_at, attempts = 0
+	where account_alias.verified_at is null
+	returning id, created_at`),
+		alias.AccountID, alias.Type, alias.Value, alias.CodeHash, alias.CodeExpiresAt, alias.CreatedAt).
+		Scan(&alias.ID, &alias.CreatedAt)
+	if err == sql.ErrNoRows {
+		return ErrAliasVerified
+	}
+	return err
+}
+
+const aliasColumns = `id, account_id, type, value, created_at, verified_at`
+
+func scanAlias(row interface{ Scan(...any) error }) (*AccountAlias, error) {
+	alias := &AccountAlias{}
+	err := row.Scan(&alias.ID, &alias.AccountID, &alias.Type, &alias.Value, &alias.CreatedAt, &alias.VerifiedAt)
+	alias.Verified = alias.VerifiedAt != nil
+	return alias, err
+}
+
+func (s *PostgresStorage) GetAliases(ctx context.Context, accountID int) ([]*AccountAlias, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery("select "+aliasColumns+" from account_alias where account_id = $1 order by id"), accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aliases := []*AccountAlias{}
+	for rows.Next() {
+		alias, err := scanAlias(rows)
+		if err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, alias)
+	}
+	return aliases, rows.Err()
+}
+
+func (s *PostgresStorage) GetVerifiedAlias(ctx context.Context, value string) (*AccountAlias, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	alias, err := scanAlias(s.db.QueryRowContext(ctx,
+		s.tagQuery("select "+aliasColumns+" from account_alias where value = $1 and verified_at is not null"), value))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrAliasNotFound, value)
+	}
+	return alias, err
+}
+
+// VerifyAlias checks the code of a pending alias, a wrong one counts
+// against its attempts
+func (s *PostgresStorage) VerifyAlias(ctx context.Context, accountID, id int, codeHash string, at time.Time) (*AccountAlias, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	alias, err := scanAlias(s.db.QueryRowContext(ctx, s.tagQuery(`update account_alias set verified_at = $1, code_hash = ''
+	where id = $2 and account_id = $3 and verified_at is null
+		and code_hash = $4 and code_expires_at > $1 and attempts < $5
+	returning `+aliasColumns),
+		at, id, accountID, codeHash, maxAliasCodeAttempts))
+	if isUniqueViolation(err, "account_alias_verified_key") {
+		return nil, ErrAliasTaken
+	}
+	if err != sql.ErrNoRows {
+		return alias, err
+	}
+
+	res, err := s.db.ExecContext(ctx, s.tagQuery(`update account_alias set attempts = attempts + 1
+	where id = $1 and account_id = $2 and verified_at is null`), id, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, fmt.Errorf("%w: %d", ErrAliasNotFound, id)
+	}
+	return nil, ErrInvalidAliasCode
+}
+
+func (s *PostgresStorage) DeleteAlias(ctx context.Context, accountID, id int) (*AccountAlias, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	alias, err := scanAlias(s.db.QueryRowContext(ctx,
+		s.tagQuery("delete from account_alias where id = $1 and account_id = $2 returning "+aliasColumns), id, accountID))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", ErrAliasNotFound, id)
+	}
+	return alias, err
+}
+
+const splitColumns = "id, account_id, account_number, description, amount, currency, status, created_at, resolved_at"
+
+func scanSplit(row interface{ Scan(...any) error }) (*SplitBill, error) {
+	split := &SplitBill{}
+	var amount int64
+	err := row.Scan(&split.ID, &split.AccountID, &split.AccountNumber, &split.Description, &amount, &split.Currency,
+		&split.Status, &split.CreatedAt, &split.ResolvedAt)
+	split.Amount = float64(amount) / 100
+	return split, err
+}
+
+const splitShareColumns = `s.id, s.split_id, s.account_id, s.account_number, s.amount, b.currency, b.description, b.account_number,
+	s.status, coalesce(s.transfer_reference::text, ''), s.responded_at`
+
+func scanSplitShare(row interface{ Scan(...any) error }) (*SplitShare, error) {
+	share := &SplitShare{}
+	var amount int64
+	err := row.Scan(&share.ID, &share.SplitID, &share.AccountID, &share.AccountNumber, &amount, &share.Currency, &share.Description,
+		&share.RequestedBy, &share.Status, &share.TransferReference, &share.RespondedAt)
+	share.Amount = float64(amount) / 100
+	return share, err
+}
+
+func (s *PostgresStorage) querySplitShares(ctx context.Context, query string, args ...any) ([]*SplitShare, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery("select "+splitShareColumns+" from split_share s join split_bill b on b.id = s.split_id "+query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := []*SplitShare{}
+	for rows.Next() {
+		share, err := scanSplitShare(rows)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, rows.Err()
+}
+
+// CreateSplit adds the split and its shares in one transaction
+func (s *PostgresStorage) CreateSplit(ctx context.Context, split *SplitBill) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, s.tagQuery(`insert into split_bill
+	(account_id, account_number, description, amount, currency, status, created_at)
+	values ($1, $2, $3, $4, $5, $6, $7) returning id`),
+		split.AccountID, split.AccountNumber, split.Description, toCents(split.Amount), split.Currency, split.Status, split.CreatedAt).Scan(&split.ID)
+	if err != nil {
+		return err
+	}
+	for _, share := range split.Shares {
+		share.SplitID = split.ID
+		if err := tx.QueryRowContext(ctx, s.tagQuery(`insert into split_share
+		(split_id, account_id, account_number, amount, status) values ($1, $2, $3, $4, $5) returning id`),
+			split.ID, share.AccountID, share.AccountNumber, toCents(share.Amount), share.Status).Scan(&share.ID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStorage) GetSplit(ctx context.Context, id int) (*SplitBill, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	split, err := scanSplit(s.db.QueryRowContext(ctx, s.tagQuery("select "+splitColumns+" from split_bill where id = $1"), id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", ErrSplitNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if split.Shares, err = s.querySplitShares(ctx, "where s.split_id = $1 order by s.id", id); err != nil {
+		return nil, err
+	}
+	return split, nil
+}
+
+// GetSplits returns the splits the account asked others to pay, newest first
+func (s *PostgresStorage) GetSplits(ctx context.Context, accountID int) ([]*SplitBill, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery("select "+splitColumns+" from split_bill where account_id = $1 order by id desc"), accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	splits := []*SplitBill{}
+	byID := map[int]*SplitBill{}
+	for rows.Next() {
+		split, err := scanSplit(rows)
+		if err != nil {
+			return nil, err
+		}
+		split.Shares = []*SplitShare{}
+		splits = append(splits, split)
+		byID[split.ID] = split
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	shares, err := s.querySplitShares(ctx, "where b.account_id = $1 order by s.id", accountID)
+	if err != nil {
+		return nil, err
+	}
+	for _, share := range shares {
+		if split := byID[share.SplitID]; split != nil {
+			split.Shares = append(split.Shares, share)
+		}
+	}
+	return splits, nil
+}
+
+func (s *PostgresStorage) GetSplitShare(ctx context.Context, id int) (*SplitShare, error) {
+	shares, err := s.querySplitShares(ctx, "where s.id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(shares) == 0 {
+		return nil, fmt.Errorf("%w: %d", ErrSplitShareNotFound, id)
+	}
+	return shares[0], nil
+}
+
+func (s *PostgresStorage) GetSplitShareByTransfer(ctx context.Context, reference string) (*SplitShare, error) {
+	shares, err := s.querySplitShares(ctx, "where s.transfer_reference = $1", reference)
+	if err != nil {
+		return nil, err
+	}
+	if len(shares) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrSplitShareNotFound, reference)
+	}
+	return shares[0], nil
+}
+
+// GetSplitShares returns the shares others asked the account to pay, newest first
+func (s *PostgresStorage) GetSplitShares(ctx context.Context, accountID int) ([]*SplitShare, error) {
+	return s.querySplitShares(ctx, "where s.account_id = $1 order by s.id desc", accountID)
+}
+
+// ResolveSplit stores split's status if it's still in status from
+func (s *PostgresStorage) ResolveSplit(ctx context.Context, split *SplitBill, from string) (bool, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, s.tagQuery("update split_bill set status = $1, resolved_at = $2 where id = $3 and status = $4"),
+		split.Status, split.ResolvedAt, split.ID, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ResolveSplitShare stores share's status if it's still in status from
+func (s *PostgresStorage) ResolveSplitShare(ctx context.Context, share *SplitShare, from string) (bool, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, s.tagQuery(`update split_share
+	set status = $1, transfer_reference = nullif($2, '')::uuid, responded_at = $3
+	where id = $4 and status = $5`),
+		share.Status, share.TransferReference, share.RespondedAt, share.ID, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+const disputeColumns = `id, reference, from_account, to_account, amount, currency, reason, status, resolution, resolved_by,
+	created_at, resolved_at`
+
+func scanDispute(row interface{ Scan(...any) error }) (*Dispute, error) {
+	d := &Dispute{}
+	var amount int64
+	err := row.Scan(&d.ID, &d.Reference, &d.FromAccount, &d.ToAccount, &amount, &d.Currency, &d.Reason, &d.Status, &d.Resolution,
+		&d.ResolvedBy, &d.CreatedAt, &d.ResolvedAt)
+	d.Amount = float64(amount) / 100
+	return d, err
+}
+
+func (s *PostgresStorage) queryDisputes(ctx context.Context, query string, args ...any) ([]*Dispute, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	disputes := []*Dispute{}
+	for rows.Next() {
+		d, err := scanDispute(rows)
+		if err != nil {
+			return nil, err
+		}
+		disputes = append(disputes, d)
+	}
+	return disputes, rows.Err()
+}
+
+func (s *PostgresStorage) CreateDispute(ctx context.Context, d *Dispute) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	err := s.db.QueryRowContext(ctx, s.tagQuery(`insert into transfer_dispute
+	(reference, from_account, to_account, amount, currency, reason, status, created_at)
+	values ($1, $2, $3, $4, $5, $6, $7, $8)
+	returning id`),
+		d.Reference, d.FromAccount, d.ToAccount, toCents(d.Amount), d.Currency, d.Reason, d.Status, d.CreatedAt).Scan(&d.ID)
+	if isUniqueViolation(err, "transfer_dispute_reference_key") {
+		return fmt.Errorf("%w: %s", ErrDisputeExists, d.Reference)
+	}
+	return err
+}
+
+func (s *PostgresStorage) GetDispute(ctx context.Context, id int) (*Dispute, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	d, err := scanDispute(s.db.QueryRowContext(ctx, s.tagQuery("select "+disputeColumns+" from transfer_dispute where id = $1"), id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", ErrDisputeNotFound, id)
+	}
+	return d, err
+}
+
+func (s *PostgresStorage) GetTransferDispute(ctx context.Context, reference string) (*Dispute, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	d, err := scanDispute(s.db.QueryRowContext(ctx, s.tagQuery("select "+disputeColumns+" from transfer_dispute where reference = $1"), reference))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrDisputeNotFound, reference)
+	}
+	return d, err
+}
+
+func (s *PostgresStorage) GetAccountDisputes(ctx context.Context, accountNumber int64) ([]*Dispute, error) {
+	return s.queryDisputes(ctx, "select "+disputeColumns+" from transfer_dispute where from_account = $1 or to_account = $1 order by id desc",
+		accountNumber)
+}
+
+func (s *PostgresStorage) GetDisputes(ctx context.Context, status string) ([]*Dispute, error) {
+	return s.queryDisputes(ctx, "select "+disputeColumns+" from transfer_dispute where status = $1 order by id", status)
+}
+
+// ResolveDispute stores d's resolution if it's still in status from
+func (s *PostgresStorage) ResolveDispute(ctx context.Context, d *Dispute, from string) (bool, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, s.tagQuery(`update transfer_dispute
+	set status = $1, resolution = $2, resolved_by = $3, resolved_at = $4
+	where id = $5 and status = $6`),
+		d.Status, d.Resolution, d.ResolvedBy, d.ResolvedAt, d.ID, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *PostgresStorage) CreateErasureRequest(ctx context.Context, req *ErasureRequest) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, s.tagQuery(`insert into account_erasure
+	(account_id, requested_at, erase_at) values ($1, $2, $3)`),
+		req.AccountID, req.RequestedAt, req.EraseAt)
+	return err
+}
+
+const erasureColumns = `account_id, requested_at, erase_at, erased_at`
+
+func scanErasureRequest(row interface{ Scan(...any) error }) (*ErasureRequest, error) {
+	req := &ErasureRequest{Status: ErasureScheduled}
+	err := row.Scan(&req.AccountID, &req.RequestedAt, &req.EraseAt, &req.ErasedAt)
+	if req.ErasedAt != nil {
+		req.Status = ErasureCompleted
+	}
+	return req, err
+}
+
+func (s *PostgresStorage) GetErasureRequest(ctx context.Context, accountID int) (*ErasureRequest, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	req, err := scanErasureRequest(s.db.QueryRowContext(ctx,
+		s.tagQuery("select "+erasureColumns+" from account_erasure where account_id = $1"), accountID))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", ErrErasureNotFound, accountID)
+	}
+	return req, err
+}
+
+// GetDueErasures lists the requests whose retention ended by now, oldest first
+func (s *PostgresStorage) GetDueErasures(ctx context.Context, now time.Time, limit int) ([]*ErasureRequest, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery("select "+erasureColumns+` from account_erasure
+	where erased_at is null and erase_at <= $1 order by erase_at limit $2`), now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	due := []*ErasureRequest{}
+	for rows.Next() {
+		req, err := scanErasureRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		due = append(due, req)
+	}
+	return due, rows.Err()
+}
+
+// Deleted when an account is erased, they only identify the holder
+var erasedTables = []string{"password_reset", "email_verification", "oidc_identity", "login_ip", "kyc_submission",
+	"account_alias", "beneficiary", "event_subscription", "notification", "api_key"}
+
+// EraseAccount scrubs the holder's personal data in one transaction and marks the erasure done
+func (s *PostgresStorage) EraseAccount(ctx context.Context, accountID int, at time.Time) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, s.tagQuery(`update account set first_name = '', last_name = '', email = null,
+	email_verified = false, nickname = '', metadata = '{}', encrypted_password = '', version = version + 1
+	where id = $1`), accountID); err != nil {
+		return err
+	}
+	for _, table := range erasedTables {
+		if _, err := tx.ExecContext(ctx, s.tagQuery("delete from "+table+" where account_id = $1"), accountID); err != nil {
+			return fmt.Errorf("%s: %v", table, err)
+		}
+	}
+
+	rows, err := tx.QueryContext(ctx, s.tagQuery("select id, changes from audit_log where account_id = $1"), accountID)
+	if err != nil {
+		return err
+	}
+	entries := map[int][]FieldChange{}
+	for rows.Next() {
+		var id int
+		var changes []byte
+		if err := rows.Scan(&id, &changes); err != nil {
+			rows.Close()
+			return err
+		}
+		decoded := []FieldChange{}
+		if err := json.Unmarshal(changes, &decoded); err != nil {
+			rows.Close()
+			return fmt.Errorf("audit entry %d: %v", id, err)
+		}
+		entries[id] = decoded
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, changes := range entries {
+		scrubbed, err := json.Marshal(eraseAuditChanges(changes))
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, s.tagQuery("update audit_log set changes = $1 where id = $2"), scrubbed, id); err != nil {
+			return fmt.Errorf("audit entry %d: %v", id, err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, s.tagQuery("update account_erasure set erased_at = $1 where account_id = $2"), at, accountID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStorage) CreatePendingOperation(ctx context.Context, op *PendingOperation) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	return s.db.QueryRowContext(ctx, s.tagQuery(`insert into pending_operation
+	(kind, params, status, requested_by, required, created_at, expires_at)
+	values ($1, $2, $3, $4, $5, $6, $7)
+	returning id`),
+		op.Kind, string(op.Params), op.Status, op.RequestedBy, op.Required, op.CreatedAt, op.ExpiresAt).Scan(&op.ID)
+}
+
+// Params are kept as text, jsonb would reorder them and break the digest approvers signed
+const pendingOperationColumns = `id, kind, params, status, requested_by, required, coalesce(result, ''), coalesce(error, ''),
+	created_at, expires_at, executed_at`
+
+func scanPendingOperation(row interface{ Scan(...any) error }) (*PendingOperation, error) {
+	op := &PendingOperation{Approvals: []*OperationApproval{}}
+	var params, result string
+	err := row.Scan(&op.ID, &op.Kind, &params, &op.Status, &op.RequestedBy, &op.Required, &result, &op.Error,
+		&op.CreatedAt, &op.ExpiresAt, &op.ExecutedAt)
+	op.Params = json.RawMessage(params)
+	if result != "" {
+		op.Result = json.RawMessage(result)
+	}
+	return op, err
+}
+
+func (s *PostgresStorage) GetPendingOperation(ctx context.Context, id int) (*PendingOperation, error) {
+	ops, err := s.getPendingOperations(ctx, "where id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("%w: %d", ErrOperationNotFound, id)
+	}
+	return ops[0], nil
+}
+
+// GetPendingOperations lists operations newest first, all of them when status is empty
+func (s *PostgresStorage) GetPendingOperations(ctx context.Context, status string) ([]*PendingOperation, error) {
+	return s.getPendingOperations(ctx, "where $1 = '' or status = $1", status)
+}
+
+func (s *PostgresStorage) getPendingOperations(ctx context.Context, where string, arg any) ([]*PendingOperation, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery("select "+pendingOperationColumns+" from pending_operation "+where+" order by id desc"), arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ops := []*PendingOperation{}
+	byID := map[int]*PendingOperation{}
+	for rows.Next() {
+		op, err := scanPendingOperation(rows)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+		byID[op.ID] = op
+	}
+	if err := rows.Err(); err != nil || len(ops) == 0 {
+		return ops, err
+	}
+
+	ids := make([]int64, 0, len(ops))
+	for id := range byID {
+		ids = append(ids, int64(id))
+	}
+	approvals, err := s.db.QueryContext(ctx, s.tagQuery(`select operation_id, approver, signature, signed_at
+	from operation_approval where operation_id = any($1) order by signed_at`), pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer approvals.Close()
+
+	for approvals.Next() {
+		var id int
+		a := &OperationApproval{}
+		if err := approvals.Scan(&id, &a.Approver, &a.Signature, &a.SignedAt); err != nil {
+			return nil, err
+		}
+		byID[id].Approvals = append(byID[id].Approvals, a)
+	}
+	return ops, approvals.Err()
+}
+
+// AddOperationApproval records one approver's signature on a pending operation
+func (s *PostgresStorage) AddOperationApproval(ctx context.Context, id int, approval *OperationApproval) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, s.tagQuery(`insert into operation_approval (operation_id, approver, signature, signed_at)
+	select id, $2, $3, $4 from pending_operation where id = $1 and status = 'pending'
+	on conflict do nothing`),
+		id, approval.Approver, approval.Signature, approval.SignedAt)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+
+	var status string
+	err = s.db.QueryRowContext(ctx, s.tagQuery("select status from pending_operation where id = $1"), id).Scan(&status)
+	switch {
+	case err == sql.ErrNoRows:
+		return fmt.Errorf("%w: %d", ErrOperationNotFound, id)
+	case err != nil:
+		return err
+	case status != OperationPending:
+		return fmt.Errorf("%w: %d is %s", ErrOperationNotPending, id, status)
+	}
+	return fmt.Errorf("%w: %s", ErrAlreadyApproved, approval.Approver)
+}
+
+// SetOperationStatus moves op from one status to another along with its
+// result, reporting false when it wasn't in from any more
+func (s *PostgresStorage) SetOperationStatus(ctx context.Context, op *PendingOperation, from, to string) (bool, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, s.tagQuery(`update pending_operation
+	set status = $1, result = nullif($2, ''), error = nullif($3, ''), executed_at = $4
+	where id = $5 and status = $6`),
+		to, string(op.Result), op.Error, op.ExecutedAt, op.ID, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n > 0 {
+		op.Status = to
+	}
+	return n > 0, err
+}
+
+// ClaimEODRun marks the day's run as running, creating it on the first
+// run. A run another instance has running is only taken over once it hasn't
+// checkpointed since staleBefore.
+func (s *PostgresStorage) ClaimEODRun(ctx context.Context, day, cutOff, now, staleBefore time.Time) (*EODRun, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, s.tagQuery(`insert into eod_run (day, status, cut_off, started_at, updated_at)
+	values ($1, 'running', $2, $3, $3)
+	on conflict (day) do update set status = 'running', updated_at = excluded.updated_at, finished_at = null
+	where eod_run.status = 'failed' or (eod_run.status = 'running' and eod_run.updated_at < $4)`),
+		day, cutOff, now, staleBefore)
+	if err != nil {
+		return nil, err
+	}
+
+	run, err := s.GetEODRun(ctx, day)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return run, err
+	}
+	if run.Status == EODCompleted {
+		return nil, fmt.Errorf("%w: %s", ErrEODCompleted, day.Format(time.DateOnly))
+	}
+	return nil, fmt.Errorf("%w: %s", ErrEODRunning, day.Format(time.DateOnly))
+}
+
+// SaveEODStep checkpoints a step, which also keeps the run's claim fresh
+func (s *PostgresStorage) SaveEODStep(ctx context.Context, day time.Time, step *EODStep) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, s.tagQuery(`with touched as (update eod_run set updated_at = now() at time zone 'utc' where day = $1)
+	insert into eod_step (day, name, status, attempts, detail, error, started_at, finished_at)
+	values ($1, $2, $3, $4, nullif($5, ''), nullif($6, ''), $7, $8)
+	on conflict (day, name) do update
+	set status = excluded.status, attempts = excluded.attempts, detail = excluded.detail, error = excluded.error,
+		started_at = excluded.started_at, finished_at = excluded.finished_at`),
+		day, step.Name, step.Status, step.Attempts, step.Detail, step.Error, step.StartedAt, step.FinishedAt)
+	return err
+}
+
+func (s *PostgresStorage) FinishEODRun(ctx context.Context, day time.Time, status string, at time.Time) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, s.tagQuery("update eod_run set status = $1, updated_at = $2, finished_at = $2 where day = $3"), status, at, day)
+	return err
+}
+
+func (s *PostgresStorage) GetEODRun(ctx context.Context, day time.Time) (*EODRun, error) {
+	runs, err := s.getEODRuns(ctx, "where day = $1", day)
+	if err != nil {
+		return nil, err
+	}
+	if len(runs) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrEODRunNotFound, day.Format(time.DateOnly))
+	}
+	return runs[0], nil
+}
+
+// GetEODRuns lists the latest limit runs, newest first
+func (s *PostgresStorage) GetEODRuns(ctx context.Context, limit int) ([]*EODRun, error) {
+	return s.getEODRuns(ctx, "order by day desc limit $1", limit)
+}
+
+func (s *PostgresStorage) getEODRuns(ctx context.Context, where string, arg any) ([]*EODRun, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery("select day, status, cut_off, started_at, updated_at, finished_at from eod_run "+where), arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []*EODRun{}
+	byDay := map[string]*EODRun{}
+	days := []string{}
+	for rows.Next() {
+		run := &EODRun{Steps: []*EODStep{}}
+		if err := rows.Scan(&run.Day, &run.Status, &run.CutOff, &run.StartedAt, &run.UpdatedAt, &run.FinishedAt); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+		byDay[run.Day.Format(time.DateOnly)] = run
+		days = append(days, run.Day.Format(time.DateOnly))
+	}
+	if err := rows.Err(); err != nil || len(runs) == 0 {
+		return runs, err
+	}
+
+	steps, err := s.db.QueryContext(ctx, s.tagQuery(`select day, name, status, attempts, coalesce(detail, ''), coalesce(error, ''), started_at, finished_at
+	from eod_step where day = any($1::date[])`), pq.Array(days))
+	if err != nil {
+		return nil, err
+	}
+	defer steps.Close()
+
+	for steps.Next() {
+		var day time.Time
+		st := &EODStep{}
+		if err := steps.Scan(&day, &st.Name, &st.Status, &st.Attempts, &st.Detail, &st.Error, &st.StartedAt, &st.FinishedAt); err != nil {
+			return nil, err
+		}
+		run := byDay[day.Format(time.DateOnly)]
+		run.Steps = append(run.Steps, st)
+	}
+	return runs, steps.Err()
+}
+
+func (s *PostgresStorage) CreateReservation(ctx context.Context, r *Reservation) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	return s.db.QueryRowContext(ctx, s.tagQuery(`insert into reservation
+	(account_id, amount, currency, kind, reference, status, created_at, expires_at)
+	values ($1, $2, $3, $4, $5, $6, $7, $8)
+	returning id`),
+		r.AccountID, r.Amount, r.Currency, r.Kind, r.Reference, r.Status, r.CreatedAt, r.ExpiresAt).Scan(&r.ID)
+}
+
+const reservationColumns = "id, account_id, amount, currency, kind, reference, status, captured, created_at, expires_at, resolved_at"
+
+func scanReservation(row interface{ Scan(...any) error }) (*Reservation, error) {
+	r := &Reservation{}
+	err := row.Scan(&r.ID, &r.AccountID, &r.Amount, &r.Currency, &r.Kind, &r.Reference, &r.Status, &r.Captured, &r.CreatedAt, &r.ExpiresAt, &r.ResolvedAt)
+	return r, err
+}
+
+func (s *PostgresStorage) GetReservation(ctx context.Context, id int) (*Reservation, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	r, err := scanReservation(s.db.QueryRowContext(ctx, s.tagQuery("select "+reservationColumns+" from reservation where id = $1"), id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", ErrHoldNotFound, id)
+	}
+	return r, err
+}
+
+// GetReservations lists an account's reservations, activeOnly leaves out
+// resolved and expired ones
+func (s *PostgresStorage) GetReservations(ctx context.Context, accountID int, activeOnly bool) ([]*Reservation, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(`select `+reservationColumns+`
+	from reservation where account_id = $1
+	and (not $2 or (status = 'active' and (expires_at is null or expires_at > now() at time zone 'utc')))
+	order by id`), accountID, activeOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reservations := []*Reservation{}
+	for rows.Next() {
+		r, err := scanReservation(rows)
+		if err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, r)
+	}
+	return reservations, rows.Err()
+}
+
+// ResolveReservation stores r's status and captured amount if it's still in status from
+func (s *PostgresStorage) ResolveReservation(ctx context.Context, r *Reservation, from string) (bool, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, s.tagQuery("update reservation set status = $1, captured = $2, resolved_at = $3 where id = $4 and status = $5"),
+		r.Status, r.Captured, r.ResolvedAt, r.ID, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ExpireReservations marks active reservations past their expiry as expired
+func (s *PostgresStorage) ExpireReservations(ctx context.Context, now time.Time) (int64, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, s.tagQuery(`update reservation set status = 'expired', resolved_at = expires_at
+	where status = 'active' and expires_at <= $1`), now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *PostgresStorage) CreatePendingTransfer(ctx context.Context, pt *PendingTransfer) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, s.tagQuery(`insert into pending_transfer
+	(reference, status, from_account, to_account, amount, currency, memo, category, reservation_id, requested_by, created_at)
+	values ($1, $2, $3, $4, $5, $6, nullif($7, ''), nullif($8, ''), $9, $10, $11)`),
+		pt.Reference, pt.Status, pt.FromAccount, pt.ToAccount, toCents(pt.Amount), pt.Currency, pt.Memo, pt.Category,
+		pt.ReservationID, pt.RequestedBy, pt.CreatedAt)
+	return err
+}
+
+const pendingTransferColumns = `reference, status, from_account, to_account, amount, currency, coalesce(memo, ''), coalesce(category, ''),
+	reservation_id, requested_by, coalesce(resolved_by, ''), coalesce(reason, ''), coalesce(error, ''), created_at, resolved_at`
+
+func scanPendingTransfer(row interface{ Scan(...any) error }) (*PendingTransfer, error) {
+	pt := &PendingTransfer{}
+	var amount int64
+	err := row.Scan(&pt.Reference, &pt.Status, &pt.FromAccount, &pt.ToAccount, &amount, &pt.Currency, &pt.Memo, &pt.Category,
+		&pt.ReservationID, &pt.RequestedBy, &pt.ResolvedBy, &pt.Reason, &pt.Error, &pt.CreatedAt, &pt.ResolvedAt)
+	pt.Amount = float64(amount) / 100
+	return pt, err
+}
+
+func (s *PostgresStorage) GetPendingTransfer(ctx context.Context, reference string) (*PendingTransfer, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	pt, err := scanPendingTransfer(s.db.QueryRowContext(ctx,
+		s.tagQuery("select "+pendingTransferColumns+" from pending_transfer where reference = $1"), reference))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrTransferNotFound, reference)
+	}
+	return pt, err
+}
+
+// GetPendingTransfers lists the transfers in status, oldest first
+func (s *PostgresStorage) GetPendingTransfers(ctx context.Context, status string) ([]*PendingTransfer, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		s.tagQuery("select "+pendingTransferColumns+" from pending_transfer where status = $1 order by created_at limit 500"), status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers := []*PendingTransfer{}
+	for rows.Next() {
+		pt, err := scanPendingTransfer(rows)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, pt)
+	}
+	return transfers, rows.Err()
+}
+
+// UpdatePendingTransfer stores pt's resolution if it's still in status from
+func (s *PostgresStorage) UpdatePendingTransfer(ctx context.Context, pt *PendingTransfer, from string) (bool, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, s.tagQuery(`update pending_transfer
+	set status = $1, resolved_by = nullif($2, ''), reason = nullif($3, ''), error = nullif($4, ''), resolved_at = $5
+	where reference = $6 and status = $7`),
+		pt.Status, pt.ResolvedBy, pt.Reason, pt.Error, pt.ResolvedAt, pt.Reference, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ReconcileLedger checks every entry balances and every account's balance
+// equals the sum of its postings
+func (s *PostgresStorage) ReconcileLedger(ctx context.Context) (*LedgerReport, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	report := &LedgerReport{Discrepancies: []*LedgerDiscrepancy{}}
+	if err := s.db.QueryRowContext(ctx, s.tagQuery("select count(*) from ledger_entry")).Scan(&report.Entries); err != nil {
+		return nil, err
+	}
+	if err := s.db.QueryRowContext(ctx, s.tagQuery("select count(*) from account")).Scan(&report.Accounts); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(`select entry_id, currency, sum(amount) from postings
+	group by entry_id, currency having sum(amount) <> 0`))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		d := &LedgerDiscrepancy{Type: DiscrepancyUnbalancedEntry}
+		if err := rows.Scan(&d.EntryID, &d.Currency, &d.Actual); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		report.Discrepancies = append(report.Discrepancies, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.QueryContext(ctx, s.tagQuery(`select a.id, a.currency, a.balance, coalesce(sum(p.amount), 0)
+	from account a left join postings p on p.account_id = a.id
+	group by a.id having a.balance <> coalesce(sum(p.amount), 0)`))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		d := &LedgerDiscrepancy{Type: DiscrepancyBalanceMismatch}
+		if err := rows.Scan(&d.AccountID, &d.Currency, &d.Actual, &d.Expected); err != nil {
+			return nil, err
+		}
+		report.Discrepancies = append(report.Discrepancies, d)
+	}
+
+	report.sort()
+	return report, rows.Err()
+}
+
+func (s *PostgresStorage) RecordTransfer(ctx context.Context, fromAccountID, toAccountID int, conv Conversion, tx Transaction) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	_, err := s.exec(ctx, tx, insertTransferQuery,
+		fromAccountID,
+		toAccountID,
+		toCents(conv.Debit),
+		conv.FromCurrency,
+		toCents(conv.Credit),
+		conv.ToCurrency,
+		conv.Rate,
+		transferKind(ctx),
+		transferReference(ctx),
+		time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to record transfer: %w", err)
+	}
+
+	return nil
+}
+
+func (s *PostgresStorage) GetTransferReceipt(ctx context.Context, reference string) (*TransferReceipt, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	query := `select f.number, d.number, t.amount, t.currency, t.converted_amount, t.to_currency, t.fx_rate, t.kind, t.created_at
+	from transfer t
+	join account f on f.id = t.from_account_id
+	join account d on d.id = t.to_account_id
+	where t.reference = $1`
+
+	var from, to Account
+	var debit, credit int64
+	var conv Conversion
+	var kind string
+	var createdAt time.Time
+	err := s.db.QueryRowContext(ctx, s.tagQuery(query), reference).Scan(
+		&from.Number, &to.Number, &debit, &conv.FromCurrency, &credit, &conv.ToCurrency, &conv.Rate, &kind, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrTransferNotFound, reference)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conv.Debit, conv.Credit = float64(debit)/100, float64(credit)/100
+	return newReceipt(reference, &from, &to, conv, kind, createdAt), nil
+}
+
+func (s *PostgresStorage) CreateTransferJob(ctx context.Context, job *TransferJob) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	request, receipt, err := marshalTransferJob(job)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, s.tagQuery(`insert into transfer_job
+	(id, status, request, actor, attempts, next_attempt_at, last_error, receipt, created_at, updated_at)
+	values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`),
+		job.ID, job.Status, request, job.Actor, job.Attempts, job.NextAttemptAt, job.LastError, receipt, job.CreatedAt, job.UpdatedAt)
+	return err
+}
+
+const transferJobColumns = "id, status, request, actor, attempts, next_attempt_at, last_error, receipt, created_at, updated_at"
+
+func scanTransferJob(row interface{ Scan(...any) error }) (*TransferJob, error) {
+	job := &TransferJob{}
+	var request string
+	var receipt sql.NullString
+	if err := row.Scan(&job.ID, &job.Status, &request, &job.Actor, &job.Attempts, &job.NextAttemptAt, &job.LastError, &receipt, &job.CreatedAt, &job.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(request), &job.Request); err != nil {
+		return nil, err
+	}
+	if receipt.Valid {
+		job.Receipt = &TransferReceipt{}
+		if err := json.Unmarshal([]byte(receipt.String), job.Receipt); err != nil {
+			return nil, err
+		}
+	}
+	return job, nil
+}
+
+func (s *PostgresStorage) GetTransferJob(ctx context.Context, id string) (*TransferJob, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	job, err := scanTransferJob(s.db.QueryRowContext(ctx, s.tagQuery("select "+transferJobColumns+" from transfer_job where id = $1"), id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrTransferJobNotFound, id)
+	}
+	return job, err
+}
+
+// GetDueTransferJobs returns queued jobs that are due and processing ones whose lease ran out
+func (s *PostgresStorage) GetDueTransferJobs(ctx context.Context, now time.Time, limit int) ([]*TransferJob, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(`select `+transferJobColumns+` from transfer_job
+	where status in ('queued', 'processing') and next_attempt_at <= $1
+	order by next_attempt_at limit $2`), now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []*TransferJob{}
+	for rows.Next() {
+		job, err := scanTransferJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// ClaimTransferJob leases a due job until leaseUntil and counts the attempt
+func (s *PostgresStorage) ClaimTransferJob(ctx context.Context, id string, now, leaseUntil time.Time) (bool, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, s.tagQuery(`update transfer_job
+	set status = 'processing', next_attempt_at = $1, attempts = attempts + 1, updated_at = $2
+	where id = $3 and status in ('queued', 'processing') and next_attempt_at <= $2`),
+		leaseUntil, now, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *PostgresStorage) UpdateTransferJob(ctx context.Context, job *TransferJob) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	_, receipt, err := marshalTransferJob(job)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, s.tagQuery(`update transfer_job
+	set status = $1, attempts = $2, next_attempt_at = $3, last_error = $4, receipt = $5, updated_at = $6
+	where id = $7`),
+		job.Status, job.Attempts, job.NextAttemptAt, job.LastError, receipt, job.UpdatedAt, job.ID)
+	return err
+}
+
+// GetDailyTransferUsage counts from day, a midnight in the account's
+// timezone, to the next one which isn't 24 hours later across DST changes.
+// The columns are UTC timestamps so the bounds are passed in UTC
+func (s *PostgresStorage) GetDailyTransferUsage(ctx context.Context, accountID int, day time.Time) (*TransferUsage, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	query := `select coalesce(sum(amount), 0), count(*) from transfer
+	where from_account_id = $1 and kind = 'transfer' and created_at >= $2 and created_at < $3`
+
+	usage := &TransferUsage{}
+	err := s.db.QueryRowContext(ctx, s.tagQuery(query), accountID, day.UTC(), day.AddDate(0, 0, 1).UTC()).Scan(&usage.Amount, &usage.Count)
+	if err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+func (s *PostgresStorage) RecordAudit(ctx context.Context, entry *AuditEntry, tx Transaction) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	changes, err := json.Marshal(entry.Changes)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.exec(ctx, tx, insertAuditQuery, entry.AccountID, entry.Actor, entry.Action, changes, entry.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to record audit entry: %v", err)
+	}
+
+	return nil
+}
+
+func (s *PostgresStorage) GetAuditLog(ctx context.Context, accountID int) ([]*AuditEntry, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(`SELECT id, account_id, actor, action, changes, created_at
+	FROM audit_log WHERE account_id = $1 ORDER BY created_at, id`), accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		entry := &AuditEntry{}
+		var changes []byte
+		if err := rows.Scan(&entry.ID, &entry.AccountID, &entry.Actor, &entry.Action, &changes, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(changes, &entry.Changes); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+const scheduledTransferColumns = `id, from_account_id, to_account_number, amount, frequency, status,
+	next_run_at, retry_at, attempts, last_error, created_at`
+
+func scanScheduledTransfer(rows *sql.Rows) (*ScheduledTransfer, error) {
+	st := &ScheduledTransfer{}
+	var amount int64
+	err := rows.Scan(
+		&st.ID,
+		&st.FromAccountID,
+		&st.ToAccountNumber,
+		&amount,
+		&st.Frequency,
+		&st.Status,
+		&st.NextRunAt,
+		&st.RetryAt,
+		&st.Attempts,
+		&st.LastError,
+		&st.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	st.Amount = float64(amount) / 100
+	return st, nil
+}
+
+func (s *PostgresStorage) queryScheduledTransfers(ctx context.Context, query string, args ...interface{}) ([]*ScheduledTransfer, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scheduled := []*ScheduledTransfer{}
+	for rows.Next() {
+		st, err := scanScheduledTransfer(rows)
+		if err != nil {
+			return nil, err
+		}
+		scheduled = append(scheduled, st)
+	}
+
+	return scheduled, rows.Err()
+}
+
+func (s *PostgresStorage) CreateScheduledTransfer(ctx context.Context, st *ScheduledTransfer) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	query := `insert into scheduled_transfer
+	(from_account_id, to_account_number, amount, frequency, status, next_run_at, created_at)
+	values ($1, $2, $3, $4, $5, $6, $7)
+	returning id`
+
+	return s.db.QueryRowContext(ctx,
+		s.tagQuery(query),
+		st.FromAccountID,
+		st.ToAccountNumber,
+		toCents(st.Amount),
+		st.Frequency,
+		st.Status,
+		st.NextRunAt,
+		st.CreatedAt).Scan(&st.ID)
+}
+
+func (s *PostgresStorage) GetScheduledTransfers(ctx context.Context, accountID int) ([]*ScheduledTransfer, error) {
+	return s.queryScheduledTransfers(ctx,
+		"SELECT "+scheduledTransferColumns+" FROM scheduled_transfer WHERE from_account_id = $1 ORDER BY id",
+		accountID)
+}
+
+func (s *PostgresStorage) CancelScheduledTransfer(ctx context.Context, accountID, id int) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		s.tagQuery("UPDATE scheduled_transfer SET status = $1 WHERE id = $2 AND from_account_id = $3 AND status = $4"),
+		ScheduledCancelled, id, accountID, ScheduledActive)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("active scheduled transfer %d not found", id)
+	}
+	return nil
+}
+
+func (s *PostgresStorage) GetDueScheduledTransfers(ctx context.Context, now time.Time, limit int) ([]*ScheduledTransfer, error) {
+	return s.queryScheduledTransfers(ctx,
+		"SELECT "+scheduledTransferColumns+` FROM scheduled_transfer
+		WHERE status = $1 AND coalesce(retry_at, next_run_at) <= $2
+		ORDER BY coalesce(retry_at, next_run_at) LIMIT $3`,
+		ScheduledActive, now, limit)
+}
+
+func (s *PostgresStorage) ClaimScheduledTransfer(ctx context.Context, id int, now, leaseUntil time.Time) (bool, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, s.tagQuery(`UPDATE scheduled_transfer SET retry_at = $1
+	WHERE id = $2 AND status = $3 AND coalesce(retry_at, next_run_at) <= $4`),
+		leaseUntil, id, ScheduledActive, now)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *PostgresStorage) UpdateScheduledTransfer(ctx context.Context, st *ScheduledTransfer) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, s.tagQuery(`UPDATE scheduled_transfer
+	SET next_run_at = $1, retry_at = $2, attempts = $3, last_error = $4
+	WHERE id = $5`),
+		st.NextRunAt, st.RetryAt, st.Attempts, st.LastError, st.ID)
+	return err
+}
+
+func (s *PostgresStorage) SearchAccounts(ctx context.Context, search AccountSearch) ([]*Account, error) {
+	// Each arm matches one of the account_search indexes, NULL never equals a number
+	number := sql.NullInt64{Int64: search.searchNumber(), Valid: search.searchNumber() != 0}
+	return s.queryAccounts(ctx, "SELECT "+accountColumns+` FROM account
+	WHERE (account_number = $1
+		OR lower(first_name) LIKE $2
+		OR lower(last_name) LIKE $2
+		OR lower(first_name || ' ' || last_name) LIKE $2
+		OR (nickname <> '' AND lower(nickname) LIKE $2))
+		AND metadata @> $5
+	ORDER BY lower(last_name), lower(first_name), id
+	LIMIT $3 OFFSET $4`, number, search.likePrefix(), search.Limit, search.Offset, search.Metadata)
+}
+
+func (s *PostgresStorage) GetOverdrawnAccounts(ctx context.Context) ([]*Account, error) {
+	return s.queryAccounts(ctx, "SELECT "+accountColumns+" FROM account WHERE balance < 0 ORDER BY id")
+}
+
+// RecordOverdraftFee reports false when the account was already charged for that day
+func (s *PostgresStorage) RecordOverdraftFee(ctx context.Context, fee *OverdraftFee, tx Transaction) (bool, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := tx.ExecContext(ctx, s.tagQuery(`insert into overdraft_fee
+	(account_id, amount, overdrawn, accrued_on, created_at)
+	values ($1, $2, $3, $4, $5)
+	on conflict (account_id, accrued_on) do nothing`),
+		fee.AccountID, fee.Amount, fee.Overdrawn, fee.AccruedOn, fee.CreatedAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to record overdraft fee: %v", err)
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *PostgresStorage) GetOverdraftFeeTotal(ctx context.Context, accountID int) (int64, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	var total int64
+	err := s.db.QueryRowContext(ctx,
+		s.tagQuery("SELECT coalesce(sum(amount), 0) FROM overdraft_fee WHERE account_id = $1"),
+		accountID).Scan(&total)
+	return total, err
+}
+
+func (s *PostgresStorage) SaveFeeSchedule(ctx context.Context, fs *FeeSchedule) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	tiers, err := json.Marshal(fs.TransferTiers)
+	if err != nil {
+		return err
+	}
+	return s.db.QueryRowContext(ctx, s.tagQuery(`insert into fee_schedule
+	(currency, monthly_fee, minimum_balance, below_minimum_fee, transfer_tiers, created_by, created_at)
+	values ($1, $2, $3, $4, $5, $6, $7) returning id`),
+		fs.Currency, fs.MonthlyFee, fs.MinimumBalance, fs.BelowMinimumFee, tiers, fs.CreatedBy, fs.CreatedAt).Scan(&fs.ID)
+}
+
+const feeScheduleColumns = "id, currency, monthly_fee, minimum_balance, below_minimum_fee, transfer_tiers, created_by, created_at"
+
+func scanFeeSchedule(row interface{ Scan(...any) error }) (*FeeSchedule, error) {
+	fs := &FeeSchedule{}
+	var tiers []byte
+	if err := row.Scan(&fs.ID, &fs.Currency, &fs.MonthlyFee, &fs.MinimumBalance, &fs.BelowMinimumFee, &tiers, &fs.CreatedBy, &fs.CreatedAt); err != nil {
+		return nil, err
+	}
+	return fs, json.Unmarshal(tiers, &fs.TransferTiers)
+}
+
+// GetFeeSchedule returns the currency's latest schedule
+func (s *PostgresStorage) GetFeeSchedule(ctx context.Context, currency string) (*FeeSchedule, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	fs, err := scanFeeSchedule(s.db.QueryRowContext(ctx, s.tagQuery("select "+feeScheduleColumns+" from fee_schedule where currency = $1 order by id desc limit 1"), currency))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrFeeScheduleNotFound, currency)
+	}
+	return fs, err
+}
+
+// GetFeeSchedules returns the latest schedule of each currency
+func (s *PostgresStorage) GetFeeSchedules(ctx context.Context) ([]*FeeSchedule, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery("select distinct on (currency) "+feeScheduleColumns+" from fee_schedule order by currency, id desc"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := []*FeeSchedule{}
+	for rows.Next() {
+		fs, err := scanFeeSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, fs)
+	}
+	return schedules, rows.Err()
+}
+
+// RecordFeeCharge reports false when the account was already charged the fee for that period
+func (s *PostgresStorage) RecordFeeCharge(ctx context.Context, charge *FeeCharge, tx Transaction) (bool, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := tx.ExecContext(ctx, s.tagQuery(`insert into fee_charge
+	(account_id, kind, period, amount, created_at)
+	values ($1, $2, $3, $4, $5)
+	on conflict (account_id, kind, period) do nothing`),
+		charge.AccountID, charge.Kind, charge.Period, charge.Amount, charge.CreatedAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to record fee charge: %v", err)
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// MergeAccounts does the bookkeeping of a merge inside tx, the caller has
+// already moved the balance with a ledger entry
+func (s *PostgresStorage) MergeAccounts(ctx context.Context, merge *AccountMerge, tx Transaction) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	from, to := merge.MergedAccountID, merge.SurvivorAccountID
+
+	relinked := 0
+	for _, query := range []string{
+		"UPDATE transfer SET from_account_id = $1 WHERE from_account_id = $2",
+		"UPDATE transfer SET to_account_id = $1 WHERE to_account_id = $2",
+	} {
+		res, err := tx.ExecContext(ctx, s.tagQuery(query), to, from)
+		if err != nil {
+			return fmt.Errorf("failed to relink transfers: %v", err)
+		}
+		n, _ := res.RowsAffected()
+		relinked += int(n)
+	}
+	merge.TransfersRelinked = relinked
+
+	if _, err := tx.ExecContext(ctx, s.tagQuery("UPDATE scheduled_transfer SET from_account_id = $1 WHERE from_account_id = $2"), to, from); err != nil {
+		return fmt.Errorf("failed to relink scheduled transfers: %v", err)
+	}
+
+	// Recorded after relinking so the adjustment keeps pointing at the merged account
+	if merge.Balance != 0 {
+		adjFrom, adjTo, amount := from, to, merge.Balance
+		if amount < 0 {
+			adjFrom, adjTo, amount = to, from, -amount
+		}
+		_, err := tx.ExecContext(ctx, s.tagQuery(`insert into transfer
+		(from_account_id, to_account_id, amount, currency, converted_amount, to_currency, fx_rate, kind, created_at)
+		values ($1, $2, $3, $4, $3, $4, 1, $5, $6)`),
+			adjFrom, adjTo, amount, merge.Currency, TransferKindAdjustment, merge.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to record adjustment: %v", err)
+		}
+	}
+
+	// A concurrent balance change since the caller read the account leaves a remainder
+	res, err := tx.ExecContext(ctx, s.tagQuery(`UPDATE account SET status = $1, merged_into = $2, closed_at = $3
+	WHERE id = $4 AND balance = 0 AND status <> $1`), AccountClosed, to, merge.CreatedAt, from)
+	if err != nil {
+		return fmt.Errorf("failed to close merged account: %v", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("account %d changed during the merge, try again", from)
+	}
+
+	_, err = tx.ExecContext(ctx, s.tagQuery(`insert into account_merge
+	(merged_account_id, survivor_account_id, balance, currency, transfers_relinked, actor, created_at)
+	values ($1, $2, $3, $4, $5, $6, $7)`),
+		from, to, merge.Balance, merge.Currency, merge.TransfersRelinked, merge.Actor, merge.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to record merge: %v", err)
+	}
+
+	return nil
+}
+
+const sweepRuleColumns = "id, account_id, to_account_number, threshold, frequency, status, next_run_at, created_at"
+
+func (s *PostgresStorage) querySweepRules(ctx context.Context, query string, args ...interface{}) ([]*SweepRule, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []*SweepRule{}
+	for rows.Next() {
+		rule := &SweepRule{}
+		var threshold int64
+		if err := rows.Scan(&rule.ID, &rule.AccountID, &rule.ToAccountNumber, &threshold,
+			&rule.Frequency, &rule.Status, &rule.NextRunAt, &rule.CreatedAt); err != nil {
+			return nil, err
+		}
+		rule.Threshold = float64(threshold) / 100
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+func (s *PostgresStorage) CreateSweepRule(ctx context.Context, rule *SweepRule) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	query := `insert into sweep_rule
+	(account_id, to_account_number, threshold, frequency, status, next_run_at, created_at)
+	values ($1, $2, $3, $4, $5, $6, $7)
+	returning id`
+
+	return s.db.QueryRowContext(ctx,
+		s.tagQuery(query),
+		rule.AccountID,
+		rule.ToAccountNumber,
+		toCents(rule.Threshold),
+		rule.Frequency,
+		rule.Status,
+		rule.NextRunAt,
+		rule.CreatedAt).Scan(&rule.ID)
+}
+
+func (s *PostgresStorage) GetSweepRules(ctx context.Context, accountID int) ([]*SweepRule, error) {
+	return s.querySweepRules(ctx, "SELECT "+sweepRuleColumns+" FROM sweep_rule WHERE account_id = $1 ORDER BY id", accountID)
+}
+
+func (s *PostgresStorage) CancelSweepRule(ctx context.Context, accountID, id int) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		s.tagQuery("UPDATE sweep_rule SET status = $1 WHERE id = $2 AND account_id = $3 AND status = $4"),
+		ScheduledCancelled, id, accountID, ScheduledActive)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("active sweep rule %d not found", id)
+	}
+	return nil
+}
+
+func (s *PostgresStorage) GetDueSweepRules(ctx context.Context, now time.Time, limit int) ([]*SweepRule, error) {
+	return s.querySweepRules(ctx,
+		"SELECT "+sweepRuleColumns+" FROM sweep_rule WHERE status = $1 AND next_run_at <= $2 ORDER BY next_run_at LIMIT $3",
+		ScheduledActive, now, limit)
+}
+
+// AdvanceSweepRule moves next_run_at on only if nobody else did first
+func (s *PostgresStorage) AdvanceSweepRule(ctx context.Context, id int, from, to time.Time) (bool, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		s.tagQuery("UPDATE sweep_rule SET next_run_at = $1 WHERE id = $2 AND next_run_at = $3 AND status = $4"),
+		to, id, from, ScheduledActive)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *PostgresStorage) RecordSweepExecution(ctx context.Context, execution *SweepExecution) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	return s.db.QueryRowContext(ctx, s.tagQuery(`insert into sweep_execution
+	(rule_id, amount, status, error, executed_at)
+	values ($1, $2, $3, $4, $5)
+	returning id`),
+		execution.RuleID,
+		toCents(execution.Amount),
+		execution.Status,
+		execution.Error,
+		execution.ExecutedAt).Scan(&execution.ID)
+}
+
+func (s *PostgresStorage) GetSweepExecutions(ctx context.Context, accountID, ruleID int) ([]*SweepExecution, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(`SELECT e.id, e.rule_id, e.amount, e.status, e.error, e.executed_at
+	FROM sweep_execution e JOIN sweep_rule r ON r.id = e.rule_id
+	WHERE r.id = $1 AND r.account_id = $2
+	ORDER BY e.executed_at DESC, e.id DESC`), ruleID, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	executions := []*SweepExecution{}
+	for rows.Next() {
+		e := &SweepExecution{}
+		var amount int64
+		if err := rows.Scan(&e.ID, &e.RuleID, &amount, &e.Status, &e.Error, &e.ExecutedAt); err != nil {
+			return nil, err
+		}
+		e.Amount = float64(amount) / 100
+		executions = append(executions, e)
+	}
+
+	return executions, rows.Err()
+}
+
+func (s *PostgresStorage) RecordCashback(ctx context.Context, c *Cashback, tx Transaction) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	_, err := tx.ExecContext(ctx, s.tagQuery(`insert into cashback
+	(account_id, rule, transfer_amount, amount, created_at)
+	values ($1, $2, $3, $4, $5)`),
+		c.AccountID, c.Rule, c.TransferAmount, c.Amount, c.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to record cashback: %v", err)
+	}
+	return nil
+}
+
+func (s *PostgresStorage) GetCashbackTotal(ctx context.Context, accountID int, since time.Time) (int64, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	var total int64
+	err := s.db.QueryRowContext(ctx,
+		s.tagQuery("SELECT coalesce(sum(amount), 0) FROM cashback WHERE account_id = $1 AND created_at >= $2"),
+		accountID, since).Scan(&total)
+	return total, err
+}
+
+func (s *PostgresStorage) GetCashbackCredits(ctx context.Context, accountID int, limit int) ([]*Cashback, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(`SELECT id, account_id, rule, transfer_amount, amount, created_at
+	FROM cashback WHERE account_id = $1 ORDER BY created_at DESC, id DESC LIMIT $2`), accountID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credits := []*Cashback{}
+	for rows.Next() {
+		c := &Cashback{}
+		if err := rows.Scan(&c.ID, &c.AccountID, &c.Rule, &c.TransferAmount, &c.Amount, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		credits = append(credits, c)
+	}
+
+	return credits, rows.Err()
+}
+
+// CreatePasswordReset voids the account's outstanding tokens so only the newest one works
+func (s *PostgresStorage) CreatePasswordReset(ctx context.Context, reset *PasswordReset) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		s.tagQuery("UPDATE password_reset SET used_at = $1 WHERE account_id = $2 AND used_at IS NULL"),
+		reset.CreatedAt, reset.AccountID); err != nil {
+		return err
+	}
+
+	err = tx.QueryRowContext(ctx, s.tagQuery(`insert into password_reset
+	(account_id, token_hash, expires_at, created_at)
+	values ($1, $2, $3, $4) RETURNING id`),
+		reset.AccountID, reset.TokenHash, reset.ExpiresAt, reset.CreatedAt).Scan(&reset.ID)
+	if err != nil {
+		return fmt.Errorf("failed to create password reset: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStorage) GetPasswordReset(ctx context.Context, tokenHash string) (*PasswordReset, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	reset := &PasswordReset{TokenHash: tokenHash}
+	err := s.db.QueryRowContext(ctx,
+		s.tagQuery("SELECT id, account_id, expires_at, used_at, created_at FROM password_reset WHERE token_hash = $1"),
+		tokenHash).Scan(&reset.ID, &reset.AccountID, &reset.ExpiresAt, &reset.UsedAt, &reset.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidResetToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reset, nil
+}
+
+// ResetPassword uses up the token and sets the new password in one transaction
+func (s *PostgresStorage) ResetPassword(ctx context.Context, resetID int, encryptedPassword string, usedAt time.Time) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var accountID int
+	err = tx.QueryRowContext(ctx, s.tagQuery(`UPDATE password_reset SET used_at = $1
+	WHERE id = $2 AND used_at IS NULL AND expires_at > $1 RETURNING account_id`),
+		usedAt, resetID).Scan(&accountID)
+	if err == sql.ErrNoRows {
+		return ErrInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		s.tagQuery("UPDATE account SET encrypted_password = $1 WHERE id = $2"),
+		encryptedPassword, accountID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RehashPassword swaps the hash only if it's still oldHash, a password
+// changed meanwhile is kept
+func (s *PostgresStorage) RehashPassword(ctx context.Context, id int, oldHash, newHash string) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx,
+		s.tagQuery("UPDATE account SET encrypted_password = $1 WHERE id = $2 AND encrypted_password = $3"),
+		newHash, id, oldHash)
+	return err
+}
+
+func (s *PostgresStorage) GetBalanceTotals(ctx context.Context) ([]*BalanceTotal, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(`SELECT currency,
+		coalesce(sum(balance) FILTER (WHERE balance > 0), 0),
+		coalesce(-sum(balance) FILTER (WHERE balance < 0), 0)
+	FROM account GROUP BY currency ORDER BY currency`))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := []*BalanceTotal{}
+	for rows.Next() {
+		t := &BalanceTotal{}
+		if err := rows.Scan(&t.Currency, &t.Deposits, &t.Overdrafts); err != nil {
+			return nil, err
+		}
+		totals = append(totals, t)
+	}
+
+	return totals, rows.Err()
+}
+
+// GetDailyIncome totals fees and cashback per day in [from, to), in the account's currency
+func (s *PostgresStorage) GetDailyIncome(ctx context.Context, from, to time.Time) ([]*DailyIncome, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(`SELECT day, currency, sum(fees), sum(cashback) FROM (
+		SELECT f.accrued_on::date AS day, a.currency, f.amount AS fees, 0 AS cashback
+		FROM overdraft_fee f JOIN account a ON a.id = f.account_id
+		WHERE f.accrued_on >= $1 AND f.accrued_on < $2
+		UNION ALL
+		SELECT c.created_at::date, a.currency, 0, c.amount
+		FROM cashback c JOIN account a ON a.id = c.account_id
+		WHERE c.created_at >= $1 AND c.created_at < $2
+	) income GROUP BY day, currency ORDER BY day, currency`), from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	income := []*DailyIncome{}
+	for rows.Next() {
+		d := &DailyIncome{}
+		if err := rows.Scan(&d.Day, &d.Currency, &d.FeeIncome, &d.CashbackExpense); err != nil {
+			return nil, err
+		}
+		income = append(income, d)
+	}
+
+	return income, rows.Err()
+}
+
+func (s *PostgresStorage) RecordLiabilitySnapshot(ctx context.Context, snap *LiabilitySnapshot) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, s.tagQuery(`insert into liability_snapshot
+	(day, currency, deposits, overdrafts, taken_at)
+	values ($1, $2, $3, $4, $5)
+	on conflict (day, currency) do update
+	set deposits = excluded.deposits, overdrafts = excluded.overdrafts, taken_at = excluded.taken_at`),
+		snap.Day, snap.Currency, snap.Deposits, snap.Overdrafts, snap.TakenAt)
+	if err != nil {
+		return fmt.Errorf("failed to record liability snapshot: %v", err)
+	}
+	return nil
+}
+
+func (s *PostgresStorage) GetLiabilitySnapshots(ctx context.Context, from, to time.Time) ([]*LiabilitySnapshot, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(`SELECT day, currency, deposits, overdrafts, taken_at
+	FROM liability_snapshot WHERE day >= $1 AND day < $2 ORDER BY day, currency`), from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snapshots := []*LiabilitySnapshot{}
+	for rows.Next() {
+		snap := &LiabilitySnapshot{}
+		if err := rows.Scan(&snap.Day, &snap.Currency, &snap.Deposits, &snap.Overdrafts, &snap.TakenAt); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snap)
+	}
+
+	return snapshots, rows.Err()
+}
+
+func (s *PostgresStorage) CreateEmailVerification(ctx context.Context, v *EmailVerification) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	err := s.db.QueryRowContext(ctx, s.tagQuery(`insert into email_verification
+	(account_id, token_hash, expires_at, created_at)
+	values ($1, $2, $3, $4) RETURNING id`),
+		v.AccountID, v.TokenHash, v.ExpiresAt, v.CreatedAt).Scan(&v.ID)
+	if err != nil {
+		return fmt.Errorf("failed to create email verification: %v", err)
+	}
+	return nil
+}
+
+// VerifyEmail uses up the token and marks the account's email verified, returning its id
+func (s *PostgresStorage) VerifyEmail(ctx context.Context, tokenHash string, now time.Time) (int, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var accountID int
+	err = tx.QueryRowContext(ctx, s.tagQuery(`UPDATE email_verification SET used_at = $1
+	WHERE token_hash = $2 AND used_at IS NULL AND expires_at > $1 RETURNING account_id`),
+		now, tokenHash).Scan(&accountID)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidVerificationToken
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		s.tagQuery("UPDATE account SET email_verified = true WHERE id = $1"), accountID); err != nil {
+		return 0, err
+	}
+
+	return accountID, tx.Commit()
+}
+
+// TouchAccountActivity moves last_activity_at forward and clears any pending dormancy notice
+func (s *PostgresStorage) TouchAccountActivity(ctx context.Context, id int, at time.Time) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	_, err := s.exec(ctx, nil, touchActivityQuery, at, id)
+	return err
+}
+
+// GetInactiveAccounts lists active accounts without activity since before, oldest first
+func (s *PostgresStorage) GetInactiveAccounts(ctx context.Context, before time.Time, skipNotified bool, limit int) ([]*Account, error) {
+	return s.queryAccounts(ctx, "SELECT "+accountColumns+` FROM account
+	WHERE status = 'active' AND last_activity_at < $1 AND (NOT $2 OR dormancy_notified_at IS NULL)
+	ORDER BY last_activity_at LIMIT $3`, before, skipNotified, limit)
+}
+
+// MarkDormancyNotified reports false when the notice was already sent
+func (s *PostgresStorage) MarkDormancyNotified(ctx context.Context, id int, at time.Time) (bool, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		s.tagQuery("UPDATE account SET dormancy_notified_at = $1 WHERE id = $2 AND dormancy_notified_at IS NULL"), at, id)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *PostgresStorage) RecordAccountEvent(ctx context.Context, event *AccountEvent) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	query := `insert into account_event
+	(account_id, type, direction, amount, balance, currency, reference, created_at)
+	values ($1, $2, $3, $4, $5, $6, nullif($7, '')::uuid, $8)
+	returning id`
+
+	return s.db.QueryRowContext(ctx, s.tagQuery(query),
+		event.AccountID,
+		event.Type,
+		event.Direction,
+		toCents(event.Amount),
+		toCents(event.Balance),
+		event.Currency,
+		event.Reference,
+		event.CreatedAt).Scan(&event.ID)
+}
+
+// GetLatestAccountEventID is zero for accounts without events
+func (s *PostgresStorage) GetLatestAccountEventID(ctx context.Context, accountID int) (int64, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	var id int64
+	err := s.db.QueryRowContext(ctx, s.tagQuery(`select coalesce(max(id), 0) from account_event where account_id = $1`), accountID).Scan(&id)
+	return id, err
+}
+
+func (s *PostgresStorage) GetAccountEvents(ctx context.Context, accountID int, after int64, limit int) ([]*AccountEvent, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	query := `select id, account_id, type, direction, amount, balance, currency, coalesce(reference::text, ''), created_at
+	from account_event where account_id = $1 and id > $2 order by id limit $3`
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(query), accountID, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*AccountEvent{}
+	for rows.Next() {
+		e := &AccountEvent{}
+		var amount, balance int64
+		if err := rows.Scan(&e.ID, &e.AccountID, &e.Type, &e.Direction, &amount, &balance, &e.Currency, &e.Reference, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.Amount, e.Balance = float64(amount)/100, float64(balance)/100
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+const eventSubscriptionColumns = "id, account_id, url, filter, secret, last_event_id, status, created_at"
+
+func (s *PostgresStorage) queryEventSubscriptions(ctx context.Context, query string, args ...interface{}) ([]*EventSubscription, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := []*EventSubscription{}
+	for rows.Next() {
+		sub := &EventSubscription{}
+		if err := rows.Scan(&sub.ID, &sub.AccountID, &sub.URL, &sub.Filter, &sub.Secret, &sub.Cursor, &sub.Status, &sub.CreatedAt); err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+
+	return subs, rows.Err()
+}
+
+// New subscriptions start at the newest event, they don't replay history
+func (s *PostgresStorage) CreateEventSubscription(ctx context.Context, sub *EventSubscription) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	query := `insert into event_subscription
+	(account_id, url, filter, secret, last_event_id, status, created_at)
+	values ($1, $2, $3, $4, (select coalesce(max(id), 0) from account_event where account_id = $1), $5, $6)
+	returning id, last_event_id`
+
+	return s.db.QueryRowContext(ctx, s.tagQuery(query),
+		sub.AccountID,
+		sub.URL,
+		sub.Filter,
+		sub.Secret,
+		sub.Status,
+		sub.CreatedAt).Scan(&sub.ID, &sub.Cursor)
+}
+
+func (s *PostgresStorage) GetEventSubscriptions(ctx context.Context, accountID int) ([]*EventSubscription, error) {
+	return s.queryEventSubscriptions(ctx, "SELECT "+eventSubscriptionColumns+" FROM event_subscription WHERE account_id = $1 ORDER BY id", accountID)
+}
+
+func (s *PostgresStorage) GetActiveEventSubscriptions(ctx context.Context, limit int) ([]*EventSubscription, error) {
+	return s.queryEventSubscriptions(ctx,
+		"SELECT "+eventSubscriptionColumns+" FROM event_subscription WHERE status = $1 ORDER BY id LIMIT $2",
+		ScheduledActive, limit)
+}
+
+func (s *PostgresStorage) CancelEventSubscription(ctx context.Context, accountID, id int) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		s.tagQuery("UPDATE event_subscription SET status = $1 WHERE id = $2 AND account_id = $3 AND status = $4"),
+		ScheduledCancelled, id, accountID, ScheduledActive)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("active subscription %d not found", id)
+	}
+	return nil
+}
+
+// AdvanceEventSubscription moves the cursor on only if nobody else did first
+func (s *PostgresStorage) AdvanceEventSubscription(ctx context.Context, id int, from, to int64) (bool, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		s.tagQuery("UPDATE event_subscription SET last_event_id = $1 WHERE id = $2 AND last_event_id = $3"), to, id, from)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// RecordTransferEnrichment replaces an earlier result from the same enricher
+func (s *PostgresStorage) RecordTransferEnrichment(ctx context.Context, e *TransferEnrichment) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	query := `insert into transaction_enrichments (reference, enricher, data, created_at)
+	values ($1, $2, $3, $4)
+	on conflict (reference, enricher) do update set data = excluded.data, created_at = excluded.created_at`
+
+	_, err := s.db.ExecContext(ctx, s.tagQuery(query), e.Reference, e.Enricher, []byte(e.Data), e.CreatedAt)
+	return err
+}
+
+func (s *PostgresStorage) GetTransferEnrichments(ctx context.Context, reference string) ([]*TransferEnrichment, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		s.tagQuery("select reference, enricher, data, created_at from transaction_enrichments where reference = $1 order by enricher"),
+		reference)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	enrichments := []*TransferEnrichment{}
+	for rows.Next() {
+		e := new(TransferEnrichment)
+		var data []byte
+		if err := rows.Scan(&e.Reference, &e.Enricher, &data, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.Data = data
+		enrichments = append(enrichments, e)
+	}
+	return enrichments, rows.Err()
+}
+
+const pinColumns = "account_id, pin_hash, failed_attempts, locked_until, updated_at"
+
+func scanPIN(row interface{ Scan(...any) error }) (*AccountPIN, error) {
+	pin := &AccountPIN{}
+	var lockedUntil sql.NullTime
+	if err := row.Scan(&pin.AccountID, &pin.Hash, &pin.FailedAttempts, &lockedUntil, &pin.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if lockedUntil.Valid {
+		pin.LockedUntil = &lockedUntil.Time
+	}
+	return pin, nil
+}
+
+func (s *PostgresStorage) SavePIN(ctx context.Context, pin *AccountPIN) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, s.tagQuery(`INSERT INTO account_pin (account_id, pin_hash, failed_attempts, locked_until, updated_at)
+	VALUES ($1, $2, 0, NULL, $3)
+	ON CONFLICT (account_id) DO UPDATE SET pin_hash = $2, failed_attempts = 0, locked_until = NULL, updated_at = $3`),
+		pin.AccountID, pin.Hash, pin.UpdatedAt)
+	return err
+}
+
+func (s *PostgresStorage) GetPIN(ctx context.Context, accountID int) (*AccountPIN, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	pin, err := scanPIN(s.db.QueryRowContext(ctx, s.tagQuery("SELECT "+pinColumns+" FROM account_pin WHERE account_id = $1"), accountID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: account %d", ErrPINNotSet, accountID)
+	}
+	return pin, err
+}
+
+// RecordPINFailure counts a wrong PIN, the one that reaches maxAttempts
+// locks the PIN until lockUntil and starts the count over
+func (s *PostgresStorage) RecordPINFailure(ctx context.Context, accountID int, maxAttempts int, lockUntil time.Time) (*AccountPIN, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	pin, err := scanPIN(s.db.QueryRowContext(ctx, s.tagQuery(`UPDATE account_pin SET
+		locked_until = CASE WHEN failed_attempts + 1 >= $2 THEN $3 ELSE locked_until END,
+		failed_attempts = CASE WHEN failed_attempts + 1 >= $2 THEN 0 ELSE failed_attempts + 1 END
+	WHERE account_id = $1 RETURNING `+pinColumns), accountID, maxAttempts, lockUntil))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: account %d", ErrPINNotSet, accountID)
+	}
+	return pin, err
+}
+
+func (s *PostgresStorage) ResetPINFailures(ctx context.Context, accountID int) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, s.tagQuery("UPDATE account_pin SET failed_attempts = 0 WHERE account_id = $1"), accountID)
+	return err
+}
+
+const loginFailureColumns = "account_id, failed_attempts, locked_until, updated_at"
+
+func scanLoginFailures(row interface{ Scan(...any) error }) (*LoginFailures, error) {
+	f := &LoginFailures{}
+	var lockedUntil sql.NullTime
+	if err := row.Scan(&f.AccountID, &f.FailedAttempts, &lockedUntil, &f.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if lockedUntil.Valid {
+		f.LockedUntil = &lockedUntil.Time
+	}
+	return f, nil
+}
+
+// GetLoginFailures has no failures for accounts that never failed a login
+func (s *PostgresStorage) GetLoginFailures(ctx context.Context, accountID int) (*LoginFailures, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	f, err := scanLoginFailures(s.db.QueryRowContext(ctx, s.tagQuery("SELECT "+loginFailureColumns+" FROM login_lockout WHERE account_id = $1"), accountID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return &LoginFailures{AccountID: accountID}, nil
+	}
+	return f, err
+}
+
+// RecordLoginFailure counts a failed login, the one that reaches
+// maxAttempts locks logins until lockUntil and starts the count over
+func (s *PostgresStorage) RecordLoginFailure(ctx context.Context, accountID int, maxAttempts int, lockUntil, now time.Time) (*LoginFailures, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	return scanLoginFailures(s.db.QueryRowContext(ctx, s.tagQuery(`INSERT INTO login_lockout AS l (account_id, failed_attempts, locked_until, updated_at)
+	VALUES ($1, CASE WHEN $2 <= 1 THEN 0 ELSE 1 END, CASE WHEN $2 <= 1 THEN $3::timestamp END, $4)
+	ON CONFLICT (account_id) DO UPDATE SET
+		locked_until = CASE WHEN l.failed_attempts + 1 >= $2 THEN $3 ELSE l.locked_until END,
+		failed_attempts = CASE WHEN l.failed_attempts + 1 >= $2 THEN 0 ELSE l.failed_attempts + 1 END,
+		updated_at = $4
+	RETURNING `+loginFailureColumns), accountID, maxAttempts, lockUntil, now))
+}
+
+func (s *PostgresStorage) ClearLoginFailures(ctx context.Context, accountID int) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, s.tagQuery("DELETE FROM login_lockout WHERE account_id = $1"), accountID)
+	return err
+}
+
+func (s *PostgresStorage) GetAccountByEmail(ctx context.Context, email string) (*Account, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery("SELECT "+accountColumns+" FROM account WHERE email = $1"), email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: email %s", ErrAccountNotFound, email)
+	}
+	return scanIntoAccount(rows)
+}
+
+func (s *PostgresStorage) GetOIDCIdentity(ctx context.Context, issuer, subject string) (*OIDCIdentity, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	identity := &OIDCIdentity{}
+	err := s.db.QueryRowContext(ctx, s.tagQuery(`SELECT id, issuer, subject, account_id, email, created_at
+	FROM oidc_identity WHERE issuer = $1 AND subject = $2`), issuer, subject).
+		Scan(&identity.ID, &identity.Issuer, &identity.Subject, &identity.AccountID, &identity.Email, &identity.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s at %s", ErrIdentityNotLinked, subject, issuer)
+	}
+	return identity, err
+}
+
+func (s *PostgresStorage) CreateOIDCIdentity(ctx context.Context, identity *OIDCIdentity) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	return s.db.QueryRowContext(ctx, s.tagQuery(`INSERT INTO oidc_identity (issuer, subject, account_id, email, created_at)
+	VALUES ($1, $2, $3, $4, $5) RETURNING id`),
+		identity.Issuer, identity.Subject, identity.AccountID, identity.Email, identity.CreatedAt).Scan(&identity.ID)
+}
+
+func (s *PostgresStorage) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	return s.db.QueryRowContext(ctx, s.tagQuery(`insert into api_key
+	(name, scope, account_id, prefix, key_hash, created_by, created_at)
+	values ($1, $2, $3, $4, $5, $6, $7)
+	returning id`),
+		key.Name, key.Scope, key.AccountID, key.Prefix, key.KeyHash, key.CreatedBy, key.CreatedAt).Scan(&key.ID)
+}
+
+const apiKeyColumns = `id, name, scope, account_id, prefix, key_hash, created_by, created_at, last_used_at, revoked_at`
+
+func scanAPIKey(row interface{ Scan(...any) error }) (*APIKey, error) {
+	k := &APIKey{}
+	err := row.Scan(&k.ID, &k.Name, &k.Scope, &k.AccountID, &k.Prefix, &k.KeyHash, &k.CreatedBy, &k.CreatedAt, &k.LastUsedAt, &k.RevokedAt)
+	return k, err
+}
+
+func (s *PostgresStorage) GetAPIKeyByHash(ctx context.Context, hash string) (*APIKey, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	key, err := scanAPIKey(s.db.QueryRowContext(ctx, s.tagQuery("select "+apiKeyColumns+" from api_key where key_hash = $1"), hash))
+	if err == sql.ErrNoRows {
+		return nil, ErrAPIKeyNotFound
+	}
+	return key, err
+}
+
+func (s *PostgresStorage) ListAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery("select "+apiKeyColumns+" from api_key order by id"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey revokes a key that's still active and returns it as revoked
+func (s *PostgresStorage) RevokeAPIKey(ctx context.Context, id int, at time.Time) (*APIKey, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	key, err := scanAPIKey(s.db.QueryRowContext(ctx, s.tagQuery(`update api_key set revoked_at = $1
+	where id = $2 and revoked_at is null
+	returning `+apiKeyColumns), at, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", ErrAPIKeyNotFound, id)
+	}
+	return key, err
+}
+
+func (s *PostgresStorage) TouchAPIKey(ctx context.Context, id int, at time.Time) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, s.tagQuery("update api_key set last_used_at = $1 where id = $2"), at, id)
+	return err
+}
+
+// GetPreferences returns the defaults for accounts that never saved any
+func (s *PostgresStorage) GetPreferences(ctx context.Context, accountID int) (*AccountPreferences, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	prefs := defaultPreferences(accountID)
+	err := s.db.QueryRowContext(ctx, s.tagQuery(`select statement_email, notify_large_transfers, notify_low_balance, notify_new_logins, timezone, updated_at
+	from account_preferences where account_id = $1`), accountID).
+		Scan(&prefs.StatementEmail, &prefs.NotifyLargeTransfers, &prefs.NotifyLowBalance, &prefs.NotifyNewLogins, &prefs.Timezone, &prefs.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return prefs, nil
+	}
+	return prefs, err
+}
+
+func (s *PostgresStorage) SavePreferences(ctx context.Context, prefs *AccountPreferences) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, s.tagQuery(`insert into account_preferences
+	(account_id, statement_email, notify_large_transfers, notify_low_balance, notify_new_logins, timezone, updated_at)
+	values ($1, $2, $3, $4, $5, $6, $7)
+	on conflict (account_id) do update set statement_email = excluded.statement_email,
+		notify_large_transfers = excluded.notify_large_transfers, notify_low_balance = excluded.notify_low_balance,
+		notify_new_logins = excluded.notify_new_logins, timezone = excluded.timezone, updated_at = excluded.updated_at`),
+		prefs.AccountID, prefs.StatementEmail, prefs.NotifyLargeTransfers, prefs.NotifyLowBalance, prefs.NotifyNewLogins, prefs.Location().String(), prefs.UpdatedAt)
+	return err
+}
+
+func (s *PostgresStorage) GetStatementOptIns(ctx context.Context) ([]int, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(`select account_id from account_preferences where statement_email order by account_id`))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ClaimStatement reports false when the period's statement was already claimed
+func (s *PostgresStorage) ClaimStatement(ctx context.Context, accountID int, period, at time.Time) (bool, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, s.tagQuery(`insert into statement_delivery (account_id, period, sent_at)
+	values ($1, $2, $3) on conflict do nothing`), accountID, period, at)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *PostgresStorage) ReleaseStatement(ctx context.Context, accountID int, period time.Time) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, s.tagQuery(`delete from statement_delivery where account_id = $1 and period = $2`), accountID, period)
+	return err
+}
+
+func (s *PostgresStorage) CreateNotification(ctx context.Context, n *Notification) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	return s.db.QueryRowContext(ctx, s.tagQuery(`insert into notification (account_id, type, message, created_at)
+	values ($1, $2, $3, $4) returning id`), n.AccountID, n.Type, n.Message, n.CreatedAt).Scan(&n.ID)
+}
+
+func (s *PostgresStorage) GetNotifications(ctx context.Context, accountID int, unreadOnly bool, limit int) ([]*Notification, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(`select id, account_id, type, message, created_at, read_at from notification
+	where account_id = $1 and (not $2 or read_at is null)
+	order by id desc limit $3`), accountID, unreadOnly, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []*Notification{}
+	for rows.Next() {
+		n := &Notification{}
+		if err := rows.Scan(&n.ID, &n.AccountID, &n.Type, &n.Message, &n.CreatedAt, &n.ReadAt); err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+// MarkNotificationsRead marks unread notifications up to upTo read, all of them when it's zero
+func (s *PostgresStorage) MarkNotificationsRead(ctx context.Context, accountID int, upTo int64, at time.Time) (int64, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, s.tagQuery(`update notification set read_at = $1
+	where account_id = $2 and read_at is null and ($3 = 0 or id <= $3)`), at, accountID, upTo)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// RecordLoginIP remembers a login's IP and reports whether it's unfamiliar:
+// new to an account that logged in from somewhere else before
+func (s *PostgresStorage) RecordLoginIP(ctx context.Context, accountID int, ip string, at time.Time) (bool, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	var inserted, others bool
+	err := s.db.QueryRowContext(ctx, s.tagQuery(`with known as (
+		select exists(select 1 from login_ip where account_id = $1 and ip <> $2) as others
+	), upsert as (
+		insert into login_ip (account_id, ip, first_seen, last_seen) values ($1, $2, $3, $3)
+		on conflict (account_id, ip) do update set last_seen = excluded.last_seen
+		returning (xmax = 0) as inserted
+	)
+	select upsert.inserted, known.others from upsert, known`), accountID, ip, at).Scan(&inserted, &others)
+	return inserted && others, err
+}
+
+// GetTransferHistory sums up fromAccountID's customer transfers, Recent counts those since since
+func (s *PostgresStorage) GetTransferHistory(ctx context.Context, fromAccountID, toAccountID int, since time.Time) (*TransferHistory, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	h := &TransferHistory{}
+	err := s.db.QueryRowContext(ctx, s.tagQuery(`select count(*), coalesce(avg(amount), 0)::bigint,
+		count(*) filter (where created_at >= $3), coalesce(bool_or(to_account_id = $2), false)
+	from transfer where from_account_id = $1 and kind = 'transfer'`), fromAccountID, toAccountID, since).
+		Scan(&h.Count, &h.Average, &h.Recent, &h.PaidBefore)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (s *PostgresStorage) CreateFraudDecision(ctx context.Context, d *FraudDecision) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	return s.db.QueryRowContext(ctx, s.tagQuery(`insert into fraud_decision
+	(reference, account_id, from_account, to_account, amount, action, rules, created_at)
+	values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`),
+		d.Reference, d.AccountID, d.FromAccount, d.ToAccount, toCents(d.Amount), d.Action, pq.Array(d.Rules), d.CreatedAt).Scan(&d.ID)
+}
+
+// GetFraudDecisions lists the newest decisions, only those with action unless it's empty
+func (s *PostgresStorage) GetFraudDecisions(ctx context.Context, action string, limit int) ([]*FraudDecision, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(`select id, reference, account_id, from_account, to_account, amount, action, rules, created_at
+	from fraud_decision where ($1 = '' or action = $1) order by id desc limit $2`), action, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	decisions := []*FraudDecision{}
+	for rows.Next() {
+		d := &FraudDecision{}
+		var amount int64
+		if err := rows.Scan(&d.ID, &d.Reference, &d.AccountID, &d.FromAccount, &d.ToAccount, &amount, &d.Action, pq.Array(&d.Rules), &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		d.Amount = float64(amount) / 100
+		decisions = append(decisions, d)
+	}
+	return decisions, rows.Err()
+}
+
+func (s *PostgresStorage) GetAccountCounts(ctx context.Context) (*AccountCounts, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	c := &AccountCounts{}
+	err := s.db.QueryRowContext(ctx, s.tagQuery(`select count(*),
+		count(*) filter (where status = 'active'), count(*) filter (where status = 'frozen'),
+		count(*) filter (where status = 'dormant'), count(*) filter (where status = 'closed')
+	from account`)).Scan(&c.Total, &c.Active, &c.Frozen, &c.Dormant, &c.Closed)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetTransferVolume totals customer transfers per day in [from, to) and currency sent
+func (s *PostgresStorage) GetTransferVolume(ctx context.Context, from, to time.Time) ([]*TransferVolume, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(`select created_at::date, currency, count(*), sum(amount)
+	from transfer where kind = 'transfer' and created_at >= $1 and created_at < $2
+	group by 1, 2 order by 1, 2`), from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	volume := []*TransferVolume{}
+	for rows.Next() {
+		v := &TransferVolume{}
+		var day time.Time
+		if err := rows.Scan(&day, &v.Currency, &v.Count, &v.Amount); err != nil {
+			return nil, err
+		}
+		v.Day = day.Format("2006-01-02")
+		volume = append(volume, v)
+	}
+	return volume, rows.Err()
+}
+
+// GetTopAccounts ranks accounts by the customer transfers they sent or received since since
+func (s *PostgresStorage) GetTopAccounts(ctx context.Context, since time.Time, limit int) ([]*AccountActivity, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(`select a.id, a.number, a.currency, count(*), sum(t.amount) from (
+		select from_account_id as account_id, amount from transfer where kind = 'transfer' and created_at >= $1
+		union all
+		select to_account_id, coalesce(converted_amount, amount) from transfer where kind = 'transfer' and created_at >= $1
+	) t join account a on a.id = t.account_id
+	group by a.id order by count(*) desc, sum(t.amount) desc, a.id limit $2`), since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []*AccountActivity{}
+	for rows.Next() {
+		a := &AccountActivity{}
+		if err := rows.Scan(&a.AccountID, &a.Number, &a.Currency, &a.Transfers, &a.Amount); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, rows.Err()
+}
+
+const mandateColumns = `id, payer_account_id, creditor_account_id, reference, max_amount, frequency, status,
+	created_at, approved_at, cancelled_at`
+
+func scanMandate(row interface{ Scan(...any) error }) (*Mandate, error) {
+	m := &Mandate{}
+	var maxAmount int64
+	err := row.Scan(&m.ID, &m.PayerAccountID, &m.CreditorAccountID, &m.Reference, &maxAmount, &m.Frequency, &m.Status,
+		&m.CreatedAt, &m.ApprovedAt, &m.CancelledAt)
+	m.MaxAmount = float64(maxAmount) / 100
+	return m, err
+}
+
+func (s *PostgresStorage) CreateMandate(ctx context.Context, m *Mandate) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	return s.db.QueryRowContext(ctx, s.tagQuery(`insert into mandate
+	(payer_account_id, creditor_account_id, reference, max_amount, frequency, status, created_at)
+	values ($1, $2, $3, $4, $5, $6, $7)
+	returning id`),
+		m.PayerAccountID, m.CreditorAccountID, m.Reference, toCents(m.MaxAmount), m.Frequency, m.Status, m.CreatedAt).Scan(&m.ID)
+}
+
+func (s *PostgresStorage) GetMandate(ctx context.Context, id int) (*Mandate, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	m, err := scanMandate(s.db.QueryRowContext(ctx, s.tagQuery("select "+mandateColumns+" from mandate where id = $1"), id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", ErrMandateNotFound, id)
+	}
+	return m, err
+}
+
+// GetMandates lists the mandates the account pays or collects on
+func (s *PostgresStorage) GetMandates(ctx context.Context, accountID int) ([]*Mandate, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery("select "+mandateColumns+` from mandate
+	where payer_account_id = $1 or creditor_account_id = $1 order by id`), accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mandates := []*Mandate{}
+	for rows.Next() {
+		m, err := scanMandate(rows)
+		if err != nil {
+			return nil, err
+		}
+		mandates = append(mandates, m)
+	}
+	return mandates, rows.Err()
+}
+
+// UpdateMandateStatus stores m's status and timestamps if it's still in status from
+func (s *PostgresStorage) UpdateMandateStatus(ctx context.Context, m *Mandate, from string) (bool, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, s.tagQuery(`update mandate set status = $1, approved_at = $2, cancelled_at = $3
+	where id = $4 and status = $5`),
+		m.Status, m.ApprovedAt, m.CancelledAt, m.ID, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+const mandateCollectionColumns = `id, mandate_id, amount, status, collect_at, retry_at, attempts, last_error,
+	coalesce(transfer_reference::text, ''), created_at`
+
+func (s *PostgresStorage) queryMandateCollections(ctx context.Context, query string, args ...any) ([]*MandateCollection, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	collections := []*MandateCollection{}
+	for rows.Next() {
+		c := &MandateCollection{}
+		var amount int64
+		if err := rows.Scan(&c.ID, &c.MandateID, &amount, &c.Status, &c.CollectAt, &c.RetryAt, &c.Attempts, &c.LastError,
+			&c.TransferReference, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		c.Amount = float64(amount) / 100
+		collections = append(collections, c)
+	}
+	return collections, rows.Err()
+}
+
+func (s *PostgresStorage) CreateMandateCollection(ctx context.Context, c *MandateCollection) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	return s.db.QueryRowContext(ctx, s.tagQuery(`insert into mandate_collection
+	(mandate_id, amount, status, collect_at, created_at)
+	values ($1, $2, $3, $4, $5)
+	returning id`),
+		c.MandateID, toCents(c.Amount), c.Status, c.CollectAt, c.CreatedAt).Scan(&c.ID)
+}
+
+func (s *PostgresStorage) GetMandateCollections(ctx context.Context, mandateID int) ([]*MandateCollection, error) {
+	return s.queryMandateCollections(ctx,
+		"select "+mandateCollectionColumns+" from mandate_collection where mandate_id = $1 order by id", mandateID)
+}
+
+func (s *PostgresStorage) GetDueMandateCollections(ctx context.Context, now time.Time, limit int) ([]*MandateCollection, error) {
+	return s.queryMandateCollections(ctx, "select "+mandateCollectionColumns+` from mandate_collection
+	where status = $1 and coalesce(retry_at, collect_at) <= $2
+	order by coalesce(retry_at, collect_at) limit $3`,
+		CollectionPending, now, limit)
+}
+
+func (s *PostgresStorage) ClaimMandateCollection(ctx context.Context, id int, now, leaseUntil time.Time) (bool, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, s.tagQuery(`update mandate_collection set retry_at = $1
+	where id = $2 and status = $3 and coalesce(retry_at, collect_at) <= $4`),
+		leaseUntil, id, CollectionPending, now)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *PostgresStorage) UpdateMandateCollection(ctx context.Context, c *MandateCollection) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, s.tagQuery(`update mandate_collection
+	set status = $1, retry_at = $2, attempts = $3, last_error = $4, transfer_reference = nullif($5, '')::uuid
+	where id = $6`),
+		c.Status, c.RetryAt, c.Attempts, c.LastError, c.TransferReference, c.ID)
+	return err
+}
+
+const chequeColumns = `id, account_id, number, drawer, amount, currency, status, reservation_id,
+	deposited_at, clears_at, resolved_at, bounce_reason`
+
+func scanCheque(row interface{ Scan(...any) error }) (*Cheque, error) {
+	c := &Cheque{}
+	var amount int64
+	err := row.Scan(&c.ID, &c.AccountID, &c.Number, &c.Drawer, &amount, &c.Currency, &c.Status, &c.ReservationID,
+		&c.DepositedAt, &c.ClearsAt, &c.ResolvedAt, &c.BounceReason)
+	c.Amount = float64(amount) / 100
+	return c, err
+}
+
+func (s *PostgresStorage) queryCheques(ctx context.Context, query string, args ...any) ([]*Cheque, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cheques := []*Cheque{}
+	for rows.Next() {
+		c, err := scanCheque(rows)
+		if err != nil {
+			return nil, err
+		}
+		cheques = append(cheques, c)
+	}
+	return cheques, rows.Err()
+}
+
+func (s *PostgresStorage) CreateCheque(ctx context.Context, c *Cheque) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	return s.db.QueryRowContext(ctx, s.tagQuery(`insert into cheque
+	(account_id, number, drawer, amount, currency, status, reservation_id, deposited_at, clears_at)
+	values ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	returning id`),
+		c.AccountID, c.Number, c.Drawer, toCents(c.Amount), c.Currency, c.Status, c.ReservationID, c.DepositedAt, c.ClearsAt).Scan(&c.ID)
+}
+
+func (s *PostgresStorage) GetCheque(ctx context.Context, id int) (*Cheque, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	c, err := scanCheque(s.db.QueryRowContext(ctx, s.tagQuery("select "+chequeColumns+" from cheque where id = $1"), id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", ErrChequeNotFound, id)
+	}
+	return c, err
+}
+
+func (s *PostgresStorage) GetCheques(ctx context.Context, accountID int) ([]*Cheque, error) {
+	return s.queryCheques(ctx, "select "+chequeColumns+" from cheque where account_id = $1 order by id desc", accountID)
+}
+
+func (s *PostgresStorage) GetDueCheques(ctx context.Context, now time.Time, limit int) ([]*Cheque, error) {
+	return s.queryCheques(ctx, "select "+chequeColumns+" from cheque where status = $1 and clears_at <= $2 order by clears_at limit $3",
+		ChequePending, now, limit)
+}
+
+// ResolveCheque stores c's status if it's still in status from
+func (s *PostgresStorage) ResolveCheque(ctx context.Context, c *Cheque, from string) (bool, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, s.tagQuery("update cheque set status = $1, resolved_at = $2, bounce_reason = $3 where id = $4 and status = $5"),
+		c.Status, c.ResolvedAt, c.BounceReason, c.ID, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+const cardColumns = "id, account_id, masked_pan, status, transaction_limit, daily_limit, expires_at, created_at"
+
+func scanCard(row interface{ Scan(...any) error }) (*Card, error) {
+	card := &Card{}
+	var transactionLimit, dailyLimit int64
+	err := row.Scan(&card.ID, &card.AccountID, &card.MaskedPAN, &card.Status, &transactionLimit, &dailyLimit, &card.ExpiresAt, &card.CreatedAt)
+	card.TransactionLimit, card.DailyLimit = float64(transactionLimit)/100, float64(dailyLimit)/100
+	return card, err
+}
+
+func (s *PostgresStorage) CreateCard(ctx context.Context, card *Card) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	return s.db.QueryRowContext(ctx, s.tagQuery(`insert into cards
+	(account_id, masked_pan, status, transaction_limit, daily_limit, expires_at, created_at)
+	values ($1, $2, $3, $4, $5, $6, $7)
+	returning id`),
+		card.AccountID, card.MaskedPAN, card.Status, toCents(card.TransactionLimit), toCents(card.DailyLimit), card.ExpiresAt, card.CreatedAt).Scan(&card.ID)
+}
+
+func (s *PostgresStorage) GetCard(ctx context.Context, id int) (*Card, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	card, err := scanCard(s.db.QueryRowContext(ctx, s.tagQuery("select "+cardColumns+" from cards where id = $1"), id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", ErrCardNotFound, id)
+	}
+	return card, err
+}
+
+func (s *PostgresStorage) GetCards(ctx context.Context, accountID int) ([]*Card, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery("select "+cardColumns+" from cards where account_id = $1 order by id"), accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cards := []*Card{}
+	for rows.Next() {
+		card, err := scanCard(rows)
+		if err != nil {
+			return nil, err
+		}
+		cards = append(cards, card)
+	}
+	return cards, rows.Err()
+}
+
+func (s *PostgresStorage) SetCardStatus(ctx context.Context, id int, from, to string) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, s.tagQuery("update cards set status = $1 where id = $2 and status = $3"), to, id, from)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("card %d is no longer %s", id, from)
+	}
+	return nil
+}
+
+func (s *PostgresStorage) UpdateCardLimits(ctx context.Context, card *Card) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, s.tagQuery("update cards set transaction_limit = $1, daily_limit = $2 where id = $3"),
+		toCents(card.TransactionLimit), toCents(card.DailyLimit), card.ID)
+	return err
+}
+
+const externalTransferColumns = `id, reference, account_id, rail, routing_number, account_number, beneficiary_name, amount,
+	currency, memo, status, return_code, created_at, settles_at, resolved_at`
+
+func scanExternalTransfer(row interface{ Scan(...any) error }) (*ExternalTransfer, error) {
+	t := &ExternalTransfer{}
+	var amount int64
+	err := row.Scan(&t.ID, &t.Reference, &t.AccountID, &t.Rail, &t.RoutingNumber, &t.AccountNumber, &t.BeneficiaryName, &amount,
+		&t.Currency, &t.Memo, &t.Status, &t.ReturnCode, &t.CreatedAt, &t.SettlesAt, &t.ResolvedAt)
+	t.Amount = float64(amount) / 100
+	return t, err
+}
+
+func (s *PostgresStorage) queryExternalTransfers(ctx context.Context, query string, args ...any) ([]*ExternalTransfer, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers := []*ExternalTransfer{}
+	for rows.Next() {
+		t, err := scanExternalTransfer(rows)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, t)
+	}
+	return transfers, rows.Err()
+}
+
+// CreateExternalTransfer records t inside tx, the transaction booking its amount out
+func (s *PostgresStorage) CreateExternalTransfer(ctx context.Context, t *ExternalTransfer, tx Transaction) error {
+	q, ok := tx.(rowQueryer)
+	if !ok {
+		return fmt.Errorf("external transfers are recorded inside a database transaction")
+	}
+	return s.insertExternalTransfer(ctx, q, t)
+}
+
+func (s *PostgresStorage) insertExternalTransfer(ctx context.Context, q rowQueryer, t *ExternalTransfer) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	return s.queryRow(ctx, q, `insert into external_transfer
+	(reference, account_id, rail, routing_number, account_number, beneficiary_name, amount, currency, memo, status, created_at, settles_at)
+	values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	returning id`,
+		t.Reference, t.AccountID, t.Rail, t.RoutingNumber, t.AccountNumber, t.BeneficiaryName, toCents(t.Amount), t.Currency, t.Memo,
+		t.Status, t.CreatedAt, t.SettlesAt).Scan(&t.ID)
+}
+
+func (s *PostgresStorage) GetExternalTransfers(ctx context.Context, accountID int) ([]*ExternalTransfer, error) {
+	return s.queryExternalTransfers(ctx, "select "+externalTransferColumns+" from external_transfer where account_id = $1 order by id desc", accountID)
+}
+
+func (s *PostgresStorage) GetDueExternalTransfers(ctx context.Context, now time.Time, limit int) ([]*ExternalTransfer, error) {
+	return s.queryExternalTransfers(ctx, "select "+externalTransferColumns+" from external_transfer where status = $1 and settles_at <= $2 order by settles_at limit $3",
+		ExternalPending, now, limit)
+}
+
+// ResolveExternalTransfer stores t's outcome if it's still in status from
+func (s *PostgresStorage) ResolveExternalTransfer(ctx context.Context, t *ExternalTransfer, from string) (bool, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, s.tagQuery("update external_transfer set status = $1, return_code = $2, resolved_at = $3 where id = $4 and status = $5"),
+		t.Status, t.ReturnCode, t.ResolvedAt, t.ID, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func scanBeneficiary(row interface{ Scan(...any) error }) (*Beneficiary, error) {
+	b := &Beneficiary{}
+	err := row.Scan(&b.ID, &b.AccountID, &b.Name, &b.AccountNumber, &b.CreatedAt)
+	return b, err
+}
+
+func (s *PostgresStorage) CreateBeneficiary(ctx context.Context, b *Beneficiary) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	return s.db.QueryRowContext(ctx, s.tagQuery(`insert into beneficiary (account_id, name, account_number, created_at)
+	values ($1, $2, $3, $4) returning id`),
+		b.AccountID, b.Name, b.AccountNumber, b.CreatedAt).Scan(&b.ID)
+}
+
+func (s *PostgresStorage) GetBeneficiary(ctx context.Context, id int) (*Beneficiary, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	b, err := scanBeneficiary(s.db.QueryRowContext(ctx, s.tagQuery("select id, account_id, name, account_number, created_at from beneficiary where id = $1"), id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", ErrBeneficiaryNotFound, id)
+	}
+	return b, err
+}
+
+func (s *PostgresStorage) GetBeneficiaries(ctx context.Context, accountID int) ([]*Beneficiary, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery("select id, account_id, name, account_number, created_at from beneficiary where account_id = $1 order by name, id"), accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	beneficiaries := []*Beneficiary{}
+	for rows.Next() {
+		b, err := scanBeneficiary(rows)
+		if err != nil {
+			return nil, err
+		}
+		beneficiaries = append(beneficiaries, b)
+	}
+	return beneficiaries, rows.Err()
+}
+
+func (s *PostgresStorage) DeleteBeneficiary(ctx context.Context, id int) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, s.tagQuery("delete from beneficiary where id = $1"), id)
+	return err
+}
+
+// Finished orders outlive their beneficiary, beneficiary_id is 0 then
+const standingOrderColumns = `id, account_id, coalesce(beneficiary_id, 0), amount, frequency, reference, start_date, end_date,
+	on_insufficient_funds, status, next_run_at, retry_at, attempts, last_error, created_at`
+
+func scanStandingOrder(row interface{ Scan(...any) error }) (*StandingOrder, error) {
+	o := &StandingOrder{}
+	var amount int64
+	err := row.Scan(&o.ID, &o.AccountID, &o.BeneficiaryID, &amount, &o.Frequency, &o.Reference, &o.StartDate, &o.EndDate,
+		&o.OnInsufficientFunds, &o.Status, &o.NextRunAt, &o.RetryAt, &o.Attempts, &o.LastError, &o.CreatedAt)
+	o.Amount = float64(amount) / 100
+	return o, err
+}
+
+func (s *PostgresStorage) queryStandingOrders(ctx context.Context, query string, args ...any) ([]*StandingOrder, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []*StandingOrder{}
+	for rows.Next() {
+		o, err := scanStandingOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	return orders, rows.Err()
+}
+
+func (s *PostgresStorage) CreateStandingOrder(ctx context.Context, o *StandingOrder) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	return s.db.QueryRowContext(ctx, s.tagQuery(`insert into standing_order
+	(account_id, beneficiary_id, amount, frequency, reference, start_date, end_date, on_insufficient_funds, status, next_run_at, created_at)
+	values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	returning id`),
+		o.AccountID, o.BeneficiaryID, toCents(o.Amount), o.Frequency, o.Reference, o.StartDate, o.EndDate, o.OnInsufficientFunds,
+		o.Status, o.NextRunAt, o.CreatedAt).Scan(&o.ID)
+}
+
+func (s *PostgresStorage) GetStandingOrder(ctx context.Context, id int) (*StandingOrder, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	o, err := scanStandingOrder(s.db.QueryRowContext(ctx, s.tagQuery("select "+standingOrderColumns+" from standing_order where id = $1"), id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", ErrStandingOrderNotFound, id)
+	}
+	return o, err
+}
+
+func (s *PostgresStorage) GetStandingOrders(ctx context.Context, accountID int) ([]*StandingOrder, error) {
+	return s.queryStandingOrders(ctx, "select "+standingOrderColumns+" from standing_order where account_id = $1 order by id", accountID)
+}
+
+func (s *PostgresStorage) GetDueStandingOrders(ctx context.Context, now time.Time, limit int) ([]*StandingOrder, error) {
+	return s.queryStandingOrders(ctx, "select "+standingOrderColumns+` from standing_order
+		where status = $1 and coalesce(retry_at, next_run_at) <= $2
+		order by coalesce(retry_at, next_run_at) limit $3`,
+		StandingOrderActive, now, limit)
+}
+
+func (s *PostgresStorage) ClaimStandingOrder(ctx context.Context, id int, now, leaseUntil time.Time) (bool, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, s.tagQuery(`update standing_order set retry_at = $1
+	where id = $2 and status = $3 and coalesce(retry_at, next_run_at) <= $4`),
+		leaseUntil, id, StandingOrderActive, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// UpdateStandingOrder stores o's status and schedule if it's still in status from
+func (s *PostgresStorage) UpdateStandingOrder(ctx context.Context, o *StandingOrder, from string) (bool, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, s.tagQuery(`update standing_order
+	set status = $1, next_run_at = $2, retry_at = $3, attempts = $4, last_error = $5
+	where id = $6 and status = $7`),
+		o.Status, o.NextRunAt, o.RetryAt, o.Attempts, o.LastError, o.ID, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// GetCategoryFlows totals the account's postings in [from, to) per entry category
+func (s *PostgresStorage) GetCategoryFlows(ctx context.Context, accountID int, from, to time.Time) ([]*CategoryFlow, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(`select coalesce(e.category, ''), count(*),
+		coalesce(sum(p.amount) filter (where p.amount > 0), 0), coalesce(-sum(p.amount) filter (where p.amount < 0), 0)
+	from postings p join ledger_entry e on e.id = p.entry_id
+	where p.account_id = $1 and e.created_at >= $2 and e.created_at < $3
+	group by 1 order by 4 desc, 3 desc, 1`), accountID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flows := []*CategoryFlow{}
+	for rows.Next() {
+		f := &CategoryFlow{}
+		if err := rows.Scan(&f.Category, &f.Count, &f.Inflow, &f.Outflow); err != nil {
+			return nil, err
+		}
+		flows = append(flows, f)
+	}
+	return flows, rows.Err()
+}
+
+// GetLargestTransactions is the account's biggest postings in [from, to) either way
+func (s *PostgresStorage) GetLargestTransactions(ctx context.Context, accountID int, from, to time.Time, limit int) ([]*AccountTransaction, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.tagQuery(`select e.id, e.kind, coalesce(e.reference::text, ''), coalesce(e.memo, ''), coalesce(e.category, ''), e.created_at, p.amount, p.currency
+	from postings p join ledger_entry e on e.id = p.entry_id
+	where p.account_id = $1 and e.created_at >= $2 and e.created_at < $3
+	order by abs(p.amount) desc, e.id desc
+	limit $4`), accountID, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := []*AccountTransaction{}
+	for rows.Next() {
+		var entry LedgerEntry
+		var amount int64
+		var currency string
+		if err := rows.Scan(&entry.ID, &entry.Kind, &entry.Reference, &entry.Memo, &entry.Category, &entry.CreatedAt, &amount, &currency); err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, newAccountTransaction(&entry, amount, currency))
+	}
+	return transactions, rows.Err()
+}
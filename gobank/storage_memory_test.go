@@ -0,0 +1,2754 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStorage is an in-memory Storage for tests. Methods a test needs but
+// that aren't implemented here fall through to the nil embedded interface and panic.
+type memoryStorage struct {
+	Storage
+
+	mu        sync.Mutex
+	nextID    int
+	accounts  map[int]*Account
+	transfers []memoryTransfer
+	audit     []*AuditEntry
+	fees      []*OverdraftFee
+	sweeps    []*SweepRule
+	sweptRuns []*SweepExecution
+	cashback  []*Cashback
+	resets    []*PasswordReset
+	verifies  []*EmailVerification
+	notified  map[int]bool
+	events    []*AccountEvent
+	subs      []*EventSubscription
+	entries   []*LedgerEntry
+	enriched  map[string]map[string]*TransferEnrichment
+	exports   map[string]*ExportDelivery
+	holds     []*LegalHold
+	ops       []*PendingOperation
+	eodRuns   map[string]*EODRun
+	snapshots []*LiabilitySnapshot
+	reserved  []*Reservation
+	pending   []*PendingTransfer
+	schedules []*FeeSchedule
+	charges   []*FeeCharge
+	jobs      []*TransferJob
+	pins      map[int]*AccountPIN
+	logins    map[int]*LoginFailures
+	idents    []*OIDCIdentity
+	apiKeys   []*APIKey
+	prefs     map[int]*AccountPreferences
+	sent      map[string]time.Time // statement claims by account and period
+	notices   []*Notification
+	loginIPs  map[int][]string
+	fraud     []*FraudDecision
+	mandates  []*Mandate
+	collects  []*MandateCollection
+	cheques   []*Cheque
+	cards     []*Card
+	external  []*ExternalTransfer
+	payees    []*Beneficiary
+	orders    []*StandingOrder
+	kyc       []*KYCSubmission
+	erasures  map[int]*ErasureRequest
+	aliases   []*memoryAlias
+	splitList []*SplitBill
+	shares    []*SplitShare
+	disputes  []*Dispute
+	scheduled []*ScheduledTransfer
+}
+
+type memoryTransfer struct {
+	fromAccountID int
+	toAccountID   int
+	amount        int64
+	conv          Conversion
+	kind          string
+	reference     string
+	createdAt     time.Time
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{accounts: map[int]*Account{}}
+}
+
+func (s *memoryStorage) CreateAccount(ctx context.Context, acc *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.accounts {
+		if acc.Email != "" && existing.Email == acc.Email {
+			return ErrEmailTaken
+		}
+	}
+
+	s.nextID++
+	acc.ID = s.nextID
+	if acc.LastActivityAt.IsZero() {
+		acc.LastActivityAt = time.Now().UTC()
+	}
+	stored := *acc
+	s.accounts[acc.ID] = &stored
+
+	// Fixtures start with a balance, book it like the ledger migration does
+	if acc.Balance != 0 {
+		s.entries = append(s.entries, &LedgerEntry{
+			ID:   int64(len(s.entries) + 1),
+			Kind: "opening",
+			Postings: []Posting{
+				{AccountID: acc.ID, Currency: acc.Currency, Amount: acc.Balance},
+				{LedgerAccount: LedgerOpeningBalances, Currency: acc.Currency, Amount: -acc.Balance},
+			},
+		})
+	}
+	return nil
+}
+
+func (s *memoryStorage) GetAccountbyID(ctx context.Context, id int) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
+	copied := *acc
+	return &copied, nil
+}
+
+func (s *memoryStorage) GetAccounts(ctx context.Context) ([]*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	accounts := []*Account{}
+	for id := 1; id <= s.nextID; id++ {
+		if acc, ok := s.accounts[id]; ok {
+			copied := *acc
+			accounts = append(accounts, &copied)
+		}
+	}
+	return accounts, nil
+}
+
+func (s *memoryStorage) SearchAccounts(ctx context.Context, search AccountSearch) ([]*Account, error) {
+	accounts, _ := s.GetAccounts(ctx)
+	return filterAccounts(accounts, search), nil
+}
+
+func (s *memoryStorage) UpdateAccount(ctx context.Context, acc *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.accounts[acc.ID]
+	if !ok {
+		return fmt.Errorf("account with id %d not found", acc.ID)
+	}
+	if stored.Version != acc.Version {
+		return fmt.Errorf("%w: account %d", ErrConflict, acc.ID)
+	}
+	stored.FirstName = acc.FirstName
+	stored.LastName = acc.LastName
+	stored.OverdraftLimit = acc.OverdraftLimit
+	stored.Nickname = acc.Nickname
+	stored.Metadata = maps.Clone(acc.Metadata)
+	stored.Version++
+	acc.Version++
+	return nil
+}
+
+func (s *memoryStorage) CloseAccount(ctx context.Context, id int, closedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[id]
+	if !ok {
+		return fmt.Errorf("account with id %d not found", id)
+	}
+	if acc.Balance != 0 {
+		return ErrBalanceNotZero
+	}
+	acc.Status = AccountClosed
+	acc.ClosedAt = &closedAt
+	return nil
+}
+
+func (s *memoryStorage) SetAccountStatus(ctx context.Context, id int, from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[id]
+	if !ok || acc.Status != from {
+		return fmt.Errorf("account %d is no longer %s", id, from)
+	}
+	acc.Status = to
+	return nil
+}
+
+func (s *memoryStorage) GetOverdrawnAccounts(ctx context.Context) ([]*Account, error) {
+	accounts, _ := s.GetAccounts(ctx)
+	overdrawn := []*Account{}
+	for _, acc := range accounts {
+		if acc.Balance < 0 {
+			overdrawn = append(overdrawn, acc)
+		}
+	}
+	return overdrawn, nil
+}
+
+func (s *memoryStorage) RecordOverdraftFee(ctx context.Context, fee *OverdraftFee, tx Transaction) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, f := range s.fees {
+		if f.AccountID == fee.AccountID && f.AccruedOn.Equal(fee.AccruedOn) {
+			return false, nil
+		}
+	}
+	s.fees = append(s.fees, fee)
+	return true, nil
+}
+
+func (s *memoryStorage) SaveFeeSchedule(ctx context.Context, fs *FeeSchedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fs.ID = len(s.schedules) + 1
+	copied := *fs
+	s.schedules = append(s.schedules, &copied)
+	return nil
+}
+
+func (s *memoryStorage) GetFeeSchedule(ctx context.Context, currency string) (*FeeSchedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.schedules) - 1; i >= 0; i-- {
+		if s.schedules[i].Currency == currency {
+			copied := *s.schedules[i]
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrFeeScheduleNotFound, currency)
+}
+
+func (s *memoryStorage) RecordFeeCharge(ctx context.Context, charge *FeeCharge, tx Transaction) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.charges {
+		if c.AccountID == charge.AccountID && c.Kind == charge.Kind && c.Period.Equal(charge.Period) {
+			return false, nil
+		}
+	}
+	s.charges = append(s.charges, charge)
+	return true, nil
+}
+
+func (s *memoryStorage) GetOverdraftFeeTotal(ctx context.Context, accountID int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var total int64
+	for _, f := range s.fees {
+		if f.AccountID == accountID {
+			total += f.Amount
+		}
+	}
+	return total, nil
+}
+
+func (s *memoryStorage) MergeAccounts(ctx context.Context, merge *AccountMerge, tx Transaction) error {
+	return s.apply(tx, func() {
+		for i, t := range s.transfers {
+			if t.fromAccountID == merge.MergedAccountID {
+				s.transfers[i].fromAccountID = merge.SurvivorAccountID
+				merge.TransfersRelinked++
+			}
+			if t.toAccountID == merge.MergedAccountID {
+				s.transfers[i].toAccountID = merge.SurvivorAccountID
+				merge.TransfersRelinked++
+			}
+		}
+		closedAt := merge.CreatedAt
+		s.accounts[merge.MergedAccountID].Status = AccountClosed
+		s.accounts[merge.MergedAccountID].MergedInto = merge.SurvivorAccountID
+		s.accounts[merge.MergedAccountID].ClosedAt = &closedAt
+	})
+}
+
+func (s *memoryStorage) GetAccountByNumber(ctx context.Context, number int64) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, acc := range s.accounts {
+		if acc.Number == number {
+			copied := *acc
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("account with number [%d] not found", number)
+}
+
+func (s *memoryStorage) BeginTransaction(ctx context.Context) (Transaction, error) {
+	return &memoryTx{store: s}, nil
+}
+
+func (s *memoryStorage) PostLedgerEntry(ctx context.Context, entry *LedgerEntry, tx Transaction) error {
+	if err := entry.validate(); err != nil {
+		return err
+	}
+
+	changes := entry.balanceChanges()
+	s.mu.Lock()
+	for _, c := range changes {
+		acc, ok := s.accounts[c.accountID]
+		if !ok {
+			s.mu.Unlock()
+			return fmt.Errorf("account with id %d not found", c.accountID)
+		}
+		if acc.Version != c.version {
+			s.mu.Unlock()
+			return fmt.Errorf("%w: account %d", ErrConflict, c.accountID)
+		}
+		// Like the account_balance_not_negative constraint
+		if acc.Balance+c.amount < 0 && acc.OverdraftLimit == 0 {
+			s.mu.Unlock()
+			return fmt.Errorf("%w: account %d has no overdraft", ErrInsufficientFunds, c.accountID)
+		}
+	}
+	s.mu.Unlock()
+
+	// Checked again at commit like the version in updateBalanceQuery's WHERE
+	if mtx, ok := tx.(*memoryTx); ok && mtx != nil {
+		mtx.checks = append(mtx.checks, func() error {
+			for _, c := range changes {
+				if s.accounts[c.accountID].Version != c.version {
+					return fmt.Errorf("%w: account %d", ErrConflict, c.accountID)
+				}
+			}
+			return nil
+		})
+	}
+
+	return s.apply(tx, func() {
+		for _, c := range changes {
+			s.accounts[c.accountID].Balance += c.amount
+			s.accounts[c.accountID].Version++
+		}
+		entry.ID = int64(len(s.entries) + 1)
+		s.entries = append(s.entries, entry)
+	})
+}
+
+func (s *memoryStorage) GetBalanceAt(ctx context.Context, accountID int, at time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var balance int64
+	for _, e := range s.entries {
+		if e.CreatedAt.After(at) {
+			continue
+		}
+		for _, p := range e.Postings {
+			if p.AccountID == accountID {
+				balance += p.Amount
+			}
+		}
+	}
+	return balance, nil
+}
+
+func (s *memoryStorage) GetAccountTransactions(ctx context.Context, accountID int, filter TransactionFilter) ([]*AccountTransaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transactions := []*AccountTransaction{}
+	for i := len(s.entries) - 1; i >= 0 && len(transactions) < filter.Limit; i-- {
+		e := s.entries[i]
+		if (filter.Category != "" && !strings.EqualFold(e.Category, filter.Category)) || (filter.Before != 0 && e.ID >= filter.Before) {
+			continue
+		}
+		for _, p := range e.Postings {
+			if p.AccountID == accountID {
+				transactions = append(transactions, newAccountTransaction(e, p.Amount, p.Currency))
+			}
+		}
+	}
+	return transactions, nil
+}
+
+func (s *memoryStorage) GetCategoryFlows(ctx context.Context, accountID int, from, to time.Time) ([]*CategoryFlow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byCategory := map[string]*CategoryFlow{}
+	for _, e := range s.entries {
+		if e.CreatedAt.Before(from) || !e.CreatedAt.Before(to) {
+			continue
+		}
+		for _, p := range e.Postings {
+			if p.AccountID != accountID {
+				continue
+			}
+			f, ok := byCategory[e.Category]
+			if !ok {
+				f = &CategoryFlow{Category: e.Category}
+				byCategory[e.Category] = f
+			}
+			f.Count++
+			if p.Amount > 0 {
+				f.Inflow += p.Amount
+			} else {
+				f.Outflow -= p.Amount
+			}
+		}
+	}
+
+	flows := make([]*CategoryFlow, 0, len(byCategory))
+	for _, f := range byCategory {
+		flows = append(flows, f)
+	}
+	sort.Slice(flows, func(i, j int) bool {
+		if flows[i].Outflow != flows[j].Outflow {
+			return flows[i].Outflow > flows[j].Outflow
+		}
+		if flows[i].Inflow != flows[j].Inflow {
+			return flows[i].Inflow > flows[j].Inflow
+		}
+		return flows[i].Category < flows[j].Category
+	})
+	return flows, nil
+}
+
+func (s *memoryStorage) GetLargestTransactions(ctx context.Context, accountID int, from, to time.Time, limit int) ([]*AccountTransaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transactions := []*AccountTransaction{}
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		e := s.entries[i]
+		if e.CreatedAt.Before(from) || !e.CreatedAt.Before(to) {
+			continue
+		}
+		for _, p := range e.Postings {
+			if p.AccountID == accountID {
+				transactions = append(transactions, newAccountTransaction(e, p.Amount, p.Currency))
+			}
+		}
+	}
+	sort.SliceStable(transactions, func(i, j int) bool { return transactions[i].Amount > transactions[j].Amount })
+	if len(transactions) > limit {
+		transactions = transactions[:limit]
+	}
+	return transactions, nil
+}
+
+// reconcile mirrors PostgresStorage.ReconcileLedger
+func (s *memoryStorage) reconcile() []*LedgerDiscrepancy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	discrepancies := []*LedgerDiscrepancy{}
+	posted := map[int]int64{}
+	for _, e := range s.entries {
+		if err := e.validate(); err != nil {
+			discrepancies = append(discrepancies, &LedgerDiscrepancy{Type: DiscrepancyUnbalancedEntry, EntryID: e.ID})
+		}
+		for _, p := range e.Postings {
+			posted[p.AccountID] += p.Amount
+		}
+	}
+	for id, acc := range s.accounts {
+		if acc.Balance != posted[id] {
+			discrepancies = append(discrepancies, &LedgerDiscrepancy{Type: DiscrepancyBalanceMismatch, AccountID: id, Expected: posted[id], Actual: acc.Balance})
+		}
+	}
+	return discrepancies
+}
+
+func (s *memoryStorage) RecordTransfer(ctx context.Context, fromAccountID, toAccountID int, conv Conversion, tx Transaction) error {
+	return s.apply(tx, func() {
+		s.transfers = append(s.transfers, memoryTransfer{
+			fromAccountID: fromAccountID,
+			toAccountID:   toAccountID,
+			amount:        toCents(conv.Debit),
+			conv:          conv,
+			kind:          transferKind(ctx),
+			reference:     transferReference(ctx),
+			createdAt:     time.Now().UTC(),
+		})
+	})
+}
+
+func (s *memoryStorage) GetTransferReceipt(ctx context.Context, reference string) (*TransferReceipt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.transfers {
+		if t.reference == reference {
+			return newReceipt(reference, s.accounts[t.fromAccountID], s.accounts[t.toAccountID], t.conv, t.kind, t.createdAt), nil
+		}
+	}
+	return nil, ErrTransferNotFound
+}
+
+func (s *memoryStorage) RecordAudit(ctx context.Context, entry *AuditEntry, tx Transaction) error {
+	return s.apply(tx, func() {
+		s.audit = append(s.audit, entry)
+	})
+}
+
+func (s *memoryStorage) GetDailyTransferUsage(ctx context.Context, accountID int, day time.Time) (*TransferUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := &TransferUsage{}
+	for _, t := range s.transfers {
+		if t.fromAccountID == accountID && t.kind == TransferKindTransfer && !t.createdAt.Before(day) && t.createdAt.Before(day.AddDate(0, 0, 1)) {
+			usage.Amount += t.amount
+			usage.Count++
+		}
+	}
+	return usage, nil
+}
+
+func (s *memoryStorage) GetDueSweepRules(ctx context.Context, now time.Time, limit int) ([]*SweepRule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	due := []*SweepRule{}
+	for _, rule := range s.sweeps {
+		if rule.Status == ScheduledActive && !rule.NextRunAt.After(now) && len(due) < limit {
+			copied := *rule
+			due = append(due, &copied)
+		}
+	}
+	return due, nil
+}
+
+func (s *memoryStorage) AdvanceSweepRule(ctx context.Context, id int, from, to time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rule := range s.sweeps {
+		if rule.ID == id && rule.NextRunAt.Equal(from) {
+			rule.NextRunAt = to
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStorage) RecordSweepExecution(ctx context.Context, execution *SweepExecution) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	execution.ID = len(s.sweptRuns) + 1
+	s.sweptRuns = append(s.sweptRuns, execution)
+	return nil
+}
+
+func (s *memoryStorage) RecordCashback(ctx context.Context, c *Cashback, tx Transaction) error {
+	return s.apply(tx, func() {
+		s.cashback = append(s.cashback, c)
+	})
+}
+
+func (s *memoryStorage) GetCashbackTotal(ctx context.Context, accountID int, since time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var total int64
+	for _, c := range s.cashback {
+		if c.AccountID == accountID && !c.CreatedAt.Before(since) {
+			total += c.Amount
+		}
+	}
+	return total, nil
+}
+
+func (s *memoryStorage) CreatePasswordReset(ctx context.Context, reset *PasswordReset) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.resets {
+		if r.AccountID == reset.AccountID && r.UsedAt == nil {
+			usedAt := reset.CreatedAt
+			r.UsedAt = &usedAt
+		}
+	}
+	reset.ID = len(s.resets) + 1
+	stored := *reset
+	s.resets = append(s.resets, &stored)
+	return nil
+}
+
+func (s *memoryStorage) GetPasswordReset(ctx context.Context, tokenHash string) (*PasswordReset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.resets {
+		if r.TokenHash == tokenHash {
+			copied := *r
+			return &copied, nil
+		}
+	}
+	return nil, ErrInvalidResetToken
+}
+
+func (s *memoryStorage) ResetPassword(ctx context.Context, resetID int, encryptedPassword string, usedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.resets {
+		if r.ID == resetID && r.UsedAt == nil && usedAt.Before(r.ExpiresAt) {
+			r.UsedAt = &usedAt
+			s.accounts[r.AccountID].EncryptedPassword = encryptedPassword
+			return nil
+		}
+	}
+	return ErrInvalidResetToken
+}
+
+func (s *memoryStorage) RehashPassword(ctx context.Context, id int, oldHash, newHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if acc, ok := s.accounts[id]; ok && acc.EncryptedPassword == oldHash {
+		acc.EncryptedPassword = newHash
+	}
+	return nil
+}
+
+func (s *memoryStorage) SavePIN(ctx context.Context, pin *AccountPIN) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pins == nil {
+		s.pins = map[int]*AccountPIN{}
+	}
+	stored := *pin
+	stored.FailedAttempts, stored.LockedUntil = 0, nil
+	s.pins[pin.AccountID] = &stored
+	return nil
+}
+
+func (s *memoryStorage) GetPIN(ctx context.Context, accountID int) (*AccountPIN, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pin, ok := s.pins[accountID]
+	if !ok {
+		return nil, fmt.Errorf("%w: account %d", ErrPINNotSet, accountID)
+	}
+	copied := *pin
+	return &copied, nil
+}
+
+func (s *memoryStorage) RecordPINFailure(ctx context.Context, accountID int, maxAttempts int, lockUntil time.Time) (*AccountPIN, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pin, ok := s.pins[accountID]
+	if !ok {
+		return nil, fmt.Errorf("%w: account %d", ErrPINNotSet, accountID)
+	}
+	if pin.FailedAttempts++; pin.FailedAttempts >= maxAttempts {
+		pin.FailedAttempts, pin.LockedUntil = 0, &lockUntil
+	}
+	copied := *pin
+	return &copied, nil
+}
+
+func (s *memoryStorage) ResetPINFailures(ctx context.Context, accountID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if pin, ok := s.pins[accountID]; ok {
+		pin.FailedAttempts = 0
+	}
+	return nil
+}
+
+func (s *memoryStorage) GetLoginFailures(ctx context.Context, accountID int) (*LoginFailures, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f, ok := s.logins[accountID]; ok {
+		copied := *f
+		return &copied, nil
+	}
+	return &LoginFailures{AccountID: accountID}, nil
+}
+
+func (s *memoryStorage) RecordLoginFailure(ctx context.Context, accountID int, maxAttempts int, lockUntil, now time.Time) (*LoginFailures, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.logins == nil {
+		s.logins = map[int]*LoginFailures{}
+	}
+	f, ok := s.logins[accountID]
+	if !ok {
+		f = &LoginFailures{AccountID: accountID}
+		s.logins[accountID] = f
+	}
+	if f.FailedAttempts++; f.FailedAttempts >= maxAttempts {
+		f.FailedAttempts, f.LockedUntil = 0, &lockUntil
+	}
+	f.UpdatedAt = now
+	copied := *f
+	return &copied, nil
+}
+
+func (s *memoryStorage) ClearLoginFailures(ctx context.Context, accountID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.logins, accountID)
+	return nil
+}
+
+func (s *memoryStorage) GetAccountByEmail(ctx context.Context, email string) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, acc := range s.accounts {
+		if acc.Email == email {
+			copied := *acc
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: email %s", ErrAccountNotFound, email)
+}
+
+func (s *memoryStorage) GetOIDCIdentity(ctx context.Context, issuer, subject string) (*OIDCIdentity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, identity := range s.idents {
+		if identity.Issuer == issuer && identity.Subject == subject {
+			copied := *identity
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s at %s", ErrIdentityNotLinked, subject, issuer)
+}
+
+func (s *memoryStorage) CreateOIDCIdentity(ctx context.Context, identity *OIDCIdentity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	identity.ID = len(s.idents) + 1
+	stored := *identity
+	s.idents = append(s.idents, &stored)
+	return nil
+}
+
+func (s *memoryStorage) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key.ID = len(s.apiKeys) + 1
+	stored := *key
+	s.apiKeys = append(s.apiKeys, &stored)
+	return nil
+}
+
+func (s *memoryStorage) GetAPIKeyByHash(ctx context.Context, hash string) (*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, k := range s.apiKeys {
+		if k.KeyHash == hash {
+			copied := *k
+			return &copied, nil
+		}
+	}
+	return nil, ErrAPIKeyNotFound
+}
+
+func (s *memoryStorage) ListAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := []*APIKey{}
+	for _, k := range s.apiKeys {
+		copied := *k
+		keys = append(keys, &copied)
+	}
+	return keys, nil
+}
+
+func (s *memoryStorage) RevokeAPIKey(ctx context.Context, id int, at time.Time) (*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, k := range s.apiKeys {
+		if k.ID == id && k.RevokedAt == nil {
+			k.RevokedAt = &at
+			copied := *k
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %d", ErrAPIKeyNotFound, id)
+}
+
+func (s *memoryStorage) TouchAPIKey(ctx context.Context, id int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, k := range s.apiKeys {
+		if k.ID == id {
+			k.LastUsedAt = &at
+		}
+	}
+	return nil
+}
+
+func (s *memoryStorage) GetPreferences(ctx context.Context, accountID int) (*AccountPreferences, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if prefs, ok := s.prefs[accountID]; ok {
+		copied := *prefs
+		return &copied, nil
+	}
+	return defaultPreferences(accountID), nil
+}
+
+func (s *memoryStorage) SavePreferences(ctx context.Context, prefs *AccountPreferences) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.prefs == nil {
+		s.prefs = map[int]*AccountPreferences{}
+	}
+	stored := *prefs
+	s.prefs[prefs.AccountID] = &stored
+	return nil
+}
+
+func (s *memoryStorage) GetStatementOptIns(ctx context.Context) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := []int{}
+	for id, prefs := range s.prefs {
+		if prefs.StatementEmail {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func statementKey(accountID int, period time.Time) string {
+	return fmt.Sprintf("%d/%s", accountID, period.Format("2006-01"))
+}
+
+func (s *memoryStorage) ClaimStatement(ctx context.Context, accountID int, period, at time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sent == nil {
+		s.sent = map[string]time.Time{}
+	}
+	key := statementKey(accountID, period)
+	if _, ok := s.sent[key]; ok {
+		return false, nil
+	}
+	s.sent[key] = at
+	return true, nil
+}
+
+func (s *memoryStorage) ReleaseStatement(ctx context.Context, accountID int, period time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sent, statementKey(accountID, period))
+	return nil
+}
+
+func (s *memoryStorage) CreateNotification(ctx context.Context, n *Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n.ID = int64(len(s.notices) + 1)
+	stored := *n
+	s.notices = append(s.notices, &stored)
+	return nil
+}
+
+func (s *memoryStorage) GetNotifications(ctx context.Context, accountID int, unreadOnly bool, limit int) ([]*Notification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	notifications := []*Notification{}
+	for i := len(s.notices) - 1; i >= 0 && len(notifications) < limit; i-- {
+		n := s.notices[i]
+		if n.AccountID == accountID && (!unreadOnly || n.ReadAt == nil) {
+			copied := *n
+			notifications = append(notifications, &copied)
+		}
+	}
+	return notifications, nil
+}
+
+func (s *memoryStorage) MarkNotificationsRead(ctx context.Context, accountID int, upTo int64, at time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var marked int64
+	for _, n := range s.notices {
+		if n.AccountID == accountID && n.ReadAt == nil && (upTo == 0 || n.ID <= upTo) {
+			n.ReadAt = &at
+			marked++
+		}
+	}
+	return marked, nil
+}
+
+func (s *memoryStorage) RecordLoginIP(ctx context.Context, accountID int, ip string, at time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.loginIPs == nil {
+		s.loginIPs = map[int][]string{}
+	}
+	known := s.loginIPs[accountID]
+	if slices.Contains(known, ip) {
+		return false, nil
+	}
+	s.loginIPs[accountID] = append(known, ip)
+	return len(known) > 0, nil
+}
+
+func (s *memoryStorage) GetTransferHistory(ctx context.Context, fromAccountID, toAccountID int, since time.Time) (*TransferHistory, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := &TransferHistory{}
+	var total int64
+	for _, t := range s.transfers {
+		if t.fromAccountID != fromAccountID || t.kind != TransferKindTransfer {
+			continue
+		}
+		h.Count++
+		total += t.amount
+		if !t.createdAt.Before(since) {
+			h.Recent++
+		}
+		if t.toAccountID == toAccountID {
+			h.PaidBefore = true
+		}
+	}
+	if h.Count > 0 {
+		h.Average = total / int64(h.Count)
+	}
+	return h, nil
+}
+
+func (s *memoryStorage) CreateFraudDecision(ctx context.Context, d *FraudDecision) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d.ID = len(s.fraud) + 1
+	stored := *d
+	stored.Rules = slices.Clone(d.Rules)
+	s.fraud = append(s.fraud, &stored)
+	return nil
+}
+
+func (s *memoryStorage) GetFraudDecisions(ctx context.Context, action string, limit int) ([]*FraudDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	decisions := []*FraudDecision{}
+	for i := len(s.fraud) - 1; i >= 0 && len(decisions) < limit; i-- {
+		if action == "" || s.fraud[i].Action == action {
+			copied := *s.fraud[i]
+			decisions = append(decisions, &copied)
+		}
+	}
+	return decisions, nil
+}
+
+func (s *memoryStorage) GetAccountCounts(ctx context.Context) (*AccountCounts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := &AccountCounts{}
+	for _, acc := range s.accounts {
+		c.Total++
+		switch acc.Status {
+		case AccountActive, "":
+			c.Active++
+		case AccountFrozen:
+			c.Frozen++
+		case AccountDormant:
+			c.Dormant++
+		case AccountClosed:
+			c.Closed++
+		}
+	}
+	return c, nil
+}
+
+func (s *memoryStorage) GetBalanceTotals(ctx context.Context) ([]*BalanceTotal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	accounts := make([]*Account, 0, len(s.accounts))
+	for _, acc := range s.accounts {
+		accounts = append(accounts, acc)
+	}
+	return balanceTotals(accounts), nil
+}
+
+func (s *memoryStorage) GetTransferVolume(ctx context.Context, from, to time.Time) ([]*TransferVolume, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byKey := map[string]*TransferVolume{}
+	for _, t := range s.transfers {
+		if t.kind != TransferKindTransfer || t.createdAt.Before(from) || !t.createdAt.Before(to) {
+			continue
+		}
+		day := t.createdAt.UTC().Format("2006-01-02")
+		v, ok := byKey[day+"/"+t.conv.FromCurrency]
+		if !ok {
+			v = &TransferVolume{Day: day, Currency: t.conv.FromCurrency}
+			byKey[day+"/"+t.conv.FromCurrency] = v
+		}
+		v.Count++
+		v.Amount += t.amount
+	}
+
+	volume := make([]*TransferVolume, 0, len(byKey))
+	for _, v := range byKey {
+		volume = append(volume, v)
+	}
+	sort.Slice(volume, func(i, j int) bool {
+		if volume[i].Day != volume[j].Day {
+			return volume[i].Day < volume[j].Day
+		}
+		return volume[i].Currency < volume[j].Currency
+	})
+	return volume, nil
+}
+
+func (s *memoryStorage) GetTopAccounts(ctx context.Context, since time.Time, limit int) ([]*AccountActivity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byID := map[int]*AccountActivity{}
+	add := func(id int, amount int64) {
+		a, ok := byID[id]
+		if !ok {
+			acc := s.accounts[id]
+			a = &AccountActivity{AccountID: id, Number: acc.Number, Currency: acc.Currency}
+			byID[id] = a
+		}
+		a.Transfers++
+		a.Amount += amount
+	}
+	for _, t := range s.transfers {
+		if t.kind == TransferKindTransfer && !t.createdAt.Before(since) {
+			add(t.fromAccountID, t.amount)
+			add(t.toAccountID, toCents(t.conv.Credit))
+		}
+	}
+
+	accounts := make([]*AccountActivity, 0, len(byID))
+	for _, a := range byID {
+		accounts = append(accounts, a)
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		if accounts[i].Transfers != accounts[j].Transfers {
+			return accounts[i].Transfers > accounts[j].Transfers
+		}
+		if accounts[i].Amount != accounts[j].Amount {
+			return accounts[i].Amount > accounts[j].Amount
+		}
+		return accounts[i].AccountID < accounts[j].AccountID
+	})
+	if len(accounts) > limit {
+		accounts = accounts[:limit]
+	}
+	return accounts, nil
+}
+
+func (s *memoryStorage) ExportDump(ctx context.Context, w dumpWriter) (*DumpSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]int, 0, len(s.accounts))
+	for id := range s.accounts {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		if err := w.WriteAccount(s.accounts[id]); err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range s.entries {
+		if err := w.WriteEntry(entry); err != nil {
+			return nil, err
+		}
+	}
+	return &DumpSummary{Accounts: len(ids), Entries: len(s.entries)}, nil
+}
+
+func (s *memoryStorage) CreateMandate(ctx context.Context, m *Mandate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m.ID = len(s.mandates) + 1
+	copied := *m
+	s.mandates = append(s.mandates, &copied)
+	return nil
+}
+
+func (s *memoryStorage) GetMandate(ctx context.Context, id int) (*Mandate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.mandates {
+		if m.ID == id {
+			copied := *m
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %d", ErrMandateNotFound, id)
+}
+
+func (s *memoryStorage) GetMandates(ctx context.Context, accountID int) ([]*Mandate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mandates := []*Mandate{}
+	for _, m := range s.mandates {
+		if m.party(accountID) {
+			copied := *m
+			mandates = append(mandates, &copied)
+		}
+	}
+	return mandates, nil
+}
+
+func (s *memoryStorage) UpdateMandateStatus(ctx context.Context, m *Mandate, from string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, stored := range s.mandates {
+		if stored.ID == m.ID && stored.Status == from {
+			copied := *m
+			s.mandates[i] = &copied
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStorage) CreateMandateCollection(ctx context.Context, c *MandateCollection) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c.ID = len(s.collects) + 1
+	copied := *c
+	s.collects = append(s.collects, &copied)
+	return nil
+}
+
+func (s *memoryStorage) GetMandateCollections(ctx context.Context, mandateID int) ([]*MandateCollection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	collections := []*MandateCollection{}
+	for _, c := range s.collects {
+		if c.MandateID == mandateID {
+			copied := *c
+			collections = append(collections, &copied)
+		}
+	}
+	return collections, nil
+}
+
+func (s *memoryStorage) GetDueMandateCollections(ctx context.Context, now time.Time, limit int) ([]*MandateCollection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	due := []*MandateCollection{}
+	for _, c := range s.collects {
+		if c.Status == CollectionPending && !mandateCollectionAt(c).After(now) && len(due) < limit {
+			copied := *c
+			due = append(due, &copied)
+		}
+	}
+	return due, nil
+}
+
+func (s *memoryStorage) ClaimMandateCollection(ctx context.Context, id int, now, leaseUntil time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.collects {
+		if c.ID == id && c.Status == CollectionPending && !mandateCollectionAt(c).After(now) {
+			c.RetryAt = &leaseUntil
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStorage) UpdateMandateCollection(ctx context.Context, c *MandateCollection) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, stored := range s.collects {
+		if stored.ID == c.ID {
+			copied := *c
+			s.collects[i] = &copied
+		}
+	}
+	return nil
+}
+
+func mandateCollectionAt(c *MandateCollection) time.Time {
+	if c.RetryAt != nil {
+		return *c.RetryAt
+	}
+	return c.CollectAt
+}
+
+func (s *memoryStorage) CreateCheque(ctx context.Context, c *Cheque) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c.ID = len(s.cheques) + 1
+	copied := *c
+	s.cheques = append(s.cheques, &copied)
+	return nil
+}
+
+func (s *memoryStorage) GetCheque(ctx context.Context, id int) (*Cheque, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.cheques {
+		if c.ID == id {
+			copied := *c
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %d", ErrChequeNotFound, id)
+}
+
+func (s *memoryStorage) GetCheques(ctx context.Context, accountID int) ([]*Cheque, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cheques := []*Cheque{}
+	for i := len(s.cheques) - 1; i >= 0; i-- {
+		if s.cheques[i].AccountID == accountID {
+			copied := *s.cheques[i]
+			cheques = append(cheques, &copied)
+		}
+	}
+	return cheques, nil
+}
+
+func (s *memoryStorage) GetDueCheques(ctx context.Context, now time.Time, limit int) ([]*Cheque, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	due := []*Cheque{}
+	for _, c := range s.cheques {
+		if c.Status == ChequePending && !c.ClearsAt.After(now) && len(due) < limit {
+			copied := *c
+			due = append(due, &copied)
+		}
+	}
+	return due, nil
+}
+
+func (s *memoryStorage) ResolveCheque(ctx context.Context, c *Cheque, from string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, stored := range s.cheques {
+		if stored.ID == c.ID && stored.Status == from {
+			stored.Status, stored.ResolvedAt, stored.BounceReason = c.Status, c.ResolvedAt, c.BounceReason
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStorage) CreateCard(ctx context.Context, card *Card) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	card.ID = len(s.cards) + 1
+	copied := *card
+	s.cards = append(s.cards, &copied)
+	return nil
+}
+
+func (s *memoryStorage) GetCard(ctx context.Context, id int) (*Card, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, card := range s.cards {
+		if card.ID == id {
+			copied := *card
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %d", ErrCardNotFound, id)
+}
+
+func (s *memoryStorage) GetCards(ctx context.Context, accountID int) ([]*Card, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cards := []*Card{}
+	for _, card := range s.cards {
+		if card.AccountID == accountID {
+			copied := *card
+			cards = append(cards, &copied)
+		}
+	}
+	return cards, nil
+}
+
+func (s *memoryStorage) SetCardStatus(ctx context.Context, id int, from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, card := range s.cards {
+		if card.ID == id && card.Status == from {
+			card.Status = to
+			return nil
+		}
+	}
+	return fmt.Errorf("card %d is no longer %s", id, from)
+}
+
+func (s *memoryStorage) UpdateCardLimits(ctx context.Context, card *Card) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, stored := range s.cards {
+		if stored.ID == card.ID {
+			stored.TransactionLimit, stored.DailyLimit = card.TransactionLimit, card.DailyLimit
+		}
+	}
+	return nil
+}
+
+func (s *memoryStorage) CreateExternalTransfer(ctx context.Context, t *ExternalTransfer, tx Transaction) error {
+	return s.apply(tx, func() {
+		t.ID = len(s.external) + 1
+		copied := *t
+		s.external = append(s.external, &copied)
+	})
+}
+
+func (s *memoryStorage) GetExternalTransfers(ctx context.Context, accountID int) ([]*ExternalTransfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transfers := []*ExternalTransfer{}
+	for i := len(s.external) - 1; i >= 0; i-- {
+		if s.external[i].AccountID == accountID {
+			copied := *s.external[i]
+			transfers = append(transfers, &copied)
+		}
+	}
+	return transfers, nil
+}
+
+func (s *memoryStorage) GetDueExternalTransfers(ctx context.Context, now time.Time, limit int) ([]*ExternalTransfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	due := []*ExternalTransfer{}
+	for _, t := range s.external {
+		if t.Status == ExternalPending && !t.SettlesAt.After(now) && len(due) < limit {
+			copied := *t
+			due = append(due, &copied)
+		}
+	}
+	return due, nil
+}
+
+func (s *memoryStorage) ResolveExternalTransfer(ctx context.Context, t *ExternalTransfer, from string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, stored := range s.external {
+		if stored.ID == t.ID && stored.Status == from {
+			stored.Status, stored.ReturnCode, stored.ResolvedAt = t.Status, t.ReturnCode, t.ResolvedAt
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStorage) CreateBeneficiary(ctx context.Context, b *Beneficiary) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b.ID = 1
+	if len(s.payees) > 0 {
+		b.ID = s.payees[len(s.payees)-1].ID + 1
+	}
+	copied := *b
+	s.payees = append(s.payees, &copied)
+	return nil
+}
+
+func (s *memoryStorage) GetBeneficiary(ctx context.Context, id int) (*Beneficiary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, b := range s.payees {
+		if b.ID == id {
+			copied := *b
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %d", ErrBeneficiaryNotFound, id)
+}
+
+func (s *memoryStorage) GetBeneficiaries(ctx context.Context, accountID int) ([]*Beneficiary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	beneficiaries := []*Beneficiary{}
+	for _, b := range s.payees {
+		if b.AccountID == accountID {
+			copied := *b
+			beneficiaries = append(beneficiaries, &copied)
+		}
+	}
+	return beneficiaries, nil
+}
+
+func (s *memoryStorage) DeleteBeneficiary(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, b := range s.payees {
+		if b.ID == id {
+			s.payees = append(s.payees[:i], s.payees[i+1:]...)
+			break
+		}
+	}
+	for _, o := range s.orders {
+		if o.BeneficiaryID == id {
+			o.BeneficiaryID = 0
+		}
+	}
+	return nil
+}
+
+func (s *memoryStorage) CreateStandingOrder(ctx context.Context, o *StandingOrder) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o.ID = len(s.orders) + 1
+	copied := *o
+	s.orders = append(s.orders, &copied)
+	return nil
+}
+
+func (s *memoryStorage) GetStandingOrder(ctx context.Context, id int) (*StandingOrder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, o := range s.orders {
+		if o.ID == id {
+			copied := *o
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %d", ErrStandingOrderNotFound, id)
+}
+
+func (s *memoryStorage) GetStandingOrders(ctx context.Context, accountID int) ([]*StandingOrder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	orders := []*StandingOrder{}
+	for _, o := range s.orders {
+		if o.AccountID == accountID {
+			copied := *o
+			orders = append(orders, &copied)
+		}
+	}
+	return orders, nil
+}
+
+func (s *memoryStorage) GetDueStandingOrders(ctx context.Context, now time.Time, limit int) ([]*StandingOrder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	due := []*StandingOrder{}
+	for _, o := range s.orders {
+		runAt := o.NextRunAt
+		if o.RetryAt != nil {
+			runAt = *o.RetryAt
+		}
+		if o.Status == StandingOrderActive && !runAt.After(now) && len(due) < limit {
+			copied := *o
+			due = append(due, &copied)
+		}
+	}
+	return due, nil
+}
+
+func (s *memoryStorage) ClaimStandingOrder(ctx context.Context, id int, now, leaseUntil time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, o := range s.orders {
+		runAt := o.NextRunAt
+		if o.RetryAt != nil {
+			runAt = *o.RetryAt
+		}
+		if o.ID == id && o.Status == StandingOrderActive && !runAt.After(now) {
+			o.RetryAt = &leaseUntil
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStorage) UpdateStandingOrder(ctx context.Context, o *StandingOrder, from string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, stored := range s.orders {
+		if stored.ID == o.ID && stored.Status == from {
+			stored.Status, stored.NextRunAt, stored.RetryAt, stored.Attempts, stored.LastError = o.Status, o.NextRunAt, o.RetryAt, o.Attempts, o.LastError
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStorage) CreateEmailVerification(ctx context.Context, v *EmailVerification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v.ID = len(s.verifies) + 1
+	stored := *v
+	s.verifies = append(s.verifies, &stored)
+	return nil
+}
+
+func (s *memoryStorage) VerifyEmail(ctx context.Context, tokenHash string, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, v := range s.verifies {
+		if v.TokenHash == tokenHash && v.UsedAt == nil && now.Before(v.ExpiresAt) {
+			v.UsedAt = &now
+			s.accounts[v.AccountID].EmailVerified = true
+			return v.AccountID, nil
+		}
+	}
+	return 0, ErrInvalidVerificationToken
+}
+
+func (s *memoryStorage) TouchAccountActivity(ctx context.Context, id int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if acc, ok := s.accounts[id]; ok && at.After(acc.LastActivityAt) {
+		acc.LastActivityAt = at
+	}
+	delete(s.notified, id)
+	return nil
+}
+
+func (s *memoryStorage) GetInactiveAccounts(ctx context.Context, before time.Time, skipNotified bool, limit int) ([]*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inactive := []*Account{}
+	for _, acc := range s.accounts {
+		if acc.Status == AccountActive && acc.LastActivityAt.Before(before) && !(skipNotified && s.notified[acc.ID]) {
+			copied := *acc
+			inactive = append(inactive, &copied)
+		}
+	}
+	return inactive, nil
+}
+
+func (s *memoryStorage) MarkDormancyNotified(ctx context.Context, id int, at time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.notified == nil {
+		s.notified = map[int]bool{}
+	}
+	if s.notified[id] {
+		return false, nil
+	}
+	s.notified[id] = true
+	return true, nil
+}
+
+// apply runs op immediately, or queues it until commit when inside a transaction
+func (s *memoryStorage) apply(tx Transaction, op func()) error {
+	if mtx, ok := tx.(*memoryTx); ok && mtx != nil {
+		mtx.ops = append(mtx.ops, op)
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	op()
+	return nil
+}
+
+type memoryTx struct {
+	store  *memoryStorage
+	checks []func() error
+	ops    []func()
+	done   bool
+}
+
+func (tx *memoryTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return nil, fmt.Errorf("memoryTx does not support raw queries")
+}
+
+func (tx *memoryTx) Commit() error {
+	if tx.done {
+		return fmt.Errorf("transaction already finished")
+	}
+	tx.done = true
+
+	tx.store.mu.Lock()
+	defer tx.store.mu.Unlock()
+	for _, check := range tx.checks {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	for _, op := range tx.ops {
+		op()
+	}
+	return nil
+}
+
+func (tx *memoryTx) Rollback() error {
+	tx.done = true
+	tx.checks, tx.ops = nil, nil
+	return nil
+}
+
+func (s *memoryStorage) RecordAccountEvent(ctx context.Context, event *AccountEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	event.ID = int64(len(s.events) + 1)
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *memoryStorage) GetAccountEvents(ctx context.Context, accountID int, after int64, limit int) ([]*AccountEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := []*AccountEvent{}
+	for _, e := range s.events {
+		if e.AccountID == accountID && e.ID > after && len(events) < limit {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (s *memoryStorage) GetLatestAccountEventID(ctx context.Context, accountID int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var id int64
+	for _, e := range s.events {
+		if e.AccountID == accountID {
+			id = max(id, e.ID)
+		}
+	}
+	return id, nil
+}
+
+func (s *memoryStorage) CreateEventSubscription(ctx context.Context, sub *EventSubscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.events {
+		if e.AccountID == sub.AccountID {
+			sub.Cursor = e.ID
+		}
+	}
+	sub.ID = len(s.subs) + 1
+	stored := *sub
+	s.subs = append(s.subs, &stored)
+	return nil
+}
+
+func (s *memoryStorage) GetEventSubscriptions(ctx context.Context, accountID int) ([]*EventSubscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subs := []*EventSubscription{}
+	for _, sub := range s.subs {
+		if sub.AccountID == accountID {
+			copied := *sub
+			subs = append(subs, &copied)
+		}
+	}
+	return subs, nil
+}
+
+func (s *memoryStorage) GetActiveEventSubscriptions(ctx context.Context, limit int) ([]*EventSubscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subs := []*EventSubscription{}
+	for _, sub := range s.subs {
+		if sub.Status == ScheduledActive && len(subs) < limit {
+			copied := *sub
+			subs = append(subs, &copied)
+		}
+	}
+	return subs, nil
+}
+
+func (s *memoryStorage) CancelEventSubscription(ctx context.Context, accountID, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sub := range s.subs {
+		if sub.ID == id && sub.AccountID == accountID && sub.Status == ScheduledActive {
+			sub.Status = ScheduledCancelled
+			return nil
+		}
+	}
+	return fmt.Errorf("active subscription %d not found", id)
+}
+
+func (s *memoryStorage) AdvanceEventSubscription(ctx context.Context, id int, from, to int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sub := range s.subs {
+		if sub.ID == id && sub.Cursor == from {
+			sub.Cursor = to
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStorage) RecordTransferEnrichment(ctx context.Context, e *TransferEnrichment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.enriched == nil {
+		s.enriched = map[string]map[string]*TransferEnrichment{}
+	}
+	if s.enriched[e.Reference] == nil {
+		s.enriched[e.Reference] = map[string]*TransferEnrichment{}
+	}
+	s.enriched[e.Reference][e.Enricher] = e
+	return nil
+}
+
+func (s *memoryStorage) GetTransferEnrichments(ctx context.Context, reference string) ([]*TransferEnrichment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	enrichments := []*TransferEnrichment{}
+	for _, e := range s.enriched[reference] {
+		enrichments = append(enrichments, e)
+	}
+	sort.Slice(enrichments, func(i, j int) bool { return enrichments[i].Enricher < enrichments[j].Enricher })
+	return enrichments, nil
+}
+
+func (s *memoryStorage) GetLedgerEntries(ctx context.Context, from, until time.Time) ([]*LedgerEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := []*LedgerEntry{}
+	for _, e := range s.entries {
+		if !e.CreatedAt.Before(from) && e.CreatedAt.Before(until) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (s *memoryStorage) GetClosingBalances(ctx context.Context, at time.Time) ([]*ClosingBalance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	since := map[int]int64{}
+	for _, e := range s.entries {
+		if !e.CreatedAt.Before(at) {
+			for _, p := range e.Postings {
+				since[p.AccountID] += p.Amount
+			}
+		}
+	}
+
+	balances := []*ClosingBalance{}
+	for id := 1; id <= s.nextID; id++ {
+		if acc, ok := s.accounts[id]; ok && acc.CreatedAt.Before(at) {
+			balances = append(balances, &ClosingBalance{AccountID: id, Number: acc.Number, Currency: acc.Currency, Balance: acc.Balance - since[id]})
+		}
+	}
+	return balances, nil
+}
+
+func (s *memoryStorage) RecordExportDelivery(ctx context.Context, d *ExportDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.exports == nil {
+		s.exports = map[string]*ExportDelivery{}
+	}
+	copied := *d
+	s.exports[d.FileName] = &copied
+	return nil
+}
+
+func (s *memoryStorage) GetExportDeliveries(ctx context.Context, since time.Time) ([]*ExportDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deliveries := []*ExportDelivery{}
+	for _, d := range s.exports {
+		if !d.Day.Before(since) {
+			copied := *d
+			deliveries = append(deliveries, &copied)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		if !deliveries[i].Day.Equal(deliveries[j].Day) {
+			return deliveries[i].Day.After(deliveries[j].Day)
+		}
+		return deliveries[i].FileName < deliveries[j].FileName
+	})
+	return deliveries, nil
+}
+
+func (s *memoryStorage) CreateLegalHold(ctx context.Context, hold *LegalHold) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hold.ID = len(s.holds) + 1
+	copied := *hold
+	s.holds = append(s.holds, &copied)
+	return nil
+}
+
+func (s *memoryStorage) GetLegalHolds(ctx context.Context, accountID int, activeOnly bool) ([]*LegalHold, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	holds := []*LegalHold{}
+	for _, h := range s.holds {
+		if h.AccountID == accountID && (!activeOnly || h.active()) {
+			copied := *h
+			holds = append(holds, &copied)
+		}
+	}
+	return holds, nil
+}
+
+func (s *memoryStorage) ReleaseLegalHold(ctx context.Context, accountID, id int, by, reason, reference string, at time.Time) (*LegalHold, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, h := range s.holds {
+		if h.ID == id && h.AccountID == accountID && h.active() {
+			h.ReleasedAt, h.ReleasedBy, h.ReleaseReason, h.ReleaseReference = &at, by, reason, reference
+			copied := *h
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %d", ErrLegalHoldNotFound, id)
+}
+
+func (s *memoryStorage) CreateKYCSubmission(ctx context.Context, sub *KYCSubmission) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, k := range s.kyc {
+		if k.AccountID == sub.AccountID && k.Status == KYCPending {
+			return ErrKYCPending
+		}
+	}
+	sub.ID = len(s.kyc) + 1
+	copied := *sub
+	s.kyc = append(s.kyc, &copied)
+	return nil
+}
+
+func (s *memoryStorage) GetKYCSubmissions(ctx context.Context, accountID int) ([]*KYCSubmission, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	submissions := []*KYCSubmission{}
+	for i := len(s.kyc) - 1; i >= 0; i-- {
+		if s.kyc[i].AccountID == accountID {
+			copied := *s.kyc[i]
+			submissions = append(submissions, &copied)
+		}
+	}
+	return submissions, nil
+}
+
+func (s *memoryStorage) GetKYCSubmissionsByStatus(ctx context.Context, status string) ([]*KYCSubmission, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	submissions := []*KYCSubmission{}
+	for _, k := range s.kyc {
+		if k.Status == status {
+			copied := *k
+			submissions = append(submissions, &copied)
+		}
+	}
+	return submissions, nil
+}
+
+func (s *memoryStorage) GetKYCStatus(ctx context.Context, accountID int) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.kyc) - 1; i >= 0; i-- {
+		if s.kyc[i].AccountID == accountID {
+			return s.kyc[i].Status, nil
+		}
+	}
+	return KYCUnverified, nil
+}
+
+func (s *memoryStorage) ReviewKYCSubmission(ctx context.Context, id int, status, reason, by string, at time.Time) (*KYCSubmission, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, k := range s.kyc {
+		if k.ID != id || k.Status != KYCPending {
+			continue
+		}
+		if status == KYCVerified {
+			for _, other := range s.kyc {
+				if other.Status == KYCVerified && other.DocumentNumberHash == k.DocumentNumberHash {
+					return nil, ErrKYCDocumentInUse
+				}
+			}
+		}
+		k.Status, k.Reason, k.ReviewedBy, k.ReviewedAt = status, reason, by, &at
+		copied := *k
+		return &copied, nil
+	}
+	return nil, fmt.Errorf("%w: %d", ErrKYCNotFound, id)
+}
+
+func (s *memoryStorage) GetAuditLog(ctx context.Context, accountID int) ([]*AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := []*AuditEntry{}
+	for _, entry := range s.audit {
+		if entry.AccountID == accountID {
+			copied := *entry
+			copied.Changes = slices.Clone(entry.Changes)
+			entries = append(entries, &copied)
+		}
+	}
+	return entries, nil
+}
+
+func (s *memoryStorage) CreateScheduledTransfer(ctx context.Context, st *ScheduledTransfer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st.ID = len(s.scheduled) + 1
+	copied := *st
+	s.scheduled = append(s.scheduled, &copied)
+	return nil
+}
+
+func (s *memoryStorage) GetScheduledTransfers(ctx context.Context, accountID int) ([]*ScheduledTransfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scheduled := []*ScheduledTransfer{}
+	for _, st := range s.scheduled {
+		if st.FromAccountID == accountID {
+			copied := *st
+			scheduled = append(scheduled, &copied)
+		}
+	}
+	return scheduled, nil
+}
+
+func (s *memoryStorage) GetSweepRules(ctx context.Context, accountID int) ([]*SweepRule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rules := []*SweepRule{}
+	for _, rule := range s.sweeps {
+		if rule.AccountID == accountID {
+			copied := *rule
+			rules = append(rules, &copied)
+		}
+	}
+	return rules, nil
+}
+
+func (s *memoryStorage) CreateErasureRequest(ctx context.Context, req *ErasureRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.erasures == nil {
+		s.erasures = map[int]*ErasureRequest{}
+	}
+	copied := *req
+	s.erasures[req.AccountID] = &copied
+	return nil
+}
+
+func (s *memoryStorage) GetErasureRequest(ctx context.Context, accountID int) (*ErasureRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	req, ok := s.erasures[accountID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrErasureNotFound, accountID)
+	}
+	copied := *req
+	return &copied, nil
+}
+
+func (s *memoryStorage) GetDueErasures(ctx context.Context, now time.Time, limit int) ([]*ErasureRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	due := []*ErasureRequest{}
+	for _, req := range s.erasures {
+		if req.ErasedAt == nil && !req.EraseAt.After(now) {
+			copied := *req
+			due = append(due, &copied)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].EraseAt.Before(due[j].EraseAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
+
+func (s *memoryStorage) EraseAccount(ctx context.Context, accountID int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[accountID]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrAccountNotFound, accountID)
+	}
+	acc.FirstName, acc.LastName, acc.Email, acc.EmailVerified = "", "", "", false
+	acc.Nickname, acc.Metadata, acc.EncryptedPassword = "", nil, ""
+
+	s.resets = slices.DeleteFunc(s.resets, func(r *PasswordReset) bool { return r.AccountID == accountID })
+	s.verifies = slices.DeleteFunc(s.verifies, func(v *EmailVerification) bool { return v.AccountID == accountID })
+	s.idents = slices.DeleteFunc(s.idents, func(i *OIDCIdentity) bool { return i.AccountID == accountID })
+	delete(s.loginIPs, accountID)
+	s.kyc = slices.DeleteFunc(s.kyc, func(k *KYCSubmission) bool { return k.AccountID == accountID })
+	s.aliases = slices.DeleteFunc(s.aliases, func(a *memoryAlias) bool { return a.AccountID == accountID })
+	s.payees = slices.DeleteFunc(s.payees, func(b *Beneficiary) bool { return b.AccountID == accountID })
+	s.subs = slices.DeleteFunc(s.subs, func(sub *EventSubscription) bool { return sub.AccountID == accountID })
+	s.notices = slices.DeleteFunc(s.notices, func(n *Notification) bool { return n.AccountID == accountID })
+	s.apiKeys = slices.DeleteFunc(s.apiKeys, func(k *APIKey) bool { return k.AccountID != nil && *k.AccountID == accountID })
+	for _, entry := range s.audit {
+		if entry.AccountID == accountID {
+			entry.Changes = eraseAuditChanges(entry.Changes)
+		}
+	}
+
+	if req, ok := s.erasures[accountID]; ok {
+		req.ErasedAt, req.Status = &at, ErasureCompleted
+	}
+	return nil
+}
+
+func (s *memoryStorage) DeleteExportDelivery(ctx context.Context, fileName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.exports[fileName]; !ok {
+		return fmt.Errorf("%w: %s", ErrExportNotFound, fileName)
+	}
+	delete(s.exports, fileName)
+	return nil
+}
+
+func copyOperation(op *PendingOperation) *PendingOperation {
+	copied := *op
+	copied.Approvals = append([]*OperationApproval{}, op.Approvals...)
+	return &copied
+}
+
+func (s *memoryStorage) CreatePendingOperation(ctx context.Context, op *PendingOperation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	op.ID = len(s.ops) + 1
+	s.ops = append(s.ops, copyOperation(op))
+	return nil
+}
+
+func (s *memoryStorage) GetPendingOperation(ctx context.Context, id int) (*PendingOperation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id < 1 || id > len(s.ops) {
+		return nil, fmt.Errorf("%w: %d", ErrOperationNotFound, id)
+	}
+	return copyOperation(s.ops[id-1]), nil
+}
+
+func (s *memoryStorage) GetPendingOperations(ctx context.Context, status string) ([]*PendingOperation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ops := []*PendingOperation{}
+	for i := len(s.ops) - 1; i >= 0; i-- {
+		if status == "" || s.ops[i].Status == status {
+			ops = append(ops, copyOperation(s.ops[i]))
+		}
+	}
+	return ops, nil
+}
+
+func (s *memoryStorage) AddOperationApproval(ctx context.Context, id int, approval *OperationApproval) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id < 1 || id > len(s.ops) {
+		return fmt.Errorf("%w: %d", ErrOperationNotFound, id)
+	}
+	op := s.ops[id-1]
+	if op.Status != OperationPending {
+		return fmt.Errorf("%w: %d is %s", ErrOperationNotPending, id, op.Status)
+	}
+	for _, a := range op.Approvals {
+		if a.Approver == approval.Approver {
+			return fmt.Errorf("%w: %s", ErrAlreadyApproved, approval.Approver)
+		}
+	}
+	op.Approvals = append(op.Approvals, approval)
+	return nil
+}
+
+func (s *memoryStorage) SetOperationStatus(ctx context.Context, op *PendingOperation, from, to string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := s.ops[op.ID-1]
+	if stored.Status != from {
+		return false, nil
+	}
+	stored.Status, stored.Result, stored.Error, stored.ExecutedAt = to, op.Result, op.Error, op.ExecutedAt
+	op.Status = to
+	return true, nil
+}
+
+func (s *memoryStorage) GetDueScheduledTransfers(ctx context.Context, now time.Time, limit int) ([]*ScheduledTransfer, error) {
+	return []*ScheduledTransfer{}, nil
+}
+
+func (s *memoryStorage) RecordLiabilitySnapshot(ctx context.Context, snap *LiabilitySnapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	copied := *snap
+	s.snapshots = append(s.snapshots, &copied)
+	return nil
+}
+
+func copyEODRun(run *EODRun) *EODRun {
+	copied := *run
+	copied.Steps = []*EODStep{}
+	for _, st := range run.Steps {
+		step := *st
+		copied.Steps = append(copied.Steps, &step)
+	}
+	return &copied
+}
+
+func (s *memoryStorage) ClaimEODRun(ctx context.Context, day, cutOff, now, staleBefore time.Time) (*EODRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.eodRuns == nil {
+		s.eodRuns = map[string]*EODRun{}
+	}
+	run, ok := s.eodRuns[day.Format(time.DateOnly)]
+	switch {
+	case !ok:
+		run = &EODRun{Day: day, CutOff: cutOff, StartedAt: now}
+		s.eodRuns[day.Format(time.DateOnly)] = run
+	case run.Status == EODCompleted:
+		return nil, fmt.Errorf("%w: %s", ErrEODCompleted, day.Format(time.DateOnly))
+	case run.Status == EODRunning && !run.UpdatedAt.Before(staleBefore):
+		return nil, fmt.Errorf("%w: %s", ErrEODRunning, day.Format(time.DateOnly))
+	}
+	run.Status, run.UpdatedAt, run.FinishedAt = EODRunning, now, nil
+	return copyEODRun(run), nil
+}
+
+func (s *memoryStorage) SaveEODStep(ctx context.Context, day time.Time, step *EODStep) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	run := s.eodRuns[day.Format(time.DateOnly)]
+	copied := *step
+	for i, st := range run.Steps {
+		if st.Name == step.Name {
+			run.Steps[i] = &copied
+			return nil
+		}
+	}
+	run.Steps = append(run.Steps, &copied)
+	return nil
+}
+
+func (s *memoryStorage) FinishEODRun(ctx context.Context, day time.Time, status string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	run := s.eodRuns[day.Format(time.DateOnly)]
+	run.Status, run.UpdatedAt, run.FinishedAt = status, at, &at
+	return nil
+}
+
+func (s *memoryStorage) GetEODRun(ctx context.Context, day time.Time) (*EODRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	run, ok := s.eodRuns[day.Format(time.DateOnly)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrEODRunNotFound, day.Format(time.DateOnly))
+	}
+	return copyEODRun(run), nil
+}
+
+func (s *memoryStorage) GetEODRuns(ctx context.Context, limit int) ([]*EODRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	runs := []*EODRun{}
+	for _, run := range s.eodRuns {
+		runs = append(runs, copyEODRun(run))
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Day.After(runs[j].Day) })
+	if len(runs) > limit {
+		runs = runs[:limit]
+	}
+	return runs, nil
+}
+
+func (s *memoryStorage) CreateReservation(ctx context.Context, r *Reservation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r.ID = len(s.reserved) + 1
+	copied := *r
+	s.reserved = append(s.reserved, &copied)
+	return nil
+}
+
+func (s *memoryStorage) GetReservations(ctx context.Context, accountID int, activeOnly bool) ([]*Reservation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reservations := []*Reservation{}
+	for _, r := range s.reserved {
+		if r.AccountID == accountID && (!activeOnly || r.active(time.Now())) {
+			copied := *r
+			reservations = append(reservations, &copied)
+		}
+	}
+	return reservations, nil
+}
+
+func (s *memoryStorage) GetReservation(ctx context.Context, id int) (*Reservation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id < 1 || id > len(s.reserved) {
+		return nil, fmt.Errorf("%w: %d", ErrHoldNotFound, id)
+	}
+	copied := *s.reserved[id-1]
+	return &copied, nil
+}
+
+func (s *memoryStorage) ResolveReservation(ctx context.Context, r *Reservation, from string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, stored := range s.reserved {
+		if stored.ID == r.ID && stored.Status == from {
+			stored.Status, stored.Captured, stored.ResolvedAt = r.Status, r.Captured, r.ResolvedAt
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStorage) ExpireReservations(ctx context.Context, now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired int64
+	for _, r := range s.reserved {
+		if r.Status == ReservationActive && r.ExpiresAt != nil && !r.ExpiresAt.After(now) {
+			r.Status, r.ResolvedAt = ReservationExpired, r.ExpiresAt
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+func (s *memoryStorage) CreatePendingTransfer(ctx context.Context, pt *PendingTransfer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	copied := *pt
+	s.pending = append(s.pending, &copied)
+	return nil
+}
+
+func (s *memoryStorage) GetPendingTransfer(ctx context.Context, reference string) (*PendingTransfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, pt := range s.pending {
+		if pt.Reference == reference {
+			copied := *pt
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrTransferNotFound, reference)
+}
+
+func (s *memoryStorage) GetPendingTransfers(ctx context.Context, status string) ([]*PendingTransfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transfers := []*PendingTransfer{}
+	for _, pt := range s.pending {
+		if pt.Status == status {
+			copied := *pt
+			transfers = append(transfers, &copied)
+		}
+	}
+	return transfers, nil
+}
+
+func (s *memoryStorage) UpdatePendingTransfer(ctx context.Context, pt *PendingTransfer, from string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, stored := range s.pending {
+		if stored.Reference == pt.Reference && stored.Status == from {
+			copied := *pt
+			s.pending[i] = &copied
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStorage) CreateTransferJob(ctx context.Context, job *TransferJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	copied := *job
+	s.jobs = append(s.jobs, &copied)
+	return nil
+}
+
+func (s *memoryStorage) GetTransferJob(ctx context.Context, id string) (*TransferJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, job := range s.jobs {
+		if job.ID == id {
+			copied := *job
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrTransferJobNotFound, id)
+}
+
+func (s *memoryStorage) GetDueTransferJobs(ctx context.Context, now time.Time, limit int) ([]*TransferJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	due := []*TransferJob{}
+	for _, job := range s.jobs {
+		if (job.Status == TransferJobQueued || job.Status == TransferJobProcessing) && !job.NextAttemptAt.After(now) && len(due) < limit {
+			copied := *job
+			due = append(due, &copied)
+		}
+	}
+	return due, nil
+}
+
+func (s *memoryStorage) ClaimTransferJob(ctx context.Context, id string, now, leaseUntil time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, job := range s.jobs {
+		if job.ID == id && (job.Status == TransferJobQueued || job.Status == TransferJobProcessing) && !job.NextAttemptAt.After(now) {
+			job.Status, job.NextAttemptAt, job.UpdatedAt = TransferJobProcessing, leaseUntil, now
+			job.Attempts++
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStorage) UpdateTransferJob(ctx context.Context, job *TransferJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, stored := range s.jobs {
+		if stored.ID == job.ID {
+			copied := *job
+			s.jobs[i] = &copied
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrTransferJobNotFound, job.ID)
+}
+
+type memoryAlias struct {
+	AccountAlias
+	attempts int
+}
+
+func (s *memoryStorage) SaveAlias(ctx context.Context, alias *AccountAlias) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, a := range s.aliases {
+		if a.AccountID == alias.AccountID && a.Value == alias.Value {
+			if a.Verified {
+				return ErrAliasVerified
+			}
+			a.CodeHash, a.CodeExpiresAt, a.attempts = alias.CodeHash, alias.CodeExpiresAt, 0
+			alias.ID, alias.CreatedAt = a.ID, a.CreatedAt
+			return nil
+		}
+	}
+	alias.ID = 1
+	if n := len(s.aliases); n > 0 {
+		alias.ID = s.aliases[n-1].ID + 1
+	}
+	s.aliases = append(s.aliases, &memoryAlias{AccountAlias: *alias})
+	return nil
+}
+
+func (s *memoryStorage) GetAliases(ctx context.Context, accountID int) ([]*AccountAlias, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	aliases := []*AccountAlias{}
+	for _, a := range s.aliases {
+		if a.AccountID == accountID {
+			copied := a.AccountAlias
+			aliases = append(aliases, &copied)
+		}
+	}
+	return aliases, nil
+}
+
+func (s *memoryStorage) GetVerifiedAlias(ctx context.Context, value string) (*AccountAlias, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, a := range s.aliases {
+		if a.Value == value && a.Verified {
+			copied := a.AccountAlias
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrAliasNotFound, value)
+}
+
+func (s *memoryStorage) VerifyAlias(ctx context.Context, accountID, id int, codeHash string, at time.Time) (*AccountAlias, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, a := range s.aliases {
+		if a.ID != id || a.AccountID != accountID || a.Verified {
+			continue
+		}
+		if a.CodeHash != codeHash || !a.CodeExpiresAt.After(at) || a.attempts >= maxAliasCodeAttempts {
+			a.attempts++
+			return nil, ErrInvalidAliasCode
+		}
+		for _, other := range s.aliases {
+			if other.Value == a.Value && other.Verified {
+				return nil, ErrAliasTaken
+			}
+		}
+		a.Verified, a.VerifiedAt, a.CodeHash = true, &at, ""
+		copied := a.AccountAlias
+		return &copied, nil
+	}
+	return nil, fmt.Errorf("%w: %d", ErrAliasNotFound, id)
+}
+
+func (s *memoryStorage) DeleteAlias(ctx context.Context, accountID, id int) (*AccountAlias, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, a := range s.aliases {
+		if a.ID == id && a.AccountID == accountID {
+			s.aliases = slices.Delete(s.aliases, i, i+1)
+			return &a.AccountAlias, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %d", ErrAliasNotFound, id)
+}
+
+func (s *memoryStorage) CreateSplit(ctx context.Context, split *SplitBill) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	split.ID = len(s.splitList) + 1
+	copied := *split
+	copied.Shares = nil
+	s.splitList = append(s.splitList, &copied)
+	for _, share := range split.Shares {
+		share.ID, share.SplitID = len(s.shares)+1, split.ID
+		stored := *share
+		s.shares = append(s.shares, &stored)
+	}
+	return nil
+}
+
+// splitShares copies the split's shares, s.mu must be held
+func (s *memoryStorage) splitShares(splitID int) []*SplitShare {
+	shares := []*SplitShare{}
+	for _, share := range s.shares {
+		if share.SplitID == splitID {
+			copied := *share
+			shares = append(shares, &copied)
+		}
+	}
+	return shares
+}
+
+func (s *memoryStorage) GetSplit(ctx context.Context, id int) (*SplitBill, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, split := range s.splitList {
+		if split.ID == id {
+			copied := *split
+			copied.Shares = s.splitShares(id)
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %d", ErrSplitNotFound, id)
+}
+
+func (s *memoryStorage) GetSplits(ctx context.Context, accountID int) ([]*SplitBill, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	splits := []*SplitBill{}
+	for i := len(s.splitList) - 1; i >= 0; i-- {
+		if s.splitList[i].AccountID == accountID {
+			copied := *s.splitList[i]
+			copied.Shares = s.splitShares(copied.ID)
+			splits = append(splits, &copied)
+		}
+	}
+	return splits, nil
+}
+
+func (s *memoryStorage) GetSplitShare(ctx context.Context, id int) (*SplitShare, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, share := range s.shares {
+		if share.ID == id {
+			copied := *share
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %d", ErrSplitShareNotFound, id)
+}
+
+func (s *memoryStorage) GetSplitShareByTransfer(ctx context.Context, reference string) (*SplitShare, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, share := range s.shares {
+		if share.TransferReference == reference {
+			copied := *share
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrSplitShareNotFound, reference)
+}
+
+func (s *memoryStorage) GetSplitShares(ctx context.Context, accountID int) ([]*SplitShare, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shares := []*SplitShare{}
+	for i := len(s.shares) - 1; i >= 0; i-- {
+		if s.shares[i].AccountID == accountID {
+			copied := *s.shares[i]
+			shares = append(shares, &copied)
+		}
+	}
+	return shares, nil
+}
+
+func (s *memoryStorage) ResolveSplit(ctx context.Context, split *SplitBill, from string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, stored := range s.splitList {
+		if stored.ID == split.ID && stored.Status == from {
+			stored.Status, stored.ResolvedAt = split.Status, split.ResolvedAt
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStorage) ResolveSplitShare(ctx context.Context, share *SplitShare, from string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, stored := range s.shares {
+		if stored.ID == share.ID && stored.Status == from {
+			stored.Status, stored.TransferReference, stored.RespondedAt = share.Status, share.TransferReference, share.RespondedAt
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStorage) CreateDispute(ctx context.Context, d *Dispute) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.disputes {
+		if existing.Reference == d.Reference {
+			return fmt.Errorf("%w: %s", ErrDisputeExists, d.Reference)
+		}
+	}
+	d.ID = len(s.disputes) + 1
+	copied := *d
+	s.disputes = append(s.disputes, &copied)
+	return nil
+}
+
+func (s *memoryStorage) findDispute(match func(d *Dispute) bool) *Dispute {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range s.disputes {
+		if match(d) {
+			copied := *d
+			return &copied
+		}
+	}
+	return nil
+}
+
+func (s *memoryStorage) GetDispute(ctx context.Context, id int) (*Dispute, error) {
+	if d := s.findDispute(func(d *Dispute) bool { return d.ID == id }); d != nil {
+		return d, nil
+	}
+	return nil, fmt.Errorf("%w: %d", ErrDisputeNotFound, id)
+}
+
+func (s *memoryStorage) GetTransferDispute(ctx context.Context, reference string) (*Dispute, error) {
+	if d := s.findDispute(func(d *Dispute) bool { return d.Reference == reference }); d != nil {
+		return d, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrDisputeNotFound, reference)
+}
+
+func (s *memoryStorage) GetAccountDisputes(ctx context.Context, accountNumber int64) ([]*Dispute, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	disputes := []*Dispute{}
+	for i := len(s.disputes) - 1; i >= 0; i-- {
+		if d := s.disputes[i]; d.FromAccount == accountNumber || d.ToAccount == accountNumber {
+			copied := *d
+			disputes = append(disputes, &copied)
+		}
+	}
+	return disputes, nil
+}
+
+func (s *memoryStorage) GetDisputes(ctx context.Context, status string) ([]*Dispute, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	disputes := []*Dispute{}
+	for _, d := range s.disputes {
+		if d.Status == status {
+			copied := *d
+			disputes = append(disputes, &copied)
+		}
+	}
+	return disputes, nil
+}
+
+func (s *memoryStorage) ResolveDispute(ctx context.Context, d *Dispute, from string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, stored := range s.disputes {
+		if stored.ID == d.ID && stored.Status == from {
+			stored.Status, stored.Resolution, stored.ResolvedBy, stored.ResolvedAt = d.Status, d.Resolution, d.ResolvedBy, d.ResolvedAt
+			return true, nil
+		}
+	}
+	return false, nil
+}
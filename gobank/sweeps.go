@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A sweep rule moves everything above Threshold to another account on a
+// schedule, e.g. weekly starting on a Friday. Sweeps are ledgered as transfers
+// of kind "sweep" and don't count towards the daily transfer limits.
+
+const (
+	TransferKindTransfer   = "transfer"
+	TransferKindSweep      = "sweep"
+	TransferKindAdjustment = "adjustment"
+
+	SweepSwept   = "swept"
+	SweepSkipped = "skipped"
+	SweepFailed  = "failed"
+)
+
+type SweepRule struct {
+	ID              int       `json:"id"`
+	AccountID       int       `json:"account_id"`
+	ToAccountNumber int64     `json:"to_account_number"`
+	Threshold       float64   `json:"threshold"`
+	Frequency       string    `json:"frequency"`
+	Status          string    `json:"status"`
+	NextRunAt       time.Time `json:"next_run_at"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+type CreateSweepRuleRequest struct {
+	ToAccountNumber int64     `json:"toAccount" validate:"required,positive"`
+	Threshold       float64   `json:"threshold" validate:"min=0"`
+	Frequency       string    `json:"frequency" validate:"required,oneof=daily weekly monthly"`
+	StartAt         time.Time `json:"startAt"`
+}
+
+type SweepExecution struct {
+	ID         int       `json:"id"`
+	RuleID     int       `json:"rule_id"`
+	Amount     float64   `json:"amount"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	ExecutedAt time.Time `json:"executed_at"`
+}
+
+type transferKindKey struct{}
+
+// withTransferKind tags the transfers recorded under ctx, plain transfers are the default
+func withTransferKind(ctx context.Context, kind string) context.Context {
+	return context.WithValue(ctx, transferKindKey{}, kind)
+}
+
+func transferKind(ctx context.Context) string {
+	if kind, ok := ctx.Value(transferKindKey{}).(string); ok {
+		return kind
+	}
+	return TransferKindTransfer
+}
+
+// sweepAmount is what a run moves, nothing when the balance is at or below the threshold
+func sweepAmount(balance int64, threshold float64) int64 {
+	return max(balance-toCents(threshold), 0)
+}
+
+// GET /account/{id}/sweeps
+func (s *APIServer) handleGetSweepRules(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	rules, err := s.store.GetSweepRules(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, rules)
+}
+
+// POST /account/{id}/sweeps
+func (s *APIServer) handleCreateSweepRule(w http.ResponseWriter, r *http.Request) error {
+	s = s.forRequest(r)
+
+	accountID, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	var req CreateSweepRuleRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+
+	from, err := s.store.GetAccountbyID(r.Context(), accountID)
+	if err != nil {
+		return err
+	}
+	if _, err := s.store.GetAccountByNumber(r.Context(), req.ToAccountNumber); err != nil {
+		return invalidField("toAccount", "exists", "is not an account")
+	}
+	if from.Number == req.ToAccountNumber {
+		return invalidField("toAccount", "different", "must not be the swept account")
+	}
+
+	startAt := req.StartAt
+	if startAt.IsZero() {
+		startAt = time.Now()
+	}
+
+	rule := &SweepRule{
+		AccountID:       accountID,
+		ToAccountNumber: req.ToAccountNumber,
+		Threshold:       req.Threshold,
+		Frequency:       req.Frequency,
+		Status:          ScheduledActive,
+		NextRunAt:       startAt.UTC(),
+		CreatedAt:       time.Now().UTC(),
+	}
+	if err := s.store.CreateSweepRule(r.Context(), rule); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, rule)
+}
+
+func sweepID(r *http.Request) (int, error) {
+	return pathID(r, "sweepID")
+}
+
+// DELETE /account/{id}/sweeps/{sweepID}
+func (s *APIServer) handleCancelSweepRule(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	ruleID, err := sweepID(r)
+	if err != nil {
+		return err
+	}
+
+	if err := s.forRequest(r).store.CancelSweepRule(r.Context(), id, ruleID); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, map[string]int{"cancelled": ruleID})
+}
+
+// GET /account/{id}/sweeps/{sweepID}/executions
+func (s *APIServer) handleSweepExecutions(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	ruleID, err := sweepID(r)
+	if err != nil {
+		return err
+	}
+
+	executions, err := s.forRequest(r).store.GetSweepExecutions(r.Context(), id, ruleID)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, executions)
+}
+
+// sweepRunner executes due sweep rules through the transfer service. A failed
+// run isn't retried, the next occurrence sweeps whatever is above the threshold.
+type sweepRunner struct {
+	api    *APIServer
+	engine TransferEngine
+}
+
+func (s *APIServer) sweepJob(engine TransferEngine) Job {
+	runner := &sweepRunner{api: s, engine: engine}
+
+	return Job{
+		Name:     "sweeps",
+		Interval: s.config.SchedulerInterval,
+		Run:      runner.run,
+	}
+}
+
+func (r *sweepRunner) run(ctx context.Context) error {
+	now := time.Now().UTC()
+
+	due, err := r.api.store.GetDueSweepRules(ctx, now, 100)
+	if err != nil {
+		return err
+	}
+	setJobQueueDepth("sweeps", len(due))
+
+	for _, rule := range due {
+		// Moving the schedule on claims the run, another instance won't pick it up
+		claimed, err := r.api.store.AdvanceSweepRule(ctx, rule.ID, rule.NextRunAt, nextOccurrence(rule.NextRunAt, rule.Frequency))
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+
+		execution := r.execute(ctx, rule, now)
+		if err := r.api.store.RecordSweepExecution(ctx, execution); err != nil {
+			log.Printf("Failed to record execution of sweep rule %d: %v", rule.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *sweepRunner) execute(ctx context.Context, rule *SweepRule, now time.Time) *SweepExecution {
+	execution := &SweepExecution{RuleID: rule.ID, Status: SweepSkipped, ExecutedAt: now}
+
+	from, err := r.api.store.GetAccountbyID(ctx, rule.AccountID)
+	if err == nil {
+		amount := float64(sweepAmount(from.Balance, rule.Threshold)) / 100
+		if amount == 0 {
+			return execution
+		}
+
+		execution.Amount = amount
+		_, _, err = r.api.transfers().Transfer(withTransferKind(ctx, TransferKindSweep), TransferRequest{
+			FromAccountNumber: from.Number,
+			ToAccountNumber:   rule.ToAccountNumber,
+			Amount:            amount,
+		}, r.engine, "sweep:"+strconv.Itoa(rule.ID))
+	}
+
+	if err != nil {
+		execution.Status = SweepFailed
+		execution.Error = err.Error()
+		return execution
+	}
+
+	execution.Status = SweepSwept
+	return execution
+}
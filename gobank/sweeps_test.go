@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSweepRunner(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	checking := &Account{Number: 4001, Balance: 150000, Status: AccountActive}
+	savings := &Account{Number: 4002, Status: AccountActive}
+	require.Nil(t, store.CreateAccount(ctx, checking))
+	require.Nil(t, store.CreateAccount(ctx, savings))
+
+	due := time.Now().UTC().Add(-time.Minute)
+	store.sweeps = []*SweepRule{{ID: 1, AccountID: checking.ID, ToAccountNumber: 4002, Threshold: 1000, Frequency: FrequencyWeekly, Status: ScheduledActive, NextRunAt: due}}
+
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	// Sweeps are exempt from the daily limits
+	s := NewAPIServer(&Config{DailyTransferAmount: 100}, store)
+	runner := &sweepRunner{api: s, engine: engine}
+
+	require.Nil(t, runner.run(ctx))
+	after, _ := store.GetAccountbyID(ctx, checking.ID)
+	assert.Equal(t, int64(100000), after.Balance)
+	require.Len(t, store.sweptRuns, 1)
+	assert.Equal(t, SweepSwept, store.sweptRuns[0].Status)
+	assert.Equal(t, 500.0, store.sweptRuns[0].Amount)
+	assert.Equal(t, TransferKindSweep, store.transfers[0].kind)
+	assert.Equal(t, due.AddDate(0, 0, 7), store.sweeps[0].NextRunAt)
+
+	// Not due again until next week
+	require.Nil(t, runner.run(ctx))
+	assert.Len(t, store.sweptRuns, 1)
+}
+
+func TestSweepAmount(t *testing.T) {
+	assert.Equal(t, int64(0), sweepAmount(50000, 1000))
+	assert.Equal(t, int64(0), sweepAmount(-100, 0))
+	assert.Equal(t, int64(2550), sweepAmount(102550, 1000))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The API is served over HTTPS when a certificate is configured, either a
+// cert/key pair from disk or certificates obtained from Let's Encrypt for
+// AutocertDomains. HTTPRedirectAddr optionally runs a plain HTTP listener
+// that sends everything to the HTTPS one; with autocert it also answers the
+// ACME http-01 challenges, so it must be reachable on port 80.
+
+type tlsSetup struct {
+	config   *tls.Config
+	redirect http.Handler // served on HTTPRedirectAddr
+}
+
+// newTLSSetup returns nil when the server should speak plain HTTP
+func newTLSSetup(cfg *Config) (*tlsSetup, error) {
+	files := cfg.TLSCertFile != "" || cfg.TLSKeyFile != ""
+	domains := splitList(cfg.AutocertDomains)
+
+	switch {
+	case files && len(domains) > 0:
+		return nil, fmt.Errorf("TLS_CERT_FILE/TLS_KEY_FILE and AUTOCERT_DOMAINS are mutually exclusive")
+	case files && (cfg.TLSCertFile == "" || cfg.TLSKeyFile == ""):
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	case !files && len(domains) == 0:
+		if cfg.HTTPRedirectAddr != "" {
+			return nil, fmt.Errorf("HTTP_REDIRECT_ADDR needs TLS to redirect to")
+		}
+		return nil, nil
+	}
+
+	redirect := httpsRedirect(cfg.ListenAddr)
+	setup := &tlsSetup{config: &tls.Config{MinVersion: tls.VersionTLS12}, redirect: redirect}
+
+	if files {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		setup.config.Certificates = []tls.Certificate{cert}
+		return setup, nil
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cfg.AutocertCacheDir),
+		Email:      cfg.AutocertEmail,
+	}
+	setup.config.GetCertificate = manager.GetCertificate
+	setup.config.NextProtos = []string{"h2", "http/1.1", "acme-tls/1"}
+	setup.redirect = manager.HTTPHandler(redirect)
+	return setup, nil
+}
+
+// httpsRedirect sends requests to the same host and path on the HTTPS
+// listener, keeping its port unless it's the default 443
+func httpsRedirect(tlsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// serve runs the API listener, over TLS when one is configured
+func (s *APIServer) serve(handler http.Handler) error {
+	setup, err := newTLSSetup(s.config)
+	if err != nil {
+		return err
+	}
+
+	if setup == nil {
+		log.Println("JSON API server running on port:", s.listenAddr)
+		return http.ListenAndServe(s.listenAddr, handler)
+	}
+
+	if s.config.HTTPRedirectAddr != "" {
+		go func() {
+			log.Println("Redirecting HTTP to HTTPS on", s.config.HTTPRedirectAddr)
+			if err := http.ListenAndServe(s.config.HTTPRedirectAddr, setup.redirect); err != nil {
+				log.Fatalf("HTTP redirect listener failed: %v", err)
+			}
+		}()
+	}
+
+	server := &http.Server{Addr: s.listenAddr, Handler: handler, TLSConfig: setup.config}
+	log.Println("JSON API server running with TLS on port:", s.listenAddr)
+	return server.ListenAndServeTLS("", "")
+}
+
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeSelfSignedCert(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+func TestTLSSetup(t *testing.T) {
+	certFile, keyFile := writeSelfSignedCert(t)
+
+	setup, err := newTLSSetup(&Config{ListenAddr: ":8080"})
+	require.Nil(t, err)
+	assert.Nil(t, setup, "plain HTTP without a certificate")
+
+	setup, err = newTLSSetup(&Config{ListenAddr: ":8443", TLSCertFile: certFile, TLSKeyFile: keyFile})
+	require.Nil(t, err)
+	require.NotNil(t, setup)
+	assert.Len(t, setup.config.Certificates, 1)
+
+	setup, err = newTLSSetup(&Config{ListenAddr: ":443", AutocertDomains: "bank.example.com, api.bank.example.com", AutocertCacheDir: t.TempDir()})
+	require.Nil(t, err)
+	assert.NotNil(t, setup.config.GetCertificate)
+
+	for name, cfg := range map[string]*Config{
+		"key missing":      {TLSCertFile: certFile},
+		"both sources":     {TLSCertFile: certFile, TLSKeyFile: keyFile, AutocertDomains: "bank.example.com"},
+		"nothing to reach": {HTTPRedirectAddr: ":80"},
+		"unreadable pair":  {TLSCertFile: certFile, TLSKeyFile: certFile},
+	} {
+		_, err := newTLSSetup(cfg)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestTLSRedirectListener(t *testing.T) {
+	for addr, want := range map[string]string{
+		":443":  "https://bank.example.com/v1/account/1?x=1",
+		":8443": "https://bank.example.com:8443/v1/account/1?x=1",
+	} {
+		rr := httptest.NewRecorder()
+		httpsRedirect(addr).ServeHTTP(rr, httptest.NewRequest("GET", "http://bank.example.com:8080/v1/account/1?x=1", nil))
+		assert.Equal(t, 308, rr.Code)
+		assert.Equal(t, want, rr.Header().Get("Location"))
+	}
+}
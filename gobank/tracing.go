@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Requests are traced with OpenTelemetry from the HTTP handler through the
+// service layer down to each storage call, so a transfer shows its
+// validation, limit checks, database transaction and commit as spans of one
+// trace. Incoming W3C traceparent headers are honoured. Spans are exported
+// over OTLP/HTTP to OTEL_EXPORTER_OTLP_ENDPOINT, the exporter also reads
+// the other standard OTEL_EXPORTER_OTLP_* variables. Without an endpoint
+// the global no-op provider is kept and spans cost next to nothing.
+
+var tracer = otel.Tracer("github.com/SIDDHARTH-PADIGAR/gobank")
+
+// setupTracing installs the OTLP exporter, the returned func flushes it
+func setupTracing(ctx context.Context, cfg *Config) (func(context.Context) error, error) {
+	if cfg.TracingEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", cfg.TracingServiceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.TracingSampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// withTracing starts a server span per request named after its route
+// template, it runs as router middleware so the route is already matched
+func withTracing(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "http.request", otelhttp.WithSpanNameFormatter(routeSpanName))
+}
+
+func routeSpanName(_ string, r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return r.Method + " " + template
+		}
+	}
+	return r.Method
+}
+
+// endSpan records err on span before ending it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traced runs fn in a child span of ctx
+func traced(ctx context.Context, name string, fn func(context.Context) error) error {
+	ctx, span := tracer.Start(ctx, name)
+	err := fn(ctx)
+	endSpan(span, err)
+	return err
+}
+
+// startDBSpan starts a database span under the one in ctx. Calls outside a
+// trace, like those of the scheduler, aren't traced on their own.
+func startDBSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	parent := trace.SpanFromContext(ctx)
+	if !parent.SpanContext().IsValid() {
+		return ctx, parent
+	}
+	return tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", "postgresql")),
+	)
+}
+
+// startStorageSpan names the span after the storage method calling queryContext
+func startStorageSpan(ctx context.Context, skip int) (context.Context, trace.Span) {
+	if !trace.SpanFromContext(ctx).SpanContext().IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+
+	name := "storage"
+	if pc, _, _, ok := runtime.Caller(skip + 1); ok {
+		if fn := runtime.FuncForPC(pc); fn != nil {
+			name = storageSpanName(fn.Name())
+		}
+	}
+	return startDBSpan(ctx, name)
+}
+
+// storageSpanName turns main.(*PostgresStorage).GetAccountbyID into
+// PostgresStorage.GetAccountbyID
+func storageSpanName(fn string) string {
+	if i := strings.LastIndex(fn, "/"); i >= 0 {
+		fn = fn[i+1:]
+	}
+	if i := strings.Index(fn, "."); i >= 0 {
+		fn = fn[i+1:]
+	}
+	return strings.NewReplacer("(*", "", ")", "").Replace(fn)
+}
+
+// tracedTx keeps a span open from BeginTransaction until the transaction
+// commits or rolls back, the commit gets a span of its own
+type tracedTx struct {
+	*sql.Tx
+	ctx     context.Context
+	span    trace.Span
+	started time.Time
+}
+
+func (t *tracedTx) Commit() error {
+	_, span := startDBSpan(t.ctx, "db.commit")
+	err := t.Tx.Commit()
+	endSpan(span, err)
+	endSpan(t.span, err)
+	if err == nil {
+		recordTransaction("committed", t.started)
+	} else {
+		recordTransaction("failed", t.started)
+	}
+	return err
+}
+
+// Rollback is deferred after most commits, only a real rollback is recorded
+func (t *tracedTx) Rollback() error {
+	err := t.Tx.Rollback()
+	if !errors.Is(err, sql.ErrTxDone) {
+		t.span.SetAttributes(attribute.Bool("db.rolled_back", true))
+		recordTransaction("rolled_back", t.started)
+	}
+	t.span.End()
+	return err
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTransferTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+
+	ctx := context.Background()
+	store := newMemoryStorage()
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9901, Balance: 10000, Currency: "USD", EmailVerified: true}))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9902, Currency: "USD"}))
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+
+	body, _ := json.Marshal(TransferRequest{FromAccountNumber: 9901, ToAccountNumber: 9902, Amount: 25})
+	w := httptest.NewRecorder()
+	NewAPIServer(&Config{}, store).routes(engine).ServeHTTP(w, httptest.NewRequest("POST", "/v1/transfer", bytes.NewReader(body)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	require.Contains(t, spans, "POST /v1/transfer")
+	root := spans["POST /v1/transfer"]
+	transfer := spans["transferService.Transfer"]
+	require.NotNil(t, transfer)
+	assert.Equal(t, root.SpanContext().SpanID(), transfer.Parent().SpanID())
+
+	for _, name := range []string{"transfer.validate", "transfer.limits", "transfer.execute"} {
+		require.Contains(t, spans, name)
+		assert.Equal(t, transfer.SpanContext().SpanID(), spans[name].Parent().SpanID(), name)
+	}
+}
+
+func TestStorageSpanName(t *testing.T) {
+	assert.Equal(t, "PostgresStorage.GetAccountbyID", storageSpanName("main.(*PostgresStorage).GetAccountbyID"))
+	assert.Equal(t, "PostgresStorage.AppendEvents.func1", storageSpanName("github.com/x/gobank.(*PostgresStorage).AppendEvents.func1"))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// An account's transaction history is read from its ledger postings, so it
+// covers transfers, fees, cashback and adjustments alike. Memo and category
+// are whatever the customer gave when making the transfer.
+
+type AccountTransaction struct {
+	EntryID   int64     `json:"entry_id"`
+	Kind      string    `json:"kind"`
+	Reference string    `json:"reference,omitempty"`
+	Direction string    `json:"direction"`
+	Amount    float64   `json:"amount"`
+	Currency  string    `json:"currency"`
+	Memo      string    `json:"memo,omitempty"`
+	Category  string    `json:"category,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type TransactionFilter struct {
+	Category string // matched case-insensitively, empty for all
+	Before   int64  // entry ID cursor, zero starts from the newest
+	Limit    int
+}
+
+const (
+	defaultTransactionLimit = 50
+	maxTransactionLimit     = 500
+)
+
+func newAccountTransaction(entry *LedgerEntry, amount int64, currency string) *AccountTransaction {
+	tx := &AccountTransaction{
+		EntryID:   entry.ID,
+		Kind:      entry.Kind,
+		Reference: entry.Reference,
+		Direction: DirectionCredit,
+		Amount:    float64(amount) / 100,
+		Currency:  currency,
+		Memo:      entry.Memo,
+		Category:  entry.Category,
+		CreatedAt: entry.CreatedAt,
+	}
+	if amount < 0 {
+		tx.Direction = DirectionDebit
+		tx.Amount = -tx.Amount
+	}
+	return tx
+}
+
+// HistoricalBalance is an account's balance in cents as it stood at At
+type HistoricalBalance struct {
+	AccountID int       `json:"account_id"`
+	Currency  string    `json:"currency"`
+	Balance   int64     `json:"balance"`
+	At        time.Time `json:"at"`
+}
+
+// GET /account/{id}/balance?at=, summed from the postings up to at, now when omitted
+func (s *APIServer) handleGetBalanceAt(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	at := time.Now().UTC()
+	if v := r.URL.Query().Get("at"); v != "" {
+		if at, err = time.Parse(time.RFC3339, v); err != nil {
+			return invalidParam("query", "at", "type", "must be an RFC 3339 timestamp")
+		}
+	}
+
+	s = s.forRequest(r)
+	acc, err := s.store.GetAccountbyID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	balance, err := s.store.GetBalanceAt(r.Context(), id, at)
+	if err != nil {
+		return err
+	}
+	return writeLocalized(w, r, http.StatusOK, &HistoricalBalance{AccountID: id, Currency: acc.Currency, Balance: balance, At: at.UTC()},
+		acc.Currency, map[string]int64{"balance": balance})
+}
+
+// GET /account/{id}/transactions?category=&before=&limit=, newest first
+func (s *APIServer) handleGetTransactions(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	query := r.URL.Query()
+	filter := TransactionFilter{Category: query.Get("category"), Limit: defaultTransactionLimit}
+	if v := query.Get("before"); v != "" {
+		if filter.Before, err = strconv.ParseInt(v, 10, 64); err != nil || filter.Before < 0 {
+			return invalidParam("query", "before", "type", "must be an entry ID")
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 1 || filter.Limit > maxTransactionLimit {
+			return invalidParam("query", "limit", "range", fmt.Sprintf("must be between 1 and %d", maxTransactionLimit))
+		}
+	}
+
+	transactions, err := s.forRequest(r).store.GetAccountTransactions(r.Context(), id, filter)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, transactions)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransactionHistory(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9201, Balance: 10000, Currency: "USD"}))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9202, Currency: "USD"}))
+
+	s := NewAPIServer(&Config{}, store)
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	for _, req := range []TransferRequest{
+		{FromAccountNumber: 9201, ToAccountNumber: 9202, Amount: 12, Memo: "Friday lunch", Category: "Dining"},
+		{FromAccountNumber: 9201, ToAccountNumber: 9202, Amount: 30, Category: "rent"},
+		{FromAccountNumber: 9201, ToAccountNumber: 9202, Amount: 8, Memo: " coffee ", Category: "dining"},
+	} {
+		_, _, err := s.transfers().Transfer(ctx, req, engine, "test")
+		require.Nil(t, err)
+	}
+
+	history := func(id int, query string) []*AccountTransaction {
+		r := httptest.NewRequest("GET", "/v1/account/"+strconv.Itoa(id)+"/transactions?"+query, nil)
+		r = mux.SetURLVars(r, map[string]string{"id": strconv.Itoa(id)})
+		w := httptest.NewRecorder()
+		makeHTTPHandle(s.handleGetTransactions)(w, r)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var transactions []*AccountTransaction
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &transactions))
+		return transactions
+	}
+
+	// The sender's history includes the opening balance, newest first
+	all := history(1, "")
+	require.Len(t, all, 4)
+	assert.Equal(t, "coffee", all[0].Memo)
+	assert.Equal(t, DirectionDebit, all[0].Direction)
+	assert.Equal(t, 8.0, all[0].Amount)
+
+	dining := history(2, "category=DINING")
+	require.Len(t, dining, 2)
+	assert.Equal(t, DirectionCredit, dining[1].Direction)
+	assert.Equal(t, "Friday lunch", dining[1].Memo)
+	assert.Equal(t, 12.0, dining[1].Amount)
+
+	older := history(2, "category=dining&before="+strconv.FormatInt(dining[0].EntryID, 10))
+	require.Len(t, older, 1)
+	assert.Equal(t, dining[1].EntryID, older[0].EntryID)
+
+	assert.Len(t, history(1, "limit=1"), 1)
+}
+
+func TestBalanceAt(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9301, Balance: 10000, Currency: "USD"}))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9302, Currency: "USD"}))
+
+	s := NewAPIServer(&Config{}, store)
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	for _, amount := range []float64{25, 40} {
+		_, _, err := s.transfers().Transfer(ctx, TransferRequest{FromAccountNumber: 9301, ToAccountNumber: 9302, Amount: amount}, engine, "test")
+		require.Nil(t, err)
+	}
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, e := range store.entries {
+		e.CreatedAt = day.AddDate(0, 0, 10*i)
+	}
+
+	balance := func(id int, query string) (int, *HistoricalBalance) {
+		r := httptest.NewRequest("GET", "/v1/account/"+strconv.Itoa(id)+"/balance?"+query, nil)
+		r = mux.SetURLVars(r, map[string]string{"id": strconv.Itoa(id)})
+		w := httptest.NewRecorder()
+		makeHTTPHandle(s.handleGetBalanceAt)(w, r)
+
+		b := &HistoricalBalance{}
+		json.Unmarshal(w.Body.Bytes(), b)
+		return w.Code, b
+	}
+
+	code, b := balance(1, "at=2024-01-15T00:00:00Z")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, int64(7500), b.Balance)
+	assert.Equal(t, "USD", b.Currency)
+
+	_, b = balance(2, "at=2024-01-31T00:00:00Z")
+	assert.Equal(t, int64(6500), b.Balance)
+	_, b = balance(1, "at=2023-12-31T00:00:00Z")
+	assert.Equal(t, int64(0), b.Balance, "before the account was opened")
+	_, b = balance(1, "")
+	assert.Equal(t, int64(3500), b.Balance)
+
+	code, _ = balance(1, "at=2024-01-31")
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+}
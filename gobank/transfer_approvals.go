@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Customer transfers above TransferLimits.ApprovalAbove don't move money
+// straight away. They're kept as pending transfers with the amount reserved
+// on the source account, which takes it out of the available balance
+// without booking anything. An admin approves the transfer, which releases
+// the reservation and performs it under the reference the customer was
+// given, or rejects it, which only releases the reservation.
+
+const (
+	TransferPendingApproval = "pending_approval"
+	TransferApproved        = "approved" // claimed by an approval, being performed
+	TransferCompleted       = "completed"
+	TransferFailed          = "failed"
+	TransferRejected        = "rejected"
+
+	ReservationActive   = "active"
+	ReservationReleased = "released"
+	ReservationCaptured = "captured"
+	ReservationExpired  = "expired"
+
+	ReservationTransferApproval = "transfer_approval"
+	ReservationAuthorization    = "authorization"
+
+	AuditTransferApproved = "transfer.approved"
+	AuditTransferRejected = "transfer.rejected"
+)
+
+// Reservation takes Amount cents out of an account's available balance
+// until it's resolved or expires
+type Reservation struct {
+	ID         int        `json:"id"`
+	AccountID  int        `json:"account_id"`
+	Amount     int64      `json:"amount"`
+	Currency   string     `json:"currency"`
+	Kind       string     `json:"kind"`
+	Reference  string     `json:"reference"`
+	Status     string     `json:"status"`
+	Captured   int64      `json:"captured,omitempty"` // booked by a capture, the rest was released
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+func (r *Reservation) active(now time.Time) bool {
+	return r.Status == ReservationActive && (r.ExpiresAt == nil || r.ExpiresAt.After(now))
+}
+
+func reservedAmount(reservations []*Reservation, now time.Time) int64 {
+	var reserved int64
+	for _, r := range reservations {
+		if r.active(now) {
+			reserved += r.Amount
+		}
+	}
+	return reserved
+}
+
+type PendingTransfer struct {
+	Reference     string     `json:"reference"`
+	Status        string     `json:"status"`
+	FromAccount   int64      `json:"from_account"`
+	ToAccount     int64      `json:"to_account"`
+	Amount        float64    `json:"amount"`
+	Currency      string     `json:"currency"`
+	Memo          string     `json:"memo,omitempty"`
+	Category      string     `json:"category,omitempty"`
+	ReservationID int        `json:"reservation_id"`
+	RequestedBy   string     `json:"requested_by"`
+	ResolvedBy    string     `json:"resolved_by,omitempty"`
+	Reason        string     `json:"reason,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ResolvedAt    *time.Time `json:"resolved_at,omitempty"`
+}
+
+func (pt *PendingTransfer) request() TransferRequest {
+	return TransferRequest{
+		FromAccountNumber: pt.FromAccount,
+		ToAccountNumber:   pt.ToAccount,
+		Amount:            pt.Amount,
+		Memo:              pt.Memo,
+		Category:          pt.Category,
+	}
+}
+
+func (pt *PendingTransfer) receipt() *TransferReceipt {
+	return &TransferReceipt{
+		Reference:     pt.Reference,
+		Status:        pt.Status,
+		Kind:          TransferKindTransfer,
+		FromAccount:   pt.FromAccount,
+		ToAccount:     pt.ToAccount,
+		Amount:        pt.Amount,
+		Currency:      pt.Currency,
+		TransferredAt: pt.CreatedAt,
+	}
+}
+
+type RejectTransferRequest struct {
+	Reason string `json:"reason" validate:"required,max=500"`
+}
+
+// needsApproval is true for customer transfers over the approval threshold
+func (l TransferLimits) needsApproval(ctx context.Context, amount int64) bool {
+	return l.ApprovalAbove > 0 && amount > l.ApprovalAbove && transferKind(ctx) == TransferKindTransfer
+}
+
+// holdForApproval reserves the amount and keeps the transfer for an admin
+func (s *transferService) holdForApproval(ctx context.Context, req TransferRequest, actor string) (*TransferReceipt, error) {
+	from, err := s.store.GetAccountByNumber(ctx, req.FromAccountNumber)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source account")
+	}
+
+	// Queued transfers keep the reference they were given
+	reference := transferReference(ctx)
+	if reference == "" {
+		reference = newTransferReference()
+	}
+
+	now := time.Now().UTC()
+	pt := &PendingTransfer{
+		Reference:   reference,
+		Status:      TransferPendingApproval,
+		FromAccount: req.FromAccountNumber,
+		ToAccount:   req.ToAccountNumber,
+		Amount:      req.Amount,
+		Currency:    from.Currency,
+		Memo:        strings.TrimSpace(req.Memo),
+		Category:    strings.TrimSpace(req.Category),
+		RequestedBy: actor,
+		CreatedAt:   now,
+	}
+	reservation := &Reservation{
+		AccountID: from.ID,
+		Amount:    toCents(req.Amount),
+		Currency:  from.Currency,
+		Kind:      ReservationTransferApproval,
+		Reference: pt.Reference,
+		Status:    ReservationActive,
+		CreatedAt: now,
+	}
+	if err := s.store.CreateReservation(ctx, reservation); err != nil {
+		return nil, err
+	}
+	pt.ReservationID = reservation.ID
+	if err := s.store.CreatePendingTransfer(ctx, pt); err != nil {
+		s.releaseReservation(ctx, reservation.ID)
+		return nil, err
+	}
+
+	log.Printf("Transfer %s of %.2f %s from %d is waiting for approval", pt.Reference, pt.Amount, pt.Currency, pt.FromAccount)
+	return pt.receipt(), nil
+}
+
+func (s *transferService) releaseReservation(ctx context.Context, id int) {
+	now := time.Now().UTC()
+	if _, err := s.store.ResolveReservation(ctx, &Reservation{ID: id, Status: ReservationReleased, ResolvedAt: &now}, ReservationActive); err != nil {
+		log.Printf("Failed to release reservation %d: %v", id, err)
+	}
+}
+
+// claimPendingTransfer moves a pending transfer on to status, once
+func (s *transferService) claimPendingTransfer(ctx context.Context, reference, status, actor, reason string) (*PendingTransfer, error) {
+	pt, err := s.store.GetPendingTransfer(ctx, reference)
+	if err != nil {
+		return nil, err
+	}
+	if pt.Status != TransferPendingApproval {
+		return nil, fmt.Errorf("%w: %s is %s", ErrTransferResolved, reference, pt.Status)
+	}
+
+	now := time.Now().UTC()
+	pt.Status, pt.ResolvedBy, pt.Reason, pt.ResolvedAt = status, actor, reason, &now
+	claimed, err := s.store.UpdatePendingTransfer(ctx, pt, TransferPendingApproval)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, fmt.Errorf("%w: %s", ErrTransferResolved, reference)
+	}
+	s.releaseReservation(ctx, pt.ReservationID)
+	return pt, nil
+}
+
+// ApproveTransfer performs a pending transfer. The balance is checked again,
+// a transfer that no longer fits fails and stays failed.
+func (s *transferService) ApproveTransfer(ctx context.Context, reference string, engine TransferEngine, actor string) (*TransferReceipt, error) {
+	pt, err := s.claimPendingTransfer(ctx, reference, TransferApproved, actor, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if bound, ok := engine.(storageBoundEngine); ok {
+		engine = bound.WithStorage(s.store)
+	}
+	req := pt.request()
+	receipt, err := s.execute(withTransferReference(ctx, pt.Reference), req, engine, pt.RequestedBy)
+
+	pt.Status = TransferCompleted
+	if err != nil {
+		pt.Status, pt.Error = TransferFailed, err.Error()
+	}
+	if _, uerr := s.store.UpdatePendingTransfer(ctx, pt, TransferApproved); uerr != nil {
+		log.Printf("Failed to record the outcome of transfer %s: %v", reference, uerr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if from, err := s.store.GetAccountByNumber(ctx, pt.FromAccount); err == nil {
+		recordAudit(ctx, s.store, actor, from.ID, AuditTransferApproved, []FieldChange{{Field: "transfer", Old: TransferPendingApproval, New: reference}})
+	}
+	s.afterTransfer(ctx, req, receipt)
+	return receipt, nil
+}
+
+func (s *transferService) RejectTransfer(ctx context.Context, reference, reason, actor string) (*PendingTransfer, error) {
+	pt, err := s.claimPendingTransfer(ctx, reference, TransferRejected, actor, strings.TrimSpace(reason))
+	if err != nil {
+		return nil, err
+	}
+	if from, err := s.store.GetAccountByNumber(ctx, pt.FromAccount); err == nil {
+		recordAudit(ctx, s.store, actor, from.ID, AuditTransferRejected, []FieldChange{{Field: "transfer", Old: TransferPendingApproval, New: reference}})
+	}
+	return pt, nil
+}
+
+func pendingReference(r *http.Request) (string, error) {
+	reference := mux.Vars(r)["reference"]
+	if !validReference.MatchString(reference) {
+		return "", newHTTPError(http.StatusBadRequest, "INVALID_REFERENCE", "transfer reference must be a UUID")
+	}
+	return reference, nil
+}
+
+// POST /transfer/{reference}/approve
+func (s *APIServer) handleApproveTransfer(engine TransferEngine) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		reference, err := pendingReference(r)
+		if err != nil {
+			return err
+		}
+		s := s.forRequest(r)
+		receipt, err := s.transfers().ApproveTransfer(r.Context(), reference, engine, auditActor(r, s.config))
+		s.settleSplitShare(r.Context(), reference)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, receipt)
+	}
+}
+
+// settleSplitShare pays or releases a split share the transfer was held for
+func (s *APIServer) settleSplitShare(ctx context.Context, reference string) {
+	if err := s.splits().Settle(ctx, reference); err != nil {
+		log.Printf("Failed to settle the split share of transfer %s: %v", reference, err)
+	}
+}
+
+// POST /transfer/{reference}/reject
+func (s *APIServer) handleRejectTransfer(w http.ResponseWriter, r *http.Request) error {
+	reference, err := pendingReference(r)
+	if err != nil {
+		return err
+	}
+	var req RejectTransferRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+
+	s = s.forRequest(r)
+	pt, err := s.transfers().RejectTransfer(r.Context(), reference, req.Reason, auditActor(r, s.config))
+	s.settleSplitShare(r.Context(), reference)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, pt)
+}
+
+// GET /admin/transfers/pending, ?status= lists resolved ones instead
+func (s *APIServer) handleGetPendingTransfers(w http.ResponseWriter, r *http.Request) error {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = TransferPendingApproval
+	}
+	transfers, err := s.forRequest(r).store.GetPendingTransfers(r.Context(), status)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, transfers)
+}
+
+// pendingTransferReceipt looks a reference up among transfers that haven't settled
+func pendingTransferReceipt(ctx context.Context, store Storage, reference string, err error) (*TransferReceipt, error) {
+	if !errors.Is(err, ErrTransferNotFound) {
+		return nil, err
+	}
+	pt, perr := store.GetPendingTransfer(ctx, reference)
+	if perr != nil {
+		return nil, err
+	}
+	return pt.receipt(), nil
+}
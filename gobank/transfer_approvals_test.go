@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransferApproval(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9501, Balance: 100000, Currency: "USD", EmailVerified: true}))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9502, Currency: "USD"}))
+
+	transfers := NewTransferService(store, TransferLimits{ApprovalAbove: 50000}, staticRateProvider{}, nil, nil)
+	engine, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	transfer := func(amount float64) (*TransferReceipt, error) {
+		receipt, _, err := transfers.Transfer(ctx, TransferRequest{FromAccountNumber: 9501, ToAccountNumber: 9502, Amount: amount}, engine, "account:9501")
+		return receipt, err
+	}
+
+	large, err := transfer(600)
+	require.Nil(t, err)
+	assert.Equal(t, TransferPendingApproval, large.Status)
+	assert.Equal(t, int64(100000), store.accounts[1].Balance, "nothing is booked yet")
+
+	// The reserved amount isn't available to other transfers
+	_, err = transfer(450)
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	assert.Contains(t, err.Error(), "reserved")
+	_, err = transfer(400)
+	require.Nil(t, err)
+
+	receipt, err := transfers.ApproveTransfer(ctx, large.Reference, engine, "admin")
+	require.Nil(t, err)
+	assert.Equal(t, large.Reference, receipt.Reference, "performed under the reference the customer was given")
+	assert.Equal(t, TransferSettled, receipt.Status)
+	assert.Equal(t, int64(0), store.accounts[1].Balance)
+	assert.Equal(t, int64(100000), store.accounts[2].Balance)
+
+	_, err = transfers.ApproveTransfer(ctx, large.Reference, engine, "admin")
+	assert.ErrorIs(t, err, ErrTransferResolved)
+
+	// Rejecting only releases the reservation
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9503, Balance: 80000, Currency: "USD", EmailVerified: true}))
+	pending, _, err := transfers.Transfer(ctx, TransferRequest{FromAccountNumber: 9503, ToAccountNumber: 9502, Amount: 700}, engine, "account:9503")
+	require.Nil(t, err)
+	rejected, err := transfers.RejectTransfer(ctx, pending.Reference, "beneficiary not verified", "admin")
+	require.Nil(t, err)
+	assert.Equal(t, TransferRejected, rejected.Status)
+	reservations, err := store.GetReservations(ctx, 3, true)
+	require.Nil(t, err)
+	assert.Empty(t, reservations)
+	assert.Equal(t, int64(80000), store.accounts[3].Balance)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// TransferEngine moves funds between two accounts atomically. Handlers
+// validate the request and limits, the engine only executes it.
+type TransferEngine interface {
+	Name() string
+	Execute(ctx context.Context, from, to *Account, conv Conversion) error
+}
+
+// Engines that hold a Storage implement this so request-scoped storage
+// (see forRequest) reaches the queries they run
+type storageBoundEngine interface {
+	WithStorage(store Storage) TransferEngine
+}
+
+type transferEngineFactory func(store Storage, cfg *Config) (TransferEngine, error)
+
+var transferEngines = map[string]transferEngineFactory{}
+
+func registerTransferEngine(name string, factory transferEngineFactory) {
+	if _, ok := transferEngines[name]; ok {
+		panic("transfer engine registered twice: " + name)
+	}
+	transferEngines[name] = factory
+}
+
+func NewTransferEngine(name string, store Storage, cfg *Config) (TransferEngine, error) {
+	factory, ok := transferEngines[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown transfer engine %q (available: %v)", name, transferEngineNames())
+	}
+	return factory(store, cfg)
+}
+
+func transferEngineNames() []string {
+	names := make([]string, 0, len(transferEngines))
+	for name := range transferEngines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	registerTransferEngine("balance", func(store Storage, cfg *Config) (TransferEngine, error) {
+		return &balanceTransferEngine{store: store}, nil
+	})
+}
+
+// balanceTransferEngine updates both balances and records the transfer in one DB transaction
+type balanceTransferEngine struct {
+	store Storage
+}
+
+func (e *balanceTransferEngine) Name() string {
+	return "balance"
+}
+
+func (e *balanceTransferEngine) WithStorage(store Storage) TransferEngine {
+	return &balanceTransferEngine{store: store}
+}
+
+func (e *balanceTransferEngine) Execute(ctx context.Context, from, to *Account, conv Conversion) error {
+	// Begin database transaction
+	tx, err := e.store.BeginTransaction(ctx)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// Debit the source and credit the destination in one balanced entry
+	if err := e.store.PostLedgerEntry(ctx, transferEntry(ctx, from, to, conv), tx); err != nil {
+		return fmt.Errorf("failed to post transfer: %w", err)
+	}
+
+	// Record the transfer so it counts towards daily limits
+	if err := e.store.RecordTransfer(ctx, from.ID, to.ID, conv, tx); err != nil {
+		return fmt.Errorf("failed to record transfer: %w", err)
+	}
+
+	// Commit transaction
+	return commitTransfer(ctx, e.store, tx)
+}
+
+// commitTransfer commits a transfer's transaction. The database applies a
+// transaction entirely or not at all, so no caller ever sees one balance
+// updated without the other, but a commit error on its own doesn't say which
+// of the two happened: the connection can drop after the server committed
+// and before the acknowledgement arrived.
+//
+// Recovery goes through the transfer's reference, which is written inside
+// the same transaction:
+//
+//  1. Commit fails, look the reference up.
+//  2. Found: the transfer was applied, report success.
+//  3. Not found: nothing was applied, report the commit error. Retrying is safe.
+//  4. Lookup fails too (the partition persists): report ErrTransferUnconfirmed
+//     with the reference. Retrying is NOT safe, the transfer may have gone
+//     through. Clients poll GET /transfer/{reference} and operators
+//     reconcile with the same lookup once the database is reachable.
+func commitTransfer(ctx context.Context, store Storage, tx Transaction) error {
+	err := tx.Commit()
+	if err == nil {
+		return nil
+	}
+
+	reference := transferReference(ctx)
+	if reference == "" {
+		return fmt.Errorf("failed to commit transfer: %v", err)
+	}
+
+	_, lookupErr := store.GetTransferReceipt(ctx, reference)
+	switch {
+	case lookupErr == nil:
+		log.Printf("Commit of transfer %s reported %v but the transfer was applied", reference, err)
+		return nil
+	case errors.Is(lookupErr, ErrTransferNotFound):
+		return fmt.Errorf("failed to commit transfer: %w", err)
+	default:
+		log.Printf("Outcome of transfer %s unknown, commit failed with %v and lookup with %v", reference, err, lookupErr)
+		return fmt.Errorf("%w, look up transfer %s before retrying", ErrTransferUnconfirmed, reference)
+	}
+}
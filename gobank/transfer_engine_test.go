@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Every registered engine needs a fixture here and must pass the conformance suite
+type transferEngineFixture interface {
+	Engine() TransferEngine
+	NewAccount(t *testing.T, balance int64) *Account
+	Balance(t *testing.T, acc *Account) int64
+	Receipt(t *testing.T, reference string) *TransferReceipt
+}
+
+var transferEngineFixtures = map[string]func(t *testing.T) transferEngineFixture{
+	"balance": func(t *testing.T) transferEngineFixture {
+		store := newMemoryStorage()
+		engine, err := NewTransferEngine("balance", store, &Config{})
+		require.Nil(t, err)
+		return &memoryEngineFixture{engine: engine, store: store}
+	},
+}
+
+type memoryEngineFixture struct {
+	engine TransferEngine
+	store  *memoryStorage
+}
+
+func (f *memoryEngineFixture) Engine() TransferEngine {
+	return f.engine
+}
+
+func (f *memoryEngineFixture) NewAccount(t *testing.T, balance int64) *Account {
+	acc := &Account{Number: int64(rand.Intn(1000000)), Balance: balance}
+	require.Nil(t, f.store.CreateAccount(context.Background(), acc))
+	return acc
+}
+
+func (f *memoryEngineFixture) Balance(t *testing.T, acc *Account) int64 {
+	stored, err := f.store.GetAccountbyID(context.Background(), acc.ID)
+	require.Nil(t, err)
+	return stored.Balance
+}
+
+func (f *memoryEngineFixture) Receipt(t *testing.T, reference string) *TransferReceipt {
+	receipt, err := f.store.GetTransferReceipt(context.Background(), reference)
+	require.Nil(t, err)
+	return receipt
+}
+
+func TestTransferEngineConformance(t *testing.T) {
+	for _, name := range transferEngineNames() {
+		newFixture, ok := transferEngineFixtures[name]
+		if !assert.True(t, ok, "transfer engine %q has no conformance fixture", name) {
+			continue
+		}
+
+		t.Run(name, func(t *testing.T) {
+			t.Run("moves funds", func(t *testing.T) {
+				f := newFixture(t)
+				from := f.NewAccount(t, 10000)
+				to := f.NewAccount(t, 500)
+
+				require.Nil(t, f.Engine().Execute(context.Background(), from, to, sameCurrency(DefaultCurrency, 25.50)))
+
+				assert.Equal(t, int64(7450), f.Balance(t, from))
+				assert.Equal(t, int64(3050), f.Balance(t, to))
+			})
+
+			t.Run("is atomic on failure", func(t *testing.T) {
+				f := newFixture(t)
+				from := f.NewAccount(t, 10000)
+				missing := &Account{ID: -1, Number: -1}
+
+				assert.Error(t, f.Engine().Execute(context.Background(), from, missing, sameCurrency(DefaultCurrency, 10)))
+				assert.Equal(t, int64(10000), f.Balance(t, from))
+			})
+
+			t.Run("handles cent precision", func(t *testing.T) {
+				f := newFixture(t)
+				from := f.NewAccount(t, 100)
+				to := f.NewAccount(t, 0)
+
+				require.Nil(t, f.Engine().Execute(context.Background(), from, to, sameCurrency(DefaultCurrency, 0.29)))
+
+				assert.Equal(t, int64(71), f.Balance(t, from))
+				assert.Equal(t, int64(29), f.Balance(t, to))
+			})
+
+			t.Run("records the reference", func(t *testing.T) {
+				f := newFixture(t)
+				from := f.NewAccount(t, 1000)
+				to := f.NewAccount(t, 0)
+				reference := newTransferReference()
+
+				ctx := withTransferReference(context.Background(), reference)
+				require.Nil(t, f.Engine().Execute(ctx, from, to, sameCurrency(DefaultCurrency, 4.20)))
+
+				receipt := f.Receipt(t, reference)
+				assert.Equal(t, from.Number, receipt.FromAccount)
+				assert.Equal(t, to.Number, receipt.ToAccount)
+				assert.Equal(t, 4.20, receipt.Amount)
+			})
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// In async mode /transfer only validates the request and queues it in
+// transfer_job, answering 202 with the job's ID. The ID is also the
+// reference the transfer is performed under, so once it succeeded
+// GET /transfer/{reference} finds it too. Transfer workers poll the queue
+// every TransferQueueInterval, lease due jobs and perform them. Transient
+// failures, like concurrent updates or an unavailable upstream, are retried
+// with exponential backoff from TransferQueueRetryDelay up to
+// TransferQueueMaxAttempts. Anything else fails the job straight away.
+//
+// A worker that dies mid-transfer leaves its lease to run out and the job
+// is picked up again. Before performing a job the worker looks its
+// reference up, a transfer that already happened isn't performed twice.
+// Queued transfers always run on the primary engine, canary routing only
+// applies to synchronous ones.
+
+const (
+	TransferModeSync  = "sync"
+	TransferModeAsync = "async"
+
+	TransferJobQueued     = "queued"
+	TransferJobProcessing = "processing"
+	TransferJobSucceeded  = "succeeded"
+	TransferJobFailed     = "failed"
+
+	// How long a worker may hold a job before another one takes it over
+	transferJobLease = time.Minute
+)
+
+type TransferJob struct {
+	ID            string           `json:"id"`
+	Status        string           `json:"status"`
+	Request       TransferRequest  `json:"request"`
+	Actor         string           `json:"-"`
+	Attempts      int              `json:"attempts"`
+	NextAttemptAt time.Time        `json:"next_attempt_at"`
+	LastError     string           `json:"last_error,omitempty"`
+	Receipt       *TransferReceipt `json:"receipt,omitempty"`
+	CreatedAt     time.Time        `json:"created_at"`
+	UpdatedAt     time.Time        `json:"updated_at"`
+}
+
+// retryableTransferError is true for failures that may go away on their own
+func retryableTransferError(err error) bool {
+	if errors.Is(err, ErrConflict) || errors.Is(err, ErrSerializationFailure) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	status, _ := apiErrorFor(err)
+	return status >= http.StatusInternalServerError
+}
+
+// enqueueTransfer stores the request for the transfer workers, its PIN is
+// checked now and not kept
+func (s *APIServer) enqueueTransfer(ctx context.Context, req TransferRequest, actor string) (*TransferJob, error) {
+	if s.transferLimits.PIN.required(toCents(req.Amount)) {
+		from, err := s.store.GetAccountByNumber(ctx, req.FromAccountNumber)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source account")
+		}
+		if err := checkTransactionPIN(ctx, s.store, s.transferLimits.PIN, from, toCents(req.Amount), req.PIN); err != nil {
+			return nil, err
+		}
+	}
+	req.PIN = ""
+
+	now := time.Now().UTC()
+	job := &TransferJob{
+		ID:            newTransferReference(),
+		Status:        TransferJobQueued,
+		Request:       req,
+		Actor:         actor,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if err := s.store.CreateTransferJob(ctx, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+type transferQueueRunner struct {
+	api         *APIServer
+	engine      TransferEngine
+	workers     int
+	maxAttempts int
+	retryDelay  time.Duration
+}
+
+// transferQueue has its own scheduler, it polls far more often than the
+// background jobs and runs whether or not they're enabled
+func (s *APIServer) transferQueue(engine TransferEngine) *Scheduler {
+	runner := &transferQueueRunner{
+		api:         s,
+		engine:      engine,
+		workers:     max(s.config.TransferQueueWorkers, 1),
+		maxAttempts: max(s.config.TransferQueueMaxAttempts, 1),
+		retryDelay:  s.config.TransferQueueRetryDelay,
+	}
+
+	scheduler := NewScheduler()
+	scheduler.Register(Job{
+		Name:     "transfer-queue",
+		Interval: s.config.TransferQueueInterval,
+		Run:      runner.run,
+	})
+	return scheduler
+}
+
+// run performs the due jobs with up to workers at a time
+func (q *transferQueueRunner) run(ctx context.Context) error {
+	now := time.Now().UTC()
+
+	due, err := q.api.store.GetDueTransferJobs(ctx, now, 100)
+	if err != nil {
+		return err
+	}
+	setJobQueueDepth("transfer_queue", len(due))
+
+	jobs := make(chan *TransferJob)
+	var wg sync.WaitGroup
+	for range q.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				q.process(ctx, job, now)
+			}
+		}()
+	}
+	for _, job := range due {
+		jobs <- job
+	}
+	close(jobs)
+	wg.Wait()
+	return nil
+}
+
+func (q *transferQueueRunner) process(ctx context.Context, job *TransferJob, now time.Time) {
+	// Lease the job so another worker or instance doesn't pick it up mid-run
+	claimed, err := q.api.store.ClaimTransferJob(ctx, job.ID, now, now.Add(transferJobLease))
+	if err != nil {
+		log.Printf("Failed to claim transfer job %s: %v", job.ID, err)
+		return
+	}
+	if !claimed {
+		return
+	}
+	job.Attempts++
+
+	q.execute(ctx, job)
+
+	job.UpdatedAt = time.Now().UTC()
+	if err := q.api.store.UpdateTransferJob(ctx, job); err != nil {
+		log.Printf("Failed to update transfer job %s: %v", job.ID, err)
+	}
+}
+
+// execute performs the job's transfer and moves it on, failures are retried
+// after retryDelay doubled for each attempt so far
+func (q *transferQueueRunner) execute(ctx context.Context, job *TransferJob) {
+	ctx = withPINVerified(withTransferReference(ctx, job.ID))
+
+	receipt, err := q.api.store.GetTransferReceipt(ctx, job.ID)
+	if err != nil {
+		receipt, err = pendingTransferReceipt(ctx, q.api.store, job.ID, err)
+	}
+	if errors.Is(err, ErrTransferNotFound) {
+		receipt, _, err = q.api.transfers().Transfer(ctx, job.Request, q.engine, job.Actor)
+	}
+
+	if err == nil {
+		job.Status, job.Receipt, job.LastError = TransferJobSucceeded, receipt, ""
+		return
+	}
+
+	job.LastError = err.Error()
+	if !retryableTransferError(err) || job.Attempts >= q.maxAttempts {
+		job.Status = TransferJobFailed
+		log.Printf("Transfer job %s failed after %d attempts: %v", job.ID, job.Attempts, err)
+		return
+	}
+	job.Status = TransferJobQueued
+	job.NextAttemptAt = time.Now().UTC().Add(q.retryDelay << (job.Attempts - 1))
+}
+
+// GET /transfer/status/{id}
+func (s *APIServer) handleGetTransferJob(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+	if !validReference.MatchString(id) {
+		return invalidParam("path", "id", "uuid", "must be the tracking ID returned by /transfer")
+	}
+	job, err := s.forRequest(r).store.GetTransferJob(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, job)
+}
+
+// marshalTransferJob encodes the request and receipt columns of a job, the
+// receipt is nil until the transfer succeeded
+func marshalTransferJob(job *TransferJob) (request string, receipt *string, err error) {
+	data, err := json.Marshal(job.Request)
+	if err != nil {
+		return "", nil, err
+	}
+	if job.Receipt != nil {
+		encoded, err := json.Marshal(job.Receipt)
+		if err != nil {
+			return "", nil, err
+		}
+		r := string(encoded)
+		receipt = &r
+	}
+	return string(data), receipt, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyEngine fails its first calls as an unavailable upstream would
+type flakyEngine struct {
+	TransferEngine
+	failures int
+}
+
+func (e *flakyEngine) Execute(ctx context.Context, from, to *Account, conv Conversion) error {
+	if e.failures > 0 {
+		e.failures--
+		return ErrUpstreamUnavailable
+	}
+	return e.TransferEngine.Execute(ctx, from, to, conv)
+}
+
+func TestTransferQueue(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStorage()
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9801, Balance: 10000, Currency: "USD", EmailVerified: true}))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9802, Currency: "USD"}))
+
+	s := NewAPIServer(&Config{TransferMode: TransferModeAsync}, store)
+	balance, err := NewTransferEngine("balance", store, &Config{})
+	require.Nil(t, err)
+	engine := &flakyEngine{TransferEngine: balance, failures: 1}
+	queue := &transferQueueRunner{api: s, engine: engine, workers: 2, maxAttempts: 3}
+
+	enqueue := func(amount float64) *TransferJob {
+		body, _ := json.Marshal(TransferRequest{FromAccountNumber: 9801, ToAccountNumber: 9802, Amount: amount})
+		w := httptest.NewRecorder()
+		makeHTTPHandle(s.handleTransfer(engine))(w, httptest.NewRequest("POST", "/v1/transfer", bytes.NewReader(body)))
+		require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+		job := &TransferJob{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), job))
+		assert.Equal(t, "/v1/transfer/status/"+job.ID, w.Header().Get("Location"))
+		return job
+	}
+	status := func(id string) *TransferJob {
+		r := mux.SetURLVars(httptest.NewRequest("GET", "/v1/transfer/status/"+id, nil), map[string]string{"id": id})
+		w := httptest.NewRecorder()
+		makeHTTPHandle(s.handleGetTransferJob)(w, r)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		job := &TransferJob{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), job))
+		return job
+	}
+
+	job := enqueue(40)
+	assert.Equal(t, TransferJobQueued, job.Status)
+	assert.Equal(t, int64(10000), store.accounts[1].Balance, "nothing moves until a worker runs")
+
+	// The unavailable upstream is retried, the transfer keeps the job's ID as its reference
+	require.Nil(t, queue.run(ctx))
+	got := status(job.ID)
+	assert.Equal(t, TransferJobQueued, got.Status)
+	assert.Equal(t, 1, got.Attempts)
+	assert.Contains(t, got.LastError, "unavailable")
+
+	require.Nil(t, queue.run(ctx))
+	got = status(job.ID)
+	require.Equal(t, TransferJobSucceeded, got.Status)
+	assert.Equal(t, 2, got.Attempts)
+	assert.Equal(t, job.ID, got.Receipt.Reference)
+	assert.Equal(t, int64(6000), store.accounts[1].Balance)
+
+	// Business errors aren't retried
+	failed := enqueue(500)
+	require.Nil(t, queue.run(ctx))
+	got = status(failed.ID)
+	assert.Equal(t, TransferJobFailed, got.Status)
+	assert.Equal(t, 1, got.Attempts)
+
+	// A job whose transfer went through before its worker died isn't repeated
+	stale := enqueue(10)
+	store.jobs[2].Status, store.jobs[2].NextAttemptAt = TransferJobProcessing, time.Now().Add(-time.Second)
+	_, _, err = s.transfers().Transfer(withTransferReference(ctx, stale.ID), stale.Request, balance, "test")
+	require.Nil(t, err)
+	require.Nil(t, queue.run(ctx))
+	assert.Equal(t, TransferJobSucceeded, status(stale.ID).Status)
+	assert.Equal(t, int64(5000), store.accounts[1].Balance)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"expvar"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Transfers run at TRANSFER_ISOLATION, serializable by default, so Postgres
+// refuses any interleaving no serial order of the transactions could have
+// produced. The refused transaction fails with SQLSTATE 40001, or 40P01 when
+// it was picked as a deadlock victim, and has changed nothing: execute runs
+// it again on fresh reads after a capped exponential backoff. Version
+// conflicts (ErrConflict) go through the same loop.
+//
+// Retries by reason and the time transactions stay open are published under
+// transfer_retries and db_transactions in /debug/vars, a climbing
+// serialization_failure count is the cue to relax the isolation level.
+
+var (
+	transferRetries = expvar.NewMap("transfer_retries")
+	dbTransactions  = expvar.NewMap("db_transactions")
+)
+
+var isolationLevels = map[string]sql.IsolationLevel{
+	"":                sql.LevelDefault,
+	"read committed":  sql.LevelReadCommitted,
+	"repeatable read": sql.LevelRepeatableRead,
+	"serializable":    sql.LevelSerializable,
+}
+
+type TransferRetryPolicy struct {
+	Isolation sql.IsolationLevel
+
+	Attempts   int           // zero means transferConflictRetries
+	Backoff    time.Duration // before the first retry, zero retries at once
+	MaxBackoff time.Duration // zero leaves the backoff uncapped
+}
+
+func NewTransferRetryPolicy(cfg *Config) TransferRetryPolicy {
+	level, ok := isolationLevels[strings.ToLower(cfg.TransferIsolation)]
+	if !ok {
+		log.Printf("Unknown TRANSFER_ISOLATION %q, transfers use the database default", cfg.TransferIsolation)
+	}
+	return TransferRetryPolicy{
+		Isolation:  level,
+		Attempts:   cfg.TransferRetries,
+		Backoff:    cfg.TransferRetryBackoff,
+		MaxBackoff: cfg.TransferRetryMaxBackoff,
+	}
+}
+
+func (p TransferRetryPolicy) attempts() int {
+	if p.Attempts > 0 {
+		return p.Attempts
+	}
+	return transferConflictRetries
+}
+
+// delay before the given retry, 1 for the first. It doubles each time up to
+// MaxBackoff and picks a point in its upper half so racing transfers spread out.
+func (p TransferRetryPolicy) delay(retry int) time.Duration {
+	if p.Backoff <= 0 {
+		return 0
+	}
+	d := p.Backoff << min(retry-1, 30)
+	if d <= 0 || (p.MaxBackoff > 0 && d > p.MaxBackoff) {
+		d = p.MaxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// wait sleeps before the given retry, or returns early with ctx's error
+func (p TransferRetryPolicy) wait(ctx context.Context, retry int) error {
+	d := p.delay(retry)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// retryReason names why another attempt at a failed transfer may succeed,
+// empty when it won't
+func retryReason(err error) string {
+	switch {
+	case errors.Is(err, ErrConflict):
+		return "conflict"
+	case isSerializationFailure(err):
+		return "serialization_failure"
+	}
+	return ""
+}
+
+func isSerializationFailure(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+	return errors.Is(err, ErrSerializationFailure)
+}
+
+type txIsolationKey struct{}
+
+// withTxIsolation makes transactions begun with ctx run at level
+func withTxIsolation(ctx context.Context, level sql.IsolationLevel) context.Context {
+	return context.WithValue(ctx, txIsolationKey{}, level)
+}
+
+func txOptions(ctx context.Context) *sql.TxOptions {
+	level, _ := ctx.Value(txIsolationKey{}).(sql.IsolationLevel)
+	if level == sql.LevelDefault {
+		return nil
+	}
+	return &sql.TxOptions{Isolation: level}
+}
+
+func recordTransaction(outcome string, started time.Time) {
+	dbTransactions.Add(outcome, 1)
+	dbTransactions.AddFloat("open_ms", float64(time.Since(started).Microseconds())/1000)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serializingStorage fails the first failures postings like Postgres does
+// when a serializable transaction loses to a concurrent one
+type serializingStorage struct {
+	*memoryStorage
+	failures  int
+	isolation sql.IsolationLevel
+}
+
+func (s *serializingStorage) PostLedgerEntry(ctx context.Context, entry *LedgerEntry, tx Transaction) error {
+	s.isolation, _ = ctx.Value(txIsolationKey{}).(sql.IsolationLevel)
+	if s.failures > 0 {
+		s.failures--
+		return &pq.Error{Code: "40001", Message: "could not serialize access due to read/write dependencies among transactions"}
+	}
+	return s.memoryStorage.PostLedgerEntry(ctx, entry, tx)
+}
+
+func TestTransferSerializationRetries(t *testing.T) {
+	ctx := context.Background()
+	policy := NewTransferRetryPolicy(&Config{TransferIsolation: "serializable", TransferRetries: 3, TransferRetryBackoff: time.Millisecond})
+
+	setup := func(failures int) (*serializingStorage, error) {
+		store := &serializingStorage{memoryStorage: newMemoryStorage(), failures: failures}
+		require.Nil(t, store.CreateAccount(ctx, &Account{Number: 1501, Balance: 5000, Currency: "USD"}))
+		require.Nil(t, store.CreateAccount(ctx, &Account{Number: 1502, Currency: "USD"}))
+
+		engine, err := NewTransferEngine("balance", store, &Config{})
+		require.Nil(t, err)
+		_, _, err = NewTransferService(store, TransferLimits{Retry: policy}, staticRateProvider{}, nil, nil).
+			Transfer(ctx, TransferRequest{FromAccountNumber: 1501, ToAccountNumber: 1502, Amount: 30}, engine, "test")
+		return store, err
+	}
+
+	retried := expvarInt(transferRetries, "serialization_failure")
+	store, err := setup(2)
+	require.Nil(t, err)
+	assert.Equal(t, sql.LevelSerializable, store.isolation)
+	from, _ := store.GetAccountByNumber(ctx, 1501)
+	assert.Equal(t, int64(2000), from.Balance, "applied once")
+	assert.Equal(t, retried+2, expvarInt(transferRetries, "serialization_failure"))
+
+	_, err = setup(3)
+	assert.ErrorIs(t, err, ErrSerializationFailure)
+	status, apiErr := apiErrorFor(err)
+	assert.Equal(t, 409, status)
+	assert.Equal(t, "SERIALIZATION_FAILURE", apiErr.Code)
+}
+
+func TestTransferRetryDelay(t *testing.T) {
+	p := TransferRetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	for retry, upper := range map[int]time.Duration{1: 10, 2: 20, 3: 40, 4: 50, 40: 50} {
+		d := p.delay(retry)
+		assert.LessOrEqual(t, d, upper*time.Millisecond, "retry %d", retry)
+		assert.GreaterOrEqual(t, d, upper*time.Millisecond/2, "retry %d", retry)
+	}
+	assert.Zero(t, TransferRetryPolicy{}.delay(1))
+
+	assert.Equal(t, sql.LevelDefault, NewTransferRetryPolicy(&Config{TransferIsolation: "chaos"}).Isolation)
+}
+
+func expvarInt(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
@@ -3,27 +3,46 @@ package main
 import (
 	"math/rand"
 	"time"
+)
 
-	"golang.org/x/crypto/bcrypt"
+// Account statuses. Closed accounts are kept for history but can't transact.
+// Dormant accounts can log in and receive money but send nothing until reactivated.
+const (
+	AccountActive  = "active"
+	AccountFrozen  = "frozen"
+	AccountClosed  = "closed"
+	AccountDormant = "dormant"
 )
 
 type Account struct {
-	ID                int       `json:"id"`
-	FirstName         string    `json:"first_name"`
-	LastName          string    `json:"last_name"`
-	Number            int64     `json:"account_number"`
-	EncryptedPassword string    `json:"-"`
-	Balance           int64     `json:"balance"`
-	CreatedAt         time.Time `json:"created_at"`
+	ID                int             `json:"id"`
+	FirstName         string          `json:"first_name"`
+	LastName          string          `json:"last_name"`
+	Number            int64           `json:"account_number"`
+	EncryptedPassword string          `json:"-"`
+	Balance           int64           `json:"balance"`
+	AvailableBalance  *int64          `json:"available_balance,omitempty"` // filled in by GetAccount, net of holds and reservations
+	Currency          string          `json:"currency"`
+	Status            string          `json:"status"`
+	OverdraftLimit    int64           `json:"overdraft_limit"`
+	MergedInto        int             `json:"merged_into,omitempty"`
+	ClosedAt          *time.Time      `json:"closed_at,omitempty"`
+	Email             string          `json:"email,omitempty"`
+	EmailVerified     bool            `json:"email_verified"`
+	Nickname          string          `json:"nickname,omitempty"` // set by the owner, see account_metadata.go
+	Metadata          AccountMetadata `json:"metadata,omitempty"`
+	LastActivityAt    time.Time       `json:"last_activity_at"`
+	CreatedAt         time.Time       `json:"created_at"`
+	Version           int64           `json:"-"` // bumped by every versioned update, see UpdateAccount
 }
 
 func (a *Account) ValidatePassword(pw string) bool {
-	return bcrypt.CompareHashAndPassword([]byte(a.EncryptedPassword), []byte(pw)) == nil
+	return passwords.Verify(a.EncryptedPassword, pw)
 
 }
 
 func NewAccount(firstName string, lastName string, password string) (*Account, error) {
-	encpw, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	encpw, err := passwords.Hash(password)
 	if err != nil {
 		return nil, err
 	}
@@ -32,15 +51,20 @@ func NewAccount(firstName string, lastName string, password string) (*Account, e
 		FirstName:         firstName,
 		LastName:          lastName,
 		Number:            int64(rand.Intn(1000000)),
-		EncryptedPassword: string(encpw),
+		EncryptedPassword: encpw,
+		Currency:          DefaultCurrency,
+		Status:            AccountActive,
+		LastActivityAt:    time.Now().UTC(),
 		CreatedAt:         time.Now().UTC(),
 	}, nil
 }
 
 type CreateAccountRequest struct {
-	FirstName string `json:"firstName"`
-	LastName  string `json:"lastName"`
-	Password  string `json:"password"`
+	FirstName string `json:"firstName" validate:"required,max=100,name"`
+	LastName  string `json:"lastName" validate:"required,max=100,name"`
+	Password  string `json:"password" validate:"required,min=8,max=72"` // bcrypt ignores anything past 72 bytes
+	Currency  string `json:"currency" validate:"max=3"`
+	Email     string `json:"email" validate:"max=254"`
 }
 
 // type TransferRequest struct {
@@ -49,8 +73,8 @@ type CreateAccountRequest struct {
 // }
 
 type LoginRequest struct {
-	Number   int64  `json:"number"`
-	Password string `json:"password"`
+	Number   int64  `json:"number" validate:"required,positive"`
+	Password string `json:"password" validate:"required,max=72"`
 }
 
 type LoginResponse struct {
@@ -63,11 +87,17 @@ type PublicAccount struct {
 	FirstName     string    `json:"first_name"`
 	LastName      string    `json:"last_name"`
 	AccountNumber int64     `json:"account_number"`
+	Currency      string    `json:"currency"`
+	Status        string    `json:"status"`
 	CreatedAt     time.Time `json:"created_at"`
 }
 
 type TransferRequest struct {
-	FromAccountNumber int64   `json:"fromAccount"`
-	ToAccountNumber   int64   `json:"toAccount"`
-	Amount            float64 `json:"amount"`
+	FromAccountNumber int64   `json:"fromAccount" validate:"required,positive"`
+	ToAccountNumber   int64   `json:"toAccount" validate:"min=1"`           // unless ToAlias is sent
+	ToAlias           string  `json:"toAlias,omitempty" validate:"max=254"` // a verified phone or email alias of the payee
+	Amount            float64 `json:"amount" validate:"positive"`
+	Category          string  `json:"category,omitempty" validate:"max=50"`
+	Memo              string  `json:"memo,omitempty" validate:"max=140"`
+	PIN               string  `json:"pin,omitempty" validate:"numeric,min=4,max=6"` // needed above TRANSACTION_PIN_THRESHOLD
 }
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Request payloads declare their rules in a validate struct tag, e.g.
+// `validate:"required,max=100,name"`. Rules are checked in order and the
+// first failing rule is reported for each field. Nested structs and slices
+// of structs are validated too.
+//
+//	required  the field must not be the zero value
+//	min=N     strings need at least N characters, numbers a value of at least N
+//	max=N     strings may have at most N characters, numbers a value of at most N
+//	positive  numbers must be greater than zero
+//	numeric   digits only
+//	name      letters, spaces, hyphens, apostrophes and periods only
+//	url       an absolute http or https URL
+//	oneof=A B the value must be one of the space separated options
+//
+// The length and charset rules are skipped for empty values, so optional
+// fields are only checked when they're sent.
+//
+// Every validation failure, whether from tags, a malformed body or a bad
+// query or path parameter, is a ValidationError listing {field, code,
+// message}. Body fields are JSON pointers into the request ("/amount",
+// "/items/0/name", "" for the whole body), parameters are their name with
+// in set to "query" or "path". The code is the rule that failed.
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	In      string `json:"in,omitempty"` // "query" or "path", empty for the body
+}
+
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		name := strings.TrimPrefix(f.Field, "/")
+		if name == "" {
+			name = "body"
+		}
+		msgs[i] = name + " " + f.Message
+	}
+	return "invalid request: " + strings.Join(msgs, ", ")
+}
+
+// invalidField reports a body field, named by its JSON name, that failed a check
+// outside its validate tags
+func invalidField(name, code, message string) *ValidationError {
+	return &ValidationError{Fields: []FieldError{{Field: jsonPointer(name), Code: code, Message: message}}}
+}
+
+// invalidParam reports a bad query or path parameter
+func invalidParam(in, name, code, message string) *ValidationError {
+	return &ValidationError{Fields: []FieldError{{Field: name, Code: code, Message: message, In: in}}}
+}
+
+// pathID parses the named path variable as an integer ID
+func pathID(r *http.Request, name string) (int, error) {
+	id, err := strconv.Atoi(mux.Vars(r)[name])
+	if err != nil {
+		return 0, invalidParam("path", name, "type", "must be an integer ID")
+	}
+	return id, nil
+}
+
+// jsonPointer builds an RFC 6901 pointer from reference tokens
+func jsonPointer(tokens ...string) string {
+	escape := strings.NewReplacer("~", "~0", "/", "~1")
+	var b strings.Builder
+	for _, token := range tokens {
+		b.WriteByte('/')
+		b.WriteString(escape.Replace(token))
+	}
+	return b.String()
+}
+
+var validName = regexp.MustCompile(`^[\p{L}][\p{L} '.-]*$`)
+
+// validateRequest checks v, a pointer to a struct, against its validate tags
+func validateRequest(v any) error {
+	fields := validateStruct("", reflect.Indirect(reflect.ValueOf(v)))
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+func validateStruct(pointer string, rv reflect.Value) []FieldError {
+	rt := rv.Type()
+
+	var fields []FieldError
+	for i := 0; i < rt.NumField(); i++ {
+		if !rt.Field(i).IsExported() {
+			continue
+		}
+		path := pointer + jsonPointer(jsonFieldName(rt.Field(i)))
+
+		if tag := rt.Field(i).Tag.Get("validate"); tag != "" {
+			if fe := checkField(path, rv.Field(i), strings.Split(tag, ",")); fe != nil {
+				fields = append(fields, *fe)
+				continue
+			}
+		}
+		fields = append(fields, validateNested(path, rv.Field(i))...)
+	}
+	return fields
+}
+
+// validateNested descends into struct, pointer and slice fields
+func validateNested(pointer string, v reflect.Value) []FieldError {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			return validateNested(pointer, v.Elem())
+		}
+	case reflect.Struct:
+		if v.Type() != reflect.TypeOf(time.Time{}) {
+			return validateStruct(pointer, v)
+		}
+	case reflect.Slice, reflect.Array:
+		if kind := v.Type().Elem().Kind(); kind != reflect.Struct && kind != reflect.Pointer {
+			return nil
+		}
+		var fields []FieldError
+		for i := 0; i < v.Len(); i++ {
+			fields = append(fields, validateNested(pointer+jsonPointer(strconv.Itoa(i)), v.Index(i))...)
+		}
+		return fields
+	}
+	return nil
+}
+
+func checkField(name string, v reflect.Value, rules []string) *FieldError {
+	for _, rule := range rules {
+		rule, arg, _ := strings.Cut(rule, "=")
+		if rule != "required" && rule != "positive" && v.IsZero() {
+			continue
+		}
+
+		var msg string
+		switch rule {
+		case "required":
+			if v.IsZero() {
+				msg = "is required"
+			}
+		case "min", "max":
+			limit, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				panic(fmt.Sprintf("validate: bad %s limit %q on %s", rule, arg, name))
+			}
+			msg = checkBound(v, rule, limit)
+		case "positive":
+			if number(v) <= 0 {
+				msg = "must be greater than zero"
+			}
+		case "numeric":
+			if strings.Trim(v.String(), "0123456789") != "" {
+				msg = "may only contain digits"
+			}
+		case "name":
+			if !validName.MatchString(v.String()) {
+				msg = "may only contain letters, spaces, hyphens, apostrophes and periods"
+			}
+		case "url":
+			if u, err := url.Parse(v.String()); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				msg = "must be an absolute http or https URL"
+			}
+		case "oneof":
+			options := strings.Fields(arg)
+			if !slices.Contains(options, v.String()) {
+				msg = "must be one of " + strings.Join(options, ", ")
+			}
+		default:
+			panic(fmt.Sprintf("validate: unknown rule %q on %s", rule, name))
+		}
+
+		if msg != "" {
+			return &FieldError{Field: name, Code: rule, Message: msg}
+		}
+	}
+	return nil
+}
+
+func checkBound(v reflect.Value, rule string, limit float64) string {
+	if v.Kind() == reflect.String {
+		n := float64(utf8.RuneCountInString(v.String()))
+		if rule == "min" && n < limit {
+			return fmt.Sprintf("must be at least %v characters", limit)
+		}
+		if rule == "max" && n > limit {
+			return fmt.Sprintf("must be at most %v characters", limit)
+		}
+		return ""
+	}
+
+	n := number(v)
+	if rule == "min" && n < limit {
+		return fmt.Sprintf("must be at least %v", limit)
+	}
+	if rule == "max" && n > limit {
+		return fmt.Sprintf("must be at most %v", limit)
+	}
+	return ""
+}
+
+func number(v reflect.Value) float64 {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	}
+	panic(fmt.Sprintf("validate: %s is not a number", v.Type()))
+}
+
+func jsonFieldName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return f.Name
+	}
+	return name
+}
+
+// decodeRequest reads a JSON body into v and validates it. Malformed bodies,
+// mistyped and unknown fields and data after the JSON value are reported as
+// validation errors too, so clients get the same per-field shape whatever
+// went wrong. Bodies over the size limit are a 413.
+func decodeRequest(r *http.Request, v any) error {
+	defer r.Body.Close()
+
+	if negotiatesDecimalAmounts(r.Header.Get("Content-Type")) {
+		if err := readDecimalRequest(r, v); err != nil {
+			var sizeErr *http.MaxBytesError
+			if errors.As(err, &sizeErr) {
+				return bodyTooLarge(sizeErr.Limit)
+			}
+			return err
+		}
+	}
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil && dec.Decode(&json.RawMessage{}) != io.EOF {
+		err = errTrailingData
+	}
+	if err != nil {
+		var typeErr *json.UnmarshalTypeError
+		var sizeErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &sizeErr):
+			return bodyTooLarge(sizeErr.Limit)
+		case strings.HasPrefix(err.Error(), unknownFieldPrefix):
+			name := strings.Trim(strings.TrimPrefix(err.Error(), unknownFieldPrefix), `"`)
+			return &ValidationError{Fields: []FieldError{{Field: jsonPointer(name), Code: "unknown", Message: "is not a known field"}}}
+		case errors.Is(err, errTrailingData):
+			return &ValidationError{Fields: []FieldError{{Field: "", Code: "json", Message: "has data after the JSON value"}}}
+		case errors.As(err, &typeErr):
+			return &ValidationError{Fields: []FieldError{{
+				Field:   jsonPointer(strings.Split(typeErr.Field, ".")...),
+				Code:    "type",
+				Message: fmt.Sprintf("must be a %s", jsonTypeName(typeErr.Type)),
+			}}}
+		case errors.Is(err, io.EOF):
+			return &ValidationError{Fields: []FieldError{{Field: "", Code: "required", Message: "is required"}}}
+		default:
+			return &ValidationError{Fields: []FieldError{{Field: "", Code: "json", Message: "is not valid JSON"}}}
+		}
+	}
+
+	return validateRequest(v)
+}
+
+// encoding/json has no error type for these
+const unknownFieldPrefix = "json: unknown field "
+
+var errTrailingData = errors.New("data after the JSON value")
+
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	}
+	return "object"
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateRequest(t *testing.T) {
+	assert.Nil(t, validateRequest(&CreateAccountRequest{FirstName: "Anne-Marie", LastName: "O'Neil", Password: "password"}))
+	assert.Nil(t, validateRequest(&TransferRequest{FromAccountNumber: 1, ToAccountNumber: 2, Amount: 0.01}))
+
+	var verr *ValidationError
+	err := validateRequest(&CreateAccountRequest{LastName: "R2-D2", Password: "short", Currency: "EURO"})
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, []FieldError{
+		{Field: "/firstName", Code: "required", Message: "is required"},
+		{Field: "/lastName", Code: "name", Message: "may only contain letters, spaces, hyphens, apostrophes and periods"},
+		{Field: "/password", Code: "min", Message: "must be at least 8 characters"},
+		{Field: "/currency", Code: "max", Message: "must be at most 3 characters"},
+	}, verr.Fields)
+
+	err = validateRequest(&TransferRequest{FromAccountNumber: 1, ToAccountNumber: -2, Amount: 0})
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, []string{"/toAccount", "/amount"}, []string{verr.Fields[0].Field, verr.Fields[1].Field})
+	assert.Equal(t, "positive", verr.Fields[1].Code)
+
+	assert.Nil(t, validateRequest(&TransferRequest{FromAccountNumber: 1, ToAccountNumber: 2, Amount: 1, PIN: "0420"}))
+	err = validateRequest(&TransferRequest{FromAccountNumber: 1, ToAccountNumber: 2, Amount: 1, PIN: "12a4"})
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, []FieldError{{Field: "/pin", Code: "numeric", Message: "may only contain digits"}}, verr.Fields)
+
+	err = validateRequest(&CreateScheduledTransferRequest{ToAccountNumber: 2, Amount: 5, Frequency: "hourly"})
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, []FieldError{{Field: "/frequency", Code: "oneof", Message: "must be one of daily, weekly, monthly"}}, verr.Fields)
+}
+
+func TestValidateNestedPointers(t *testing.T) {
+	type item struct {
+		Name string `json:"name" validate:"required"`
+	}
+	type batch struct {
+		Label string  `json:"a/b" validate:"max=3"`
+		Items []item  `json:"items"`
+		Owner *item   `json:"owner"`
+		Refs  []int64 `json:"refs"`
+	}
+
+	var verr *ValidationError
+	err := validateRequest(&batch{Label: "long", Items: []item{{Name: "ok"}, {}}, Owner: &item{}, Refs: []int64{1}})
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, []string{"/a~1b", "/items/1/name", "/owner/name"}, []string{verr.Fields[0].Field, verr.Fields[1].Field, verr.Fields[2].Field})
+}
+
+func TestDecodeRequestErrors(t *testing.T) {
+	handler := makeHTTPHandle(func(w http.ResponseWriter, r *http.Request) error {
+		var req LoginRequest
+		if err := decodeRequest(r, &req); err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, req)
+	})
+
+	post := func(body string) (int, ApiError) {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "/login", strings.NewReader(body)))
+		var apiErr ApiError
+		json.NewDecoder(w.Body).Decode(&apiErr)
+		return w.Code, apiErr
+	}
+
+	status, apiErr := post(`{"number": "123", "password": "x"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.Equal(t, "VALIDATION_FAILED", apiErr.Code)
+	assert.Equal(t, []FieldError{{Field: "/number", Code: "type", Message: "must be a number"}}, apiErr.Fields)
+
+	status, apiErr = post(`{"number": 123`)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.Equal(t, []FieldError{{Field: "", Code: "json", Message: "is not valid JSON"}}, apiErr.Fields)
+
+	_, apiErr = post(`{"number": 123, "pasword": "password"}`)
+	assert.Equal(t, []FieldError{{Field: "/pasword", Code: "unknown", Message: "is not a known field"}}, apiErr.Fields)
+
+	_, apiErr = post(`{"number": 123, "password": "password"} {"number": 456}`)
+	assert.Equal(t, []FieldError{{Field: "", Code: "json", Message: "has data after the JSON value"}}, apiErr.Fields)
+
+	_, apiErr = post(`{}`)
+	assert.Len(t, apiErr.Fields, 2)
+
+	status, _ = post(`{"number": 123, "password": "password"}`)
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestParameterErrors(t *testing.T) {
+	s := NewAPIServer(&Config{}, newMemoryStorage())
+
+	get := func(target string, vars map[string]string) (int, ApiError) {
+		w := httptest.NewRecorder()
+		makeHTTPHandle(s.handleGetTransactions)(w, mux.SetURLVars(httptest.NewRequest("GET", target, nil), vars))
+		var apiErr ApiError
+		json.NewDecoder(w.Body).Decode(&apiErr)
+		return w.Code, apiErr
+	}
+
+	status, apiErr := get("/v1/account/abc/transactions", map[string]string{"id": "abc"})
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.Equal(t, []FieldError{{Field: "id", Code: "type", Message: "must be an integer ID", In: "path"}}, apiErr.Fields)
+
+	status, apiErr = get("/v1/account/1/transactions?limit=0", map[string]string{"id": "1"})
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.Equal(t, "VALIDATION_FAILED", apiErr.Code)
+	assert.Equal(t, []FieldError{{Field: "limit", Code: "range", Message: "must be between 1 and 500", In: "query"}}, apiErr.Fields)
+}
+
+// Unknown rules only panic once their field is set, so check every request's tags up front
+func TestRequestValidateTags(t *testing.T) {
+	known := []string{"required", "min", "max", "positive", "numeric", "name", "url", "oneof"}
+	var check func(rt reflect.Type)
+	check = func(rt reflect.Type) {
+		switch rt.Kind() {
+		case reflect.Pointer, reflect.Slice, reflect.Array:
+			check(rt.Elem())
+		case reflect.Struct:
+			for i := 0; i < rt.NumField(); i++ {
+				field := rt.Field(i)
+				for _, rule := range strings.Split(field.Tag.Get("validate"), ",") {
+					if name, _, _ := strings.Cut(rule, "="); name != "" {
+						assert.Contains(t, known, name, "%s.%s", rt.Name(), field.Name)
+					}
+				}
+				if field.Type != reflect.TypeOf(time.Time{}) {
+					check(field.Type)
+				}
+			}
+		}
+	}
+	for _, op := range apiOperations {
+		if op.Request != nil {
+			check(reflect.TypeOf(op.Request))
+		}
+	}
+}
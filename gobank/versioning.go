@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// The API is served under a version prefix, /v1 today. Each version is a
+// routeSet built once and mounted under its prefix; the unprefixed legacy
+// paths alias /v1 and answer with Deprecation headers. A future /v2 can start
+// from v1's set and swap the handlers whose response shapes change:
+//
+//	v2 := v1.with("/v2", func(rs *routeSet) { rs.HandleFunc("/account/{id}", ...).Methods("GET") })
+//	mountVersions(router, s.config, legacy, v1, v2)
+
+const currentAPIVersion = "/v1"
+
+type versionedRoute struct {
+	path    string
+	methods []string
+	handler http.Handler
+}
+
+// Methods restricts the route to methods, like mux.Route.Methods
+func (route *versionedRoute) Methods(methods ...string) *versionedRoute {
+	route.methods = methods
+	return route
+}
+
+func (route *versionedRoute) key() string {
+	return route.path + " " + strings.Join(route.methods, ",")
+}
+
+// routeSet collects one version's routes before they're mounted
+type routeSet struct {
+	prefix string
+	routes []*versionedRoute
+}
+
+func newRouteSet(prefix string) *routeSet {
+	return &routeSet{prefix: prefix}
+}
+
+func (rs *routeSet) HandleFunc(path string, handler http.HandlerFunc) *versionedRoute {
+	return rs.Handle(path, handler)
+}
+
+// Handle adds a route, one for the same path and methods replaces the
+// handler of the route already in the set when it's mounted
+func (rs *routeSet) Handle(path string, handler http.Handler) *versionedRoute {
+	route := &versionedRoute{path: path, handler: handler}
+	rs.routes = append(rs.routes, route)
+	return route
+}
+
+// with copies the set under a new prefix and applies changes to the copy
+func (rs *routeSet) with(prefix string, changes func(*routeSet)) *routeSet {
+	next := &routeSet{prefix: prefix}
+	for _, route := range rs.routes {
+		copied := *route
+		next.routes = append(next.routes, &copied)
+	}
+	changes(next)
+	return next
+}
+
+// mounted are the set's routes in the order they were added, with the
+// handler of the last route added for each path and methods
+func (rs *routeSet) mounted() []*versionedRoute {
+	routes := []*versionedRoute{}
+	index := map[string]int{}
+	for _, route := range rs.routes {
+		if i, ok := index[route.key()]; ok {
+			routes[i] = route
+			continue
+		}
+		index[route.key()] = len(routes)
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// mountVersions serves every version under its prefix, plus legacy's routes
+// at the root with deprecation headers pointing at legacy's prefix
+func mountVersions(router *mux.Router, cfg *Config, legacy *routeSet, versions ...*routeSet) {
+	// Not a PathPrefix subrouter: mux forgets a method mismatch on the next
+	// route sharing the prefix, which would turn 405s into 404s
+	for _, version := range versions {
+		for _, route := range version.mounted() {
+			mountRoute(router, version.prefix+route.path, route.methods, route.handler)
+		}
+	}
+
+	for _, route := range legacy.mounted() {
+		mountRoute(router, route.path, route.methods, withDeprecation(legacy.prefix, cfg.LegacyRoutesSunset, route.handler))
+	}
+}
+
+func mountRoute(router *mux.Router, path string, methods []string, handler http.Handler) {
+	r := router.Handle(path, handler)
+	if len(methods) > 0 {
+		r.Methods(methods...)
+	}
+}
+
+// withDeprecation marks a legacy alias, successor points at the versioned path
+func withDeprecation(successor, sunset string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+r.URL.Path+`>; rel="successor-version"`)
+		if sunset != "" {
+			w.Header().Set("Sunset", sunset)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMountVersions(t *testing.T) {
+	respond := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(body)) }
+	}
+
+	v1 := newRouteSet("/v1")
+	v1.HandleFunc("/account/{id}", respond("v1 account")).Methods("GET")
+	v1.HandleFunc("/account/{id}", respond("v1 close")).Methods("DELETE")
+	v1.HandleFunc("/transfer", respond("v1 transfer"))
+	v2 := v1.with("/v2", func(rs *routeSet) {
+		rs.HandleFunc("/account/{id}", respond("v2 account")).Methods("GET")
+	})
+
+	router := mux.NewRouter()
+	mountVersions(router, &Config{LegacyRoutesSunset: "Wed, 01 Jan 2025 00:00:00 GMT"}, v1, v1, v2)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	w := get("/v1/account/7")
+	assert.Equal(t, "v1 account", w.Body.String())
+	assert.Empty(t, w.Header().Get("Deprecation"))
+
+	assert.Equal(t, "v2 account", get("/v2/account/7").Body.String())
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/v2/account/7", nil))
+	assert.Equal(t, "v1 close", w.Body.String(), "only the GET route was replaced")
+	assert.Equal(t, "v1 transfer", get("/v2/transfer").Body.String())
+
+	w = get("/account/7")
+	assert.Equal(t, "v1 account", w.Body.String())
+	assert.Equal(t, "true", w.Header().Get("Deprecation"))
+	assert.Equal(t, `</v1/account/7>; rel="successor-version"`, w.Header().Get("Link"))
+	assert.Equal(t, "Wed, 01 Jan 2025 00:00:00 GMT", w.Header().Get("Sunset"))
+}
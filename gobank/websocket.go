@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// /ws is a WebSocket gateway onto the account event outbox. The connection
+// is authenticated once, at the upgrade, with x-jwt-token or x-api-key, or
+// ?token= for browsers that can't set headers. Clients then subscribe to the
+// accounts the credentials may read:
+//
+//	{"type": "subscribe", "account_id": 1, "since": 0}
+//	{"type": "unsubscribe", "account_id": 1}
+//
+// and receive {"type": "event", "event": {...}} for every event after since,
+// new events only when since is left out. The server pings every
+// WS_PING_INTERVAL and drops connections that don't pong in time, and drops
+// those whose JWT expires. Subscriptions read the outbox by cursor, so a
+// slow client only holds its readers back: at most WS_SEND_BUFFER messages
+// wait for it, and a write that takes longer than WS_WRITE_TIMEOUT closes
+// the connection. The client reconnects and resubscribes from its cursor.
+
+type WSMessage struct {
+	Type      string        `json:"type"`
+	AccountID int           `json:"account_id,omitempty"`
+	Since     *int64        `json:"since,omitempty"`
+	Cursor    int64         `json:"cursor,omitempty"`
+	Event     *AccountEvent `json:"event,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+var wsUpgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 4096}
+
+// wsCredentials decides which accounts a connection may subscribe to
+type wsCredentials struct {
+	allows  func(ctx context.Context, accountID int) bool
+	expires time.Time // zero when the credentials don't expire
+}
+
+func (s *APIServer) wsAuthenticate(r *http.Request) (*wsCredentials, bool) {
+	if key := requestAPIKey(r, s.store); key != nil && r.Header.Get("x-jwt-token") == "" {
+		return &wsCredentials{allows: func(ctx context.Context, accountID int) bool {
+			return key.allowsAccount(accountID, false)
+		}}, true
+	}
+
+	raw := r.Header.Get("x-jwt-token")
+	if raw == "" {
+		raw = r.URL.Query().Get("token")
+	}
+	token, err := validateJWT(raw)
+	if err != nil || !token.Valid || tokenRevoked(s.revocations, token) {
+		return nil, false
+	}
+	number, ok := jwtAccountNumber(token)
+	if !ok {
+		return nil, false
+	}
+
+	creds := &wsCredentials{allows: func(ctx context.Context, accountID int) bool {
+		account, err := s.store.GetAccountbyID(ctx, accountID)
+		return err == nil && account.Number == number
+	}}
+	if exp, err := token.Claims.GetExpirationTime(); err == nil && exp != nil {
+		creds.expires = exp.Time
+	}
+	return creds, true
+}
+
+type wsConn struct {
+	conn   *websocket.Conn
+	send   chan *WSMessage
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	subs map[int]context.CancelFunc
+}
+
+// GET /ws
+func (s *APIServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	creds, ok := s.wsAuthenticate(r)
+	if !ok {
+		permissionDenied(w, r)
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already answered the client
+		return
+	}
+
+	// The handler runs until the connection closes
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if creds.expires.IsZero() {
+		ctx, cancel = context.WithCancel(r.Context())
+	} else {
+		ctx, cancel = context.WithDeadline(r.Context(), creds.expires)
+	}
+	c := &wsConn{
+		conn:   conn,
+		send:   make(chan *WSMessage, max(s.config.WSSendBuffer, 1)),
+		ctx:    ctx,
+		cancel: cancel,
+		subs:   map[int]context.CancelFunc{},
+	}
+	go c.writeLoop(s.config.WSPingInterval, s.config.WSWriteTimeout)
+	c.readLoop(s.forRequest(r).store, creds, s.config.WSPingInterval)
+}
+
+// readLoop handles subscriptions until the client goes away
+func (c *wsConn) readLoop(store Storage, creds *wsCredentials, pingInterval time.Duration) {
+	defer c.cancel()
+
+	// A pong is due within two ping intervals
+	pongWait := 2 * pingInterval
+	c.conn.SetReadLimit(4096)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		var msg WSMessage
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			return
+		}
+
+		switch msg.Type {
+		case "subscribe":
+			if !creds.allows(c.ctx, msg.AccountID) {
+				c.reply(&WSMessage{Type: "error", AccountID: msg.AccountID, Error: "Permission denied"})
+				continue
+			}
+			c.subscribe(store, msg.AccountID, msg.Since)
+		case "unsubscribe":
+			c.unsubscribe(msg.AccountID)
+			c.reply(&WSMessage{Type: "unsubscribed", AccountID: msg.AccountID})
+		default:
+			c.reply(&WSMessage{Type: "error", Error: fmt.Sprintf("unknown message type %q", msg.Type)})
+		}
+	}
+}
+
+func (c *wsConn) subscribe(store Storage, accountID int, since *int64) {
+	c.mu.Lock()
+	if cancel, ok := c.subs[accountID]; ok {
+		cancel()
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.subs[accountID] = cancel
+	c.mu.Unlock()
+
+	var cursor int64
+	if since != nil {
+		cursor = *since
+	} else {
+		latest, err := store.GetLatestAccountEventID(ctx, accountID)
+		if err != nil {
+			c.reply(&WSMessage{Type: "error", AccountID: accountID, Error: "could not subscribe"})
+			return
+		}
+		cursor = latest
+	}
+
+	c.reply(&WSMessage{Type: "subscribed", AccountID: accountID, Cursor: cursor})
+	go c.feed(ctx, store, accountID, cursor)
+}
+
+func (c *wsConn) unsubscribe(accountID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cancel, ok := c.subs[accountID]; ok {
+		cancel()
+		delete(c.subs, accountID)
+	}
+}
+
+// feed follows the account's outbox, blocking while the send buffer is full
+func (c *wsConn) feed(ctx context.Context, store Storage, accountID int, cursor int64) {
+	for {
+		events, err := nextEvents(ctx, store, accountID, cursor, eventPollLimit, 30*time.Second)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("WebSocket feed of account %d failed: %v", accountID, err)
+				c.cancel()
+			}
+			return
+		}
+		for _, event := range events {
+			select {
+			case c.send <- &WSMessage{Type: "event", AccountID: accountID, Event: event}:
+				cursor = event.ID
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// reply queues a control message, it waits behind events like they wait for the client
+func (c *wsConn) reply(msg *WSMessage) {
+	select {
+	case c.send <- msg:
+	case <-c.ctx.Done():
+	}
+}
+
+// writeLoop is the connection's only writer
+func (c *wsConn) writeLoop(pingInterval, writeTimeout time.Duration) {
+	ping := time.NewTicker(pingInterval)
+	defer func() {
+		ping.Stop()
+		c.cancel()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				return
+			}
+		case <-c.ctx.Done():
+			closing := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+			if c.ctx.Err() == context.DeadlineExceeded {
+				closing = websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "token expired")
+			}
+			c.conn.WriteControl(websocket.CloseMessage, closing, time.Now().Add(writeTimeout))
+			return
+		}
+	}
+}
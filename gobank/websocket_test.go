@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebSocketFeed(t *testing.T) {
+	t.Setenv("JWT_SECRET", "ws-secret")
+	ctx := context.Background()
+	store := newMemoryStorage()
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9211, Balance: 10000, Currency: "USD"}))
+	require.Nil(t, store.CreateAccount(ctx, &Account{Number: 9212, Balance: 5000, Currency: "USD"}))
+	engine, _ := NewTransferEngine("balance", store, &Config{})
+
+	s := NewAPIServer(&Config{WSPingInterval: 50 * time.Millisecond, WSWriteTimeout: time.Second, WSSendBuffer: 4}, store)
+	router := mux.NewRouter()
+	router.Use(withTracing)
+	router.HandleFunc("/v1/ws", s.handleWebSocket)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/ws"
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NotNil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "the upgrade needs credentials")
+
+	token, err := createJWT(&Account{Number: 9212})
+	require.Nil(t, err)
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"x-jwt-token": {token}})
+	require.Nil(t, err)
+	defer conn.Close()
+	pings := 0
+	conn.SetPingHandler(func(string) error {
+		pings++
+		return conn.WriteControl(websocket.PongMessage, nil, time.Now().Add(time.Second))
+	})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var msg WSMessage
+	require.Nil(t, conn.WriteJSON(WSMessage{Type: "subscribe", AccountID: 1}))
+	require.Nil(t, conn.ReadJSON(&msg))
+	assert.Equal(t, WSMessage{Type: "error", AccountID: 1, Error: "Permission denied"}, msg, "another customer's account")
+
+	require.Nil(t, conn.WriteJSON(WSMessage{Type: "subscribe", AccountID: 2}))
+	msg = WSMessage{}
+	require.Nil(t, conn.ReadJSON(&msg))
+	assert.Equal(t, WSMessage{Type: "subscribed", AccountID: 2}, msg)
+
+	// Events arrive as they're recorded, the connection stays up across pings
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		s.transfers().Transfer(ctx, TransferRequest{FromAccountNumber: 9211, ToAccountNumber: 9212, Amount: 10}, engine, "test")
+	}()
+	msg = WSMessage{}
+	require.Nil(t, conn.ReadJSON(&msg))
+	assert.Equal(t, "event", msg.Type)
+	require.NotNil(t, msg.Event)
+	assert.Equal(t, int64(2), msg.Event.ID, "the sender's debit is id 1")
+	assert.Equal(t, 2, msg.Event.AccountID)
+	assert.Greater(t, pings, 0)
+
+	// A resubscription replays from since
+	since := int64(0)
+	require.Nil(t, conn.WriteJSON(WSMessage{Type: "subscribe", AccountID: 2, Since: &since}))
+	msg = WSMessage{}
+	require.Nil(t, conn.ReadJSON(&msg))
+	assert.Equal(t, "subscribed", msg.Type)
+	msg = WSMessage{}
+	require.Nil(t, conn.ReadJSON(&msg))
+	require.NotNil(t, msg.Event)
+	assert.Equal(t, int64(2), msg.Event.ID)
+
+	require.Nil(t, conn.WriteJSON(WSMessage{Type: "unsubscribe", AccountID: 2}))
+	msg = WSMessage{}
+	require.Nil(t, conn.ReadJSON(&msg))
+	assert.Equal(t, WSMessage{Type: "unsubscribed", AccountID: 2}, msg)
+}